@@ -62,6 +62,9 @@ type TiKVClient struct {
 	GrpcKeepAliveTimeout uint `toml:"grpc-keepalive-timeout" json:"grpc-keepalive-timeout"`
 	// GrpcCompressionType is the compression type for gRPC channel: none or gzip.
 	GrpcCompressionType string `toml:"grpc-compression-type" json:"grpc-compression-type"`
+	// GrpcCompressionThreshold is the size in bytes above which prewrite and commit requests are compressed by gzip,
+	// regardless of GrpcCompressionType. 0 means such requests aren't compressed individually.
+	GrpcCompressionThreshold uint `toml:"grpc-compression-threshold" json:"grpc-compression-threshold"`
 	// CommitTimeout is the max time which command 'commit' will wait.
 	CommitTimeout string      `toml:"commit-timeout" json:"commit-timeout"`
 	AsyncCommit   AsyncCommit `toml:"async-commit" json:"async-commit"`
@@ -87,6 +90,15 @@ type TiKVClient struct {
 	// TTLRefreshedTxnSize controls whether a transaction should update its TTL or not.
 	TTLRefreshedTxnSize      int64  `toml:"ttl-refreshed-txn-size" json:"ttl-refreshed-txn-size"`
 	ResolveLockLiteThreshold uint64 `toml:"resolve-lock-lite-threshold" json:"resolve-lock-lite-threshold"`
+	// PrewriteMaxAttempts is the max number of attempts to prewrite a batch of mutations, including the retries
+	// after resolving locks. 0 means unlimited, and only the backoff budget limits the retries.
+	PrewriteMaxAttempts uint `toml:"prewrite-max-attempts" json:"prewrite-max-attempts"`
+	// RoutingLabelKeys are the keys of the store labels that matter for routing requests. A store is replaced in the
+	// region cache only if its address or these labels change, other labels are updated in place.
+	RoutingLabelKeys []string `toml:"routing-label-keys" json:"routing-label-keys"`
+	// BackgroundResolveLockRate limits the number of locks resolved per second in the background, e.g. by GC.
+	// 0 means unlimited. Resolving locks met by reads and writes isn't limited.
+	BackgroundResolveLockRate uint `toml:"background-resolve-lock-rate" json:"background-resolve-lock-rate"`
 }
 
 // AsyncCommit is the config for the async commit feature. The switch to enable it is a system variable.
@@ -154,7 +166,10 @@ func DefaultTiKVClient() TiKVClient {
 			AdmissionMinProcessMs: 5,
 		},
 
-		ResolveLockLiteThreshold: 16,
+		ResolveLockLiteThreshold:  16,
+		PrewriteMaxAttempts:       0,
+		RoutingLabelKeys:          []string{"zone", "region", "host", "engine"},
+		BackgroundResolveLockRate: 0,
 	}
 }
 
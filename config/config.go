@@ -78,6 +78,9 @@ type Config struct {
 	TxnScope              string
 	EnableAsyncCommit     bool
 	Enable1PC             bool
+	// DisableBucketFeature makes the client ignore region buckets entirely, for clusters
+	// that can't handle bucket related fields.
+	DisableBucketFeature bool
 }
 
 // DefaultConfig returns the default configuration.
@@ -95,6 +98,7 @@ func DefaultConfig() Config {
 		TxnScope:              "",
 		EnableAsyncCommit:     false,
 		Enable1PC:             false,
+		DisableBucketFeature:  false,
 	}
 }
 
@@ -0,0 +1,118 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package error
+
+import (
+	"context"
+
+	"github.com/pkg/errors"
+)
+
+// ErrorClass tells how the caller should handle an error.
+type ErrorClass int
+
+const (
+	// NotRetryable means the operation fails and retrying it doesn't help.
+	NotRetryable ErrorClass = iota
+	// RetryableTxn means the transaction fails without being committed, it can be retried from the beginning with a
+	// new start ts.
+	RetryableTxn
+	// RetryableStmt means the statement fails for a transient reason, e.g. timeout, it can be retried in the same
+	// transaction.
+	RetryableStmt
+	// Undetermined means the transaction may or may not be committed, so it must not be retried blindly.
+	Undetermined
+)
+
+func (c ErrorClass) String() string {
+	switch c {
+	case NotRetryable:
+		return "NotRetryable"
+	case RetryableTxn:
+		return "RetryableTxn"
+	case RetryableStmt:
+		return "RetryableStmt"
+	case Undetermined:
+		return "Undetermined"
+	default:
+		return "Unknown"
+	}
+}
+
+// Classify returns the class of the error, looking through the wrapping errors. It returns NotRetryable for nil and
+// the errors that aren't known to be retryable.
+func Classify(err error) ErrorClass {
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		if class, ok := classify(e); ok {
+			return class
+		}
+	}
+	return NotRetryable
+}
+
+// IsRetryableTxnError returns true if the transaction can be retried from the beginning after err.
+func IsRetryableTxnError(err error) bool {
+	return Classify(err) == RetryableTxn
+}
+
+// IsRetryableStmtError returns true if the statement can be retried in the same transaction after err.
+func IsRetryableStmtError(err error) bool {
+	return Classify(err) == RetryableStmt
+}
+
+func classify(err error) (ErrorClass, bool) {
+	switch err {
+	case ErrResultUndetermined:
+		return Undetermined, true
+	case ErrTiKVServerTimeout, ErrTiFlashServerTimeout, ErrTiKVServerBusy, ErrTiFlashServerBusy, ErrTiKVStaleCommand,
+		ErrTiKVMaxTimestampNotSynced, ErrResolveLockTimeout, ErrRegionUnavailable, ErrRegionDataNotReady,
+		ErrRegionNotInitialized:
+		return RetryableStmt, true
+	case ErrTiKVDiskFull:
+		// The disk isn't freed by retrying, it's up to the user to add capacity or delete data.
+		return NotRetryable, true
+	case ErrBodyMissing, ErrTiDBShuttingDown, ErrNotExist, ErrCannotSetNilValue, ErrInvalidTxn, ErrQueryInterrupted,
+		ErrLockAcquireFailAndNoWaitSet, ErrLockWaitTimeout, ErrUnknown, ErrClientClosed:
+		return NotRetryable, true
+	}
+	switch e := err.(type) {
+	case *ErrWriteConflict, *ErrWriteConflictInLatch, *ErrRetryable, *ErrGCTooEarly, *ErrPrewriteTooManyAttempts,
+		*ErrTxnAborted, *ErrCommitTSTooLarge, *ErrTxnNotFound, *ErrMinCommitTSTooLarge:
+		return RetryableTxn, true
+	case *ErrPDServerTimeout, *ErrTokenLimit, *ErrNoAvailablePeers, *ErrNoAvailableTiFlash, *ErrResolveLocksFailed:
+		return RetryableStmt, true
+	case *ErrSendRequest:
+		// Transport errors are transient, unless the request is cancelled or the original error tells otherwise.
+		if errors.Cause(e.Err) == context.Canceled {
+			return NotRetryable, true
+		}
+		for inner := e.Err; inner != nil; inner = errors.Unwrap(inner) {
+			if class, ok := classify(inner); ok {
+				return class, true
+			}
+		}
+		return RetryableStmt, true
+	case *ErrDeadlock:
+		// A retryable deadlock is detected by the lock waiter, which can retry the statement with a new for update ts.
+		if e.IsRetryable {
+			return RetryableStmt, true
+		}
+		return NotRetryable, true
+	case *ErrKeyExist, *ErrAssertionFailed, *ErrTxnTooLarge, *ErrEntryTooLarge, *ErrPartialScan, *PDError,
+		*ErrRPCMessageTooLarge, *ErrInvalidOnePCFallback, *ErrUnexpectedKeyErr, *ErrLockResolveProtocol:
+		return NotRetryable, true
+	}
+	return NotRetryable, false
+}
@@ -0,0 +1,159 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package error
+
+import (
+	"context"
+	"go/ast"
+	"go/parser"
+	"go/token"
+	"io/fs"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestClassify(t *testing.T) {
+	// The table covers all the exported errors of the package, an error added without being classified fails
+	// TestClassifyAllErrors.
+	cases := map[string]struct {
+		err   error
+		class ErrorClass
+	}{
+		"ErrBodyMissing":                 {ErrBodyMissing, NotRetryable},
+		"ErrTiDBShuttingDown":            {ErrTiDBShuttingDown, NotRetryable},
+		"ErrNotExist":                    {ErrNotExist, NotRetryable},
+		"ErrCannotSetNilValue":           {ErrCannotSetNilValue, NotRetryable},
+		"ErrInvalidTxn":                  {ErrInvalidTxn, NotRetryable},
+		"ErrTiKVServerTimeout":           {ErrTiKVServerTimeout, RetryableStmt},
+		"ErrTiFlashServerTimeout":        {ErrTiFlashServerTimeout, RetryableStmt},
+		"ErrQueryInterrupted":            {ErrQueryInterrupted, NotRetryable},
+		"ErrTiKVStaleCommand":            {ErrTiKVStaleCommand, RetryableStmt},
+		"ErrTiKVMaxTimestampNotSynced":   {ErrTiKVMaxTimestampNotSynced, RetryableStmt},
+		"ErrLockAcquireFailAndNoWaitSet": {ErrLockAcquireFailAndNoWaitSet, NotRetryable},
+		"ErrResolveLockTimeout":          {ErrResolveLockTimeout, RetryableStmt},
+		"ErrLockWaitTimeout":             {ErrLockWaitTimeout, NotRetryable},
+		"ErrTiKVServerBusy":              {ErrTiKVServerBusy, RetryableStmt},
+		"ErrTiFlashServerBusy":           {ErrTiFlashServerBusy, RetryableStmt},
+		"ErrRegionUnavailable":           {ErrRegionUnavailable, RetryableStmt},
+		"ErrRegionDataNotReady":          {ErrRegionDataNotReady, RetryableStmt},
+		"ErrRegionNotInitialized":        {ErrRegionNotInitialized, RetryableStmt},
+		"ErrTiKVDiskFull":                {ErrTiKVDiskFull, NotRetryable},
+		"ErrUnknown":                     {ErrUnknown, NotRetryable},
+		"ErrResultUndetermined":          {ErrResultUndetermined, Undetermined},
+		"ErrClientClosed":                {ErrClientClosed, NotRetryable},
+		"ErrDeadlock":                    {&ErrDeadlock{Deadlock: &kvrpcpb.Deadlock{}}, NotRetryable},
+		"PDError":                        {&PDError{}, NotRetryable},
+		"ErrKeyExist":                    {&ErrKeyExist{AlreadyExist: &kvrpcpb.AlreadyExist{}}, NotRetryable},
+		"ErrWriteConflict":               {&ErrWriteConflict{WriteConflict: &kvrpcpb.WriteConflict{}}, RetryableTxn},
+		"ErrWriteConflictInLatch":        {&ErrWriteConflictInLatch{}, RetryableTxn},
+		"ErrRetryable":                   {&ErrRetryable{}, RetryableTxn},
+		"ErrTxnTooLarge":                 {&ErrTxnTooLarge{}, NotRetryable},
+		"ErrEntryTooLarge":               {&ErrEntryTooLarge{}, NotRetryable},
+		"ErrPartialScan":                 {&ErrPartialScan{}, NotRetryable},
+		"ErrPDServerTimeout":             {NewErrPDServerTimeout(""), RetryableStmt},
+		"ErrGCTooEarly":                  {&ErrGCTooEarly{}, RetryableTxn},
+		"ErrTokenLimit":                  {&ErrTokenLimit{}, RetryableStmt},
+		"ErrRPCMessageTooLarge":          {&ErrRPCMessageTooLarge{}, NotRetryable},
+		"ErrPrewriteTooManyAttempts":     {&ErrPrewriteTooManyAttempts{}, RetryableTxn},
+		"ErrNoAvailablePeers":            {&ErrNoAvailablePeers{}, RetryableStmt},
+		"ErrNoAvailableTiFlash":          {&ErrNoAvailableTiFlash{}, RetryableStmt},
+		"ErrAssertionFailed":             {&ErrAssertionFailed{AssertionFailed: &kvrpcpb.AssertionFailed{}}, NotRetryable},
+		"ErrTxnAborted":                  {&ErrTxnAborted{}, RetryableTxn},
+		"ErrCommitTSTooLarge":            {&ErrCommitTSTooLarge{}, RetryableTxn},
+		"ErrTxnNotFound":                 {&ErrTxnNotFound{}, RetryableTxn},
+		"ErrMinCommitTSTooLarge":         {&ErrMinCommitTSTooLarge{}, RetryableTxn},
+		"ErrInvalidOnePCFallback":        {&ErrInvalidOnePCFallback{}, NotRetryable},
+		"ErrUnexpectedKeyErr":            {&ErrUnexpectedKeyErr{KeyErr: &kvrpcpb.KeyError{}}, NotRetryable},
+		"ErrLockResolveProtocol":         {&ErrLockResolveProtocol{}, NotRetryable},
+		"ErrResolveLocksFailed":          {&ErrResolveLocksFailed{}, RetryableStmt},
+		"ErrSendRequest":                 {&ErrSendRequest{Err: errors.New("connection refused")}, RetryableStmt},
+	}
+
+	names := exportedErrors(t)
+	tableNames := make([]string, 0, len(cases))
+	for name, c := range cases {
+		tableNames = append(tableNames, name)
+		_, known := classify(c.err)
+		assert.True(t, known, name)
+		assert.Equal(t, c.class, Classify(c.err), name)
+		// The class is kept when the error is wrapped.
+		assert.Equal(t, c.class, Classify(errors.WithMessage(errors.WithStack(c.err), "wrapped")), name)
+	}
+	sort.Strings(tableNames)
+	assert.Equal(t, names, tableNames, "all the exported errors should be classified")
+
+	assert.Equal(t, RetryableStmt, Classify(&ErrDeadlock{Deadlock: &kvrpcpb.Deadlock{}, IsRetryable: true}))
+	assert.Equal(t, NotRetryable, Classify(nil))
+	assert.Equal(t, NotRetryable, Classify(errors.New("unknown")))
+	assert.True(t, IsRetryableTxnError(errors.WithStack(&ErrWriteConflict{WriteConflict: &kvrpcpb.WriteConflict{}})))
+	assert.False(t, IsRetryableTxnError(ErrTiKVServerTimeout))
+	assert.True(t, IsRetryableStmtError(ErrTiKVServerTimeout))
+	assert.True(t, IsErrorUndetermined(ErrResultUndetermined))
+	assert.Equal(t, NotRetryable, Classify(&ErrSendRequest{Err: errors.WithStack(context.Canceled)}))
+	assert.Equal(t, NotRetryable, Classify(&ErrSendRequest{Err: &ErrRPCMessageTooLarge{}}))
+
+	// The errors extracted from the key errors are typed.
+	assert.Equal(t, RetryableTxn, Classify(ExtractKeyErr(&kvrpcpb.KeyError{Abort: "abort"})))
+	assert.Equal(t, RetryableTxn, Classify(ExtractKeyErr(&kvrpcpb.KeyError{TxnNotFound: &kvrpcpb.TxnNotFound{StartTs: 1}})))
+	assert.Equal(t, RetryableTxn, Classify(ExtractKeyErr(&kvrpcpb.KeyError{CommitTsTooLarge: &kvrpcpb.CommitTsTooLarge{CommitTs: 1}})))
+}
+
+// exportedErrors returns the names of the exported error variables and error types declared in the package.
+func exportedErrors(t *testing.T) []string {
+	fset := token.NewFileSet()
+	pkgs, err := parser.ParseDir(fset, ".", func(info fs.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go")
+	}, 0)
+	require.Nil(t, err)
+	var names []string
+	for _, pkg := range pkgs {
+		for _, file := range pkg.Files {
+			for _, decl := range file.Decls {
+				switch d := decl.(type) {
+				case *ast.GenDecl:
+					if d.Tok != token.VAR {
+						continue
+					}
+					for _, spec := range d.Specs {
+						for _, name := range spec.(*ast.ValueSpec).Names {
+							if name.IsExported() && strings.HasPrefix(name.Name, "Err") {
+								names = append(names, name.Name)
+							}
+						}
+					}
+				case *ast.FuncDecl:
+					if d.Name.Name != "Error" || d.Recv == nil || len(d.Recv.List) != 1 {
+						continue
+					}
+					recv := d.Recv.List[0].Type
+					if star, ok := recv.(*ast.StarExpr); ok {
+						recv = star.X
+					}
+					if ident, ok := recv.(*ast.Ident); ok && ident.IsExported() {
+						names = append(names, ident.Name)
+					}
+				}
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
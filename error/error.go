@@ -90,6 +90,8 @@ var (
 	ErrUnknown = errors.New("unknow")
 	// ErrResultUndetermined is the error when execution result is unknown.
 	ErrResultUndetermined = errors.New("execution result undetermined")
+	// ErrClientClosed is the error when the client or the region cache is used after it's closed.
+	ErrClientClosed = errors.New("client is closed")
 )
 
 // MismatchClusterID represents the message that the cluster ID of the PD client does not match the PD.
@@ -198,6 +200,16 @@ func (e *ErrEntryTooLarge) Error() string {
 	return fmt.Sprintf("entry size too large, size: %v,limit: %v.", e.Size, e.Limit)
 }
 
+// ErrPartialScan is the error reported by a scanner which skips some failed ranges, whose handling is decided by the
+// partial result handler of the snapshot.
+type ErrPartialScan struct {
+	SkippedRanges int
+}
+
+func (e *ErrPartialScan) Error() string {
+	return fmt.Sprintf("scan skipped %d failed ranges", e.SkippedRanges)
+}
+
 // ErrPDServerTimeout is the error when pd server is timeout.
 type ErrPDServerTimeout struct {
 	msg string
@@ -231,6 +243,98 @@ func (e *ErrTokenLimit) Error() string {
 	return fmt.Sprintf("Store token is up to the limit, store id = %d.", e.StoreID)
 }
 
+// ErrRPCMessageTooLarge is the error that a request or its response exceeds the gRPC message size limit.
+type ErrRPCMessageTooLarge struct {
+	Err error
+}
+
+func (e *ErrRPCMessageTooLarge) Error() string {
+	return fmt.Sprintf("rpc message too large: %v", e.Err)
+}
+
+// IsErrRPCMessageTooLarge returns true if it is ErrRPCMessageTooLarge.
+func IsErrRPCMessageTooLarge(err error) bool {
+	var e *ErrRPCMessageTooLarge
+	return errors.As(err, &e)
+}
+
+// ErrPrewriteTooManyAttempts is the error that prewriting a batch of mutations exceeds the max attempts.
+type ErrPrewriteTooManyAttempts struct {
+	Attempts int
+}
+
+func (e *ErrPrewriteTooManyAttempts) Error() string {
+	return fmt.Sprintf("prewrite too many retries, attempts: %d", e.Attempts)
+}
+
+// ErrNoAvailablePeers is the error that a region has no available peers, e.g. all of its peers are down or on
+// tombstone stores.
+type ErrNoAvailablePeers struct {
+	RegionID uint64
+}
+
+func (e *ErrNoAvailablePeers) Error() string {
+	return fmt.Sprintf("no available peers, region: %d", e.RegionID)
+}
+
+// IsErrNoAvailablePeers returns true if it is ErrNoAvailablePeers.
+func IsErrNoAvailablePeers(err error) bool {
+	var e *ErrNoAvailablePeers
+	return errors.As(err, &e)
+}
+
+// ErrNoAvailableTiFlash is the error that a region has no valid TiFlash peer, e.g. all of its TiFlash stores are
+// down, while the region itself may still be valid. The request can be sent to TiKV instead.
+type ErrNoAvailableTiFlash struct {
+	RegionID uint64
+}
+
+func (e *ErrNoAvailableTiFlash) Error() string {
+	return fmt.Sprintf("no available tiflash peers, region: %d", e.RegionID)
+}
+
+// IsErrNoAvailableTiFlash returns true if it is ErrNoAvailableTiFlash.
+func IsErrNoAvailableTiFlash(err error) bool {
+	var e *ErrNoAvailableTiFlash
+	return errors.As(err, &e)
+}
+
+// ErrSendRequest is the transport error of sending a request to a store, with the context of the request. The
+// original error, e.g. a gRPC status error, can be got by errors.Cause or errors.Unwrap.
+type ErrSendRequest struct {
+	Err     error
+	ReqType string
+	// Addr is the address of the target store. ProxyAddr is the address of the store forwarding the request, it's
+	// empty if the request isn't forwarded.
+	Addr          string
+	ProxyAddr     string
+	StoreID       uint64
+	RegionID      uint64
+	RegionConfVer uint64
+	RegionVer     uint64
+	// Attempt is the number of the attempt that fails, starting from 1.
+	Attempt int
+}
+
+func (e *ErrSendRequest) Error() string {
+	via := ""
+	if e.ProxyAddr != "" {
+		via = fmt.Sprintf(" via %s", e.ProxyAddr)
+	}
+	return fmt.Sprintf("send %s request to store %d at %s%s failed, region: {%d %d %d}, attempt: %d: %v",
+		e.ReqType, e.StoreID, e.Addr, via, e.RegionID, e.RegionConfVer, e.RegionVer, e.Attempt, e.Err)
+}
+
+// Cause returns the original error for errors.Cause.
+func (e *ErrSendRequest) Cause() error {
+	return e.Err
+}
+
+// Unwrap returns the original error for errors.Is and errors.As.
+func (e *ErrSendRequest) Unwrap() error {
+	return e.Err
+}
+
 // ErrAssertionFailed is the error that assertion on data failed.
 type ErrAssertionFailed struct {
 	*kvrpcpb.AssertionFailed
@@ -240,6 +344,82 @@ func (e *ErrAssertionFailed) Error() string {
 	return fmt.Sprintf("assertion failed { %s }", e.AssertionFailed.String())
 }
 
+// ErrTxnAborted is the error that TiKV aborts the transaction.
+type ErrTxnAborted struct {
+	Reason string
+}
+
+func (e *ErrTxnAborted) Error() string {
+	return fmt.Sprintf("tikv aborts txn: %s", e.Reason)
+}
+
+// ErrCommitTSTooLarge is the error that the commit ts is larger than TiKV allows.
+type ErrCommitTSTooLarge struct {
+	CommitTS uint64
+}
+
+func (e *ErrCommitTSTooLarge) Error() string {
+	return fmt.Sprintf("commit TS %v is too large", e.CommitTS)
+}
+
+// ErrTxnNotFound is the error that the transaction to operate on is not found, e.g. it's rolled back.
+type ErrTxnNotFound struct {
+	StartTS uint64
+}
+
+func (e *ErrTxnNotFound) Error() string {
+	return fmt.Sprintf("txn %d not found", e.StartTS)
+}
+
+// ErrMinCommitTSTooLarge is the error that the min commit ts of the primary lock is pushed too far to commit.
+type ErrMinCommitTSTooLarge struct {
+	MinCommitTS       uint64
+	AttemptedCommitTS uint64
+}
+
+func (e *ErrMinCommitTSTooLarge) Error() string {
+	return fmt.Sprintf("2PC MinCommitTS is too large, we got MinCommitTS: %d, and AttemptedCommitTS: %d", e.MinCommitTS, e.AttemptedCommitTS)
+}
+
+// ErrInvalidOnePCFallback is the error that TiKV returns a min commit ts when 1PC falls back to 2PC, which breaks
+// the protocol.
+type ErrInvalidOnePCFallback struct {
+	MinCommitTS uint64
+}
+
+func (e *ErrInvalidOnePCFallback) Error() string {
+	return fmt.Sprintf("MinCommitTs must be 0 when 1pc falls back to 2pc, got %d", e.MinCommitTS)
+}
+
+// ErrUnexpectedKeyErr is the error that TiKV returns a key error which the request doesn't expect, e.g., a key error
+// other than TxnNotFound of checking the status of a transaction.
+type ErrUnexpectedKeyErr struct {
+	KeyErr *kvrpcpb.KeyError
+}
+
+func (e *ErrUnexpectedKeyErr) Error() string {
+	return fmt.Sprintf("unexpected key error: %s", e.KeyErr)
+}
+
+// ErrLockResolveProtocol is the error that the result of resolving locks breaks the protocol, e.g., the commit ts of
+// an async commit transaction is inconsistent among its keys.
+type ErrLockResolveProtocol struct {
+	Reason string
+}
+
+func (e *ErrLockResolveProtocol) Error() string {
+	return fmt.Sprintf("resolving locks breaks the protocol: %s", e.Reason)
+}
+
+// ErrResolveLocksFailed is the error that some requests of resolving the locks of a transaction fail.
+type ErrResolveLocksFailed struct {
+	Errs []string
+}
+
+func (e *ErrResolveLocksFailed) Error() string {
+	return fmt.Sprintf("resolving locks finished with errors: %v", e.Errs)
+}
+
 // ExtractKeyErr extracts a KeyError.
 func ExtractKeyErr(keyErr *kvrpcpb.KeyError) error {
 	if val, err := util.EvalFailpoint("mockRetryableErrorResp"); err == nil {
@@ -262,18 +442,17 @@ func ExtractKeyErr(keyErr *kvrpcpb.KeyError) error {
 	}
 
 	if keyErr.Abort != "" {
-		err := errors.Errorf("tikv aborts txn: %s", keyErr.GetAbort())
+		err := errors.WithStack(&ErrTxnAborted{Reason: keyErr.GetAbort()})
 		logutil.BgLogger().Warn("2PC failed", zap.Error(err))
 		return err
 	}
 	if keyErr.CommitTsTooLarge != nil {
-		err := errors.Errorf("commit TS %v is too large", keyErr.CommitTsTooLarge.CommitTs)
+		err := errors.WithStack(&ErrCommitTSTooLarge{CommitTS: keyErr.CommitTsTooLarge.CommitTs})
 		logutil.BgLogger().Warn("2PC failed", zap.Error(err))
 		return err
 	}
 	if keyErr.TxnNotFound != nil {
-		err := errors.Errorf("txn %d not found", keyErr.TxnNotFound.StartTs)
-		return err
+		return errors.WithStack(&ErrTxnNotFound{StartTS: keyErr.TxnNotFound.StartTs})
 	}
 	return errors.Errorf("unexpected KeyError: %s", keyErr.String())
 }
@@ -36,12 +36,16 @@ package tikv_test
 
 import (
 	"context"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/suite"
 	"github.com/tikv/client-go/v2/metrics"
 	"github.com/tikv/client-go/v2/oracle"
 	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/util"
 )
 
 func TestOnePC(t *testing.T) {
@@ -306,3 +310,56 @@ func (s *testOnePCSuite) TestTxnCommitCounter() {
 	s.Equal(diff.AsyncCommit, int64(1))
 	s.Equal(diff.OnePC, int64(1))
 }
+
+// prewriteCaptureClient captures the protocol flags of the last prewrite request.
+type prewriteCaptureClient struct {
+	tikv.Client
+	mu             sync.Mutex
+	useAsyncCommit bool
+	tryOnePC       bool
+}
+
+func (c *prewriteCaptureClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+	if req.Type == tikvrpc.CmdPrewrite {
+		c.mu.Lock()
+		c.useAsyncCommit = req.Prewrite().GetUseAsyncCommit()
+		c.tryOnePC = req.Prewrite().GetTryOnePc()
+		c.mu.Unlock()
+	}
+	return c.Client.SendRequest(ctx, addr, req, timeout)
+}
+
+func (s *testOnePCSuite) TestDisableAsyncCommitAnd1PC() {
+	client := &prewriteCaptureClient{Client: s.store.GetTiKVClient()}
+	s.store.SetTiKVClient(client)
+
+	k := []byte("k")
+	testCases := []struct {
+		disableAsyncCommit bool
+		disable1PC         bool
+		protocol           string
+	}{
+		{false, false, util.CommitProtocol1PC},
+		{false, true, util.CommitProtocolAsyncCommit},
+		{true, false, util.CommitProtocol1PC},
+		{true, true, util.CommitProtocol2PC},
+	}
+	for _, tc := range testCases {
+		txn := s.begin1PC()
+		txn.SetEnableAsyncCommit(true)
+		s.Nil(txn.Set(k, []byte(tc.protocol)))
+		// The options take effect even if they are set after the transaction starts.
+		txn.SetDisableAsyncCommit(tc.disableAsyncCommit)
+		txn.SetDisable1PC(tc.disable1PC)
+		var commitDetail *util.CommitDetails
+		ctx := context.WithValue(context.Background(), util.CommitDetailCtxKey, &commitDetail)
+		s.Nil(txn.Commit(ctx))
+
+		client.mu.Lock()
+		s.Equal(!tc.disableAsyncCommit, client.useAsyncCommit)
+		s.Equal(!tc.disable1PC, client.tryOnePC)
+		client.mu.Unlock()
+		s.Equal(tc.protocol, commitDetail.CommitProtocol)
+		s.mustPointGet(k, []byte(tc.protocol))
+	}
+}
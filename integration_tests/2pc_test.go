@@ -59,9 +59,11 @@ import (
 	"github.com/tikv/client-go/v2/testutils"
 	"github.com/tikv/client-go/v2/tikv"
 	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/tikvrpc/interceptor"
 	"github.com/tikv/client-go/v2/txnkv"
 	"github.com/tikv/client-go/v2/txnkv/transaction"
 	"github.com/tikv/client-go/v2/txnkv/txnlock"
+	"github.com/tikv/client-go/v2/util"
 )
 
 var (
@@ -353,12 +355,7 @@ func (s *testCommitterSuite) TestContextCancelCausingUndetermined() {
 	committer.PrewriteAllMutations(context.Background())
 	s.Nil(err)
 
-	s.Nil(failpoint.Enable("tikvclient/rpcContextCancelErr", `return(true)`))
-	defer func() {
-		s.Nil(failpoint.Disable("tikvclient/rpcContextCancelErr"))
-	}()
-
-	err = committer.CommitMutations(context.Background())
+	err = committer.CommitMutations(withCanceledRPCs(context.Background()))
 	s.NotNil(committer.GetUndeterminedErr())
 	s.Equal(errors.Cause(err), context.Canceled)
 }
@@ -456,6 +453,78 @@ func (s *testCommitterSuite) errMsgMustContain(err error, msg string) {
 	s.Contains(err.Error(), msg)
 }
 
+// compressorClient records the compressors of the prewrite and commit requests.
+type compressorClient struct {
+	tikv.Client
+	mu          sync.Mutex
+	compressors map[tikvrpc.CmdType][]string
+}
+
+func (c *compressorClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+	if req.Type == tikvrpc.CmdPrewrite || req.Type == tikvrpc.CmdCommit {
+		c.mu.Lock()
+		c.compressors[req.Type] = append(c.compressors[req.Type], req.UseCompressor)
+		c.mu.Unlock()
+	}
+	return c.Client.SendRequest(ctx, addr, req, timeout)
+}
+
+func (c *compressorClient) take() map[tikvrpc.CmdType][]string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	compressors := c.compressors
+	c.compressors = make(map[tikvrpc.CmdType][]string)
+	return compressors
+}
+
+func (s *testCommitterSuite) TestCompressLargeRequests() {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	s.Require().Nil(err)
+	testutils.BootstrapWithMultiRegions(cluster, []byte("b"))
+	compressorClient := &compressorClient{Client: client, compressors: make(map[tikvrpc.CmdType][]string)}
+	store, err := tikv.NewTestTiKVStore(compressorClient, pdClient, nil, nil, 0)
+	s.Require().Nil(err)
+	defer store.Close()
+
+	commit := func(largeKey, smallKey string) {
+		txn, err := store.Begin()
+		s.Require().Nil(err)
+		s.Nil(txn.Set([]byte(largeKey), bytes.Repeat([]byte("v"), 4096)))
+		s.Nil(txn.Set([]byte(smallKey), []byte("v")))
+		s.Nil(txn.Commit(context.Background()))
+	}
+
+	// Requests aren't compressed by default.
+	commit("a1", "c1")
+	compressors := compressorClient.take()
+	s.Equal([]string{"", ""}, compressors[tikvrpc.CmdPrewrite])
+	s.NotEmpty(compressors[tikvrpc.CmdCommit])
+	for _, compressor := range compressors[tikvrpc.CmdCommit] {
+		s.Empty(compressor)
+	}
+
+	// Only the prewrite request of the large value exceeds the threshold.
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.GrpcCompressionThreshold = 1024
+	})()
+	commit("a2", "c2")
+	compressors = compressorClient.take()
+	s.ElementsMatch([]string{"gzip", ""}, compressors[tikvrpc.CmdPrewrite])
+	s.NotEmpty(compressors[tikvrpc.CmdCommit])
+	for _, compressor := range compressors[tikvrpc.CmdCommit] {
+		s.Empty(compressor)
+	}
+
+	// Commit requests are compressed if they have many keys.
+	config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.GrpcCompressionThreshold = 16
+	})
+	commit("a3", "a4")
+	compressors = compressorClient.take()
+	s.Equal([]string{"gzip"}, compressors[tikvrpc.CmdPrewrite])
+	s.Equal([]string{"gzip"}, compressors[tikvrpc.CmdCommit])
+}
+
 func (s *testCommitterSuite) TestCommitBeforePrewrite() {
 	txn := s.begin()
 	err := txn.Set([]byte("a"), []byte("a1"))
@@ -677,6 +746,76 @@ func (s *testCommitterSuite) TestUnsetPrimaryKey() {
 	s.Nil(err)
 }
 
+func (s *testCommitterSuite) TestPrimarySelection() {
+	// The keys are in different regions.
+	keys := []string{"a1", "b1", "c1", "d1"}
+	newTxn := func(selection transaction.PrimarySelection) transaction.TxnProbe {
+		txn := s.begin()
+		for _, k := range keys {
+			s.Nil(txn.Set([]byte(k), []byte(k+"_v")))
+		}
+		txn.SetPrimarySelection(selection)
+		return txn
+	}
+	selectPrimary := func(selection transaction.PrimarySelection) []byte {
+		committer, err := newTxn(selection).NewCommitter(0)
+		s.Nil(err)
+		return committer.GetPrimaryKey()
+	}
+	selectIdx := func(idx int) transaction.PrimarySelection {
+		return transaction.PrimarySelectionCallback(func(mutations transaction.CommitterMutations) int {
+			s.Equal(len(keys), mutations.Len())
+			return idx
+		})
+	}
+
+	s.Equal([]byte("a1"), selectPrimary(nil))
+	s.Equal([]byte("a1"), selectPrimary(transaction.PrimarySelectionDefault))
+	s.Equal([]byte("c1"), selectPrimary(selectIdx(2)))
+	selected := make(map[string]struct{})
+	for i := 0; i < 100; i++ {
+		selected[string(selectPrimary(transaction.PrimarySelectionRandom))] = struct{}{}
+	}
+	s.Greater(len(selected), 1)
+	for k := range selected {
+		s.Contains(keys, k)
+	}
+	_, err := newTxn(selectIdx(len(keys))).NewCommitter(0)
+	s.NotNil(err)
+
+	// The selected primary is reported in the commit details.
+	txn := newTxn(selectIdx(1))
+	var commitDetail *util.CommitDetails
+	ctx := context.WithValue(context.Background(), util.CommitDetailCtxKey, &commitDetail)
+	s.Nil(txn.Commit(ctx))
+	s.Equal([]byte("b1"), commitDetail.PrimaryKey)
+
+	// The primary fixed by the pessimistic lock is not changed.
+	txn = newTxn(selectIdx(3))
+	txn.SetPessimistic(true)
+	lockCtx := &kv.LockCtx{ForUpdateTS: txn.StartTS(), WaitStartTime: time.Now()}
+	s.Nil(txn.LockKeys(context.Background(), lockCtx, []byte("b1")))
+	commitDetail = nil
+	s.Nil(txn.Commit(ctx))
+	s.Equal([]byte("b1"), commitDetail.PrimaryKey)
+
+	// The secondary locks are resolved according to the selected primary.
+	txn = newTxn(selectIdx(3))
+	for _, k := range keys {
+		s.Nil(txn.Set([]byte(k), []byte(k+"_v2")))
+	}
+	committer, err := txn.NewCommitter(0)
+	s.Nil(err)
+	s.Equal([]byte("d1"), committer.GetPrimaryKey())
+	s.Nil(committer.PrewriteAllMutations(context.Background()))
+	commitTS, err := s.store.GetOracle().GetTimestamp(context.Background(), &oracle.Option{TxnScope: oracle.GlobalTxnScope})
+	s.Nil(err)
+	committer.SetCommitTS(commitTS)
+	s.Nil(committer.CommitMutations(context.Background()))
+	s.True(s.isKeyLocked([]byte("a1")))
+	s.checkValues(map[string]string{"a1": "a1_v2", "b1": "b1_v2", "c1": "c1_v2", "d1": "d1_v2"})
+}
+
 func (s *testCommitterSuite) TestPessimisticLockedKeysDedup() {
 	txn := s.begin()
 	txn.SetPessimistic(true)
@@ -1595,6 +1734,41 @@ func (s *testCommitterSuite) TestFailCommitPrimaryRPCErrorThenKeyError() {
 	s.False(tikverr.IsErrorUndetermined(err))
 }
 
+// TestPrewriteMaxAttemptsAcrossSplit tests the attempts made before the mutations are split again count towards the
+// max attempts of the new batches.
+func (s *testCommitterSuite) TestPrewriteMaxAttemptsAcrossSplit() {
+	// Leave a lock which doesn't expire in the test.
+	txn1 := s.begin()
+	s.Nil(txn1.Set([]byte("ma"), []byte("ma1")))
+	committer1, err := txn1.NewCommitter(0)
+	s.Nil(err)
+	committer1.SetLockTTL(20000)
+	s.Nil(committer1.PrewriteAllMutations(context.Background()))
+
+	// The region splits before the first prewrite, which fails with EpochNotMatch and splits the mutations again.
+	region, _, _ := s.cluster.GetRegionByKey([]byte("ma"))
+	var prewrites int32
+	splitRegion := func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+		return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+			if req.Type == tikvrpc.CmdPrewrite && atomic.AddInt32(&prewrites, 1) == 1 {
+				newRegionID, newPeerID := s.cluster.AllocID(), s.cluster.AllocID()
+				s.cluster.Split(region.Id, newRegionID, []byte("mb"), []uint64{newPeerID}, newPeerID)
+			}
+			return next(target, req)
+		}
+	}
+	txn2 := s.begin()
+	txn2.SetPrewriteMaxAttempts(2)
+	txn2.SetRPCInterceptor(splitRegion)
+	s.Nil(txn2.Set([]byte("ma"), []byte("ma2")))
+	err = txn2.Commit(context.Background())
+	var tooManyAttempts *tikverr.ErrPrewriteTooManyAttempts
+	s.True(errors.As(err, &tooManyAttempts), errors.WithStack(err))
+	s.Equal(2, tooManyAttempts.Attempts)
+	// The attempt before the split is counted, so the lock is met only once.
+	s.Equal(int32(2), atomic.LoadInt32(&prewrites))
+}
+
 func (s *testCommitterSuite) TestFailCommitTimeout() {
 	s.Nil(failpoint.Enable("tikvclient/rpcCommitTimeout", `return(true)`))
 	defer func() {
@@ -1741,3 +1915,95 @@ func (s *testCommitterSuite) TestFlagsInMemBufferMutations() {
 		s.Equal(assertNotExist, mutations.IsAssertNotExist(i))
 	})
 }
+
+// slowCommitClient fails the commit requests containing failKey after a delay.
+type slowCommitClient struct {
+	tikv.Client
+	failKey []byte
+	delay   time.Duration
+}
+
+func (c *slowCommitClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+	if req.Type == tikvrpc.CmdCommit {
+		for _, key := range req.Commit().GetKeys() {
+			if bytes.Equal(key, c.failKey) {
+				time.Sleep(c.delay)
+				return &tikvrpc.Response{Resp: &kvrpcpb.CommitResponse{Error: &kvrpcpb.KeyError{Abort: "injected"}}}, nil
+			}
+		}
+	}
+	return c.Client.SendRequest(ctx, addr, req, timeout)
+}
+
+func (s *testCommitterSuite) TestCommitSecondariesIsolated() {
+	// Put each key in its own region.
+	keys := make([][]byte, 0, 50)
+	for i := 0; i < 50; i++ {
+		key := []byte(fmt.Sprintf("z%02d", i))
+		keys = append(keys, key)
+		if i > 0 {
+			region, _, _ := s.cluster.GetRegionByKey(key)
+			newRegionID := s.cluster.AllocID()
+			newPeerID := s.cluster.AllocID()
+			s.cluster.Split(region.Id, newRegionID, key, []uint64{newPeerID}, newPeerID)
+		}
+	}
+	failKey := keys[25]
+	s.store.SetTiKVClient(&slowCommitClient{Client: s.store.GetTiKVClient(), failKey: failKey, delay: 2 * time.Second})
+
+	txn := s.begin()
+	txn.SetCommitterConcurrency(4)
+	secondaries := make(chan *util.CommitDetails, 1)
+	txn.SetSecondariesCallback(func(detail *util.CommitDetails, err error) {
+		s.NotNil(err)
+		secondaries <- detail
+	})
+	for _, key := range keys {
+		s.Nil(txn.Set(key, key))
+	}
+	var commitDetail *util.CommitDetails
+	ctx := context.WithValue(context.Background(), util.CommitDetailCtxKey, &commitDetail)
+	s.Nil(txn.Commit(ctx))
+
+	// The other secondaries are committed without waiting for the slow one.
+	s.Eventually(func() bool {
+		for _, key := range keys {
+			if !bytes.Equal(key, failKey) && s.isKeyLocked(key) {
+				return false
+			}
+		}
+		return true
+	}, time.Second, 50*time.Millisecond)
+	s.True(s.isKeyLocked(failKey))
+
+	// The commit details are filled before the commit returns. They have the primary batch only, as the
+	// secondaries are committed in the background.
+	commitDetail.Mu.Lock()
+	s.Equal(int32(1), commitDetail.Mu.CommitBatchNum)
+	s.Equal(int32(0), commitDetail.Mu.CommitFailedBatchNum)
+	s.Equal(s.mustGetRegionID(keys[0]), commitDetail.Mu.SlowestCommitRegion)
+	commitDetail.Mu.Unlock()
+
+	// The outcomes of the secondaries are reported to the callback, including the failure of the slow one.
+	var secondaryDetail *util.CommitDetails
+	select {
+	case secondaryDetail = <-secondaries:
+	case <-time.After(10 * time.Second):
+		s.FailNow("the secondaries callback isn't called")
+	}
+	s.True(s.isKeyLocked(failKey))
+	secondaryDetail.Mu.Lock()
+	s.Equal(int32(len(keys)-1), secondaryDetail.Mu.CommitBatchNum)
+	s.Equal(int32(1), secondaryDetail.Mu.CommitFailedBatchNum)
+	s.Equal(s.mustGetRegionID(failKey), secondaryDetail.Mu.SlowestCommitRegion)
+	s.GreaterOrEqual(secondaryDetail.Mu.SlowestCommitTime, 2*time.Second)
+	secondaryDetail.Mu.Unlock()
+
+	// They don't change the commit details returned to the caller.
+	s.store.WaitGroup().Wait()
+	commitDetail.Mu.Lock()
+	defer commitDetail.Mu.Unlock()
+	s.Equal(int32(1), commitDetail.Mu.CommitBatchNum)
+	s.Equal(int32(0), commitDetail.Mu.CommitFailedBatchNum)
+	s.Equal(s.mustGetRegionID(keys[0]), commitDetail.Mu.SlowestCommitRegion)
+}
@@ -254,13 +254,8 @@ func (s *testAsyncCommitFailSuite) TestAsyncCommitContextCancelCausingUndetermin
 	err := txn.Set([]byte("a"), []byte("va"))
 	s.Nil(err)
 
-	s.Nil(failpoint.Enable("tikvclient/rpcContextCancelErr", `return(true)`))
-	defer func() {
-		s.Nil(failpoint.Disable("tikvclient/rpcContextCancelErr"))
-	}()
-
 	ctx := context.WithValue(context.Background(), util.SessionID, uint64(1))
-	err = txn.Commit(ctx)
+	err = txn.Commit(withCanceledRPCs(ctx))
 	s.NotNil(err)
 	s.NotNil(txn.GetCommitter().GetUndeterminedErr())
 }
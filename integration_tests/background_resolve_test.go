@@ -0,0 +1,210 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/testutils"
+	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/txnkv/txnlock"
+)
+
+// resolvePriorityClient records the priorities of the requests sent to resolve locks.
+type resolvePriorityClient struct {
+	tikv.Client
+	mu         sync.Mutex
+	priorities map[tikvrpc.CmdType][]kvrpcpb.CommandPri
+	// mismatched counts the requests whose priority in the batch queue differs from the command priority.
+	mismatched int
+}
+
+func (c *resolvePriorityClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+	if req.Type == tikvrpc.CmdResolveLock || req.Type == tikvrpc.CmdCheckTxnStatus {
+		c.mu.Lock()
+		c.priorities[req.Type] = append(c.priorities[req.Type], req.Priority)
+		if req.LowPriorityBatch != (req.Priority == kvrpcpb.CommandPri_Low) {
+			c.mismatched++
+		}
+		c.mu.Unlock()
+	}
+	return c.Client.SendRequest(ctx, addr, req, timeout)
+}
+
+func (c *resolvePriorityClient) take() map[tikvrpc.CmdType][]kvrpcpb.CommandPri {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	priorities := c.priorities
+	c.priorities = make(map[tikvrpc.CmdType][]kvrpcpb.CommandPri)
+	return priorities
+}
+
+func newBackgroundResolveTestStore(t *testing.T) (tikv.StoreProbe, *resolvePriorityClient) {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	require.Nil(t, err)
+	testutils.BootstrapWithSingleStore(cluster)
+	priorityClient := &resolvePriorityClient{Client: client, priorities: make(map[tikvrpc.CmdType][]kvrpcpb.CommandPri)}
+	store, err := tikv.NewTestTiKVStore(priorityClient, pdClient, nil, nil, 0)
+	require.Nil(t, err)
+	return tikv.StoreProbe{KVStore: store}, priorityClient
+}
+
+// prewriteLocks prewrites the keys with a long TTL and returns the locks, the first key is the primary.
+func prewriteLocks(t *testing.T, store tikv.StoreProbe, keys ...string) []*txnlock.Lock {
+	txn, err := store.Begin()
+	require.Nil(t, err)
+	for _, key := range keys {
+		require.Nil(t, txn.Set([]byte(key), []byte(key)))
+	}
+	committer, err := txn.NewCommitter(0)
+	require.Nil(t, err)
+	committer.SetPrimaryKey([]byte(keys[0]))
+	committer.SetLockTTL(20000)
+	require.Nil(t, committer.PrewriteAllMutations(context.Background()))
+
+	locks := make([]*txnlock.Lock, 0, len(keys))
+	for _, key := range keys {
+		locks = append(locks, txnlock.NewLock(&kvrpcpb.LockInfo{
+			Key:         []byte(key),
+			PrimaryLock: []byte(keys[0]),
+			LockVersion: txn.StartTS(),
+			LockTtl:     20000,
+			TxnSize:     uint64(len(keys)),
+			LockType:    kvrpcpb.Op_Put,
+		}))
+	}
+	return locks
+}
+
+func TestBackgroundResolveLockPriority(t *testing.T) {
+	store, client := newBackgroundResolveTestStore(t)
+	defer store.Close()
+	lr := store.GetLockResolver()
+	locks := prewriteLocks(t, store, "k1", "k2")
+
+	// Locks met by reads and writes are resolved with normal priority.
+	bo := tikv.NewBackofferWithVars(context.Background(), getMaxBackoff, nil)
+	msBeforeExpired, err := lr.ResolveLocks(bo, 0, locks)
+	require.Nil(t, err)
+	require.Greater(t, msBeforeExpired, int64(0))
+	priorities := client.take()
+	require.NotEmpty(t, priorities[tikvrpc.CmdCheckTxnStatus])
+	for _, pri := range priorities[tikvrpc.CmdCheckTxnStatus] {
+		require.Equal(t, kvrpcpb.CommandPri_Normal, pri)
+	}
+
+	// Locks resolved by GC are resolved with low priority.
+	ctx := context.Background()
+	bo = tikv.NewGcResolveLockMaxBackoffer(ctx)
+	loc, err := store.GetRegionCache().LocateKey(bo, locks[0].Key)
+	require.Nil(t, err)
+	ok, err := lr.BatchResolveLocks(bo, locks, loc.Region)
+	require.Nil(t, err)
+	require.True(t, ok)
+	// The context of the caller's Backoffer isn't changed.
+	require.True(t, bo.GetCtx() == ctx)
+	priorities = client.take()
+	require.NotEmpty(t, priorities[tikvrpc.CmdCheckTxnStatus])
+	require.NotEmpty(t, priorities[tikvrpc.CmdResolveLock])
+	for _, pris := range priorities {
+		for _, pri := range pris {
+			require.Equal(t, kvrpcpb.CommandPri_Low, pri)
+		}
+	}
+
+	// Locks resolved with a background context are resolved with low priority as well.
+	locks = prewriteLocks(t, store, "k3")
+	bo = tikv.NewBackofferWithVars(txnlock.WithBackgroundResolve(context.Background()), getMaxBackoff, nil)
+	_, err = lr.ResolveLocks(bo, 0, locks)
+	require.Nil(t, err)
+	priorities = client.take()
+	require.NotEmpty(t, priorities[tikvrpc.CmdCheckTxnStatus])
+	for _, pri := range priorities[tikvrpc.CmdCheckTxnStatus] {
+		require.Equal(t, kvrpcpb.CommandPri_Low, pri)
+	}
+
+	// Only the requests resolving locks in the background are put behind the others in the batch queue.
+	client.mu.Lock()
+	defer client.mu.Unlock()
+	require.Zero(t, client.mismatched)
+}
+
+func TestBackgroundResolveLockRate(t *testing.T) {
+	store, client := newBackgroundResolveTestStore(t)
+	defer store.Close()
+	lr := tikv.NewLockResolverProb(store.GetLockResolver())
+	locks := prewriteLocks(t, store, "k1", "k2")
+
+	// The clock is frozen, and waiting returns at once after the delay is recorded.
+	var (
+		mu     sync.Mutex
+		delays []time.Duration
+	)
+	now := time.Now()
+	lr.SetBackgroundResolveClock(func() time.Time { return now }, func(d time.Duration) <-chan time.Time {
+		mu.Lock()
+		defer mu.Unlock()
+		delays = append(delays, d)
+		ch := make(chan time.Time, 1)
+		ch <- now.Add(d)
+		return ch
+	})
+	takeDelays := func() []time.Duration {
+		mu.Lock()
+		defer mu.Unlock()
+		taken := delays
+		delays = nil
+		return taken
+	}
+
+	// 2 locks per batch at 20 locks/s, each batch after the first one waits 100ms more.
+	lr.SetBackgroundResolveLockRate(20)
+	bo := tikv.NewGcResolveLockMaxBackoffer(context.Background())
+	loc, err := store.GetRegionCache().LocateKey(bo, locks[0].Key)
+	require.Nil(t, err)
+	for i := 0; i < 5; i++ {
+		ok, err := lr.BatchResolveLocks(bo, locks, loc.Region)
+		require.Nil(t, err)
+		require.True(t, ok)
+	}
+	require.Equal(t, []time.Duration{100 * time.Millisecond, 200 * time.Millisecond, 300 * time.Millisecond, 400 * time.Millisecond}, takeDelays())
+	require.Len(t, client.take()[tikvrpc.CmdResolveLock], 5)
+
+	// The limit doesn't apply to resolving locks in the foreground.
+	lr.SetBackgroundResolveLockRate(1)
+	ok, err := lr.BatchResolveLocks(bo, locks, loc.Region)
+	require.Nil(t, err)
+	require.True(t, ok)
+	locks = prewriteLocks(t, store, "k3")
+	_, err = lr.ResolveLocks(tikv.NewBackofferWithVars(context.Background(), getMaxBackoff, nil), 0, locks)
+	require.Nil(t, err)
+	require.Empty(t, takeDelays())
+
+	// Background resolving gives up when the context is done while waiting.
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	lr.SetBackgroundResolveClock(func() time.Time { return now }, func(d time.Duration) <-chan time.Time {
+		cancel()
+		return make(chan time.Time)
+	})
+	_, err = lr.ResolveLocks(tikv.NewBackofferWithVars(txnlock.WithBackgroundResolve(ctx), getMaxBackoff, nil), 0, locks)
+	require.ErrorIs(t, err, context.Canceled)
+}
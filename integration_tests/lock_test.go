@@ -49,6 +49,7 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/suite"
+	"github.com/tikv/client-go/v2/config"
 	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/kv"
 	"github.com/tikv/client-go/v2/oracle"
@@ -241,6 +242,38 @@ func (s *testLockSuite) TestGetTxnStatus() {
 	s.Greater(status.TTL(), uint64(0), fmt.Sprintf("action:%s", status.Action()))
 }
 
+func (s *testLockSuite) TestResolveSingleLock() {
+	lr := s.store.GetLockResolver()
+	bo := tikv.NewBackofferWithVars(context.Background(), getMaxBackoff, nil)
+
+	// The lock of an alive transaction is kept.
+	s.lockKey([]byte("k1"), []byte("v1"), []byte("p1"), []byte("p1"), 3000, false, false)
+	msBeforeExpired, err := lr.ResolveLock(bo, s.mustGetLock([]byte("k1")))
+	s.Nil(err)
+	s.Greater(msBeforeExpired, int64(0))
+	s.mustGetLock([]byte("k1"))
+
+	// The lock is committed if the primary key is committed.
+	_, commitTS := s.lockKey([]byte("k2"), []byte("v2"), []byte("p2"), []byte("p2"), 3000, true, false)
+	msBeforeExpired, err = lr.ResolveLock(bo, s.mustGetLock([]byte("k2")))
+	s.Nil(err)
+	s.Equal(int64(0), msBeforeExpired)
+	v, err := s.store.GetSnapshot(commitTS).Get(context.Background(), []byte("k2"))
+	s.Nil(err)
+	s.Equal([]byte("v2"), v)
+
+	// The lock is rolled back if the transaction is expired.
+	s.lockKey([]byte("k3"), []byte("v3"), []byte("p3"), []byte("p3"), 1, false, false)
+	time.Sleep(10 * time.Millisecond)
+	msBeforeExpired, err = lr.ResolveLock(bo, s.mustGetLock([]byte("k3")))
+	s.Nil(err)
+	s.Equal(int64(0), msBeforeExpired)
+	txn, err := s.store.Begin()
+	s.Nil(err)
+	_, err = txn.Get(context.Background(), []byte("k3"))
+	s.True(tikverr.IsErrNotFound(err))
+}
+
 func (s *testLockSuite) TestCheckTxnStatusTTL() {
 	txn, err := s.store.Begin()
 	s.Nil(err)
@@ -898,6 +931,25 @@ func (s *testLockSuite) TestPrewriteEncountersLargerTsLock() {
 	<-ch
 }
 
+func (s *testLockSuite) TestPrewriteMaxAttempts() {
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.PrewriteMaxAttempts = 2
+	})()
+
+	// Leave a lock which doesn't expire in the test.
+	s.lockKey([]byte("k1"), []byte("v1"), []byte("k1"), []byte("v1"), 20000, false, false)
+
+	txn, err := s.store.Begin()
+	s.Nil(err)
+	s.Nil(txn.Set([]byte("k1"), []byte("v2")))
+	start := time.Now()
+	err = txn.Commit(context.Background())
+	var tooManyAttempts *tikverr.ErrPrewriteTooManyAttempts
+	s.True(errors.As(err, &tooManyAttempts))
+	s.Equal(2, tooManyAttempts.Attempts)
+	s.Less(time.Since(start), 10*time.Second)
+}
+
 func (s *testLockSuite) TestResolveLocksForRead() {
 	ctx := context.Background()
 	var resolvedLocks, committedLocks []uint64
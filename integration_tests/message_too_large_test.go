@@ -0,0 +1,114 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv_test
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// msgSizeLimitClient rejects requests whose request or response message is larger than the limit of the command,
+// like a gRPC client with a small MaxRecvMsgSize talking to a TiKV with a small max message size.
+type msgSizeLimitClient struct {
+	tikv.Client
+	limits map[tikvrpc.CmdType]int
+}
+
+type sizer interface {
+	Size() int
+}
+
+func (c *msgSizeLimitClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+	limit, ok := c.limits[req.Type]
+	if !ok {
+		return c.Client.SendRequest(ctx, addr, req, timeout)
+	}
+	if size := req.Req.(sizer).Size(); size > limit {
+		return nil, status.Errorf(codes.ResourceExhausted, "trying to send message larger than max (%d vs. %d)", size, limit)
+	}
+	resp, err := c.Client.SendRequest(ctx, addr, req, timeout)
+	if err != nil {
+		return nil, err
+	}
+	if size := resp.Resp.(sizer).Size(); size > limit {
+		return nil, status.Errorf(codes.ResourceExhausted, "grpc: received message larger than max (%d vs. %d)", size, limit)
+	}
+	return resp, nil
+}
+
+func TestSplitRequestOnMessageTooLarge(t *testing.T) {
+	require := require.New(t)
+
+	store := NewTestStore(t)
+	defer store.Close()
+	client := &msgSizeLimitClient{Client: store.GetTiKVClient(), limits: map[tikvrpc.CmdType]int{
+		tikvrpc.CmdPrewrite: 350,
+		tikvrpc.CmdCommit:   120,
+		tikvrpc.CmdBatchGet: 350,
+		tikvrpc.CmdScan:     350,
+	}}
+	store.SetTiKVClient(client)
+	ctx := context.Background()
+
+	value := bytes.Repeat([]byte("v"), 100)
+	keys := make([][]byte, 0, 10)
+	txn, err := store.Begin()
+	require.Nil(err)
+	for i := 0; i < 10; i++ {
+		key := []byte(fmt.Sprintf("msg_too_large_%d", i))
+		keys = append(keys, key)
+		require.Nil(txn.Set(key, value))
+	}
+	require.Nil(txn.Commit(ctx))
+
+	txn, err = store.Begin()
+	require.Nil(err)
+	values, err := txn.BatchGet(ctx, keys)
+	require.Nil(err)
+	require.Len(values, len(keys))
+	for _, key := range keys {
+		require.Equal(value, values[string(key)])
+	}
+
+	txn, err = store.Begin()
+	require.Nil(err)
+	iter, err := txn.Iter([]byte("msg_too_large_"), []byte("msg_too_large`"))
+	require.Nil(err)
+	var scanned [][]byte
+	for iter.Valid() {
+		require.Equal(value, iter.Value())
+		scanned = append(scanned, iter.Key())
+		require.Nil(iter.Next())
+	}
+	iter.Close()
+	require.Equal(keys, scanned)
+
+	// A single key can't be split.
+	client.limits[tikvrpc.CmdBatchGet] = 50
+	txn, err = store.Begin()
+	require.Nil(err)
+	_, err = txn.BatchGet(ctx, keys[:1])
+	require.True(tikverr.IsErrRPCMessageTooLarge(err))
+}
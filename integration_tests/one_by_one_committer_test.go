@@ -0,0 +1,146 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/oracle"
+	"github.com/tikv/client-go/v2/testutils"
+	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/txnkv/transaction"
+)
+
+func TestBuildPrewriteAndCommitRequest(t *testing.T) {
+	assert := assert.New(t)
+
+	mutations := transaction.NewPlainMutations(2)
+	mutations.Push(kvrpcpb.Op_Put, []byte("a"), []byte("va"), false, false, true)
+	mutations.Push(kvrpcpb.Op_Del, []byte("b"), nil, true, false, false)
+	req := transaction.BuildPrewriteRequest(transaction.PrewriteOptions{
+		Mutations:   &mutations,
+		Primary:     []byte("a"),
+		StartTS:     10,
+		LockTTL:     3000,
+		TxnSize:     2,
+		MinCommitTS: 11,
+		Context:     kvrpcpb.Context{Priority: kvrpcpb.CommandPri_High},
+	})
+	prewrite := req.Prewrite()
+	assert.Equal([]*kvrpcpb.Mutation{
+		{Op: kvrpcpb.Op_Put, Key: []byte("a"), Value: []byte("va"), Assertion: kvrpcpb.Assertion_NotExist},
+		{Op: kvrpcpb.Op_Del, Key: []byte("b")},
+	}, prewrite.Mutations)
+	assert.Equal([]bool{false, true}, prewrite.IsPessimisticLock)
+	assert.Equal([]byte("a"), prewrite.PrimaryLock)
+	assert.Equal(uint64(10), prewrite.StartVersion)
+	assert.Equal(uint64(3000), prewrite.LockTtl)
+	assert.Equal(uint64(11), prewrite.MinCommitTs)
+	assert.False(prewrite.UseAsyncCommit)
+	assert.Equal(kvrpcpb.CommandPri_High, req.Context.Priority)
+	assert.NotZero(req.Context.MaxExecutionDurationMs)
+
+	req = transaction.BuildCommitRequest(transaction.CommitOptions{
+		Keys:     [][]byte{[]byte("a"), []byte("b")},
+		StartTS:  10,
+		CommitTS: 20,
+	})
+	commit := req.Commit()
+	assert.Equal([][]byte{[]byte("a"), []byte("b")}, commit.Keys)
+	assert.Equal(uint64(10), commit.StartVersion)
+	assert.Equal(uint64(20), commit.CommitVersion)
+	assert.NotZero(req.Context.MaxExecutionDurationMs)
+}
+
+func TestOneByOneCommitter(t *testing.T) {
+	require, assert := require.New(t), assert.New(t)
+
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	require.Nil(err)
+	_, _, regionID := testutils.BootstrapWithSingleStore(cluster)
+	store, err := tikv.NewTestTiKVStore(client, pdClient, nil, nil, 0)
+	require.Nil(err)
+	defer store.Close()
+	ctx := context.Background()
+
+	// Make the mutations span two regions.
+	newRegionID, newPeerID := cluster.AllocID(), cluster.AllocID()
+	cluster.Split(regionID, newRegionID, []byte("c"), []uint64{newPeerID}, newPeerID)
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("d")}
+	mutations := transaction.NewPlainMutations(len(keys))
+	for _, k := range keys {
+		mutations.Push(kvrpcpb.Op_Put, k, append([]byte("v"), k...), false, false, false)
+	}
+	startTS, err := store.CurrentTimestamp(oracle.GlobalTxnScope)
+	require.Nil(err)
+	committer := transaction.NewOneByOneCommitter(store, startTS, keys[0], 3000)
+	groups, err := committer.GroupMutations(ctx, &mutations)
+	require.Nil(err)
+	require.Len(groups, 2)
+
+	commitTS, err := committer.Execute(ctx, groups)
+	require.Nil(err)
+	assert.Greater(commitTS, startTS)
+
+	snapshot := store.GetSnapshot(commitTS)
+	for _, k := range keys {
+		v, err := snapshot.Get(ctx, k)
+		assert.Nil(err)
+		assert.Equal(append([]byte("v"), k...), v)
+	}
+	snapshot = store.GetSnapshot(commitTS - 1)
+	_, err = snapshot.Get(ctx, keys[0])
+	assert.True(tikverr.IsErrNotFound(err))
+
+	// Regions are located again if they are changed after grouping.
+	mutations = transaction.NewPlainMutations(len(keys))
+	for _, k := range keys {
+		mutations.Push(kvrpcpb.Op_Put, k, append([]byte("w"), k...), false, false, false)
+	}
+	startTS, err = store.CurrentTimestamp(oracle.GlobalTxnScope)
+	require.Nil(err)
+	committer = transaction.NewOneByOneCommitter(store, startTS, keys[0], 3000)
+	groups, err = committer.GroupMutations(ctx, &mutations)
+	require.Nil(err)
+	newRegionID, newPeerID = cluster.AllocID(), cluster.AllocID()
+	cluster.Split(regionID, newRegionID, []byte("b"), []uint64{newPeerID}, newPeerID)
+	require.Nil(committer.Prewrite(ctx, groups))
+
+	// The old transaction can't overwrite the prewritten keys.
+	oldCommitter := transaction.NewOneByOneCommitter(store, startTS-1, keys[1], 3000)
+	oldGroups, err := oldCommitter.GroupMutations(ctx, &mutations)
+	require.Nil(err)
+	assert.NotNil(oldCommitter.Prewrite(ctx, oldGroups))
+
+	commitTS, err = store.CurrentTimestamp(oracle.GlobalTxnScope)
+	require.Nil(err)
+	actualCommitTS, err := committer.Commit(ctx, groups, commitTS)
+	require.Nil(err)
+	assert.Equal(commitTS, actualCommitTS)
+
+	txn, err := store.Begin()
+	require.Nil(err)
+	for _, k := range keys {
+		v, err := txn.Get(ctx, k)
+		assert.Nil(err)
+		assert.Equal(append([]byte("w"), k...), v)
+	}
+}
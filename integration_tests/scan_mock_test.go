@@ -36,10 +36,23 @@ package tikv_test
 
 import (
 	"context"
+	"math"
+	"sync/atomic"
 	"testing"
+	"time"
 
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pkg/errors"
 	"github.com/stretchr/testify/suite"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/testutils"
 	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/tikvrpc/interceptor"
+	pd "github.com/tikv/pd/client"
 )
 
 func TestScanMock(t *testing.T) {
@@ -113,3 +126,361 @@ func (s *testScanMockSuite) TestReverseScan() {
 	}
 	s.False(scanner.Valid())
 }
+
+func (s *testScanMockSuite) TestScanPartialResult() {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	s.Require().Nil(err)
+	_, regionIDs, _ := testutils.BootstrapWithMultiRegions(cluster, []byte("h"), []byte("p"))
+	kvStore, err := tikv.NewTestTiKVStore(client, pdClient, nil, nil, 0)
+	s.Require().Nil(err)
+	store := tikv.StoreProbe{KVStore: kvStore}
+	defer store.Close()
+
+	txn, err := store.Begin()
+	s.Nil(err)
+	for ch := byte('a'); ch <= byte('z'); ch++ {
+		err = txn.Set([]byte{ch}, []byte{ch})
+		s.Nil(err)
+	}
+	err = txn.Commit(context.Background())
+	s.Nil(err)
+
+	// The scan requests to the region [h, p) always fail with region errors, until the backoffer is exhausted.
+	defer tikv.ConfigProbe{}.SetScannerNextMaxBackoff(tikv.ConfigProbe{}.SetScannerNextMaxBackoff(100))
+	failedRegion := regionIDs[1]
+	failRegion := func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+		return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+			if req.Type == tikvrpc.CmdScan && req.RegionId == failedRegion {
+				return &tikvrpc.Response{Resp: &kvrpcpb.ScanResponse{RegionError: &errorpb.Error{KeyNotInRegion: &errorpb.KeyNotInRegion{}}}}, nil
+			}
+			return next(target, req)
+		}
+	}
+	var failedRanges []kv.KeyRange
+	skip := func(failedRange kv.KeyRange, err error) bool {
+		s.NotNil(err)
+		failedRanges = append(failedRanges, failedRange)
+		return true
+	}
+	var expected [][]byte
+	for ch := byte('a'); ch <= byte('z'); ch++ {
+		if ch < 'h' || ch >= 'p' {
+			expected = append(expected, []byte{ch})
+		}
+	}
+
+	for _, reverse := range []bool{false, true} {
+		txn, err = store.Begin()
+		s.Nil(err)
+		txn.GetSnapshot().SetRPCInterceptor(failRegion)
+		txn.GetSnapshot().SetPartialResultHandler(skip)
+		failedRanges = nil
+		scanner, err := txn.NewScanner(nil, []byte("{"), 3, reverse)
+		s.Nil(err)
+		var keys [][]byte
+		for scanner.Valid() {
+			s.Equal(scanner.Key(), scanner.Value())
+			keys = append(keys, scanner.Key())
+			s.Nil(scanner.Next())
+		}
+		if reverse {
+			for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+				keys[i], keys[j] = keys[j], keys[i]
+			}
+		}
+		s.Equal(expected, keys)
+		s.Equal([]kv.KeyRange{{StartKey: []byte("h"), EndKey: []byte("p")}}, failedRanges)
+		var partialErr *tikverr.ErrPartialScan
+		s.True(errors.As(scanner.Err(), &partialErr))
+		s.Equal(1, partialErr.SkippedRanges)
+	}
+
+	// The scan fails if the handler doesn't skip the range.
+	txn, err = store.Begin()
+	s.Nil(err)
+	txn.GetSnapshot().SetRPCInterceptor(failRegion)
+	txn.GetSnapshot().SetPartialResultHandler(func(kv.KeyRange, error) bool { return false })
+	scanner, err := txn.NewScanner([]byte("f"), nil, 3, false)
+	s.Nil(err)
+	s.Equal([]byte("f"), scanner.Key())
+	s.Nil(scanner.Next())
+	s.Equal([]byte("g"), scanner.Key())
+	s.NotNil(scanner.Next())
+	s.False(scanner.Valid())
+	s.Nil(scanner.Err())
+
+	// The errors that aren't retried away don't reach the handler, they fail the scan at once.
+	abortRegion := func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+		return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+			if req.Type == tikvrpc.CmdScan && req.RegionId == failedRegion {
+				return &tikvrpc.Response{Resp: &kvrpcpb.ScanResponse{Error: &kvrpcpb.KeyError{Abort: "injected"}}}, nil
+			}
+			return next(target, req)
+		}
+	}
+	txn, err = store.Begin()
+	s.Nil(err)
+	txn.GetSnapshot().SetRPCInterceptor(abortRegion)
+	failedRanges = nil
+	txn.GetSnapshot().SetPartialResultHandler(skip)
+	scanner, err = txn.NewScanner([]byte("f"), nil, 3, false)
+	s.Nil(err)
+	s.Nil(scanner.Next())
+	s.NotNil(scanner.Next())
+	s.False(scanner.Valid())
+	s.Empty(failedRanges)
+}
+
+func (s *testScanMockSuite) TestScanMaxLimit() {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	s.Require().Nil(err)
+	testutils.BootstrapWithMultiRegions(cluster, []byte("h"), []byte("p"))
+	kvStore, err := tikv.NewTestTiKVStore(client, pdClient, nil, nil, 0)
+	s.Require().Nil(err)
+	store := tikv.StoreProbe{KVStore: kvStore}
+	defer store.Close()
+
+	txn, err := store.Begin()
+	s.Nil(err)
+	var expected [][]byte
+	for ch := byte('a'); ch <= byte('z'); ch++ {
+		err = txn.Set([]byte{ch}, []byte{ch})
+		s.Nil(err)
+		expected = append(expected, []byte{ch})
+	}
+	err = txn.Commit(context.Background())
+	s.Nil(err)
+
+	// The server returns at most maxLimit pairs for each scan request.
+	for _, maxLimit := range []int{1, 4} {
+		maxLimit := maxLimit
+		capResponse := func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+			return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+				if req.Type == tikvrpc.CmdScan {
+					s.LessOrEqual(req.Scan().GetLimit(), uint32(maxLimit))
+				}
+				resp, err := next(target, req)
+				if err == nil && req.Type == tikvrpc.CmdScan {
+					if scanResp, ok := resp.Resp.(*kvrpcpb.ScanResponse); ok && len(scanResp.Pairs) > maxLimit {
+						scanResp.Pairs = scanResp.Pairs[:maxLimit]
+					}
+				}
+				return resp, err
+			}
+		}
+
+		for _, reverse := range []bool{false, true} {
+			txn, err = store.Begin()
+			s.Nil(err)
+			txn.GetSnapshot().SetRPCInterceptor(capResponse)
+			txn.GetSnapshot().SetScanMaxLimit(maxLimit)
+			scanner, err := txn.NewScanner(nil, []byte("{"), 100, reverse)
+			s.Nil(err)
+			var keys [][]byte
+			for scanner.Valid() {
+				s.Equal(scanner.Key(), scanner.Value())
+				keys = append(keys, scanner.Key())
+				s.Nil(scanner.Next())
+			}
+			if reverse {
+				for i, j := 0, len(keys)-1; i < j; i, j = i+1, j-1 {
+					keys[i], keys[j] = keys[j], keys[i]
+				}
+			}
+			// Each key is returned exactly once.
+			s.Equal(expected, keys, "maxLimit %d, reverse %v", maxLimit, reverse)
+		}
+	}
+}
+
+func (s *testScanMockSuite) TestScanPreferTiFlash() {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	s.Require().Nil(err)
+	_, regionIDs, _ := testutils.BootstrapWithMultiRegions(cluster, []byte("h"), []byte("p"))
+	// Only the region [h, p) has a TiFlash peer.
+	tiflashStoreID := cluster.AllocID()
+	cluster.AddStore(tiflashStoreID, "tiflash", &metapb.StoreLabel{Key: "engine", Value: "tiflash"})
+	cluster.AddPeer(regionIDs[1], tiflashStoreID, cluster.AllocID())
+	kvStore, err := tikv.NewTestTiKVStore(client, pdClient, nil, nil, 0)
+	s.Require().Nil(err)
+	store := tikv.StoreProbe{KVStore: kvStore}
+	defer store.Close()
+
+	txn, err := store.Begin()
+	s.Nil(err)
+	for ch := byte('a'); ch <= byte('z'); ch++ {
+		err = txn.Set([]byte{ch}, []byte{ch})
+		s.Nil(err)
+	}
+	err = txn.Commit(context.Background())
+	s.Nil(err)
+
+	bo := tikv.NewBackofferWithVars(context.Background(), 5000, nil)
+	covered, missing, err := store.GetRegionCache().CheckTiFlashCoverage(bo, []byte("h"), []byte("p"))
+	s.Nil(err)
+	s.True(covered)
+	s.Empty(missing)
+	covered, missing, err = store.GetRegionCache().CheckTiFlashCoverage(bo, nil, nil)
+	s.Nil(err)
+	s.False(covered)
+	s.Len(missing, 2)
+	s.Equal(regionIDs[0], missing[0].GetID())
+	s.Equal(regionIDs[2], missing[1].GetID())
+
+	// TiFlash doesn't serve KvScan, so the scan reads all the regions from TiKV even if it prefers TiFlash.
+	targets := make(map[uint64]string)
+	recordTarget := func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+		return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+			if req.Type == tikvrpc.CmdScan {
+				targets[req.RegionId] = target
+			}
+			return next(target, req)
+		}
+	}
+	txn, err = store.Begin()
+	s.Nil(err)
+	txn.GetSnapshot().SetRPCInterceptor(recordTarget)
+	txn.GetSnapshot().SetPreferTiFlash(true)
+	scanner, err := txn.NewScanner(nil, nil, 100, false)
+	s.Nil(err)
+	for ch := byte('a'); ch <= byte('z'); ch++ {
+		s.Equal([]byte{ch}, scanner.Key())
+		s.Nil(scanner.Next())
+	}
+	s.False(scanner.Valid())
+	s.Len(targets, 3)
+	for _, regionID := range regionIDs {
+		s.NotEqual("tiflash", targets[regionID])
+	}
+}
+
+func (s *testScanMockSuite) TestReadEndpointPreferTiFlash() {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	s.Require().Nil(err)
+	_, regionIDs, _ := testutils.BootstrapWithMultiRegions(cluster, []byte("h"))
+	// Only the region [h, ) has a TiFlash peer.
+	tiflashStoreID := cluster.AllocID()
+	cluster.AddStore(tiflashStoreID, "tiflash", &metapb.StoreLabel{Key: "engine", Value: "tiflash"})
+	cluster.AddPeer(regionIDs[1], tiflashStoreID, cluster.AllocID())
+	kvStore, err := tikv.NewTestTiKVStore(client, pdClient, nil, nil, 0)
+	s.Require().Nil(err)
+	store := tikv.StoreProbe{KVStore: kvStore}
+	defer store.Close()
+
+	snapshot := store.GetSnapshot(math.MaxUint64)
+	snapshot.SetPreferTiFlash(true)
+	bo := tikv.NewBackofferWithVars(context.Background(), 5000, nil)
+	loc, err := store.GetRegionCache().LocateKey(bo, []byte("h"))
+	s.Nil(err)
+	et, err := snapshot.ReadEndpoint(bo, loc.Region, tikvrpc.CmdCop)
+	s.Nil(err)
+	s.Equal(tikvrpc.TiFlash, et)
+
+	// The KV reads aren't served by TiFlash.
+	for _, cmd := range []tikvrpc.CmdType{tikvrpc.CmdGet, tikvrpc.CmdBatchGet, tikvrpc.CmdScan} {
+		et, err = snapshot.ReadEndpoint(bo, loc.Region, cmd)
+		s.Nil(err)
+		s.Equal(tikvrpc.TiKV, et)
+	}
+
+	// A stale region is still read from TiFlash, so that it's retried with the reloaded region.
+	store.GetRegionCache().InvalidateCachedRegion(loc.Region)
+	et, err = snapshot.ReadEndpoint(bo, loc.Region, tikvrpc.CmdCop)
+	s.Nil(err)
+	s.Equal(tikvrpc.TiFlash, et)
+
+	// The region without TiFlash peers falls back to TiKV.
+	loc, err = store.GetRegionCache().LocateKey(bo, []byte("a"))
+	s.Nil(err)
+	et, err = snapshot.ReadEndpoint(bo, loc.Region, tikvrpc.CmdCop)
+	s.Nil(err)
+	s.Equal(tikvrpc.TiKV, et)
+}
+
+// noCloseClient doesn't close the underlying client, so that the client can be shared by stores.
+type noCloseClient struct {
+	tikv.Client
+}
+
+func (c noCloseClient) Close() error {
+	return nil
+}
+
+// syncLoadCountingPDClient counts the regions loaded from PD on behalf of the requests of transactions, which
+// excludes the regions prefetched by scanners in the background.
+type syncLoadCountingPDClient struct {
+	pd.Client
+	syncLoads int32
+}
+
+func (c *syncLoadCountingPDClient) GetRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	if ctx.Value(tikv.TxnStartKey()) != nil {
+		atomic.AddInt32(&c.syncLoads, 1)
+	}
+	return c.Client.GetRegion(ctx, key, opts...)
+}
+
+func (s *testScanMockSuite) TestScanPrefetch() {
+	var splitKeys [][]byte
+	for ch := byte('b'); ch <= byte('t'); ch++ {
+		splitKeys = append(splitKeys, []byte{ch})
+	}
+
+	// scan scans 20 regions of 5 keys each with a cold region cache, and returns the number of synchronous region
+	// loads from PD.
+	scan := func(prefetch bool) int32 {
+		client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+		s.Require().Nil(err)
+		testutils.BootstrapWithMultiRegions(cluster, splitKeys...)
+
+		// Write the data with another store, so that the region cache of the store to scan is cold.
+		writeStore, err := tikv.NewTestTiKVStore(client, pdClient, func(c tikv.Client) tikv.Client {
+			return noCloseClient{c}
+		}, nil, 0)
+		s.Require().Nil(err)
+		defer writeStore.Close()
+		var keys [][]byte
+		txn, err := writeStore.Begin()
+		s.Nil(err)
+		for ch := byte('a'); ch <= byte('t'); ch++ {
+			for i := byte('0'); i < byte('5'); i++ {
+				keys = append(keys, []byte{ch, i})
+				s.Nil(txn.Set([]byte{ch, i}, []byte{ch, i}))
+			}
+		}
+		s.Nil(txn.Commit(context.Background()))
+
+		countingPDClient := &syncLoadCountingPDClient{}
+		store, err := tikv.NewTestTiKVStore(client, pdClient, nil, func(c pd.Client) pd.Client {
+			countingPDClient.Client = c
+			return countingPDClient
+		}, 0)
+		s.Require().Nil(err)
+		defer store.Close()
+
+		// Slow down the scan requests, so that the prefetches are done before the scanner moves to the next regions.
+		slowScan := func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+			return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+				if req.Type == tikvrpc.CmdScan {
+					time.Sleep(10 * time.Millisecond)
+				}
+				return next(target, req)
+			}
+		}
+		txn, err = store.Begin()
+		s.Nil(err)
+		txn.GetSnapshot().SetRPCInterceptor(slowScan)
+		txn.GetSnapshot().SetScanPrefetch(prefetch)
+		scanner, err := txn.NewScanner(nil, nil, 2, false)
+		s.Nil(err)
+		for _, key := range keys {
+			s.Equal(key, scanner.Key())
+			s.Nil(scanner.Next())
+		}
+		s.False(scanner.Valid())
+		return atomic.LoadInt32(&countingPDClient.syncLoads)
+	}
+
+	s.Equal(int32(20), scan(false))
+	s.LessOrEqual(scan(true), int32(2))
+}
@@ -0,0 +1,152 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv_test
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/testutils"
+	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/tikvrpc"
+)
+
+// batchGetCountClient counts the BatchGet requests and the keys in them.
+type batchGetCountClient struct {
+	tikv.Client
+	requests int64
+	keys     int64
+}
+
+func (c *batchGetCountClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+	if req.Type == tikvrpc.CmdBatchGet {
+		atomic.AddInt64(&c.requests, 1)
+		atomic.AddInt64(&c.keys, int64(len(req.BatchGet().GetKeys())))
+	}
+	return c.Client.SendRequest(ctx, addr, req, timeout)
+}
+
+// newBatchGetTestStore creates a store with regions split at k3 and k6 and keys k0 ~ k9, except k5.
+func newBatchGetTestStore(t require.TestingT) (*tikv.KVStore, *batchGetCountClient) {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	require.Nil(t, err)
+	testutils.BootstrapWithMultiRegions(cluster, []byte("k3"), []byte("k6"))
+	countClient := &batchGetCountClient{Client: client}
+	store, err := tikv.NewTestTiKVStore(countClient, pdClient, nil, nil, 0)
+	require.Nil(t, err)
+
+	txn, err := store.Begin()
+	require.Nil(t, err)
+	for i := 0; i < 10; i++ {
+		if i == 5 {
+			continue
+		}
+		key := []byte(fmt.Sprintf("k%d", i))
+		require.Nil(t, txn.Set(key, append([]byte("v"), key...)))
+	}
+	require.Nil(t, txn.Commit(context.Background()))
+	return store, countClient
+}
+
+func TestBatchGetDuplicateKeys(t *testing.T) {
+	store, client := newBatchGetTestStore(t)
+	defer store.Close()
+
+	// Duplicates span all regions, and k5 doesn't exist.
+	keys := [][]byte{
+		[]byte("k8"), []byte("k1"), []byte("k4"), []byte("k8"), []byte("k5"),
+		[]byte("k1"), []byte("k4"), []byte("k5"), []byte("k0"), []byte("k8"),
+	}
+
+	snapshot := store.GetSnapshot(math.MaxUint64)
+	m, err := snapshot.BatchGet(context.Background(), keys)
+	require.Nil(t, err)
+	require.Len(t, m, 4)
+	for _, k := range []string{"k0", "k1", "k4", "k8"} {
+		require.Equal(t, []byte("v"+k), m[k])
+	}
+	// Each distinct key is fetched once.
+	require.Equal(t, int64(5), atomic.LoadInt64(&client.keys))
+	require.Equal(t, int64(3), atomic.LoadInt64(&client.requests))
+
+	atomic.StoreInt64(&client.requests, 0)
+	atomic.StoreInt64(&client.keys, 0)
+	snapshot = store.GetSnapshot(math.MaxUint64)
+	values := make([][]byte, len(keys))
+	err = snapshot.BatchGetInto(context.Background(), keys, func(idx int, value []byte) {
+		require.Nil(t, values[idx])
+		values[idx] = value
+	})
+	require.Nil(t, err)
+	for i, key := range keys {
+		if string(key) == "k5" {
+			require.Nil(t, values[i])
+		} else {
+			require.Equal(t, append([]byte("v"), key...), values[i])
+		}
+	}
+	require.Equal(t, int64(5), atomic.LoadInt64(&client.keys))
+	require.Equal(t, int64(3), atomic.LoadInt64(&client.requests))
+
+	// Cached values are used.
+	err = snapshot.BatchGetInto(context.Background(), keys, func(idx int, value []byte) {
+		require.Equal(t, values[idx], value)
+	})
+	require.Nil(t, err)
+	require.Equal(t, int64(3), atomic.LoadInt64(&client.requests))
+}
+
+// BenchmarkBatchGetDuplicateKeys gets 20 keys of which half are duplicates.
+func BenchmarkBatchGetDuplicateKeys(b *testing.B) {
+	store, client := newBatchGetTestStore(b)
+	defer store.Close()
+
+	keys := make([][]byte, 0, 20)
+	for i := 0; i < 10; i++ {
+		keys = append(keys, []byte(fmt.Sprintf("k%d", i)))
+	}
+	keys = append(keys, keys...)
+
+	run := func(b *testing.B, batchGet func(keys [][]byte) error) {
+		atomic.StoreInt64(&client.requests, 0)
+		atomic.StoreInt64(&client.keys, 0)
+		b.ReportAllocs()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := batchGet(keys); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.StopTimer()
+		b.ReportMetric(float64(atomic.LoadInt64(&client.requests))/float64(b.N), "rpcs/op")
+		b.ReportMetric(float64(atomic.LoadInt64(&client.keys))/float64(b.N), "rpc-keys/op")
+	}
+	b.Run("Map", func(b *testing.B) {
+		run(b, func(keys [][]byte) error {
+			_, err := store.GetSnapshot(math.MaxUint64).BatchGet(context.Background(), keys)
+			return err
+		})
+	})
+	b.Run("Into", func(b *testing.B) {
+		run(b, func(keys [][]byte) error {
+			return store.GetSnapshot(math.MaxUint64).BatchGetInto(context.Background(), keys, func(int, []byte) {})
+		})
+	})
+}
@@ -0,0 +1,98 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package tikv_test
+
+import (
+	"context"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/metrics"
+	"github.com/tikv/client-go/v2/oracle"
+	"github.com/tikv/client-go/v2/testutils"
+	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/txnkv/txnsnapshot"
+)
+
+func TestReadYourWritesCheck(t *testing.T) {
+	client, cluster, pdClient, err := testutils.NewMockTiKV("", nil)
+	require.Nil(t, err)
+	storeIDs, _, _, _ := testutils.BootstrapWithMultiStores(cluster, 3)
+	store, err := tikv.NewTestTiKVStore(client, pdClient, nil, nil, 0)
+	require.Nil(t, err)
+	defer store.Close()
+	store.EnableReadYourWritesCheck(100)
+
+	ctx := context.Background()
+	k1, k2 := []byte("k1"), []byte("k2")
+	txn, err := store.Begin()
+	require.Nil(t, err)
+	require.Nil(t, txn.Set(k1, []byte("v1")))
+	require.Nil(t, txn.Set(k2, []byte("v2")))
+	require.Nil(t, txn.Commit(ctx))
+
+	// The followers miss the writes committed from now on.
+	staleTS, err := store.CurrentTimestamp(oracle.GlobalTxnScope)
+	require.Nil(t, err)
+	for _, storeID := range storeIDs[1:] {
+		cluster.SetStaleReplica(storeID, staleTS)
+	}
+	txn, err = store.Begin()
+	require.Nil(t, err)
+	require.Nil(t, txn.Set(k1, []byte("v1-new")))
+	require.Nil(t, txn.Delete(k2))
+	require.Nil(t, txn.Commit(ctx))
+	require.Equal(t, 2, store.GetRecentCommits().Len())
+
+	newSnapshot := func(check bool) *txnsnapshot.KVSnapshot {
+		ts, err := store.CurrentTimestamp(oracle.GlobalTxnScope)
+		require.Nil(t, err)
+		snapshot := store.GetSnapshot(ts)
+		snapshot.SetReplicaRead(kv.ReplicaReadFollower)
+		snapshot.SetReadYourWritesCheck(check)
+		return snapshot
+	}
+
+	// The stale followers serve the old values without the check.
+	violations := metrics.GetReadYourWritesViolations()
+	snapshot := newSnapshot(false)
+	val, err := snapshot.Get(ctx, k1)
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1"), val)
+	require.Equal(t, violations, metrics.GetReadYourWritesViolations())
+
+	// The check detects the stale values and reads the keys from the leader again.
+	snapshot = newSnapshot(true)
+	val, err = snapshot.Get(ctx, k1)
+	require.Nil(t, err)
+	require.Equal(t, []byte("v1-new"), val)
+	require.Equal(t, violations+1, metrics.GetReadYourWritesViolations())
+	// The deleted key is checked too.
+	m, err := snapshot.BatchGet(ctx, [][]byte{k1, k2})
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{"k1": []byte("v1-new")}, m)
+	require.Equal(t, violations+3, metrics.GetReadYourWritesViolations())
+
+	// The up-to-date followers pass the check.
+	for _, storeID := range storeIDs[1:] {
+		cluster.SetStaleReplica(storeID, 0)
+	}
+	snapshot = newSnapshot(true)
+	m, err = snapshot.BatchGet(ctx, [][]byte{k1, k2})
+	require.Nil(t, err)
+	require.Equal(t, map[string][]byte{"k1": []byte("v1-new")}, m)
+	require.Equal(t, violations+3, metrics.GetReadYourWritesViolations())
+}
@@ -132,6 +132,13 @@ func (s *testSplitSuite) TestStaleEpoch() {
 	s.Nil(err)
 }
 
+func (s *testSplitSuite) TestReplacePDClient() {
+	mockPDClient := &mockPDClient{client: s.store.GetRegionCache().PDClient()}
+	s.store.GetRegionCache().ReplacePDClient(mockPDClient, false)
+	// The store shares the pd client of the region cache.
+	s.True(s.store.GetPDClient() == mockPDClient)
+}
+
 var errStopped = errors.New("stopped")
 
 type mockPDClient struct {
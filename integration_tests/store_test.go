@@ -37,16 +37,18 @@ package tikv_test
 import (
 	"context"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
-	"github.com/pingcap/failpoint"
+	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/stretchr/testify/suite"
 	"github.com/tikv/client-go/v2/oracle"
 	"github.com/tikv/client-go/v2/oracle/oracles"
 	"github.com/tikv/client-go/v2/tikv"
 	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/tikvrpc/interceptor"
 	"github.com/tikv/client-go/v2/txnkv"
 )
 
@@ -180,10 +182,22 @@ func (s *testStoreSuite) TestFailBusyServerKV() {
 	err = txn.Commit(context.Background())
 	s.Nil(err)
 
+	// The server is busy for the first request.
+	var calls int32
+	ctx := interceptor.WithRPCInterceptor(context.Background(), func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+		return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+			if atomic.AddInt32(&calls, 1) == 1 {
+				return &tikvrpc.Response{
+					Resp: &kvrpcpb.GetResponse{RegionError: &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}},
+				}, nil
+			}
+			return next(target, req)
+		}
+	})
 	txn, err = s.store.Begin()
 	s.Require().Nil(err)
-	s.Nil(failpoint.Enable("tikvclient/tikvStoreSendReqResult", `1*return("busy")->return("")`))
-	val, err := txn.Get(context.TODO(), []byte("key"))
+	val, err := txn.Get(ctx, []byte("key"))
 	s.Nil(err)
 	s.Equal(val, []byte("value"))
+	s.Equal(int32(2), atomic.LoadInt32(&calls))
 }
@@ -49,6 +49,8 @@ import (
 	"github.com/tikv/client-go/v2/config"
 	"github.com/tikv/client-go/v2/testutils"
 	"github.com/tikv/client-go/v2/tikv"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/tikvrpc/interceptor"
 	"github.com/tikv/client-go/v2/txnkv/transaction"
 	"github.com/tikv/client-go/v2/util/codec"
 	pd "github.com/tikv/pd/client"
@@ -150,3 +152,12 @@ func toTiDBKeys(keys [][]byte) []kv.Key {
 	kvKeys := *(*[]kv.Key)(unsafe.Pointer(&keys))
 	return kvKeys
 }
+
+// withCanceledRPCs binds an interceptor to ctx which fails the requests with context.Canceled without sending them.
+func withCanceledRPCs(ctx context.Context) context.Context {
+	return interceptor.WithRPCInterceptor(ctx, func(next interceptor.RPCInterceptorFunc) interceptor.RPCInterceptorFunc {
+		return func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+			return nil, context.Canceled
+		}
+	})
+}
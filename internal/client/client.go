@@ -37,11 +37,13 @@ package client
 
 import (
 	"context"
+	"crypto/tls"
 	"fmt"
 	"io"
 	"math"
 	"runtime/trace"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -53,7 +55,6 @@ import (
 	"github.com/pingcap/kvproto/pkg/mpp"
 	"github.com/pingcap/kvproto/pkg/tikvpb"
 	"github.com/pkg/errors"
-	"github.com/prometheus/client_golang/prometheus"
 	"github.com/tikv/client-go/v2/config"
 	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/internal/logutil"
@@ -75,18 +76,6 @@ import (
 // current value, an error will be reported from gRPC.
 var MaxRecvMsgSize = math.MaxInt64 - 1
 
-// Timeout durations.
-const (
-	dialTimeout       = 5 * time.Second
-	ReadTimeoutShort  = 30 * time.Second // For requests that read/write several key-values.
-	ReadTimeoutMedium = 60 * time.Second // For requests that may need scan region.
-
-	// MaxWriteExecutionTime is the MaxExecutionDurationMs field for write requests.
-	// Because the last deadline check is before proposing, let us give it 10 more seconds
-	// after proposing.
-	MaxWriteExecutionTime = ReadTimeoutShort - 10*time.Second
-)
-
 // Grpc window size
 const (
 	GrpcInitialWindowSize     = 1 << 30
@@ -112,7 +101,17 @@ type connArray struct {
 	target string
 
 	index uint32
-	v     []*grpc.ClientConn
+	// mu protects v from being changed by resize while it's read.
+	mu sync.RWMutex
+	v  []*grpcConn
+	// resizeMu serializes resize and Close.
+	resizeMu sync.Mutex
+	// draining tracks the connections removed by resize, which are closed after their in-flight requests finish.
+	draining sync.WaitGroup
+	// inflight is the number of requests in progress to the target.
+	inflight int64
+	// transportOpt is the transport credentials to dial the target, it's kept for dialing more connections on resize.
+	transportOpt grpc.DialOption
 	// streamTimeout binds with a background goroutine to process coprocessor streaming timeout.
 	streamTimeout chan *tikvrpc.Lease
 	dialTimeout   time.Duration
@@ -121,103 +120,86 @@ type connArray struct {
 	done chan struct{}
 }
 
-func newConnArray(maxSize uint, addr string, security config.Security, idleNotify *uint32, enableBatch bool, dialTimeout time.Duration) (*connArray, error) {
+// grpcConn is a gRPC connection in the connArray.
+type grpcConn struct {
+	*grpc.ClientConn
+	// requests is the number of requests sent over the connection, including the batched ones.
+	requests uint64
+	// inflight is the number of unary calls and streams in progress over the connection.
+	inflight int64
+	// batchClient sends the batched requests over the connection, it's nil when batch is disabled.
+	batchClient *batchCommandsClient
+}
+
+// acquire marks a unary call or a stream in progress over the connection. The returned function must be called
+// after it finishes, and it's safe to be called more than once.
+func (c *grpcConn) acquire() func() {
+	atomic.AddInt64(&c.inflight, 1)
+	var once sync.Once
+	return func() {
+		once.Do(func() { atomic.AddInt64(&c.inflight, -1) })
+	}
+}
+
+// idle returns whether there is no request in progress over the connection.
+func (c *grpcConn) idle() bool {
+	if atomic.LoadInt64(&c.inflight) > 0 {
+		return false
+	}
+	if c.batchClient == nil {
+		return true
+	}
+	idle := true
+	c.batchClient.batched.Range(func(_, _ interface{}) bool {
+		idle = false
+		return false
+	})
+	return idle
+}
+
+// connDrainTimeout is the longest time to wait for the in-flight requests of a connection removed by resize.
+var connDrainTimeout = 2 * time.Minute
+
+func newConnArray(maxSize uint, addr string, tlsConfig *tls.Config, idleNotify *uint32, enableBatch bool, dialTimeout time.Duration) (*connArray, error) {
 	a := &connArray{
 		index:         0,
-		v:             make([]*grpc.ClientConn, maxSize),
+		v:             make([]*grpcConn, maxSize),
 		streamTimeout: make(chan *tikvrpc.Lease, 1024),
 		done:          make(chan struct{}),
 		dialTimeout:   dialTimeout,
 	}
-	if err := a.Init(addr, security, idleNotify, enableBatch); err != nil {
+	if err := a.Init(addr, tlsConfig, idleNotify, enableBatch); err != nil {
 		return nil, err
 	}
 	return a, nil
 }
 
-func (a *connArray) Init(addr string, security config.Security, idleNotify *uint32, enableBatch bool) error {
+// Init dials the connections of the connArray, with TLS if tlsConfig isn't nil.
+func (a *connArray) Init(addr string, tlsConfig *tls.Config, idleNotify *uint32, enableBatch bool) error {
 	a.target = addr
 
-	opt := grpc.WithTransportCredentials(insecure.NewCredentials())
-	if len(security.ClusterSSLCA) != 0 {
-		tlsConfig, err := security.ToTLSConfig()
-		if err != nil {
-			return errors.WithStack(err)
-		}
-		opt = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
+	a.transportOpt = grpc.WithTransportCredentials(insecure.NewCredentials())
+	if tlsConfig != nil {
+		a.transportOpt = grpc.WithTransportCredentials(credentials.NewTLS(tlsConfig))
 	}
 
 	cfg := config.GetGlobalConfig()
-	var (
-		unaryInterceptor  grpc.UnaryClientInterceptor
-		streamInterceptor grpc.StreamClientInterceptor
-	)
-	if cfg.OpenTracingEnable {
-		unaryInterceptor = grpc_opentracing.UnaryClientInterceptor()
-		streamInterceptor = grpc_opentracing.StreamClientInterceptor()
-	}
-
 	allowBatch := (cfg.TiKVClient.MaxBatchSize > 0) && enableBatch
 	if allowBatch {
 		a.batchConn = newBatchConn(uint(len(a.v)), cfg.TiKVClient.MaxBatchSize, idleNotify)
 		a.pendingRequests = metrics.TiKVBatchPendingRequests.WithLabelValues(a.target)
 		a.batchSize = metrics.TiKVBatchRequests.WithLabelValues(a.target)
 	}
-	keepAlive := cfg.TiKVClient.GrpcKeepAliveTime
-	keepAliveTimeout := cfg.TiKVClient.GrpcKeepAliveTimeout
 	for i := range a.v {
-		ctx, cancel := context.WithTimeout(context.Background(), a.dialTimeout)
-		var callOptions []grpc.CallOption
-		callOptions = append(callOptions, grpc.MaxCallRecvMsgSize(MaxRecvMsgSize))
-		if cfg.TiKVClient.GrpcCompressionType == gzip.Name {
-			callOptions = append(callOptions, grpc.UseCompressor(gzip.Name))
-		}
-		conn, err := grpc.DialContext(
-			ctx,
-			addr,
-			opt,
-			grpc.WithInitialWindowSize(GrpcInitialWindowSize),
-			grpc.WithInitialConnWindowSize(GrpcInitialConnWindowSize),
-			grpc.WithUnaryInterceptor(unaryInterceptor),
-			grpc.WithStreamInterceptor(streamInterceptor),
-			grpc.WithDefaultCallOptions(callOptions...),
-			grpc.WithConnectParams(grpc.ConnectParams{
-				Backoff: backoff.Config{
-					BaseDelay:  100 * time.Millisecond, // Default was 1s.
-					Multiplier: 1.6,                    // Default
-					Jitter:     0.2,                    // Default
-					MaxDelay:   3 * time.Second,        // Default was 120s.
-				},
-				MinConnectTimeout: a.dialTimeout,
-			}),
-			grpc.WithKeepaliveParams(keepalive.ClientParameters{
-				Time:                time.Duration(keepAlive) * time.Second,
-				Timeout:             time.Duration(keepAliveTimeout) * time.Second,
-				PermitWithoutStream: true,
-			}),
-		)
-		cancel()
+		conn, err := a.dial(cfg)
 		if err != nil {
 			// Cleanup if the initialization fails.
 			a.Close()
-			return errors.WithStack(err)
+			return err
 		}
 		a.v[i] = conn
-
-		if allowBatch {
-			batchClient := &batchCommandsClient{
-				target:           a.target,
-				conn:             conn,
-				forwardedClients: make(map[string]*batchCommandsStream),
-				batched:          sync.Map{},
-				epoch:            0,
-				closed:           0,
-				tikvClientCfg:    cfg.TiKVClient,
-				tikvLoad:         &a.tikvTransportLayerLoad,
-				dialTimeout:      a.dialTimeout,
-				tryLock:          tryLock{sync.NewCond(new(sync.Mutex)), false},
-			}
-			a.batchCommandsClients = append(a.batchCommandsClients, batchClient)
+		if conn.batchClient != nil {
+			a.batchCommandsClients = append(a.batchCommandsClients, conn.batchClient)
 		}
 	}
 	go tikvrpc.CheckStreamTimeoutLoop(a.streamTimeout, a.done)
@@ -228,22 +210,207 @@ func (a *connArray) Init(addr string, security config.Security, idleNotify *uint
 	return nil
 }
 
+// dial dials a new connection to the target, with a batch client if batch is enabled.
+func (a *connArray) dial(cfg *config.Config) (*grpcConn, error) {
+	var (
+		unaryInterceptor  grpc.UnaryClientInterceptor
+		streamInterceptor grpc.StreamClientInterceptor
+	)
+	if cfg.OpenTracingEnable {
+		unaryInterceptor = grpc_opentracing.UnaryClientInterceptor()
+		streamInterceptor = grpc_opentracing.StreamClientInterceptor()
+	}
+	keepAlive := cfg.TiKVClient.GrpcKeepAliveTime
+	keepAliveTimeout := cfg.TiKVClient.GrpcKeepAliveTimeout
+
+	ctx, cancel := context.WithTimeout(context.Background(), a.dialTimeout)
+	var callOptions []grpc.CallOption
+	callOptions = append(callOptions, grpc.MaxCallRecvMsgSize(MaxRecvMsgSize))
+	if cfg.TiKVClient.GrpcCompressionType == gzip.Name {
+		callOptions = append(callOptions, grpc.UseCompressor(gzip.Name))
+	}
+	conn, err := grpc.DialContext(
+		ctx,
+		a.target,
+		a.transportOpt,
+		grpc.WithInitialWindowSize(GrpcInitialWindowSize),
+		grpc.WithInitialConnWindowSize(GrpcInitialConnWindowSize),
+		grpc.WithUnaryInterceptor(unaryInterceptor),
+		grpc.WithStreamInterceptor(streamInterceptor),
+		grpc.WithChainUnaryInterceptor(compressorInterceptor),
+		grpc.WithDefaultCallOptions(callOptions...),
+		grpc.WithConnectParams(grpc.ConnectParams{
+			Backoff: backoff.Config{
+				BaseDelay:  100 * time.Millisecond, // Default was 1s.
+				Multiplier: 1.6,                    // Default
+				Jitter:     0.2,                    // Default
+				MaxDelay:   3 * time.Second,        // Default was 120s.
+			},
+			MinConnectTimeout: a.dialTimeout,
+		}),
+		grpc.WithKeepaliveParams(keepalive.ClientParameters{
+			Time:                time.Duration(keepAlive) * time.Second,
+			Timeout:             time.Duration(keepAliveTimeout) * time.Second,
+			PermitWithoutStream: true,
+		}),
+	)
+	cancel()
+	if err != nil {
+		return nil, errors.WithStack(err)
+	}
+
+	c := &grpcConn{ClientConn: conn}
+	if a.batchConn != nil {
+		c.batchClient = &batchCommandsClient{
+			target:           a.target,
+			conn:             conn,
+			forwardedClients: make(map[string]*batchCommandsStream),
+			batched:          sync.Map{},
+			epoch:            0,
+			closed:           0,
+			tikvClientCfg:    cfg.TiKVClient,
+			tikvLoad:         &a.tikvTransportLayerLoad,
+			requests:         &c.requests,
+			dialTimeout:      a.dialTimeout,
+			tryLock:          tryLock{sync.NewCond(new(sync.Mutex)), false},
+		}
+	}
+	return c, nil
+}
+
 func (a *connArray) Get() *grpc.ClientConn {
-	next := atomic.AddUint32(&a.index, 1) % uint32(len(a.v))
-	return a.v[next]
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return a.next().ClientConn
+}
+
+// get chooses a connection by round-robin and acquires it before the connections can be changed by resize, so that
+// it's not closed until the returned function is called, see grpcConn.acquire.
+func (a *connArray) get() (*grpcConn, func()) {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	conn := a.next()
+	return conn, conn.acquire()
+}
+
+// next chooses a connection by round-robin, a.mu must be held.
+func (a *connArray) next() *grpcConn {
+	conn := a.v[atomic.AddUint32(&a.index, 1)%uint32(len(a.v))]
+	atomic.AddUint64(&conn.requests, 1)
+	return conn
+}
+
+// size returns the number of connections in rotation.
+func (a *connArray) size() uint {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	return uint(len(a.v))
+}
+
+// requestCounts returns the number of requests sent over each connection.
+func (a *connArray) requestCounts() []uint64 {
+	a.mu.RLock()
+	defer a.mu.RUnlock()
+	counts := make([]uint64, len(a.v))
+	for i, conn := range a.v {
+		counts[i] = atomic.LoadUint64(&conn.requests)
+	}
+	return counts
+}
+
+// resize grows or shrinks the connections to n. The new connections are dialed before they're put into rotation.
+// The excess connections are removed from rotation at once, and closed after their in-flight requests finish.
+func (a *connArray) resize(n uint) error {
+	a.resizeMu.Lock()
+	defer a.resizeMu.Unlock()
+	select {
+	case <-a.done:
+		return errors.Errorf("connections to %s are closed", a.target)
+	default:
+	}
+
+	size := a.size()
+	if n > size {
+		cfg := config.GetGlobalConfig()
+		conns := make([]*grpcConn, 0, n-size)
+		for i := size; i < n; i++ {
+			conn, err := a.dial(cfg)
+			if err != nil {
+				for _, c := range conns {
+					tikverr.Log(c.Close())
+				}
+				return err
+			}
+			conns = append(conns, conn)
+		}
+		a.mu.Lock()
+		a.v = append(a.v, conns...)
+		a.mu.Unlock()
+		if a.batchConn != nil {
+			a.batchConn.addClients(conns)
+		}
+	} else if n < size {
+		a.mu.Lock()
+		removed := a.v[n:]
+		a.v = a.v[:n:n]
+		a.mu.Unlock()
+		if a.batchConn != nil {
+			a.batchConn.removeClients(removed)
+		}
+		for _, conn := range removed {
+			a.draining.Add(1)
+			go a.drain(conn)
+		}
+	}
+	logutil.BgLogger().Info("resize connection pool",
+		zap.String("target", a.target), zap.Uint("from", size), zap.Uint("to", n))
+	return nil
+}
+
+// drain closes the connection removed from rotation after its in-flight requests finish, or connDrainTimeout
+// elapses, or the connArray is closed.
+func (a *connArray) drain(conn *grpcConn) {
+	defer a.draining.Done()
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+	timeout := time.After(connDrainTimeout)
+	for !conn.idle() {
+		select {
+		case <-ticker.C:
+			continue
+		case <-timeout:
+			logutil.BgLogger().Warn("close connection with requests in progress after drain timeout",
+				zap.String("target", a.target))
+		case <-a.done:
+		}
+		break
+	}
+	if conn.batchClient != nil {
+		// After the connection is closed, `batchRecvLoop`s will check the flag.
+		atomic.StoreInt32(&conn.batchClient.closed, 1)
+	}
+	tikverr.Log(conn.Close())
 }
 
 func (a *connArray) Close() {
+	a.resizeMu.Lock()
+	defer a.resizeMu.Unlock()
 	if a.batchConn != nil {
 		a.batchConn.Close()
 	}
 
+	a.mu.RLock()
 	for _, c := range a.v {
-		err := c.Close()
-		tikverr.Log(err)
+		if c != nil {
+			err := c.Close()
+			tikverr.Log(err)
+		}
 	}
+	a.mu.RUnlock()
 
 	close(a.done)
+	// The draining connections are closed at once after done is closed.
+	a.draining.Wait()
 }
 
 // Opt is the option for the client.
@@ -256,6 +423,28 @@ func WithSecurity(security config.Security) Opt {
 	}
 }
 
+// ConnPoolAutoResize configures RPCClient to resize the connection pool of each address by the number of requests
+// in progress to it.
+type ConnPoolAutoResize struct {
+	// MinConns and MaxConns bound the number of connections to an address.
+	MinConns uint
+	MaxConns uint
+	// GrowThreshold is the number of in-flight requests per connection above which a connection is added.
+	GrowThreshold uint
+	// ShrinkThreshold is the number of in-flight requests per connection below which a connection is removed.
+	// It should be less than GrowThreshold.
+	ShrinkThreshold uint
+	// Interval is how often the in-flight requests are checked.
+	Interval time.Duration
+}
+
+// WithConnPoolAutoResize makes the client resize the connection pools automatically, see ConnPoolAutoResize.
+func WithConnPoolAutoResize(cfg ConnPoolAutoResize) Opt {
+	return func(c *RPCClient) {
+		c.autoResize = &cfg
+	}
+}
+
 // RPCClient is RPC client struct.
 // TODO: Add flow control between RPC clients in TiDB ond RPC servers in TiKV.
 // Since we use shared client connection to communicate to the same TiKV, it's possible
@@ -265,6 +454,13 @@ type RPCClient struct {
 
 	conns    map[string]*connArray
 	security config.Security
+	// tlsConfig is loaded from security once and shared by all the connections. A failed load isn't cached, so that
+	// it's loaded again after the certificates are fixed.
+	tlsConfig struct {
+		sync.Mutex
+		loaded bool
+		config *tls.Config
+	}
 
 	idleNotify uint32
 
@@ -272,6 +468,10 @@ type RPCClient struct {
 	// Implement background cleanup.
 	isClosed    bool
 	dialTimeout time.Duration
+
+	autoResize *ConnPoolAutoResize
+	done       chan struct{}
+	wg         sync.WaitGroup
 }
 
 // NewRPCClient creates a client that manages connections and rpc calls with tikv-servers.
@@ -279,18 +479,49 @@ func NewRPCClient(opts ...Opt) *RPCClient {
 	cli := &RPCClient{
 		conns:       make(map[string]*connArray),
 		dialTimeout: dialTimeout,
+		done:        make(chan struct{}),
 	}
 	for _, opt := range opts {
 		opt(cli)
 	}
+	if cli.autoResize != nil && cli.autoResize.Interval > 0 {
+		cli.wg.Add(1)
+		go cli.autoResizeConnPools(*cli.autoResize)
+	}
 	return cli
 }
 
+// ValidateSecurity loads the TLS config from the security config set by WithSecurity, so that a misconfigured
+// certificate is reported up front instead of on the first request. The loaded TLS config is shared by all the
+// connections of the client.
+func (c *RPCClient) ValidateSecurity() error {
+	_, err := c.getTLSConfig()
+	return err
+}
+
+// getTLSConfig returns the TLS config of the client, it's nil if TLS isn't enabled.
+func (c *RPCClient) getTLSConfig() (*tls.Config, error) {
+	c.tlsConfig.Lock()
+	defer c.tlsConfig.Unlock()
+	if c.tlsConfig.loaded {
+		return c.tlsConfig.config, nil
+	}
+	if len(c.security.ClusterSSLCA) != 0 {
+		tlsConfig, err := c.security.ToTLSConfig()
+		if err != nil {
+			return nil, errors.WithMessage(err, "invalid security config")
+		}
+		c.tlsConfig.config = tlsConfig
+	}
+	c.tlsConfig.loaded = true
+	return c.tlsConfig.config, nil
+}
+
 func (c *RPCClient) getConnArray(addr string, enableBatch bool, opt ...func(cfg *config.TiKVClient)) (*connArray, error) {
 	c.RLock()
 	if c.isClosed {
 		c.RUnlock()
-		return nil, errors.Errorf("rpcClient is closed")
+		return nil, errors.WithStack(tikverr.ErrClientClosed)
 	}
 	array, ok := c.conns[addr]
 	c.RUnlock()
@@ -314,14 +545,20 @@ func (c *RPCClient) getConnArray(addr string, enableBatch bool, opt ...func(cfg
 func (c *RPCClient) createConnArray(addr string, enableBatch bool, opts ...func(cfg *config.TiKVClient)) (*connArray, error) {
 	c.Lock()
 	defer c.Unlock()
+	if c.isClosed {
+		return nil, errors.WithStack(tikverr.ErrClientClosed)
+	}
 	array, ok := c.conns[addr]
 	if !ok {
-		var err error
 		client := config.GetGlobalConfig().TiKVClient
 		for _, opt := range opts {
 			opt(&client)
 		}
-		array, err = newConnArray(client.GrpcConnectionCount, addr, c.security, &c.idleNotify, enableBatch, c.dialTimeout)
+		tlsConfig, err := c.getTLSConfig()
+		if err != nil {
+			return nil, err
+		}
+		array, err = newConnArray(client.GrpcConnectionCount, addr, tlsConfig, &c.idleNotify, enableBatch, c.dialTimeout)
 		if err != nil {
 			return nil, err
 		}
@@ -334,6 +571,7 @@ func (c *RPCClient) closeConns() {
 	c.Lock()
 	if !c.isClosed {
 		c.isClosed = true
+		close(c.done)
 		// close all connections
 		for _, array := range c.conns {
 			array.Close()
@@ -342,30 +580,9 @@ func (c *RPCClient) closeConns() {
 	c.Unlock()
 }
 
-var sendReqHistCache sync.Map
-
-type sendReqHistCacheKey struct {
-	tp       tikvrpc.CmdType
-	id       uint64
-	staleRad bool
-}
-
 func (c *RPCClient) updateTiKVSendReqHistogram(req *tikvrpc.Request, start time.Time, staleRead bool) {
-	key := sendReqHistCacheKey{
-		req.Type,
-		req.Context.GetPeer().GetStoreId(),
-		staleRead,
-	}
-
-	v, ok := sendReqHistCache.Load(key)
-	if !ok {
-		reqType := req.Type.String()
-		storeID := strconv.FormatUint(req.Context.GetPeer().GetStoreId(), 10)
-		v = metrics.TiKVSendReqHistogram.WithLabelValues(reqType, storeID, strconv.FormatBool(staleRead))
-		sendReqHistCache.Store(key, v)
-	}
-
-	v.(prometheus.Observer).Observe(time.Since(start).Seconds())
+	metrics.SendReqHistogramWith(req.Type.String(), req.Context.GetPeer().GetStoreId(), staleRead).
+		Observe(time.Since(start).Seconds())
 }
 
 // SendRequest sends a Request to server and receives Response.
@@ -386,6 +603,15 @@ func (c *RPCClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.R
 	if err != nil {
 		return nil, err
 	}
+	// The gauge is kept for the deferred Dec, so the series isn't recreated if the store is removed meanwhile.
+	storeID := req.Context.GetPeer().GetStoreId()
+	inflightGauge := metrics.TiKVInflightRequests.WithLabelValues(strconv.FormatUint(storeID, 10))
+	atomic.AddInt64(&connArray.inflight, 1)
+	inflightGauge.Inc()
+	defer func() {
+		atomic.AddInt64(&connArray.inflight, -1)
+		inflightGauge.Dec()
+	}()
 
 	start := time.Now()
 	staleRead := req.GetStaleRead()
@@ -400,20 +626,33 @@ func (c *RPCClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.R
 
 	// TiDB RPC server supports batch RPC, but batch connection will send heart beat, It's not necessary since
 	// request to TiDB is not high frequency.
-	if config.GetGlobalConfig().TiKVClient.MaxBatchSize > 0 && enableBatch {
-		if batchReq := req.ToBatchCommandsRequest(); batchReq != nil {
+	// The connArray still enables batch for a request with ForceUnary, so that later requests to the address can be
+	// batched.
+	if config.GetGlobalConfig().TiKVClient.MaxBatchSize > 0 && enableBatch && !req.ForceUnary {
+		if batchReq := req.ToBatchCommandsRequest(); batchReq != nil && req.UseCompressor == "" && !req.HasUnbatchableMetadata() && connArray.batchConn.useBatch() {
 			defer trace.StartRegion(ctx, req.Type.String()).End()
-			return sendBatchRequest(ctx, addr, req.ForwardedHost, connArray.batchConn, batchReq, timeout)
+			resp, err := sendBatchRequest(ctx, addr, req.ForwardedHost, connArray.batchConn, batchReq, req.LowPriorityBatch, timeout)
+			if !isBatchUnimplemented(err) {
+				if err == nil {
+					connArray.batchConn.upgrade(addr)
+				}
+				return resp, err
+			}
+			// The server doesn't support the BatchCommands stream, retry it by a unary call.
+			connArray.batchConn.downgrade(addr, storeID, err)
 		}
 	}
 
-	clientConn := connArray.Get()
+	// Keep the connection from being closed by resize before the call or stream finishes.
+	conn, release := connArray.get()
+	clientConn := conn.ClientConn
 	if state := clientConn.GetState(); state == connectivity.TransientFailure {
-		storeID := strconv.FormatUint(req.Context.GetPeer().GetStoreId(), 10)
-		metrics.TiKVGRPCConnTransientFailureCounter.WithLabelValues(addr, storeID).Inc()
+		metrics.TiKVGRPCConnTransientFailureCounter.WithLabelValues(addr, strconv.FormatUint(storeID, 10)).Inc()
 	}
 
+	ctx = appendRequestMetadata(ctx, req)
 	if req.IsDebugReq() {
+		defer release()
 		client := debugpb.NewDebugClient(clientConn)
 		ctx1, cancel := context.WithTimeout(ctx, timeout)
 		defer cancel()
@@ -428,19 +667,49 @@ func (c *RPCClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.R
 	}
 	switch req.Type {
 	case tikvrpc.CmdBatchCop:
-		return c.getBatchCopStreamResponse(ctx, client, req, timeout, connArray)
+		return c.getBatchCopStreamResponse(ctx, client, req, timeout, connArray, release)
 	case tikvrpc.CmdCopStream:
-		return c.getCopStreamResponse(ctx, client, req, timeout, connArray)
+		return c.getCopStreamResponse(ctx, client, req, timeout, connArray, release)
 	case tikvrpc.CmdMPPConn:
-		return c.getMPPStreamResponse(ctx, client, req, timeout, connArray)
+		return c.getMPPStreamResponse(ctx, client, req, timeout, connArray, release)
 	}
 	// Or else it's a unary call.
+	defer release()
+	if req.UseCompressor != "" {
+		ctx = context.WithValue(ctx, compressorCtxKey{}, req.UseCompressor)
+	}
 	ctx1, cancel := context.WithTimeout(ctx, timeout)
 	defer cancel()
 	return tikvrpc.CallRPC(ctx1, client, req)
 }
 
-func (c *RPCClient) getCopStreamResponse(ctx context.Context, client tikvpb.TikvClient, req *tikvrpc.Request, timeout time.Duration, connArray *connArray) (*tikvrpc.Response, error) {
+// appendRequestMetadata appends the custom metadata of the request to the outgoing context. The forwarding metadata is
+// reserved and set by ForwardedHost only.
+func appendRequestMetadata(ctx context.Context, req *tikvrpc.Request) context.Context {
+	if len(req.Metadata) == 0 {
+		return ctx
+	}
+	pairs := make([]string, 0, 2*len(req.Metadata))
+	for k, v := range req.Metadata {
+		if strings.EqualFold(k, forwardMetadataKey) {
+			continue
+		}
+		pairs = append(pairs, k, v)
+	}
+	return metadata.AppendToOutgoingContext(ctx, pairs...)
+}
+
+type compressorCtxKey struct{}
+
+// compressorInterceptor compresses unary requests with the compressor set by tikvrpc.Request.UseCompressor.
+func compressorInterceptor(ctx context.Context, method string, req, reply interface{}, cc *grpc.ClientConn, invoker grpc.UnaryInvoker, opts ...grpc.CallOption) error {
+	if name, ok := ctx.Value(compressorCtxKey{}).(string); ok {
+		opts = append(opts, grpc.UseCompressor(name))
+	}
+	return invoker(ctx, method, req, reply, cc, opts...)
+}
+
+func (c *RPCClient) getCopStreamResponse(ctx context.Context, client tikvpb.TikvClient, req *tikvrpc.Request, timeout time.Duration, connArray *connArray, release func()) (*tikvrpc.Response, error) {
 	// Coprocessor streaming request.
 	// Use context to support timeout for grpc streaming client.
 	ctx1, cancel := context.WithCancel(ctx)
@@ -450,13 +719,17 @@ func (c *RPCClient) getCopStreamResponse(ctx context.Context, client tikvpb.Tikv
 	resp, err := tikvrpc.CallRPC(ctx1, client, req)
 	if err != nil {
 		cancel()
+		release()
 		return nil, err
 	}
 
 	// Put the lease object to the timeout channel, so it would be checked periodically.
 	copStream := resp.Resp.(*tikvrpc.CopStreamResponse)
 	copStream.Timeout = timeout
-	copStream.Lease.Cancel = cancel
+	copStream.Lease.Cancel = func() {
+		cancel()
+		release()
+	}
 	connArray.streamTimeout <- &copStream.Lease
 
 	// Read the first streaming response to get CopStreamResponse.
@@ -466,6 +739,7 @@ func (c *RPCClient) getCopStreamResponse(ctx context.Context, client tikvpb.Tikv
 	first, err = copStream.Recv()
 	if err != nil {
 		if errors.Cause(err) != io.EOF {
+			release()
 			return nil, errors.WithStack(err)
 		}
 		logutil.BgLogger().Debug("copstream returns nothing for the request.")
@@ -475,7 +749,7 @@ func (c *RPCClient) getCopStreamResponse(ctx context.Context, client tikvpb.Tikv
 
 }
 
-func (c *RPCClient) getBatchCopStreamResponse(ctx context.Context, client tikvpb.TikvClient, req *tikvrpc.Request, timeout time.Duration, connArray *connArray) (*tikvrpc.Response, error) {
+func (c *RPCClient) getBatchCopStreamResponse(ctx context.Context, client tikvpb.TikvClient, req *tikvrpc.Request, timeout time.Duration, connArray *connArray, release func()) (*tikvrpc.Response, error) {
 	// Coprocessor streaming request.
 	// Use context to support timeout for grpc streaming client.
 	ctx1, cancel := context.WithCancel(ctx)
@@ -485,13 +759,17 @@ func (c *RPCClient) getBatchCopStreamResponse(ctx context.Context, client tikvpb
 	resp, err := tikvrpc.CallRPC(ctx1, client, req)
 	if err != nil {
 		cancel()
+		release()
 		return nil, err
 	}
 
 	// Put the lease object to the timeout channel, so it would be checked periodically.
 	copStream := resp.Resp.(*tikvrpc.BatchCopStreamResponse)
 	copStream.Timeout = timeout
-	copStream.Lease.Cancel = cancel
+	copStream.Lease.Cancel = func() {
+		cancel()
+		release()
+	}
 	connArray.streamTimeout <- &copStream.Lease
 
 	// Read the first streaming response to get CopStreamResponse.
@@ -501,6 +779,7 @@ func (c *RPCClient) getBatchCopStreamResponse(ctx context.Context, client tikvpb
 	first, err = copStream.Recv()
 	if err != nil {
 		if errors.Cause(err) != io.EOF {
+			release()
 			return nil, errors.WithStack(err)
 		}
 		logutil.BgLogger().Debug("batch copstream returns nothing for the request.")
@@ -509,7 +788,7 @@ func (c *RPCClient) getBatchCopStreamResponse(ctx context.Context, client tikvpb
 	return resp, nil
 }
 
-func (c *RPCClient) getMPPStreamResponse(ctx context.Context, client tikvpb.TikvClient, req *tikvrpc.Request, timeout time.Duration, connArray *connArray) (*tikvrpc.Response, error) {
+func (c *RPCClient) getMPPStreamResponse(ctx context.Context, client tikvpb.TikvClient, req *tikvrpc.Request, timeout time.Duration, connArray *connArray, release func()) (*tikvrpc.Response, error) {
 	// MPP streaming request.
 	// Use context to support timeout for grpc streaming client.
 	ctx1, cancel := context.WithCancel(ctx)
@@ -519,13 +798,17 @@ func (c *RPCClient) getMPPStreamResponse(ctx context.Context, client tikvpb.Tikv
 	resp, err := tikvrpc.CallRPC(ctx1, client, req)
 	if err != nil {
 		cancel()
+		release()
 		return nil, err
 	}
 
 	// Put the lease object to the timeout channel, so it would be checked periodically.
 	copStream := resp.Resp.(*tikvrpc.MPPStreamResponse)
 	copStream.Timeout = timeout
-	copStream.Lease.Cancel = cancel
+	copStream.Lease.Cancel = func() {
+		cancel()
+		release()
+	}
 	connArray.streamTimeout <- &copStream.Lease
 
 	// Read the first streaming response to get CopStreamResponse.
@@ -535,6 +818,7 @@ func (c *RPCClient) getMPPStreamResponse(ctx context.Context, client tikvpb.Tikv
 	first, err = copStream.Recv()
 	if err != nil {
 		if errors.Cause(err) != io.EOF {
+			release()
 			return nil, errors.WithStack(err)
 		}
 	}
@@ -546,9 +830,99 @@ func (c *RPCClient) getMPPStreamResponse(ctx context.Context, client tikvpb.Tikv
 func (c *RPCClient) Close() error {
 	// TODO: add a unit test for SendRequest After Closed
 	c.closeConns()
+	c.wg.Wait()
 	return nil
 }
 
+// GetPendingBatchRequests returns the number of requests waiting in the batch queue to the address.
+// It returns 0 if there is no batch connection to the address.
+func (c *RPCClient) GetPendingBatchRequests(addr string) int {
+	c.RLock()
+	array, ok := c.conns[addr]
+	c.RUnlock()
+	if !ok || array.batchConn == nil {
+		return 0
+	}
+	return array.batchConn.pendingRequestCount()
+}
+
+// GetConnRequestCounts returns the number of requests sent over each gRPC connection, grouped by address. It shows
+// how evenly the requests are spread over the connections, which helps to tune GrpcConnectionCount.
+func (c *RPCClient) GetConnRequestCounts() map[string][]uint64 {
+	c.RLock()
+	defer c.RUnlock()
+	counts := make(map[string][]uint64, len(c.conns))
+	for addr, array := range c.conns {
+		counts[addr] = array.requestCounts()
+	}
+	return counts
+}
+
+// GetConnCount returns the number of gRPC connections in rotation to the address, or 0 if there is no connection.
+func (c *RPCClient) GetConnCount(addr string) int {
+	c.RLock()
+	array, ok := c.conns[addr]
+	c.RUnlock()
+	if !ok {
+		return 0
+	}
+	return int(array.size())
+}
+
+// ResizeConnPool grows or shrinks the gRPC connections to the address to n. The excess connections are removed from
+// rotation at once, and closed after the requests in progress over them finish.
+func (c *RPCClient) ResizeConnPool(addr string, n uint) error {
+	if n == 0 {
+		return errors.New("the connection pool size must be positive")
+	}
+	c.RLock()
+	array, ok := c.conns[addr]
+	c.RUnlock()
+	if !ok {
+		return errors.Errorf("no connection to %s", addr)
+	}
+	return array.resize(n)
+}
+
+// autoResizeConnPools adds a connection to an address when the in-flight requests per connection exceed
+// GrowThreshold, and removes one when they drop below ShrinkThreshold.
+func (c *RPCClient) autoResizeConnPools(cfg ConnPoolAutoResize) {
+	defer c.wg.Done()
+	ticker := time.NewTicker(cfg.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.done:
+			return
+		case <-ticker.C:
+		}
+
+		c.RLock()
+		arrays := make([]*connArray, 0, len(c.conns))
+		for _, array := range c.conns {
+			arrays = append(arrays, array)
+		}
+		c.RUnlock()
+		for _, array := range arrays {
+			size := array.size()
+			inflight := uint(atomic.LoadInt64(&array.inflight))
+			n := size
+			if inflight > cfg.GrowThreshold*size && size < cfg.MaxConns {
+				n = size + 1
+			} else if inflight < cfg.ShrinkThreshold*size && size > cfg.MinConns && size > 1 {
+				n = size - 1
+			}
+			if n == size {
+				continue
+			}
+			if err := array.resize(n); err != nil {
+				logutil.BgLogger().Info("failed to resize connection pool",
+					zap.String("target", array.target), zap.Error(err))
+			}
+		}
+	}
+}
+
 // CloseAddr closes gRPC connections to the address.
 func (c *RPCClient) CloseAddr(addr string) error {
 	c.Lock()
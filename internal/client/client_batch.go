@@ -39,6 +39,7 @@ import (
 	"context"
 	"math"
 	"runtime/trace"
+	"strconv"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -55,8 +56,10 @@ import (
 	"github.com/tikv/client-go/v2/util"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
 	"google.golang.org/grpc/connectivity"
 	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
 )
 
 type batchCommandsEntry struct {
@@ -182,7 +185,12 @@ type batchConn struct {
 	idle uint32
 
 	// batchCommandsCh used for batch commands.
-	batchCommandsCh        chan *batchCommandsEntry
+	batchCommandsCh chan *batchCommandsEntry
+	// lowPriorityCh is used for batch commands with low priority, e.g. resolving locks in the background.
+	// They're fetched only when there is no pending request in batchCommandsCh.
+	lowPriorityCh chan *batchCommandsEntry
+	// clientsMu protects batchCommandsClients from being changed by resize while requests are sent.
+	clientsMu              sync.RWMutex
 	batchCommandsClients   []*batchCommandsClient
 	tikvTransportLayerLoad uint64
 	closed                 chan struct{}
@@ -195,13 +203,33 @@ type batchConn struct {
 
 	pendingRequests prometheus.Observer
 	batchSize       prometheus.Observer
+	// downgraded is the prometheus.Gauge of the store the connection is downgraded for, it's set by downgrade.
+	downgraded atomic.Value
+
+	// downgradedAt is the time in unix nanoseconds when the server is found not supporting the BatchCommands
+	// stream, or 0 if it supports. Requests are sent by unary calls while it's downgraded.
+	downgradedAt int64
 
 	index uint32
 }
 
+// batchDowngradeProbeInterval is the interval to check whether a server which doesn't support the BatchCommands
+// stream supports it again, e.g., after it's upgraded.
+var batchDowngradeProbeInterval = 3 * time.Minute
+
+// batchStreamSetupFailureLimit is the number of consecutive failures to set up the BatchCommands stream after which
+// the server is regarded as not supporting the stream.
+const batchStreamSetupFailureLimit = 3
+
+// isBatchUnimplemented returns whether the error means the server doesn't support the BatchCommands stream.
+func isBatchUnimplemented(err error) bool {
+	return err != nil && status.Code(errors.Cause(err)) == codes.Unimplemented
+}
+
 func newBatchConn(connCount, maxBatchSize uint, idleNotify *uint32) *batchConn {
 	return &batchConn{
 		batchCommandsCh:        make(chan *batchCommandsEntry, maxBatchSize),
+		lowPriorityCh:          make(chan *batchCommandsEntry, maxBatchSize),
 		batchCommandsClients:   make([]*batchCommandsClient, 0, connCount),
 		tikvTransportLayerLoad: 0,
 		closed:                 make(chan struct{}),
@@ -211,10 +239,57 @@ func newBatchConn(connCount, maxBatchSize uint, idleNotify *uint32) *batchConn {
 	}
 }
 
+// useBatch returns whether requests should be sent by the BatchCommands stream. It returns false if the server
+// doesn't support the stream, except for one request in every batchDowngradeProbeInterval to probe it again.
+func (a *batchConn) useBatch() bool {
+	downgradedAt := atomic.LoadInt64(&a.downgradedAt)
+	if downgradedAt == 0 {
+		return true
+	}
+	now := time.Now().UnixNano()
+	if now-downgradedAt < int64(batchDowngradeProbeInterval) {
+		return false
+	}
+	return atomic.CompareAndSwapInt64(&a.downgradedAt, downgradedAt, now)
+}
+
+// downgrade makes requests sent by unary calls because the server doesn't support the BatchCommands stream.
+func (a *batchConn) downgrade(target string, storeID uint64, err error) {
+	if atomic.SwapInt64(&a.downgradedAt, time.Now().UnixNano()) != 0 {
+		return
+	}
+	logutil.BgLogger().Warn("server doesn't support batch commands, downgrade to unary calls",
+		zap.String("target", target), zap.Uint64("store", storeID), zap.Error(err))
+	gauge := metrics.TiKVBatchClientDowngraded.WithLabelValues(strconv.FormatUint(storeID, 10))
+	gauge.Set(1)
+	a.downgraded.Store(gauge)
+}
+
+// resetDowngraded resets the downgraded gauge set by downgrade.
+func (a *batchConn) resetDowngraded() {
+	if gauge, ok := a.downgraded.Load().(prometheus.Gauge); ok {
+		gauge.Set(0)
+	}
+}
+
+// upgrade makes requests sent by the BatchCommands stream again after a probe succeeds.
+func (a *batchConn) upgrade(target string) {
+	if atomic.LoadInt64(&a.downgradedAt) == 0 || atomic.SwapInt64(&a.downgradedAt, 0) == 0 {
+		return
+	}
+	logutil.BgLogger().Info("server supports batch commands again", zap.String("target", target))
+	a.resetDowngraded()
+}
+
 func (a *batchConn) isIdle() bool {
 	return atomic.LoadUint32(&a.idle) != 0
 }
 
+// pendingRequestCount returns the number of requests waiting to be fetched by the batch send loop.
+func (a *batchConn) pendingRequestCount() int {
+	return len(a.batchCommandsCh) + len(a.lowPriorityCh)
+}
+
 // fetchAllPendingRequests fetches all pending requests from the channel.
 func (a *batchConn) fetchAllPendingRequests(
 	maxBatchSize int,
@@ -223,10 +298,7 @@ func (a *batchConn) fetchAllPendingRequests(
 	var headEntry *batchCommandsEntry
 	select {
 	case headEntry = <-a.batchCommandsCh:
-		if !a.idleDetect.Stop() {
-			<-a.idleDetect.C
-		}
-		a.idleDetect.Reset(idleTimeout)
+	case headEntry = <-a.lowPriorityCh:
 	case <-a.idleDetect.C:
 		a.idleDetect.Reset(idleTimeout)
 		atomic.AddUint32(&a.idle, 1)
@@ -236,24 +308,18 @@ func (a *batchConn) fetchAllPendingRequests(
 	case <-a.closed:
 		return time.Now()
 	}
+	if !a.idleDetect.Stop() {
+		<-a.idleDetect.C
+	}
+	a.idleDetect.Reset(idleTimeout)
 	if headEntry == nil {
 		return time.Now()
 	}
 	ts := time.Now()
 	a.reqBuilder.push(headEntry)
 
-	// This loop is for trying best to collect more requests.
-	for a.reqBuilder.len() < maxBatchSize {
-		select {
-		case entry := <-a.batchCommandsCh:
-			if entry == nil {
-				return ts
-			}
-			a.reqBuilder.push(entry)
-		default:
-			return ts
-		}
-	}
+	// Try best to collect more requests.
+	a.collectPendingRequests(maxBatchSize)
 	return ts
 }
 
@@ -272,6 +338,11 @@ func (a *batchConn) fetchMorePendingRequests(
 				return
 			}
 			a.reqBuilder.push(entry)
+		case entry := <-a.lowPriorityCh:
+			if entry == nil {
+				return
+			}
+			a.reqBuilder.push(entry)
 		case <-after.C:
 			return
 		}
@@ -281,6 +352,12 @@ func (a *batchConn) fetchMorePendingRequests(
 	// Do an additional non-block try. Here we test the length with `maxBatchSize` instead
 	// of `batchWaitSize` because trying best to fetch more requests is necessary so that
 	// we can adjust the `batchWaitSize` dynamically.
+	a.collectPendingRequests(maxBatchSize)
+}
+
+// collectPendingRequests fetches pending requests without blocking until the batch is full.
+// Low priority requests are fetched only when there is no pending normal request.
+func (a *batchConn) collectPendingRequests(maxBatchSize int) {
 	for a.reqBuilder.len() < maxBatchSize {
 		select {
 		case entry := <-a.batchCommandsCh:
@@ -288,6 +365,15 @@ func (a *batchConn) fetchMorePendingRequests(
 				return
 			}
 			a.reqBuilder.push(entry)
+			continue
+		default:
+		}
+		select {
+		case entry := <-a.lowPriorityCh:
+			if entry == nil {
+				return
+			}
+			a.reqBuilder.push(entry)
 		default:
 			return
 		}
@@ -328,7 +414,7 @@ func (a *batchConn) batchSendLoop(cfg config.TiKVClient) {
 				a.fetchMorePendingRequests(int(cfg.MaxBatchSize), int(bestBatchWaitSize), cfg.MaxBatchWaitTime)
 			}
 		}
-		a.pendingRequests.Observe(float64(len(a.batchCommandsCh)))
+		a.pendingRequests.Observe(float64(a.pendingRequestCount()))
 		a.batchSize.Observe(float64(a.reqBuilder.len()))
 		length := a.reqBuilder.len()
 		if uint(length) == 0 {
@@ -346,7 +432,40 @@ func (a *batchConn) batchSendLoop(cfg config.TiKVClient) {
 	}
 }
 
+// addClients puts the batch clients of the new connections into rotation.
+func (a *batchConn) addClients(conns []*grpcConn) {
+	a.clientsMu.Lock()
+	defer a.clientsMu.Unlock()
+	for _, conn := range conns {
+		a.batchCommandsClients = append(a.batchCommandsClients, conn.batchClient)
+	}
+}
+
+// removeClients takes the batch clients of the connections out of rotation. It waits for the ongoing send, so the
+// clients won't be used to send requests after it returns.
+func (a *batchConn) removeClients(conns []*grpcConn) {
+	a.clientsMu.Lock()
+	defer a.clientsMu.Unlock()
+	clients := make([]*batchCommandsClient, 0, len(a.batchCommandsClients))
+	for _, cli := range a.batchCommandsClients {
+		removed := false
+		for _, conn := range conns {
+			if conn.batchClient == cli {
+				removed = true
+				break
+			}
+		}
+		if !removed {
+			clients = append(clients, cli)
+		}
+	}
+	a.batchCommandsClients = clients
+}
+
 func (a *batchConn) getClientAndSend() {
+	a.clientsMu.RLock()
+	defer a.clientsMu.RUnlock()
+
 	// Choose a connection by round-robbin.
 	var (
 		cli    *batchCommandsClient
@@ -378,9 +497,11 @@ func (a *batchConn) getClientAndSend() {
 		}
 	})
 	if req != nil {
+		cli.countRequests(len(req.RequestIds))
 		cli.send("", req)
 	}
 	for forwardedHost, req := range forwardingReqs {
+		cli.countRequests(len(req.RequestIds))
 		cli.send(forwardedHost, req)
 	}
 }
@@ -484,6 +605,8 @@ type batchCommandsClient struct {
 	tikvClientCfg config.TiKVClient
 	tikvLoad      *uint64
 	dialTimeout   time.Duration
+	// requests points to the request counter of the connection in the connArray.
+	requests *uint64
 
 	// Increased in each reconnection.
 	// It's used to prevent the connection from reconnecting multiple times
@@ -493,12 +616,21 @@ type batchCommandsClient struct {
 	closed int32
 	// tryLock protects client when re-create the streaming.
 	tryLock
+	// setupFailures is the number of consecutive failures to set up a stream after the connection is ready.
+	// It's protected by tryLock.
+	setupFailures int
 }
 
 func (c *batchCommandsClient) isStopped() bool {
 	return atomic.LoadInt32(&c.closed) != 0
 }
 
+func (c *batchCommandsClient) countRequests(n int) {
+	if c.requests != nil {
+		atomic.AddUint64(c.requests, uint64(n))
+	}
+}
+
 func (c *batchCommandsClient) send(forwardedHost string, req *tikvpb.BatchCommandsRequest) {
 	err := c.initBatchClient(forwardedHost)
 	if err != nil {
@@ -508,6 +640,10 @@ func (c *batchCommandsClient) send(forwardedHost string, req *tikvpb.BatchComman
 			zap.String("forwardedHost", forwardedHost),
 			zap.Error(err),
 		)
+		if c.setupFailures >= batchStreamSetupFailureLimit {
+			// Let the requests fall back to unary calls.
+			err = status.Errorf(codes.Unimplemented, "failed to set up batch commands stream %d times: %v", c.setupFailures, err)
+		}
 		c.failPendingRequests(err)
 		return
 	}
@@ -606,6 +742,11 @@ func (c *batchCommandsClient) batchRecvLoop(cfg config.TiKVClient, tikvTransport
 			if c.isStopped() {
 				return
 			}
+			if isBatchUnimplemented(err) {
+				// Recreating the stream doesn't help, so drop it and let the next send create it again.
+				c.dropStream(err, streamClient)
+				return
+			}
 			logutil.BgLogger().Info(
 				"batchRecvLoop fails when receiving, needs to reconnect",
 				zap.String("target", c.target),
@@ -651,6 +792,27 @@ func (c *batchCommandsClient) batchRecvLoop(cfg config.TiKVClient, tikvTransport
 	}
 }
 
+// dropStream fails all pending requests and drops the stream, the next send will create a new one.
+func (c *batchCommandsClient) dropStream(err error, streamClient *batchCommandsStream) {
+	c.lockForRecreate()
+	defer c.unlockForRecreate()
+
+	logutil.BgLogger().Info(
+		"batchRecvLoop drops the streaming because the server doesn't support it",
+		zap.String("target", c.target),
+		zap.String("forwardedHost", streamClient.forwardedHost),
+		zap.Error(err),
+	)
+	c.failPendingRequests(err)
+	if streamClient.forwardedHost == "" {
+		if c.client == streamClient {
+			c.client = nil
+		}
+	} else if c.forwardedClients[streamClient.forwardedHost] == streamClient {
+		delete(c.forwardedClients, streamClient.forwardedHost)
+	}
+}
+
 func (c *batchCommandsClient) recreateStreamingClient(err error, streamClient *batchCommandsStream, epoch *uint64) (stopped bool) {
 	// Forbids the batchSendLoop using the old client and
 	// blocks other streams trying to recreate.
@@ -729,8 +891,10 @@ func (c *batchCommandsClient) initBatchClient(forwardedHost string) error {
 
 	streamClient, err := c.newBatchStream(forwardedHost)
 	if err != nil {
+		c.setupFailures++
 		return err
 	}
+	c.setupFailures = 0
 	if forwardedHost == "" {
 		c.client = streamClient
 	} else {
@@ -742,10 +906,13 @@ func (c *batchCommandsClient) initBatchClient(forwardedHost string) error {
 
 func (a *batchConn) Close() {
 	// Close all batchRecvLoop.
+	a.clientsMu.RLock()
 	for _, c := range a.batchCommandsClients {
 		// After connections are closed, `batchRecvLoop`s will check the flag.
 		atomic.StoreInt32(&c.closed, 1)
 	}
+	a.clientsMu.RUnlock()
+	a.resetDowngraded()
 	// Don't close(batchCommandsCh) because when Close() is called, someone maybe
 	// calling SendRequest and writing batchCommandsCh, if we close it here the
 	// writing goroutine will panic.
@@ -758,6 +925,7 @@ func sendBatchRequest(
 	forwardedHost string,
 	batchConn *batchConn,
 	req *tikvpb.BatchCommandsRequest_Request,
+	lowPriority bool,
 	timeout time.Duration,
 ) (*tikvrpc.Response, error) {
 	entry := &batchCommandsEntry{
@@ -768,12 +936,16 @@ func sendBatchRequest(
 		canceled:      0,
 		err:           nil,
 	}
+	entryCh := batchConn.batchCommandsCh
+	if lowPriority {
+		entryCh = batchConn.lowPriorityCh
+	}
 	timer := time.NewTimer(timeout)
 	defer timer.Stop()
 
 	start := time.Now()
 	select {
-	case batchConn.batchCommandsCh <- entry:
+	case entryCh <- entry:
 	case <-ctx.Done():
 		logutil.BgLogger().Warn("send request is cancelled",
 			zap.String("to", addr), zap.String("cause", ctx.Err().Error()))
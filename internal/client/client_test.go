@@ -36,7 +36,17 @@ package client
 
 import (
 	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
 	"fmt"
+	"math"
+	"math/big"
+	"os"
+	"path/filepath"
 	"sync"
 	"sync/atomic"
 	"testing"
@@ -50,8 +60,11 @@ import (
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
 	"github.com/tikv/client-go/v2/config"
+	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/tikvrpc"
+	"google.golang.org/grpc"
 	"google.golang.org/grpc/connectivity"
+	"google.golang.org/grpc/encoding/gzip"
 	"google.golang.org/grpc/metadata"
 )
 
@@ -79,7 +92,7 @@ func TestConn(t *testing.T) {
 
 	client.Close()
 	conn4, err := client.getConnArray(addr, true)
-	assert.NotNil(t, err)
+	assert.True(t, errors.Is(err, tikverr.ErrClientClosed))
 	assert.Nil(t, conn4)
 }
 
@@ -95,16 +108,204 @@ func TestGetConnAfterClose(t *testing.T) {
 	assert.True(t, state == connectivity.Shutdown)
 }
 
+func TestGetConnRequestCounts(t *testing.T) {
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.GrpcConnectionCount = 4
+	})()
+
+	client := NewRPCClient()
+	defer client.Close()
+	assert.Empty(t, client.GetConnRequestCounts())
+
+	addr := "127.0.0.1:6379"
+	connArray, err := client.getConnArray(addr, false)
+	assert.Nil(t, err)
+	assert.Equal(t, map[string][]uint64{addr: {0, 0, 0, 0}}, client.GetConnRequestCounts())
+	for i := 0; i < 10; i++ {
+		connArray.Get()
+	}
+	// The requests are sent over the connections by round-robin.
+	assert.Equal(t, map[string][]uint64{addr: {2, 3, 3, 2}}, client.GetConnRequestCounts())
+}
+
+func TestResizeConnPool(t *testing.T) {
+	server, port := startMockTikvService()
+	require.True(t, port > 0)
+	defer server.Stop()
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", port)
+
+	for _, maxBatchSize := range []uint{0, 128} {
+		func() {
+			defer config.UpdateGlobal(func(conf *config.Config) {
+				conf.TiKVClient.MaxBatchSize = maxBatchSize
+				conf.TiKVClient.GrpcConnectionCount = 2
+			})()
+			rpcClient := NewRPCClient()
+			defer rpcClient.Close()
+			assert.Equal(t, 0, rpcClient.GetConnCount(addr))
+			assert.NotNil(t, rpcClient.ResizeConnPool(addr, 4))
+
+			req := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+			_, err := rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second)
+			require.Nil(t, err)
+			assert.Equal(t, 2, rpcClient.GetConnCount(addr))
+			assert.NotNil(t, rpcClient.ResizeConnPool(addr, 0))
+
+			var (
+				wg     sync.WaitGroup
+				stop   int32
+				errCnt int64
+			)
+			for i := 0; i < 8; i++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for atomic.LoadInt32(&stop) == 0 {
+						req := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+						if _, err := rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second); err != nil {
+							atomic.AddInt64(&errCnt, 1)
+						}
+						copReq := tikvrpc.NewRequest(tikvrpc.CmdCopStream, &coprocessor.Request{})
+						resp, err := rpcClient.SendRequest(context.Background(), addr, copReq, 10*time.Second)
+						if err != nil {
+							atomic.AddInt64(&errCnt, 1)
+							continue
+						}
+						resp.Resp.(*tikvrpc.CopStreamResponse).Close()
+					}
+				}()
+			}
+
+			for _, n := range []uint{6, 1, 3, 1} {
+				time.Sleep(50 * time.Millisecond)
+				assert.Nil(t, rpcClient.ResizeConnPool(addr, n))
+				assert.Equal(t, int(n), rpcClient.GetConnCount(addr))
+				connArray, err := rpcClient.getConnArray(addr, true)
+				require.Nil(t, err)
+				if connArray.batchConn != nil {
+					assert.Len(t, connArray.batchConn.batchCommandsClients, int(n))
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+			atomic.StoreInt32(&stop, 1)
+			wg.Wait()
+			assert.Equal(t, int64(0), atomic.LoadInt64(&errCnt))
+			assert.Equal(t, 1, rpcClient.GetConnCount(addr))
+			assert.Len(t, rpcClient.GetConnRequestCounts()[addr], 1)
+		}()
+	}
+}
+
+func TestAutoResizeConnPool(t *testing.T) {
+	server, port := startMockTikvService()
+	require.True(t, port > 0)
+	defer server.Stop()
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", port)
+
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.GrpcConnectionCount = 4
+	})()
+	rpcClient := NewRPCClient(WithConnPoolAutoResize(ConnPoolAutoResize{
+		MinConns:        2,
+		MaxConns:        8,
+		GrowThreshold:   100,
+		ShrinkThreshold: 1,
+		Interval:        10 * time.Millisecond,
+	}))
+	defer rpcClient.Close()
+
+	req := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+	_, err := rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second)
+	require.Nil(t, err)
+	// There is no request in progress, so the pool shrinks to MinConns.
+	assert.Eventually(t, func() bool {
+		return rpcClient.GetConnCount(addr) == 2
+	}, 5*time.Second, 10*time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 2, rpcClient.GetConnCount(addr))
+}
+
+func TestGetPendingBatchRequests(t *testing.T) {
+	client := NewRPCClient()
+	defer client.Close()
+
+	addr := "127.0.0.1:6379"
+	assert.Equal(t, 0, client.GetPendingBatchRequests(addr))
+
+	// The batch send loop isn't started, so requests stay in the queue.
+	batchConn := newBatchConn(1, 8, nil)
+	client.conns[addr] = &connArray{batchConn: batchConn, done: make(chan struct{})}
+	assert.Equal(t, 0, client.GetPendingBatchRequests(addr))
+	for i := 0; i < 3; i++ {
+		batchConn.batchCommandsCh <- &batchCommandsEntry{}
+	}
+	assert.Equal(t, 3, client.GetPendingBatchRequests(addr))
+	<-batchConn.batchCommandsCh
+	assert.Equal(t, 2, client.GetPendingBatchRequests(addr))
+
+	nonBatchAddr := "127.0.0.1:6380"
+	client.conns[nonBatchAddr] = &connArray{done: make(chan struct{})}
+	assert.Equal(t, 0, client.GetPendingBatchRequests(nonBatchAddr))
+	delete(client.conns, addr)
+	delete(client.conns, nonBatchAddr)
+}
+
+func TestLowPriorityBatchRequests(t *testing.T) {
+	batchConn := newBatchConn(1, 8, nil)
+	newEntry := func(id uint64) *batchCommandsEntry {
+		return &batchCommandsEntry{req: &tikvpb.BatchCommandsRequest_Request{
+			Cmd: &tikvpb.BatchCommandsRequest_Request_Empty{Empty: &tikvpb.BatchCommandsEmptyRequest{TestId: id}},
+		}}
+	}
+	entryIDs := func() []uint64 {
+		ids := make([]uint64, 0, batchConn.reqBuilder.len())
+		for _, e := range batchConn.reqBuilder.entries {
+			ids = append(ids, e.req.GetEmpty().GetTestId())
+		}
+		return ids
+	}
+
+	// Low priority requests are fetched after all normal ones.
+	batchConn.lowPriorityCh <- newEntry(1)
+	batchConn.lowPriorityCh <- newEntry(2)
+	batchConn.batchCommandsCh <- newEntry(3)
+	batchConn.batchCommandsCh <- newEntry(4)
+	batchConn.batchCommandsCh <- newEntry(5)
+	assert.Equal(t, 5, batchConn.pendingRequestCount())
+	batchConn.collectPendingRequests(4)
+	assert.Equal(t, []uint64{3, 4, 5, 1}, entryIDs())
+	assert.Equal(t, 1, batchConn.pendingRequestCount())
+
+	// A normal request which arrives later still goes first.
+	batchConn.reqBuilder.reset()
+	batchConn.batchCommandsCh <- newEntry(6)
+	batchConn.collectPendingRequests(8)
+	assert.Equal(t, []uint64{6, 2}, entryIDs())
+	assert.Equal(t, 0, batchConn.pendingRequestCount())
+
+	// Low priority requests are sent when there are no normal ones.
+	batchConn.reqBuilder.reset()
+	batchConn.lowPriorityCh <- newEntry(7)
+	batchConn.fetchAllPendingRequests(8)
+	assert.Equal(t, []uint64{7}, entryIDs())
+
+	// sendBatchRequest puts low priority requests into the low priority queue.
+	_, err := sendBatchRequest(context.Background(), "", "", batchConn, newEntry(8).req, true, 100*time.Millisecond)
+	assert.NotNil(t, err)
+	assert.Equal(t, 0, len(batchConn.batchCommandsCh))
+	assert.Equal(t, 1, len(batchConn.lowPriorityCh))
+}
+
 func TestCancelTimeoutRetErr(t *testing.T) {
 	req := new(tikvpb.BatchCommandsRequest_Request)
 	a := newBatchConn(1, 1, nil)
 
 	ctx, cancel := context.WithCancel(context.TODO())
 	cancel()
-	_, err := sendBatchRequest(ctx, "", "", a, req, 2*time.Second)
+	_, err := sendBatchRequest(ctx, "", "", a, req, false, 2*time.Second)
 	assert.Equal(t, errors.Cause(err), context.Canceled)
 
-	_, err = sendBatchRequest(context.Background(), "", "", a, req, 0)
+	_, err = sendBatchRequest(context.Background(), "", "", a, req, false, 0)
 	assert.Equal(t, errors.Cause(err), context.DeadlineExceeded)
 }
 
@@ -232,6 +433,36 @@ func TestCollapseResolveLock(t *testing.T) {
 	}
 }
 
+func TestForceUnary(t *testing.T) {
+	server, port := startMockTikvService()
+	require.True(t, port > 0)
+	defer server.Stop()
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", port)
+
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.MaxBatchSize = 128
+		conf.TiKVClient.GrpcConnectionCount = 1
+	})()
+	rpcClient := NewRPCClient()
+	defer rpcClient.closeConns()
+
+	req := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+	req.ForceUnary = true
+	_, err := rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second)
+	assert.Nil(t, err)
+	connArray, err := rpcClient.getConnArray(addr, true)
+	require.Nil(t, err)
+	require.NotNil(t, connArray.batchConn)
+	batchClient := connArray.batchConn.batchCommandsClients[0]
+	// The BatchCommands stream isn't created by the unary call.
+	assert.Nil(t, batchClient.client)
+
+	req.ForceUnary = false
+	_, err = rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second)
+	assert.Nil(t, err)
+	assert.NotNil(t, batchClient.client)
+}
+
 func TestForwardMetadataByUnaryCall(t *testing.T) {
 	server, port := startMockTikvService()
 	require.True(t, port > 0)
@@ -365,6 +596,215 @@ func TestForwardMetadataByBatchCommands(t *testing.T) {
 	assert.Equal(t, atomic.LoadUint64(&checkCnt), uint64(2))
 }
 
+func TestUseCompressor(t *testing.T) {
+	server, port := startMockTikvService()
+	require.True(t, port > 0)
+	defer server.Stop()
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", port)
+
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.MaxBatchSize = 128
+		conf.TiKVClient.GrpcConnectionCount = 1
+	})()
+	rpcClient := NewRPCClient()
+	defer rpcClient.closeConns()
+
+	var mu sync.Mutex
+	var methods, compressors []string
+	server.setMetaChecker(func(ctx context.Context) error {
+		method, _ := grpc.Method(ctx)
+		compressor := ""
+		if stream, ok := grpc.ServerTransportStreamFromContext(ctx).(interface{ RecvCompress() string }); ok {
+			compressor = stream.RecvCompress()
+		}
+		mu.Lock()
+		methods = append(methods, method)
+		compressors = append(compressors, compressor)
+		mu.Unlock()
+		return nil
+	})
+
+	// Requests without the compressor are sent by the BatchCommands stream uncompressed.
+	prewriteReq := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+	_, err := rpcClient.SendRequest(context.Background(), addr, prewriteReq, 10*time.Second)
+	assert.Nil(t, err)
+	// Requests with the compressor are compressed and sent by unary calls.
+	prewriteReq = tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{PrimaryLock: []byte("k")})
+	prewriteReq.UseCompressor = gzip.Name
+	for i := 0; i < 2; i++ {
+		_, err = rpcClient.SendRequest(context.Background(), addr, prewriteReq, 10*time.Second)
+		assert.Nil(t, err)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	assert.Equal(t, []string{"/tikvpb.Tikv/BatchCommands", "/tikvpb.Tikv/KvPrewrite", "/tikvpb.Tikv/KvPrewrite"}, methods)
+	assert.Equal(t, []string{"", gzip.Name, gzip.Name}, compressors)
+}
+
+func TestRequestMetadata(t *testing.T) {
+	server, port := startMockTikvService()
+	require.True(t, port > 0)
+	defer server.Stop()
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", port)
+
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.MaxBatchSize = 128
+		conf.TiKVClient.GrpcConnectionCount = 1
+	})()
+	rpcClient := NewRPCClient()
+	defer rpcClient.closeConns()
+
+	forwardedHost := "127.0.0.1:6666"
+	var checkCnt, batchCnt uint64
+	server.setMetaChecker(func(ctx context.Context) error {
+		method, _ := grpc.Method(ctx)
+		md, ok := metadata.FromIncomingContext(ctx)
+		assert.True(t, ok)
+		if method == "/tikvpb.Tikv/BatchCommands" {
+			atomic.AddUint64(&batchCnt, 1)
+			assert.Empty(t, md.Get("x-trace-id"))
+			return nil
+		}
+		atomic.AddUint64(&checkCnt, 1)
+		assert.Equal(t, []string{"t1"}, md.Get("x-tenant"))
+		assert.Equal(t, []string{"trace-1"}, md.Get("x-trace-id"))
+		assert.Equal(t, []string{forwardedHost}, md.Get(forwardMetadataKey))
+		if method != "/tikvpb.Tikv/KvPrewrite" && method != "/tikvpb.Tikv/CoprocessorStream" {
+			assert.Fail(t, "unexpected method", method)
+		}
+		return nil
+	})
+
+	// By default, the requests with any metadata are sent by unary calls and the forwarding metadata is kept.
+	reqMetadata := map[string]string{"x-tenant": "t1", "X-Trace-ID": "trace-1", forwardMetadataKey: "127.0.0.1:7777"}
+	prewriteReq := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+	prewriteReq.ForwardedHost = forwardedHost
+	prewriteReq.Metadata = reqMetadata
+	_, err := rpcClient.SendRequest(context.Background(), addr, prewriteReq, 10*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&checkCnt))
+	assert.Equal(t, uint64(0), atomic.LoadUint64(&batchCnt))
+
+	// The requests with only best-effort metadata are batched.
+	tikvrpc.SetBestEffortMetadataKeys("X-Trace-ID")
+	defer tikvrpc.SetBestEffortMetadataKeys()
+	batchReq := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+	batchReq.Metadata = map[string]string{"x-trace-id": "trace-1"}
+	_, err = rpcClient.SendRequest(context.Background(), addr, batchReq, 10*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&checkCnt))
+	assert.Equal(t, uint64(1), atomic.LoadUint64(&batchCnt))
+
+	// The requests with other metadata are still sent by unary calls.
+	_, err = rpcClient.SendRequest(context.Background(), addr, prewriteReq, 10*time.Second)
+	assert.Nil(t, err)
+	copStreamReq := tikvrpc.NewRequest(tikvrpc.CmdCopStream, &coprocessor.Request{})
+	copStreamReq.ForwardedHost = forwardedHost
+	copStreamReq.Metadata = reqMetadata
+	_, err = rpcClient.SendRequest(context.Background(), addr, copStreamReq, 10*time.Second)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(3), atomic.LoadUint64(&checkCnt))
+}
+
+func TestValidateSecurity(t *testing.T) {
+	rpcClient := NewRPCClient()
+	assert.Nil(t, rpcClient.ValidateSecurity())
+	tlsConfig, err := rpcClient.getTLSConfig()
+	assert.Nil(t, err)
+	assert.Nil(t, tlsConfig)
+	rpcClient.closeConns()
+
+	rpcClient = NewRPCClient(WithSecurity(config.NewSecurity("/not/exist/ca.pem", "", "", nil)))
+	defer rpcClient.closeConns()
+	err = rpcClient.ValidateSecurity()
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid security config")
+	// The error is reported by requests without dialing.
+	_, err = rpcClient.SendRequest(context.Background(), "127.0.0.1:6666", tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{}), time.Second)
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "invalid security config")
+	assert.Empty(t, rpcClient.conns)
+
+	// The failure isn't cached, the config is loaded once the CA is fixed.
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	rpcClient2 := NewRPCClient(WithSecurity(config.NewSecurity(caFile, "", "", nil)))
+	defer rpcClient2.closeConns()
+	assert.NotNil(t, rpcClient2.ValidateSecurity())
+	require.Nil(t, os.WriteFile(caFile, newTestCACert(t), 0600))
+	assert.Nil(t, rpcClient2.ValidateSecurity())
+	tlsConfig, err = rpcClient2.getTLSConfig()
+	assert.Nil(t, err)
+	assert.NotNil(t, tlsConfig)
+	// The loaded config is cached.
+	require.Nil(t, os.Remove(caFile))
+	tlsConfig2, err := rpcClient2.getTLSConfig()
+	assert.Nil(t, err)
+	assert.Same(t, tlsConfig, tlsConfig2)
+}
+
+// newTestCACert returns a self-signed CA certificate in PEM.
+func newTestCACert(t *testing.T) []byte {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.Nil(t, err)
+	tmpl := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "test ca"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	require.Nil(t, err)
+	return pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+}
+
+func TestBatchCommandsDowngrade(t *testing.T) {
+	server, port := startMockTikvService()
+	require.True(t, port > 0)
+	defer server.Stop()
+	addr := fmt.Sprintf("%s:%d", "127.0.0.1", port)
+	atomic.StoreInt32(&server.unimplementBatch, 1)
+
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.TiKVClient.MaxBatchSize = 128
+		conf.TiKVClient.GrpcConnectionCount = 1
+	})()
+	defer func(interval time.Duration) {
+		batchDowngradeProbeInterval = interval
+	}(batchDowngradeProbeInterval)
+	rpcClient := NewRPCClient()
+	defer rpcClient.closeConns()
+
+	// Requests fall back to unary calls.
+	req := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+	for i := 0; i < 3; i++ {
+		_, err := rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second)
+		require.Nil(t, err)
+	}
+	conn, err := rpcClient.getConnArray(addr, true)
+	require.Nil(t, err)
+	require.NotZero(t, atomic.LoadInt64(&conn.downgradedAt))
+
+	// CloseAddr resets the state.
+	require.Nil(t, rpcClient.CloseAddr(addr))
+	conn, err = rpcClient.getConnArray(addr, true)
+	require.Nil(t, err)
+	require.Zero(t, atomic.LoadInt64(&conn.downgradedAt))
+	_, err = rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second)
+	require.Nil(t, err)
+	require.NotZero(t, atomic.LoadInt64(&conn.downgradedAt))
+
+	// Batch commands are used again after the server supports it.
+	atomic.StoreInt32(&server.unimplementBatch, 0)
+	batchDowngradeProbeInterval = 0
+	_, err = rpcClient.SendRequest(context.Background(), addr, req, 10*time.Second)
+	require.Nil(t, err)
+	require.Zero(t, atomic.LoadInt64(&conn.downgradedAt))
+}
+
 func TestBatchCommandsBuilder(t *testing.T) {
 	builder := newBatchCommandsBuilder(128)
 
@@ -471,3 +911,35 @@ func TestBatchCommandsBuilder(t *testing.T) {
 	assert.Equal(t, len(builder.forwardingReqs), 0)
 	assert.NotEqual(t, builder.idAlloc, 0)
 }
+
+func TestTimeoutFor(t *testing.T) {
+	defer SetTimeoutConfig(DefaultTimeoutConfig())
+
+	get := tikvrpc.NewRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{})
+	scan := tikvrpc.NewRequest(tikvrpc.CmdScan, &kvrpcpb.ScanRequest{})
+	assert.Equal(t, ReadTimeoutShort, TimeoutFor(get))
+	assert.Equal(t, ReadTimeoutMedium, TimeoutFor(scan))
+
+	// Tiny scans fail faster and huge scans get more time.
+	scan.ResultSizeHint = 10
+	assert.Equal(t, ReadTimeoutShort, TimeoutFor(scan))
+	scan.ResultSizeHint = 256
+	assert.Equal(t, ReadTimeoutMedium, TimeoutFor(scan))
+	scan.ResultSizeHint = 200000
+	assert.Equal(t, ReadTimeoutMedium+10*time.Second, TimeoutFor(scan))
+	scan.ResultSizeHint = math.MaxUint64
+	assert.Equal(t, 10*time.Minute, TimeoutFor(scan))
+
+	// Small batch gets keep the timeout of their type.
+	batchGet := tikvrpc.NewRequest(tikvrpc.CmdBatchGet, &kvrpcpb.BatchGetRequest{})
+	batchGet.ResultSizeHint = 10
+	assert.Equal(t, ReadTimeoutMedium, TimeoutFor(batchGet))
+
+	// The mapping can be overridden and the override can't be changed by the caller afterwards.
+	cfg := DefaultTimeoutConfig()
+	cfg.ByType[tikvrpc.CmdGet] = time.Second
+	SetTimeoutConfig(cfg)
+	cfg.ByType[tikvrpc.CmdGet] = time.Minute
+	assert.Equal(t, time.Second, TimeoutFor(get))
+	assert.Equal(t, time.Second, GetTimeoutConfig().ByType[tikvrpc.CmdGet])
+}
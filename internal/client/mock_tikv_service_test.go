@@ -25,6 +25,7 @@ import (
 	"fmt"
 	"net"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/pingcap/kvproto/pkg/coprocessor"
@@ -33,6 +34,8 @@ import (
 	"github.com/tikv/client-go/v2/internal/logutil"
 	"go.uber.org/zap"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 type server struct {
@@ -44,6 +47,8 @@ type server struct {
 		sync.Mutex
 		check func(context.Context) error
 	}
+	// unimplementBatch makes BatchCommands fail with Unimplemented, like a server that doesn't support it.
+	unimplementBatch int32
 }
 
 func (s *server) KvPrewrite(ctx context.Context, req *kvrpcpb.PrewriteRequest) (*kvrpcpb.PrewriteResponse, error) {
@@ -64,6 +69,9 @@ func (s *server) BatchCommands(ss tikvpb.Tikv_BatchCommandsServer) error {
 	if err := s.checkMetadata(ss.Context()); err != nil {
 		return err
 	}
+	if atomic.LoadInt32(&s.unimplementBatch) != 0 {
+		return status.Error(codes.Unimplemented, "unknown method BatchCommands")
+	}
 	for {
 		req, err := ss.Recv()
 		if err != nil {
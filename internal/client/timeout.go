@@ -0,0 +1,137 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package client
+
+import (
+	"sync/atomic"
+	"time"
+
+	"github.com/tikv/client-go/v2/tikvrpc"
+)
+
+// Timeout durations.
+const (
+	dialTimeout       = 5 * time.Second
+	ReadTimeoutShort  = 30 * time.Second // For requests that read/write several key-values.
+	ReadTimeoutMedium = 60 * time.Second // For requests that may need scan region.
+
+	// MaxWriteExecutionTime is the MaxExecutionDurationMs field for write requests.
+	// Because the last deadline check is before proposing, let us give it 10 more seconds
+	// after proposing.
+	MaxWriteExecutionTime = ReadTimeoutShort - 10*time.Second
+)
+
+// TimeoutConfig decides the default timeout of a request by its type and result size hint, see TimeoutFor.
+type TimeoutConfig struct {
+	// Default is the timeout of the request types missing in ByType.
+	Default time.Duration
+	// ByType is the timeout of each request type regardless of the result size.
+	ByType map[tikvrpc.CmdType]time.Duration
+	// Requests hinting at most SmallResultSize results use their timeout in SmallResultByType if it's shorter than
+	// the timeout of their type, so that they fail faster. The types missing in SmallResultByType aren't shortened.
+	SmallResultSize   uint64
+	SmallResultByType map[tikvrpc.CmdType]time.Duration
+	// Requests hinting more than LargeResultSize results get PerResultTimeout more for each result beyond it, up to
+	// MaxTimeout. A zero MaxTimeout means no upper bound.
+	LargeResultSize  uint64
+	PerResultTimeout time.Duration
+	MaxTimeout       time.Duration
+}
+
+// DefaultTimeoutConfig returns the TimeoutConfig used by default.
+func DefaultTimeoutConfig() TimeoutConfig {
+	return TimeoutConfig{
+		Default: ReadTimeoutShort,
+		ByType: map[tikvrpc.CmdType]time.Duration{
+			tikvrpc.CmdBatchGet:    ReadTimeoutMedium,
+			tikvrpc.CmdScan:        ReadTimeoutMedium,
+			tikvrpc.CmdScanLock:    ReadTimeoutMedium,
+			tikvrpc.CmdDeleteRange: ReadTimeoutMedium,
+		},
+		SmallResultSize: 64,
+		SmallResultByType: map[tikvrpc.CmdType]time.Duration{
+			tikvrpc.CmdScan:     ReadTimeoutShort,
+			tikvrpc.CmdScanLock: ReadTimeoutShort,
+		},
+		LargeResultSize:  100000,
+		PerResultTimeout: 100 * time.Microsecond,
+		MaxTimeout:       10 * time.Minute,
+	}
+}
+
+type timeoutConfigHolder struct {
+	cfg TimeoutConfig
+}
+
+var timeoutConfig atomic.Value // *timeoutConfigHolder
+
+func init() {
+	timeoutConfig.Store(&timeoutConfigHolder{cfg: DefaultTimeoutConfig()})
+}
+
+// SetTimeoutConfig overrides the config used by TimeoutFor, e.g. to tune the timeouts for a deployment.
+func SetTimeoutConfig(cfg TimeoutConfig) {
+	cfg.ByType = copyTimeouts(cfg.ByType)
+	cfg.SmallResultByType = copyTimeouts(cfg.SmallResultByType)
+	timeoutConfig.Store(&timeoutConfigHolder{cfg: cfg})
+}
+
+func copyTimeouts(timeouts map[tikvrpc.CmdType]time.Duration) map[tikvrpc.CmdType]time.Duration {
+	copied := make(map[tikvrpc.CmdType]time.Duration, len(timeouts))
+	for tp, timeout := range timeouts {
+		copied[tp] = timeout
+	}
+	return copied
+}
+
+// GetTimeoutConfig returns the config used by TimeoutFor.
+func GetTimeoutConfig() TimeoutConfig {
+	return timeoutConfig.Load().(*timeoutConfigHolder).cfg
+}
+
+// TimeoutFor returns the default timeout of the request according to its type and ResultSizeHint. It's only a
+// default, the timeout passed to SendRequest is always respected.
+func TimeoutFor(req *tikvrpc.Request) time.Duration {
+	return GetTimeoutConfig().timeoutFor(req)
+}
+
+func (cfg *TimeoutConfig) timeoutFor(req *tikvrpc.Request) time.Duration {
+	timeout, ok := cfg.ByType[req.Type]
+	if !ok {
+		timeout = cfg.Default
+	}
+	hint := req.ResultSizeHint
+	if hint == 0 {
+		return timeout
+	}
+	if hint <= cfg.SmallResultSize {
+		if small, ok := cfg.SmallResultByType[req.Type]; ok && small > 0 && small < timeout {
+			return small
+		}
+		return timeout
+	}
+	if hint > cfg.LargeResultSize && cfg.PerResultTimeout > 0 {
+		extra := hint - cfg.LargeResultSize
+		// Cap the extra timeout before multiplying to avoid overflows.
+		if cfg.MaxTimeout > 0 && extra > uint64(cfg.MaxTimeout/cfg.PerResultTimeout) {
+			return cfg.MaxTimeout
+		}
+		timeout += time.Duration(extra) * cfg.PerResultTimeout
+		if cfg.MaxTimeout > 0 && timeout > cfg.MaxTimeout {
+			timeout = cfg.MaxTimeout
+		}
+	}
+	return timeout
+}
@@ -0,0 +1,370 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/gogo/protobuf/proto"
+	"github.com/pkg/errors"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/internal/logutil"
+	"github.com/tikv/client-go/v2/internal/retry"
+	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/metrics"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"go.uber.org/zap"
+)
+
+// HedgePolicy decides whether and when an idempotent read request should be hedged, i.e. sent to a
+// second replica if the first one doesn't respond in time. The first successful response is used and
+// the other attempt is cancelled.
+//
+// All methods must be thread-safe.
+type HedgePolicy interface {
+	// HedgeDelay returns how long to wait for the response from the store before hedging the request.
+	// A non-positive value means the request won't be hedged. It's called exactly once for each request
+	// that is eligible for hedging.
+	HedgeDelay(store *Store) time.Duration
+	// AllowHedge reports whether a hedge can be fired now. It's called right before firing a hedge, so
+	// implementations can use it to limit the extra load caused by hedging.
+	AllowHedge() bool
+	// Observe records the latency of a successful attempt sent to the store.
+	Observe(store *Store, latency time.Duration)
+}
+
+// HedgeConfig is the configuration of the default HedgePolicy.
+type HedgeConfig struct {
+	// Delay is the static hedge delay. If AdaptiveDelay is enabled, it's used for stores without any
+	// latency samples.
+	Delay time.Duration
+	// AdaptiveDelay derives the hedge delay from the latency EWMA of each store. The delay is
+	// mean + 2 * mean deviation, which is close to the p95 latency for typical latency distributions.
+	AdaptiveDelay bool
+	// MinDelay and MaxDelay clamp the adaptive delay. A zero MaxDelay means no upper bound.
+	MinDelay time.Duration
+	MaxDelay time.Duration
+	// MaxHedgeRatio is the max ratio of hedged requests to all eligible requests, e.g. 0.05 means at most
+	// 5% of the requests are hedged.
+	MaxHedgeRatio float64
+	// Burst is the max number of hedges that can be fired in a row when the budget is full.
+	Burst int
+}
+
+const (
+	// hedgeEWMAWeight is the weight of a new latency sample in the EWMA.
+	hedgeEWMAWeight = 0.1
+	// defaultHedgeBurst is used when HedgeConfig.Burst is not set.
+	defaultHedgeBurst = 10
+)
+
+type storeLatency struct {
+	mean float64 // in nanoseconds
+	dev  float64 // mean deviation in nanoseconds
+}
+
+type hedgePolicy struct {
+	cfg HedgeConfig
+
+	mu struct {
+		sync.Mutex
+		tokens    float64
+		latencies map[uint64]*storeLatency
+	}
+}
+
+// NewHedgePolicy creates the default HedgePolicy with the given config. It limits the hedged requests
+// with a token bucket: each eligible request adds MaxHedgeRatio tokens and each hedge consumes one.
+func NewHedgePolicy(cfg HedgeConfig) HedgePolicy {
+	if cfg.Burst <= 0 {
+		cfg.Burst = defaultHedgeBurst
+	}
+	p := &hedgePolicy{cfg: cfg}
+	p.mu.latencies = make(map[uint64]*storeLatency)
+	return p
+}
+
+func (p *hedgePolicy) HedgeDelay(store *Store) time.Duration {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.mu.tokens += p.cfg.MaxHedgeRatio
+	if p.mu.tokens > float64(p.cfg.Burst) {
+		p.mu.tokens = float64(p.cfg.Burst)
+	}
+	if !p.cfg.AdaptiveDelay {
+		return p.cfg.Delay
+	}
+	l, ok := p.mu.latencies[store.storeID]
+	if !ok {
+		return p.cfg.Delay
+	}
+	delay := time.Duration(l.mean + 2*l.dev)
+	if delay < p.cfg.MinDelay {
+		delay = p.cfg.MinDelay
+	}
+	if p.cfg.MaxDelay > 0 && delay > p.cfg.MaxDelay {
+		delay = p.cfg.MaxDelay
+	}
+	return delay
+}
+
+func (p *hedgePolicy) AllowHedge() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.mu.tokens < 1 {
+		return false
+	}
+	p.mu.tokens--
+	return true
+}
+
+func (p *hedgePolicy) Observe(store *Store, latency time.Duration) {
+	if !p.cfg.AdaptiveDelay {
+		return
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	sample := float64(latency)
+	l, ok := p.mu.latencies[store.storeID]
+	if !ok {
+		p.mu.latencies[store.storeID] = &storeLatency{mean: sample}
+		return
+	}
+	diff := sample - l.mean
+	if diff < 0 {
+		diff = -diff
+	}
+	l.dev += hedgeEWMAWeight * (diff - l.dev)
+	l.mean += hedgeEWMAWeight * (sample - l.mean)
+}
+
+type hedgePolicyHolder struct {
+	policy HedgePolicy
+}
+
+// SetHedgePolicy sets the policy used to hedge idempotent read requests sent with the region cache.
+// Hedging is disabled if p is nil, which is the default.
+func (c *RegionCache) SetHedgePolicy(p HedgePolicy) {
+	c.hedgePolicy.Store(&hedgePolicyHolder{policy: p})
+}
+
+func (c *RegionCache) getHedgePolicy() HedgePolicy {
+	if h, ok := c.hedgePolicy.Load().(*hedgePolicyHolder); ok {
+		return h.policy
+	}
+	return nil
+}
+
+// isHedgeableRequest returns whether the request is an idempotent read that can be sent to multiple
+// replicas at the same time.
+func isHedgeableRequest(req *tikvrpc.Request) bool {
+	switch req.Type {
+	case tikvrpc.CmdGet, tikvrpc.CmdBatchGet, tikvrpc.CmdScan, tikvrpc.CmdCop,
+		tikvrpc.CmdRawGet, tikvrpc.CmdRawBatchGet, tikvrpc.CmdRawScan:
+		return true
+	}
+	return false
+}
+
+// hedgeDelay returns the delay before hedging the request sent with rpcCtx, or a non-positive value
+// if the request shouldn't be hedged.
+func (s *RegionRequestSender) hedgeDelay(req *tikvrpc.Request, rpcCtx *RPCContext, et tikvrpc.EndpointType) time.Duration {
+	policy := s.regionCache.getHedgePolicy()
+	if policy == nil || et != tikvrpc.TiKV || !isHedgeableRequest(req) || kv.StoreLimit.Load() > 0 ||
+		rpcCtx.ProxyStore != nil || rpcCtx.TiKVNum <= 1 || s.replicaSelector == nil {
+		return 0
+	}
+	// Only hedge in the steady states. In other states the selector is recovering from failures and
+	// the replicas are tried one by one on purpose.
+	switch s.replicaSelector.state.(type) {
+	case *accessKnownLeader, *accessFollower:
+	default:
+		return 0
+	}
+	return policy.HedgeDelay(rpcCtx.Store)
+}
+
+// buildHedgeRPCContext picks a replica on a different store from the primary attempt and builds the
+// RPCContext for the hedged request. It doesn't change the state of the replica selector. It returns
+// nil if there is no suitable replica.
+func (s *RegionRequestSender) buildHedgeRPCContext(bo *retry.Backoffer, primary *RPCContext) *RPCContext {
+	selector := s.replicaSelector
+	replicas := selector.replicas
+	offset := s.regionCache.rnd.Intn(len(replicas))
+	for i := 0; i < len(replicas); i++ {
+		idx := (offset + i) % len(replicas)
+		replica := replicas[idx]
+		if replica.store.storeID == primary.Store.storeID || replica.isEpochStale() ||
+			atomic.LoadInt32(&replica.store.unreachable) != 0 {
+			continue
+		}
+		if state, ok := selector.state.(*accessFollower); ok && !replica.store.IsLabelsMatch(state.option.labels) {
+			continue
+		}
+		addr, err := s.regionCache.getStoreAddr(bo, selector.region, replica.store)
+		if err != nil || len(addr) == 0 {
+			continue
+		}
+		return &RPCContext{
+			Region:     primary.Region,
+			Meta:       primary.Meta,
+			Peer:       replica.peer,
+			AccessIdx:  AccessIndex(idx),
+			Store:      replica.store,
+			Addr:       addr,
+			AccessMode: tiKVOnly,
+			TiKVNum:    primary.TiKVNum,
+		}
+	}
+	return nil
+}
+
+// copyRequestForHedge copies the request so that it can be sent to another peer concurrently.
+func copyRequestForHedge(req *tikvrpc.Request) (*tikvrpc.Request, error) {
+	msg, ok := req.Req.(proto.Message)
+	if !ok {
+		return nil, errors.Errorf("cannot copy request of type %v for hedging", req.Type)
+	}
+	hedgeReq := *req
+	hedgeReq.Req = proto.Clone(msg)
+	// Followers have to read index to serve non-stale reads.
+	if !hedgeReq.StaleRead {
+		hedgeReq.ReplicaRead = true
+	}
+	return &hedgeReq, nil
+}
+
+type hedgeResult struct {
+	rpcCtx  *RPCContext
+	resp    *tikvrpc.Response
+	err     error
+	latency time.Duration
+}
+
+func (r *hedgeResult) succeeded() bool {
+	if r.err != nil || r.resp == nil {
+		return false
+	}
+	regionErr, err := r.resp.GetRegionError()
+	return err == nil && regionErr == nil
+}
+
+// sendReqToRegionWithHedge sends the request like sendReqToRegion, and hedges it to another replica if
+// there is no response in delay. It returns the response and the RPCContext of the attempt the response
+// comes from. A cancelled or failed hedge never invokes onSendFail, only the failure of the primary
+// attempt is handled when neither attempt succeeds.
+func (s *RegionRequestSender) sendReqToRegionWithHedge(bo *retry.Backoffer, rpcCtx *RPCContext, req *tikvrpc.Request, timeout time.Duration, delay time.Duration) (resp *tikvrpc.Response, respCtx *RPCContext, retry bool, err error) {
+	if e := tikvrpc.SetContext(req, rpcCtx.Meta, rpcCtx.Peer); e != nil {
+		return nil, nil, false, e
+	}
+	req.ForwardedHost = ""
+	policy := s.regionCache.getHedgePolicy()
+
+	ctx, cancel := context.WithCancel(bo.GetCtx())
+	defer cancel()
+	if rawHook := ctx.Value(RPCCancellerCtxKey{}); rawHook != nil {
+		var cancelHook context.CancelFunc
+		ctx, cancelHook = rawHook.(*RPCCanceller).WithCancel(ctx)
+		defer cancelHook()
+	}
+
+	timeout, readTimeoutLimited := capReadTimeout(ctx, req, timeout)
+	// The channel is buffered so that the loser never blocks after the winner is returned.
+	results := make(chan *hedgeResult, 2)
+	send := func(rpcCtx *RPCContext, req *tikvrpc.Request) {
+		start := time.Now()
+		resp, err := s.client.SendRequest(ctx, rpcCtx.Addr, req, timeout)
+		results <- &hedgeResult{rpcCtx: rpcCtx, resp: resp, err: err, latency: time.Since(start)}
+	}
+
+	start := time.Now()
+	go send(rpcCtx, req)
+	inflight, hedged := 1, false
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+
+	var primary *hedgeResult
+	for inflight > 0 {
+		select {
+		case <-timer.C:
+			if !policy.AllowHedge() {
+				continue
+			}
+			hedgeCtx := s.buildHedgeRPCContext(bo, rpcCtx)
+			if hedgeCtx == nil {
+				continue
+			}
+			hedgeReq, e := copyRequestForHedge(req)
+			if e != nil {
+				logutil.Logger(bo.GetCtx()).Warn("failed to hedge request", zap.Error(e))
+				continue
+			}
+			if e = tikvrpc.SetContext(hedgeReq, hedgeCtx.Meta, hedgeCtx.Peer); e != nil {
+				continue
+			}
+			metrics.HedgeRequestCounterFired.Inc()
+			logutil.Eventf(bo.GetCtx(), "hedge %s request to region %d at %s", req.Type, rpcCtx.Region.id, hedgeCtx.Addr)
+			go send(hedgeCtx, hedgeReq)
+			inflight++
+			hedged = true
+		case r := <-results:
+			inflight--
+			if r.succeeded() {
+				policy.Observe(r.rpcCtx.Store, r.latency)
+				if r.rpcCtx != rpcCtx {
+					metrics.HedgeRequestCounterWin.Inc()
+				}
+				if s.Stats != nil {
+					RecordRegionRequestRuntimeStats(s.Stats, req.Type, time.Since(start))
+				}
+				return r.resp, r.rpcCtx, false, nil
+			}
+			if r.rpcCtx == rpcCtx {
+				primary = r
+				// Don't wait for the hedge timer if the primary attempt fails before hedging.
+				if !hedged {
+					inflight = 0
+				}
+			}
+		}
+	}
+
+	// Neither attempt succeeds. Handle the result of the primary attempt as if there was no hedge.
+	if s.Stats != nil {
+		RecordRegionRequestRuntimeStats(s.Stats, req.Type, time.Since(start))
+	}
+	if primary.err == nil {
+		return primary.resp, rpcCtx, false, nil
+	}
+	primary.err = s.wrapSendError(primary.err, rpcCtx, req)
+	s.rpcError = primary.err
+	if e := bo.GetCtx().Err(); e != nil && errors.Cause(e) == context.Canceled {
+		return nil, nil, false, errors.WithStack(e)
+	}
+	// Retrying the same request won't help, the caller should split it if possible.
+	if isMessageTooLargeErr(primary.err) {
+		return nil, nil, false, errors.WithStack(&tikverr.ErrRPCMessageTooLarge{Err: primary.err})
+	}
+	if readTimeoutLimited && s.retryAfterReadTimeout(bo, rpcCtx, primary.err) {
+		return nil, rpcCtx, true, nil
+	}
+	if e := s.onSendFail(bo, rpcCtx, primary.err); e != nil {
+		return nil, nil, false, primary.err
+	}
+	return nil, rpcCtx, true, nil
+}
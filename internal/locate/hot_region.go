@@ -0,0 +1,219 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"math"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/metrics"
+	"github.com/tikv/client-go/v2/tikvrpc"
+)
+
+// HotRegionConfig is the configuration of detecting hot regions on the client and spreading their reads to the
+// followers.
+type HotRegionConfig struct {
+	// Threshold is the decayed request count above which a region is hot. A region receiving r requests per second
+	// steadily has a decayed count of about r * HalfLife / ln2.
+	Threshold float64
+	// HalfLife is the time it takes for the request count of a region to decay by half. It's 10s if not set.
+	HalfLife time.Duration
+	// SampleRate is the ratio of requests that are counted, e.g. 8 means 1 in 8 requests is counted with a weight
+	// of 8. All requests are counted if it's not set.
+	SampleRate uint32
+	// MaxFollowerFailureRate stops spreading the reads of a region if the send failure rate of any of its
+	// followers is above it. It's 0.1 if not set.
+	MaxFollowerFailureRate float64
+}
+
+const (
+	defaultHotRegionHalfLife               = 10 * time.Second
+	defaultHotRegionMaxFollowerFailureRate = 0.1
+	// hotRegionPruneInterval is the number of sampled requests between two prunes of the cold regions.
+	hotRegionPruneInterval = 1024
+)
+
+// HotRegion is a region detected hot on the client.
+type HotRegion struct {
+	RegionID uint64
+	// Hotness is the decayed request count of the region.
+	Hotness float64
+}
+
+type hotRegionCounter struct {
+	count   float64
+	updated time.Time
+}
+
+// decayed returns the count of the counter decayed to now.
+func (c *hotRegionCounter) decayed(now time.Time, halfLife time.Duration) float64 {
+	elapsed := now.Sub(c.updated)
+	if elapsed <= 0 {
+		return c.count
+	}
+	return c.count * math.Exp2(-float64(elapsed)/float64(halfLife))
+}
+
+// hotRegionTracker counts the requests sent to each region with counters decaying over time.
+type hotRegionTracker struct {
+	cfg     HotRegionConfig
+	sampled uint32
+
+	mu struct {
+		sync.RWMutex
+		counters map[uint64]*hotRegionCounter
+	}
+}
+
+func newHotRegionTracker(cfg HotRegionConfig) *hotRegionTracker {
+	if cfg.HalfLife <= 0 {
+		cfg.HalfLife = defaultHotRegionHalfLife
+	}
+	if cfg.SampleRate == 0 {
+		cfg.SampleRate = 1
+	}
+	if cfg.MaxFollowerFailureRate <= 0 {
+		cfg.MaxFollowerFailureRate = defaultHotRegionMaxFollowerFailureRate
+	}
+	t := &hotRegionTracker{cfg: cfg}
+	t.mu.counters = make(map[uint64]*hotRegionCounter)
+	return t
+}
+
+// observe counts a request sent to the region if it's sampled.
+func (t *hotRegionTracker) observe(regionID uint64, now time.Time) {
+	seq := atomic.AddUint32(&t.sampled, 1)
+	if seq%t.cfg.SampleRate != 0 {
+		return
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	c, ok := t.mu.counters[regionID]
+	if !ok {
+		c = &hotRegionCounter{}
+		t.mu.counters[regionID] = c
+	}
+	c.count = c.decayed(now, t.cfg.HalfLife) + float64(t.cfg.SampleRate)
+	c.updated = now
+	if (seq/t.cfg.SampleRate)%hotRegionPruneInterval == 0 {
+		for id, c := range t.mu.counters {
+			if c.decayed(now, t.cfg.HalfLife) < 1 {
+				delete(t.mu.counters, id)
+			}
+		}
+	}
+}
+
+func (t *hotRegionTracker) isHot(regionID uint64, now time.Time) bool {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	c, ok := t.mu.counters[regionID]
+	return ok && c.decayed(now, t.cfg.HalfLife) >= t.cfg.Threshold
+}
+
+// hotRegions returns the hot regions ordered by hotness descending.
+func (t *hotRegionTracker) hotRegions(now time.Time) []HotRegion {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	var regions []HotRegion
+	for id, c := range t.mu.counters {
+		if hotness := c.decayed(now, t.cfg.HalfLife); hotness >= t.cfg.Threshold {
+			regions = append(regions, HotRegion{RegionID: id, Hotness: hotness})
+		}
+	}
+	sort.Slice(regions, func(i, j int) bool {
+		return regions[i].Hotness > regions[j].Hotness
+	})
+	return regions
+}
+
+type hotRegionTrackerHolder struct {
+	tracker *hotRegionTracker
+}
+
+// SetHotRegionConfig enables detecting hot regions with the config. The leader reads of hot regions that tolerate
+// follower reads, see tikvrpc.Request.AllowHotRegionFollowerRead, are upgraded to mixed replica reads. It's
+// disabled if cfg is nil, which is the default. Setting it again resets the request counters.
+func (c *RegionCache) SetHotRegionConfig(cfg *HotRegionConfig) {
+	var tracker *hotRegionTracker
+	if cfg != nil {
+		tracker = newHotRegionTracker(*cfg)
+	}
+	c.hotRegionTracker.Store(&hotRegionTrackerHolder{tracker: tracker})
+}
+
+func (c *RegionCache) getHotRegionTracker() *hotRegionTracker {
+	if h, ok := c.hotRegionTracker.Load().(*hotRegionTrackerHolder); ok {
+		return h.tracker
+	}
+	return nil
+}
+
+// HotRegions returns the regions detected hot on the client, ordered by hotness descending. It's for debugging
+// and returns nil if hot region detection is disabled.
+func (c *RegionCache) HotRegions() []HotRegion {
+	tracker := c.getHotRegionTracker()
+	if tracker == nil {
+		return nil
+	}
+	return tracker.hotRegions(time.Now())
+}
+
+// spreadHotRegionRead counts the request to the region and upgrades it to a mixed replica read if the region is
+// hot. It returns a function to restore the request, or nil if the request is not changed.
+func (s *RegionRequestSender) spreadHotRegionRead(req *tikvrpc.Request, regionID RegionVerID, et tikvrpc.EndpointType) func() {
+	tracker := s.regionCache.getHotRegionTracker()
+	if tracker == nil || et != tikvrpc.TiKV {
+		return nil
+	}
+	now := time.Now()
+	tracker.observe(regionID.id, now)
+	// Writes, stale reads and the reads that must be served by the leader are never spread.
+	if !req.AllowHotRegionFollowerRead || !isHedgeableRequest(req) || req.StaleRead ||
+		req.ReplicaReadType != kv.ReplicaReadLeader || !tracker.isHot(regionID.id, now) {
+		return nil
+	}
+	region := s.regionCache.GetCachedRegionWithRLock(regionID)
+	if region == nil || !region.isValid() {
+		return nil
+	}
+	rs := region.getStore()
+	followers := 0
+	for i := 0; i < rs.accessStoreNum(tiKVOnly); i++ {
+		if AccessIndex(i) == rs.workTiKVIdx {
+			continue
+		}
+		_, store := rs.accessStore(tiKVOnly, AccessIndex(i))
+		if store.GetSendFailureRate() > tracker.cfg.MaxFollowerFailureRate {
+			return nil
+		}
+		followers++
+	}
+	if followers == 0 {
+		return nil
+	}
+	metrics.TiKVHotRegionFollowerReadCounter.Inc()
+	replicaRead := req.ReplicaRead
+	req.ReplicaReadType = kv.ReplicaReadMixed
+	req.ReplicaRead = true
+	return func() {
+		req.ReplicaReadType = kv.ReplicaReadLeader
+		req.ReplicaRead = replicaRead
+	}
+}
@@ -37,9 +37,12 @@ package locate
 import (
 	"bytes"
 	"context"
+	cryptorand "crypto/rand"
+	"encoding/binary"
 	"fmt"
 	"math/rand"
 	"sort"
+	"strconv"
 	"strings"
 	"sync"
 	"sync/atomic"
@@ -63,6 +66,7 @@ import (
 	pd "github.com/tikv/pd/client"
 	atomic2 "go.uber.org/atomic"
 	"go.uber.org/zap"
+	"golang.org/x/sync/semaphore"
 	"golang.org/x/sync/singleflight"
 	"google.golang.org/grpc"
 	"google.golang.org/grpc/backoff"
@@ -120,6 +124,17 @@ type Region struct {
 	syncFlag      int32          // region need be sync in next turn
 	lastAccess    int64          // last region access time, see checkRegionCacheTTL
 	invalidReason InvalidReason  // the reason why the region is invalidated
+	// suspectPeers is set when PD reports all peers down but the region is still built with them,
+	// a peer failing to send is not retried then. Immutable after init.
+	suspectPeers bool
+	// leaderKnown is set when the leader reported by PD is one of the available peers. Immutable after init.
+	leaderKnown bool
+	// inflight is the number of RPCContexts built from the region and not released by ReleaseRPCContext yet.
+	inflight int32
+	// failureHandled is the sum of the store epochs plus 1 at which the failures of the requests to the region are
+	// handled, i.e. the region is invalidated or scheduled to reload, or 0 if none. The failures of the other requests
+	// in flight at the same store epochs don't repeat it.
+	failureHandled uint64
 }
 
 // AccessIndex represent the index for accessIndex array
@@ -169,7 +184,7 @@ func (r *regionStore) clone() *regionStore {
 	storeEpochs := make([]uint32, len(r.stores))
 	copy(storeEpochs, r.storeEpochs)
 	rs := &regionStore{
-		workTiFlashIdx: r.workTiFlashIdx,
+		workTiFlashIdx: atomic.LoadInt32(&r.workTiFlashIdx),
 		proxyTiKVIdx:   r.proxyTiKVIdx,
 		workTiKVIdx:    r.workTiKVIdx,
 		stores:         r.stores,
@@ -183,6 +198,16 @@ func (r *regionStore) clone() *regionStore {
 	return rs
 }
 
+// storeEpochSum returns the sum of the store epochs. Every epoch only increases, so the sum identifies the store
+// epochs of a region.
+func (r *regionStore) storeEpochSum() uint64 {
+	var sum uint64
+	for _, epoch := range r.storeEpochs {
+		sum += uint64(epoch)
+	}
+	return sum
+}
+
 // return next follower store's index
 func (r *regionStore) follower(seed uint32, op *storeSelectorOp) AccessIndex {
 	l := uint32(r.accessStoreNum(tiKVOnly))
@@ -222,11 +247,39 @@ func (r *regionStore) kvPeer(seed uint32, op *storeSelectorOp) AccessIndex {
 	if len(candidates) == 0 {
 		return r.workTiKVIdx
 	}
-	return candidates[seed%uint32(len(candidates))]
+	if !op.mixedReadWeighted() {
+		return candidates[seed%uint32(len(candidates))]
+	}
+	weights := make([]uint64, len(candidates))
+	var totalWeight uint64
+	for i, accessIdx := range candidates {
+		weights[i] = 1
+		if r.isPreferredByMixedRead(accessIdx, op) {
+			weights[i] = uint64(op.mixedReadWeight)
+		}
+		totalWeight += weights[i]
+	}
+	w := uint64(seed) % totalWeight
+	for i, weight := range weights {
+		if w < weight {
+			return candidates[i]
+		}
+		w -= weight
+	}
+	return candidates[len(candidates)-1]
+}
+
+func (r *regionStore) isPreferredByMixedRead(aidx AccessIndex, op *storeSelectorOp) bool {
+	_, s := r.accessStore(tiKVOnly, aidx)
+	return op.isPreferredByMixedRead(aidx == r.workTiKVIdx, s)
 }
 
 func (r *regionStore) filterStoreCandidate(aidx AccessIndex, op *storeSelectorOp) bool {
 	_, s := r.accessStore(tiKVOnly, aidx)
+	// filter the followers of unknown lag
+	if aidx != r.workTiKVIdx && op.isFollowerLagUnknown(s) {
+		return false
+	}
 	// filter label unmatched store
 	return s.IsLabelsMatch(op.labels)
 }
@@ -241,7 +294,9 @@ func newRegion(bo *retry.Backoffer, c *RegionCache, pdRegion *pd.Region) (*Regio
 		workTiFlashIdx: 0,
 		stores:         make([]*Store, 0, len(r.meta.Peers)),
 		storeEpochs:    make([]uint32, 0, len(r.meta.Peers)),
-		buckets:        pdRegion.Buckets,
+	}
+	if !c.disableBuckets {
+		rs.buckets = pdRegion.Buckets
 	}
 
 	leader := pdRegion.Leader
@@ -251,7 +306,7 @@ func newRegion(bo *retry.Backoffer, c *RegionCache, pdRegion *pd.Region) (*Regio
 		c.storeMu.RLock()
 		store, exists := c.storeMu.stores[p.StoreId]
 		c.storeMu.RUnlock()
-		if !exists {
+		if !exists || c.isStoreNotFoundExpired(store) {
 			store = c.getStoreByStoreID(p.StoreId)
 		}
 		addr, err := store.initResolve(bo, c)
@@ -264,6 +319,7 @@ func newRegion(bo *retry.Backoffer, c *RegionCache, pdRegion *pd.Region) (*Regio
 		}
 		if isSamePeer(p, leader) {
 			leaderAccessIdx = AccessIndex(len(rs.accessIndex[tiKVOnly]))
+			r.leaderKnown = true
 		}
 		availablePeers = append(availablePeers, p)
 		switch store.storeType {
@@ -275,10 +331,9 @@ func newRegion(bo *retry.Backoffer, c *RegionCache, pdRegion *pd.Region) (*Regio
 		rs.stores = append(rs.stores, store)
 		rs.storeEpochs = append(rs.storeEpochs, atomic.LoadUint32(&store.epoch))
 	}
-	// TODO(youjiali1995): It's possible the region info in PD is stale for now but it can recover.
-	// Maybe we need backoff here.
+	// It's possible the region info in PD is stale for now but it can recover, the caller may reload it later.
 	if len(availablePeers) == 0 {
-		return nil, errors.Errorf("no available peers, region: {%v}", r.meta)
+		return nil, errors.WithStack(&tikverr.ErrNoAvailablePeers{RegionID: r.meta.GetId()})
 	}
 	rs.workTiKVIdx = leaderAccessIdx
 	r.meta.Peers = availablePeers
@@ -295,6 +350,14 @@ func (r *Region) getStore() (store *regionStore) {
 	return
 }
 
+// stores returns the stores of the region, or nil if the regionStore of the region isn't set.
+func (r *Region) stores() []*Store {
+	if rs := r.getStore(); rs != nil {
+		return rs.stores
+	}
+	return nil
+}
+
 func (r *Region) setStore(store *regionStore) {
 	atomic.StorePointer(&r.store, unsafe.Pointer(store))
 }
@@ -341,7 +404,37 @@ func (r *Region) checkNeedReloadAndMarkUpdated() bool {
 	if oldValue == updated {
 		return false
 	}
-	return atomic.CompareAndSwapInt32(&r.syncFlag, oldValue, updated)
+	if !atomic.CompareAndSwapInt32(&r.syncFlag, oldValue, updated) {
+		return false
+	}
+	// The region is used again if it fails to be reloaded, so the failures after it should be handled again.
+	atomic.StoreUint64(&r.failureHandled, 0)
+	return true
+}
+
+// claimFailureHandling returns true if the caller is the first to handle the failures of the requests to the region
+// sent at the store epochs of rs. A Region is replaced when it's reloaded, so the failures are handled once for a
+// region version and its store epochs.
+func (r *Region) claimFailureHandling(rs *regionStore) bool {
+	key := rs.storeEpochSum() + 1
+	for {
+		handled := atomic.LoadUint64(&r.failureHandled)
+		// The epochs only increase, so the failures at the same or older epochs are handled already.
+		if handled >= key {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&r.failureHandled, handled, key) {
+			metrics.RegionCacheCounterWithFailureHandled.Inc()
+			return true
+		}
+	}
+}
+
+// acquireRPCContext records the RPCContext built from the region in flight until it's released.
+func (r *Region) acquireRPCContext(ctx *RPCContext) *RPCContext {
+	ctx.region = r
+	atomic.AddInt32(&r.inflight, 1)
+	return ctx
 }
 
 func (r *Region) checkNeedReload() bool {
@@ -357,61 +450,281 @@ func (r *Region) isValid() bool {
 // All public methods of this struct should be thread-safe, unless explicitly pointed out or the method is for testing
 // purposes only.
 type RegionCache struct {
-	pdClient         pd.Client
+	pdClient         atomic.Value // *pdClientHolder
 	enableForwarding bool
+	// disableBuckets makes the cache ignore buckets: they are neither loaded from PD nor kept in regions.
+	disableBuckets bool
+	// strictDownPeerFiltering is 1 if a region whose peers are all reported down by PD fails to load.
+	strictDownPeerFiltering uint32
 
+	// Lock order: c.mu must be acquired before c.storeMu if both are held.
 	mu struct {
 		sync.RWMutex                           // mutex protect cached region
 		regions        map[RegionVerID]*Region // cached regions are organized as regionVerID to region ref mapping
 		latestVersions map[uint64]RegionVerID  // cache the map from regionID to its latest RegionVerID
 		sorted         *btree.BTree            // cache regions are organized as sorted key to region ref mapping
+		// storeRegions indexes the versions in regions by the IDs of their stores. It only has entries for the
+		// versions in regions, so its size is bounded by the number of cached regions times their peers.
+		storeRegions map[uint64]map[RegionVerID]struct{}
 	}
 	storeMu struct {
 		sync.RWMutex
 		stores map[uint64]*Store
 	}
+	// needCheckMu holds the stores marked need check since the last pass of asyncCheckAndResolveLoop, so that none
+	// of them is missed however the notifications to notifyCheckCh are coalesced.
+	needCheckMu struct {
+		sync.Mutex
+		stores map[uint64]*Store
+	}
 	notifyCheckCh chan struct{}
 	closeCh       chan struct{}
+	// closed is 1 if the cache is closed.
+	closed      int32
+	hedgePolicy atomic.Value // *hedgePolicyHolder
+	// hotRegionTracker counts the requests to each region to spread the reads of hot regions to followers.
+	hotRegionTracker atomic.Value // *hotRegionTrackerHolder
+	// regionMetaKeyDecoder decodes the range keys of the region meta carried by EpochNotMatch errors.
+	regionMetaKeyDecoder atomic.Value // *regionMetaKeyDecoderHolder
+	// onAllReplicasFailed is called when the requests to all the replicas of a region fail.
+	onAllReplicasFailed atomic.Value // *allReplicasFailedHolder
+	// regionLoadLimiter bounds the concurrent region requests to PD, it's nil if unlimited.
+	regionLoadLimiter *semaphore.Weighted
+	// regionLoadSf deduplicates concurrent loads of the same missing key.
+	regionLoadSf singleflight.Group
+	// regionLoadMu tracks the in-flight loads of missing regions. A miss waits for the loads started before it, so
+	// the misses of different keys in a region share one request to PD.
+	regionLoadMu struct {
+		sync.Mutex
+		inflight map[chan struct{}]struct{}
+	}
+	// rnd is the source of all the random choices of replicas and proxies, so a failure can be reproduced by
+	// creating the cache with the same seed.
+	rnd *lockedRand
+	// storeNotFoundTTL is how long a store that PD doesn't know is remembered as a tombstone. It's remembered
+	// forever if it's 0.
+	storeNotFoundTTL time.Duration
+	// regionNotFoundRetries is the number of times a request is retried before the region is invalidated when TiKV
+	// reports RegionNotFound.
+	regionNotFoundRetries int32
+	// livenessProvider replaces the built-in health check to tell the liveness of stores if it's set.
+	livenessProvider atomic.Value // *livenessProviderHolder
+	// disableStoreEpochRefresh makes a region be invalidated instead of refreshing its store epochs when a store
+	// of it has failed since the region was loaded.
+	disableStoreEpochRefresh bool
+}
+
+// RegionCacheOption configures the RegionCache created by NewRegionCache.
+type RegionCacheOption func(*RegionCache)
+
+// defaultMaxConcurrentRegionLoads is the default limit of concurrent requests to load regions from PD.
+const defaultMaxConcurrentRegionLoads = 256
+
+// WithMaxConcurrentRegionLoads limits the number of concurrent requests to load regions from PD, so that PD isn't
+// flooded when a cold cache is accessed by many goroutines. It's unlimited if n <= 0. The default is 256.
+func WithMaxConcurrentRegionLoads(n int) RegionCacheOption {
+	return func(c *RegionCache) {
+		if n > 0 {
+			c.regionLoadLimiter = semaphore.NewWeighted(int64(n))
+		} else {
+			c.regionLoadLimiter = nil
+		}
+	}
+}
+
+// WithRandSeed sets the seed of the random choices of replicas and proxies made by the cache. By default, the seed
+// is generated from crypto/rand.
+func WithRandSeed(seed int64) RegionCacheOption {
+	return func(c *RegionCache) {
+		c.rnd = newLockedRand(seed)
+	}
+}
+
+// WithStoreEpochRefresh sets whether the store epochs of a cached region are refreshed when one of its stores has
+// failed since the region was loaded. If it's disabled, the region is invalidated and loaded from PD again instead,
+// which can make a region be reloaded again and again when a store is flapping. It's enabled by default.
+func WithStoreEpochRefresh(enabled bool) RegionCacheOption {
+	return func(c *RegionCache) {
+		c.disableStoreEpochRefresh = !enabled
+	}
+}
 
-	testingKnobs struct {
-		// Replace the requestLiveness function for test purpose. Note that in unit tests, if this is not set,
-		// requestLiveness always returns unreachable.
-		mockRequestLiveness func(s *Store, bo *retry.Backoffer) livenessState
+// WithStoreNotFoundTTL sets how long a store that PD reports as tombstone or not found is remembered, so that the
+// regions referencing it don't ask PD for it again and again. After the ttl, the store is resolved again the next
+// time a region referencing it is loaded. By default, such a store is remembered forever.
+func WithStoreNotFoundTTL(ttl time.Duration) RegionCacheOption {
+	return func(c *RegionCache) {
+		if ttl > 0 {
+			c.storeNotFoundTTL = ttl
+		} else {
+			c.storeNotFoundTTL = 0
+		}
+	}
+}
+
+// lockedRand is a rand.Rand which is safe for concurrent use.
+type lockedRand struct {
+	sync.Mutex
+	seed int64
+	rnd  *rand.Rand
+}
+
+func newLockedRand(seed int64) *lockedRand {
+	return &lockedRand{seed: seed, rnd: rand.New(rand.NewSource(seed))}
+}
+
+// Intn returns a non-negative pseudo-random number in [0,n). It panics if n <= 0.
+func (r *lockedRand) Intn(n int) int {
+	r.Lock()
+	defer r.Unlock()
+	return r.rnd.Intn(n)
+}
+
+func (r *lockedRand) reseed(seed int64) {
+	r.Lock()
+	defer r.Unlock()
+	r.seed = seed
+	r.rnd.Seed(seed)
+}
+
+// randomSeed generates a seed from crypto/rand, and falls back to the current time if it fails.
+func randomSeed() int64 {
+	var b [8]byte
+	if _, err := cryptorand.Read(b[:]); err != nil {
+		return time.Now().UnixNano()
 	}
+	return int64(binary.LittleEndian.Uint64(b[:]))
 }
 
 // NewRegionCache creates a RegionCache.
-func NewRegionCache(pdClient pd.Client) *RegionCache {
-	c := &RegionCache{
-		pdClient: pdClient,
+func NewRegionCache(pdClient pd.Client, opts ...RegionCacheOption) *RegionCache {
+	c := &RegionCache{}
+	c.regionLoadLimiter = semaphore.NewWeighted(defaultMaxConcurrentRegionLoads)
+	for _, opt := range opts {
+		opt(c)
+	}
+	if c.rnd == nil {
+		c.rnd = newLockedRand(randomSeed())
 	}
+	logutil.BgLogger().Debug("region cache created", zap.Int64("rand-seed", c.rnd.seed))
+	c.pdClient.Store(&pdClientHolder{client: pdClient})
 	c.mu.regions = make(map[RegionVerID]*Region)
 	c.mu.latestVersions = make(map[uint64]RegionVerID)
 	c.mu.sorted = btree.New(btreeDegree)
+	c.mu.storeRegions = make(map[uint64]map[RegionVerID]struct{})
 	c.storeMu.stores = make(map[uint64]*Store)
+	c.needCheckMu.stores = make(map[uint64]*Store)
 	c.notifyCheckCh = make(chan struct{}, 1)
 	c.closeCh = make(chan struct{})
 	interval := config.GetGlobalConfig().StoresRefreshInterval
 	go c.asyncCheckAndResolveLoop(time.Duration(interval) * time.Second)
 	c.enableForwarding = config.GetGlobalConfig().EnableForwarding
+	c.disableBuckets = config.GetGlobalConfig().DisableBucketFeature
+	c.strictDownPeerFiltering = 1
 	return c
 }
 
+// SetStrictDownPeerFiltering sets whether a region fails to load when all its peers are reported down by PD,
+// which is the default. The DownPeers reported by PD may be stale, so if it's not strict, the region is built
+// with all its peers instead, and a peer failing to send is not retried. Peers on tombstone stores are always
+// filtered.
+func (c *RegionCache) SetStrictDownPeerFiltering(strict bool) {
+	var v uint32
+	if strict {
+		v = 1
+	}
+	atomic.StoreUint32(&c.strictDownPeerFiltering, v)
+}
+
+// SetRandSeedForTest resets the seed of the random choices of replicas and proxies made by the cache.
+// It's only used in tests.
+func (c *RegionCache) SetRandSeedForTest(seed int64) {
+	c.rnd.reseed(seed)
+	logutil.BgLogger().Debug("region cache rand seed reset", zap.Int64("rand-seed", seed))
+}
+
+// RegionMetaKeyDecoder decodes the range keys of a region meta returned by TiKV, which are encoded in the same way
+// as the keys stored in PD. It must not modify the given region because it may be shared, a shallow copy should be
+// returned instead.
+type RegionMetaKeyDecoder func(r *metapb.Region) (*metapb.Region, error)
+
+type regionMetaKeyDecoderHolder struct {
+	decoder RegionMetaKeyDecoder
+}
+
+// SetRegionMetaKeyDecoder sets the decoder of the range keys of the region metas carried by EpochNotMatch errors.
+// If decoder is nil, which is the default, the keys are decoded from the memcomparable format if the PD client is a
+// CodecPDClient, and are used as they are otherwise.
+func (c *RegionCache) SetRegionMetaKeyDecoder(decoder RegionMetaKeyDecoder) {
+	c.regionMetaKeyDecoder.Store(&regionMetaKeyDecoderHolder{decoder: decoder})
+}
+
+func (c *RegionCache) decodeRegionMetaKey(r *metapb.Region) (*metapb.Region, error) {
+	if h, ok := c.regionMetaKeyDecoder.Load().(*regionMetaKeyDecoderHolder); ok && h.decoder != nil {
+		return h.decoder(r)
+	}
+	if _, ok := c.PDClient().(*CodecPDClient); ok {
+		return decodeRegionMetaKeyWithShallowCopy(r)
+	}
+	return r, nil
+}
+
+type allReplicasFailedHolder struct {
+	callback func(region RegionVerID, err error)
+}
+
+// SetOnAllReplicasFailed sets the callback which is called when the requests to all the replicas of a region have
+// failed, e.g. a RegionRequestSender has tried all of them, which means the region is likely unavailable, so that the
+// caller can fail fast or alert instead of retrying. err is the error of the last request failing to be sent, which
+// can be nil if the replicas fail with region errors. The callback must not block.
+func (c *RegionCache) SetOnAllReplicasFailed(callback func(region RegionVerID, err error)) {
+	c.onAllReplicasFailed.Store(&allReplicasFailedHolder{callback: callback})
+}
+
+func (c *RegionCache) notifyAllReplicasFailed(region RegionVerID, err error) {
+	metrics.RegionCacheCounterWithAllReplicasFailed.Inc()
+	if h, ok := c.onAllReplicasFailed.Load().(*allReplicasFailedHolder); ok && h.callback != nil {
+		h.callback(region, err)
+	}
+}
+
+// SetRegionNotFoundRetries sets the number of times a request is retried with backoff before the region is
+// invalidated when TiKV reports RegionNotFound. The peer may miss the region only briefly during splits and merges,
+// so retrying avoids reloading the region from PD. The region is invalidated immediately if n <= 0, which is the
+// default.
+func (c *RegionCache) SetRegionNotFoundRetries(n int) {
+	if n < 0 {
+		n = 0
+	}
+	atomic.StoreInt32(&c.regionNotFoundRetries, int32(n))
+}
+
 // clear clears all cached data in the RegionCache. It's only used in tests.
 func (c *RegionCache) clear() {
 	c.mu.Lock()
 	c.mu.regions = make(map[RegionVerID]*Region)
 	c.mu.latestVersions = make(map[uint64]RegionVerID)
 	c.mu.sorted = btree.New(btreeDegree)
+	c.mu.storeRegions = make(map[uint64]map[RegionVerID]struct{})
 	c.mu.Unlock()
 	c.storeMu.Lock()
 	c.storeMu.stores = make(map[uint64]*Store)
 	c.storeMu.Unlock()
 }
 
-// Close releases region cache's resource.
+// Close releases region cache's resource. The methods that may access PD fail with tikverr.ErrClientClosed after it's
+// closed. It's safe to call Close more than once.
 func (c *RegionCache) Close() {
-	close(c.closeCh)
+	if atomic.CompareAndSwapInt32(&c.closed, 0, 1) {
+		close(c.closeCh)
+	}
+}
+
+func (c *RegionCache) checkClosed() error {
+	if atomic.LoadInt32(&c.closed) == 1 {
+		return errors.WithStack(tikverr.ErrClientClosed)
+	}
+	return nil
 }
 
 // asyncCheckAndResolveLoop with
@@ -423,11 +736,11 @@ func (c *RegionCache) asyncCheckAndResolveLoop(interval time.Duration) {
 		needCheckStores = needCheckStores[:0]
 		select {
 		case <-c.closeCh:
+			// Drop the pending stores, so that they aren't counted as pending checks after the cache is closed.
+			c.takeNeedCheckStores(needCheckStores)
 			return
 		case <-c.notifyCheckCh:
-			c.checkAndResolve(needCheckStores, func(s *Store) bool {
-				return s.getResolveState() == needCheck
-			})
+			c.resolveStores(c.takeNeedCheckStores(needCheckStores))
 		case <-ticker.C:
 			// refresh store to update labels.
 			c.checkAndResolve(needCheckStores, func(s *Store) bool {
@@ -443,6 +756,19 @@ func (c *RegionCache) asyncCheckAndResolveLoop(interval time.Duration) {
 // checkAndResolve checks and resolve addr of failed stores.
 // this method isn't thread-safe and only be used by one goroutine.
 func (c *RegionCache) checkAndResolve(needCheckStores []*Store, needCheck func(*Store) bool) {
+	c.storeMu.RLock()
+	for _, store := range c.storeMu.stores {
+		if needCheck(store) {
+			needCheckStores = append(needCheckStores, store)
+		}
+	}
+	c.storeMu.RUnlock()
+
+	c.resolveStores(needCheckStores)
+}
+
+// resolveStores re-resolves the stores one by one.
+func (c *RegionCache) resolveStores(stores []*Store) {
 	defer func() {
 		r := recover()
 		if r != nil {
@@ -452,35 +778,96 @@ func (c *RegionCache) checkAndResolve(needCheckStores []*Store, needCheck func(*
 		}
 	}()
 
-	c.storeMu.RLock()
-	for _, store := range c.storeMu.stores {
-		if needCheck(store) {
-			needCheckStores = append(needCheckStores, store)
-		}
-	}
-	c.storeMu.RUnlock()
-
-	for _, store := range needCheckStores {
+	for _, store := range stores {
 		_, err := store.reResolve(c)
 		tikverr.Log(err)
 	}
 }
 
+// notifyNeedCheck adds the store to the set of stores to check and wakes up asyncCheckAndResolveLoop. A notification
+// is coalesced with the pending one if the loop hasn't taken it yet, which is fine because the next pass checks all
+// the stores in the set.
+func (c *RegionCache) notifyNeedCheck(s *Store) {
+	c.needCheckMu.Lock()
+	// The gauge is shared by all the region caches of the process, so each cache adds its own changes to it.
+	if _, ok := c.needCheckMu.stores[s.storeID]; !ok {
+		metrics.TiKVPendingStoreChecks.Inc()
+	}
+	c.needCheckMu.stores[s.storeID] = s
+	c.needCheckMu.Unlock()
+
+	select {
+	case c.notifyCheckCh <- struct{}{}:
+	default:
+		metrics.RegionCacheCounterWithStoreCheckCoalesced.Inc()
+	}
+}
+
+// takeNeedCheckStores takes all the stores marked need check from the set atomically and appends the ones still
+// needing check to stores.
+func (c *RegionCache) takeNeedCheckStores(stores []*Store) []*Store {
+	c.needCheckMu.Lock()
+	pending := c.needCheckMu.stores
+	c.needCheckMu.stores = make(map[uint64]*Store, len(pending))
+	metrics.TiKVPendingStoreChecks.Sub(float64(len(pending)))
+	c.needCheckMu.Unlock()
+
+	for _, store := range pending {
+		if store.getResolveState() == needCheck {
+			stores = append(stores, store)
+		}
+	}
+	return stores
+}
+
 // SetRegionCacheStore is used to set a store in region cache, for testing only
 func (c *RegionCache) SetRegionCacheStore(id uint64, storeType tikvrpc.EndpointType, state uint64, labels []*metapb.StoreLabel) {
 	c.storeMu.Lock()
 	defer c.storeMu.Unlock()
-	c.storeMu.stores[id] = &Store{
+	store := &Store{
 		storeID:   id,
 		storeType: storeType,
 		state:     state,
-		labels:    labels,
 	}
+	store.setLabels(labels)
+	c.storeMu.stores[id] = store
+}
+
+// SetStoreResolveState changes the resolve state of a store in the region cache, for testing only. The state is one of
+// unresolved, resolved, needCheck, deleted and tombstone. It returns false if the store isn't in the region cache or
+// its state is changed by another one concurrently.
+func (c *RegionCache) SetStoreResolveState(storeID uint64, state uint64) bool {
+	c.storeMu.RLock()
+	store, ok := c.storeMu.stores[storeID]
+	c.storeMu.RUnlock()
+	if !ok {
+		return false
+	}
+	return store.changeResolveStateTo(store.getResolveState(), resolveState(state))
+}
+
+type pdClientHolder struct {
+	client pd.Client
 }
 
 // SetPDClient replaces pd client,for testing only
 func (c *RegionCache) SetPDClient(client pd.Client) {
-	c.pdClient = client
+	c.ReplacePDClient(client, false)
+}
+
+// ReplacePDClient replaces the pd client used by the region cache. It's safe to call it while the region cache is
+// in use, e.g., to switch to another PD endpoint when migrating the PD cluster. If invalidate is true, all cached
+// regions are invalidated so that they are reloaded from the new pd client. The replaced client isn't closed.
+func (c *RegionCache) ReplacePDClient(client pd.Client, invalidate bool) {
+	c.pdClient.Store(&pdClientHolder{client: client})
+	if !invalidate {
+		return
+	}
+	c.mu.RLock()
+	for _, r := range c.mu.regions {
+		r.invalidate(Other)
+	}
+	c.mu.RUnlock()
 }
 
 // RPCContext contains data that is needed to send RPC to a region.
@@ -495,6 +882,37 @@ type RPCContext struct {
 	ProxyStore *Store // nil means proxy is not used
 	ProxyAddr  string // valid when ProxyStore is not nil
 	TiKVNum    int    // Number of TiKV nodes among the region's peers. Assuming non-TiKV peers are all TiFlash peers.
+
+	// region is the cached region the context is built from, it's nil if it's not built by the cache.
+	region *Region
+	// released is set by ReleaseRPCContext.
+	released int32
+}
+
+// RPCOutcome is the outcome of a request sent with an RPCContext, see RegionCache.ReleaseRPCContext.
+type RPCOutcome int
+
+const (
+	// RPCOutcomeOK means the request gets a response without region errors.
+	RPCOutcomeOK RPCOutcome = iota
+	// RPCOutcomeRegionError means the request gets a region error.
+	RPCOutcomeRegionError
+	// RPCOutcomeSendFail means the request fails to be sent or gets no response.
+	RPCOutcomeSendFail
+)
+
+// ReleaseRPCContext releases the RPCContext returned by the cache after the request sent with it completes, so that
+// the requests in flight to each region are tracked, see Region.InflightRequests. Releasing an RPCContext more than
+// once or one not built by the cache is a no-op.
+func (c *RegionCache) ReleaseRPCContext(ctx *RPCContext, outcome RPCOutcome) {
+	if ctx == nil || ctx.region == nil || !atomic.CompareAndSwapInt32(&ctx.released, 0, 1) {
+		return
+	}
+	atomic.AddInt32(&ctx.region.inflight, -1)
+	// The failure is coalesced into the one that has invalidated the region or scheduled reloading it.
+	if outcome == RPCOutcomeSendFail && atomic.LoadUint64(&ctx.region.failureHandled) != 0 {
+		metrics.RegionCacheCounterWithFailureCoalesced.Inc()
+	}
 }
 
 func (c *RPCContext) String() string {
@@ -510,9 +928,95 @@ func (c *RPCContext) String() string {
 	return res
 }
 
+// RPCContextLogFields is the structured form of an RPCContext, whose fields can be indexed by log aggregation when
+// it's logged as JSON.
+type RPCContextLogFields struct {
+	RegionID      uint64 `json:"region_id"`
+	RegionConfVer uint64 `json:"region_conf_ver"`
+	RegionVer     uint64 `json:"region_ver"`
+	PeerID        uint64 `json:"peer_id"`
+	StoreID       uint64 `json:"store_id"`
+	StoreType     string `json:"store_type"`
+	Addr          string `json:"addr"`
+	AccessIdx     int    `json:"access_idx"`
+	AccessMode    string `json:"access_mode"`
+	ProxyStoreID  uint64 `json:"proxy_store_id,omitempty"`
+	ProxyAddr     string `json:"proxy_addr,omitempty"`
+	TiKVNum       int    `json:"tikv_num"`
+}
+
+// LogFields returns the structured form of the RPCContext for logging. The store fields are left empty if the
+// store is nil, and the proxy fields are left empty if the request isn't forwarded.
+func (c *RPCContext) LogFields() RPCContextLogFields {
+	f := RPCContextLogFields{
+		RegionID:      c.Region.GetID(),
+		RegionConfVer: c.Region.GetConfVer(),
+		RegionVer:     c.Region.GetVer(),
+		PeerID:        c.Peer.GetId(),
+		Addr:          c.Addr,
+		AccessIdx:     int(c.AccessIdx),
+		AccessMode:    c.AccessMode.String(),
+		TiKVNum:       c.TiKVNum,
+	}
+	if c.Store != nil {
+		f.StoreID = c.Store.storeID
+		f.StoreType = c.Store.storeType.Name()
+	}
+	if c.ProxyStore != nil {
+		f.ProxyStoreID = c.ProxyStore.storeID
+		f.ProxyAddr = c.ProxyAddr
+	}
+	return f
+}
+
+// ViaProxy returns whether the request is forwarded to the target store by a proxy store.
+func (c *RPCContext) ViaProxy() bool {
+	return c.ProxyStore != nil
+}
+
 type storeSelectorOp struct {
 	leaderOnly bool
 	labels     []*metapb.StoreLabel
+	forwarding *bool
+	// mixedReadPreference and mixedReadWeight bias the replica selected by mixed reads.
+	mixedReadPreference MixedReadPreference
+	mixedReadWeight     uint32
+	localLabels         []*metapb.StoreLabel
+	// followerLagKnown reports whether the lag of the follower on the store is known, nil means all are known.
+	followerLagKnown func(storeID uint64) bool
+	// tiFlashFallback makes GetTiFlashRPCContext return ErrNoAvailableTiFlash if there is no valid TiFlash peer.
+	tiFlashFallback bool
+}
+
+// mixedReadWeighted returns whether mixed reads are biased toward the preferred replicas.
+func (op *storeSelectorOp) mixedReadWeighted() bool {
+	return op.mixedReadPreference != MixedReadPreferNone && op.mixedReadWeight > 1
+}
+
+// isPreferredByMixedRead returns whether the replica on the store is preferred by mixed reads.
+func (op *storeSelectorOp) isPreferredByMixedRead(isLeader bool, s *Store) bool {
+	switch op.mixedReadPreference {
+	case MixedReadPreferLeader:
+		return isLeader
+	case MixedReadPreferLocal:
+		return len(op.localLabels) > 0 && s.IsLabelsMatch(op.localLabels)
+	default:
+		return false
+	}
+}
+
+// forwardingEnabled returns whether requests can be forwarded by a proxy store, falling back to defaultValue
+// if WithForwarding is not specified.
+func (op *storeSelectorOp) forwardingEnabled(defaultValue bool) bool {
+	if op.forwarding == nil {
+		return defaultValue
+	}
+	return *op.forwarding
+}
+
+// isFollowerLagUnknown returns whether the follower on the store should be skipped for its unknown lag.
+func (op *storeSelectorOp) isFollowerLagUnknown(store *Store) bool {
+	return op.followerLagKnown != nil && !op.followerLagKnown(store.storeID)
 }
 
 // StoreSelectorOption configures storeSelectorOp.
@@ -525,6 +1029,16 @@ func WithMatchLabels(labels []*metapb.StoreLabel) StoreSelectorOption {
 	}
 }
 
+// WithTiFlashFallback makes GetTiFlashRPCContext return ErrNoAvailableTiFlash instead of nil when the region has no
+// TiFlash peer, or all the TiFlash peers of the region are invalid or mismatch the labels, so that the caller can tell
+// it from a stale region and send the request to TiKV instead of retrying TiFlash. A region without TiFlash peers
+// isn't invalidated then, since reloading it doesn't help the caller that falls back.
+func WithTiFlashFallback() StoreSelectorOption {
+	return func(op *storeSelectorOp) {
+		op.tiFlashFallback = true
+	}
+}
+
 // WithLeaderOnly indicates selecting stores with leader only.
 func WithLeaderOnly() StoreSelectorOption {
 	return func(op *storeSelectorOp) {
@@ -532,9 +1046,67 @@ func WithLeaderOnly() StoreSelectorOption {
 	}
 }
 
+// WithSkipFollowersOfUnknownLag makes follower and mixed reads skip the followers whose lag behind the leader is
+// unknown, i.e. lagKnown returns false for their stores, e.g. because the stores haven't reported their safe ts.
+// The reads fall back to the leader if no follower is left.
+//
+// It's a safety setting for the reads that can't tolerate a lagging follower: the reads stay correct, but the load
+// they put on the followers moves to the leader whenever the lag info is missing, e.g. right after the client starts
+// or a store restarts. By default, any follower can be selected.
+func WithSkipFollowersOfUnknownLag(lagKnown func(storeID uint64) bool) StoreSelectorOption {
+	return func(op *storeSelectorOp) {
+		op.followerLagKnown = lagKnown
+	}
+}
+
+// WithForwarding indicates whether requests to an unreachable leader can be forwarded by a proxy store.
+// It overrides the EnableForwarding config for the requests sent with it.
+func WithForwarding(enabled bool) StoreSelectorOption {
+	return func(op *storeSelectorOp) {
+		op.forwarding = &enabled
+	}
+}
+
+// MixedReadPreference indicates the replicas preferred by mixed reads, i.e. kv.ReplicaReadMixed.
+type MixedReadPreference int
+
+const (
+	// MixedReadPreferNone selects the replicas uniformly, which is the default.
+	MixedReadPreferNone MixedReadPreference = iota
+	// MixedReadPreferLeader prefers the leader for fresher data.
+	MixedReadPreferLeader
+	// MixedReadPreferLocal prefers the replicas on the local stores for lower latency.
+	MixedReadPreferLocal
+)
+
+// WithMixedReadPreference biases mixed reads toward the preferred replicas, each of which is weight times as likely
+// to be selected as another replica. The stores matching localLabels, e.g. the zone label, are the local stores for
+// MixedReadPreferLocal. It takes no effect if weight <= 1.
+func WithMixedReadPreference(pref MixedReadPreference, weight uint32, localLabels []*metapb.StoreLabel) StoreSelectorOption {
+	return func(op *storeSelectorOp) {
+		op.mixedReadPreference = pref
+		op.mixedReadWeight = weight
+		op.localLabels = localLabels
+	}
+}
+
 // GetTiKVRPCContext returns RPCContext for a region. If it returns nil, the region
-// must be out of date and already dropped from cache.
-func (c *RegionCache) GetTiKVRPCContext(bo *retry.Backoffer, id RegionVerID, replicaRead kv.ReplicaReadType, followerStoreSeed uint32, opts ...StoreSelectorOption) (*RPCContext, error) {
+// must be out of date and already dropped from cache, or the stores of it keep failing. The RPCContext should be
+// released by ReleaseRPCContext.
+func (c *RegionCache) GetTiKVRPCContext(bo *retry.Backoffer, id RegionVerID, replicaRead kv.ReplicaReadType, followerStoreSeed uint32, opts ...StoreSelectorOption) (rpcCtx *RPCContext, err error) {
+	if err = c.checkClosed(); err != nil {
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			return
+		}
+		if rpcCtx == nil {
+			metrics.RegionCacheLookupRPCCtxNil.Inc()
+		} else {
+			metrics.RegionCacheLookupRPCCtxHit.Inc()
+		}
+	}()
 	ts := time.Now().Unix()
 
 	cachedRegion := c.GetCachedRegionWithRLock(id)
@@ -550,27 +1122,137 @@ func (c *RegionCache) GetTiKVRPCContext(bo *retry.Backoffer, id RegionVerID, rep
 		return nil, nil
 	}
 
+	options := &storeSelectorOp{}
+	for _, op := range opts {
+		op(options)
+	}
+	for i := 0; ; i++ {
+		regionStore := cachedRegion.getStore()
+		var (
+			store     *Store
+			peer      *metapb.Peer
+			storeIdx  int
+			accessIdx AccessIndex
+		)
+		isLeaderReq := false
+		switch replicaRead {
+		case kv.ReplicaReadFollower:
+			store, peer, accessIdx, storeIdx = cachedRegion.FollowerStorePeer(regionStore, followerStoreSeed, options)
+		case kv.ReplicaReadMixed:
+			store, peer, accessIdx, storeIdx = cachedRegion.AnyStorePeer(regionStore, followerStoreSeed, options)
+		default:
+			isLeaderReq = true
+			store, peer, accessIdx, storeIdx = cachedRegion.WorkStorePeer(regionStore)
+		}
+		forwarding := isLeaderReq && options.forwardingEnabled(c.enableForwarding)
+		rpcCtx, err = c.buildTiKVRPCContext(bo, id, cachedRegion, regionStore, store, peer, accessIdx, storeIdx, forwarding)
+		// Select the store again if the store epochs are refreshed, the region is still valid in this case.
+		if err != nil || rpcCtx != nil || i >= maxStoreEpochRefreshRetries ||
+			cachedRegion.checkNeedReload() || cachedRegion.getStore() == regionStore {
+			return rpcCtx, err
+		}
+	}
+}
+
+// PeekTargetStore returns the store that GetTiKVRPCContext would select for the request right now. It's side-effect
+// free: it only looks at the cached region without loading regions or resolving stores from PD, refreshing the
+// region's TTL or choosing a proxy. It returns false if the region isn't cached or valid, or the selected store isn't
+// resolved yet. The result is advisory since the selection may change before the request is sent, e.g., for planning
+// tasks by store.
+func (c *RegionCache) PeekTargetStore(id RegionVerID, replicaRead kv.ReplicaReadType, followerStoreSeed uint32, opts ...StoreSelectorOption) (storeID uint64, addr string, ok bool) {
+	cachedRegion := c.GetCachedRegionWithRLock(id)
+	if cachedRegion == nil || cachedRegion.checkNeedReload() {
+		return 0, "", false
+	}
+	if time.Now().Unix()-atomic.LoadInt64(&cachedRegion.lastAccess) > regionCacheTTLSec {
+		return 0, "", false
+	}
+
 	regionStore := cachedRegion.getStore()
-	var (
-		store     *Store
-		peer      *metapb.Peer
-		storeIdx  int
-		accessIdx AccessIndex
-	)
 	options := &storeSelectorOp{}
 	for _, op := range opts {
 		op(options)
 	}
-	isLeaderReq := false
+	var (
+		store    *Store
+		storeIdx int
+	)
 	switch replicaRead {
 	case kv.ReplicaReadFollower:
-		store, peer, accessIdx, storeIdx = cachedRegion.FollowerStorePeer(regionStore, followerStoreSeed, options)
+		store, _, _, storeIdx = cachedRegion.FollowerStorePeer(regionStore, followerStoreSeed, options)
 	case kv.ReplicaReadMixed:
-		store, peer, accessIdx, storeIdx = cachedRegion.AnyStorePeer(regionStore, followerStoreSeed, options)
+		store, _, _, storeIdx = cachedRegion.AnyStorePeer(regionStore, followerStoreSeed, options)
 	default:
-		isLeaderReq = true
-		store, peer, accessIdx, storeIdx = cachedRegion.WorkStorePeer(regionStore)
+		store, _, _, storeIdx = cachedRegion.WorkStorePeer(regionStore)
+	}
+	if store == nil || atomic.LoadUint32(&store.epoch) != regionStore.storeEpochs[storeIdx] {
+		return 0, "", false
+	}
+	switch store.getResolveState() {
+	case resolved, needCheck:
+		return store.storeID, store.addr, len(store.addr) > 0
+	default:
+		return 0, "", false
+	}
+}
+
+// GetTiKVReadIndexRPCContexts returns the RPCContext of the leader, to which the ReadIndex request should be sent,
+// and the RPCContext of a follower to read from after that. Both are picked from the same snapshot of the region's
+// stores so that they are consistent with each other. If the region has no available follower, the follower
+// RPCContext points to the leader. If it returns nil, the region must be out of date and already dropped from cache.
+func (c *RegionCache) GetTiKVReadIndexRPCContexts(bo *retry.Backoffer, id RegionVerID, followerStoreSeed uint32, opts ...StoreSelectorOption) (leaderCtx *RPCContext, followerCtx *RPCContext, err error) {
+	if err = c.checkClosed(); err != nil {
+		return nil, nil, err
+	}
+	ts := time.Now().Unix()
+
+	cachedRegion := c.GetCachedRegionWithRLock(id)
+	if cachedRegion == nil {
+		return nil, nil, nil
 	}
+
+	if cachedRegion.checkNeedReload() {
+		return nil, nil, nil
+	}
+
+	if !cachedRegion.checkRegionCacheTTL(ts) {
+		return nil, nil, nil
+	}
+
+	regionStore := cachedRegion.getStore()
+	options := &storeSelectorOp{}
+	for _, op := range opts {
+		op(options)
+	}
+	store, peer, accessIdx, storeIdx := cachedRegion.WorkStorePeer(regionStore)
+	leaderCtx, err = c.buildTiKVRPCContext(bo, id, cachedRegion, regionStore, store, peer, accessIdx, storeIdx, options.forwardingEnabled(c.enableForwarding))
+	if err != nil || leaderCtx == nil {
+		return nil, nil, err
+	}
+	store, peer, accessIdx, storeIdx = cachedRegion.FollowerStorePeer(regionStore, followerStoreSeed, options)
+	followerCtx, err = c.buildTiKVRPCContext(bo, id, cachedRegion, regionStore, store, peer, accessIdx, storeIdx, false)
+	if err != nil || followerCtx == nil {
+		// No request is sent with the leader's context.
+		c.ReleaseRPCContext(leaderCtx, RPCOutcomeOK)
+		return nil, nil, err
+	}
+	return leaderCtx, followerCtx, nil
+}
+
+// buildTiKVRPCContext builds the RPCContext to access the store selected from the regionStore of the cached region.
+// If forwarding is true and the store is unreachable, the request is sent via a proxy store.
+// It returns nil if the store is not found or has failed since the regionStore was built.
+func (c *RegionCache) buildTiKVRPCContext(
+	bo *retry.Backoffer,
+	id RegionVerID,
+	cachedRegion *Region,
+	regionStore *regionStore,
+	store *Store,
+	peer *metapb.Peer,
+	accessIdx AccessIndex,
+	storeIdx int,
+	forwarding bool,
+) (*RPCContext, error) {
 	addr, err := c.getStoreAddr(bo, cachedRegion, store)
 	if err != nil {
 		return nil, err
@@ -589,6 +1271,9 @@ func (c *RegionCache) GetTiKVRPCContext(bo *retry.Backoffer, id RegionVerID, rep
 
 	storeFailEpoch := atomic.LoadUint32(&store.epoch)
 	if storeFailEpoch != regionStore.storeEpochs[storeIdx] {
+		if c.refreshStoreEpochs(cachedRegion, regionStore, storeIdx) {
+			return nil, nil
+		}
 		cachedRegion.invalidate(Other)
 		logutil.BgLogger().Info("invalidate current region, because others failed on same store",
 			zap.Uint64("region", id.GetID()),
@@ -600,7 +1285,7 @@ func (c *RegionCache) GetTiKVRPCContext(bo *retry.Backoffer, id RegionVerID, rep
 		proxyStore *Store
 		proxyAddr  string
 	)
-	if c.enableForwarding && isLeaderReq {
+	if forwarding {
 		if atomic.LoadInt32(&store.unreachable) == 0 {
 			regionStore.unsetProxyStoreIfNeeded(cachedRegion)
 		} else {
@@ -614,7 +1299,7 @@ func (c *RegionCache) GetTiKVRPCContext(bo *retry.Backoffer, id RegionVerID, rep
 		}
 	}
 
-	return &RPCContext{
+	return cachedRegion.acquireRPCContext(&RPCContext{
 		Region:     id,
 		Meta:       cachedRegion.meta,
 		Peer:       peer,
@@ -625,11 +1310,35 @@ func (c *RegionCache) GetTiKVRPCContext(bo *retry.Backoffer, id RegionVerID, rep
 		ProxyStore: proxyStore,
 		ProxyAddr:  proxyAddr,
 		TiKVNum:    regionStore.accessStoreNum(tiKVOnly),
-	}, nil
+	}), nil
 }
 
-// GetAllValidTiFlashStores returns the store ids of all valid TiFlash stores, the store id of currentStore is always the first one
-func (c *RegionCache) GetAllValidTiFlashStores(id RegionVerID, currentStore *Store) []uint64 {
+// CurrentTiFlashStore returns the ID of the TiFlash store that the region currently targets, i.e. the store at its
+// workTiFlashIdx, which is rotated by GetTiFlashRPCContext with loadBalance. It returns false if the region isn't
+// cached or has no TiFlash peer.
+func (c *RegionCache) CurrentTiFlashStore(id RegionVerID) (uint64, bool) {
+	cachedRegion := c.GetCachedRegionWithRLock(id)
+	if cachedRegion == nil {
+		return 0, false
+	}
+	regionStore := cachedRegion.getStore()
+	num := regionStore.accessStoreNum(tiFlashOnly)
+	if num == 0 {
+		return 0, false
+	}
+	accessIdx := AccessIndex(int(atomic.LoadInt32(&regionStore.workTiFlashIdx)) % num)
+	_, store := regionStore.accessStore(tiFlashOnly, accessIdx)
+	return store.storeID, true
+}
+
+// GetAllValidTiFlashStores returns the store ids of all valid TiFlash stores, the store id of currentStore is always the first one.
+// Stores not matching the labels in opts are excluded.
+func (c *RegionCache) GetAllValidTiFlashStores(id RegionVerID, currentStore *Store, opts ...StoreSelectorOption) []uint64 {
+	op := &storeSelectorOp{}
+	for _, o := range opts {
+		o(op)
+	}
+
 	// set the cap to 2 because usually, TiFlash table will have 2 replicas
 	allStores := make([]uint64, 0, 2)
 	// make sure currentStore id is always the first in allStores
@@ -653,6 +1362,9 @@ func (c *RegionCache) GetAllValidTiFlashStores(id RegionVerID, currentStore *Sto
 		if store.getResolveState() == needCheck {
 			continue
 		}
+		if !store.IsLabelsMatch(op.labels) {
+			continue
+		}
 		storeFailEpoch := atomic.LoadUint32(&store.epoch)
 		if storeFailEpoch != regionStore.storeEpochs[storeIdx] {
 			continue
@@ -662,11 +1374,68 @@ func (c *RegionCache) GetAllValidTiFlashStores(id RegionVerID, currentStore *Sto
 	return allStores
 }
 
+// CheckTiFlashCoverage checks whether every region in [startKey, endKey) has a valid TiFlash peer, i.e. a peer on a
+// resolved TiFlash store whose epoch matches. An empty endKey means the range has no upper bound. The regions
+// without a valid TiFlash peer are returned in missing.
+func (c *RegionCache) CheckTiFlashCoverage(bo *retry.Backoffer, startKey, endKey []byte) (covered bool, missing []RegionVerID, err error) {
+	if err = c.checkClosed(); err != nil {
+		return false, nil, err
+	}
+	for {
+		loc, err := c.LocateKey(bo, startKey)
+		if err != nil {
+			return false, nil, err
+		}
+		valid, err := c.hasValidTiFlashPeer(bo, loc.Region)
+		if err != nil {
+			return false, nil, err
+		}
+		if !valid {
+			missing = append(missing, loc.Region)
+		}
+		if len(loc.EndKey) == 0 || (len(endKey) > 0 && bytes.Compare(loc.EndKey, endKey) >= 0) {
+			break
+		}
+		startKey = loc.EndKey
+	}
+	return len(missing) == 0, missing, nil
+}
+
+// hasValidTiFlashPeer checks whether the cached region has a peer on a resolved TiFlash store whose epoch matches.
+func (c *RegionCache) hasValidTiFlashPeer(bo *retry.Backoffer, id RegionVerID) (bool, error) {
+	cachedRegion := c.GetCachedRegionWithRLock(id)
+	if cachedRegion == nil {
+		return false, nil
+	}
+	regionStore := cachedRegion.getStore()
+	for i := 0; i < regionStore.accessStoreNum(tiFlashOnly); i++ {
+		storeIdx, store := regionStore.accessStore(tiFlashOnly, AccessIndex(i))
+		addr, err := c.getStoreAddr(bo, cachedRegion, store)
+		if err != nil {
+			return false, err
+		}
+		if len(addr) > 0 && atomic.LoadUint32(&store.epoch) == regionStore.storeEpochs[storeIdx] {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
 // GetTiFlashRPCContext returns RPCContext for a region must access flash store. If it returns nil, the region
 // must be out of date and already dropped from cache or not flash store found.
 // `loadBalance` is an option. For MPP and batch cop, it is pointless and might cause try the failed store repeatly.
-func (c *RegionCache) GetTiFlashRPCContext(bo *retry.Backoffer, id RegionVerID, loadBalance bool) (*RPCContext, error) {
+// If labels are specified in opts, only the TiFlash stores matching them are selected, and nil is returned if
+// there is no such store. If WithTiFlashFallback is specified, ErrNoAvailableTiFlash is returned instead of nil when
+// all the TiFlash peers are invalid or mismatch the labels, and nil means the region is stale only. The RPCContext should be released by ReleaseRPCContext.
+func (c *RegionCache) GetTiFlashRPCContext(bo *retry.Backoffer, id RegionVerID, loadBalance bool, opts ...StoreSelectorOption) (*RPCContext, error) {
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
 	ts := time.Now().Unix()
+	op := &storeSelectorOp{}
+	for _, o := range opts {
+		o(op)
+	}
 
 	cachedRegion := c.GetCachedRegionWithRLock(id)
 	if cachedRegion == nil {
@@ -677,6 +1446,9 @@ func (c *RegionCache) GetTiFlashRPCContext(bo *retry.Backoffer, id RegionVerID,
 	}
 
 	regionStore := cachedRegion.getStore()
+	if op.tiFlashFallback && regionStore.accessStoreNum(tiFlashOnly) == 0 {
+		return nil, errors.WithStack(&tikverr.ErrNoAvailableTiFlash{RegionID: id.GetID()})
+	}
 
 	// sIdx is for load balance of TiFlash store.
 	var sIdx int
@@ -685,6 +1457,7 @@ func (c *RegionCache) GetTiFlashRPCContext(bo *retry.Backoffer, id RegionVerID,
 	} else {
 		sIdx = int(atomic.LoadInt32(&regionStore.workTiFlashIdx))
 	}
+	labelMismatched := 0
 	for i := 0; i < regionStore.accessStoreNum(tiFlashOnly); i++ {
 		accessIdx := AccessIndex((sIdx + i) % regionStore.accessStoreNum(tiFlashOnly))
 		storeIdx, store := regionStore.accessStore(tiFlashOnly, accessIdx)
@@ -700,6 +1473,10 @@ func (c *RegionCache) GetTiFlashRPCContext(bo *retry.Backoffer, id RegionVerID,
 			_, err := store.reResolve(c)
 			tikverr.Log(err)
 		}
+		if !store.IsLabelsMatch(op.labels) {
+			labelMismatched++
+			continue
+		}
 		atomic.StoreInt32(&regionStore.workTiFlashIdx, int32(accessIdx))
 		peer := cachedRegion.meta.Peers[storeIdx]
 		storeFailEpoch := atomic.LoadUint32(&store.epoch)
@@ -711,7 +1488,7 @@ func (c *RegionCache) GetTiFlashRPCContext(bo *retry.Backoffer, id RegionVerID,
 			// TiFlash will always try to find out a valid peer, avoiding to retry too many times.
 			continue
 		}
-		return &RPCContext{
+		return cachedRegion.acquireRPCContext(&RPCContext{
 			Region:     id,
 			Meta:       cachedRegion.meta,
 			Peer:       peer,
@@ -720,10 +1497,21 @@ func (c *RegionCache) GetTiFlashRPCContext(bo *retry.Backoffer, id RegionVerID,
 			Addr:       addr,
 			AccessMode: tiFlashOnly,
 			TiKVNum:    regionStore.accessStoreNum(tiKVOnly),
-		}, nil
+		}), nil
 	}
 
+	// The region is still valid if no store matches the labels, let the caller decide how to fall back.
+	if labelMismatched == regionStore.accessStoreNum(tiFlashOnly) && labelMismatched > 0 {
+		if op.tiFlashFallback {
+			return nil, errors.WithStack(&tikverr.ErrNoAvailableTiFlash{RegionID: id.GetID()})
+		}
+		return nil, nil
+	}
+	// The region is still invalidated so that the TiFlash stores are checked again the next time it's loaded.
 	cachedRegion.invalidate(Other)
+	if op.tiFlashFallback {
+		return nil, errors.WithStack(&tikverr.ErrNoAvailableTiFlash{RegionID: id.GetID()})
+	}
 	return nil, nil
 }
 
@@ -741,6 +1529,48 @@ func (l *KeyLocation) Contains(key []byte) bool {
 		(bytes.Compare(key, l.EndKey) < 0 || len(l.EndKey) == 0)
 }
 
+// Compare returns the position of key relative to the region: -1 if it's before StartKey, 0 if it's in
+// [StartKey, EndKey), and 1 if it's at or after EndKey. An empty EndKey means the region has no upper bound.
+func (l *KeyLocation) Compare(key []byte) int {
+	if bytes.Compare(key, l.StartKey) < 0 {
+		return -1
+	}
+	if len(l.EndKey) > 0 && bytes.Compare(key, l.EndKey) >= 0 {
+		return 1
+	}
+	return 0
+}
+
+// ClampRange returns the intersection of [start, end) and the region. An empty start means no lower bound and an
+// empty end means no upper bound, so the returned end is empty only if neither the range nor the region has an
+// upper bound. ok is false if the range and the region are disjoint. The returned keys are not copied.
+func (l *KeyLocation) ClampRange(start, end []byte) (cs, ce []byte, ok bool) {
+	cs = start
+	if bytes.Compare(cs, l.StartKey) < 0 {
+		cs = l.StartKey
+	}
+	ce = end
+	if len(ce) == 0 || (len(l.EndKey) > 0 && bytes.Compare(l.EndKey, ce) < 0) {
+		ce = l.EndKey
+	}
+	if len(ce) > 0 && bytes.Compare(cs, ce) >= 0 {
+		return nil, nil, false
+	}
+	return cs, ce, true
+}
+
+// CoversRange checks if [start, end) is entirely in the region. An empty start means no lower bound and an empty end
+// means no upper bound.
+func (l *KeyLocation) CoversRange(start, end []byte) bool {
+	if bytes.Compare(start, l.StartKey) < 0 {
+		return false
+	}
+	if len(l.EndKey) == 0 {
+		return true
+	}
+	return len(end) > 0 && bytes.Compare(end, l.EndKey) <= 0
+}
+
 // String implements fmt.Stringer interface.
 func (l *KeyLocation) String() string {
 	return fmt.Sprintf("region %s,startKey:%s,endKey:%s", l.Region.String(), kv.StrKey(l.StartKey), kv.StrKey(l.EndKey))
@@ -786,6 +1616,9 @@ func (b *Bucket) Contains(key []byte) bool {
 
 // LocateKey searches for the region and range that the key is located.
 func (c *RegionCache) LocateKey(bo *retry.Backoffer, key []byte) (*KeyLocation, error) {
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
 	r, err := c.findRegionByKey(bo, key, false)
 	if err != nil {
 		return nil, err
@@ -801,6 +1634,9 @@ func (c *RegionCache) LocateKey(bo *retry.Backoffer, key []byte) (*KeyLocation,
 // LocateEndKey searches for the region and range that the key is located.
 // Unlike LocateKey, start key of a region is exclusive and end key is inclusive.
 func (c *RegionCache) LocateEndKey(bo *retry.Backoffer, key []byte) (*KeyLocation, error) {
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
 	r, err := c.findRegionByKey(bo, key, true)
 	if err != nil {
 		return nil, err
@@ -813,23 +1649,84 @@ func (c *RegionCache) LocateEndKey(bo *retry.Backoffer, key []byte) (*KeyLocatio
 	}, nil
 }
 
+// LeaderAddr returns the address and the ID of the leader store of the region that the key is located. The region
+// is reloaded with backoff if it's not cached, out of date, or its leader store can't be resolved.
+func (c *RegionCache) LeaderAddr(bo *retry.Backoffer, key []byte) (string, uint64, error) {
+	if err := c.checkClosed(); err != nil {
+		return "", 0, err
+	}
+	for {
+		loc, err := c.LocateKey(bo, key)
+		if err != nil {
+			return "", 0, err
+		}
+		rpcCtx, err := c.GetTiKVRPCContext(bo, loc.Region, kv.ReplicaReadLeader, 0)
+		if err != nil {
+			return "", 0, err
+		}
+		if rpcCtx != nil {
+			// No request is sent with it.
+			c.ReleaseRPCContext(rpcCtx, RPCOutcomeOK)
+			return rpcCtx.Addr, rpcCtx.Store.StoreID(), nil
+		}
+		// The region is out of date, drop it so that it's reloaded by the next LocateKey.
+		c.InvalidateCachedRegion(loc.Region)
+		if err = bo.Backoff(retry.BoRegionMiss, errors.Errorf("region %d is out of date", loc.Region.GetID())); err != nil {
+			return "", 0, err
+		}
+	}
+}
+
+// cacheLookupSampleRate is the rate of timing the region cache lookups. Only 1 of every cacheLookupSampleRate
+// lookups is timed, so that the cache hits don't pay for reading the clock and observing the histogram.
+const cacheLookupSampleRate = 64
+
+var cacheLookupSeq uint32
+
+func sampleCacheLookup() bool {
+	return atomic.AddUint32(&cacheLookupSeq, 1)%cacheLookupSampleRate == 0
+}
+
 func (c *RegionCache) findRegionByKey(bo *retry.Backoffer, key []byte, isEndKey bool) (r *Region, err error) {
-	r = c.searchCachedRegion(key, isEndKey)
+	hitCounter, missCounter, staleCounter, expiredCounter := metrics.RegionCacheLookupLocateKeyHit,
+		metrics.RegionCacheLookupLocateKeyMissLoad, metrics.RegionCacheLookupLocateKeyHitStaleReload,
+		metrics.RegionCacheLookupLocateKeyExpired
+	if isEndKey {
+		hitCounter, missCounter, staleCounter, expiredCounter = metrics.RegionCacheLookupLocateEndKeyHit,
+			metrics.RegionCacheLookupLocateEndKeyMissLoad, metrics.RegionCacheLookupLocateEndKeyHitStaleReload,
+			metrics.RegionCacheLookupLocateEndKeyExpired
+	}
+	var start time.Time
+	sampled := sampleCacheLookup()
+	if sampled {
+		start = time.Now()
+	}
+	r, expired := c.searchCachedRegionWithExpired(key, isEndKey)
+	if sampled {
+		metrics.RegionCacheLookupDurationCache.Observe(time.Since(start).Seconds())
+	}
 	if r == nil {
+		if expired {
+			expiredCounter.Inc()
+		} else {
+			missCounter.Inc()
+		}
 		// load region when it is not exists or expired.
-		lr, err := c.loadRegion(bo, key, isEndKey)
+		start = time.Now()
+		lr, err := c.loadAndInsertRegion(bo, key, isEndKey)
+		metrics.RegionCacheLookupDurationPDLoad.Observe(time.Since(start).Seconds())
 		if err != nil {
 			// no region data, return error if failure.
 			return nil, err
 		}
 		logutil.Eventf(bo.GetCtx(), "load region %d from pd, due to cache-miss", lr.GetID())
 		r = lr
-		c.mu.Lock()
-		c.insertRegionToCache(r)
-		c.mu.Unlock()
 	} else if r.checkNeedReloadAndMarkUpdated() {
+		staleCounter.Inc()
 		// load region when it be marked as need reload.
+		start = time.Now()
 		lr, err := c.loadRegion(bo, key, isEndKey)
+		metrics.RegionCacheLookupDurationPDLoad.Observe(time.Since(start).Seconds())
 		if err != nil {
 			// ignore error and use old region info.
 			logutil.Logger(bo.GetCtx()).Error("load region failure",
@@ -841,6 +1738,8 @@ func (c *RegionCache) findRegionByKey(bo *retry.Backoffer, key []byte, isEndKey
 			c.insertRegionToCache(r)
 			c.mu.Unlock()
 		}
+	} else {
+		hitCounter.Inc()
 	}
 	return r, nil
 }
@@ -888,11 +1787,58 @@ func (c *RegionCache) OnSendFailForTiFlash(bo *retry.Backoffer, store *Store, re
 	}
 
 	// force reload region when retry all known peers in region.
-	if scheduleReload {
+	if scheduleReload && r.claimFailureHandling(rs) {
 		r.scheduleReload()
+		c.notifyAllReplicasFailed(region, err)
 	}
 }
 
+// maxStoreEpochRefreshRetries is the max number of times GetTiKVRPCContext selects the store again after the store
+// epochs of the region are refreshed.
+const maxStoreEpochRefreshRetries = 3
+
+// refreshStoreEpochs is called when the store at storeIdx of the regionStore has failed since the regionStore was
+// built. The region meta is still valid and only the health of the store changes, so instead of invalidating the
+// region and loading it from PD again, it refreshes the snapshot of the store's epoch and switches the work TiKV away
+// from the failed store. A peer is healthy if its store hasn't failed since the regionStore was built either, and it
+// returns false if no healthy TiKV peer remains, and the region should be invalidated then.
+func (c *RegionCache) refreshStoreEpochs(r *Region, rs *regionStore, storeIdx int) bool {
+	if c.disableStoreEpochRefresh {
+		return false
+	}
+	healthyIdx := AccessIndex(-1)
+	tiKVNum := rs.accessStoreNum(tiKVOnly)
+	for i := 0; i < tiKVNum; i++ {
+		accessIdx := AccessIndex((int(rs.workTiKVIdx) + i) % tiKVNum)
+		sidx, store := rs.accessStore(tiKVOnly, accessIdx)
+		if sidx == storeIdx || rs.storeEpochs[sidx] != atomic.LoadUint32(&store.epoch) ||
+			atomic.LoadInt32(&store.unreachable) != 0 {
+			continue
+		}
+		if state := store.getResolveState(); state == tombstone || state == deleted {
+			continue
+		}
+		healthyIdx = accessIdx
+		break
+	}
+	if healthyIdx < 0 {
+		metrics.RegionCacheCounterWithEpochMismatchInvalidate.Inc()
+		return false
+	}
+	newRs := rs.clone()
+	newRs.storeEpochs[storeIdx] = atomic.LoadUint32(&rs.stores[storeIdx].epoch)
+	newRs.workTiKVIdx = healthyIdx
+	if newRs.proxyTiKVIdx >= 0 {
+		if sidx, _ := newRs.accessStore(tiKVOnly, newRs.proxyTiKVIdx); sidx == storeIdx {
+			newRs.proxyTiKVIdx = -1
+		}
+	}
+	// If the CAS fails, the regionStore has been replaced by others and the caller just selects the store again.
+	r.compareAndSwapStore(rs, newRs)
+	metrics.RegionCacheCounterWithEpochMismatchRefresh.Inc()
+	return true
+}
+
 func (c *RegionCache) markRegionNeedBeRefill(s *Store, storeIdx int, rs *regionStore) int {
 	incEpochStoreIdx := -1
 	// invalidate regions in store.
@@ -903,13 +1849,16 @@ func (c *RegionCache) markRegionNeedBeRefill(s *Store, storeIdx int, rs *regionS
 		metrics.RegionCacheCounterWithInvalidateStoreRegionsOK.Inc()
 	}
 	// schedule a store addr resolve.
-	s.markNeedCheck(c.notifyCheckCh)
+	s.markNeedCheck(c)
 	return incEpochStoreIdx
 }
 
 // OnSendFail handles send request fail logic.
 func (c *RegionCache) OnSendFail(bo *retry.Backoffer, ctx *RPCContext, scheduleReload bool, err error) {
 	metrics.RegionCacheCounterWithSendFail.Inc()
+	if ctx.Store != nil {
+		ctx.Store.sendStats.record(ctx.Store.storeID, true)
+	}
 	r := c.GetCachedRegionWithRLock(ctx.Region)
 	if r == nil {
 		return
@@ -950,20 +1899,42 @@ func (c *RegionCache) OnSendFail(bo *retry.Backoffer, ctx *RPCContext, scheduleR
 	}
 
 	// force reload region when retry all known peers in region.
-	if scheduleReload {
+	if scheduleReload && r.claimFailureHandling(rs) {
 		r.scheduleReload()
+		c.notifyAllReplicasFailed(ctx.Region, err)
 	}
-
 }
 
 // LocateRegionByID searches for the region with ID.
 func (c *RegionCache) LocateRegionByID(bo *retry.Backoffer, regionID uint64) (*KeyLocation, error) {
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
+	var start time.Time
+	sampled := sampleCacheLookup()
+	if sampled {
+		start = time.Now()
+	}
 	c.mu.RLock()
 	r := c.getRegionByIDFromCache(regionID)
+	dangling := r == nil && c.hasDanglingVersion(regionID)
+	_, cached := c.mu.latestVersions[regionID]
+	expired := r == nil && cached && !dangling
 	c.mu.RUnlock()
+	if sampled {
+		metrics.RegionCacheLookupDurationCache.Observe(time.Since(start).Seconds())
+	}
+	if dangling {
+		c.mu.Lock()
+		c.removeDanglingVersion(regionID)
+		c.mu.Unlock()
+	}
 	if r != nil {
 		if r.checkNeedReloadAndMarkUpdated() {
+			metrics.RegionCacheLookupByIDHitStaleReload.Inc()
+			start = time.Now()
 			lr, err := c.loadRegionByID(bo, regionID)
+			metrics.RegionCacheLookupDurationPDLoad.Observe(time.Since(start).Seconds())
 			if err != nil {
 				// ignore error and use old region info.
 				logutil.Logger(bo.GetCtx()).Error("load region failure",
@@ -974,6 +1945,8 @@ func (c *RegionCache) LocateRegionByID(bo *retry.Backoffer, regionID uint64) (*K
 				c.insertRegionToCache(r)
 				c.mu.Unlock()
 			}
+		} else {
+			metrics.RegionCacheLookupByIDHit.Inc()
 		}
 		loc := &KeyLocation{
 			Region:   r.VerID(),
@@ -984,7 +1957,14 @@ func (c *RegionCache) LocateRegionByID(bo *retry.Backoffer, regionID uint64) (*K
 		return loc, nil
 	}
 
+	if expired {
+		metrics.RegionCacheLookupByIDExpired.Inc()
+	} else {
+		metrics.RegionCacheLookupByIDMissLoad.Inc()
+	}
+	start = time.Now()
 	r, err := c.loadRegionByID(bo, regionID)
+	metrics.RegionCacheLookupDurationPDLoad.Observe(time.Since(start).Seconds())
 	if err != nil {
 		return nil, err
 	}
@@ -1000,11 +1980,102 @@ func (c *RegionCache) LocateRegionByID(bo *retry.Backoffer, regionID uint64) (*K
 	}, nil
 }
 
+// locateRegionsByIDConcurrency is the max number of regions loaded from PD concurrently by LocateRegionsByID.
+const locateRegionsByIDConcurrency = 16
+
+// LocateRegionsByID searches for the regions with the given IDs like LocateRegionByID. The cached regions are
+// located from the cache, and the others are loaded from PD concurrently. It returns the locations of the regions
+// found and the errors of the others, both keyed by region ID.
+func (c *RegionCache) LocateRegionsByID(bo *retry.Backoffer, regionIDs []uint64) (map[uint64]*KeyLocation, map[uint64]error) {
+	locs := make(map[uint64]*KeyLocation, len(regionIDs))
+	errs := make(map[uint64]error)
+
+	misses := make([]uint64, 0, len(regionIDs))
+	seen := make(map[uint64]struct{}, len(regionIDs))
+	for _, id := range regionIDs {
+		if _, ok := seen[id]; ok {
+			continue
+		}
+		seen[id] = struct{}{}
+		c.mu.RLock()
+		cached := c.getRegionByIDFromCache(id) != nil
+		c.mu.RUnlock()
+		if !cached {
+			misses = append(misses, id)
+			continue
+		}
+		loc, err := c.LocateRegionByID(bo, id)
+		if err != nil {
+			errs[id] = err
+		} else {
+			locs[id] = loc
+		}
+	}
+
+	var (
+		mu    sync.Mutex
+		wg    sync.WaitGroup
+		limit = make(chan struct{}, locateRegionsByIDConcurrency)
+	)
+	for _, id := range misses {
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(bo *retry.Backoffer, id uint64) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			loc, err := c.LocateRegionByID(bo, id)
+			mu.Lock()
+			if err != nil {
+				errs[id] = err
+			} else {
+				locs[id] = loc
+			}
+			mu.Unlock()
+		}(bo.Clone(), id)
+	}
+	wg.Wait()
+	return locs, errs
+}
+
+// WaitForLeader reloads the region from PD with backoff until PD reports its leader, and then updates the cache
+// with it. It returns an error if the backoffer is exhausted or its context is done.
+func (c *RegionCache) WaitForLeader(bo *retry.Backoffer, regionID uint64) (*Region, error) {
+	if err := c.checkClosed(); err != nil {
+		return nil, err
+	}
+	for {
+		r, err := c.loadRegionByID(bo, regionID)
+		if err != nil {
+			return nil, err
+		}
+		if r.leaderKnown {
+			leaderStoreID := r.GetLeaderStoreID()
+			c.mu.Lock()
+			c.insertRegionToCache(r)
+			c.mu.Unlock()
+			// The region may switch to another peer if the old one is invalidated due to no leader, but the leader
+			// reported by PD is more recent.
+			r.switchWorkLeaderToPeer(r.getPeerOnStore(leaderStoreID))
+			return r, nil
+		}
+		logutil.Logger(bo.GetCtx()).Info("wait for region leader",
+			zap.Uint64("regionID", regionID))
+		if err = bo.Backoff(retry.BoRegionScheduling, errors.Errorf("region %d has no leader", regionID)); err != nil {
+			return nil, errors.WithStack(err)
+		}
+	}
+}
+
 // GroupKeysByRegion separates keys into groups by their belonging Regions.
 // Specially it also returns the first key's region which may be used as the
 // 'PrimaryLockKey' and should be committed ahead of others.
 // filter is used to filter some unwanted keys.
 func (c *RegionCache) GroupKeysByRegion(bo *retry.Backoffer, keys [][]byte, filter func(key, regionStartKey []byte) bool) (map[RegionVerID][][]byte, RegionVerID, error) {
+	if err := c.checkClosed(); err != nil {
+		return nil, RegionVerID{}, err
+	}
 	groups := make(map[RegionVerID][][]byte)
 	var first RegionVerID
 	var lastLoc *KeyLocation
@@ -1028,47 +2099,119 @@ func (c *RegionCache) GroupKeysByRegion(bo *retry.Backoffer, keys [][]byte, filt
 	return groups, first, nil
 }
 
+// CountKeysByLeaderStore returns the number of keys whose region leaders are on each store, keyed by the store ID.
+// The keys of a region whose leader can't be told from the cache are counted under store 0.
+func (c *RegionCache) CountKeysByLeaderStore(bo *retry.Backoffer, keys [][]byte) (map[uint64]int, error) {
+	groups, _, err := c.GroupKeysByRegion(bo, keys, nil)
+	if err != nil {
+		return nil, err
+	}
+	counts := make(map[uint64]int)
+	for id, groupKeys := range groups {
+		region := c.GetCachedRegionWithRLock(id)
+		if region == nil {
+			// The region is evicted from the cache after grouping, locate it again.
+			loc, err := c.LocateKey(bo, groupKeys[0])
+			if err != nil {
+				return nil, err
+			}
+			region = c.GetCachedRegionWithRLock(loc.Region)
+		}
+		var storeID uint64
+		if region != nil {
+			storeID = region.GetLeaderStoreID()
+		}
+		counts[storeID] += len(groupKeys)
+	}
+	return counts, nil
+}
+
 // ListRegionIDsInKeyRange lists ids of regions in [start_key,end_key].
 func (c *RegionCache) ListRegionIDsInKeyRange(bo *retry.Backoffer, startKey, endKey []byte) (regionIDs []uint64, err error) {
+	regionIDs, _, err = c.ListRegionIDsInKeyRangeWithContinuation(bo, startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return regionIDs, nil
+}
+
+// ListRegionIDsInKeyRangeWithContinuation lists ids of regions in [start_key,end_key]. If it fails or the context
+// of bo is done before reaching end_key, the ids listed so far are returned with the error, along with the key to
+// resume from.
+func (c *RegionCache) ListRegionIDsInKeyRangeWithContinuation(bo *retry.Backoffer, startKey, endKey []byte) (regionIDs []uint64, nextKey []byte, err error) {
+	if err = c.checkClosed(); err != nil {
+		return nil, nil, err
+	}
 	for {
+		if err := bo.GetCtx().Err(); err != nil {
+			return regionIDs, startKey, errors.WithStack(err)
+		}
 		curRegion, err := c.LocateKey(bo, startKey)
 		if err != nil {
-			return nil, err
+			return regionIDs, startKey, err
+		}
+		if curRegion.Compare(startKey) > 0 {
+			return regionIDs, startKey, errors.Errorf("region %d ends at %s, which doesn't advance the start key %s",
+				curRegion.Region.id, util.HexRegionKeyStr(curRegion.EndKey), util.HexRegionKeyStr(startKey))
 		}
 		regionIDs = append(regionIDs, curRegion.Region.id)
-		if curRegion.Contains(endKey) {
-			break
+		// endKey is inclusive, so the listing ends at the region containing it.
+		if curRegion.Compare(endKey) == 0 || len(curRegion.EndKey) == 0 {
+			return regionIDs, nil, nil
 		}
 		startKey = curRegion.EndKey
 	}
-	return regionIDs, nil
 }
 
 // LoadRegionsInKeyRange lists regions in [start_key,end_key].
 func (c *RegionCache) LoadRegionsInKeyRange(bo *retry.Backoffer, startKey, endKey []byte) (regions []*Region, err error) {
-	var batchRegions []*Region
+	regions, _, err = c.LoadRegionsInKeyRangeWithContinuation(bo, startKey, endKey)
+	if err != nil {
+		return nil, err
+	}
+	return regions, nil
+}
+
+// LoadRegionsInKeyRangeWithContinuation lists regions in [start_key,end_key]. If it fails or the context of bo is
+// done before reaching end_key, the regions loaded so far are returned with the error, along with the key to
+// resume from.
+func (c *RegionCache) LoadRegionsInKeyRangeWithContinuation(bo *retry.Backoffer, startKey, endKey []byte) (regions []*Region, nextKey []byte, err error) {
+	if err = c.checkClosed(); err != nil {
+		return nil, nil, err
+	}
 	for {
-		batchRegions, err = c.BatchLoadRegionsWithKeyRange(bo, startKey, endKey, defaultRegionsPerBatch)
+		if err := bo.GetCtx().Err(); err != nil {
+			return regions, startKey, errors.WithStack(err)
+		}
+		batchRegions, err := c.BatchLoadRegionsWithKeyRange(bo, startKey, endKey, defaultRegionsPerBatch)
 		if err != nil {
-			return nil, err
+			return regions, startKey, err
 		}
 		if len(batchRegions) == 0 {
 			// should never happen
-			break
+			return regions, nil, nil
 		}
-		regions = append(regions, batchRegions...)
 		endRegion := batchRegions[len(batchRegions)-1]
-		if endRegion.ContainsByEnd(endKey) {
-			break
+		// loaded is the key range of the loaded batch.
+		loaded := &KeyLocation{StartKey: batchRegions[0].StartKey(), EndKey: endRegion.EndKey()}
+		if loaded.Compare(startKey) > 0 {
+			return regions, startKey, errors.Errorf("region %d ends at %s, which doesn't advance the start key %s",
+				endRegion.GetID(), util.HexRegionKeyStr(endRegion.EndKey()), util.HexRegionKeyStr(startKey))
+		}
+		regions = append(regions, batchRegions...)
+		if loaded.CoversRange(startKey, endKey) || len(endRegion.EndKey()) == 0 {
+			return regions, nil, nil
 		}
 		startKey = endRegion.EndKey()
 	}
-	return
 }
 
 // BatchLoadRegionsWithKeyRange loads at most given numbers of regions to the RegionCache,
 // within the given key range from the startKey to endKey. Returns the loaded regions.
 func (c *RegionCache) BatchLoadRegionsWithKeyRange(bo *retry.Backoffer, startKey []byte, endKey []byte, count int) (regions []*Region, err error) {
+	if err = c.checkClosed(); err != nil {
+		return nil, err
+	}
 	regions, err = c.scanRegions(bo, startKey, endKey, count)
 	if err != nil {
 		return
@@ -1117,6 +2260,19 @@ func (c *RegionCache) InvalidateCachedRegionWithReason(id RegionVerID, reason In
 
 // UpdateLeader update some region cache with newer leader info.
 func (c *RegionCache) UpdateLeader(regionID RegionVerID, leader *metapb.Peer, currentPeerIdx AccessIndex) {
+	c.updateLeader(nil, regionID, leader, currentPeerIdx)
+}
+
+// UpdateLeaderOrReload updates the leader like UpdateLeader, but if the leader isn't a peer of the cached region,
+// e.g. it's added by a conf change, the region is reloaded from PD with bo to find it. The region is invalidated if
+// the leader can't be found in the reloaded region either.
+func (c *RegionCache) UpdateLeaderOrReload(bo *retry.Backoffer, regionID RegionVerID, leader *metapb.Peer, currentPeerIdx AccessIndex) {
+	c.updateLeader(bo, regionID, leader, currentPeerIdx)
+}
+
+// updateLeader updates the leader of the cached region, the region is reloaded to find the leader only if bo isn't
+// nil.
+func (c *RegionCache) updateLeader(bo *retry.Backoffer, regionID RegionVerID, leader *metapb.Peer, currentPeerIdx AccessIndex) {
 	r := c.GetCachedRegionWithRLock(regionID)
 	if r == nil {
 		logutil.BgLogger().Debug("regionCache: cannot find region when updating leader",
@@ -1134,6 +2290,15 @@ func (c *RegionCache) UpdateLeader(regionID RegionVerID, leader *metapb.Peer, cu
 	}
 
 	if !r.switchWorkLeaderToPeer(leader) {
+		if bo != nil {
+			if newRegion := c.reloadRegionForLeader(bo, r, leader); newRegion != nil {
+				logutil.BgLogger().Info("switch region leader to specific leader of the reloaded region due to kv return NotLeader",
+					zap.Uint64("regionID", regionID.GetID()),
+					zap.Uint64("confVer", newRegion.GetMeta().GetRegionEpoch().GetConfVer()),
+					zap.Uint64("leaderStoreID", leader.GetStoreId()))
+				return
+			}
+		}
 		logutil.BgLogger().Info("invalidate region cache due to cannot find peer when updating leader",
 			zap.Uint64("regionID", regionID.GetID()),
 			zap.Int("currIdx", int(currentPeerIdx)),
@@ -1147,23 +2312,149 @@ func (c *RegionCache) UpdateLeader(regionID RegionVerID, leader *metapb.Peer, cu
 	}
 }
 
+// reloadRegionForLeader reloads the region from PD when the leader reported by TiKV isn't a peer of the cached
+// region r, and inserts it into the cache with the work TiKV switched to the leader. Concurrent reloads of the same
+// region share one request to PD. It returns nil if the leader isn't a peer of the reloaded region either, and the
+// caller should invalidate r then.
+func (c *RegionCache) reloadRegionForLeader(bo *retry.Backoffer, r *Region, leader *metapb.Peer) *Region {
+	v, err, _ := c.regionLoadSf.Do(fmt.Sprintf("i%d-%d", r.GetID(), leader.GetId()), func() (interface{}, error) {
+		newRegion, err := c.loadRegionByID(bo, r.GetID())
+		if err != nil {
+			return nil, err
+		}
+		if _, found := newRegion.getPeerStoreIndex(leader); !found {
+			return nil, nil
+		}
+		c.mu.Lock()
+		c.insertRegionToCache(newRegion)
+		c.mu.Unlock()
+		newRegion.switchWorkLeaderToPeer(leader)
+		return newRegion, nil
+	})
+	if err != nil {
+		logutil.Logger(bo.GetCtx()).Warn("failed to reload region for the leader hint",
+			zap.Uint64("regionID", r.GetID()), zap.Error(err))
+	}
+	newRegion, _ := v.(*Region)
+	if newRegion == nil {
+		metrics.RegionCacheCounterWithLeaderHintInvalidated.Inc()
+		return nil
+	}
+	metrics.RegionCacheCounterWithLeaderHintRecovered.Inc()
+	return newRegion
+}
+
 // removeVersionFromCache removes a RegionVerID from cache, tries to cleanup
-// both c.mu.regions and c.mu.versions. Note this function is not thread-safe.
+// c.mu.regions, c.mu.versions and c.mu.storeRegions. Note this function is not thread-safe.
 func (c *RegionCache) removeVersionFromCache(oldVer RegionVerID, regionID uint64) {
+	if r, ok := c.mu.regions[oldVer]; ok {
+		for _, store := range r.stores() {
+			c.removeStoreRegionIndex(store.storeID, oldVer)
+		}
+	}
 	delete(c.mu.regions, oldVer)
 	if ver, ok := c.mu.latestVersions[regionID]; ok && ver.Equals(oldVer) {
 		delete(c.mu.latestVersions, regionID)
 	}
 }
 
+// removeStoreRegionIndex removes the version from the index of the store, and the index itself if it's empty.
+// It should be protected by c.mu.Lock().
+func (c *RegionCache) removeStoreRegionIndex(storeID uint64, ver RegionVerID) {
+	vers, ok := c.mu.storeRegions[storeID]
+	if !ok {
+		return
+	}
+	delete(vers, ver)
+	if len(vers) == 0 {
+		delete(c.mu.storeRegions, storeID)
+	}
+}
+
+// recycleRegionsOnStore eagerly updates the cached regions whose regionStore references the store, so that the
+// regions which are never accessed again don't keep the store. It's called after the store is tombstoned or
+// deleted. If the store is deleted, i.e., replaced by a new store, the regions are switched to the new store as
+// changeToActiveStore does when they are accessed. Otherwise the regions are invalidated and removed from the cache,
+// so that their stale ranges don't shadow newer regions. It returns the number of updated regions.
+// c.storeMu must not be held by the caller.
+func (c *RegionCache) recycleRegionsOnStore(store *Store) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	replaced := store.getResolveState() == deleted
+	recycled := 0
+	for ver := range c.mu.storeRegions[store.storeID] {
+		r, ok := c.mu.regions[ver]
+		if !ok {
+			c.removeStoreRegionIndex(store.storeID, ver)
+			continue
+		}
+		// The region may reference the store replacing it already, see changeToActiveStore.
+		referenced := false
+		for _, s := range r.stores() {
+			if s == store {
+				referenced = true
+				break
+			}
+		}
+		if !referenced {
+			continue
+		}
+		recycled++
+		if replaced {
+			c.changeToActiveStore(r, store)
+			continue
+		}
+		r.invalidate(StoreNotFound)
+		if item := c.mu.sorted.Get(newBtreeItem(r)); item != nil && item.(*btreeItem).cachedRegion == r {
+			c.mu.sorted.Delete(item)
+		}
+		c.removeVersionFromCache(ver, ver.GetID())
+	}
+	return recycled
+}
+
 // insertRegionToCache tries to insert the Region to cache.
 // It should be protected by c.mu.Lock().
 func (c *RegionCache) insertRegionToCache(cachedRegion *Region) {
-	old := c.mu.sorted.ReplaceOrInsert(newBtreeItem(cachedRegion))
-	if old != nil {
-		store := cachedRegion.getStore()
+	// Inherit the states of the old region before publishing the new one.
+	if old := c.mu.sorted.Get(newBtreeItem(cachedRegion)); old != nil {
 		oldRegion := old.(*btreeItem).cachedRegion
-		oldRegionStore := oldRegion.getStore()
+		c.inheritRegionStore(cachedRegion, oldRegion)
+		// Invalidate the old region in case it's not invalidated and some requests try with the stale region information.
+		oldRegion.invalidate(Other)
+		// The old region may have a different ID from the new one, e.g. after split or merge, so remove
+		// the version by the old region's ID. Otherwise latestVersions keeps referencing a removed version.
+		c.removeVersionFromCache(oldRegion.VerID(), oldRegion.GetID())
+	}
+	c.mu.sorted.ReplaceOrInsert(newBtreeItem(cachedRegion))
+	c.mu.regions[cachedRegion.VerID()] = cachedRegion
+	newVer := cachedRegion.VerID()
+	for _, store := range cachedRegion.stores() {
+		vers, ok := c.mu.storeRegions[store.storeID]
+		if !ok {
+			vers = make(map[RegionVerID]struct{})
+			c.mu.storeRegions[store.storeID] = vers
+		}
+		vers[newVer] = struct{}{}
+	}
+	latest, ok := c.mu.latestVersions[cachedRegion.VerID().id]
+	if ok {
+		// Replace the latest version if it's dangling.
+		_, ok = c.mu.regions[latest]
+	}
+	if !ok || latest.GetVer() < newVer.GetVer() || latest.GetConfVer() < newVer.GetConfVer() {
+		c.mu.latestVersions[cachedRegion.VerID().id] = newVer
+	}
+}
+
+// inheritRegionStore updates the regionStore of the region according to the old region it replaces. The region
+// may be visible to other goroutines already, so the regionStore is replaced via clone and CAS instead of being
+// modified in place.
+func (c *RegionCache) inheritRegionStore(r *Region, oldRegion *Region) {
+	oldRegionStore := oldRegion.getStore()
+	for {
+		store := r.getStore()
+		newStore := store.clone()
 		// TODO(youjiali1995): remove this because the new retry logic can handle this issue.
 		//
 		// Joint consensus is enabled in v5.0, which is possible to make a leader step down as a learner during a conf change.
@@ -1172,25 +2463,19 @@ func (c *RegionCache) insertRegionToCache(cachedRegion *Region) {
 		// To solve it, one solution is always to try a different peer if the invalid reason of the old cached region is no-leader.
 		// There is a small probability that the current peer who reports no-leader becomes a leader and TiDB has to retry once in this case.
 		if InvalidReason(atomic.LoadInt32((*int32)(&oldRegion.invalidReason))) == NoLeader {
-			store.workTiKVIdx = (oldRegionStore.workTiKVIdx + 1) % AccessIndex(store.accessStoreNum(tiKVOnly))
+			newStore.workTiKVIdx = (oldRegionStore.workTiKVIdx + 1) % AccessIndex(newStore.accessStoreNum(tiKVOnly))
 		}
-		// Invalidate the old region in case it's not invalidated and some requests try with the stale region information.
-		oldRegion.invalidate(Other)
 		// Don't refresh TiFlash work idx for region. Otherwise, it will always goto a invalid store which
 		// is under transferring regions.
-		store.workTiFlashIdx = atomic.LoadInt32(&oldRegionStore.workTiFlashIdx)
+		newStore.workTiFlashIdx = atomic.LoadInt32(&oldRegionStore.workTiFlashIdx)
 
 		// Keep the buckets information if needed.
-		if store.buckets == nil || (oldRegionStore.buckets != nil && store.buckets.GetVersion() < oldRegionStore.buckets.GetVersion()) {
-			store.buckets = oldRegionStore.buckets
+		if !c.disableBuckets && (newStore.buckets == nil || (oldRegionStore.buckets != nil && newStore.buckets.GetVersion() < oldRegionStore.buckets.GetVersion())) {
+			newStore.buckets = oldRegionStore.buckets
+		}
+		if r.compareAndSwapStore(store, newStore) {
+			return
 		}
-		c.removeVersionFromCache(oldRegion.VerID(), cachedRegion.VerID().id)
-	}
-	c.mu.regions[cachedRegion.VerID()] = cachedRegion
-	newVer := cachedRegion.VerID()
-	latest, ok := c.mu.latestVersions[cachedRegion.VerID().id]
-	if !ok || latest.GetVer() < newVer.GetVer() || latest.GetConfVer() < newVer.GetConfVer() {
-		c.mu.latestVersions[cachedRegion.VerID().id] = newVer
 	}
 }
 
@@ -1200,8 +2485,15 @@ func (c *RegionCache) insertRegionToCache(cachedRegion *Region) {
 // If the given key is the end key of the region that you want, you may set the second argument to true. This is useful
 // when processing in reverse order.
 func (c *RegionCache) searchCachedRegion(key []byte, isEndKey bool) *Region {
+	r, _ := c.searchCachedRegionWithExpired(key, isEndKey)
+	return r
+}
+
+// searchCachedRegionWithExpired is like searchCachedRegion, but also reports whether the key is covered by a
+// cached region which has expired or been invalidated.
+func (c *RegionCache) searchCachedRegionWithExpired(key []byte, isEndKey bool) (r *Region, expired bool) {
 	ts := time.Now().Unix()
-	var r *Region
+	var expiredRegion *Region
 	c.mu.RLock()
 	c.mu.sorted.DescendLessOrEqual(newBtreeSearchItem(key), func(item btree.Item) bool {
 		r = item.(*btreeItem).cachedRegion
@@ -1210,16 +2502,22 @@ func (c *RegionCache) searchCachedRegion(key []byte, isEndKey bool) *Region {
 			return true // iterate next item
 		}
 		if !r.checkRegionCacheTTL(ts) {
+			if expiredRegion == nil {
+				expiredRegion = r
+			}
 			r = nil
 			return true
 		}
 		return false
 	})
 	c.mu.RUnlock()
-	if r != nil && (!isEndKey && r.Contains(key) || isEndKey && r.ContainsByEnd(key)) {
-		return r
+	covers := func(r *Region) bool {
+		return !isEndKey && r.Contains(key) || isEndKey && r.ContainsByEnd(key)
 	}
-	return nil
+	if r != nil && covers(r) {
+		return r, false
+	}
+	return nil, expiredRegion != nil && covers(expiredRegion)
 }
 
 // getRegionByIDFromCache tries to get region by regionID from cache. Like
@@ -1233,9 +2531,7 @@ func (c *RegionCache) getRegionByIDFromCache(regionID uint64) *Region {
 	}
 	latestRegion, ok := c.mu.regions[ver]
 	if !ok {
-		// should not happen
-		logutil.BgLogger().Warn("region version not found",
-			zap.Uint64("regionID", regionID), zap.Stringer("version", &ver))
+		// It's a dangling version, see removeDanglingVersion.
 		return nil
 	}
 	lastAccess := atomic.LoadInt64(&latestRegion.lastAccess)
@@ -1248,6 +2544,32 @@ func (c *RegionCache) getRegionByIDFromCache(regionID uint64) *Region {
 	return latestRegion
 }
 
+// hasDanglingVersion checks whether the latest version of the region is missing in c.mu.regions.
+// It should be called with c.mu.RLock().
+func (c *RegionCache) hasDanglingVersion(regionID uint64) bool {
+	ver, ok := c.mu.latestVersions[regionID]
+	if !ok {
+		return false
+	}
+	_, ok = c.mu.regions[ver]
+	return !ok
+}
+
+// removeDanglingVersion removes the latest version of the region if it's not in c.mu.regions,
+// so that the region can be loaded and cached again. It should be protected by c.mu.Lock().
+func (c *RegionCache) removeDanglingVersion(regionID uint64) {
+	// Check again because the cache may be updated after c.mu.RUnlock().
+	if !c.hasDanglingVersion(regionID) {
+		return
+	}
+	ver := c.mu.latestVersions[regionID]
+	delete(c.mu.latestVersions, regionID)
+	metrics.TiKVRegionCacheDanglingVersionCounter.Inc()
+	logutil.BgLogger().Warn("remove dangling region version from cache",
+		zap.Uint64("regionID", regionID), zap.Stringer("version", &ver),
+		zap.Int("regions", len(c.mu.regions)), zap.Int("latestVersions", len(c.mu.latestVersions)))
+}
+
 // GetStoresByType gets stores by type `typ`
 // TODO: revise it by get store by closure.
 func (c *RegionCache) GetStoresByType(typ tikvrpc.EndpointType) []*Store {
@@ -1261,17 +2583,18 @@ func (c *RegionCache) GetStoresByType(typ tikvrpc.EndpointType) []*Store {
 		if store.storeType == typ {
 			//TODO: revise it with store.clone()
 			storeLabel := make([]*metapb.StoreLabel, 0)
-			for _, label := range store.labels {
+			for _, label := range store.getLabels() {
 				storeLabel = append(storeLabel, &metapb.StoreLabel{
 					Key:   label.Key,
 					Value: label.Value,
 				})
 			}
-			stores = append(stores, &Store{
+			s := &Store{
 				addr:    store.addr,
 				storeID: store.storeID,
-				labels:  storeLabel,
-			})
+			}
+			s.setLabels(storeLabel)
+			stores = append(stores, s)
 		}
 	}
 	return stores
@@ -1297,10 +2620,124 @@ func filterUnavailablePeers(region *pd.Region) {
 	region.Meta.Peers = new
 }
 
+// filterDownPeers filters the down peers of the region. If all peers are down and the filtering is not strict,
+// the peers are kept and it returns true to mark them as suspect.
+func (c *RegionCache) filterDownPeers(region *pd.Region) (suspect bool) {
+	peers := region.Meta.Peers
+	// Peers are filtered in place, the backing array is left unchanged if all of them are filtered.
+	filterUnavailablePeers(region)
+	if len(region.Meta.Peers) > 0 || len(peers) == 0 || atomic.LoadUint32(&c.strictDownPeerFiltering) == 1 {
+		return false
+	}
+	region.Meta.Peers = peers
+	metrics.RegionCacheCounterWithIgnoreDownPeers.Inc()
+	logutil.BgLogger().Warn("all peers of the region are reported down, use them as suspect",
+		zap.Uint64("region", region.Meta.GetId()),
+		zap.Int("peers", len(peers)))
+	return true
+}
+
+// newSuspectRegion creates a region like newRegion, and marks its peers as suspect if needed.
+func newSuspectRegion(bo *retry.Backoffer, c *RegionCache, pdRegion *pd.Region, suspect bool) (*Region, error) {
+	r, err := newRegion(bo, c, pdRegion)
+	if err != nil {
+		return nil, err
+	}
+	r.suspectPeers = suspect
+	return r, nil
+}
+
+// maxNoAvailablePeersRetry is the max times to reload a region which has no available peers, because the region info
+// in PD may be stale for a short while during store transitions.
+const maxNoAvailablePeersRetry = 2
+
+// newRegionFromPD creates a region from the region info loaded from PD. The returned error is ErrNoAvailablePeers if
+// all peers are filtered out.
+func (c *RegionCache) newRegionFromPD(bo *retry.Backoffer, pdRegion *pd.Region) (*Region, error) {
+	suspect := c.filterDownPeers(pdRegion)
+	if len(pdRegion.Meta.Peers) == 0 {
+		return nil, errors.WithStack(&tikverr.ErrNoAvailablePeers{RegionID: pdRegion.Meta.GetId()})
+	}
+	return newSuspectRegion(bo, c, pdRegion, suspect)
+}
+
+// loadAndInsertRegion loads the region of the key from PD and inserts it into the cache. Concurrent calls with the
+// same key share one load, so that a burst of cache misses doesn't send duplicated requests to PD.
+func (c *RegionCache) loadAndInsertRegion(bo *retry.Backoffer, key []byte, isEndKey bool) (*Region, error) {
+	sfKey := "s" + string(key)
+	if isEndKey {
+		sfKey = "e" + string(key)
+	}
+	executed := false
+	v, err, _ := c.regionLoadSf.Do(sfKey, func() (interface{}, error) {
+		executed = true
+		return c.doLoadAndInsertRegion(bo, key, isEndKey)
+	})
+	if err != nil && !executed {
+		// The error may be caused by the backoffer of the caller that loaded the region, e.g. its context is
+		// canceled, so retry with our own backoffer.
+		return c.doLoadAndInsertRegion(bo, key, isEndKey)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return v.(*Region), nil
+}
+
+func (c *RegionCache) doLoadAndInsertRegion(bo *retry.Backoffer, key []byte, isEndKey bool) (*Region, error) {
+	return c.doLoadRegion(bo, key, isEndKey, true)
+}
+
+// insertLoadedRegion inserts the region loaded for the key to the cache and returns it, unless a newer region
+// covering the key is cached, which is returned instead.
+func (c *RegionCache) insertLoadedRegion(r *Region, key []byte, isEndKey bool) *Region {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	// The region may be split or merged after it's loaded, and the new regions may be inserted already. Don't
+	// replace them with the stale one.
+	if newer := c.getNewerCachedRegion(r, key, isEndKey); newer != nil {
+		return newer
+	}
+	c.insertRegionToCache(r)
+	return r
+}
+
+// getNewerCachedRegion returns the valid cached region which covers the key and has a newer version than r.
+// It should be called with c.mu held.
+func (c *RegionCache) getNewerCachedRegion(r *Region, key []byte, isEndKey bool) *Region {
+	var cached *Region
+	c.mu.sorted.DescendLessOrEqual(newBtreeSearchItem(key), func(item btree.Item) bool {
+		cached = item.(*btreeItem).cachedRegion
+		if isEndKey && bytes.Equal(cached.StartKey(), key) {
+			cached = nil
+			return true
+		}
+		return false
+	})
+	if cached == nil || !cached.isValid() {
+		return nil
+	}
+	if !isEndKey && !cached.Contains(key) || isEndKey && !cached.ContainsByEnd(key) {
+		return nil
+	}
+	if cached.GetMeta().GetRegionEpoch().GetVersion() <= r.GetMeta().GetRegionEpoch().GetVersion() {
+		return nil
+	}
+	return cached
+}
+
 // loadRegion loads region from pd client, and picks the first peer as leader.
 // If the given key is the end key of the region that you want, you may set the second argument to true. This is useful
 // when processing in reverse order.
 func (c *RegionCache) loadRegion(bo *retry.Backoffer, key []byte, isEndKey bool) (*Region, error) {
+	return c.doLoadRegion(bo, key, isEndKey, false)
+}
+
+// doLoadRegion loads the region of the key from PD. If insert is true, the region is inserted to the cache before
+// the slot of the limiter of concurrent region loads is released. The cache is also checked again after waiting for
+// the in-flight loads started before and after waiting for a slot, so that the misses of the keys in a region share
+// one request to PD.
+func (c *RegionCache) doLoadRegion(bo *retry.Backoffer, key []byte, isEndKey bool, insert bool) (*Region, error) {
 	ctx := bo.GetCtx()
 	if span := opentracing.SpanFromContext(ctx); span != nil && span.Tracer() != nil {
 		span1 := span.Tracer().StartSpan("loadRegion", opentracing.ChildOf(span.Context()))
@@ -1308,8 +2745,24 @@ func (c *RegionCache) loadRegion(bo *retry.Backoffer, key []byte, isEndKey bool)
 		ctx = opentracing.ContextWithSpan(ctx, span1)
 	}
 
+	if insert {
+		done, prev := c.startRegionLoad()
+		defer c.finishRegionLoad(done)
+		if len(prev) > 0 {
+			if err := waitRegionLoads(ctx, prev); err != nil {
+				return nil, err
+			}
+			// The region may be loaded for another key in it during the wait.
+			if r := c.searchCachedRegion(key, isEndKey); r != nil {
+				metrics.RegionCacheCounterWithRegionLoadCollapsed.Inc()
+				return r, nil
+			}
+		}
+	}
+
 	var backoffErr error
 	searchPrev := false
+	noPeersRetry := 0
 	for {
 		if backoffErr != nil {
 			err := bo.Backoff(retry.BoPDRPC, backoffErr)
@@ -1318,11 +2771,25 @@ func (c *RegionCache) loadRegion(bo *retry.Backoffer, key []byte, isEndKey bool)
 			}
 		}
 		var reg *pd.Region
-		var err error
+		waited, err := c.acquireRegionLoad(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if insert && waited {
+			// The region may be loaded for another key in it during the wait.
+			if r := c.searchCachedRegion(key, isEndKey); r != nil {
+				c.releaseRegionLoad()
+				metrics.RegionCacheCounterWithRegionLoadCollapsed.Inc()
+				return r, nil
+			}
+		}
 		if searchPrev {
-			reg, err = c.pdClient.GetPrevRegion(ctx, key, pd.WithBuckets())
+			reg, err = c.PDClient().GetPrevRegion(ctx, key, c.getRegionOptions()...)
 		} else {
-			reg, err = c.pdClient.GetRegion(ctx, key, pd.WithBuckets())
+			reg, err = c.PDClient().GetRegion(ctx, key, c.getRegionOptions()...)
+		}
+		if err != nil || reg == nil || reg.Meta == nil || !insert {
+			c.releaseRegionLoad()
 		}
 		if err != nil {
 			metrics.RegionCacheCounterWithGetRegionError.Inc()
@@ -1340,16 +2807,100 @@ func (c *RegionCache) loadRegion(bo *retry.Backoffer, key []byte, isEndKey bool)
 			backoffErr = errors.Errorf("region not found for key %q", util.HexRegionKeyStr(key))
 			continue
 		}
-		filterUnavailablePeers(reg)
-		if len(reg.Meta.Peers) == 0 {
-			return nil, errors.New("receive Region with no available peer")
-		}
 		if isEndKey && !searchPrev && bytes.Equal(reg.Meta.StartKey, key) && len(reg.Meta.StartKey) != 0 {
+			if insert {
+				c.releaseRegionLoad()
+			}
 			searchPrev = true
 			continue
 		}
-		return newRegion(bo, c, reg)
+		region, err := c.newRegionFromPD(bo, reg)
+		if insert {
+			if err == nil {
+				region = c.insertLoadedRegion(region, key, isEndKey)
+			}
+			c.releaseRegionLoad()
+		}
+		if tikverr.IsErrNoAvailablePeers(err) && noPeersRetry < maxNoAvailablePeersRetry {
+			noPeersRetry++
+			if err = bo.Backoff(retry.BoRegionMiss, err); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			backoffErr = nil
+			continue
+		}
+		return region, err
+	}
+}
+
+// acquireRegionLoad waits until a region request can be sent to PD if the concurrency is limited by
+// WithMaxConcurrentRegionLoads, and reports whether it has waited. The waiting is bounded by ctx, which is the
+// context of the caller's Backoffer. releaseRegionLoad must be called after the request if it returns nil error.
+func (c *RegionCache) acquireRegionLoad(ctx context.Context) (waited bool, err error) {
+	if c.regionLoadLimiter != nil && !c.regionLoadLimiter.TryAcquire(1) {
+		metrics.RegionCacheCounterWithRegionLoadThrottled.Inc()
+		start := time.Now()
+		err := c.regionLoadLimiter.Acquire(ctx, 1)
+		metrics.TiKVRegionLoadWaitDuration.Observe(time.Since(start).Seconds())
+		if err != nil {
+			return true, errors.WithStack(err)
+		}
+		waited = true
+	}
+	metrics.TiKVRegionLoadInflight.Inc()
+	return waited, nil
+}
+
+// releaseRegionLoad releases the slot acquired by acquireRegionLoad.
+func (c *RegionCache) releaseRegionLoad() {
+	metrics.TiKVRegionLoadInflight.Dec()
+	if c.regionLoadLimiter != nil {
+		c.regionLoadLimiter.Release(1)
+	}
+}
+
+// startRegionLoad registers a load of a missing region. It returns the channel to close by finishRegionLoad when the
+// load is finished, and the channels of the loads in flight, which the load should wait for.
+func (c *RegionCache) startRegionLoad() (done chan struct{}, prev []chan struct{}) {
+	c.regionLoadMu.Lock()
+	defer c.regionLoadMu.Unlock()
+	if c.regionLoadMu.inflight == nil {
+		c.regionLoadMu.inflight = make(map[chan struct{}]struct{})
+	}
+	for ch := range c.regionLoadMu.inflight {
+		prev = append(prev, ch)
+	}
+	done = make(chan struct{})
+	c.regionLoadMu.inflight[done] = struct{}{}
+	return done, prev
+}
+
+// finishRegionLoad unregisters the load started by startRegionLoad and wakes up the loads waiting for it.
+func (c *RegionCache) finishRegionLoad(done chan struct{}) {
+	c.regionLoadMu.Lock()
+	delete(c.regionLoadMu.inflight, done)
+	c.regionLoadMu.Unlock()
+	close(done)
+}
+
+// waitRegionLoads waits until the loads are finished. The waiting is bounded by ctx.
+func waitRegionLoads(ctx context.Context, loads []chan struct{}) error {
+	for _, done := range loads {
+		select {
+		case <-done:
+		case <-ctx.Done():
+			return errors.WithStack(ctx.Err())
+		}
+	}
+	return nil
+}
+
+// getRegionOptions returns the options used to get regions from PD.
+func (c *RegionCache) getRegionOptions() []pd.GetRegionOption {
+	if c.disableBuckets {
+		return nil
 	}
+	return []pd.GetRegionOption{pd.WithBuckets()}
 }
 
 // loadRegionByID loads region from pd client, and picks the first peer as leader.
@@ -1361,6 +2912,7 @@ func (c *RegionCache) loadRegionByID(bo *retry.Backoffer, regionID uint64) (*Reg
 		ctx = opentracing.ContextWithSpan(ctx, span1)
 	}
 	var backoffErr error
+	noPeersRetry := 0
 	for {
 		if backoffErr != nil {
 			err := bo.Backoff(retry.BoPDRPC, backoffErr)
@@ -1368,7 +2920,11 @@ func (c *RegionCache) loadRegionByID(bo *retry.Backoffer, regionID uint64) (*Reg
 				return nil, errors.WithStack(err)
 			}
 		}
-		reg, err := c.pdClient.GetRegionByID(ctx, regionID, pd.WithBuckets())
+		if _, err := c.acquireRegionLoad(ctx); err != nil {
+			return nil, err
+		}
+		reg, err := c.PDClient().GetRegionByID(ctx, regionID, c.getRegionOptions()...)
+		c.releaseRegionLoad()
 		if err != nil {
 			metrics.RegionCacheCounterWithGetRegionByIDError.Inc()
 		} else {
@@ -1384,11 +2940,16 @@ func (c *RegionCache) loadRegionByID(bo *retry.Backoffer, regionID uint64) (*Reg
 		if reg == nil || reg.Meta == nil {
 			return nil, errors.Errorf("region not found for regionID %d", regionID)
 		}
-		filterUnavailablePeers(reg)
-		if len(reg.Meta.Peers) == 0 {
-			return nil, errors.New("receive Region with no available peer")
+		region, err := c.newRegionFromPD(bo, reg)
+		if tikverr.IsErrNoAvailablePeers(err) && noPeersRetry < maxNoAvailablePeersRetry {
+			noPeersRetry++
+			if err = bo.Backoff(retry.BoRegionMiss, err); err != nil {
+				return nil, errors.WithStack(err)
+			}
+			backoffErr = nil
+			continue
 		}
-		return newRegion(bo, c, reg)
+		return region, err
 	}
 }
 
@@ -1439,7 +3000,11 @@ func (c *RegionCache) scanRegions(bo *retry.Backoffer, startKey, endKey []byte,
 				return nil, errors.WithStack(err)
 			}
 		}
-		regionsInfo, err := c.pdClient.ScanRegions(ctx, startKey, endKey, limit)
+		if _, err := c.acquireRegionLoad(ctx); err != nil {
+			return nil, err
+		}
+		regionsInfo, err := c.PDClient().ScanRegions(ctx, startKey, endKey, limit)
+		c.releaseRegionLoad()
 		if err != nil {
 			if isDecodeError(err) {
 				return nil, errors.Errorf("failed to decode region range key, startKey: %q, limit: %q, err: %v", util.HexRegionKeyStr(startKey), limit, err)
@@ -1489,6 +3054,27 @@ func (c *RegionCache) GetCachedRegionWithRLock(regionID RegionVerID) (r *Region)
 	return
 }
 
+// DumpRegions returns at most `limit` cached regions whose start keys are in [startKey, endKey), in key order.
+// An empty endKey means no upper bound. To page through the cache, pass the end key of the last returned
+// region as the startKey of the next call.
+func (c *RegionCache) DumpRegions(startKey, endKey []byte, limit int) []*Region {
+	if limit <= 0 {
+		return nil
+	}
+	var regions []*Region
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	c.mu.sorted.AscendGreaterOrEqual(newBtreeSearchItem(startKey), func(item btree.Item) bool {
+		region := item.(*btreeItem).cachedRegion
+		if len(endKey) > 0 && bytes.Compare(region.StartKey(), endKey) >= 0 {
+			return false
+		}
+		regions = append(regions, region)
+		return len(regions) < limit
+	})
+	return regions
+}
+
 func (c *RegionCache) getStoreAddr(bo *retry.Backoffer, region *Region, store *Store) (addr string, err error) {
 	state := store.getResolveState()
 	switch state {
@@ -1509,7 +3095,7 @@ func (c *RegionCache) getStoreAddr(bo *retry.Backoffer, region *Region, store *S
 }
 
 func (c *RegionCache) getProxyStore(region *Region, store *Store, rs *regionStore, workStoreIdx AccessIndex) (proxyStore *Store, proxyAccessIdx AccessIndex, proxyStoreIdx int) {
-	if !c.enableForwarding || store.storeType != tikvrpc.TiKV || atomic.LoadInt32(&store.unreachable) == 0 {
+	if store.storeType != tikvrpc.TiKV || atomic.LoadInt32(&store.unreachable) == 0 {
 		return
 	}
 
@@ -1524,7 +3110,7 @@ func (c *RegionCache) getProxyStore(region *Region, store *Store, rs *regionStor
 	}
 
 	// Randomly select an non-leader peer
-	first := rand.Intn(tikvNum - 1)
+	first := c.rnd.Intn(tikvNum - 1)
 	if first >= int(workStoreIdx) {
 		first = (first + 1) % tikvNum
 	}
@@ -1575,11 +3161,14 @@ func (c *RegionCache) changeToActiveStore(region *Region, store *Store) (addr st
 	return
 }
 
+// getStoreByStoreID returns the store in the cache, or creates an unresolved one if it's absent. The lookup and the
+// insertion are done under the same write lock, so concurrent callers always get the same instance. A store that PD
+// doesn't know is replaced by a new unresolved one after storeNotFoundTTL, so that it's resolved again.
 func (c *RegionCache) getStoreByStoreID(storeID uint64) (store *Store) {
 	var ok bool
 	c.storeMu.Lock()
 	store, ok = c.storeMu.stores[storeID]
-	if ok {
+	if ok && !c.isStoreNotFoundExpired(store) {
 		c.storeMu.Unlock()
 		return
 	}
@@ -1589,6 +3178,16 @@ func (c *RegionCache) getStoreByStoreID(storeID uint64) (store *Store) {
 	return
 }
 
+// isStoreNotFoundExpired returns true if PD reported the store as tombstone or not found more than storeNotFoundTTL
+// ago.
+func (c *RegionCache) isStoreNotFoundExpired(store *Store) bool {
+	if c.storeNotFoundTTL <= 0 || store.getResolveState() != tombstone {
+		return false
+	}
+	notFoundAt := atomic.LoadInt64(&store.notFoundAt)
+	return notFoundAt > 0 && time.Since(time.Unix(0, notFoundAt)) > c.storeNotFoundTTL
+}
+
 func (c *RegionCache) getStoresByLabels(labels []*metapb.StoreLabel) []*Store {
 	c.storeMu.RLock()
 	defer c.storeMu.RUnlock()
@@ -1604,6 +3203,9 @@ func (c *RegionCache) getStoresByLabels(labels []*metapb.StoreLabel) []*Store {
 // OnRegionEpochNotMatch removes the old region and inserts new regions into the cache.
 // It returns whether retries the request because it's possible the region epoch is ahead of TiKV's due to slow appling.
 func (c *RegionCache) OnRegionEpochNotMatch(bo *retry.Backoffer, ctx *RPCContext, currentRegions []*metapb.Region) (bool, error) {
+	if err := c.checkClosed(); err != nil {
+		return false, err
+	}
 	if len(currentRegions) == 0 {
 		c.InvalidateCachedRegionWithReason(ctx.Region, EpochNotMatch)
 		return false, nil
@@ -1623,7 +3225,7 @@ func (c *RegionCache) OnRegionEpochNotMatch(bo *retry.Backoffer, ctx *RPCContext
 	var buckets *metapb.Buckets
 	c.mu.Lock()
 	cachedRegion, ok := c.mu.regions[ctx.Region]
-	if ok {
+	if ok && !c.disableBuckets {
 		buckets = cachedRegion.getStore().buckets
 	}
 	c.mu.Unlock()
@@ -1632,14 +3234,13 @@ func (c *RegionCache) OnRegionEpochNotMatch(bo *retry.Backoffer, ctx *RPCContext
 	newRegions := make([]*Region, 0, len(currentRegions))
 	// If the region epoch is not ahead of TiKV's, replace region meta in region cache.
 	for _, meta := range currentRegions {
-		if _, ok := c.pdClient.(*CodecPDClient); ok {
-			var err error
-			// Can't modify currentRegions in this function because it can be shared by
-			// multiple goroutines, refer to https://github.com/pingcap/tidb/pull/16962.
-			if meta, err = decodeRegionMetaKeyWithShallowCopy(meta); err != nil {
-				return false, errors.Errorf("newRegion's range key is not encoded: %v, %v", meta, err)
-			}
+		// Can't modify currentRegions in this function because it can be shared by
+		// multiple goroutines, refer to https://github.com/pingcap/tidb/pull/16962.
+		decoded, err := c.decodeRegionMetaKey(meta)
+		if err != nil {
+			return false, errors.Errorf("newRegion's range key is not encoded: %v, %v", meta, err)
 		}
+		meta = decoded
 		// TODO(youjiali1995): new regions inherit old region's buckets now. Maybe we should make EpochNotMatch error
 		// carry buckets information. Can it bring much overhead?
 		region, err := newRegion(bo, c, &pd.Region{Meta: meta, Buckets: buckets})
@@ -1673,7 +3274,7 @@ func (c *RegionCache) OnRegionEpochNotMatch(bo *retry.Backoffer, ctx *RPCContext
 
 // PDClient returns the pd.Client in RegionCache.
 func (c *RegionCache) PDClient() pd.Client {
-	return c.pdClient
+	return c.pdClient.Load().(*pdClientHolder).client
 }
 
 // GetTiFlashStores returns the information of all tiflash nodes.
@@ -1689,9 +3290,23 @@ func (c *RegionCache) GetTiFlashStores() []*Store {
 	return stores
 }
 
+// RegionBucketVersion returns the version of the buckets of the cached region, or 0 if the region or its buckets
+// are not cached.
+func (c *RegionCache) RegionBucketVersion(id RegionVerID) uint64 {
+	r := c.GetCachedRegionWithRLock(id)
+	if r == nil {
+		return 0
+	}
+	return r.getStore().buckets.GetVersion()
+}
+
 // UpdateBucketsIfNeeded queries PD to update the buckets of the region in the cache if
 // the latestBucketsVer is newer than the cached one.
+// It does nothing if the bucket feature is disabled.
 func (c *RegionCache) UpdateBucketsIfNeeded(regionID RegionVerID, latestBucketsVer uint64) {
+	if c.disableBuckets || c.checkClosed() != nil {
+		return
+	}
 	r := c.GetCachedRegionWithRLock(regionID)
 	if r == nil {
 		return
@@ -1773,6 +3388,33 @@ func (r *Region) GetLeaderStoreID() uint64 {
 	return r.meta.Peers[storeIdx].StoreId
 }
 
+// InflightRequests returns the number of requests sent with the RPCContexts built from the region and not released by
+// RegionCache.ReleaseRPCContext yet.
+func (r *Region) InflightRequests() int {
+	return int(atomic.LoadInt32(&r.inflight))
+}
+
+// PeerCount returns the number of peers of the region.
+func (r *Region) PeerCount() int {
+	return len(r.meta.Peers)
+}
+
+// HealthyPeerCount returns the number of peers of the region whose stores are resolved and reachable from the
+// client's view. It can be compared with PeerCount to tell whether the region is under-replicated.
+func (r *Region) HealthyPeerCount() int {
+	rs := r.getStore()
+	if rs == nil {
+		return 0
+	}
+	count := 0
+	for _, store := range rs.stores {
+		if store.getResolveState() == resolved && atomic.LoadInt32(&store.unreachable) == 0 {
+			count++
+		}
+	}
+	return count
+}
+
 func (r *Region) getKvStorePeer(rs *regionStore, aidx AccessIndex) (store *Store, peer *metapb.Peer, accessIdx AccessIndex, storeIdx int) {
 	storeIdx, store = rs.accessStore(tiKVOnly, aidx)
 	peer = r.meta.Peers[storeIdx]
@@ -1968,7 +3610,7 @@ type Store struct {
 	saddr        string               // loaded store status address
 	storeID      uint64               // store's id
 	state        uint64               // unsafe store storeState
-	labels       []*metapb.StoreLabel // stored store labels
+	labels       atomic.Value         // stored store labels, []*metapb.StoreLabel
 	resolveMutex sync.Mutex           // protect pd from concurrent init requests
 	epoch        uint32               // store fail epoch, see RegionStore.storeEpochs
 	storeType    tikvrpc.EndpointType // type of the store
@@ -1977,8 +3619,14 @@ type Store struct {
 	// whether the store is unreachable due to some reason, therefore requests to the store needs to be
 	// forwarded by other stores. this is also the flag that a checkUntilHealth goroutine is running for this store.
 	// this mechanism is currently only applicable for TiKV stores.
-	unreachable      int32
-	unreachableSince time.Time
+	unreachable int32
+	// unreachableSince is the time in unix nanoseconds when the store is marked unreachable.
+	unreachableSince atomic2.Int64
+
+	// sendStats records the latest sends to the store to calculate its send failure rate.
+	sendStats storeSendStats
+	// notFoundAt is the unix nano time when initResolve found the store is tombstone or not found in PD.
+	notFoundAt int64
 }
 
 type resolveState uint64
@@ -2023,7 +3671,7 @@ func (s *Store) initResolve(bo *retry.Backoffer, c *RegionCache) (addr string, e
 	}
 	var store *metapb.Store
 	for {
-		store, err = c.pdClient.GetStore(bo.GetCtx(), s.storeID)
+		store, err = c.PDClient().GetStore(bo.GetCtx(), s.storeID)
 		if err != nil {
 			metrics.RegionCacheCounterWithGetStoreError.Inc()
 		} else {
@@ -2042,6 +3690,7 @@ func (s *Store) initResolve(bo *retry.Backoffer, c *RegionCache) (addr string, e
 		}
 		// The store is a tombstone.
 		if store == nil {
+			atomic.StoreInt64(&s.notFoundAt, time.Now().UnixNano())
 			s.setResolveState(tombstone)
 			return "", nil
 		}
@@ -2052,7 +3701,7 @@ func (s *Store) initResolve(bo *retry.Backoffer, c *RegionCache) (addr string, e
 		s.addr = addr
 		s.saddr = store.GetStatusAddress()
 		s.storeType = tikvrpc.GetStoreTypeByMeta(store)
-		s.labels = store.GetLabels()
+		s.setLabels(store.GetLabels())
 		// Shouldn't have other one changing its state concurrently, but we still use changeResolveStateTo for safety.
 		s.changeResolveStateTo(unresolved, resolved)
 		return s.addr, nil
@@ -2069,7 +3718,7 @@ func isStoreNotFoundError(err error) bool {
 // deleted.
 func (s *Store) reResolve(c *RegionCache) (bool, error) {
 	var addr string
-	store, err := c.pdClient.GetStore(context.Background(), s.storeID)
+	store, err := c.PDClient().GetStore(context.Background(), s.storeID)
 	if err != nil {
 		metrics.RegionCacheCounterWithGetStoreError.Inc()
 	} else {
@@ -2090,23 +3739,57 @@ func (s *Store) reResolve(c *RegionCache) (bool, error) {
 		atomic.AddUint32(&s.epoch, 1)
 		s.setResolveState(tombstone)
 		metrics.RegionCacheCounterWithInvalidateStoreRegionsOK.Inc()
+		s.recycleRegions(c)
+		deleteStoreMetrics(s.storeID)
 		return false, nil
 	}
 
 	storeType := tikvrpc.GetStoreTypeByMeta(store)
 	addr = store.GetAddress()
+	if s.addr == addr && s.storeType == storeType && !s.IsSameLabels(store.GetLabels()) &&
+		isSameRoutingLabels(s.getLabels(), store.GetLabels(), config.GetGlobalConfig().TiKVClient.RoutingLabelKeys) {
+		// Only the labels not used for routing change, so the regions on the store needn't be refreshed.
+		s.setLabels(store.GetLabels())
+	}
 	if s.addr != addr || !s.IsSameLabels(store.GetLabels()) {
-		newStore := &Store{storeID: s.storeID, addr: addr, saddr: store.GetStatusAddress(), storeType: storeType, labels: store.GetLabels(), state: uint64(resolved)}
+		newStore := &Store{storeID: s.storeID, addr: addr, saddr: store.GetStatusAddress(), storeType: storeType, state: uint64(resolved)}
+		newStore.setLabels(store.GetLabels())
+		// Carry over the failure history, otherwise a flapping store looks healthy every time its labels change.
+		newStore.epoch = atomic.LoadUint32(&s.epoch)
+		if atomic.LoadInt32(&s.unreachable) != 0 && newStore.storeType == tikvrpc.TiKV {
+			newStore.unreachable = 1
+			newStore.unreachableSince.Store(s.unreachableSince.Load())
+			go newStore.checkUntilHealth(c)
+		}
+		newStore.sendStats.copyFrom(&s.sendStats)
 		c.storeMu.Lock()
 		c.storeMu.stores[newStore.storeID] = newStore
 		c.storeMu.Unlock()
 		s.setResolveState(deleted)
+		s.recycleRegions(c)
 		return false, nil
 	}
 	s.changeResolveStateTo(needCheck, resolved)
 	return true, nil
 }
 
+// deleteStoreMetrics deletes the per-store series of the gauges after the store is removed, otherwise they are kept
+// with the last values forever.
+func deleteStoreMetrics(storeID uint64) {
+	label := strconv.FormatUint(storeID, 10)
+	metrics.TiKVInflightRequests.DeleteLabelValues(label)
+	metrics.TiKVBatchClientDowngraded.DeleteLabelValues(label)
+}
+
+// recycleRegions removes the cached regions referencing the tombstoned or deleted store eagerly, instead of waiting
+// for them to be accessed again.
+func (s *Store) recycleRegions(c *RegionCache) {
+	if recycled := c.recycleRegionsOnStore(s); recycled > 0 {
+		logutil.BgLogger().Info("recycle regions of invalid store",
+			zap.Uint64("store", s.storeID), zap.Uint64("state", uint64(s.getResolveState())), zap.Int("regions", recycled))
+	}
+}
+
 func (s *Store) getResolveState() resolveState {
 	var state resolveState
 	if s == nil {
@@ -2138,18 +3821,44 @@ func (s *Store) changeResolveStateTo(from, to resolveState) bool {
 }
 
 // markNeedCheck marks resolved store to be async resolve to check store addr change.
-func (s *Store) markNeedCheck(notifyCheckCh chan struct{}) {
+func (s *Store) markNeedCheck(c *RegionCache) {
 	if s.changeResolveStateTo(resolved, needCheck) {
-		select {
-		case notifyCheckCh <- struct{}{}:
-		default:
+		c.notifyNeedCheck(s)
+	}
+}
+
+func (s *Store) getLabels() []*metapb.StoreLabel {
+	labels, _ := s.labels.Load().([]*metapb.StoreLabel)
+	return labels
+}
+
+func (s *Store) setLabels(labels []*metapb.StoreLabel) {
+	s.labels.Store(labels)
+}
+
+// isSameRoutingLabels returns whether the labels with the given keys are the same in both labels.
+func isSameRoutingLabels(labels1, labels2 []*metapb.StoreLabel, keys []string) bool {
+	getLabel := func(labels []*metapb.StoreLabel, key string) (string, bool) {
+		for _, label := range labels {
+			if label.Key == key {
+				return label.Value, true
+			}
+		}
+		return "", false
+	}
+	for _, key := range keys {
+		v1, ok1 := getLabel(labels1, key)
+		v2, ok2 := getLabel(labels2, key)
+		if ok1 != ok2 || v1 != v2 {
+			return false
 		}
 	}
+	return true
 }
 
 // IsSameLabels returns whether the store have the same labels with target labels
 func (s *Store) IsSameLabels(labels []*metapb.StoreLabel) bool {
-	if len(s.labels) != len(labels) {
+	if len(s.getLabels()) != len(labels) {
 		return false
 	}
 	return s.IsLabelsMatch(labels)
@@ -2160,9 +3869,10 @@ func (s *Store) IsLabelsMatch(labels []*metapb.StoreLabel) bool {
 	if len(labels) < 1 {
 		return true
 	}
+	storeLabels := s.getLabels()
 	for _, targetLabel := range labels {
 		match := false
-		for _, label := range s.labels {
+		for _, label := range storeLabels {
 			if targetLabel.Key == label.Key && targetLabel.Value == label.Value {
 				match = true
 				break
@@ -2175,7 +3885,9 @@ func (s *Store) IsLabelsMatch(labels []*metapb.StoreLabel) bool {
 	return true
 }
 
-type livenessState uint32
+// Liveness is the liveness of a store, which decides whether the requests to the store should be forwarded by
+// other stores.
+type Liveness uint32
 
 var (
 	livenessSf singleflight.Group
@@ -2194,11 +3906,45 @@ func GetStoreLivenessTimeout() time.Duration {
 }
 
 const (
-	unknown livenessState = iota
-	reachable
-	unreachable
+	// LivenessUnknown means the liveness of the store can't be told for now.
+	LivenessUnknown Liveness = iota
+	// LivenessReachable means the store can be accessed directly.
+	LivenessReachable
+	// LivenessUnreachable means the store can't be accessed directly.
+	LivenessUnreachable
 )
 
+// String implements fmt.Stringer interface.
+func (l Liveness) String() string {
+	switch l {
+	case LivenessReachable:
+		return "reachable"
+	case LivenessUnreachable:
+		return "unreachable"
+	default:
+		return "unknown"
+	}
+}
+
+type livenessProviderHolder struct {
+	provider func(addr string, storeID uint64) Liveness
+}
+
+// SetStoreLivenessProvider sets the function that tells the liveness of a store instead of the built-in health check
+// of the store's status API. It's called when a request to the store fails and by the health check loop of an
+// unreachable store, so the requests to the store are forwarded until it returns LivenessReachable. The provider must
+// be safe for concurrent use and shouldn't block long. Setting it to nil restores the built-in health check.
+func (c *RegionCache) SetStoreLivenessProvider(provider func(addr string, storeID uint64) Liveness) {
+	c.livenessProvider.Store(&livenessProviderHolder{provider: provider})
+}
+
+func (c *RegionCache) getStoreLivenessProvider() func(addr string, storeID uint64) Liveness {
+	if h, ok := c.livenessProvider.Load().(*livenessProviderHolder); ok {
+		return h.provider
+	}
+	return nil
+}
+
 func (s *Store) startHealthCheckLoopIfNeeded(c *RegionCache) {
 	// This mechanism doesn't support non-TiKV stores currently.
 	if s.storeType != tikvrpc.TiKV {
@@ -2206,16 +3952,26 @@ func (s *Store) startHealthCheckLoopIfNeeded(c *RegionCache) {
 			zap.Uint64("storeID", s.storeID), zap.String("addr", s.addr))
 		return
 	}
+	// The health check loop exits immediately if the cache is closed.
+	if c.checkClosed() != nil {
+		return
+	}
 
 	// It may be already started by another thread.
 	if atomic.CompareAndSwapInt32(&s.unreachable, 0, 1) {
-		s.unreachableSince = time.Now()
+		s.unreachableSince.Store(time.Now().UnixNano())
 		go s.checkUntilHealth(c)
 	}
 }
 
 func (s *Store) checkUntilHealth(c *RegionCache) {
-	defer atomic.CompareAndSwapInt32(&s.unreachable, 1, 0)
+	defer func() {
+		// A deleted store keeps the flag so that requests still holding it are forwarded until they switch to
+		// the replacement store, which takes over the health check.
+		if s.getResolveState() != deleted {
+			atomic.CompareAndSwapInt32(&s.unreachable, 1, 0)
+		}
+	}()
 
 	ticker := time.NewTicker(time.Second)
 	lastCheckPDTime := time.Now()
@@ -2228,6 +3984,11 @@ func (s *Store) checkUntilHealth(c *RegionCache) {
 		case <-c.closeCh:
 			return
 		case <-ticker.C:
+			// The store is replaced by a new one, which continues the health check if needed.
+			if s.getResolveState() == deleted {
+				logutil.BgLogger().Info("[health check] store meta deleted, stop checking", zap.Uint64("storeID", s.storeID), zap.String("addr", s.addr))
+				return
+			}
 			if time.Since(lastCheckPDTime) > time.Second*30 {
 				lastCheckPDTime = time.Now()
 
@@ -2242,7 +4003,7 @@ func (s *Store) checkUntilHealth(c *RegionCache) {
 
 			bo := retry.NewNoopBackoff(ctx)
 			l := s.requestLiveness(bo, c)
-			if l == reachable {
+			if l == LivenessReachable {
 				logutil.BgLogger().Info("[health check] store became reachable", zap.Uint64("storeID", s.storeID))
 
 				return
@@ -2251,22 +4012,28 @@ func (s *Store) checkUntilHealth(c *RegionCache) {
 	}
 }
 
-func (s *Store) requestLiveness(bo *retry.Backoffer, c *RegionCache) (l livenessState) {
-	if c != nil && c.testingKnobs.mockRequestLiveness != nil {
-		return c.testingKnobs.mockRequestLiveness(s, bo)
+func (s *Store) requestLiveness(bo *retry.Backoffer, c *RegionCache) (l Liveness) {
+	if c != nil {
+		if provider := c.getStoreLivenessProvider(); provider != nil {
+			return provider(s.addr, s.storeID)
+		}
 	}
 
 	if storeLivenessTimeout == 0 {
-		return unreachable
+		return LivenessUnreachable
 	}
 
 	if s.getResolveState() != resolved {
-		l = unknown
+		l = LivenessUnknown
 		return
 	}
 	addr := s.addr
+	var launched int32
 	rsCh := livenessSf.DoChan(addr, func() (interface{}, error) {
-		return invokeKVStatusAPI(addr, storeLivenessTimeout), nil
+		atomic.StoreInt32(&launched, 1)
+		l := invokeKVStatusAPI(addr, storeLivenessTimeout)
+		metrics.TiKVLivenessProbeCounter.WithLabelValues("launch", l.String()).Inc()
+		return l, nil
 	})
 	var ctx context.Context
 	if bo != nil {
@@ -2276,9 +4043,13 @@ func (s *Store) requestLiveness(bo *retry.Backoffer, c *RegionCache) (l liveness
 	}
 	select {
 	case rs := <-rsCh:
-		l = rs.Val.(livenessState)
+		l = rs.Val.(Liveness)
+		// The probe launched by this check is counted by itself.
+		if atomic.LoadInt32(&launched) == 0 {
+			metrics.TiKVLivenessProbeCounter.WithLabelValues("dedup", l.String()).Inc()
+		}
 	case <-ctx.Done():
-		l = unknown
+		l = LivenessUnknown
 		return
 	}
 	return
@@ -2289,10 +4060,10 @@ func (s *Store) GetAddr() string {
 	return s.addr
 }
 
-func invokeKVStatusAPI(addr string, timeout time.Duration) (l livenessState) {
+func invokeKVStatusAPI(addr string, timeout time.Duration) (l Liveness) {
 	start := time.Now()
 	defer func() {
-		if l == reachable {
+		if l == LivenessReachable {
 			metrics.StatusCountWithOK.Inc()
 		} else {
 			metrics.StatusCountWithError.Inc()
@@ -2305,7 +4076,7 @@ func invokeKVStatusAPI(addr string, timeout time.Duration) (l livenessState) {
 	conn, cli, err := createKVHealthClient(ctx, addr)
 	if err != nil {
 		logutil.BgLogger().Info("[health check] create grpc connection failed", zap.String("store", addr), zap.Error(err))
-		l = unreachable
+		l = LivenessUnreachable
 		return
 	}
 	defer func() {
@@ -2319,24 +4090,24 @@ func invokeKVStatusAPI(addr string, timeout time.Duration) (l livenessState) {
 	resp, err := cli.Check(ctx, req)
 	if err != nil {
 		logutil.BgLogger().Info("[health check] check health error", zap.String("store", addr), zap.Error(err))
-		l = unreachable
+		l = LivenessUnreachable
 		return
 	}
 
 	status := resp.GetStatus()
 	if status == healthpb.HealthCheckResponse_UNKNOWN {
 		logutil.BgLogger().Info("[health check] check health returns unknown", zap.String("store", addr))
-		l = unknown
+		l = LivenessUnknown
 		return
 	}
 
 	if status != healthpb.HealthCheckResponse_SERVING {
 		logutil.BgLogger().Info("[health check] service not serving", zap.Stringer("status", status))
-		l = unreachable
+		l = LivenessUnreachable
 		return
 	}
 
-	l = reachable
+	l = LivenessReachable
 	return
 }
 
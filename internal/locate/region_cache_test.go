@@ -35,22 +35,36 @@
 package locate
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"fmt"
+	"math"
 	"math/rand"
 	"reflect"
+	"strconv"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
 	"github.com/gogo/protobuf/proto"
 	"github.com/google/btree"
 	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/prometheus/client_golang/prometheus"
+	dto "github.com/prometheus/client_model/go"
 	"github.com/stretchr/testify/suite"
+	"github.com/tikv/client-go/v2/config"
+	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/internal/mockstore/mocktikv"
 	"github.com/tikv/client-go/v2/internal/retry"
 	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/metrics"
+	"github.com/tikv/client-go/v2/tikvrpc"
 	pd "github.com/tikv/pd/client"
 )
 
@@ -189,10 +203,112 @@ func (s *testRegionCacheSuite) TestStoreLabels() {
 		}
 		stores := s.cache.getStoresByLabels(labels)
 		s.Equal(len(stores), 1)
-		s.Equal(stores[0].labels, labels)
+		s.Equal(stores[0].getLabels(), labels)
 	}
 }
 
+func (s *testRegionCacheSuite) TestReadIndexRPCContexts() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	leaderCtx, followerCtx, err := s.cache.GetTiKVReadIndexRPCContexts(s.bo, loc.Region, rand.Uint32())
+	s.Nil(err)
+	s.Equal(s.storeAddr(s.store1), leaderCtx.Addr)
+	s.Equal(s.storeAddr(s.store2), followerCtx.Addr)
+	s.Equal(loc.Region, leaderCtx.Region)
+	s.Equal(loc.Region, followerCtx.Region)
+	s.True(leaderCtx.Meta == followerCtx.Meta)
+
+	// Both are nil if the region is out of date.
+	s.cache.InvalidateCachedRegion(loc.Region)
+	leaderCtx, followerCtx, err = s.cache.GetTiKVReadIndexRPCContexts(s.bo, loc.Region, 0)
+	s.Nil(err)
+	s.Nil(leaderCtx)
+	s.Nil(followerCtx)
+}
+
+func (s *testRegionCacheSuite) TestOnAllReplicasFailed() {
+	var failedRegions []RegionVerID
+	s.cache.SetOnAllReplicasFailed(func(region RegionVerID, err error) {
+		failedRegions = append(failedRegions, region)
+	})
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	sender := NewRegionRequestSender(s.cache, nil)
+
+	// Fail the leader, then the request is retried on the follower.
+	ctx, err := s.cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	s.Equal(s.store1, ctx.Store.storeID)
+	s.cache.OnSendFail(s.bo, ctx, sender.NeedReloadRegion(ctx), nil)
+	s.Empty(failedRegions)
+
+	// Fail the follower, then all the replicas are tried.
+	ctx, err = s.cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	s.Equal(s.store2, ctx.Store.storeID)
+	s.cache.OnSendFail(s.bo, ctx, sender.NeedReloadRegion(ctx), nil)
+	s.Equal([]RegionVerID{loc.Region}, failedRegions)
+}
+
+func (s *testRegionCacheSuite) TestStoreSendFailureRate() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	ctx, err := s.cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	store := ctx.Store
+	s.Equal(0.0, store.GetSendFailureRate())
+
+	s.cache.OnSendFail(s.bo, ctx, false, errors.New("send fail"))
+	s.Equal(1.0, store.GetSendFailureRate())
+	for i := 0; i < 3; i++ {
+		s.cache.OnSendSuccess(ctx)
+	}
+	s.Equal(0.25, store.GetSendFailureRate())
+
+	// The failure slides out of the window.
+	for i := 0; i < sendStatsWindowSize-3; i++ {
+		s.cache.OnSendSuccess(ctx)
+	}
+	s.Equal(0.0, store.GetSendFailureRate())
+}
+
+func (s *testRegionCacheSuite) TestHealthyPeerCount() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	region := s.cache.GetCachedRegionWithRLock(loc.Region)
+	s.Equal(2, region.PeerCount())
+	s.Equal(2, region.HealthyPeerCount())
+
+	store := s.cache.getStoreByStoreID(s.store2)
+	atomic.StoreInt32(&store.unreachable, 1)
+	s.Equal(2, region.PeerCount())
+	s.Equal(1, region.HealthyPeerCount())
+	atomic.StoreInt32(&store.unreachable, 0)
+	s.Equal(2, region.HealthyPeerCount())
+}
+
+func (s *testRegionCacheSuite) TestCountKeysByLeaderStore() {
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("m"), newPeers, newPeers[0])
+	s.cluster.ChangeLeader(region2, newPeers[1])
+
+	keys := [][]byte{[]byte("a"), []byte("b"), []byte("c"), []byte("m"), []byte("n")}
+	counts, err := s.cache.CountKeysByLeaderStore(s.bo, keys)
+	s.Nil(err)
+	s.Equal(map[uint64]int{s.store1: 3, s.store2: 2}, counts)
+
+	// The regions are loaded if they aren't cached.
+	s.cache.clear()
+	counts, err = s.cache.CountKeysByLeaderStore(s.bo, keys)
+	s.Nil(err)
+	s.Equal(map[uint64]int{s.store1: 3, s.store2: 2}, counts)
+
+	counts, err = s.cache.CountKeysByLeaderStore(s.bo, nil)
+	s.Nil(err)
+	s.Empty(counts)
+}
+
 func (s *testRegionCacheSuite) TestSimple() {
 	seed := rand.Uint32()
 	r := s.getRegion([]byte("a"))
@@ -208,6 +324,70 @@ func (s *testRegionCacheSuite) TestSimple() {
 	s.Nil(r)
 }
 
+func (s *testRegionCacheSuite) TestMarkManyStoresNeedCheck() {
+	var (
+		blocking int32
+		entered  = make(chan struct{})
+		release  = make(chan struct{})
+	)
+	cache := NewRegionCache(&hookedPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}, onGetStore: func(uint64) {
+		if atomic.CompareAndSwapInt32(&blocking, 1, 0) {
+			close(entered)
+			<-release
+		}
+	}})
+	defer cache.Close()
+
+	stores := make([]*Store, 0, 100)
+	for i := 0; i < 100; i++ {
+		storeID := s.cluster.AllocID()
+		s.cluster.AddStore(storeID, s.storeAddr(storeID))
+		store := cache.getStoreByStoreID(storeID)
+		_, err := store.initResolve(s.bo, cache)
+		s.Nil(err)
+		stores = append(stores, store)
+	}
+
+	// Block the loop in the pass checking the first store.
+	pendingChecks := readGauge(metrics.TiKVPendingStoreChecks)
+	atomic.StoreInt32(&blocking, 1)
+	stores[0].markNeedCheck(cache)
+	<-entered
+
+	// Mark the others concurrently while the loop is busy. They are all kept in the set and wait for a single
+	// notification.
+	var wg sync.WaitGroup
+	for _, store := range stores[1:] {
+		wg.Add(1)
+		go func(store *Store) {
+			defer wg.Done()
+			store.markNeedCheck(cache)
+		}(store)
+	}
+	wg.Wait()
+	cache.needCheckMu.Lock()
+	s.Len(cache.needCheckMu.stores, len(stores)-1)
+	cache.needCheckMu.Unlock()
+	s.Len(cache.notifyCheckCh, 1)
+	// The pending stores of the cache are added to the ones of the other caches.
+	s.Equal(pendingChecks+float64(len(stores)-1), readGauge(metrics.TiKVPendingStoreChecks))
+
+	// The next pass re-resolves all of them without waiting for the ticker.
+	close(release)
+	s.Eventually(func() bool {
+		for _, store := range stores {
+			if store.getResolveState() != resolved {
+				return false
+			}
+		}
+		return true
+	}, 3*time.Second, 10*time.Millisecond)
+	cache.needCheckMu.Lock()
+	s.Len(cache.needCheckMu.stores, 0)
+	cache.needCheckMu.Unlock()
+	s.Equal(pendingChecks, readGauge(metrics.TiKVPendingStoreChecks))
+}
+
 // TestResolveStateTransition verifies store's resolve state transition. For example,
 // a newly added store is in unresolved state and will be resolved soon if it's an up store,
 // or in tombstone state if it's a tombstone.
@@ -236,13 +416,13 @@ func (s *testRegionCacheSuite) TestResolveStateTransition() {
 
 	// Mark the store needCheck. The resolve state should be resolved soon.
 	store := cache.getStoreByStoreID(s.store1)
-	store.markNeedCheck(cache.notifyCheckCh)
+	store.markNeedCheck(cache)
 	waitResolve(store)
 	s.Equal(store.getResolveState(), resolved)
 
 	// Mark the store needCheck and it becomes a tombstone. The resolve state should be tombstone.
 	s.cluster.MarkTombstone(s.store1)
-	store.markNeedCheck(cache.notifyCheckCh)
+	store.markNeedCheck(cache)
 	waitResolve(store)
 	s.Equal(store.getResolveState(), tombstone)
 	s.cluster.StartStore(s.store1)
@@ -254,7 +434,7 @@ func (s *testRegionCacheSuite) TestResolveStateTransition() {
 	s.Equal(store.getResolveState(), resolved)
 	storeMeta := s.cluster.GetStore(s.store1)
 	s.cluster.RemoveStore(s.store1)
-	store.markNeedCheck(cache.notifyCheckCh)
+	store.markNeedCheck(cache)
 	waitResolve(store)
 	s.Equal(store.getResolveState(), tombstone)
 	s.cluster.AddStore(storeMeta.GetId(), storeMeta.GetAddress(), storeMeta.GetLabels()...)
@@ -266,13 +446,38 @@ func (s *testRegionCacheSuite) TestResolveStateTransition() {
 	store.initResolve(bo, cache)
 	s.Equal(store.getResolveState(), resolved)
 	s.cluster.UpdateStoreAddr(s.store1, store.addr+"0", &metapb.StoreLabel{Key: "k", Value: "v"})
-	store.markNeedCheck(cache.notifyCheckCh)
+	store.markNeedCheck(cache)
 	waitResolve(store)
 	s.Equal(store.getResolveState(), deleted)
 	newStore := cache.getStoreByStoreID(s.store1)
 	s.Equal(newStore.getResolveState(), resolved)
 	s.Equal(newStore.addr, store.addr+"0")
-	s.Equal(newStore.labels, []*metapb.StoreLabel{{Key: "k", Value: "v"}})
+	s.Equal(newStore.getLabels(), []*metapb.StoreLabel{{Key: "k", Value: "v"}})
+
+	// Mark the store needCheck and only its non-routing labels are changed.
+	// The labels should be updated in place without replacing the store.
+	cache.clear()
+	store = cache.getStoreByStoreID(s.store1)
+	store.initResolve(bo, cache)
+	s.Equal(store.getResolveState(), resolved)
+	zone := &metapb.StoreLabel{Key: "zone", Value: "z1"}
+	s.cluster.UpdateStoreAddr(s.store1, store.addr, zone, &metapb.StoreLabel{Key: "k", Value: "v1"})
+	store.markNeedCheck(cache)
+	waitResolve(store)
+	s.Equal(store.getResolveState(), resolved)
+	s.Equal(store.getLabels(), []*metapb.StoreLabel{zone, {Key: "k", Value: "v1"}})
+	s.True(cache.getStoreByStoreID(s.store1) == store)
+	s.True(store.IsLabelsMatch([]*metapb.StoreLabel{{Key: "k", Value: "v1"}}))
+
+	// Mark the store needCheck and its zone is changed. The store should be replaced.
+	s.cluster.UpdateStoreAddr(s.store1, store.addr, &metapb.StoreLabel{Key: "zone", Value: "z2"}, &metapb.StoreLabel{Key: "k", Value: "v1"})
+	store.markNeedCheck(cache)
+	waitResolve(store)
+	s.Equal(store.getResolveState(), deleted)
+	newStore = cache.getStoreByStoreID(s.store1)
+	s.False(newStore == store)
+	s.Equal(newStore.getResolveState(), resolved)
+	s.Equal(newStore.getLabels(), []*metapb.StoreLabel{{Key: "zone", Value: "z2"}, {Key: "k", Value: "v1"}})
 
 	// Check initResolve()ing a tombstone store. The resolve state should be tombstone.
 	cache.clear()
@@ -376,10 +581,764 @@ func (s *testRegionCacheSuite) TestFilterDownPeersOrPeersOnTombstoneOrDroppedSto
 	_, err = s.cache.findRegionByKey(bo, key, false)
 	s.NotNil(err)
 	s.Regexp(".*no available peers.", err.Error())
+	s.True(tikverr.IsErrNoAvailablePeers(err))
+	s.cluster.StartStore(s.store1)
+	s.cluster.StartStore(s.store2)
+}
+
+// downPeersPDClient reports all peers of the regions down. If recoverAfter is positive, the peers are reported up
+// after so many calls.
+type downPeersPDClient struct {
+	pd.Client
+	recoverAfter int32
+	calls        int32
+}
+
+func (c *downPeersPDClient) GetRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	r, err := c.Client.GetRegion(ctx, key, opts...)
+	calls := atomic.AddInt32(&c.calls, 1)
+	if c.recoverAfter > 0 && calls > c.recoverAfter {
+		return r, err
+	}
+	if r != nil && r.Meta != nil {
+		r.DownPeers = append([]*metapb.Peer(nil), r.Meta.Peers...)
+	}
+	return r, err
+}
+
+func (s *testRegionCacheSuite) TestNoAvailablePeersRetry() {
+	pdClient := &downPeersPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}}
+	cache := NewRegionCache(pdClient)
+	defer cache.Close()
+
+	// The region is reloaded a few times before reporting the error.
+	_, err := cache.LocateKey(s.bo, []byte("a"))
+	var noPeersErr *tikverr.ErrNoAvailablePeers
+	s.True(errors.As(err, &noPeersErr))
+	s.Equal(s.region1, noPeersErr.RegionID)
+	s.Equal(int32(maxNoAvailablePeersRetry+1), atomic.LoadInt32(&pdClient.calls))
+
+	// The region is loaded if PD recovers in time.
+	atomic.StoreInt32(&pdClient.calls, 0)
+	pdClient.recoverAfter = 1
+	loc, err := cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Equal(s.region1, loc.Region.id)
+	s.Equal(int32(2), atomic.LoadInt32(&pdClient.calls))
+}
+
+// blockingPDClient counts the GetRegion calls, and blocks the first one after the region is fetched until released.
+type blockingPDClient struct {
+	pd.Client
+	calls   int32
+	fetched chan struct{}
+	release chan struct{}
+}
+
+func (c *blockingPDClient) GetRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	r, err := c.Client.GetRegion(ctx, key, opts...)
+	if atomic.AddInt32(&c.calls, 1) == 1 {
+		close(c.fetched)
+		<-c.release
+	}
+	return r, err
+}
+
+func (s *testRegionCacheSuite) TestDedupRegionLoads() {
+	newPDClient := func() *blockingPDClient {
+		return &blockingPDClient{
+			Client:  &CodecPDClient{mocktikv.NewPDClient(s.cluster)},
+			fetched: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+	}
+	pdClient := newPDClient()
+	cache := NewRegionCache(pdClient)
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			loc, err := cache.LocateKey(retry.NewBackofferWithVars(context.Background(), 5000, nil), []byte("a"))
+			s.Nil(err)
+			s.Equal(s.region1, loc.Region.id)
+		}()
+	}
+	<-pdClient.fetched
+	// Wait for the other calls to join the load.
+	time.Sleep(50 * time.Millisecond)
+	close(pdClient.release)
+	wg.Wait()
+	s.Equal(int32(1), atomic.LoadInt32(&pdClient.calls))
+	s.Equal(1, cache.mu.sorted.Len())
+
+	// The region is split after it's loaded and before it's inserted.
+	pdClient = newPDClient()
+	cache2 := NewRegionCache(pdClient)
+	defer cache2.Close()
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		loc, err := cache2.LocateKey(retry.NewBackofferWithVars(context.Background(), 5000, nil), []byte("a"))
+		s.Nil(err)
+		s.Equal([]byte("m"), loc.EndKey)
+	}()
+	<-pdClient.fetched
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("m"), newPeers, newPeers[0])
+	// The new region is loaded and inserted by another key in it.
+	loc, err := cache2.LocateKey(s.bo, []byte("b"))
+	s.Nil(err)
+	s.Equal([]byte("m"), loc.EndKey)
+	close(pdClient.release)
+	wg.Wait()
+	// The stale region doesn't replace the new one.
+	meta, _ := s.cluster.GetRegion(s.region1)
+	r := cache2.searchCachedRegion([]byte("a"), false)
+	s.NotNil(r)
+	s.Equal(meta.GetRegionEpoch().GetVersion(), r.GetMeta().GetRegionEpoch().GetVersion())
+	loc, err = cache2.LocateKey(s.bo, []byte("z"))
+	s.Nil(err)
+	s.Equal(region2, loc.Region.id)
+}
+
+// slowPDClient delays the region requests and records the max number of concurrent ones.
+type slowPDClient struct {
+	pd.Client
+	delay       time.Duration
+	inflight    int32
+	maxInflight int32
+}
+
+func (c *slowPDClient) enter() {
+	inflight := atomic.AddInt32(&c.inflight, 1)
+	for {
+		maxInflight := atomic.LoadInt32(&c.maxInflight)
+		if inflight <= maxInflight || atomic.CompareAndSwapInt32(&c.maxInflight, maxInflight, inflight) {
+			break
+		}
+	}
+	time.Sleep(c.delay)
+	atomic.AddInt32(&c.inflight, -1)
+}
+
+func (c *slowPDClient) GetRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	c.enter()
+	return c.Client.GetRegion(ctx, key, opts...)
+}
+
+func (c *slowPDClient) GetRegionByID(ctx context.Context, regionID uint64, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	c.enter()
+	return c.Client.GetRegionByID(ctx, regionID, opts...)
+}
+
+func (s *testRegionCacheSuite) TestMaxConcurrentRegionLoads() {
+	regionIDs := []uint64{s.region1}
+	keys := []string{"a"}
+	for i := 1; i < 10; i++ {
+		key := fmt.Sprintf("k%d", i)
+		regionID := s.cluster.AllocID()
+		newPeers := s.cluster.AllocIDs(2)
+		s.cluster.Split(regionIDs[len(regionIDs)-1], regionID, []byte(key), newPeers, newPeers[0])
+		regionIDs = append(regionIDs, regionID)
+		keys = append(keys, key)
+	}
+
+	pdClient := &slowPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}, delay: 20 * time.Millisecond}
+	cache := NewRegionCache(pdClient, WithMaxConcurrentRegionLoads(2))
+	defer cache.Close()
+
+	var wg sync.WaitGroup
+	for i := range keys {
+		wg.Add(2)
+		go func(key string) {
+			defer wg.Done()
+			_, err := cache.LocateKey(retry.NewBackofferWithVars(context.Background(), 5000, nil), []byte(key))
+			s.Nil(err)
+		}(keys[i])
+		go func(regionID uint64) {
+			defer wg.Done()
+			_, err := cache.loadRegionByID(retry.NewBackofferWithVars(context.Background(), 5000, nil), regionID)
+			s.Nil(err)
+		}(regionIDs[i])
+	}
+	wg.Wait()
+	s.Equal(int32(2), atomic.LoadInt32(&pdClient.maxInflight))
+
+	// A load waiting for the limiter is canceled with its context.
+	s.True(cache.regionLoadLimiter.TryAcquire(2))
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cache.loadRegion(retry.NewBackofferWithVars(ctx, 5000, nil), []byte("a"), false)
+	s.ErrorIs(err, context.DeadlineExceeded)
+	cache.regionLoadLimiter.Release(2)
+
+	// It's limited by default and unlimited if n <= 0.
+	cache2 := NewRegionCache(pdClient)
+	defer cache2.Close()
+	s.True(cache2.regionLoadLimiter.TryAcquire(defaultMaxConcurrentRegionLoads))
+	s.False(cache2.regionLoadLimiter.TryAcquire(1))
+	cache3 := NewRegionCache(pdClient, WithMaxConcurrentRegionLoads(0))
+	defer cache3.Close()
+	s.Nil(cache3.regionLoadLimiter)
+}
+
+func (s *testRegionCacheSuite) TestCollapseRegionLoads() {
+	newPDClient := func() *blockingPDClient {
+		return &blockingPDClient{
+			Client:  &CodecPDClient{mocktikv.NewPDClient(s.cluster)},
+			fetched: make(chan struct{}),
+			release: make(chan struct{}),
+		}
+	}
+	// The keys are different but in the same region. The misses find the region loaded by the first one after
+	// waiting for it, so they collapse into one load, with or without a tight limit of concurrent loads.
+	for _, opts := range [][]RegionCacheOption{nil, {WithMaxConcurrentRegionLoads(1)}} {
+		pdClient := newPDClient()
+		cache := NewRegionCache(pdClient, opts...)
+		var wg sync.WaitGroup
+		for i := 0; i < 100; i++ {
+			wg.Add(1)
+			go func(key []byte) {
+				defer wg.Done()
+				loc, err := cache.LocateKey(retry.NewBackofferWithVars(context.Background(), 5000, nil), key)
+				s.Nil(err)
+				s.Equal(s.region1, loc.Region.id)
+			}([]byte(fmt.Sprintf("k%03d", i)))
+		}
+		<-pdClient.fetched
+		time.Sleep(50 * time.Millisecond)
+		close(pdClient.release)
+		wg.Wait()
+		s.Equal(int32(1), atomic.LoadInt32(&pdClient.calls))
+		cache.Close()
+	}
+
+	// The wait for an in-flight load is bounded by the context of the miss.
+	pdClient := newPDClient()
+	cache := NewRegionCache(pdClient)
+	defer cache.Close()
+	var wg sync.WaitGroup
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		_, err := cache.LocateKey(retry.NewBackofferWithVars(context.Background(), 5000, nil), []byte("a"))
+		s.Nil(err)
+	}()
+	<-pdClient.fetched
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err := cache.LocateKey(retry.NewBackofferWithVars(ctx, 5000, nil), []byte("z"))
+	s.ErrorIs(err, context.DeadlineExceeded)
+	s.Equal(int32(1), atomic.LoadInt32(&pdClient.calls))
+	close(pdClient.release)
+	wg.Wait()
+}
+
+func (s *testRegionCacheSuite) TestRPCContextLogFields() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	ctx, err := s.cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	f := ctx.LogFields()
+	s.Equal(s.region1, f.RegionID)
+	s.Equal(loc.Region.GetVer(), f.RegionVer)
+	s.Equal(s.peer1, f.PeerID)
+	s.Equal(s.store1, f.StoreID)
+	s.Equal("tikv", f.StoreType)
+	s.Equal(s.storeAddr(s.store1), f.Addr)
+	s.Equal("TiKvOnly", f.AccessMode)
+	s.Equal(2, f.TiKVNum)
+	b, err := json.Marshal(f)
+	s.Nil(err)
+	s.NotContains(string(b), "proxy")
+	s.Contains(string(b), fmt.Sprintf(`"store_id":%d`, s.store1))
+
+	// The proxy is reported if the request is forwarded.
+	ctx.ProxyStore = s.cache.getStoreByStoreID(s.store2)
+	ctx.ProxyAddr = s.storeAddr(s.store2)
+	f = ctx.LogFields()
+	s.Equal(s.store2, f.ProxyStoreID)
+	s.Equal(s.storeAddr(s.store2), f.ProxyAddr)
+
+	// Nil stores are fine.
+	f = (&RPCContext{}).LogFields()
+	s.Zero(f.StoreID)
+	s.Empty(f.StoreType)
+}
+
+func (s *testRegionCacheSuite) TestStoreLivenessProvider() {
+	_, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	store := s.cache.getStoreByStoreID(s.store1)
+
+	var gotAddr string
+	var gotStoreID uint64
+	s.cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		gotAddr, gotStoreID = addr, storeID
+		return LivenessReachable
+	})
+	s.Equal(LivenessReachable, store.requestLiveness(s.bo, s.cache))
+	s.Equal(s.storeAddr(s.store1), gotAddr)
+	s.Equal(s.store1, gotStoreID)
+
+	// The built-in health check is used again, which always returns unreachable in unit tests.
+	s.cache.SetStoreLivenessProvider(nil)
+	s.Equal(LivenessUnreachable, store.requestLiveness(s.bo, s.cache))
+}
+
+func (s *testRegionCacheSuite) TestLivenessProbeDedupMetrics() {
+	_, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	store := s.cache.getStoreByStoreID(s.store1)
+	defer SetStoreLivenessTimeout(GetStoreLivenessTimeout())
+	SetStoreLivenessTimeout(100 * time.Millisecond)
+
+	launch := metrics.TiKVLivenessProbeCounter.WithLabelValues("launch", LivenessUnreachable.String())
+	dedup := metrics.TiKVLivenessProbeCounter.WithLabelValues("dedup", LivenessUnreachable.String())
+	launchBefore, dedupBefore := readCounter(launch), readCounter(dedup)
+	// Each check either launches a probe or shares the result of the probe in flight.
+	var wg sync.WaitGroup
+	for i := 0; i < 10; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			s.Equal(LivenessUnreachable, store.requestLiveness(retry.NewNoopBackoff(context.Background()), s.cache))
+		}()
+	}
+	wg.Wait()
+	launched, deduped := readCounter(launch)-launchBefore, readCounter(dedup)-dedupBefore
+	s.GreaterOrEqual(launched, float64(1))
+	s.Equal(float64(10), launched+deduped)
+}
+
+// getStoreCountingPDClient counts the GetStore requests for each store.
+type getStoreCountingPDClient struct {
+	pd.Client
+	mu    sync.Mutex
+	calls map[uint64]int
+}
+
+func (c *getStoreCountingPDClient) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	c.mu.Lock()
+	c.calls[storeID]++
+	c.mu.Unlock()
+	return c.Client.GetStore(ctx, storeID)
+}
+
+func (c *getStoreCountingPDClient) getCalls(storeID uint64) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.calls[storeID]
+}
+
+func (s *testRegionCacheSuite) TestStoreNotFoundCache() {
+	// 50 regions have a peer on a store which PD doesn't know.
+	missingStore := s.cluster.AllocID()
+	regionIDs := []uint64{s.region1}
+	for i := 1; i < 50; i++ {
+		regionID := s.cluster.AllocID()
+		newPeers := s.cluster.AllocIDs(2)
+		s.cluster.Split(regionIDs[len(regionIDs)-1], regionID, []byte(fmt.Sprintf("k%02d", i)), newPeers, newPeers[0])
+		regionIDs = append(regionIDs, regionID)
+	}
+	for _, regionID := range regionIDs {
+		s.cluster.AddPeer(regionID, missingStore, s.cluster.AllocID())
+	}
+
+	pdClient := &getStoreCountingPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}, calls: make(map[uint64]int)}
+	ttl := 300 * time.Millisecond
+	cache := NewRegionCache(pdClient, WithStoreNotFoundTTL(ttl))
+	defer cache.Close()
+
+	loadAll := func() {
+		var wg sync.WaitGroup
+		stores := make([]*Store, len(regionIDs))
+		for i, regionID := range regionIDs {
+			wg.Add(1)
+			go func(i int, regionID uint64) {
+				defer wg.Done()
+				region, err := cache.loadRegionByID(retry.NewBackofferWithVars(context.Background(), 5000, nil), regionID)
+				s.Nil(err)
+				// The peer on the missing store is filtered.
+				s.Len(region.GetMeta().GetPeers(), 2)
+				stores[i] = cache.getStoreByStoreID(missingStore)
+			}(i, regionID)
+		}
+		wg.Wait()
+		// All the regions see the same store instance.
+		for _, store := range stores {
+			s.Same(stores[0], store)
+		}
+	}
+
+	loadAll()
+	s.Equal(1, pdClient.getCalls(missingStore))
+	loadAll()
+	s.Equal(1, pdClient.getCalls(missingStore))
+
+	// The store is resolved again once the ttl expires.
+	time.Sleep(ttl + 100*time.Millisecond)
+	loadAll()
+	s.Equal(2, pdClient.getCalls(missingStore))
+	s.Equal(1, pdClient.getCalls(s.store1))
+}
+
+func (s *testRegionCacheSuite) TestPeekTargetStore() {
+	var regionLoads int32
+	storeClient := &getStoreCountingPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}, calls: make(map[uint64]int)}
+	pdClient := &hookedPDClient{
+		Client:          storeClient,
+		onGetRegion:     func() { atomic.AddInt32(&regionLoads, 1) },
+		onGetRegionByID: func() { atomic.AddInt32(&regionLoads, 1) },
+		onScanRegions:   func() { atomic.AddInt32(&regionLoads, 1) },
+	}
+	cache := NewRegionCache(pdClient)
+	defer cache.Close()
+
+	// The region isn't cached.
+	_, _, ok := cache.PeekTargetStore(NewRegionVerID(s.region1, 1, 1), kv.ReplicaReadLeader, 0)
+	s.False(ok)
+	s.Zero(atomic.LoadInt32(&regionLoads))
+
+	loc, err := cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Equal(int32(1), atomic.LoadInt32(&regionLoads))
+	region := cache.GetCachedRegionWithRLock(loc.Region)
+	lastAccess := time.Now().Unix() - 10
+	atomic.StoreInt64(&region.lastAccess, lastAccess)
+
+	type selection struct {
+		storeID uint64
+		addr    string
+	}
+	replicaReads := []kv.ReplicaReadType{kv.ReplicaReadLeader, kv.ReplicaReadFollower, kv.ReplicaReadMixed}
+	expected := make(map[kv.ReplicaReadType][]selection)
+	for _, replicaRead := range replicaReads {
+		for seed := uint32(0); seed < 4; seed++ {
+			ctx, err := cache.GetTiKVRPCContext(s.bo, loc.Region, replicaRead, seed)
+			s.Nil(err)
+			s.NotNil(ctx)
+			expected[replicaRead] = append(expected[replicaRead], selection{ctx.Store.storeID, ctx.Addr})
+		}
+	}
+	store1Calls, store2Calls := storeClient.getCalls(s.store1), storeClient.getCalls(s.store2)
+	atomic.StoreInt64(&region.lastAccess, lastAccess)
+
+	for _, replicaRead := range replicaReads {
+		for seed := uint32(0); seed < 4; seed++ {
+			storeID, addr, ok := cache.PeekTargetStore(loc.Region, replicaRead, seed)
+			s.True(ok)
+			s.Equal(expected[replicaRead][seed], selection{storeID, addr})
+		}
+	}
+	s.Equal(store1Calls, storeClient.getCalls(s.store1))
+	s.Equal(store2Calls, storeClient.getCalls(s.store2))
+	s.Equal(int32(1), atomic.LoadInt32(&regionLoads))
+	s.Equal(lastAccess, atomic.LoadInt64(&region.lastAccess))
+
+	// It doesn't select a stale region.
+	region.invalidate(Other)
+	_, _, ok = cache.PeekTargetStore(loc.Region, kv.ReplicaReadLeader, 0)
+	s.False(ok)
+}
+
+func (s *testRegionCacheSuite) TestStrictDownPeerFiltering() {
+	cache := NewRegionCache(&downPeersPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}})
+	defer cache.Close()
+	cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessReachable
+	})
+	sender := NewRegionRequestSender(cache, mocktikv.NewRPCClient(s.cluster, s.mvccStore, nil))
+	req := tikvrpc.NewRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("a"), Version: 1})
+
+	// The region fails to load by default.
+	_, err := cache.LocateKey(s.bo, []byte("a"))
+	s.NotNil(err)
+
+	// The stale down peers are used as suspect peers.
+	cache.SetStrictDownPeerFiltering(false)
+	loc, err := cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	region := cache.GetCachedRegionWithRLock(loc.Region)
+	s.True(region.suspectPeers)
+	s.Len(region.GetMeta().GetPeers(), 2)
+	resp, err := sender.SendReq(s.bo, req, loc.Region, time.Second)
+	s.Nil(err)
+	regionErr, err := resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+
+	// A suspect leader is not retried after failing to send.
+	selector, err := newReplicaSelector(cache, loc.Region, req)
+	s.Nil(err)
+	_, err = selector.next(s.bo)
+	s.Nil(err)
+	selector.onSendFailure(s.bo, errors.New("send fail"))
+	s.IsType(&tryFollower{}, selector.state)
+
+	// Peers on tombstone stores are still filtered.
+	cache.clear()
+	s.cluster.MarkTombstone(s.store1)
+	s.cluster.MarkTombstone(s.store2)
+	_, err = cache.LocateKey(s.bo, []byte("a"))
+	s.NotNil(err)
 	s.cluster.StartStore(s.store1)
 	s.cluster.StartStore(s.store2)
 }
 
+func (s *testRegionCacheSuite) TestRegionMetaKeyDecoder() {
+	onEpochNotMatch := func(endKey string) error {
+		cachedRegion := s.getRegion([]byte("a"))
+		newMeta := proto.Clone(cachedRegion.meta).(*metapb.Region)
+		newMeta.RegionEpoch.Version++
+		newMeta.EndKey = []byte(endKey)
+		_, err := s.cache.OnRegionEpochNotMatch(s.bo, &RPCContext{Region: cachedRegion.VerID(), Store: s.cache.getStoreByStoreID(s.store1)}, []*metapb.Region{newMeta})
+		s.Equal([]byte(endKey), newMeta.EndKey)
+		return err
+	}
+
+	// The keys are used as they are by default if the PD client isn't a CodecPDClient.
+	s.Nil(onEpochNotMatch("p_m"))
+	s.Equal([]byte("p_m"), s.getRegion([]byte("a")).EndKey())
+
+	s.cache.SetRegionMetaKeyDecoder(func(r *metapb.Region) (*metapb.Region, error) {
+		if !bytes.HasPrefix(r.EndKey, []byte("p_")) {
+			return nil, errors.New("missing prefix")
+		}
+		nr := *r
+		nr.EndKey = r.EndKey[2:]
+		return &nr, nil
+	})
+	s.Nil(onEpochNotMatch("p_n"))
+	s.Equal([]byte("n"), s.getRegion([]byte("a")).EndKey())
+	s.NotNil(onEpochNotMatch("n"))
+
+	s.cache.SetRegionMetaKeyDecoder(nil)
+	s.Nil(onEpochNotMatch("o"))
+	s.Equal([]byte("o"), s.getRegion([]byte("a")).EndKey())
+}
+
+// scatterPDClient reports the scatter-region operator of a region running for the given number of polls, and then
+// reports the final response, or reports the operator is gone if there isn't one.
+type scatterPDClient struct {
+	pd.Client
+	mu      sync.Mutex
+	running map[uint64]int
+	final   map[uint64]*pdpb.GetOperatorResponse
+	polls   map[uint64]int
+}
+
+func (c *scatterPDClient) GetOperator(ctx context.Context, regionID uint64) (*pdpb.GetOperatorResponse, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.polls[regionID]++
+	if c.polls[regionID] <= c.running[regionID] {
+		return &pdpb.GetOperatorResponse{RegionId: regionID, Desc: []byte("scatter-region"), Status: pdpb.OperatorStatus_RUNNING}, nil
+	}
+	if resp, ok := c.final[regionID]; ok {
+		return resp, nil
+	}
+	return &pdpb.GetOperatorResponse{
+		Header: &pdpb.ResponseHeader{Error: &pdpb.Error{Type: pdpb.ErrorType_UNKNOWN, Message: "operator not found"}},
+	}, nil
+}
+
+func (s *testRegionCacheSuite) TestWaitScatterRegionFinish() {
+	pdClient := &scatterPDClient{
+		Client: mocktikv.NewPDClient(s.cluster),
+		running: map[uint64]int{
+			1: 3, 2: 2, 3: 1, 4: math.MaxInt32,
+			5: 2, 6: 2, 7: 2,
+		},
+		final: map[uint64]*pdpb.GetOperatorResponse{
+			1: {RegionId: 1, Desc: []byte("scatter-region"), Status: pdpb.OperatorStatus_SUCCESS},
+			2: {RegionId: 2, Desc: []byte("scatter-region"), Status: pdpb.OperatorStatus_TIMEOUT},
+		},
+		polls: make(map[uint64]int),
+	}
+	cache := NewRegionCache(pdClient)
+	defer cache.Close()
+	newBo := func(maxSleep int) *retry.Backoffer {
+		return retry.NewBackofferWithVars(context.Background(), maxSleep, nil)
+	}
+
+	// The operator finishes or is gone after a few polls.
+	for id, polls := range map[uint64]int{1: 4, 2: 3, 3: 2} {
+		s.Nil(cache.WaitScatterRegionFinish(newBo(5000), id, 0))
+		s.Equal(polls, pdClient.polls[id])
+	}
+
+	// The wait is limited by both backOff and the backoffer.
+	s.NotNil(cache.WaitScatterRegionFinish(newBo(5000), 4, 10))
+	s.NotNil(cache.WaitScatterRegionFinish(newBo(10), 4, 0))
+
+	s.Nil(cache.WaitScatterRegionsFinish(newBo(5000), []uint64{5, 6, 7}, 0))
+	for _, id := range []uint64{5, 6, 7} {
+		s.Equal(3, pdClient.polls[id])
+	}
+	s.NotNil(cache.WaitScatterRegionsFinish(newBo(5000), []uint64{1, 4}, 10))
+}
+
+// noLeaderPDClient reports no leader for the regions loaded by ID for the given times.
+type noLeaderPDClient struct {
+	pd.Client
+	noLeaderTimes int32
+	calls         int32
+}
+
+func (c *noLeaderPDClient) GetRegionByID(ctx context.Context, regionID uint64, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	r, err := c.Client.GetRegionByID(ctx, regionID, opts...)
+	if atomic.AddInt32(&c.calls, 1) <= atomic.LoadInt32(&c.noLeaderTimes) && r != nil {
+		r.Leader = nil
+	}
+	return r, err
+}
+
+func (s *testRegionCacheSuite) TestWaitForLeader() {
+	pdClient := &noLeaderPDClient{Client: mocktikv.NewPDClient(s.cluster), noLeaderTimes: 2}
+	cache := NewRegionCache(pdClient)
+	defer cache.Close()
+
+	// The leader is transferred to peer2, so it's not the first peer of the region anymore.
+	s.cluster.ChangeLeader(s.region1, s.peer2)
+	region, err := cache.WaitForLeader(s.bo, s.region1)
+	s.Nil(err)
+	s.Equal(int32(3), atomic.LoadInt32(&pdClient.calls))
+	s.Equal(s.store2, region.GetLeaderStoreID())
+	loc, err := cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.True(cache.GetCachedRegionWithRLock(loc.Region) == region)
+
+	// The leader reported by PD is used even if the cached region is invalidated due to no leader.
+	region.invalidate(NoLeader)
+	atomic.StoreInt32(&pdClient.calls, 0)
+	region, err = cache.WaitForLeader(s.bo, s.region1)
+	s.Nil(err)
+	s.Equal(int32(3), atomic.LoadInt32(&pdClient.calls))
+	s.Equal(s.store2, region.GetLeaderStoreID())
+
+	// It stops waiting when the context is done.
+	atomic.StoreInt32(&pdClient.noLeaderTimes, math.MaxInt32)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	_, err = cache.WaitForLeader(retry.NewBackofferWithVars(ctx, 60000, nil), s.region1)
+	s.NotNil(err)
+}
+
+func (s *testRegionCacheSuite) TestLeaderAddr() {
+	addr, storeID, err := s.cache.LeaderAddr(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Equal(s.storeAddr(s.store1), addr)
+	s.Equal(s.store1, storeID)
+
+	// The region is reloaded if it's out of date.
+	s.cluster.ChangeLeader(s.region1, s.peer2)
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.cache.GetCachedRegionWithRLock(loc.Region).invalidate(Other)
+	addr, storeID, err = s.cache.LeaderAddr(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Equal(s.storeAddr(s.store2), addr)
+	s.Equal(s.store2, storeID)
+}
+
+func (s *testRegionCacheSuite) TestUseAfterClose() {
+	cache := NewRegionCache(mocktikv.NewPDClient(s.cluster))
+	loc, err := cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	rpcCtx, err := cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	s.NotNil(rpcCtx)
+	cache.Close()
+	// Close is idempotent.
+	s.NotPanics(cache.Close)
+
+	checkClosed := func(err error) {
+		s.True(errors.Is(err, tikverr.ErrClientClosed), "%v", err)
+	}
+	_, err = cache.LocateKey(s.bo, []byte("a"))
+	checkClosed(err)
+	_, err = cache.LocateEndKey(s.bo, []byte("a"))
+	checkClosed(err)
+	_, _, err = cache.LeaderAddr(s.bo, []byte("a"))
+	checkClosed(err)
+	_, err = cache.LocateRegionByID(s.bo, s.region1)
+	checkClosed(err)
+	_, errs := cache.LocateRegionsByID(s.bo, []uint64{s.region1})
+	checkClosed(errs[s.region1])
+	_, err = cache.WaitForLeader(s.bo, s.region1)
+	checkClosed(err)
+	_, err = cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	checkClosed(err)
+	_, _, err = cache.GetTiKVReadIndexRPCContexts(s.bo, loc.Region, 0)
+	checkClosed(err)
+	_, err = cache.GetTiFlashRPCContext(s.bo, loc.Region, false)
+	checkClosed(err)
+	_, _, err = cache.GroupKeysByRegion(s.bo, [][]byte{[]byte("a")}, nil)
+	checkClosed(err)
+	_, err = cache.ListRegionIDsInKeyRange(s.bo, []byte("a"), []byte("z"))
+	checkClosed(err)
+	_, _, err = cache.ListRegionIDsInKeyRangeWithContinuation(s.bo, []byte("a"), []byte("z"))
+	checkClosed(err)
+	_, err = cache.LoadRegionsInKeyRange(s.bo, []byte("a"), []byte("z"))
+	checkClosed(err)
+	_, _, err = cache.LoadRegionsInKeyRangeWithContinuation(s.bo, []byte("a"), []byte("z"))
+	checkClosed(err)
+	_, err = cache.BatchLoadRegionsWithKeyRange(s.bo, []byte("a"), []byte("z"), 1)
+	checkClosed(err)
+	_, err = cache.BatchLoadRegionsFromKey(s.bo, []byte("a"), 1)
+	checkClosed(err)
+	_, err = cache.OnRegionEpochNotMatch(s.bo, rpcCtx, nil)
+	checkClosed(err)
+}
+
+func (s *testRegionCacheSuite) TestInsertRegionToCacheConcurrently() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			bo := retry.NewBackofferWithVars(ctx, 100, nil)
+			for ctx.Err() == nil {
+				_, err := s.cache.GetTiKVRPCContext(bo, loc.Region, kv.ReplicaReadLeader, 0)
+				s.Nil(err)
+			}
+		}()
+	}
+
+	for i := 0; i < 100; i++ {
+		region, err := s.cache.loadRegionByID(s.bo, s.region1)
+		s.Nil(err)
+		oldRegion := s.cache.GetCachedRegionWithRLock(loc.Region)
+		oldWorkIdx := oldRegion.getStore().workTiKVIdx
+		noLeader := i%2 == 0
+		if noLeader {
+			oldRegion.invalidate(NoLeader)
+		}
+		s.cache.mu.Lock()
+		s.cache.insertRegionToCache(region)
+		s.cache.mu.Unlock()
+		s.True(s.cache.GetCachedRegionWithRLock(loc.Region) == region)
+		s.False(oldRegion.isValid())
+		// The peer is rotated if the old region has no leader.
+		if noLeader {
+			s.Equal((oldWorkIdx+1)%2, region.getStore().workTiKVIdx)
+		} else {
+			s.Equal(AccessIndex(0), region.getStore().workTiKVIdx)
+		}
+	}
+	cancel()
+	wg.Wait()
+}
+
 func (s *testRegionCacheSuite) TestUpdateLeader() {
 	seed := rand.Uint32()
 	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
@@ -454,6 +1413,44 @@ func (s *testRegionCacheSuite) TestUpdateLeader2() {
 	s.NotEqual(follower, follower2)
 }
 
+func (s *testRegionCacheSuite) TestUpdateLeaderOrReload() {
+	seed := rand.Uint32()
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	// new store3 becomes leader
+	store3 := s.cluster.AllocID()
+	peer3 := s.cluster.AllocID()
+	s.cluster.AddStore(store3, s.storeAddr(store3))
+	s.cluster.AddPeer(s.region1, store3, peer3)
+	// tikv-server reports `NotLeader`
+	s.cache.UpdateLeaderOrReload(s.bo, loc.Region, &metapb.Peer{Id: peer3, StoreId: store3}, 0)
+
+	// Store3 does not exist in cache, so the region is reloaded from PD and switched to the new leader.
+	s.Nil(s.cache.GetCachedRegionWithRLock(loc.Region))
+	r := s.getRegion([]byte("a"))
+	s.NotNil(r)
+	s.Equal(r.GetID(), s.region1)
+	s.NotEqual(r.VerID(), loc.Region)
+	s.Equal(s.getAddr([]byte("a"), kv.ReplicaReadLeader, 0), s.storeAddr(store3))
+	follower := s.getAddr([]byte("a"), kv.ReplicaReadFollower, seed)
+	if seed%2 == 0 {
+		s.Equal(follower, s.storeAddr(s.store1))
+	} else {
+		s.Equal(follower, s.storeAddr(s.store2))
+	}
+	follower2 := s.getAddr([]byte("a"), kv.ReplicaReadFollower, seed+1)
+	if (seed+1)%2 == 0 {
+		s.Equal(follower2, s.storeAddr(s.store1))
+	} else {
+		s.Equal(follower2, s.storeAddr(s.store2))
+	}
+	s.NotEqual(follower, follower2)
+
+	// The region is invalidated if the leader isn't found in the reloaded region either.
+	s.cache.UpdateLeaderOrReload(s.bo, r.VerID(), &metapb.Peer{Id: s.cluster.AllocID(), StoreId: s.cluster.AllocID()}, 0)
+	s.False(r.isValid())
+}
+
 func (s *testRegionCacheSuite) TestUpdateLeader3() {
 	seed := rand.Uint32()
 	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
@@ -484,10 +1481,10 @@ func (s *testRegionCacheSuite) TestUpdateLeader3() {
 	s.Equal(ctx.Addr, "store2")
 	s.cache.OnSendFail(retry.NewNoopBackoff(context.Background()), ctx, false, errors.New("send fail"))
 	s.cache.checkAndResolve(nil, func(*Store) bool { return true })
+	// The region is recycled once store2 is tombstoned, so it's reloaded with the new leader.
+	s.Nil(s.cache.GetCachedRegionWithRLock(loc.Region))
 	s.cache.UpdateLeader(loc.Region, &metapb.Peer{Id: s.peer2, StoreId: s.store2}, 0)
 	addr := s.getAddr([]byte("a"), kv.ReplicaReadLeader, 0)
-	s.Equal(addr, "")
-	addr = s.getAddr([]byte("a"), kv.ReplicaReadLeader, 0)
 	s.Equal(addr, s.storeAddr(store3))
 
 	addr = s.getAddr([]byte("a"), kv.ReplicaReadFollower, seed)
@@ -496,6 +1493,108 @@ func (s *testRegionCacheSuite) TestUpdateLeader3() {
 	s.NotEqual(addr2, s.storeAddr(store3))
 }
 
+func (s *testRegionCacheSuite) TestSetStoreResolveState() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	region := s.cache.GetCachedRegionWithRLock(loc.Region)
+	s.NotNil(region)
+	store := s.cache.getStoreByStoreID(s.store1)
+	s.Equal(resolved, store.getResolveState())
+
+	// Stores not in the cache aren't added.
+	unknownStore := s.cluster.AllocID()
+	s.False(s.cache.SetStoreResolveState(unknownStore, uint64(needCheck)))
+	s.cache.storeMu.RLock()
+	_, ok := s.cache.storeMu.stores[unknownStore]
+	s.cache.storeMu.RUnlock()
+	s.False(ok)
+
+	// A needCheck store is resolved again.
+	s.True(s.cache.SetStoreResolveState(s.store1, uint64(needCheck)))
+	s.Equal(needCheck, store.getResolveState())
+	s.cache.checkAndResolve(nil, func(st *Store) bool { return st.getResolveState() == needCheck })
+	s.Equal(resolved, store.getResolveState())
+
+	// A tombstone store has no address.
+	s.True(s.cache.SetStoreResolveState(s.store1, uint64(tombstone)))
+	addr, err := s.cache.getStoreAddr(s.bo, region, store)
+	s.Nil(err)
+	s.Equal("", addr)
+
+	// A deleted store is replaced by the active one in the region.
+	s.True(s.cache.SetStoreResolveState(s.store1, uint64(deleted)))
+	newStore := &Store{storeID: s.store1, addr: "store1-new", storeType: tikvrpc.TiKV, state: uint64(resolved)}
+	s.cache.storeMu.Lock()
+	s.cache.storeMu.stores[s.store1] = newStore
+	s.cache.storeMu.Unlock()
+	addr, err = s.cache.getStoreAddr(s.bo, region, store)
+	s.Nil(err)
+	s.Equal("store1-new", addr)
+	s.Contains(region.getStore().stores, newStore)
+	s.NotContains(region.getStore().stores, store)
+}
+
+func (s *testRegionCacheSuite) TestRecycleRegionsOnInvalidStore() {
+	const regionCount = 100
+	regionID := s.region1
+	for i := 1; i < regionCount; i++ {
+		newRegionID := s.cluster.AllocID()
+		newPeers := s.cluster.AllocIDs(2)
+		s.cluster.Split(regionID, newRegionID, []byte(fmt.Sprintf("k%03d", i)), newPeers, newPeers[0])
+		regionID = newRegionID
+	}
+	regions := make([]*Region, 0, regionCount)
+	regions = append(regions, s.getRegion([]byte("a")))
+	for i := 1; i < regionCount; i++ {
+		regions = append(regions, s.getRegion([]byte(fmt.Sprintf("k%03d", i))))
+	}
+	s.checkCache(regionCount)
+	s.Len(s.cache.mu.storeRegions[s.store1], regionCount)
+	s.Len(s.cache.mu.storeRegions[s.store2], regionCount)
+
+	// The regions are switched to the new store when store2 is replaced, and they are still valid.
+	store2 := s.cache.getStoreByStoreID(s.store2)
+	s.cluster.UpdateStoreAddr(s.store2, s.storeAddr(s.store2)+"-new")
+	valid, err := store2.reResolve(s.cache)
+	s.Nil(err)
+	s.False(valid)
+	s.Equal(deleted, store2.getResolveState())
+	newStore2 := s.cache.getStoreByStoreID(s.store2)
+	s.False(newStore2 == store2)
+	for _, r := range regions {
+		s.True(r.isValid())
+		s.Contains(r.getStore().stores, newStore2)
+		s.NotContains(r.getStore().stores, store2)
+	}
+	s.checkCache(regionCount)
+
+	// The regions are invalidated and removed from the cache once store1 is tombstoned.
+	store1 := s.cache.getStoreByStoreID(s.store1)
+	s.cluster.MarkTombstone(s.store1)
+	valid, err = store1.reResolve(s.cache)
+	s.Nil(err)
+	s.False(valid)
+	s.Equal(tombstone, store1.getResolveState())
+	for _, r := range regions {
+		s.False(r.isValid())
+		s.Equal(StoreNotFound, InvalidReason(atomic.LoadInt32((*int32)(&r.invalidReason))))
+	}
+	s.cache.mu.RLock()
+	s.Empty(s.cache.mu.regions)
+	s.Empty(s.cache.mu.latestVersions)
+	s.Empty(s.cache.mu.storeRegions)
+	s.Equal(0, s.cache.mu.sorted.Len())
+	s.cache.mu.RUnlock()
+
+	// The regions are loaded again without the peers on the tombstone store.
+	s.cluster.ChangeLeader(s.region1, s.peer2)
+	r := s.getRegion([]byte("a"))
+	s.NotNil(r)
+	s.Equal(s.storeAddr(s.store2)+"-new", s.getAddr([]byte("a"), kv.ReplicaReadLeader, 0))
+	s.NotContains(s.cache.mu.storeRegions, s.store1)
+	s.Len(s.cache.mu.storeRegions[s.store2], 1)
+}
+
 func (s *testRegionCacheSuite) TestSendFailedButLeaderNotChange() {
 	// 3 nodes and no.1 is leader.
 	store3 := s.cluster.AllocID()
@@ -701,10 +1800,26 @@ func (s *testRegionCacheSuite) TestSendFailInvalidateRegionsInSameStore() {
 	s.checkCache(2)
 	s.cache.OnSendFail(s.bo, ctx, false, errors.New("test error"))
 
-	// Get region2 cache will get nil then reload.
+	// Get region2 cache will refresh the store epochs and switch to the other store without reloading.
 	ctx2, err := s.cache.GetTiKVRPCContext(s.bo, loc2.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	s.NotNil(ctx2)
+	s.Equal(s.store2, ctx2.Store.storeID)
+	s.True(s.cache.GetCachedRegionWithRLock(loc2.Region).isValid())
+
+	// Without refreshing the store epochs, get region2 cache will get nil then reload.
+	cache := NewRegionCache(s.cache.PDClient(), WithStoreEpochRefresh(false))
+	defer cache.Close()
+	loc1, err = cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	loc2, err = cache.LocateKey(s.bo, []byte("x"))
+	s.Nil(err)
+	ctx, _ = cache.GetTiKVRPCContext(s.bo, loc1.Region, kv.ReplicaReadLeader, 0)
+	cache.OnSendFail(s.bo, ctx, false, errors.New("test error"))
+	ctx2, err = cache.GetTiKVRPCContext(s.bo, loc2.Region, kv.ReplicaReadLeader, 0)
 	s.Nil(ctx2)
 	s.Nil(err)
+	s.False(cache.GetCachedRegionWithRLock(loc2.Region).isValid())
 }
 
 func (s *testRegionCacheSuite) TestSendFailedInMultipleNode() {
@@ -917,15 +2032,131 @@ func (s *testRegionCacheSuite) TestSplit() {
 	s.cache.InvalidateCachedRegion(r.VerID())
 	s.checkCache(0)
 
-	r = s.getRegion([]byte("x"))
-	s.Equal(r.GetID(), region2)
-	s.Equal(s.getAddr([]byte("x"), kv.ReplicaReadLeader, 0), s.storeAddr(s.store1))
-	s.Equal(s.getAddr([]byte("x"), kv.ReplicaReadFollower, seed), s.storeAddr(s.store2))
-	s.checkCache(1)
+	r = s.getRegion([]byte("x"))
+	s.Equal(r.GetID(), region2)
+	s.Equal(s.getAddr([]byte("x"), kv.ReplicaReadLeader, 0), s.storeAddr(s.store1))
+	s.Equal(s.getAddr([]byte("x"), kv.ReplicaReadFollower, seed), s.storeAddr(s.store2))
+	s.checkCache(1)
+
+	r = s.getRegionWithEndKey([]byte("m"))
+	s.Equal(r.GetID(), s.region1)
+	s.checkCache(2)
+}
+
+func (s *testRegionCacheSuite) TestDumpRegions() {
+	// split to ['' - 'b' - 'c' - 'd' - 'e' - '']
+	regionIDs := []uint64{s.region1}
+	for _, key := range []string{"b", "c", "d", "e"} {
+		regionID := s.cluster.AllocID()
+		newPeers := s.cluster.AllocIDs(2)
+		s.cluster.Split(regionIDs[len(regionIDs)-1], regionID, []byte(key), newPeers, newPeers[0])
+		regionIDs = append(regionIDs, regionID)
+	}
+	for _, key := range []string{"a", "b", "c", "d", "e"} {
+		s.getRegion([]byte(key))
+	}
+	s.checkCache(5)
+
+	dumpIDs := func(startKey, endKey []byte, limit int) []uint64 {
+		var ids []uint64
+		for _, r := range s.cache.DumpRegions(startKey, endKey, limit) {
+			ids = append(ids, r.GetID())
+		}
+		return ids
+	}
+	s.Equal(regionIDs, dumpIDs(nil, nil, 10))
+	s.Nil(dumpIDs(nil, nil, 0))
+	s.Equal(regionIDs[1:3], dumpIDs([]byte("b"), []byte("d"), 10))
+	s.Equal(regionIDs[2:], dumpIDs([]byte("bb"), nil, 10))
+
+	// Page through the cache.
+	var paged []uint64
+	var startKey []byte
+	for {
+		regions := s.cache.DumpRegions(startKey, nil, 2)
+		s.LessOrEqual(len(regions), 2)
+		for _, r := range regions {
+			paged = append(paged, r.GetID())
+		}
+		startKey = regions[len(regions)-1].EndKey()
+		if len(startKey) == 0 {
+			break
+		}
+	}
+	s.Equal(regionIDs, paged)
+}
+
+func readCounter(c prometheus.Counter) float64 {
+	pb := &dto.Metric{}
+	if err := c.Write(pb); err != nil {
+		return -1
+	}
+	return pb.GetCounter().GetValue()
+}
+
+func readGauge(g prometheus.Gauge) float64 {
+	pb := &dto.Metric{}
+	if err := g.Write(pb); err != nil {
+		return -1
+	}
+	return pb.GetGauge().GetValue()
+}
+
+func (s *testRegionCacheSuite) TestRegionCacheLookupMetrics() {
+	defer SetRegionCacheTTLSec(regionCacheTTLSec)
+	SetRegionCacheTTLSec(1)
+
+	// ['' - 'm' - '']
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("m"), newPeers, newPeers[0])
+
+	checkInc := func(c prometheus.Counter, f func()) {
+		before := readCounter(c)
+		f()
+		s.Equal(before+1, readCounter(c))
+	}
+	locateKey := func() {
+		_, err := s.cache.LocateKey(s.bo, []byte("a"))
+		s.Nil(err)
+	}
+	locateByID := func(id uint64) func() {
+		return func() {
+			_, err := s.cache.LocateRegionByID(s.bo, id)
+			s.Nil(err)
+		}
+	}
+	getCached := func(id uint64) *Region {
+		s.cache.mu.RLock()
+		defer s.cache.mu.RUnlock()
+		return s.cache.getRegionByIDFromCache(id)
+	}
+	// Make the cached region idle for longer than the TTL.
+	expire := func(id uint64) {
+		atomic.StoreInt64(&getCached(id).lastAccess, time.Now().Unix()-2)
+	}
+
+	checkInc(metrics.RegionCacheLookupLocateKeyMissLoad, locateKey)
+	checkInc(metrics.RegionCacheLookupLocateKeyHit, locateKey)
+	getCached(s.region1).scheduleReload()
+	checkInc(metrics.RegionCacheLookupLocateKeyHitStaleReload, locateKey)
+	expire(s.region1)
+	checkInc(metrics.RegionCacheLookupLocateKeyExpired, locateKey)
 
-	r = s.getRegionWithEndKey([]byte("m"))
-	s.Equal(r.GetID(), s.region1)
-	s.checkCache(2)
+	checkInc(metrics.RegionCacheLookupByIDMissLoad, locateByID(region2))
+	checkInc(metrics.RegionCacheLookupByIDHit, locateByID(region2))
+	expire(region2)
+	checkInc(metrics.RegionCacheLookupByIDExpired, locateByID(region2))
+
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	getRPCCtx := func() {
+		_, err := s.cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+		s.Nil(err)
+	}
+	checkInc(metrics.RegionCacheLookupRPCCtxHit, getRPCCtx)
+	expire(s.region1)
+	checkInc(metrics.RegionCacheLookupRPCCtxNil, getRPCCtx)
 }
 
 func (s *testRegionCacheSuite) TestMerge() {
@@ -1023,6 +2254,193 @@ func (s *testRegionCacheSuite) TestRegionEpochOnTiFlash() {
 	s.NotEqual(lctx.Peer.Id, s.peer1)
 }
 
+func (s *testRegionCacheSuite) TestTiFlashRPCContextWithLabels() {
+	// add store3 as tiflash, store1 and store3 are tiflash stores in different zones.
+	store3 := s.cluster.AllocID()
+	peer3 := s.cluster.AllocID()
+	s.cluster.UpdateStoreAddr(s.store1, s.storeAddr(s.store1), &metapb.StoreLabel{Key: "engine", Value: "tiflash"}, &metapb.StoreLabel{Key: "zone", Value: "z1"})
+	s.cluster.AddStore(store3, s.storeAddr(store3), &metapb.StoreLabel{Key: "engine", Value: "tiflash"}, &metapb.StoreLabel{Key: "zone", Value: "z2"})
+	s.cluster.AddPeer(s.region1, store3, peer3)
+
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+
+	for i := 0; i < 4; i++ {
+		ctx, err := s.cache.GetTiFlashRPCContext(s.bo, loc.Region, true, WithMatchLabels([]*metapb.StoreLabel{{Key: "zone", Value: "z1"}}))
+		s.Nil(err)
+		s.Equal(s.peer1, ctx.Peer.Id)
+		ctx, err = s.cache.GetTiFlashRPCContext(s.bo, loc.Region, true, WithMatchLabels([]*metapb.StoreLabel{{Key: "zone", Value: "z2"}}))
+		s.Nil(err)
+		s.Equal(peer3, ctx.Peer.Id)
+	}
+	ctx, err := s.cache.GetTiFlashRPCContext(s.bo, loc.Region, true)
+	s.Nil(err)
+	s.Equal([]uint64{ctx.Store.storeID, s.store1 + store3 - ctx.Store.storeID}, s.cache.GetAllValidTiFlashStores(loc.Region, ctx.Store))
+	s.Equal([]uint64{ctx.Store.storeID}, s.cache.GetAllValidTiFlashStores(loc.Region, ctx.Store, WithMatchLabels([]*metapb.StoreLabel{{Key: "zone", Value: "z3"}})))
+
+	// No store matches the labels, the region is still valid.
+	ctx, err = s.cache.GetTiFlashRPCContext(s.bo, loc.Region, true, WithMatchLabels([]*metapb.StoreLabel{{Key: "zone", Value: "z3"}}))
+	s.Nil(err)
+	s.Nil(ctx)
+	s.True(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+}
+
+func (s *testRegionCacheSuite) TestCurrentTiFlashStore() {
+	// add store3 as tiflash, store1 and store3 are tiflash stores.
+	store3 := s.cluster.AllocID()
+	peer3 := s.cluster.AllocID()
+	s.cluster.UpdateStoreAddr(s.store1, s.storeAddr(s.store1), &metapb.StoreLabel{Key: "engine", Value: "tiflash"})
+	s.cluster.AddStore(store3, s.storeAddr(store3), &metapb.StoreLabel{Key: "engine", Value: "tiflash"})
+	s.cluster.AddPeer(s.region1, store3, peer3)
+
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	_, ok := s.cache.CurrentTiFlashStore(RegionVerID{})
+	s.False(ok)
+
+	// The load balance rotates the TiFlash stores.
+	seen := make(map[uint64]bool)
+	for i := 0; i < 4; i++ {
+		ctx, err := s.cache.GetTiFlashRPCContext(s.bo, loc.Region, true)
+		s.Nil(err)
+		current, ok := s.cache.CurrentTiFlashStore(loc.Region)
+		s.True(ok)
+		s.Equal(ctx.Store.storeID, current)
+		seen[current] = true
+	}
+	s.Len(seen, 2)
+}
+
+func (s *testRegionCacheSuite) TestTiFlashFallback() {
+	// The caller is told to fall back if the region has no TiFlash peer, and the region is still valid.
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	ctx, err := s.cache.GetTiFlashRPCContext(s.bo, loc.Region, false, WithTiFlashFallback())
+	s.Nil(ctx)
+	s.True(tikverr.IsErrNoAvailableTiFlash(err))
+	s.True(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+
+	store3 := s.cluster.AllocID()
+	peer3 := s.cluster.AllocID()
+	s.cluster.AddStore(store3, s.storeAddr(store3), &metapb.StoreLabel{Key: "engine", Value: "tiflash"})
+	s.cluster.AddPeer(s.region1, store3, peer3)
+	s.cache.InvalidateCachedRegion(loc.Region)
+
+	loc, err = s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	ctx, err = s.cache.GetTiFlashRPCContext(s.bo, loc.Region, false, WithTiFlashFallback())
+	s.Nil(err)
+	s.Equal(peer3, ctx.Peer.Id)
+	s.cache.ReleaseRPCContext(ctx, RPCOutcomeOK)
+
+	// The TiFlash store fails, the caller is told to fall back to TiKV.
+	atomic.AddUint32(&s.cache.getStoreByStoreID(store3).epoch, 1)
+	ctx, err = s.cache.GetTiFlashRPCContext(s.bo, loc.Region, false, WithTiFlashFallback())
+	s.Nil(ctx)
+	s.True(tikverr.IsErrNoAvailableTiFlash(err))
+	s.Equal(tikverr.RetryableStmt, tikverr.Classify(err))
+	s.False(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+
+	// It returns nil without the option.
+	loc, err = s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	atomic.AddUint32(&s.cache.getStoreByStoreID(store3).epoch, 1)
+	ctx, err = s.cache.GetTiFlashRPCContext(s.bo, loc.Region, false)
+	s.Nil(err)
+	s.Nil(ctx)
+
+	// The caller is told to fall back if no TiFlash store matches the labels, and the region is still valid.
+	loc, err = s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	labels := []*metapb.StoreLabel{{Key: "zone", Value: "z1"}}
+	ctx, err = s.cache.GetTiFlashRPCContext(s.bo, loc.Region, false, WithMatchLabels(labels), WithTiFlashFallback())
+	s.Nil(ctx)
+	s.True(tikverr.IsErrNoAvailableTiFlash(err))
+	s.True(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+}
+
+func (s *testRegionCacheSuite) TestCheckTiFlashCoverage() {
+	// Split the region at "m", and add a TiFlash peer to the region [, m) only.
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("m"), newPeers, newPeers[0])
+	store3 := s.cluster.AllocID()
+	peer3 := s.cluster.AllocID()
+	s.cluster.AddStore(store3, s.storeAddr(store3), &metapb.StoreLabel{Key: "engine", Value: "tiflash"})
+	s.cluster.AddPeer(s.region1, store3, peer3)
+
+	covered, missing, err := s.cache.CheckTiFlashCoverage(s.bo, []byte("a"), []byte("m"))
+	s.Nil(err)
+	s.True(covered)
+	s.Empty(missing)
+
+	covered, missing, err = s.cache.CheckTiFlashCoverage(s.bo, []byte("a"), nil)
+	s.Nil(err)
+	s.False(covered)
+	s.Len(missing, 1)
+	s.Equal(region2, missing[0].GetID())
+
+	// The TiFlash peer isn't valid if its store fails.
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	atomic.AddUint32(&s.cache.getStoreByStoreID(store3).epoch, 1)
+	covered, missing, err = s.cache.CheckTiFlashCoverage(s.bo, nil, []byte("m"))
+	s.Nil(err)
+	s.False(covered)
+	s.Equal([]RegionVerID{loc.Region}, missing)
+}
+
+func (s *testRegionCacheSuite) TestStoreEpochRefreshOnFlappingStore() {
+	flap := func(opts ...RegionCacheOption) int32 {
+		var loads int32
+		pdClient := &hookedPDClient{
+			Client:          &CodecPDClient{mocktikv.NewPDClient(s.cluster)},
+			onGetRegion:     func() { atomic.AddInt32(&loads, 1) },
+			onGetRegionByID: func() { atomic.AddInt32(&loads, 1) },
+		}
+		cache := NewRegionCache(pdClient, opts...)
+		defer cache.Close()
+		loc, err := cache.LocateKey(s.bo, []byte("a"))
+		s.Nil(err)
+		atomic.StoreInt32(&loads, 0)
+		// The store just accessed fails every time, which is noticed by the requests to other regions on it.
+		for i := 0; i < 20; i++ {
+			rpcCtx, err := cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+			s.Nil(err)
+			if rpcCtx == nil {
+				loc, err = cache.LocateKey(s.bo, []byte("a"))
+				s.Nil(err)
+				rpcCtx, err = cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+				s.Nil(err)
+				s.NotNil(rpcCtx)
+			}
+			atomic.AddUint32(&rpcCtx.Store.epoch, 1)
+			cache.ReleaseRPCContext(rpcCtx, RPCOutcomeOK)
+		}
+		return atomic.LoadInt32(&loads)
+	}
+
+	// The region is reloaded from PD every time the store fails if the store epochs aren't refreshed.
+	s.Equal(int32(19), flap(WithStoreEpochRefresh(false)))
+	refreshed := readCounter(metrics.RegionCacheCounterWithEpochMismatchRefresh)
+	s.Zero(flap())
+	s.Equal(float64(19), readCounter(metrics.RegionCacheCounterWithEpochMismatchRefresh)-refreshed)
+
+	// The region is invalidated if no healthy peer remains.
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	region := s.cache.GetCachedRegionWithRLock(loc.Region)
+	invalidated := readCounter(metrics.RegionCacheCounterWithEpochMismatchInvalidate)
+	for _, store := range region.getStore().stores {
+		atomic.AddUint32(&store.epoch, 1)
+	}
+	rpcCtx, err := s.cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	s.Nil(rpcCtx)
+	s.False(region.isValid())
+	s.Equal(float64(1), readCounter(metrics.RegionCacheCounterWithEpochMismatchInvalidate)-invalidated)
+}
+
 const regionSplitKeyFormat = "t%08d"
 
 func createClusterWithStoresAndRegions(regionCnt, storeCount int) *mocktikv.Cluster {
@@ -1066,6 +2484,268 @@ func (s *testRegionCacheSuite) TestListRegionIDsInCache() {
 	s.Equal(regionIDs, []uint64{s.region1, region2})
 }
 
+// hookedPDClient calls the hooks after getting regions from PD.
+type hookedPDClient struct {
+	pd.Client
+	onGetRegion     func()
+	onGetRegionByID func()
+	onScanRegions   func()
+	onGetStore      func(storeID uint64)
+	// redirect makes GetRegion return the region of another key.
+	redirect map[string][]byte
+}
+
+func (c *hookedPDClient) GetRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	if k, ok := c.redirect[string(key)]; ok {
+		key = k
+	}
+	r, err := c.Client.GetRegion(ctx, key, opts...)
+	if c.onGetRegion != nil {
+		c.onGetRegion()
+	}
+	return r, err
+}
+
+func (c *hookedPDClient) GetRegionByID(ctx context.Context, regionID uint64, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	r, err := c.Client.GetRegionByID(ctx, regionID, opts...)
+	if c.onGetRegionByID != nil {
+		c.onGetRegionByID()
+	}
+	return r, err
+}
+
+func (c *hookedPDClient) ScanRegions(ctx context.Context, startKey, endKey []byte, limit int) ([]*pd.Region, error) {
+	rs, err := c.Client.ScanRegions(ctx, startKey, endKey, limit)
+	if c.onScanRegions != nil {
+		c.onScanRegions()
+	}
+	return rs, err
+}
+
+func (c *hookedPDClient) GetStore(ctx context.Context, storeID uint64) (*metapb.Store, error) {
+	if c.onGetStore != nil {
+		c.onGetStore(storeID)
+	}
+	return c.Client.GetStore(ctx, storeID)
+}
+
+func (s *testRegionCacheSuite) TestLocateRegionsByID() {
+	// split to ['' - 'b' - 'c' - 'd' - '']
+	regionIDs := []uint64{s.region1}
+	for _, key := range []string{"b", "c", "d"} {
+		regionID := s.cluster.AllocID()
+		newPeers := s.cluster.AllocIDs(2)
+		s.cluster.Split(regionIDs[len(regionIDs)-1], regionID, []byte(key), newPeers, newPeers[0])
+		regionIDs = append(regionIDs, regionID)
+	}
+
+	var calls int64
+	cache := NewRegionCache(&hookedPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}, onGetRegionByID: func() {
+		atomic.AddInt64(&calls, 1)
+	}})
+	defer cache.Close()
+	_, err := cache.LocateRegionByID(s.bo, regionIDs[1])
+	s.Nil(err)
+	s.Equal(int64(1), atomic.LoadInt64(&calls))
+
+	notExist := s.cluster.AllocID()
+	locs, errs := cache.LocateRegionsByID(s.bo, append([]uint64{notExist, regionIDs[0]}, regionIDs...))
+	// The cached region and the duplicated ID are not loaded again.
+	s.Equal(int64(1+len(regionIDs)), atomic.LoadInt64(&calls))
+	s.Len(locs, len(regionIDs))
+	boundaries := []string{"", "b", "c", "d", ""}
+	for i, id := range regionIDs {
+		s.Equal(id, locs[id].Region.GetID())
+		s.Equal([]byte(boundaries[i]), locs[id].StartKey)
+		s.Equal([]byte(boundaries[i+1]), locs[id].EndKey)
+	}
+	s.Len(errs, 1)
+	s.NotNil(errs[notExist])
+}
+
+func (s *testRegionCacheSuite) TestListRegionIDsWithContinuation() {
+	// split to ['' - 'b' - 'c' - 'd' - 'e' - '']
+	regionIDs := []uint64{s.region1}
+	for _, key := range []string{"b", "c", "d", "e"} {
+		regionID := s.cluster.AllocID()
+		newPeers := s.cluster.AllocIDs(2)
+		s.cluster.Split(regionIDs[len(regionIDs)-1], regionID, []byte(key), newPeers, newPeers[0])
+		regionIDs = append(regionIDs, regionID)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	calls := 0
+	pdCli := &hookedPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}, onGetRegion: func() {
+		calls++
+		if calls == 2 {
+			cancel()
+		}
+	}}
+	cache := NewRegionCache(pdCli)
+	defer cache.Close()
+
+	// The context is canceled after loading 2 regions.
+	ids, nextKey, err := cache.ListRegionIDsInKeyRangeWithContinuation(retry.NewBackofferWithVars(ctx, 5000, nil), []byte("a"), nil)
+	s.ErrorIs(err, context.Canceled)
+	s.Equal(regionIDs[:2], ids)
+	s.Equal([]byte("c"), nextKey)
+	_, err = cache.ListRegionIDsInKeyRange(retry.NewBackofferWithVars(ctx, 5000, nil), []byte("a"), nil)
+	s.NotNil(err)
+
+	// Resume from nextKey.
+	ids, nextKey, err = cache.ListRegionIDsInKeyRangeWithContinuation(s.bo, nextKey, nil)
+	s.Nil(err)
+	s.Equal(regionIDs[2:], ids)
+	s.Nil(nextKey)
+}
+
+func (s *testRegionCacheSuite) TestListRegionIDsNotAdvancing() {
+	// ['' - 'b' - '']
+	region2 := s.cluster.AllocID()
+	newPeers := s.cluster.AllocIDs(2)
+	s.cluster.Split(s.region1, region2, []byte("b"), newPeers, newPeers[0])
+
+	// PD returns ['' - 'b') for "c", which would make the listing loop forever.
+	pdCli := &hookedPDClient{
+		Client:   &CodecPDClient{mocktikv.NewPDClient(s.cluster)},
+		redirect: map[string][]byte{"c": []byte("a")},
+	}
+	cache := NewRegionCache(pdCli)
+	defer cache.Close()
+
+	ids, nextKey, err := cache.ListRegionIDsInKeyRangeWithContinuation(s.bo, []byte("c"), []byte("z"))
+	s.NotNil(err)
+	s.Empty(ids)
+	s.Equal([]byte("c"), nextKey)
+}
+
+func (s *testRegionCacheSuite) TestKeyLocationRanges() {
+	// The first, a middle, the last region and a single region of the keyspace.
+	first := &KeyLocation{StartKey: []byte(""), EndKey: []byte("b")}
+	middle := &KeyLocation{StartKey: []byte("b"), EndKey: []byte("d")}
+	last := &KeyLocation{StartKey: []byte("d"), EndKey: []byte("")}
+	whole := &KeyLocation{StartKey: []byte(""), EndKey: []byte("")}
+
+	compareCases := []struct {
+		loc  *KeyLocation
+		key  string
+		want int
+	}{
+		{first, "", 0}, {first, "a", 0}, {first, "b", 1}, {first, "c", 1},
+		{middle, "", -1}, {middle, "a", -1}, {middle, "b", 0}, {middle, "c", 0}, {middle, "d", 1}, {middle, "e", 1},
+		{last, "", -1}, {last, "c", -1}, {last, "d", 0}, {last, "e", 0},
+		{whole, "", 0}, {whole, "z", 0},
+	}
+	for _, c := range compareCases {
+		s.Equal(c.want, c.loc.Compare([]byte(c.key)), "%s %q", c.loc, c.key)
+	}
+
+	clampCases := []struct {
+		loc        *KeyLocation
+		start, end string
+		cs, ce     string
+		ok         bool
+		covers     bool
+	}{
+		// Unbounded ranges.
+		{first, "", "", "", "b", true, false},
+		{middle, "", "", "b", "d", true, false},
+		{last, "", "", "d", "", true, false},
+		{whole, "", "", "", "", true, true},
+		// Ranges ending at the boundaries.
+		{first, "", "b", "", "b", true, true},
+		{first, "a", "b", "a", "b", true, true},
+		{middle, "a", "b", "", "", false, false},
+		{middle, "b", "d", "b", "d", true, true},
+		{middle, "a", "c", "b", "c", true, false},
+		{middle, "c", "e", "c", "d", true, false},
+		{middle, "c", "", "c", "d", true, false},
+		{middle, "d", "e", "", "", false, false},
+		{middle, "d", "", "", "", false, false},
+		{last, "a", "d", "", "", false, false},
+		{last, "a", "e", "d", "e", true, false},
+		{last, "d", "", "d", "", true, true},
+		{last, "e", "", "e", "", true, true},
+		{last, "d", "e", "d", "e", true, true},
+		// Ranges inside a region.
+		{first, "", "a", "", "a", true, true},
+		{middle, "b", "c", "b", "c", true, true},
+		{whole, "a", "c", "a", "c", true, true},
+		{whole, "a", "", "a", "", true, true},
+	}
+	for _, c := range clampCases {
+		cs, ce, ok := c.loc.ClampRange([]byte(c.start), []byte(c.end))
+		s.Equal(c.ok, ok, "%s [%q, %q)", c.loc, c.start, c.end)
+		if ok {
+			s.Equal(c.cs, string(cs), "%s [%q, %q)", c.loc, c.start, c.end)
+			s.Equal(c.ce, string(ce), "%s [%q, %q)", c.loc, c.start, c.end)
+		}
+		s.Equal(c.covers, c.loc.CoversRange([]byte(c.start), []byte(c.end)), "%s [%q, %q)", c.loc, c.start, c.end)
+	}
+
+	// Check all permutations of the boundaries against the keys in between. Every non-empty intersection contains
+	// one of the boundaries, so the points are enough to tell the ranges apart.
+	bounds := []string{"", "a", "b", "c", "d", "e"}
+	points := []string{"", "0", "a", "a0", "b", "b0", "c", "c0", "d", "d0", "e", "e0"}
+	inRange := func(key, start, end string) bool {
+		return key >= start && (end == "" || key < end)
+	}
+	for _, loc := range []*KeyLocation{first, middle, last, whole} {
+		regionStart, regionEnd := string(loc.StartKey), string(loc.EndKey)
+		for _, p := range points {
+			s.Equal(inRange(p, regionStart, regionEnd), loc.Compare([]byte(p)) == 0, "%s %q", loc, p)
+		}
+		for _, start := range bounds {
+			for _, end := range bounds {
+				if end != "" && start >= end {
+					continue
+				}
+				cs, ce, ok := loc.ClampRange([]byte(start), []byte(end))
+				intersects, covers := false, true
+				for _, p := range points {
+					inBoth := inRange(p, start, end) && inRange(p, regionStart, regionEnd)
+					intersects = intersects || inBoth
+					if inRange(p, start, end) && !inRange(p, regionStart, regionEnd) {
+						covers = false
+					}
+					if ok {
+						s.Equal(inBoth, inRange(p, string(cs), string(ce)), "%s [%q, %q) %q", loc, start, end, p)
+					}
+				}
+				s.Equal(intersects, ok, "%s [%q, %q)", loc, start, end)
+				s.Equal(covers, loc.CoversRange([]byte(start), []byte(end)), "%s [%q, %q)", loc, start, end)
+			}
+		}
+	}
+}
+
+func (s *testRegionCacheSuite) TestLoadRegionsWithContinuation() {
+	regionCnt := 200
+	cluster := createClusterWithStoresAndRegions(regionCnt, 3)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	pdCli := &hookedPDClient{Client: mocktikv.NewPDClient(cluster), onScanRegions: cancel}
+	cache := NewRegionCache(pdCli)
+	defer cache.Close()
+
+	// The context is canceled after loading the first batch.
+	regions, nextKey, err := cache.LoadRegionsInKeyRangeWithContinuation(retry.NewBackofferWithVars(ctx, 5000, nil), nil, nil)
+	s.ErrorIs(err, context.Canceled)
+	s.Len(regions, defaultRegionsPerBatch)
+	s.Equal(regions[len(regions)-1].EndKey(), nextKey)
+
+	// Resume from nextKey.
+	pdCli.onScanRegions = nil
+	rest, nextKey, err := cache.LoadRegionsInKeyRangeWithContinuation(s.bo, nextKey, nil)
+	s.Nil(err)
+	s.Nil(nextKey)
+	s.Len(rest, regionCnt+1-defaultRegionsPerBatch)
+	s.Equal(regions[len(regions)-1].EndKey(), rest[0].StartKey())
+	s.Empty(rest[len(rest)-1].EndKey())
+}
+
 func (s *testRegionCacheSuite) TestScanRegions() {
 	// Split at "a", "b", "c", "d"
 	regions := s.cluster.AllocIDs(4)
@@ -1238,6 +2918,95 @@ func (s *testRegionCacheSuite) TestMixedReadFallback() {
 	s.Equal(ctx.Peer.Id, s.peer2)
 }
 
+func (s *testRegionCacheSuite) TestMixedReadPreference() {
+	// 3 nodes and no.1 is leader, no.3 is the local store.
+	store3 := s.cluster.AllocID()
+	peer3 := s.cluster.AllocID()
+	s.cluster.AddStore(store3, s.storeAddr(store3))
+	s.cluster.AddPeer(s.region1, store3, peer3)
+	s.cluster.ChangeLeader(s.region1, s.peer1)
+	localLabels := []*metapb.StoreLabel{{Key: "zone", Value: "dc-1"}}
+	s.cluster.UpdateStoreLabels(store3, localLabels)
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+
+	mixedReadPeers := func(seeds int, opts ...StoreSelectorOption) []uint64 {
+		var peers []uint64
+		for seed := 0; seed < seeds; seed++ {
+			ctx, err := s.cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadMixed, uint32(seed), opts...)
+			s.Nil(err)
+			peers = append(peers, ctx.Peer.Id)
+		}
+		return peers
+	}
+
+	// The preferred replica takes weight slots of the seeds.
+	s.Equal([]uint64{s.peer1, s.peer1, s.peer1, s.peer2, peer3},
+		mixedReadPeers(5, WithMixedReadPreference(MixedReadPreferLeader, 3, nil)))
+	s.Equal([]uint64{s.peer1, s.peer2, peer3, peer3},
+		mixedReadPeers(4, WithMixedReadPreference(MixedReadPreferLocal, 2, localLabels)))
+	// It's uniform without a weight.
+	s.Equal([]uint64{s.peer1, s.peer2, peer3},
+		mixedReadPeers(3, WithMixedReadPreference(MixedReadPreferLocal, 1, localLabels)))
+	// Only the candidates are weighted.
+	s.Equal([]uint64{peer3, peer3},
+		mixedReadPeers(2, WithMatchLabels(localLabels), WithMixedReadPreference(MixedReadPreferLeader, 3, nil)))
+	// It falls back to the leader if there is no candidate.
+	dc2Labels := []*metapb.StoreLabel{{Key: "zone", Value: "dc-2"}}
+	s.Equal([]uint64{s.peer1, s.peer1},
+		mixedReadPeers(2, WithMatchLabels(dc2Labels), WithMixedReadPreference(MixedReadPreferLocal, 3, localLabels)))
+}
+
+func (s *testRegionCacheSuite) TestSkipFollowersOfUnknownLag() {
+	// 3 nodes and no.1 is leader, only the lag of store3 is known.
+	store3 := s.cluster.AllocID()
+	peer3 := s.cluster.AllocID()
+	s.cluster.AddStore(store3, s.storeAddr(store3))
+	s.cluster.AddPeer(s.region1, store3, peer3)
+	s.cluster.ChangeLeader(s.region1, s.peer1)
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+
+	knownStores := map[uint64]bool{store3: true}
+	lagKnown := func(storeID uint64) bool { return knownStores[storeID] }
+	peers := func(replicaRead kv.ReplicaReadType, opts ...StoreSelectorOption) []uint64 {
+		var peers []uint64
+		for seed := 0; seed < 3; seed++ {
+			ctx, err := s.cache.GetTiKVRPCContext(s.bo, loc.Region, replicaRead, uint32(seed), opts...)
+			s.Nil(err)
+			peers = append(peers, ctx.Peer.Id)
+		}
+		return peers
+	}
+
+	// Any follower is selected by default.
+	s.Equal([]uint64{s.peer2, peer3, s.peer2}, peers(kv.ReplicaReadFollower))
+	s.Equal([]uint64{s.peer1, s.peer2, peer3}, peers(kv.ReplicaReadMixed))
+	// The follower of unknown lag is skipped, and the leader is always a candidate.
+	s.Equal([]uint64{peer3, peer3, peer3}, peers(kv.ReplicaReadFollower, WithSkipFollowersOfUnknownLag(lagKnown)))
+	s.Equal([]uint64{s.peer1, peer3, s.peer1}, peers(kv.ReplicaReadMixed, WithSkipFollowersOfUnknownLag(lagKnown)))
+
+	// The replica selector skips them as well.
+	seed := uint32(0)
+	req := tikvrpc.NewReplicaReadRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{}, kv.ReplicaReadFollower, &seed)
+	for i := 0; i < 3; i++ {
+		selector, err := newReplicaSelector(s.cache, loc.Region, req, WithSkipFollowersOfUnknownLag(lagKnown))
+		s.Nil(err)
+		ctx, err := selector.next(s.bo)
+		s.Nil(err)
+		s.Equal(peer3, ctx.Peer.Id)
+	}
+
+	// Fall back to the leader if the lag of no follower is known.
+	delete(knownStores, store3)
+	s.Equal([]uint64{s.peer1, s.peer1, s.peer1}, peers(kv.ReplicaReadFollower, WithSkipFollowersOfUnknownLag(lagKnown)))
+	selector, err := newReplicaSelector(s.cache, loc.Region, req, WithSkipFollowersOfUnknownLag(lagKnown))
+	s.Nil(err)
+	ctx, err := selector.next(s.bo)
+	s.Nil(err)
+	s.Equal(s.peer1, ctx.Peer.Id)
+}
+
 func (s *testRegionCacheSuite) TestPeersLenChange() {
 	// 2 peers [peer1, peer2] and let peer2 become leader
 	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
@@ -1504,4 +3273,250 @@ func (s *testRegionCacheSuite) TestBuckets() {
 	s.cluster.SplitRegionBuckets(newBuckets.RegionId, newBuckets.Keys, newBuckets.Version)
 	s.cache.UpdateBucketsIfNeeded(cachedRegion.VerID(), newBuckets.GetVersion())
 	waitUpdateBuckets(newBuckets, []byte("a"))
+	s.Equal(newBuckets.GetVersion(), s.cache.RegionBucketVersion(s.getRegion([]byte("a")).VerID()))
+
+	// The version is 0 if the region isn't cached.
+	s.Zero(s.cache.RegionBucketVersion(NewRegionVerID(s.cluster.AllocID(), 1, 1)))
+}
+
+// regionOptsPDClient records the number of options passed to get regions from PD.
+type regionOptsPDClient struct {
+	pd.Client
+	opts int32
+}
+
+func (c *regionOptsPDClient) GetRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	atomic.AddInt32(&c.opts, int32(len(opts)))
+	return c.Client.GetRegion(ctx, key, opts...)
+}
+
+func (c *regionOptsPDClient) GetPrevRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	atomic.AddInt32(&c.opts, int32(len(opts)))
+	return c.Client.GetPrevRegion(ctx, key, opts...)
+}
+
+func (c *regionOptsPDClient) GetRegionByID(ctx context.Context, regionID uint64, opts ...pd.GetRegionOption) (*pd.Region, error) {
+	atomic.AddInt32(&c.opts, int32(len(opts)))
+	return c.Client.GetRegionByID(ctx, regionID, opts...)
+}
+
+func (s *testRegionCacheSuite) TestDeleteStoreMetricsOnTombstone() {
+	s.getRegion([]byte("a"))
+	label := strconv.FormatUint(s.store1, 10)
+	metrics.TiKVInflightRequests.WithLabelValues(label).Set(1)
+	metrics.TiKVBatchClientDowngraded.WithLabelValues(label).Set(1)
+
+	store1 := s.cache.getStoreByStoreID(s.store1)
+	s.cluster.MarkTombstone(s.store1)
+	valid, err := store1.reResolve(s.cache)
+	s.Nil(err)
+	s.False(valid)
+	// The series are already deleted.
+	s.False(metrics.TiKVInflightRequests.DeleteLabelValues(label))
+	s.False(metrics.TiKVBatchClientDowngraded.DeleteLabelValues(label))
+}
+
+func (s *testRegionCacheSuite) TestReplacePDClient() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+
+	var wg sync.WaitGroup
+	done := make(chan struct{})
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			s.cache.InvalidateCachedRegion(loc.Region)
+			_, err := s.cache.LocateKey(retry.NewBackofferWithVars(context.Background(), 5000, nil), []byte("a"))
+			s.Nil(err)
+		}
+	}()
+
+	var calls int32
+	pdCli := &hookedPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}, onGetRegion: func() {
+		atomic.AddInt32(&calls, 1)
+	}}
+	for i := 0; i < 10; i++ {
+		s.cache.ReplacePDClient(pdCli, false)
+		time.Sleep(time.Millisecond)
+	}
+	close(done)
+	wg.Wait()
+	s.True(s.cache.PDClient() == pdCli)
+
+	// Cached regions are reloaded from the new pd client after being invalidated.
+	_, err = s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.cache.ReplacePDClient(pdCli, true)
+	s.checkCache(0)
+	before := atomic.LoadInt32(&calls)
+	_, err = s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Equal(before+1, atomic.LoadInt32(&calls))
+}
+
+func (s *testRegionCacheSuite) TestDisableBucketFeature() {
+	defer config.UpdateGlobal(func(conf *config.Config) {
+		conf.DisableBucketFeature = true
+	})()
+	pdCli := &regionOptsPDClient{Client: &CodecPDClient{mocktikv.NewPDClient(s.cluster)}}
+	cache := NewRegionCache(pdCli)
+	defer cache.Close()
+
+	r, _ := s.cluster.GetRegion(s.region1)
+	bucketKeys := [][]byte{r.GetStartKey(), []byte("a"), []byte("b"), r.GetEndKey()}
+	for i, k := range bucketKeys {
+		if k == nil {
+			bucketKeys[i] = []byte{}
+		}
+	}
+	s.cluster.SplitRegionBuckets(s.region1, bucketKeys, 1)
+
+	// No bucket option is passed to PD and no buckets are cached.
+	loc, err := cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Nil(loc.Buckets)
+	s.Zero(loc.GetBucketVersion())
+	s.Nil(loc.LocateBucket([]byte("a")))
+	loc, err = cache.LocateEndKey(s.bo, []byte("b"))
+	s.Nil(err)
+	s.Nil(loc.Buckets)
+	loc, err = cache.LocateRegionByID(s.bo, s.region1)
+	s.Nil(err)
+	s.Nil(loc.Buckets)
+	s.Zero(atomic.LoadInt32(&pdCli.opts))
+
+	// insertRegionToCache doesn't keep buckets of the old region.
+	cachedRegion := cache.GetCachedRegionWithRLock(loc.Region)
+	s.NotNil(cachedRegion)
+	cachedRegion.getStore().buckets = &metapb.Buckets{Version: 1, Keys: bucketKeys}
+	fakeRegion := &Region{
+		meta:          cachedRegion.meta,
+		syncFlag:      cachedRegion.syncFlag,
+		lastAccess:    cachedRegion.lastAccess,
+		invalidReason: cachedRegion.invalidReason,
+	}
+	fakeRegion.setStore(cachedRegion.getStore().clone())
+	fakeRegion.getStore().buckets = nil
+	cache.insertRegionToCache(fakeRegion)
+	cachedRegion = cache.GetCachedRegionWithRLock(loc.Region)
+	s.Nil(cachedRegion.getStore().buckets)
+
+	// New regions don't inherit buckets on epoch not match.
+	cachedRegion.getStore().buckets = &metapb.Buckets{Version: 1, Keys: bucketKeys}
+	newMeta := proto.Clone(cachedRegion.meta).(*metapb.Region)
+	newMeta.RegionEpoch.Version++
+	newMeta.RegionEpoch.ConfVer++
+	_, err = cache.OnRegionEpochNotMatch(s.bo, &RPCContext{Region: cachedRegion.VerID(), Store: cache.getStoreByStoreID(s.store1)}, []*metapb.Region{newMeta})
+	s.Nil(err)
+	loc, err = cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Nil(loc.Buckets)
+
+	// UpdateBucketsIfNeeded doesn't reload the region.
+	cache.UpdateBucketsIfNeeded(loc.Region, 100)
+	time.Sleep(100 * time.Millisecond)
+	s.Zero(atomic.LoadInt32(&pdCli.opts))
+	s.Nil(cache.GetCachedRegionWithRLock(loc.Region).getStore().buckets)
+}
+
+func (s *testRegionCacheSuite) checkVersionsConsistent() {
+	s.cache.mu.RLock()
+	defer s.cache.mu.RUnlock()
+	for id, ver := range s.cache.mu.latestVersions {
+		_, ok := s.cache.mu.regions[ver]
+		s.True(ok, "region %d version %v not found", id, ver)
+	}
+}
+
+func (s *testRegionCacheSuite) TestDanglingLatestVersion() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("a"))
+	s.Nil(err)
+	s.Equal(s.region1, loc.Region.id)
+
+	// A region with a different ID replaces the cached one with the same start key, e.g. after merge.
+	cachedRegion := s.cache.GetCachedRegionWithRLock(loc.Region)
+	meta := proto.Clone(cachedRegion.meta).(*metapb.Region)
+	meta.Id = s.cluster.AllocID()
+	region, err := newRegion(s.bo, s.cache, &pd.Region{Meta: meta, Leader: meta.Peers[0]})
+	s.Nil(err)
+	s.cache.mu.Lock()
+	s.cache.insertRegionToCache(region)
+	s.cache.mu.Unlock()
+	s.cache.mu.RLock()
+	_, ok := s.cache.mu.latestVersions[s.region1]
+	s.cache.mu.RUnlock()
+	s.False(ok)
+	s.checkVersionsConsistent()
+
+	// The region is loaded again and cached.
+	loc, err = s.cache.LocateRegionByID(s.bo, s.region1)
+	s.Nil(err)
+	s.Equal(s.region1, loc.Region.id)
+	s.checkVersionsConsistent()
+
+	// The latest version points at a missing region.
+	dangling := RegionVerID{id: s.region1, confVer: loc.Region.confVer + 10, ver: loc.Region.ver + 10}
+	s.cache.mu.Lock()
+	s.cache.mu.latestVersions[s.region1] = dangling
+	s.cache.mu.Unlock()
+	s.cache.mu.RLock()
+	s.Nil(s.cache.getRegionByIDFromCache(s.region1))
+	s.cache.mu.RUnlock()
+
+	loc, err = s.cache.LocateRegionByID(s.bo, s.region1)
+	s.Nil(err)
+	s.Equal(s.region1, loc.Region.id)
+	s.cache.mu.RLock()
+	s.Equal(loc.Region, s.cache.mu.latestVersions[s.region1])
+	s.NotNil(s.cache.getRegionByIDFromCache(s.region1))
+	s.cache.mu.RUnlock()
+	s.checkVersionsConsistent()
+
+	// A dangling version doesn't prevent a newer region from being cached either.
+	s.cache.mu.Lock()
+	s.cache.mu.latestVersions[s.region1] = dangling
+	s.cache.mu.Unlock()
+	r, err := s.cache.loadRegionByID(s.bo, s.region1)
+	s.Nil(err)
+	s.cache.mu.Lock()
+	s.cache.insertRegionToCache(r)
+	s.cache.mu.Unlock()
+	s.checkVersionsConsistent()
+
+	// Concurrent inserts and invalidations keep the maps consistent.
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func() {
+			defer wg.Done()
+			bo := retry.NewBackofferWithVars(context.Background(), 5000, nil)
+			for j := 0; j < 50; j++ {
+				loc, err := s.cache.LocateRegionByID(bo, s.region1)
+				s.Nil(err)
+				s.cache.InvalidateCachedRegion(loc.Region)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			bo := retry.NewBackofferWithVars(context.Background(), 5000, nil)
+			for j := 0; j < 50; j++ {
+				r, err := s.cache.loadRegionByID(bo, s.region1)
+				s.Nil(err)
+				s.cache.mu.Lock()
+				s.cache.insertRegionToCache(r)
+				s.cache.mu.Unlock()
+			}
+		}()
+	}
+	wg.Wait()
+	s.checkVersionsConsistent()
+	loc, err = s.cache.LocateRegionByID(s.bo, s.region1)
+	s.Nil(err)
+	s.Equal(s.region1, loc.Region.id)
 }
@@ -37,7 +37,6 @@ package locate
 import (
 	"context"
 	"fmt"
-	"math/rand"
 	"strconv"
 	"strings"
 	"sync"
@@ -105,6 +104,12 @@ type RegionRequestSender struct {
 	replicaSelector   *replicaSelector
 	failStoreIDs      map[uint64]struct{}
 	failProxyStoreIDs map[uint64]struct{}
+	// regionNotFoundRetried is the number of times the request is retried on RegionNotFound.
+	regionNotFoundRetried int
+	// attempt is the number of the attempt being sent by SendReqCtx, starting from 1.
+	attempt int
+	// readTimeoutRetried is the number of times the request is retried at once after exceeding KVReadTimeout.
+	readTimeoutRetried int
 	RegionRequestRuntimeStats
 }
 
@@ -257,6 +262,10 @@ type replicaSelector struct {
 	targetIdx AccessIndex
 	// replicas[proxyIdx] is the store used to redirect requests this time
 	proxyIdx AccessIndex
+	// enableForwarding indicates whether requests to an unreachable leader can be forwarded by a proxy store
+	enableForwarding bool
+	// lastSendErr is the error of the last request failing to be sent.
+	lastSendErr error
 }
 
 // selectorState is the interface of states of the replicaSelector.
@@ -332,14 +341,14 @@ func (state *accessKnownLeader) next(bo *retry.Backoffer, selector *replicaSelec
 
 func (state *accessKnownLeader) onSendFailure(bo *retry.Backoffer, selector *replicaSelector, cause error) {
 	liveness := selector.checkLiveness(bo, selector.targetReplica())
-	if liveness != reachable && len(selector.replicas) > 1 && selector.regionCache.enableForwarding {
+	if liveness != LivenessReachable && len(selector.replicas) > 1 && selector.enableForwarding {
 		selector.state = &accessByKnownProxy{leaderIdx: state.leaderIdx}
 		return
 	}
-	if liveness != reachable || selector.targetReplica().isExhausted(maxReplicaAttempt) {
+	if liveness != LivenessReachable || selector.targetReplica().isExhausted(maxReplicaAttempt) {
 		selector.state = &tryFollower{leaderIdx: state.leaderIdx, lastIdx: state.leaderIdx}
 	}
-	if liveness != reachable {
+	if liveness != LivenessReachable {
 		selector.invalidateReplicaStore(selector.targetReplica(), cause)
 	}
 }
@@ -380,7 +389,7 @@ func (state *tryFollower) next(bo *retry.Backoffer, selector *replicaSelector) (
 	// If all followers are tried and fail, backoff and retry.
 	if selector.targetIdx < 0 {
 		metrics.TiKVReplicaSelectorFailureCounter.WithLabelValues("exhausted").Inc()
-		selector.invalidateRegion()
+		selector.onReplicasExhausted()
 		return nil, nil
 	}
 	return selector.buildRPCContext(bo)
@@ -393,7 +402,7 @@ func (state *tryFollower) onSendSuccess(selector *replicaSelector) {
 }
 
 func (state *tryFollower) onSendFailure(bo *retry.Backoffer, selector *replicaSelector, cause error) {
-	if selector.checkLiveness(bo, selector.targetReplica()) != reachable {
+	if selector.checkLiveness(bo, selector.targetReplica()) != LivenessReachable {
 		selector.invalidateReplicaStore(selector.targetReplica(), cause)
 	}
 }
@@ -425,7 +434,7 @@ func (state *accessByKnownProxy) next(bo *retry.Backoffer, selector *replicaSele
 
 func (state *accessByKnownProxy) onSendFailure(bo *retry.Backoffer, selector *replicaSelector, cause error) {
 	selector.state = &tryNewProxy{leaderIdx: state.leaderIdx}
-	if selector.checkLiveness(bo, selector.proxyReplica()) != reachable {
+	if selector.checkLiveness(bo, selector.proxyReplica()) != LivenessReachable {
 		selector.invalidateReplicaStore(selector.proxyReplica(), cause)
 	}
 }
@@ -459,12 +468,15 @@ func (state *tryNewProxy) next(bo *retry.Backoffer, selector *replicaSelector) (
 	if candidateNum == 0 {
 		metrics.TiKVReplicaSelectorFailureCounter.WithLabelValues("exhausted").Inc()
 		selector.invalidateReplicaStore(leader, errors.Errorf("all followers are tried as proxy but fail"))
-		selector.region.scheduleReload()
+		if selector.region.claimFailureHandling(selector.regionStore) {
+			selector.region.scheduleReload()
+			selector.regionCache.notifyAllReplicasFailed(selector.region.VerID(), selector.lastSendErr)
+		}
 		return nil, nil
 	}
 
 	// Skip advanceCnt valid candidates to find a proxy peer randomly
-	advanceCnt := rand.Intn(candidateNum)
+	advanceCnt := selector.regionCache.rnd.Intn(candidateNum)
 	for idx, replica := range selector.replicas {
 		if !state.isCandidate(AccessIndex(idx), replica) {
 			continue
@@ -489,7 +501,7 @@ func (state *tryNewProxy) onSendSuccess(selector *replicaSelector) {
 }
 
 func (state *tryNewProxy) onSendFailure(bo *retry.Backoffer, selector *replicaSelector, cause error) {
-	if selector.checkLiveness(bo, selector.proxyReplica()) != reachable {
+	if selector.checkLiveness(bo, selector.proxyReplica()) != LivenessReachable {
 		selector.invalidateReplicaStore(selector.proxyReplica(), cause)
 	}
 }
@@ -512,14 +524,16 @@ type accessFollower struct {
 
 func (state *accessFollower) next(bo *retry.Backoffer, selector *replicaSelector) (*RPCContext, error) {
 	if state.lastIdx < 0 {
-		if state.tryLeader {
-			state.lastIdx = AccessIndex(rand.Intn(len(selector.replicas)))
+		if state.tryLeader && state.option.mixedReadWeighted() {
+			state.lastIdx = state.pickMixedReadReplica(selector)
+		} else if state.tryLeader {
+			state.lastIdx = AccessIndex(selector.regionCache.rnd.Intn(len(selector.replicas)))
 		} else {
 			if len(selector.replicas) <= 1 {
 				state.lastIdx = state.leaderIdx
 			} else {
 				// Randomly select a non-leader peer
-				state.lastIdx = AccessIndex(rand.Intn(len(selector.replicas) - 1))
+				state.lastIdx = AccessIndex(selector.regionCache.rnd.Intn(len(selector.replicas) - 1))
 				if state.lastIdx >= state.leaderIdx {
 					state.lastIdx++
 				}
@@ -551,7 +565,7 @@ func (state *accessFollower) next(bo *retry.Backoffer, selector *replicaSelector
 		leader := selector.replicas[state.leaderIdx]
 		if leader.isEpochStale() || leader.isExhausted(1) {
 			metrics.TiKVReplicaSelectorFailureCounter.WithLabelValues("exhausted").Inc()
-			selector.invalidateRegion()
+			selector.onReplicasExhausted()
 			return nil, nil
 		}
 		state.lastIdx = state.leaderIdx
@@ -560,8 +574,37 @@ func (state *accessFollower) next(bo *retry.Backoffer, selector *replicaSelector
 	return selector.buildRPCContext(bo)
 }
 
+// pickMixedReadReplica randomly picks a candidate replica for the first attempt of a mixed read, each preferred
+// replica is mixedReadWeight times as likely to be picked as another one, see WithMixedReadPreference.
+func (state *accessFollower) pickMixedReadReplica(selector *replicaSelector) AccessIndex {
+	weights := make([]int, len(selector.replicas))
+	totalWeight := 0
+	for i, replica := range selector.replicas {
+		idx := AccessIndex(i)
+		if !state.isCandidate(idx, replica) {
+			continue
+		}
+		weights[i] = 1
+		if state.option.isPreferredByMixedRead(idx == state.leaderIdx, replica.store) {
+			weights[i] = int(state.option.mixedReadWeight)
+		}
+		totalWeight += weights[i]
+	}
+	if totalWeight == 0 {
+		return AccessIndex(selector.regionCache.rnd.Intn(len(selector.replicas)))
+	}
+	w := selector.regionCache.rnd.Intn(totalWeight)
+	for i, weight := range weights {
+		if w < weight {
+			return AccessIndex(i)
+		}
+		w -= weight
+	}
+	return state.leaderIdx
+}
+
 func (state *accessFollower) onSendFailure(bo *retry.Backoffer, selector *replicaSelector, cause error) {
-	if selector.checkLiveness(bo, selector.targetReplica()) != reachable {
+	if selector.checkLiveness(bo, selector.targetReplica()) != LivenessReachable {
 		selector.invalidateReplicaStore(selector.targetReplica(), cause)
 	}
 }
@@ -571,7 +614,9 @@ func (state *accessFollower) isCandidate(idx AccessIndex, replica *replica) bool
 		// The request can only be sent to the leader.
 		((state.option.leaderOnly && idx == state.leaderIdx) ||
 			// Choose a replica with matched labels.
-			(!state.option.leaderOnly && (state.tryLeader || idx != state.leaderIdx) && replica.store.IsLabelsMatch(state.option.labels)))
+			(!state.option.leaderOnly && (state.tryLeader || idx != state.leaderIdx) && replica.store.IsLabelsMatch(state.option.labels) &&
+				// Skip the followers of unknown lag if required.
+				(idx == state.leaderIdx || !state.option.isFollowerLagUnknown(replica.store))))
 }
 
 type invalidStore struct {
@@ -595,34 +640,27 @@ func (state *invalidLeader) next(_ *retry.Backoffer, _ *replicaSelector) (*RPCCo
 }
 
 // newReplicaSelector creates a replicaSelector which selects replicas according to reqType and opts.
-// opts is currently only effective for follower read.
+// WithForwarding is effective for leader requests, and other options are only effective for follower read.
 func newReplicaSelector(regionCache *RegionCache, regionID RegionVerID, req *tikvrpc.Request, opts ...StoreSelectorOption) (*replicaSelector, error) {
 	cachedRegion := regionCache.GetCachedRegionWithRLock(regionID)
 	if cachedRegion == nil || !cachedRegion.isValid() {
 		return nil, nil
 	}
 	regionStore := cachedRegion.getStore()
-	replicas := make([]*replica, 0, regionStore.accessStoreNum(tiKVOnly))
-	for _, storeIdx := range regionStore.accessIndex[tiKVOnly] {
-		replicas = append(replicas, &replica{
-			store:    regionStore.stores[storeIdx],
-			peer:     cachedRegion.meta.Peers[storeIdx],
-			epoch:    regionStore.storeEpochs[storeIdx],
-			attempts: 0,
-		})
+	replicas := newReplicas(cachedRegion, regionStore)
+	option := storeSelectorOp{}
+	for _, op := range opts {
+		op(&option)
 	}
+	enableForwarding := option.forwardingEnabled(regionCache.enableForwarding)
 	var state selectorState
 	if !req.ReplicaReadType.IsFollowerRead() {
-		if regionCache.enableForwarding && regionStore.proxyTiKVIdx >= 0 {
+		if enableForwarding && regionStore.proxyTiKVIdx >= 0 {
 			state = &accessByKnownProxy{leaderIdx: regionStore.workTiKVIdx}
 		} else {
 			state = &accessKnownLeader{leaderIdx: regionStore.workTiKVIdx}
 		}
 	} else {
-		option := storeSelectorOp{}
-		for _, op := range opts {
-			op(&option)
-		}
 		state = &accessFollower{
 			tryLeader:         req.ReplicaReadType == kv.ReplicaReadMixed,
 			isGlobalStaleRead: req.IsGlobalStaleRead(),
@@ -640,9 +678,24 @@ func newReplicaSelector(regionCache *RegionCache, regionID RegionVerID, req *tik
 		state,
 		-1,
 		-1,
+		enableForwarding,
+		nil,
 	}, nil
 }
 
+func newReplicas(region *Region, regionStore *regionStore) []*replica {
+	replicas := make([]*replica, 0, regionStore.accessStoreNum(tiKVOnly))
+	for _, storeIdx := range regionStore.accessIndex[tiKVOnly] {
+		replicas = append(replicas, &replica{
+			store:    regionStore.stores[storeIdx],
+			peer:     region.meta.Peers[storeIdx],
+			epoch:    regionStore.storeEpochs[storeIdx],
+			attempts: 0,
+		})
+	}
+	return replicas
+}
+
 const maxReplicaAttempt = 10
 
 // next creates the RPCContext of the current candidate replica.
@@ -719,8 +772,16 @@ func (s *replicaSelector) buildRPCContext(bo *retry.Backoffer) (*RPCContext, err
 	// Backoff and retry if no replica is selected or the selected replica is stale
 	if targetReplica == nil || targetReplica.isEpochStale() ||
 		(proxyReplica != nil && proxyReplica.isEpochStale()) {
-		// TODO(youjiali1995): Is it necessary to invalidate the region?
 		metrics.TiKVReplicaSelectorFailureCounter.WithLabelValues("stale_store").Inc()
+		var stale *replica
+		if targetReplica != nil && targetReplica.isEpochStale() {
+			stale = targetReplica
+		} else if proxyReplica != nil && proxyReplica.isEpochStale() {
+			stale = proxyReplica
+		}
+		if stale != nil && s.refreshStaleReplica(stale) {
+			return nil, nil
+		}
 		s.invalidateRegion()
 		return nil, nil
 	}
@@ -759,21 +820,29 @@ func (s *replicaSelector) buildRPCContext(bo *retry.Backoffer) (*RPCContext, err
 		proxyReplica.attempts++
 	}
 
-	return rpcCtx, nil
+	return s.region.acquireRPCContext(rpcCtx), nil
 }
 
 func (s *replicaSelector) onSendFailure(bo *retry.Backoffer, err error) {
 	metrics.RegionCacheCounterWithSendFail.Inc()
+	s.lastSendErr = err
+	if target := s.targetReplica(); target != nil {
+		target.store.sendStats.record(target.store.storeID, true)
+		// All peers were reported down by PD, so rotate to the next peer quickly.
+		if s.region.suspectPeers {
+			target.attempts = maxReplicaAttempt
+		}
+	}
 	s.state.onSendFailure(bo, s, err)
 }
 
-func (s *replicaSelector) checkLiveness(bo *retry.Backoffer, accessReplica *replica) livenessState {
+func (s *replicaSelector) checkLiveness(bo *retry.Backoffer, accessReplica *replica) Liveness {
 	store := accessReplica.store
 	liveness := store.requestLiveness(bo, s.regionCache)
 	// We only check health in loop if forwarding is enabled now.
 	// The restriction might be relaxed if necessary, but the implementation
 	// may be checked carefully again.
-	if liveness != reachable && s.regionCache.enableForwarding {
+	if liveness != LivenessReachable && s.enableForwarding {
 		store.startHealthCheckLoopIfNeeded(s.regionCache)
 	}
 	return liveness
@@ -785,7 +854,7 @@ func (s *replicaSelector) invalidateReplicaStore(replica *replica, cause error)
 		logutil.BgLogger().Info("mark store's regions need be refill", zap.Uint64("id", store.storeID), zap.String("addr", store.addr), zap.Error(cause))
 		metrics.RegionCacheCounterWithInvalidateStoreRegionsOK.Inc()
 		// schedule a store addr resolve.
-		store.markNeedCheck(s.regionCache.notifyCheckCh)
+		store.markNeedCheck(s.regionCache)
 	}
 }
 
@@ -802,14 +871,15 @@ func (s *replicaSelector) onNotLeader(bo *retry.Backoffer, ctx *RPCContext, notL
 			return false, err
 		}
 	} else {
-		s.updateLeader(notLeader.GetLeader())
+		s.updateLeader(bo, notLeader.GetLeader())
 	}
 	return true, nil
 }
 
 // updateLeader updates the leader of the cached region.
-// If the leader peer isn't found in the region, the region will be invalidated.
-func (s *replicaSelector) updateLeader(leader *metapb.Peer) {
+// If the leader peer isn't found in the region, the region is reloaded from PD to find it, and the selector
+// accesses the leader of the reloaded region. The region will be invalidated if the leader isn't found still.
+func (s *replicaSelector) updateLeader(bo *retry.Backoffer, leader *metapb.Peer) {
 	if leader == nil {
 		return
 	}
@@ -831,13 +901,51 @@ func (s *replicaSelector) updateLeader(leader *metapb.Peer) {
 			return
 		}
 	}
+	// The leader may be added by a conf change that the cached version doesn't know about.
+	if region := s.regionCache.reloadRegionForLeader(bo, s.region, leader); region != nil {
+		s.region = region
+		s.regionStore = region.getStore()
+		s.replicas = newReplicas(region, s.regionStore)
+		s.state = &accessKnownLeader{leaderIdx: s.regionStore.workTiKVIdx}
+		logutil.BgLogger().Debug("switch region leader to specific leader of the reloaded region due to kv return NotLeader",
+			zap.Uint64("regionID", region.GetID()),
+			zap.Uint64("leaderStoreID", leader.GetStoreId()))
+		return
+	}
 	// Invalidate the region since the new leader is not in the cached version.
 	s.region.invalidate(StoreNotFound)
 }
 
+// refreshStaleReplica is called when the store of the replica has failed since the selector was created. Instead of
+// invalidating the region, it refreshes the store's epoch in the current regionStore of the region and switches the
+// work TiKV away from it, see RegionCache.refreshStoreEpochs. It returns false if the store isn't found in the region
+// or no healthy TiKV peer remains, and the region should be invalidated by the caller then.
+func (s *replicaSelector) refreshStaleReplica(stale *replica) bool {
+	if s.region == nil {
+		return false
+	}
+	rs := s.region.getStore()
+	for i, store := range rs.stores {
+		if store == stale.store {
+			return s.regionCache.refreshStoreEpochs(s.region, rs, i)
+		}
+	}
+	return false
+}
+
+// invalidateRegion invalidates the region unless it's done by another request to the region already.
 func (s *replicaSelector) invalidateRegion() {
-	if s.region != nil {
+	if s.region != nil && s.region.claimFailureHandling(s.regionStore) {
+		s.region.invalidate(Other)
+	}
+}
+
+// onReplicasExhausted invalidates the region after all the replicas are tried and fail, and notifies the callback
+// set by RegionCache.SetOnAllReplicasFailed.
+func (s *replicaSelector) onReplicasExhausted() {
+	if s.region != nil && s.region.claimFailureHandling(s.regionStore) {
 		s.region.invalidate(Other)
+		s.regionCache.notifyAllReplicasFailed(s.region.VerID(), s.lastSendErr)
 	}
 }
 
@@ -859,7 +967,7 @@ func (s *RegionRequestSender) getRPCContext(
 		}
 		return s.replicaSelector.next(bo)
 	case tikvrpc.TiFlash:
-		return s.regionCache.GetTiFlashRPCContext(bo, regionID, true)
+		return s.regionCache.GetTiFlashRPCContext(bo, regionID, true, opts...)
 	case tikvrpc.TiDB:
 		return &RPCContext{Addr: s.storeAddr}, nil
 	default:
@@ -871,6 +979,8 @@ func (s *RegionRequestSender) reset() {
 	s.replicaSelector = nil
 	s.failStoreIDs = nil
 	s.failProxyStoreIDs = nil
+	s.regionNotFoundRetried = 0
+	s.readTimeoutRetried = 0
 }
 
 // IsFakeRegionError returns true if err is fake region error.
@@ -878,6 +988,18 @@ func IsFakeRegionError(err *errorpb.Error) bool {
 	return err != nil && err.GetEpochNotMatch() != nil && len(err.GetEpochNotMatch().CurrentRegions) == 0
 }
 
+// MaxMessageTooLargeSplitDepth is the max number of times a request is split into halves when the request or
+// its response exceeds the gRPC message size limit.
+const MaxMessageTooLargeSplitDepth = 10
+
+// isMessageTooLargeErr checks if the rpc error is caused by a message exceeding the gRPC message size limit,
+// e.g. the response is larger than client.MaxRecvMsgSize or TiKV rejects the request for its size. gRPC reports
+// other errors with ResourceExhausted too, e.g. a server running out of memory, so the message is checked as well.
+func isMessageTooLargeErr(err error) bool {
+	s, ok := status.FromError(errors.Cause(err))
+	return ok && s.Code() == codes.ResourceExhausted && strings.Contains(s.Message(), "message larger than max")
+}
+
 // SendReqCtx sends a request to tikv server and return response and RPCCtx of this RPC.
 func (s *RegionRequestSender) SendReqCtx(
 	bo *retry.Backoffer,
@@ -914,10 +1036,6 @@ func (s *RegionRequestSender) SendReqCtx(
 						Resp: &kvrpcpb.GCResponse{RegionError: &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}},
 					}, nil, nil
 				}
-			case "busy":
-				return &tikvrpc.Response{
-					Resp: &kvrpcpb.GCResponse{RegionError: &errorpb.Error{ServerIsBusy: &errorpb.ServerIsBusy{}}},
-				}, nil, nil
 			case "requestTiDBStoreError":
 				if et == tikvrpc.TiDB {
 					return nil, nil, errors.WithStack(tikverr.ErrTiKVServerTimeout)
@@ -936,6 +1054,10 @@ func (s *RegionRequestSender) SendReqCtx(
 		req.Context.MaxExecutionDurationMs = uint64(timeout.Milliseconds())
 	}
 
+	if restore := s.spreadHotRegionRead(req, regionID, et); restore != nil {
+		defer restore()
+	}
+
 	s.reset()
 	tryTimes := 0
 	defer func() {
@@ -959,6 +1081,7 @@ func (s *RegionRequestSender) SendReqCtx(
 		if _, err := util.EvalFailpoint("invalidCacheAndRetry"); err == nil {
 			// cooperate with tikvclient/setGcResolveMaxBackoff
 			if c := bo.GetCtx().Value("injectedBackoff"); c != nil {
+				s.regionCache.ReleaseRPCContext(rpcCtx, RPCOutcomeRegionError)
 				resp, err = tikvrpc.GenRegionErrorResp(req, &errorpb.Error{EpochNotMatch: &errorpb.EpochNotMatch{}})
 				return resp, nil, err
 			}
@@ -978,8 +1101,20 @@ func (s *RegionRequestSender) SendReqCtx(
 
 		logutil.Eventf(bo.GetCtx(), "send %s request to region %d at %s", req.Type, regionID.id, rpcCtx.Addr)
 		s.storeAddr = rpcCtx.Addr
+		s.attempt = tryTimes + 1
+		sentCtx := rpcCtx
 		var retry bool
-		resp, retry, err = s.sendReqToRegion(bo, rpcCtx, req, timeout)
+		if delay := s.hedgeDelay(req, rpcCtx, et); delay > 0 {
+			var respCtx *RPCContext
+			resp, respCtx, retry, err = s.sendReqToRegionWithHedge(bo, rpcCtx, req, timeout, delay)
+			if respCtx != nil {
+				rpcCtx = respCtx
+				s.storeAddr = rpcCtx.Addr
+			}
+		} else {
+			resp, retry, err = s.sendReqToRegion(bo, rpcCtx, req, timeout)
+		}
+		s.regionCache.ReleaseRPCContext(sentCtx, rpcOutcome(resp, err))
 		if err != nil {
 			return nil, nil, err
 		}
@@ -998,6 +1133,7 @@ func (s *RegionRequestSender) SendReqCtx(
 			tryTimes++
 			continue
 		}
+		s.regionCache.OnSendSuccess(rpcCtx)
 
 		var regionErr *errorpb.Error
 		regionErr, err = resp.GetRegionError()
@@ -1022,6 +1158,17 @@ func (s *RegionRequestSender) SendReqCtx(
 	}
 }
 
+// rpcOutcome tells the outcome of a request from its response and error.
+func rpcOutcome(resp *tikvrpc.Response, err error) RPCOutcome {
+	if err != nil || resp == nil {
+		return RPCOutcomeSendFail
+	}
+	if regionErr, e := resp.GetRegionError(); e != nil || regionErr != nil {
+		return RPCOutcomeRegionError
+	}
+	return RPCOutcomeOK
+}
+
 // RPCCancellerCtxKey is context key attach rpc send cancelFunc collector to ctx.
 type RPCCancellerCtxKey struct{}
 
@@ -1142,6 +1289,8 @@ func (s *RegionRequestSender) sendReqToRegion(bo *retry.Backoffer, rpcCtx *RPCCo
 		}
 	}
 
+	timeout, readTimeoutLimited := capReadTimeout(ctx, req, timeout)
+
 	if !injectFailOnSend {
 		start := time.Now()
 		resp, err = s.client.SendRequest(ctx, sendToAddr, req, timeout)
@@ -1179,20 +1328,9 @@ func (s *RegionRequestSender) sendReqToRegion(bo *retry.Backoffer, rpcCtx *RPCCo
 				resp = nil
 			}
 		}
-
-		if val, e := util.EvalFailpoint("rpcContextCancelErr"); e == nil {
-			if val.(bool) {
-				ctx1, cancel := context.WithCancel(context.Background())
-				cancel()
-				<-ctx1.Done()
-				ctx = ctx1
-				err = ctx.Err()
-				resp = nil
-			}
-		}
 	}
 
-	if rpcCtx.ProxyStore != nil {
+	if rpcCtx.ViaProxy() {
 		fromStore := strconv.FormatUint(rpcCtx.ProxyStore.storeID, 10)
 		toStore := strconv.FormatUint(rpcCtx.Store.storeID, 10)
 		result := "ok"
@@ -1200,9 +1338,13 @@ func (s *RegionRequestSender) sendReqToRegion(bo *retry.Backoffer, rpcCtx *RPCCo
 			result = "fail"
 		}
 		metrics.TiKVForwardRequestCounter.WithLabelValues(fromStore, toStore, req.Type.String(), result).Inc()
+		if sizer, ok := req.Req.(interface{ Size() int }); ok {
+			metrics.TiKVForwardRequestBytes.WithLabelValues(fromStore, toStore).Add(float64(sizer.Size()))
+		}
 	}
 
 	if err != nil {
+		err = s.wrapSendError(err, rpcCtx, req)
 		s.rpcError = err
 
 		// Because in rpc logic, context.Cancel() will be transferred to rpcContext.Cancel error. For rpcContext cancel,
@@ -1212,11 +1354,19 @@ func (s *RegionRequestSender) sendReqToRegion(bo *retry.Backoffer, rpcCtx *RPCCo
 			return nil, false, errors.WithStack(ctx.Err())
 		}
 
+		// Retrying the same request won't help, the caller should split it if possible.
+		if isMessageTooLargeErr(err) {
+			return nil, false, errors.WithStack(&tikverr.ErrRPCMessageTooLarge{Err: err})
+		}
+
 		if val, e := util.EvalFailpoint("noRetryOnRpcError"); e == nil {
 			if val.(bool) {
 				return nil, false, err
 			}
 		}
+		if readTimeoutLimited && s.retryAfterReadTimeout(bo, rpcCtx, err) {
+			return nil, true, nil
+		}
 		if e := s.onSendFail(bo, rpcCtx, err); e != nil {
 			return nil, false, err
 		}
@@ -1225,6 +1375,57 @@ func (s *RegionRequestSender) sendReqToRegion(bo *retry.Backoffer, rpcCtx *RPCCo
 	return
 }
 
+// capReadTimeout caps the timeout of an attempt with the KVReadTimeout of the request. It also returns whether the
+// attempt is limited by KVReadTimeout rather than the call timeout or the deadline of the context.
+func capReadTimeout(ctx context.Context, req *tikvrpc.Request, timeout time.Duration) (time.Duration, bool) {
+	if req.KVReadTimeout <= 0 || req.KVReadTimeout >= timeout {
+		return timeout, false
+	}
+	deadline, ok := ctx.Deadline()
+	return req.KVReadTimeout, !ok || req.KVReadTimeout < time.Until(deadline)
+}
+
+// retryAfterReadTimeout returns whether the read abandoned for exceeding KVReadTimeout is retried at once. The read
+// is slow rather than the store failing, so it's retried without invalidating the store or backing off. Replica
+// reads move on to the next replica, and leader reads retry the leader. Once the request has timed out as many times
+// as the region has replicas, it's handled as a send failure, which backs off, so a hung store isn't retried forever.
+func (s *RegionRequestSender) retryAfterReadTimeout(bo *retry.Backoffer, rpcCtx *RPCContext, err error) bool {
+	if s.replicaSelector == nil || bo.GetCtx().Err() != nil || !isDeadlineExceeded(err) {
+		return false
+	}
+	if s.readTimeoutRetried >= len(rpcCtx.Meta.GetPeers()) {
+		return false
+	}
+	s.readTimeoutRetried++
+	metrics.TiKVKVReadTimeoutRetryCounter.Inc()
+	return true
+}
+
+// wrapSendError attaches the target and the attempt of the request to the transport error of sending it.
+func (s *RegionRequestSender) wrapSendError(err error, rpcCtx *RPCContext, req *tikvrpc.Request) error {
+	e := &tikverr.ErrSendRequest{
+		Err:           err,
+		ReqType:       req.Type.String(),
+		Addr:          rpcCtx.Addr,
+		RegionID:      rpcCtx.Region.id,
+		RegionConfVer: rpcCtx.Region.confVer,
+		RegionVer:     rpcCtx.Region.ver,
+		Attempt:       s.attempt,
+	}
+	if rpcCtx.Store != nil {
+		e.StoreID = rpcCtx.Store.storeID
+	}
+	if rpcCtx.ProxyStore != nil {
+		e.ProxyAddr = rpcCtx.ProxyAddr
+	}
+	return e
+}
+
+func isDeadlineExceeded(err error) bool {
+	cause := errors.Cause(err)
+	return cause == context.DeadlineExceeded || status.Code(cause) == codes.DeadlineExceeded
+}
+
 func (s *RegionRequestSender) getStoreToken(st *Store, limit int64) error {
 	// Checking limit is not thread safe, preferring this for avoiding load in loop.
 	count := st.tokenCount.Load()
@@ -1382,7 +1583,7 @@ func (s *RegionRequestSender) onRegionError(bo *retry.Backoffer, ctx *RPCContext
 			return false, nil
 		} else {
 			// don't backoff if a new leader is returned.
-			s.regionCache.UpdateLeader(ctx.Region, notLeader.GetLeader(), ctx.AccessIdx)
+			s.regionCache.UpdateLeaderOrReload(bo, ctx.Region, notLeader.GetLeader(), ctx.AccessIdx)
 			return true, nil
 		}
 	}
@@ -1395,8 +1596,16 @@ func (s *RegionRequestSender) onRegionError(bo *retry.Backoffer, ctx *RPCContext
 		return true, nil
 	}
 
-	// This peer is removed from the region. Invalidate the region since it's too stale.
+	// This peer is removed from the region. Invalidate the region since it's too stale, unless it's configured to
+	// retry for a while because the peer may be created soon, e.g. by a split.
 	if regionErr.GetRegionNotFound() != nil {
+		if s.regionNotFoundRetried < int(atomic.LoadInt32(&s.regionCache.regionNotFoundRetries)) {
+			s.regionNotFoundRetried++
+			if err = bo.Backoff(retry.BoRegionMiss, errors.Errorf("region not found: %v, ctx: %v", regionErr.GetRegionNotFound(), ctx)); err != nil {
+				return false, err
+			}
+			return true, nil
+		}
 		s.regionCache.InvalidateCachedRegion(ctx.Region)
 		return false, nil
 	}
@@ -1455,7 +1664,7 @@ func (s *RegionRequestSender) onRegionError(bo *retry.Backoffer, ctx *RPCContext
 		logutil.BgLogger().Debug("tikv reports `StoreNotMatch` retry later",
 			zap.Stringer("storeNotMatch", storeNotMatch),
 			zap.Stringer("ctx", ctx))
-		ctx.Store.markNeedCheck(s.regionCache.notifyCheckCh)
+		ctx.Store.markNeedCheck(s.regionCache)
 		s.regionCache.InvalidateCachedRegion(ctx.Region)
 		// It's possible the address of store is not changed but the DNS resolves to a different address in k8s environment,
 		// so we always reconnect in this case.
@@ -36,11 +36,14 @@ package locate
 
 import (
 	"context"
+	"strconv"
+	"sync"
 	"sync/atomic"
 	"testing"
 	"time"
 	"unsafe"
 
+	"github.com/pingcap/kvproto/pkg/coprocessor"
 	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pingcap/kvproto/pkg/metapb"
@@ -52,6 +55,8 @@ import (
 	"github.com/tikv/client-go/v2/kv"
 	"github.com/tikv/client-go/v2/oracle"
 	"github.com/tikv/client-go/v2/tikvrpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestRegionRequestToThreeStores(t *testing.T) {
@@ -163,10 +168,10 @@ func (s *testRegionRequestToThreeStoresSuite) TestForwarding() {
 		}
 		return innerClient.SendRequest(ctx, addr, req, timeout)
 	}}
-	var storeState uint32 = uint32(unreachable)
-	s.regionRequestSender.regionCache.testingKnobs.mockRequestLiveness = func(s *Store, bo *retry.Backoffer) livenessState {
-		return livenessState(atomic.LoadUint32(&storeState))
-	}
+	var storeState uint32 = uint32(LivenessUnreachable)
+	s.regionRequestSender.regionCache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return Liveness(atomic.LoadUint32(&storeState))
+	})
 
 	loc, err := s.regionRequestSender.regionCache.LocateKey(bo, []byte("k"))
 	s.Nil(err)
@@ -188,7 +193,7 @@ func (s *testRegionRequestToThreeStoresSuite) TestForwarding() {
 
 	// Simulate recovering to normal
 	s.regionRequestSender.client = innerClient
-	atomic.StoreUint32(&storeState, uint32(reachable))
+	atomic.StoreUint32(&storeState, uint32(LivenessReachable))
 	start := time.Now()
 	for {
 		if atomic.LoadInt32(&leaderStore.unreachable) == 0 {
@@ -199,7 +204,7 @@ func (s *testRegionRequestToThreeStoresSuite) TestForwarding() {
 		}
 		time.Sleep(time.Millisecond * 200)
 	}
-	atomic.StoreUint32(&storeState, uint32(unreachable))
+	atomic.StoreUint32(&storeState, uint32(LivenessUnreachable))
 
 	req = tikvrpc.NewRequest(tikvrpc.CmdRawGet, &kvrpcpb.RawGetRequest{Key: []byte("k")})
 	resp, ctx, err = s.regionRequestSender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV)
@@ -266,6 +271,210 @@ func (s *testRegionRequestToThreeStoresSuite) TestForwarding() {
 	s.Nil(ctx.ProxyStore)
 }
 
+func (s *testRegionRequestToThreeStoresSuite) TestForwardingToPartitionedStore() {
+	s.regionRequestSender.regionCache.enableForwarding = true
+	s.regionRequestSender.regionCache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		if s.cluster.IsStorePartitioned(storeID) {
+			return LivenessUnreachable
+		}
+		return LivenessReachable
+	})
+	leaderStore, leaderAddr := s.loadAndGetLeaderStore()
+	bo := retry.NewBackoffer(context.Background(), 10000)
+	loc, err := s.cache.LocateKey(bo, []byte("k"))
+	s.Nil(err)
+
+	// The leader can't be accessed directly, but can be accessed via a follower.
+	s.cluster.PartitionStore(leaderStore.storeID)
+	req := tikvrpc.NewRequest(tikvrpc.CmdRawPut, &kvrpcpb.RawPutRequest{Key: []byte("k"), Value: []byte("v1")})
+	resp, ctx, err := s.regionRequestSender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+	s.Nil(err)
+	regionErr, err := resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	s.Equal("", resp.Resp.(*kvrpcpb.RawPutResponse).Error)
+	s.Equal(leaderAddr, ctx.Addr)
+	s.NotNil(ctx.ProxyStore)
+	s.NotEqual(leaderAddr, ctx.ProxyAddr)
+	s.Equal(int32(1), atomic.LoadInt32(&leaderStore.unreachable))
+	s.GreaterOrEqual(s.cache.GetCachedRegionWithRLock(loc.Region).getStore().proxyTiKVIdx, AccessIndex(0))
+
+	// The requests are sent to the leader directly after the partition is healed and detected by the health check.
+	s.cluster.HealPartition(leaderStore.storeID)
+	s.Eventually(func() bool {
+		return atomic.LoadInt32(&leaderStore.unreachable) == 0
+	}, 3*time.Second, 100*time.Millisecond)
+	req = tikvrpc.NewRequest(tikvrpc.CmdRawGet, &kvrpcpb.RawGetRequest{Key: []byte("k")})
+	resp, ctx, err = s.regionRequestSender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+	s.Nil(err)
+	regionErr, err = resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	s.Equal([]byte("v1"), resp.Resp.(*kvrpcpb.RawGetResponse).Value)
+	s.Equal(leaderAddr, ctx.Addr)
+	s.Nil(ctx.ProxyStore)
+	s.Equal("", ctx.ProxyAddr)
+	s.Equal(AccessIndex(-1), s.cache.GetCachedRegionWithRLock(loc.Region).getStore().proxyTiKVIdx)
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestForwardingPerRequest() {
+	s.regionRequestSender.regionCache.enableForwarding = false
+
+	_, leaderAddr := s.loadAndGetLeaderStore()
+
+	// Simulate that the leader is network-partitioned but can be accessed by forwarding via a follower.
+	var forwarded int32
+	innerClient := s.regionRequestSender.client
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		if addr == leaderAddr {
+			return nil, errors.New("simulated rpc error")
+		}
+		// MockTiKV doesn't support forwarding. Simulate forwarding here.
+		if len(req.ForwardedHost) != 0 {
+			atomic.AddInt32(&forwarded, 1)
+			addr = req.ForwardedHost
+		}
+		return innerClient.SendRequest(ctx, addr, req, timeout)
+	}}
+	s.regionRequestSender.regionCache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessUnreachable
+	})
+
+	sendPut := func(value string, opts ...StoreSelectorOption) (*tikvrpc.Response, *RPCContext, error) {
+		bo := retry.NewBackoffer(context.Background(), 2000)
+		loc, err := s.regionRequestSender.regionCache.LocateKey(bo, []byte("k"))
+		s.Nil(err)
+		req := tikvrpc.NewRequest(tikvrpc.CmdRawPut, &kvrpcpb.RawPutRequest{
+			Key:   []byte("k"),
+			Value: []byte(value),
+		})
+		return s.regionRequestSender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV, opts...)
+	}
+
+	// The flagged request is forwarded although forwarding is disabled in the region cache.
+	resp, ctx, err := sendPut("v1", WithForwarding(true))
+	s.Nil(err)
+	regionErr, err := resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	s.Equal(ctx.Addr, leaderAddr)
+	s.True(ctx.ViaProxy())
+	s.NotEqual(ctx.ProxyAddr, leaderAddr)
+	s.Greater(atomic.LoadInt32(&forwarded), int32(0))
+
+	// The request without the option doesn't use the proxy even though the region has one.
+	atomic.StoreInt32(&forwarded, 0)
+	_, ctx, _ = sendPut("v2")
+	s.True(ctx == nil || !ctx.ViaProxy())
+	s.Equal(int32(0), atomic.LoadInt32(&forwarded))
+
+	// The request disabling forwarding explicitly doesn't use the proxy when it's enabled in the region cache.
+	s.regionRequestSender.regionCache.enableForwarding = true
+	_, ctx, _ = sendPut("v3", WithForwarding(false))
+	s.True(ctx == nil || !ctx.ViaProxy())
+	s.Equal(int32(0), atomic.LoadInt32(&forwarded))
+
+	// The flagged request still reaches the unreachable leader via a proxy.
+	resp, ctx, err = sendPut("v4", WithForwarding(true))
+	s.Nil(err)
+	regionErr, err = resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	s.True(ctx.ViaProxy())
+	s.Greater(atomic.LoadInt32(&forwarded), int32(0))
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestUnreachableStoreLabelsFlapping() {
+	cache := s.regionRequestSender.regionCache
+	cache.enableForwarding = true
+	leaderStore, leaderAddr := s.loadAndGetLeaderStore()
+	bo := retry.NewBackoffer(context.Background(), 10000)
+
+	// Simulate that the leader is network-partitioned but can be accessed by forwarding via a follower
+	var directReqs int32
+	innerClient := s.regionRequestSender.client
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		if addr == leaderAddr {
+			atomic.AddInt32(&directReqs, 1)
+			return nil, errors.New("simulated rpc error")
+		}
+		// MockTiKV doesn't support forwarding. Simulate forwarding here.
+		if len(req.ForwardedHost) != 0 {
+			addr = req.ForwardedHost
+		}
+		return innerClient.SendRequest(ctx, addr, req, timeout)
+	}}
+	var storeState uint32 = uint32(LivenessUnreachable)
+	cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return Liveness(atomic.LoadUint32(&storeState))
+	})
+
+	loc, err := cache.LocateKey(bo, []byte("k"))
+	s.Nil(err)
+	sendReq := func() *RPCContext {
+		req := tikvrpc.NewRequest(tikvrpc.CmdRawPut, &kvrpcpb.RawPutRequest{
+			Key:   []byte("k"),
+			Value: []byte("v"),
+		})
+		resp, ctx, err := s.regionRequestSender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+		s.Nil(err)
+		regionErr, err := resp.GetRegionError()
+		s.Nil(err)
+		s.Nil(regionErr)
+		return ctx
+	}
+	ctx := sendReq()
+	s.NotNil(ctx.ProxyStore)
+	s.Equal(int32(1), atomic.LoadInt32(&directReqs))
+	s.Equal(int32(1), atomic.LoadInt32(&leaderStore.unreachable))
+
+	// Flap the routing labels of the unreachable store, the replacement store keeps the failure history.
+	store := leaderStore
+	for i := 0; i < 3; i++ {
+		s.cluster.UpdateStoreLabels(store.storeID, []*metapb.StoreLabel{{Key: "zone", Value: strconv.Itoa(i)}})
+		valid, err := store.reResolve(cache)
+		s.Nil(err)
+		s.False(valid)
+		newStore := cache.getStoreByStoreID(store.storeID)
+		s.True(newStore != store)
+		s.Equal(atomic.LoadUint32(&store.epoch), atomic.LoadUint32(&newStore.epoch))
+		s.Equal(int32(1), atomic.LoadInt32(&newStore.unreachable))
+
+		ctx = sendReq()
+		s.NotNil(ctx.ProxyStore)
+		s.Equal(leaderAddr, ctx.Addr)
+		store = newStore
+	}
+	s.Equal(int32(1), atomic.LoadInt32(&directReqs))
+
+	// A label not used for routing is updated in place.
+	labels := []*metapb.StoreLabel{{Key: "zone", Value: "2"}, {Key: "flap", Value: "0"}}
+	s.cluster.UpdateStoreLabels(store.storeID, labels)
+	valid, err := store.reResolve(cache)
+	s.Nil(err)
+	s.True(valid)
+	s.True(cache.getStoreByStoreID(store.storeID) == store)
+	s.True(store.IsSameLabels(labels))
+	s.Equal(int32(1), atomic.LoadInt32(&store.unreachable))
+	ctx = sendReq()
+	s.NotNil(ctx.ProxyStore)
+	s.Equal(int32(1), atomic.LoadInt32(&directReqs))
+
+	// Requests are sent to the store directly after it's reachable.
+	s.regionRequestSender.client = innerClient
+	atomic.StoreUint32(&storeState, uint32(LivenessReachable))
+	start := time.Now()
+	for atomic.LoadInt32(&store.unreachable) != 0 {
+		if time.Since(start) > 3*time.Second {
+			s.FailNow("store didn't recover to normal in time")
+		}
+		time.Sleep(time.Millisecond * 200)
+	}
+	ctx = sendReq()
+	s.Nil(ctx.ProxyStore)
+	s.Equal(leaderAddr, ctx.Addr)
+}
+
 func refreshEpochs(regionStore *regionStore) {
 	for i, store := range regionStore.stores {
 		regionStore.storeEpochs[i] = atomic.LoadUint32(&store.epoch)
@@ -299,7 +508,7 @@ func (s *testRegionRequestToThreeStoresSuite) TestReplicaSelector() {
 	region.meta.Peers = append(region.meta.Peers, peer)
 	atomic.StorePointer(&region.store, unsafe.Pointer(regionStore))
 
-	cache := NewRegionCache(s.cache.pdClient)
+	cache := NewRegionCache(s.cache.PDClient())
 	defer cache.Close()
 	cache.insertRegionToCache(region)
 
@@ -372,9 +581,9 @@ func (s *testRegionRequestToThreeStoresSuite) TestReplicaSelector() {
 	replicaSelector, err = newReplicaSelector(cache, regionLoc.Region, req)
 	s.Nil(err)
 	s.NotNil(replicaSelector)
-	cache.testingKnobs.mockRequestLiveness = func(s *Store, bo *retry.Backoffer) livenessState {
-		return unreachable
-	}
+	cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessUnreachable
+	})
 	s.IsType(&accessKnownLeader{}, replicaSelector.state)
 	_, err = replicaSelector.next(s.bo)
 	s.Nil(err)
@@ -393,9 +602,9 @@ func (s *testRegionRequestToThreeStoresSuite) TestReplicaSelector() {
 	replicaSelector, err = newReplicaSelector(cache, regionLoc.Region, req)
 	s.Nil(err)
 	s.NotNil(replicaSelector)
-	cache.testingKnobs.mockRequestLiveness = func(s *Store, bo *retry.Backoffer) livenessState {
-		return unreachable
-	}
+	cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessUnreachable
+	})
 	s.IsType(&accessKnownLeader{}, replicaSelector.state)
 	_, err = replicaSelector.next(s.bo)
 	s.Nil(err)
@@ -522,7 +731,7 @@ func (s *testRegionRequestToThreeStoresSuite) TestReplicaSelector() {
 	regionStore.workTiKVIdx = AccessIndex(0)
 	accessIdx := AccessIndex(regionStore.accessStoreNum(tiKVOnly) - 1)
 	_, store := regionStore.accessStore(tiKVOnly, accessIdx)
-	store.labels = labels
+	store.setLabels(labels)
 	for i := 0; i < 5; i++ {
 		replicaSelector, err = newReplicaSelector(cache, regionLoc.Region, req, WithMatchLabels(labels))
 		s.NotNil(replicaSelector)
@@ -555,7 +764,7 @@ func (s *testRegionRequestToThreeStoresSuite) TestReplicaSelector() {
 
 	// Invalidate the region if the leader is not in the region.
 	region.lastAccess = time.Now().Unix()
-	replicaSelector.updateLeader(&metapb.Peer{Id: s.cluster.AllocID(), StoreId: s.cluster.AllocID()})
+	replicaSelector.updateLeader(s.bo, &metapb.Peer{Id: s.cluster.AllocID(), StoreId: s.cluster.AllocID()})
 	s.False(region.isValid())
 	// Don't try next replica if the region is invalidated.
 	rpcCtx, err = replicaSelector.next(s.bo)
@@ -563,6 +772,93 @@ func (s *testRegionRequestToThreeStoresSuite) TestReplicaSelector() {
 	s.Nil(err)
 }
 
+func (s *testRegionRequestToThreeStoresSuite) TestRandSeed() {
+	// selectPeers runs a failover scenario with the leader unreachable, and returns the sequence of the followers
+	// selected by follower reads and the proxies selected by leader reads.
+	selectPeers := func(cache *RegionCache) []uint64 {
+		cache.enableForwarding = true
+		cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+			return LivenessUnreachable
+		})
+		loc, err := cache.LocateRegionByID(s.bo, s.regionID)
+		s.Nil(err)
+
+		var peers []uint64
+		for i := 0; i < 20; i++ {
+			req := tikvrpc.NewReplicaReadRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{}, kv.ReplicaReadFollower, nil)
+			replicaSelector, err := newReplicaSelector(cache, loc.Region, req)
+			s.Nil(err)
+			rpcCtx, err := replicaSelector.next(s.bo)
+			s.Nil(err)
+			s.NotEqual(s.leaderPeer, rpcCtx.Peer.GetId())
+			peers = append(peers, rpcCtx.Peer.GetId())
+
+			req = tikvrpc.NewRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{}, kvrpcpb.Context{})
+			replicaSelector, err = newReplicaSelector(cache, loc.Region, req)
+			s.Nil(err)
+			_, err = replicaSelector.next(s.bo)
+			s.Nil(err)
+			replicaSelector.onSendFailure(s.bo, nil)
+			rpcCtx, err = replicaSelector.next(s.bo)
+			s.Nil(err)
+			s.IsType(&tryNewProxy{}, replicaSelector.state)
+			s.Equal(s.leaderPeer, rpcCtx.Peer.GetId())
+			peers = append(peers, replicaSelector.proxyReplica().peer.GetId())
+		}
+		return peers
+	}
+
+	cache := NewRegionCache(s.cache.PDClient(), WithRandSeed(1))
+	defer cache.Close()
+	peers := selectPeers(cache)
+
+	// The same seed selects the same peers.
+	cache2 := NewRegionCache(s.cache.PDClient(), WithRandSeed(1))
+	defer cache2.Close()
+	s.Equal(peers, selectPeers(cache2))
+	cache2.SetRandSeedForTest(1)
+	s.Equal(peers, selectPeers(cache2))
+
+	// Different seeds can select different peers.
+	cache3 := NewRegionCache(s.cache.PDClient(), WithRandSeed(2))
+	defer cache3.Close()
+	s.NotEqual(peers, selectPeers(cache3))
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestNotLeaderWithUnknownLeaderPeer() {
+	req := tikvrpc.NewRequest(tikvrpc.CmdRawPut, &kvrpcpb.RawPutRequest{
+		Key:   []byte("key"),
+		Value: []byte("value"),
+	})
+	loc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+
+	// A new peer is added by a conf change and becomes the leader, which the cached region doesn't know about.
+	storeID, peerID := s.cluster.AllocID(), s.cluster.AllocID()
+	s.cluster.AddStore(storeID, "store"+strconv.FormatUint(storeID, 10))
+	s.cluster.AddPeer(s.regionID, storeID, peerID)
+	s.cluster.ChangeLeader(s.regionID, peerID)
+
+	// The region is reloaded to find the leader, so the request succeeds without returning a region miss.
+	bo := retry.NewBackoffer(context.Background(), -1)
+	resp, rpcCtx, err := s.regionRequestSender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+	s.Nil(err)
+	regionErr, err := resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	s.Equal(storeID, rpcCtx.Store.StoreID())
+	s.Equal(0, bo.GetTotalBackoffTimes())
+	s.Nil(s.cache.GetCachedRegionWithRLock(loc.Region))
+
+	// The following requests are sent to the leader directly.
+	newLoc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	s.NotEqual(loc.Region, newLoc.Region)
+	rpcCtx, err = s.cache.GetTiKVRPCContext(s.bo, newLoc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	s.Equal(storeID, rpcCtx.Store.StoreID())
+}
+
 // TODO(youjiali1995): Remove duplicated tests. This test may be duplicated with other
 // tests but it's a dedicated one to test sending requests with the replica selector.
 func (s *testRegionRequestToThreeStoresSuite) TestSendReqWithReplicaSelector() {
@@ -649,9 +945,9 @@ func (s *testRegionRequestToThreeStoresSuite) TestSendReqWithReplicaSelector() {
 
 	// The leader store is alive but can't provide service.
 	// Region will be invalidated due to running out of all replicas.
-	s.regionRequestSender.regionCache.testingKnobs.mockRequestLiveness = func(s *Store, bo *retry.Backoffer) livenessState {
-		return reachable
-	}
+	s.regionRequestSender.regionCache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessReachable
+	})
 	reloadRegion()
 	s.cluster.StopStore(s.storeIDs[0])
 	bo = retry.NewBackoffer(context.Background(), -1)
@@ -770,9 +1066,9 @@ func (s *testRegionRequestToThreeStoresSuite) TestSendReqWithReplicaSelector() {
 	}
 
 	// Runs out of all replicas and then returns a send error.
-	s.regionRequestSender.regionCache.testingKnobs.mockRequestLiveness = func(s *Store, bo *retry.Backoffer) livenessState {
-		return unreachable
-	}
+	s.regionRequestSender.regionCache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessUnreachable
+	})
 	reloadRegion()
 	for _, store := range s.storeIDs {
 		s.cluster.StopStore(store)
@@ -820,3 +1116,514 @@ func (s *testRegionRequestToThreeStoresSuite) TestSendReqWithReplicaSelector() {
 		s.True(totalAttempts <= 2)
 	}
 }
+
+func (s *testRegionRequestToThreeStoresSuite) TestHedgeReadRequest() {
+	leaderStore, leaderAddr := s.loadAndGetLeaderStore()
+	var calls, cancelled int32
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (response *tikvrpc.Response, err error) {
+		atomic.AddInt32(&calls, 1)
+		if req.Type != tikvrpc.CmdRawGet {
+			return &tikvrpc.Response{Resp: &kvrpcpb.RawPutResponse{}}, nil
+		}
+		if addr == leaderAddr {
+			// The leader is slow and returns after the request is cancelled.
+			select {
+			case <-ctx.Done():
+				atomic.AddInt32(&cancelled, 1)
+				return nil, ctx.Err()
+			case <-time.After(time.Second):
+			}
+			return &tikvrpc.Response{Resp: &kvrpcpb.RawGetResponse{Value: []byte("leader")}}, nil
+		}
+		if !req.ReplicaRead {
+			return nil, errors.New("hedged request should be a replica read")
+		}
+		return &tikvrpc.Response{Resp: &kvrpcpb.RawGetResponse{Value: []byte("follower")}}, nil
+	}}
+	s.cache.SetHedgePolicy(NewHedgePolicy(HedgeConfig{Delay: 10 * time.Millisecond, MaxHedgeRatio: 1}))
+
+	loc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	req := tikvrpc.NewRequest(tikvrpc.CmdRawGet, &kvrpcpb.RawGetRequest{Key: []byte("key")})
+	start := time.Now()
+	resp, rpcCtx, err := s.regionRequestSender.SendReqCtx(s.bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+	s.Nil(err)
+	s.True(time.Since(start) < 500*time.Millisecond)
+	s.Equal([]byte("follower"), resp.Resp.(*kvrpcpb.RawGetResponse).Value)
+	s.NotEqual(leaderStore.storeID, rpcCtx.Store.storeID)
+	s.Eventually(func() bool {
+		return atomic.LoadInt32(&cancelled) == 1
+	}, time.Second, 10*time.Millisecond)
+	s.Equal(int32(2), atomic.LoadInt32(&calls))
+	// The cancelled attempt doesn't affect the region cache.
+	region := s.cache.GetCachedRegionWithRLock(loc.Region)
+	s.True(region.isValid())
+	s.Equal(leaderStore.storeID, region.GetLeaderStoreID())
+
+	// Write requests are never hedged.
+	atomic.StoreInt32(&calls, 0)
+	put := tikvrpc.NewRequest(tikvrpc.CmdRawPut, &kvrpcpb.RawPutRequest{Key: []byte("key"), Value: []byte("value")})
+	_, err = s.regionRequestSender.SendReq(s.bo, put, loc.Region, time.Second)
+	s.Nil(err)
+	s.Equal(int32(1), atomic.LoadInt32(&calls))
+
+	// A hedged request whose response is too large fails with ErrRPCMessageTooLarge so that the caller splits it.
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		return nil, status.Error(codes.ResourceExhausted, "grpc: received message larger than max (100 vs. 10)")
+	}}
+	req = tikvrpc.NewRequest(tikvrpc.CmdRawGet, &kvrpcpb.RawGetRequest{Key: []byte("key")})
+	_, _, err = s.regionRequestSender.SendReqCtx(s.bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+	s.True(tikverr.IsErrRPCMessageTooLarge(err))
+	s.True(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestHedgePolicy() {
+	store := &Store{storeID: 1}
+	p := NewHedgePolicy(HedgeConfig{Delay: time.Millisecond, MaxHedgeRatio: 0.5, Burst: 1})
+	// Each eligible request earns 0.5 token and a hedge costs 1 token.
+	s.Equal(time.Millisecond, p.HedgeDelay(store))
+	s.False(p.AllowHedge())
+	p.HedgeDelay(store)
+	s.True(p.AllowHedge())
+	s.False(p.AllowHedge())
+	// The budget can't exceed the burst.
+	for i := 0; i < 10; i++ {
+		p.HedgeDelay(store)
+	}
+	s.True(p.AllowHedge())
+	s.False(p.AllowHedge())
+
+	p = NewHedgePolicy(HedgeConfig{Delay: time.Second, AdaptiveDelay: true, MinDelay: time.Millisecond, MaxDelay: 100 * time.Millisecond})
+	s.Equal(time.Second, p.HedgeDelay(store))
+	for i := 0; i < 10; i++ {
+		p.Observe(store, 10*time.Millisecond)
+	}
+	s.Equal(10*time.Millisecond, p.HedgeDelay(store))
+	p.Observe(store, time.Hour)
+	s.Equal(100*time.Millisecond, p.HedgeDelay(store))
+	s.Equal(time.Second, p.HedgeDelay(&Store{storeID: 2}))
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestRegionNotFoundRetries() {
+	var failures int32
+	innerClient := s.regionRequestSender.client
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		if atomic.AddInt32(&failures, -1) >= 0 {
+			return &tikvrpc.Response{Resp: &kvrpcpb.RawGetResponse{RegionError: &errorpb.Error{RegionNotFound: &errorpb.RegionNotFound{}}}}, nil
+		}
+		return innerClient.SendRequest(ctx, addr, req, timeout)
+	}}
+	req := tikvrpc.NewRequest(tikvrpc.CmdRawGet, &kvrpcpb.RawGetRequest{Key: []byte("key")})
+
+	// The region is invalidated immediately by default.
+	atomic.StoreInt32(&failures, 1)
+	loc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	resp, err := s.regionRequestSender.SendReq(retry.NewBackofferWithVars(context.Background(), 5000, nil), req, loc.Region, time.Second)
+	s.Nil(err)
+	regionErr, err := resp.GetRegionError()
+	s.Nil(err)
+	s.NotNil(regionErr)
+	s.False(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+
+	// The request succeeds after retries and the region is kept.
+	s.cache.SetRegionNotFoundRetries(2)
+	atomic.StoreInt32(&failures, 2)
+	loc, err = s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	resp, err = s.regionRequestSender.SendReq(retry.NewBackofferWithVars(context.Background(), 5000, nil), req, loc.Region, time.Second)
+	s.Nil(err)
+	regionErr, err = resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	s.True(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+
+	// The region is invalidated once the retries are exhausted.
+	atomic.StoreInt32(&failures, 3)
+	resp, err = s.regionRequestSender.SendReq(retry.NewBackofferWithVars(context.Background(), 5000, nil), req, loc.Region, time.Second)
+	s.Nil(err)
+	regionErr, err = resp.GetRegionError()
+	s.Nil(err)
+	s.NotNil(regionErr)
+	s.False(s.cache.GetCachedRegionWithRLock(loc.Region).isValid())
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestKVReadTimeout() {
+	var (
+		addrs    []string
+		timeouts []time.Duration
+	)
+	innerClient := s.regionRequestSender.client
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		addrs = append(addrs, addr)
+		timeouts = append(timeouts, timeout)
+		if len(addrs) == 1 {
+			return nil, errors.WithMessage(context.DeadlineExceeded, "wait recvLoop")
+		}
+		return innerClient.SendRequest(ctx, addr, req, timeout)
+	}}
+
+	loc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	region := s.cache.GetCachedRegionWithRLock(loc.Region)
+	stores := region.getStore().stores
+	epochs := make([]uint32, len(stores))
+	for i, store := range stores {
+		epochs[i] = atomic.LoadUint32(&store.epoch)
+	}
+
+	seed := uint32(0)
+	req := tikvrpc.NewReplicaReadRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("key")}, kv.ReplicaReadFollower, &seed)
+	req.KVReadTimeout = 50 * time.Millisecond
+	bo := retry.NewBackofferWithVars(context.Background(), 5000, nil)
+	resp, err := s.regionRequestSender.SendReq(bo, req, loc.Region, time.Second)
+	s.Nil(err)
+	regionErr, err := resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+
+	// The timed out read is retried on another peer at once, and the stores are not marked failed.
+	s.Len(addrs, 2)
+	s.NotEqual(addrs[0], addrs[1])
+	s.Equal([]time.Duration{50 * time.Millisecond, 50 * time.Millisecond}, timeouts)
+	s.Zero(bo.GetTotalSleep())
+	s.True(region.isValid())
+	for i, store := range stores {
+		s.Equal(epochs[i], atomic.LoadUint32(&store.epoch))
+	}
+
+	// The read isn't limited by KVReadTimeout if the deadline of the context comes first, so the timeout is handled
+	// as a send failure of the store.
+	addrs, timeouts = nil, nil
+	req = tikvrpc.NewReplicaReadRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("key")}, kv.ReplicaReadFollower, &seed)
+	req.KVReadTimeout = 3 * time.Second
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	bo = retry.NewBackofferWithVars(ctx, 5000, nil)
+	resp, err = s.regionRequestSender.SendReq(bo, req, loc.Region, 5*time.Second)
+	s.Nil(err)
+	regionErr, err = resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	s.Len(addrs, 2)
+	// It backs off before the retry.
+	s.Greater(bo.GetTotalSleep(), 0)
+
+	// A hedged read is capped by KVReadTimeout and retried at once after exceeding it too.
+	_, leaderAddr := s.loadAndGetLeaderStore()
+	s.cache.SetHedgePolicy(NewHedgePolicy(HedgeConfig{Delay: 10 * time.Millisecond, MaxHedgeRatio: 1}))
+	var mu sync.Mutex
+	addrs, timeouts = nil, nil
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		mu.Lock()
+		addrs = append(addrs, addr)
+		timeouts = append(timeouts, timeout)
+		first := len(addrs) == 1
+		mu.Unlock()
+		if first {
+			return nil, errors.WithMessage(context.DeadlineExceeded, "wait recvLoop")
+		}
+		return innerClient.SendRequest(ctx, addr, req, timeout)
+	}}
+	req = tikvrpc.NewRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("key")})
+	req.KVReadTimeout = 50 * time.Millisecond
+	bo = retry.NewBackofferWithVars(context.Background(), 5000, nil)
+	resp, err = s.regionRequestSender.SendReq(bo, req, loc.Region, time.Second)
+	s.Nil(err)
+	regionErr, err = resp.GetRegionError()
+	s.Nil(err)
+	s.Nil(regionErr)
+	mu.Lock()
+	s.Equal([]string{leaderAddr, leaderAddr}, addrs)
+	s.Equal([]time.Duration{50 * time.Millisecond, 50 * time.Millisecond}, timeouts)
+	mu.Unlock()
+	s.Zero(bo.GetTotalSleep())
+	s.cache.SetHedgePolicy(nil)
+
+	// A read timing out on every attempt is retried at once only until it has timed out as many times as there
+	// are replicas. Then it backs off like a send failure, so a hung leader isn't retried forever.
+	var sends int32
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		atomic.AddInt32(&sends, 1)
+		return nil, errors.WithMessage(context.DeadlineExceeded, "wait recvLoop")
+	}}
+	req = tikvrpc.NewRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("key")})
+	req.KVReadTimeout = 50 * time.Millisecond
+	bo = retry.NewBackofferWithVars(context.Background(), 1000, nil)
+	resp, err = s.regionRequestSender.SendReq(bo, req, loc.Region, time.Second)
+	if err == nil {
+		regionErr, err = resp.GetRegionError()
+		s.Nil(err)
+		s.NotNil(regionErr)
+	}
+	s.Greater(atomic.LoadInt32(&sends), int32(len(stores)))
+	s.Greater(bo.GetTotalSleep(), 0)
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestMixedReadPreference() {
+	_, leaderAddr := s.loadAndGetLeaderStore()
+	var leaderReads int
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		if addr == leaderAddr {
+			leaderReads++
+		}
+		return &tikvrpc.Response{Resp: &kvrpcpb.GetResponse{}}, nil
+	}}
+	loc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	send := func(opts ...StoreSelectorOption) {
+		seed := uint32(0)
+		req := tikvrpc.NewReplicaReadRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("key")}, kv.ReplicaReadMixed, &seed)
+		resp, _, err := s.regionRequestSender.SendReqCtx(s.bo, req, loc.Region, time.Second, tikvrpc.TiKV, opts...)
+		s.Nil(err)
+		regionErr, err := resp.GetRegionError()
+		s.Nil(err)
+		s.Nil(regionErr)
+	}
+
+	// The mixed reads are spread to all the replicas by default.
+	for i := 0; i < 300; i++ {
+		send()
+	}
+	s.Less(leaderReads, 150)
+
+	// Almost all of them go to the leader if it's preferred with a large weight.
+	leaderReads = 0
+	for i := 0; i < 300; i++ {
+		send(WithMixedReadPreference(MixedReadPreferLeader, 100, nil))
+	}
+	s.Greater(leaderReads, 250)
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestHotRegionFollowerRead() {
+	_, leaderAddr := s.loadAndGetLeaderStore()
+	var leaderReads, followerReads int
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		if addr == leaderAddr {
+			leaderReads++
+		} else {
+			s.True(req.ReplicaRead)
+			followerReads++
+		}
+		if req.Type == tikvrpc.CmdPrewrite {
+			return &tikvrpc.Response{Resp: &kvrpcpb.PrewriteResponse{}}, nil
+		}
+		return &tikvrpc.Response{Resp: &kvrpcpb.GetResponse{}}, nil
+	}}
+	s.cache.SetHotRegionConfig(&HotRegionConfig{Threshold: 20, HalfLife: time.Hour})
+	defer s.cache.SetHotRegionConfig(nil)
+
+	loc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	send := func(allow bool) *tikvrpc.Request {
+		req := tikvrpc.NewRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("key")})
+		req.AllowHotRegionFollowerRead = allow
+		_, err := s.regionRequestSender.SendReq(s.bo, req, loc.Region, time.Second)
+		s.Nil(err)
+		return req
+	}
+
+	// All the reads go to the leader until the region is hot.
+	for i := 0; i < 19; i++ {
+		send(true)
+	}
+	s.Equal(19, leaderReads)
+	s.Zero(followerReads)
+	s.Empty(s.cache.HotRegions())
+
+	// Then they are spread to the followers, and the request is restored after sent.
+	for i := 0; i < 100; i++ {
+		req := send(true)
+		s.Equal(kv.ReplicaReadLeader, req.ReplicaReadType)
+		s.False(req.ReplicaRead)
+	}
+	s.Greater(followerReads, 30)
+	hot := s.cache.HotRegions()
+	s.Len(hot, 1)
+	s.Equal(loc.Region.GetID(), hot[0].RegionID)
+	s.GreaterOrEqual(hot[0].Hotness, 20.0)
+
+	// Reads that don't tolerate follower reads and writes always go to the leader.
+	leaderReads, followerReads = 0, 0
+	for i := 0; i < 20; i++ {
+		send(false)
+		prewrite := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, &kvrpcpb.PrewriteRequest{})
+		prewrite.AllowHotRegionFollowerRead = true
+		_, err := s.regionRequestSender.SendReq(s.bo, prewrite, loc.Region, time.Second)
+		s.Nil(err)
+	}
+	s.Equal(40, leaderReads)
+	s.Zero(followerReads)
+
+	// Stop spreading the reads once a follower starts failing.
+	region := s.cache.GetCachedRegionWithRLock(loc.Region)
+	rs := region.getStore()
+	for _, store := range rs.stores {
+		if store.storeID != region.GetLeaderStoreID() {
+			for i := 0; i < sendStatsWindowSize; i++ {
+				store.sendStats.record(store.storeID, true)
+			}
+			break
+		}
+	}
+	leaderReads, followerReads = 0, 0
+	for i := 0; i < 20; i++ {
+		send(true)
+	}
+	s.Equal(20, leaderReads)
+	s.Zero(followerReads)
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestOnAllReplicasFailed() {
+	var (
+		failedRegions []RegionVerID
+		failedErrs    []error
+	)
+	s.cache.SetOnAllReplicasFailed(func(region RegionVerID, err error) {
+		failedRegions = append(failedRegions, region)
+		failedErrs = append(failedErrs, err)
+	})
+	loc, err := s.cache.LocateKey(s.bo, []byte("k"))
+	s.Nil(err)
+
+	// All the stores are dead.
+	sendErr := errors.New("connection refused")
+	s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		return nil, sendErr
+	}}
+	s.cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessUnreachable
+	})
+	req := tikvrpc.NewRequest(tikvrpc.CmdRawGet, &kvrpcpb.RawGetRequest{Key: []byte("k")})
+	bo := retry.NewBackofferWithVars(context.Background(), 10000, nil)
+	resp, _, err := s.regionRequestSender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+	s.Nil(err)
+	regionErr, err := resp.GetRegionError()
+	s.Nil(err)
+	s.NotNil(regionErr)
+	s.Equal([]RegionVerID{loc.Region}, failedRegions)
+	s.Len(failedErrs, 1)
+	s.ErrorIs(failedErrs[0], sendErr)
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestCoalesceRegionFailures() {
+	var reloads int32
+	cache := NewRegionCache(&hookedPDClient{
+		Client:          &CodecPDClient{mocktikv.NewPDClient(s.cluster)},
+		onGetRegion:     func() { atomic.AddInt32(&reloads, 1) },
+		onGetRegionByID: func() { atomic.AddInt32(&reloads, 1) },
+	})
+	defer cache.Close()
+	loc, err := cache.LocateKey(s.bo, []byte("k"))
+	s.Nil(err)
+	region := cache.GetCachedRegionWithRLock(loc.Region)
+
+	// The RPCContexts handed out are tracked until they're released.
+	rpcCtx, err := cache.GetTiKVRPCContext(s.bo, loc.Region, kv.ReplicaReadLeader, 0)
+	s.Nil(err)
+	s.Equal(1, region.InflightRequests())
+	cache.ReleaseRPCContext(rpcCtx, RPCOutcomeOK)
+	cache.ReleaseRPCContext(rpcCtx, RPCOutcomeOK)
+	s.Equal(0, region.InflightRequests())
+
+	// The failures are handled once for the store epochs.
+	rs := region.getStore()
+	s.True(region.claimFailureHandling(rs))
+	s.False(region.claimFailureHandling(rs))
+	newRs := rs.clone()
+	newRs.storeEpochs[0]++
+	s.True(region.claimFailureHandling(newRs))
+	s.False(region.claimFailureHandling(rs))
+	atomic.StoreUint64(&region.failureHandled, 0)
+
+	// All the stores are dead.
+	var sent int32
+	client := &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+		atomic.AddInt32(&sent, 1)
+		return nil, errors.New("connection refused")
+	}}
+	cache.SetStoreLivenessProvider(func(addr string, storeID uint64) Liveness {
+		return LivenessUnreachable
+	})
+	atomic.StoreInt32(&reloads, 0)
+	var wg, sendWg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+		sendWg.Add(1)
+		go func() {
+			defer wg.Done()
+			sender := NewRegionRequestSender(cache, client)
+			req := tikvrpc.NewRequest(tikvrpc.CmdRawGet, &kvrpcpb.RawGetRequest{Key: []byte("k")})
+			bo := retry.NewBackofferWithVars(context.Background(), 10000, nil)
+			resp, _, err := sender.SendReqCtx(bo, req, loc.Region, time.Second, tikvrpc.TiKV)
+			sendWg.Done()
+			s.Nil(err)
+			regionErr, err := resp.GetRegionError()
+			s.Nil(err)
+			s.NotNil(regionErr.GetEpochNotMatch())
+			// Locate the key again like the callers do on region errors, after all the requests in flight fail.
+			sendWg.Wait()
+			_, err = cache.LocateKey(bo, []byte("k"))
+			s.Nil(err)
+		}()
+	}
+	wg.Wait()
+	s.GreaterOrEqual(atomic.LoadInt32(&sent), int32(50))
+	// The failures of the requests in flight are coalesced, so the region is reloaded only once.
+	s.Equal(int32(1), atomic.LoadInt32(&reloads))
+	s.False(region.isValid())
+	s.Equal(0, region.InflightRequests())
+}
+
+func (s *testRegionRequestToThreeStoresSuite) TestSendErrorContext() {
+	loc, err := s.cache.LocateKey(s.bo, []byte("key"))
+	s.Nil(err)
+	for _, c := range []struct {
+		req *tikvrpc.Request
+		err error
+	}{
+		// Unary requests fail with the gRPC status errors.
+		{
+			tikvrpc.NewRequest(tikvrpc.CmdRawPut, &kvrpcpb.RawPutRequest{Key: []byte("key")}),
+			status.Error(codes.Unavailable, "connection refused"),
+		},
+		// Batched requests fail when waiting for the responses from the batch stream.
+		{
+			tikvrpc.NewRequest(tikvrpc.CmdGet, &kvrpcpb.GetRequest{Key: []byte("key")}),
+			errors.WithMessage(status.Error(codes.Unavailable, "batch stream broken"), "wait recvLoop"),
+		},
+		// Streaming requests fail when establishing the stream.
+		{
+			tikvrpc.NewRequest(tikvrpc.CmdCopStream, &coprocessor.Request{}),
+			errors.WithStack(status.Error(codes.Unavailable, "failed to establish stream")),
+		},
+	} {
+		var addrs []string
+		sendErr := c.err
+		s.regionRequestSender.client = &fnClient{fn: func(ctx context.Context, addr string, req *tikvrpc.Request, timeout time.Duration) (*tikvrpc.Response, error) {
+			addrs = append(addrs, addr)
+			return nil, sendErr
+		}}
+		bo := retry.NewBackofferWithVars(context.Background(), 1, nil)
+		_, err := s.regionRequestSender.SendReq(bo, c.req, loc.Region, time.Second)
+		s.NotNil(err)
+
+		var e *tikverr.ErrSendRequest
+		s.True(errors.As(err, &e), c.req.Type)
+		s.Equal(c.req.Type.String(), e.ReqType)
+		s.Equal(addrs[len(addrs)-1], e.Addr)
+		s.Empty(e.ProxyAddr)
+		s.NotZero(e.StoreID)
+		s.Equal(loc.Region.GetID(), e.RegionID)
+		s.Equal(loc.Region.GetConfVer(), e.RegionConfVer)
+		s.Equal(loc.Region.GetVer(), e.RegionVer)
+		s.Equal(len(addrs), e.Attempt)
+		s.Contains(err.Error(), e.Addr)
+
+		// The original error is kept in the chain.
+		s.True(errors.Is(err, sendErr))
+		st, ok := status.FromError(errors.Cause(err))
+		s.True(ok)
+		s.Equal(codes.Unavailable, st.Code())
+	}
+}
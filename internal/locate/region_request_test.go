@@ -56,6 +56,8 @@ import (
 	"github.com/tikv/client-go/v2/internal/retry"
 	"github.com/tikv/client-go/v2/tikvrpc"
 	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
 )
 
 func TestRegionRequestToSingleStore(t *testing.T) {
@@ -255,6 +257,14 @@ func (s *testRegionRequestToSingleStoreSuite) TestOnSendFailedWithCancelled() {
 	s.NotNil(resp.Resp)
 }
 
+func (s *testRegionRequestToSingleStoreSuite) TestIsMessageTooLargeErr() {
+	s.True(isMessageTooLargeErr(status.Error(codes.ResourceExhausted, "grpc: received message larger than max (100 vs. 10)")))
+	s.True(isMessageTooLargeErr(errors.WithStack(status.Error(codes.ResourceExhausted, "trying to send message larger than max (100 vs. 10)"))))
+	s.False(isMessageTooLargeErr(status.Error(codes.ResourceExhausted, "the server is out of memory")))
+	s.False(isMessageTooLargeErr(status.Error(codes.Unavailable, "message larger than max")))
+	s.False(isMessageTooLargeErr(errors.New("message larger than max")))
+}
+
 func (s *testRegionRequestToSingleStoreSuite) TestNoReloadRegionWhenCtxCanceled() {
 	req := tikvrpc.NewRequest(tikvrpc.CmdRawPut, &kvrpcpb.RawPutRequest{
 		Key:   []byte("key"),
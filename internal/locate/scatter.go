@@ -0,0 +1,110 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"bytes"
+	"sync"
+
+	"github.com/pingcap/kvproto/pkg/pdpb"
+	"github.com/pkg/errors"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/internal/logutil"
+	"github.com/tikv/client-go/v2/internal/retry"
+	"go.uber.org/zap"
+)
+
+// waitScatterRegionsConcurrency is the max number of regions waited concurrently by WaitScatterRegionsFinish.
+const waitScatterRegionsConcurrency = 16
+
+// WaitScatterRegionFinish waits until the scatter-region operator of the region finishes, that is, it's not
+// running anymore or it's already gone. backOff is the max time to wait in milliseconds, if backOff <= 0, it waits
+// as long as bo allows. tikv.KVStore.WaitScatterRegionFinish is a shortcut of it.
+func (c *RegionCache) WaitScatterRegionFinish(bo *retry.Backoffer, regionID uint64, backOff int) error {
+	logutil.BgLogger().Info("wait scatter region",
+		zap.Uint64("regionID", regionID), zap.Int("backoff(ms)", backOff))
+
+	startSleep := bo.GetTotalSleep()
+	logFreq := 0
+	for {
+		resp, err := c.PDClient().GetOperator(bo.GetCtx(), regionID)
+		if err == nil {
+			// PD reports an error in the header without the operator if the operator is gone.
+			if resp == nil || !bytes.Equal(resp.Desc, []byte("scatter-region")) || resp.Status != pdpb.OperatorStatus_RUNNING {
+				logutil.BgLogger().Info("wait scatter region finished",
+					zap.Uint64("regionID", regionID),
+					zap.String("desc", string(resp.GetDesc())),
+					zap.Stringer("status", resp.GetStatus()))
+				return nil
+			}
+			if resp.GetHeader().GetError() != nil {
+				err = errors.WithStack(&tikverr.PDError{
+					Err: resp.Header.Error,
+				})
+				logutil.BgLogger().Warn("wait scatter region error",
+					zap.Uint64("regionID", regionID), zap.Error(err))
+				return err
+			}
+			if logFreq%10 == 0 {
+				logutil.BgLogger().Info("wait scatter region",
+					zap.Uint64("regionID", regionID),
+					zap.Stringer("status", resp.GetStatus()))
+			}
+			logFreq++
+			err = errors.Errorf("scatter region %d is running", regionID)
+		}
+		if backOff > 0 && bo.GetTotalSleep()-startSleep >= backOff {
+			return errors.Errorf("wait scatter region timeout, regionID: %d, backoff(ms): %d, err: %v", regionID, backOff, err)
+		}
+		if err = bo.Backoff(retry.BoRegionMiss, err); err != nil {
+			return errors.WithStack(err)
+		}
+	}
+}
+
+// WaitScatterRegionsFinish waits until the scatter-region operators of all the regions finish like
+// WaitScatterRegionFinish does. The regions are waited concurrently, each with a clone of bo. It returns the first
+// error, and stops waiting for the other regions then.
+func (c *RegionCache) WaitScatterRegionsFinish(bo *retry.Backoffer, regionIDs []uint64, backOff int) error {
+	bo, cancel := bo.Fork()
+	defer cancel()
+
+	var (
+		mu       sync.Mutex
+		wg       sync.WaitGroup
+		limit    = make(chan struct{}, waitScatterRegionsConcurrency)
+		firstErr error
+	)
+	for _, id := range regionIDs {
+		limit <- struct{}{}
+		wg.Add(1)
+		go func(bo *retry.Backoffer, id uint64) {
+			defer func() {
+				<-limit
+				wg.Done()
+			}()
+			if err := c.WaitScatterRegionFinish(bo, id, backOff); err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+					cancel()
+				}
+				mu.Unlock()
+			}
+		}(bo.Clone(), id)
+	}
+	wg.Wait()
+	return firstErr
+}
@@ -0,0 +1,91 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package locate
+
+import (
+	"math/bits"
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tikv/client-go/v2/metrics"
+)
+
+// sendStatsWindowSize is the number of the latest sends to a store used to calculate its send failure rate.
+const sendStatsWindowSize = 64
+
+// storeSendStats records whether the latest sends to a store failed in a fixed size sliding window.
+type storeSendStats struct {
+	sync.Mutex
+	failures uint64 // bitmap of the sends in the window, a set bit means the send failed
+	pos      uint   // position of the next send in the window
+	count    int    // number of sends in the window
+	gauge    prometheus.Gauge
+}
+
+func (s *storeSendStats) record(storeID uint64, failed bool) {
+	s.Lock()
+	defer s.Unlock()
+	bit := uint64(1) << s.pos
+	if failed {
+		s.failures |= bit
+	} else {
+		s.failures &^= bit
+	}
+	s.pos = (s.pos + 1) % sendStatsWindowSize
+	if s.count < sendStatsWindowSize {
+		s.count++
+	}
+	if s.gauge == nil {
+		s.gauge = metrics.TiKVStoreSendFailureRate.WithLabelValues(strconv.FormatUint(storeID, 10))
+	}
+	s.gauge.Set(s.failureRateLocked())
+}
+
+func (s *storeSendStats) failureRate() float64 {
+	s.Lock()
+	defer s.Unlock()
+	return s.failureRateLocked()
+}
+
+func (s *storeSendStats) failureRateLocked() float64 {
+	if s.count == 0 {
+		return 0
+	}
+	return float64(bits.OnesCount64(s.failures)) / float64(s.count)
+}
+
+// copyFrom copies the sends in the window of another store.
+func (s *storeSendStats) copyFrom(other *storeSendStats) {
+	other.Lock()
+	failures, pos, count := other.failures, other.pos, other.count
+	other.Unlock()
+	s.Lock()
+	s.failures, s.pos, s.count = failures, pos, count
+	s.Unlock()
+}
+
+// GetSendFailureRate returns the ratio of failed sends among the latest sends to the store. A store which is
+// failing can be deprioritized according to it before being marked unreachable.
+func (s *Store) GetSendFailureRate() float64 {
+	return s.sendStats.failureRate()
+}
+
+// OnSendSuccess records a successful send to the store of the RPCContext.
+func (c *RegionCache) OnSendSuccess(ctx *RPCContext) {
+	if ctx != nil && ctx.Store != nil {
+		ctx.Store.sendStats.record(ctx.Store.storeID, false)
+	}
+}
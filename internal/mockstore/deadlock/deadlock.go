@@ -36,6 +36,7 @@ package deadlock
 
 import (
 	"fmt"
+	"sort"
 	"sync"
 )
 
@@ -43,6 +44,12 @@ import (
 type Detector struct {
 	waitForMap map[uint64]*txnList
 	lock       sync.Mutex
+
+	// forcedKeyHashes are key hashes on which waiting is always reported as a deadlock.
+	forcedKeyHashes map[uint64]struct{}
+	// limit is the max number of wait-for edges, 0 means no limit.
+	limit int
+	edges int
 }
 
 type txnList struct {
@@ -54,10 +61,18 @@ type txnKeyHashPair struct {
 	keyHash uint64
 }
 
+// WaitFor is an edge of the wait-for graph: Txn waits for WaitForTxn on the key with KeyHash.
+type WaitFor struct {
+	Txn        uint64
+	WaitForTxn uint64
+	KeyHash    uint64
+}
+
 // NewDetector creates a new Detector.
 func NewDetector() *Detector {
 	return &Detector{
-		waitForMap: map[uint64]*txnList{},
+		waitForMap:      map[uint64]*txnList{},
+		forcedKeyHashes: map[uint64]struct{}{},
 	}
 }
 
@@ -71,14 +86,73 @@ func (e *ErrDeadlock) Error() string {
 }
 
 // Detect detects deadlock for the sourceTxn on a locked key.
+// Waiting on a forced key hash, or waiting when the wait-for graph is full, is reported as a deadlock too.
 func (d *Detector) Detect(sourceTxn, waitForTxn, keyHash uint64) *ErrDeadlock {
 	d.lock.Lock()
+	defer d.lock.Unlock()
+	if _, ok := d.forcedKeyHashes[keyHash]; ok {
+		return &ErrDeadlock{KeyHash: keyHash}
+	}
 	err := d.doDetect(sourceTxn, waitForTxn)
-	if err == nil {
-		d.register(sourceTxn, waitForTxn, keyHash)
+	if err != nil {
+		return err
+	}
+	if d.limit > 0 && d.edges >= d.limit && !d.registered(sourceTxn, waitForTxn, keyHash) {
+		return &ErrDeadlock{KeyHash: keyHash}
 	}
+	d.register(sourceTxn, waitForTxn, keyHash)
+	return nil
+}
+
+// Register adds an edge to the wait-for graph without detecting deadlock. It's used to seed the graph in tests.
+func (d *Detector) Register(sourceTxn, waitForTxn, keyHash uint64) {
+	d.lock.Lock()
+	d.register(sourceTxn, waitForTxn, keyHash)
 	d.lock.Unlock()
-	return err
+}
+
+// ForceDeadlock makes the detector report a deadlock whenever a transaction waits on the key hash.
+func (d *Detector) ForceDeadlock(keyHash uint64) {
+	d.lock.Lock()
+	d.forcedKeyHashes[keyHash] = struct{}{}
+	d.lock.Unlock()
+}
+
+// ClearForcedDeadlocks removes all key hashes set by ForceDeadlock.
+func (d *Detector) ClearForcedDeadlocks() {
+	d.lock.Lock()
+	d.forcedKeyHashes = map[uint64]struct{}{}
+	d.lock.Unlock()
+}
+
+// SetLimit sets the max number of edges in the wait-for graph. Once the limit is reached, waiting that would
+// add a new edge is reported as a deadlock. 0 means no limit.
+func (d *Detector) SetLimit(limit int) {
+	d.lock.Lock()
+	d.limit = limit
+	d.lock.Unlock()
+}
+
+// WaitForGraph returns all edges of the wait-for graph, sorted by Txn, WaitForTxn and KeyHash.
+func (d *Detector) WaitForGraph() []WaitFor {
+	d.lock.Lock()
+	graph := make([]WaitFor, 0, d.edges)
+	for txn, list := range d.waitForMap {
+		for _, pair := range list.txns {
+			graph = append(graph, WaitFor{Txn: txn, WaitForTxn: pair.txn, KeyHash: pair.keyHash})
+		}
+	}
+	d.lock.Unlock()
+	sort.Slice(graph, func(i, j int) bool {
+		if graph[i].Txn != graph[j].Txn {
+			return graph[i].Txn < graph[j].Txn
+		}
+		if graph[i].WaitForTxn != graph[j].WaitForTxn {
+			return graph[i].WaitForTxn < graph[j].WaitForTxn
+		}
+		return graph[i].KeyHash < graph[j].KeyHash
+	})
+	return graph
 }
 
 func (d *Detector) doDetect(sourceTxn, waitForTxn uint64) *ErrDeadlock {
@@ -97,25 +171,40 @@ func (d *Detector) doDetect(sourceTxn, waitForTxn uint64) *ErrDeadlock {
 	return nil
 }
 
-func (d *Detector) register(sourceTxn, waitForTxn, keyHash uint64) {
+func (d *Detector) registered(sourceTxn, waitForTxn, keyHash uint64) bool {
 	list := d.waitForMap[sourceTxn]
-	pair := txnKeyHashPair{txn: waitForTxn, keyHash: keyHash}
 	if list == nil {
-		d.waitForMap[sourceTxn] = &txnList{txns: []txnKeyHashPair{pair}}
-		return
+		return false
 	}
 	for _, tar := range list.txns {
 		if tar.txn == waitForTxn && tar.keyHash == keyHash {
-			return
+			return true
 		}
 	}
+	return false
+}
+
+func (d *Detector) register(sourceTxn, waitForTxn, keyHash uint64) {
+	if d.registered(sourceTxn, waitForTxn, keyHash) {
+		return
+	}
+	d.edges++
+	list := d.waitForMap[sourceTxn]
+	pair := txnKeyHashPair{txn: waitForTxn, keyHash: keyHash}
+	if list == nil {
+		d.waitForMap[sourceTxn] = &txnList{txns: []txnKeyHashPair{pair}}
+		return
+	}
 	list.txns = append(list.txns, pair)
 }
 
 // CleanUp removes the wait for entry for the transaction.
 func (d *Detector) CleanUp(txn uint64) {
 	d.lock.Lock()
-	delete(d.waitForMap, txn)
+	if l := d.waitForMap[txn]; l != nil {
+		d.edges -= len(l.txns)
+		delete(d.waitForMap, txn)
+	}
 	d.lock.Unlock()
 }
 
@@ -128,6 +217,7 @@ func (d *Detector) CleanUpWaitFor(txn, waitForTxn, keyHash uint64) {
 		for i, tar := range l.txns {
 			if tar == pair {
 				l.txns = append(l.txns[:i], l.txns[i+1:]...)
+				d.edges--
 				break
 			}
 		}
@@ -144,6 +234,7 @@ func (d *Detector) Expire(minTS uint64) {
 	d.lock.Lock()
 	for ts := range d.waitForMap {
 		if ts < minTS {
+			d.edges -= len(d.waitForMap[ts].txns)
 			delete(d.waitForMap, ts)
 		}
 	}
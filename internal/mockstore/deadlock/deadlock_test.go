@@ -79,3 +79,34 @@ func TestDeadlock(t *testing.T) {
 	detector.Expire(2)
 	assert.Len(detector.waitForMap, 0)
 }
+
+func TestDeadlockHooks(t *testing.T) {
+	assert := assert.New(t)
+	detector := NewDetector()
+
+	// Seed the wait-for graph and inspect it.
+	detector.Register(2, 1, 100)
+	detector.Register(1, 3, 200)
+	detector.Register(1, 3, 200)
+	assert.Equal([]WaitFor{{Txn: 1, WaitForTxn: 3, KeyHash: 200}, {Txn: 2, WaitForTxn: 1, KeyHash: 100}}, detector.WaitForGraph())
+	assert.EqualError(detector.Detect(3, 2, 300), "deadlock(200)")
+
+	// Forced key hashes are always reported as deadlock.
+	detector.ForceDeadlock(400)
+	assert.EqualError(detector.Detect(4, 5, 400), "deadlock(400)")
+	assert.Nil(detector.Detect(4, 5, 500))
+	detector.ClearForcedDeadlocks()
+	assert.Nil(detector.Detect(4, 5, 400))
+	assert.Len(detector.WaitForGraph(), 4)
+
+	// New edges overflowing the limit are reported as deadlock, existing edges are still allowed.
+	detector.SetLimit(4)
+	assert.EqualError(detector.Detect(6, 7, 600), "deadlock(600)")
+	assert.Nil(detector.Detect(4, 5, 500))
+	detector.CleanUp(4)
+	assert.Nil(detector.Detect(6, 7, 600))
+	detector.CleanUpWaitFor(6, 7, 600)
+	detector.Expire(3)
+	assert.Empty(detector.WaitForGraph())
+	assert.Equal(0, detector.edges)
+}
@@ -189,6 +189,59 @@ func (c *Cluster) UnCancelStore(storeID uint64) {
 	}
 }
 
+// SetStaleReplica makes the replica reads served by the store read the data at readTS at most, which fakes a
+// follower lagging behind the leader. A zero readTS makes the store up to date again.
+func (c *Cluster) SetStaleReplica(storeID, readTS uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if store := c.stores[storeID]; store != nil {
+		store.staleReadTS = readTS
+	}
+}
+
+// PartitionStore makes the store unreachable from the client, while it can still be accessed by forwarding the
+// requests via other stores.
+func (c *Cluster) PartitionStore(storeID uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if store := c.stores[storeID]; store != nil {
+		store.partitioned = true
+	}
+}
+
+// HealPartition makes the store partitioned by PartitionStore reachable from the client again.
+func (c *Cluster) HealPartition(storeID uint64) {
+	c.Lock()
+	defer c.Unlock()
+
+	if store := c.stores[storeID]; store != nil {
+		store.partitioned = false
+	}
+}
+
+// IsStorePartitioned returns whether the store is unreachable from the client. It tells the liveness of the store
+// to the health check of the client.
+func (c *Cluster) IsStorePartitioned(storeID uint64) bool {
+	c.RLock()
+	defer c.RUnlock()
+
+	store := c.stores[storeID]
+	return store != nil && store.partitioned
+}
+
+// replicaReadTS returns the ts at which the store serves a replica read at ts.
+func (c *Cluster) replicaReadTS(storeID, ts uint64) uint64 {
+	c.RLock()
+	defer c.RUnlock()
+
+	if store := c.stores[storeID]; store != nil && store.staleReadTS != 0 && store.staleReadTS < ts {
+		return store.staleReadTS
+	}
+	return ts
+}
+
 // GetStoreByAddr returns a Store's meta by an addr.
 func (c *Cluster) GetStoreByAddr(addr string) *metapb.Store {
 	c.RLock()
@@ -689,6 +742,10 @@ func (r *Region) incVersion() {
 type Store struct {
 	meta   *metapb.Store
 	cancel bool // return context.Cancelled error when cancel is true.
+	// staleReadTS is the max ts of the data the store serves for replica reads, 0 means unlimited.
+	staleReadTS uint64
+	// partitioned means the store can't be accessed by the client directly.
+	partitioned bool
 }
 
 func newStore(storeID uint64, addr string, labels ...*metapb.StoreLabel) *Store {
@@ -91,6 +91,30 @@ func (e ErrAlreadyCommitted) Error() string {
 	return "txn already committed"
 }
 
+// ErrInvalidCommitTS is returned when the commitTS of a commit request is not greater than the startTS.
+type ErrInvalidCommitTS struct {
+	StartTS  uint64
+	CommitTS uint64
+}
+
+func (e *ErrInvalidCommitTS) Error() string {
+	return fmt.Sprintf("invalid commit ts %v, it must be greater than the start ts %v", e.CommitTS, e.StartTS)
+}
+
+// ErrCommitTSMismatch is returned when a transaction is committed again with a different commitTS. It indicates a
+// bug of the client, so it's never retryable.
+type ErrCommitTSMismatch struct {
+	Key              []byte
+	StartTS          uint64
+	CommitTS         uint64
+	ExistingCommitTS uint64
+}
+
+func (e *ErrCommitTSMismatch) Error() string {
+	return fmt.Sprintf("txn=%v on key=%s is already committed at %v, but it's committed again at %v",
+		e.StartTS, hex.EncodeToString(e.Key), e.ExistingCommitTS, e.CommitTS)
+}
+
 // ErrAlreadyRollbacked is returned when lock operation meets rollback write record
 type ErrAlreadyRollbacked struct {
 	startTS uint64
@@ -155,3 +179,14 @@ func (e *ErrAssertionFailed) Error() string {
 	return fmt.Sprintf("AssertionFailed { StartTS: %v, Key: %v, Assertion: %v, ExistingStartTS: %v, ExistingCommitTS: %v }",
 		e.StartTS, hex.EncodeToString(e.Key), e.Assertion.String(), e.ExistingStartTS, e.ExistingCommitTS)
 }
+
+// ErrValueTooLarge is returned when the value of a mutation exceeds the max value size.
+type ErrValueTooLarge struct {
+	Key     []byte
+	Size    int
+	MaxSize int
+}
+
+func (e *ErrValueTooLarge) Error() string {
+	return fmt.Sprintf("value is too large, key: %q, size: %v, max size: %v", e.Key, e.Size, e.MaxSize)
+}
@@ -35,6 +35,7 @@
 package mocktikv
 
 import (
+	"fmt"
 	"math"
 	"testing"
 
@@ -42,6 +43,7 @@ import (
 	"github.com/pkg/errors"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/internal/mockstore/deadlock"
 )
 
 func lock(key, primary string, ts uint64) *kvrpcpb.LockInfo {
@@ -182,6 +184,10 @@ func mustBatchResolveLock(t *testing.T, store MVCCStore, txnInfos map[uint64]uin
 	assert.Nil(t, store.BatchResolveLock(nil, nil, txnInfos))
 }
 
+func mustResolveLockByPrimary(t *testing.T, store MVCCStore, start, end, primary string, startTS, commitTS uint64) {
+	assert.Nil(t, store.ResolveLockByPrimary([]byte(start), []byte(end), []byte(primary), startTS, commitTS))
+}
+
 func mustGC(t *testing.T, store MVCCStore, safePoint uint64) {
 	assert.Nil(t, store.GC(nil, nil, safePoint))
 }
@@ -459,6 +465,40 @@ func TestScanWithResolvedLock(t *testing.T) {
 	}
 }
 
+func TestScanLockedKey(t *testing.T) {
+	assert := assert.New(t)
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustPutOK(t, store, "a", "va", 1, 2)
+	mustPutOK(t, store, "c", "vc", 1, 2)
+	mustPrewriteOK(t, store, putMutations("b", "vb"), "b", 5)
+
+	checkPairs := func(pairs []Pair, keys ...string) {
+		assert.Len(pairs, len(keys))
+		for i, pair := range pairs {
+			assert.Equal([]byte(keys[i]), pair.Key)
+			if keys[i] != "b" {
+				assert.Nil(pair.Err)
+				assert.Equal([]byte("v"+keys[i]), pair.Value)
+				continue
+			}
+			lock, ok := errors.Cause(pair.Err).(*ErrLocked)
+			assert.True(ok)
+			assert.Equal([]byte("b"), lock.Key.Raw())
+			assert.Equal([]byte("b"), lock.Primary)
+			assert.Equal(uint64(5), lock.StartTS)
+		}
+	}
+	checkPairs(store.Scan(nil, nil, 10, 10, kvrpcpb.IsolationLevel_SI, nil), "a", "b", "c")
+	checkPairs(store.ReverseScan(nil, nil, 10, 10, kvrpcpb.IsolationLevel_SI, nil), "c", "b", "a")
+
+	// The lock is not seen before its start ts.
+	checkPairs(store.Scan(nil, nil, 10, 4, kvrpcpb.IsolationLevel_SI, nil), "a", "c")
+	checkPairs(store.ReverseScan(nil, nil, 10, 4, kvrpcpb.IsolationLevel_SI, nil), "c", "a")
+}
+
 func TestCommitConflict(t *testing.T) {
 	assert := assert.New(t)
 	store, err := NewMVCCLevelDB("")
@@ -539,6 +579,45 @@ func TestBatchResolveLock(t *testing.T) {
 	mustScanLock(t, store, 30, nil)
 }
 
+func TestResolveLockByPrimary(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustPrewriteOK(t, store, putMutations("a1", "v5", "b1", "v5", "c1", "v5"), "a1", 5)
+	mustPrewriteOK(t, store, putMutations("a2", "v5", "b2", "v5"), "a2", 5)
+	mustPrewriteOK(t, store, putMutations("a3", "v6", "b3", "v6"), "a1", 6)
+
+	// The secondaries are resolved region by region, i.e. [a, b) then [b, "").
+	mustResolveLockByPrimary(t, store, "a", "b", "a1", 5, 10)
+	mustGetOK(t, store, "a1", 10, "v5")
+	mustScanLock(t, store, 10, []*kvrpcpb.LockInfo{
+		lock("a2", "a2", 5),
+		lock("a3", "a1", 6),
+		lock("b1", "a1", 5),
+		lock("b2", "a2", 5),
+		lock("b3", "a1", 6),
+		lock("c1", "a1", 5),
+	})
+	mustResolveLockByPrimary(t, store, "b", "", "a1", 5, 10)
+	mustGetOK(t, store, "b1", 10, "v5")
+	mustGetOK(t, store, "c1", 10, "v5")
+	mustScanLock(t, store, 10, []*kvrpcpb.LockInfo{
+		lock("a2", "a2", 5),
+		lock("a3", "a1", 6),
+		lock("b2", "a2", 5),
+		lock("b3", "a1", 6),
+	})
+
+	mustResolveLockByPrimary(t, store, "", "", "a2", 5, 0)
+	mustGetNone(t, store, "a2", 10)
+	mustGetNone(t, store, "b2", 10)
+	mustScanLock(t, store, 10, []*kvrpcpb.LockInfo{
+		lock("a3", "a1", 6),
+		lock("b3", "a1", 6),
+	})
+}
+
 func TestGC(t *testing.T) {
 	store, err := NewMVCCLevelDB("")
 	require.Nil(t, err)
@@ -671,21 +750,21 @@ func TestCheckTxnStatus(t *testing.T) {
 	startTS := uint64(5 << 18)
 	mustPrewriteWithTTLOK(t, store, putMutations("pk", "val"), "pk", startTS, 666)
 
-	ttl, commitTS, action, err := store.CheckTxnStatus([]byte("pk"), startTS, startTS+100, 666, false, false)
+	ttl, commitTS, action, _, err := store.CheckTxnStatus([]byte("pk"), startTS, startTS+100, 666, false, false, false)
 	assert.Nil(err)
 	assert.Equal(ttl, uint64(666))
 	assert.Equal(commitTS, uint64(0))
 	assert.Equal(action, kvrpcpb.Action_MinCommitTSPushed)
 
 	// MaxUint64 as callerStartTS shouldn't update minCommitTS but return Action_MinCommitTSPushed.
-	ttl, commitTS, action, err = store.CheckTxnStatus([]byte("pk"), startTS, math.MaxUint64, 666, false, false)
+	ttl, commitTS, action, _, err = store.CheckTxnStatus([]byte("pk"), startTS, math.MaxUint64, 666, false, false, false)
 	assert.Nil(err)
 	assert.Equal(ttl, uint64(666))
 	assert.Equal(commitTS, uint64(0))
 	assert.Equal(action, kvrpcpb.Action_MinCommitTSPushed)
 	mustCommitOK(t, store, [][]byte{[]byte("pk")}, startTS, startTS+101)
 
-	ttl, commitTS, _, err = store.CheckTxnStatus([]byte("pk"), startTS, 0, 666, false, false)
+	ttl, commitTS, _, _, err = store.CheckTxnStatus([]byte("pk"), startTS, 0, 666, false, false, false)
 	assert.Nil(err)
 	assert.Equal(ttl, uint64(0))
 	assert.Equal(commitTS, startTS+101)
@@ -693,7 +772,7 @@ func TestCheckTxnStatus(t *testing.T) {
 	mustPrewriteWithTTLOK(t, store, putMutations("pk1", "val"), "pk1", startTS, 666)
 	mustRollbackOK(t, store, [][]byte{[]byte("pk1")}, startTS)
 
-	ttl, commitTS, action, err = store.CheckTxnStatus([]byte("pk1"), startTS, 0, 666, false, false)
+	ttl, commitTS, action, _, err = store.CheckTxnStatus([]byte("pk1"), startTS, 0, 666, false, false, false)
 	assert.Nil(err)
 	assert.Equal(ttl, uint64(0))
 	assert.Equal(commitTS, uint64(0))
@@ -701,21 +780,21 @@ func TestCheckTxnStatus(t *testing.T) {
 
 	mustPrewriteWithTTLOK(t, store, putMutations("pk2", "val"), "pk2", startTS, 666)
 	currentTS := uint64(777 << 18)
-	ttl, commitTS, action, err = store.CheckTxnStatus([]byte("pk2"), startTS, 0, currentTS, false, false)
+	ttl, commitTS, action, _, err = store.CheckTxnStatus([]byte("pk2"), startTS, 0, currentTS, false, false, false)
 	assert.Nil(err)
 	assert.Equal(ttl, uint64(0))
 	assert.Equal(commitTS, uint64(0))
 	assert.Equal(action, kvrpcpb.Action_TTLExpireRollback)
 
 	// Cover the TxnNotFound case.
-	_, _, _, err = store.CheckTxnStatus([]byte("txnNotFound"), 5, 0, 666, false, false)
+	_, _, _, _, err = store.CheckTxnStatus([]byte("txnNotFound"), 5, 0, 666, false, false, false)
 	assert.NotNil(err)
 	notFound, ok := errors.Cause(err).(*ErrTxnNotFound)
 	assert.True(ok)
 	assert.Equal(notFound.StartTs, uint64(5))
 	assert.Equal(string(notFound.PrimaryKey), "txnNotFound")
 
-	ttl, commitTS, action, err = store.CheckTxnStatus([]byte("txnNotFound"), 5, 0, 666, true, false)
+	ttl, commitTS, action, _, err = store.CheckTxnStatus([]byte("txnNotFound"), 5, 0, 666, true, false, false)
 	assert.Nil(err)
 	assert.Equal(ttl, uint64(0))
 	assert.Equal(commitTS, uint64(0))
@@ -732,13 +811,103 @@ func TestCheckTxnStatus(t *testing.T) {
 	assert.NotNil(errs)
 }
 
+func TestCheckTxnStatusWithoutPush(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	startTS := uint64(5 << 18)
+	mustPrewriteWithTTLOK(t, store, putMutations("pk", "val"), "pk", startTS, 666)
+
+	store.SetMinCommitTSPushDisabled(true)
+	for _, callerStartTS := range []uint64{startTS + 100, math.MaxUint64} {
+		ttl, commitTS, action, _, err := store.CheckTxnStatus([]byte("pk"), startTS, callerStartTS, 666, false, false, false)
+		assert.Nil(t, err)
+		assert.Equal(t, uint64(666), ttl)
+		assert.Equal(t, uint64(0), commitTS)
+		assert.Equal(t, kvrpcpb.Action_NoAction, action)
+	}
+	// The minCommitTS isn't pushed, so the transaction can commit before the caller.
+	mustCommitOK(t, store, [][]byte{[]byte("pk")}, startTS, startTS+50)
+
+	mustPrewriteWithTTLOK(t, store, putMutations("pk1", "val"), "pk1", startTS, 666)
+	store.SetMinCommitTSPushDisabled(false)
+	_, _, action, _, err := store.CheckTxnStatus([]byte("pk1"), startTS, startTS+100, 666, false, false, false)
+	assert.Nil(t, err)
+	assert.Equal(t, kvrpcpb.Action_MinCommitTSPushed, action)
+	mustCommitErr(t, store, [][]byte{[]byte("pk1")}, startTS, startTS+50)
+}
+
+func TestCheckAsyncCommitTxnStatus(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	startTS := uint64(5 << 18)
+	secondaries := [][]byte{[]byte("s1"), []byte("s2")}
+	req := &kvrpcpb.PrewriteRequest{
+		Mutations:      putMutations("pk", "val", "s1", "val", "s2", "val"),
+		PrimaryLock:    []byte("pk"),
+		StartVersion:   startTS,
+		LockTtl:        666,
+		MinCommitTs:    startTS + 1,
+		UseAsyncCommit: true,
+		Secondaries:    secondaries,
+	}
+	require.Nil(t, store.Prewrite(req))
+
+	// The expired async-commit lock is neither rolled back nor pushed.
+	currentTS := uint64(777 << 18)
+	ttl, commitTS, action, lockInfo, err := store.CheckTxnStatus([]byte("pk"), startTS, startTS+100, currentTS, true, false, false)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(666), ttl)
+	assert.Equal(t, uint64(0), commitTS)
+	assert.Equal(t, kvrpcpb.Action_NoAction, action)
+	require.NotNil(t, lockInfo)
+	assert.True(t, lockInfo.UseAsyncCommit)
+	assert.Equal(t, secondaries, lockInfo.Secondaries)
+	assert.Equal(t, startTS+1, lockInfo.MinCommitTs)
+
+	locks, commitTS, err := store.CheckSecondaryLocks(secondaries, startTS)
+	require.Nil(t, err)
+	assert.Equal(t, uint64(0), commitTS)
+	require.Len(t, locks, 2)
+	for i, lock := range locks {
+		assert.Equal(t, secondaries[i], lock.Key)
+		assert.Equal(t, startTS, lock.LockVersion)
+		assert.True(t, lock.UseAsyncCommit)
+		assert.Empty(t, lock.Secondaries)
+	}
+
+	// A key which isn't locked means the transaction is committed.
+	mustCommitOK(t, store, [][]byte{[]byte("s1")}, startTS, startTS+10)
+	locks, commitTS, err = store.CheckSecondaryLocks(secondaries, startTS)
+	require.Nil(t, err)
+	assert.Empty(t, locks)
+	assert.Equal(t, startTS+10, commitTS)
+
+	// Or rolled back if it's never prewritten, and it can't be prewritten later.
+	locks, commitTS, err = store.CheckSecondaryLocks([][]byte{[]byte("s3")}, startTS)
+	require.Nil(t, err)
+	assert.Empty(t, locks)
+	assert.Equal(t, uint64(0), commitTS)
+	req.Mutations = putMutations("s3", "val")
+	assert.NotNil(t, store.Prewrite(req))
+
+	// The lock is checked as a normal one if the caller forces sync commit.
+	_, _, action, lockInfo, err = store.CheckTxnStatus([]byte("pk"), startTS, startTS+100, currentTS, true, false, true)
+	require.Nil(t, err)
+	assert.Equal(t, kvrpcpb.Action_TTLExpireRollback, action)
+	assert.Nil(t, lockInfo)
+}
+
 func TestRejectCommitTS(t *testing.T) {
 	store, err := NewMVCCLevelDB("")
 	require.Nil(t, err)
 	defer store.Close()
 	mustPrewriteOK(t, store, putMutations("x", "A"), "x", 5)
 	// Push the minCommitTS
-	_, _, _, err = store.CheckTxnStatus([]byte("x"), 5, 100, 100, false, false)
+	_, _, _, _, err = store.CheckTxnStatus([]byte("x"), 5, 100, 100, false, false, false)
 	assert.Nil(t, err)
 	err = store.Commit([][]byte{[]byte("x")}, 5, 10)
 	e, ok := errors.Cause(err).(*ErrCommitTSExpired)
@@ -746,6 +915,99 @@ func TestRejectCommitTS(t *testing.T) {
 	assert.Equal(t, e.MinCommitTs, uint64(101))
 }
 
+func TestCommitTSNotGreaterThanStartTS(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+	mustPrewriteOK(t, store, putMutations("x", "A"), "x", 5)
+	for _, commitTS := range []uint64{4, 5} {
+		err = store.Commit([][]byte{[]byte("x")}, 5, commitTS)
+		e, ok := errors.Cause(err).(*ErrInvalidCommitTS)
+		assert.True(t, ok)
+		assert.Equal(t, commitTS, e.CommitTS)
+	}
+	// The lock is kept after the invalid commits.
+	mustGetErr(t, store, "x", 10)
+	mustCommitOK(t, store, [][]byte{[]byte("x")}, 5, 6)
+	mustGetOK(t, store, "x", 10, "A")
+}
+
+func TestCommitWithDifferentCommitTS(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+	mustPrewriteOK(t, store, putMutations("x", "A", "y", "B"), "x", 5)
+	mustCommitOK(t, store, [][]byte{[]byte("x"), []byte("y")}, 5, 10)
+	// Committing again with the same commitTS is idempotent.
+	mustCommitOK(t, store, [][]byte{[]byte("x"), []byte("y")}, 5, 10)
+
+	err = store.Commit([][]byte{[]byte("y")}, 5, 11)
+	e, ok := errors.Cause(err).(*ErrCommitTSMismatch)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("y"), e.Key)
+	assert.Equal(t, uint64(11), e.CommitTS)
+	assert.Equal(t, uint64(10), e.ExistingCommitTS)
+	commitTS, err := store.GetCommitTS([]byte("y"), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, uint64(10), commitTS)
+}
+
+func TestRollbackCommittedTxn(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+	mustPrewriteOK(t, store, putMutations("x", "A", "y", "B", "z", "C"), "x", 5)
+	mustCommitOK(t, store, [][]byte{[]byte("x"), []byte("y"), []byte("z")}, 5, 10)
+	// Newer versions and locks of other transactions on the keys don't hide the commit records.
+	mustPutOK(t, store, "x", "A2", 15, 20)
+	mustPrewriteOK(t, store, putMutations("y", "B2"), "y", 25)
+
+	for _, keys := range [][][]byte{
+		{[]byte("x")},
+		{[]byte("y")},
+		{[]byte("z")},
+		{[]byte("x"), []byte("y"), []byte("z")},
+		{[]byte("z"), []byte("y"), []byte("x")},
+	} {
+		err = store.Rollback(keys, 5)
+		commitTS, ok := errors.Cause(err).(ErrAlreadyCommitted)
+		assert.True(t, ok)
+		assert.Equal(t, ErrAlreadyCommitted(10), commitTS)
+	}
+	mustGetOK(t, store, "x", 12, "A")
+	mustGetOK(t, store, "z", 12, "C")
+}
+
+func TestGetCommitTS(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustGetCommitTS := func(key string, startTS, expect uint64) {
+		commitTS, err := store.GetCommitTS([]byte(key), startTS)
+		assert.Nil(t, err)
+		assert.Equal(t, expect, commitTS)
+	}
+
+	mustPrewriteOK(t, store, putMutations("x", "A", "y", "B"), "x", 5)
+	mustGetCommitTS("x", 5, 0)
+	mustCommitOK(t, store, [][]byte{[]byte("x")}, 5, 10)
+	mustGetCommitTS("x", 5, 10)
+	mustGetCommitTS("y", 5, 0)
+	mustCommitOK(t, store, [][]byte{[]byte("y")}, 5, 10)
+	mustGetCommitTS("y", 5, 10)
+
+	// A later transaction doesn't hide the earlier commit.
+	mustPutOK(t, store, "x", "C", 15, 20)
+	mustGetCommitTS("x", 5, 10)
+	mustGetCommitTS("x", 15, 20)
+
+	mustPrewriteOK(t, store, putMutations("z", "D"), "z", 25)
+	mustRollbackOK(t, store, [][]byte{[]byte("z")}, 25)
+	mustGetCommitTS("z", 25, 0)
+	mustGetCommitTS("notExist", 5, 0)
+}
+
 func TestMvccGetByKey(t *testing.T) {
 	store, err := NewMVCCLevelDB("")
 	require.Nil(t, err)
@@ -767,6 +1029,220 @@ func TestMvccGetByKey(t *testing.T) {
 	assert.Equal(t, mvccInfo, except)
 }
 
+func TestGetHistory(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustPutOK(t, store, "x", "A", 5, 10)
+	mustDeleteOK(t, store, "x", 15, 20)
+	mustPrewriteOK(t, store, putMutations("x", "B"), "x", 25)
+	mustRollbackOK(t, store, [][]byte{[]byte("x")}, 25)
+	mustPutOK(t, store, "x", "C", 30, 35)
+	mustPutOK(t, store, "y", "D", 40, 45)
+	// The uncommitted lock isn't a version.
+	mustPrewriteOK(t, store, putMutations("x", "E"), "x", 50)
+
+	mustGetHistory := func(key string, fromTS, toTS uint64, expect ...HistoryVersion) {
+		history, err := store.GetHistory([]byte(key), fromTS, toTS)
+		require.Nil(t, err)
+		assert.Equal(t, expect, history)
+	}
+	put := func(commitTS uint64, value string) HistoryVersion {
+		return HistoryVersion{CommitTS: commitTS, Op: kvrpcpb.Op_Put, Value: []byte(value)}
+	}
+	del := HistoryVersion{CommitTS: 20, Op: kvrpcpb.Op_Del}
+
+	mustGetHistory("x", 0, math.MaxUint64, put(35, "C"), del, put(10, "A"))
+	// Both bounds are inclusive.
+	mustGetHistory("x", 10, 35, put(35, "C"), del, put(10, "A"))
+	mustGetHistory("x", 11, 34, del)
+	mustGetHistory("x", 21, 34)
+	mustGetHistory("x", 0, 9)
+	mustGetHistory("x", 35, 10)
+	mustGetHistory("y", 0, math.MaxUint64, put(45, "D"))
+	mustGetHistory("z", 0, math.MaxUint64)
+}
+
+func TestRawBatchPutMultiCF(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	store.RawPut("", []byte("k1"), []byte("v1"))
+	store.RawPut("lock", []byte("k1"), []byte("l1"))
+	entries := []RawEntry{
+		{Key: []byte("k1"), Value: []byte("v1-new")},
+		{Key: []byte("k2"), Value: []byte("v2")},
+		{Cf: "lock", Key: []byte("k1"), Value: []byte("l1-new")},
+		{Cf: "write", Key: []byte("k1"), Value: []byte("w1")},
+		// A key written twice is restored to its value before the batch.
+		{Key: []byte("k1"), Value: []byte("v1-newer")},
+	}
+
+	// The write to the second column family fails after the first one is written.
+	store.rawBatchWriteHook = func(cf string) error {
+		if cf == "lock" {
+			return errors.New("injected error")
+		}
+		return nil
+	}
+	err = store.RawBatchPutMultiCF(entries)
+	assert.NotNil(t, err)
+	assert.Equal(t, []byte("v1"), store.RawGet("", []byte("k1")))
+	assert.Nil(t, store.RawGet("", []byte("k2")))
+	assert.Equal(t, []byte("l1"), store.RawGet("lock", []byte("k1")))
+	assert.Nil(t, store.RawGet("write", []byte("k1")))
+
+	// The write to the column family created by the batch fails.
+	store.rawBatchWriteHook = func(cf string) error {
+		if cf == "write" {
+			return errors.New("injected error")
+		}
+		return nil
+	}
+	err = store.RawBatchPutMultiCF(entries)
+	assert.NotNil(t, err)
+	assert.Equal(t, []byte("v1"), store.RawGet("", []byte("k1")))
+	assert.Nil(t, store.RawGet("", []byte("k2")))
+	assert.Equal(t, []byte("l1"), store.RawGet("lock", []byte("k1")))
+	assert.Nil(t, store.RawGet("write", []byte("k1")))
+
+	store.rawBatchWriteHook = nil
+	err = store.RawBatchPutMultiCF(entries)
+	assert.Nil(t, err)
+	assert.Equal(t, []byte("v1-newer"), store.RawGet("", []byte("k1")))
+	assert.Equal(t, []byte("v2"), store.RawGet("", []byte("k2")))
+	assert.Equal(t, []byte("l1-new"), store.RawGet("lock", []byte("k1")))
+	assert.Equal(t, []byte("w1"), store.RawGet("write", []byte("k1")))
+}
+
+func TestShortValueMaxLen(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustPutOK(t, store, "q1", "12345", 5, 10)
+	mustPrewriteOK(t, store, putMutations("q1", "1234567"), "q1", 15)
+	info := store.MvccGetByKey([]byte("q1"))
+	assert.Equal(t, []byte("1234567"), info.Lock.ShortValue)
+	assert.Equal(t, []byte("12345"), info.Writes[0].ShortValue)
+
+	store.SetShortValueMaxLen(5)
+	info = store.MvccGetByKey([]byte("q1"))
+	assert.Nil(t, info.Lock.ShortValue)
+	assert.Equal(t, []byte("12345"), info.Writes[0].ShortValue)
+	assert.Equal(t, []byte("12345"), info.Values[0].Value)
+
+	store.SetShortValueMaxLen(4)
+	info, key := store.MvccGetByStartTS(5)
+	assert.Equal(t, []byte("q1"), key)
+	assert.Nil(t, info.Writes[0].ShortValue)
+	assert.Equal(t, []byte("12345"), info.Values[0].Value)
+}
+
+func TestMaxValueSize(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	// Unlimited by default.
+	mustPutOK(t, store, "v1", "1234567890", 5, 10)
+
+	store.SetMaxValueSize(5)
+	mustPutOK(t, store, "v2", "12345", 15, 20)
+	mutations := append(putMutations("v3", "123", "v4", "123456"), &kvrpcpb.Mutation{
+		Op:  kvrpcpb.Op_Del,
+		Key: []byte("v1"),
+	})
+	errs := store.Prewrite(&kvrpcpb.PrewriteRequest{
+		Mutations:    mutations,
+		PrimaryLock:  []byte("v3"),
+		StartVersion: 25,
+	})
+	require.Len(t, errs, 3)
+	assert.Nil(t, errs[0])
+	tooLarge, ok := errs[1].(*ErrValueTooLarge)
+	require.True(t, ok)
+	assert.Equal(t, []byte("v4"), tooLarge.Key)
+	assert.Equal(t, 6, tooLarge.Size)
+	assert.Equal(t, 5, tooLarge.MaxSize)
+	assert.Nil(t, errs[2])
+	// Nothing is written if any mutation fails.
+	mustGetNone(t, store, "v3", 30)
+	mustGetOK(t, store, "v1", 30, "1234567890")
+
+	store.SetMaxValueSize(0)
+	mustPutOK(t, store, "v4", "123456", 35, 40)
+	mustGetOK(t, store, "v4", 45, "123456")
+}
+
+func TestFlashbackGet(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustPutOK(t, store, "key", "v1", 5, 10)
+	mustPutOK(t, store, "key", "v2", 15, 20)
+	mustDeleteOK(t, store, "key", 25, 30)
+	mustPrewriteOK(t, putMutations("key", "v3"), "key", 35)
+	// Get fails due to the lock.
+	mustGetErr(t, store, "key", 40)
+
+	for _, c := range []struct {
+		ts    uint64
+		value []byte
+	}{
+		{9, nil},
+		{10, []byte("v1")},
+		{19, []byte("v1")},
+		{20, []byte("v2")},
+		{30, nil},
+		{40, nil},
+	} {
+		val, err := store.FlashbackGet([]byte("key"), c.ts)
+		assert.Nil(t, err)
+		assert.Equal(t, c.value, val, "ts: %d", c.ts)
+	}
+}
+
+func TestInjectAssertionFailure(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustPutOK(t, store, "a1", "1", 5, 10)
+	injected := &ErrAssertionFailed{
+		StartTS:          15,
+		Key:              []byte("a1"),
+		Assertion:        kvrpcpb.Assertion_NotExist,
+		ExistingStartTS:  5,
+		ExistingCommitTS: 10,
+	}
+	store.SetAssertionFailure(kvrpcpb.Op_Put, injected)
+	prewrite := func(mutations []*kvrpcpb.Mutation, startTS uint64) []error {
+		return store.Prewrite(&kvrpcpb.PrewriteRequest{
+			Mutations:    mutations,
+			PrimaryLock:  mutations[0].Key,
+			StartVersion: startTS,
+		})
+	}
+
+	errs := prewrite(putMutations("a1", "2", "a2", "2"), 15)
+	require.Len(t, errs, 2)
+	assert.Same(t, injected, errs[0])
+	assert.Nil(t, errs[1])
+	// Nothing is written if any mutation fails.
+	mustGetNone(t, store, "a2", 20)
+
+	// Mutations of other ops aren't affected.
+	mustDeleteOK(t, store, "a1", 25, 30)
+	mustGetNone(t, store, "a1", 35)
+
+	store.SetAssertionFailure(kvrpcpb.Op_Put, nil)
+	assert.Nil(t, prewrite(putMutations("a1", "3"), 40)[0])
+}
+
 func TestTxnHeartBeat(t *testing.T) {
 	store, err := NewMVCCLevelDB("")
 	require.Nil(t, err)
@@ -790,3 +1266,152 @@ func TestTxnHeartBeat(t *testing.T) {
 	_, err = store.TxnHeartBeat([]byte("pk"), 5, 1000)
 	assert.NotNil(err)
 }
+
+func TestDeadlockDetectorHooks(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	pessimisticLock := func(key string, startTS uint64) *kvrpcpb.KeyError {
+		resp := store.PessimisticLock(&kvrpcpb.PessimisticLockRequest{
+			Mutations:    []*kvrpcpb.Mutation{{Op: kvrpcpb.Op_PessimisticLock, Key: []byte(key)}},
+			PrimaryLock:  []byte(key),
+			StartVersion: startTS,
+			ForUpdateTs:  startTS,
+			LockTtl:      3000,
+			WaitTimeout:  LockNoWait,
+		})
+		if len(resp.Errors) == 0 {
+			return nil
+		}
+		return resp.Errors[0]
+	}
+	detector := store.DeadlockDetector()
+	keyHash := DeadlockKeyHash([]byte("k"))
+
+	assert.Nil(t, pessimisticLock("k", 10))
+	keyErr := pessimisticLock("k", 20)
+	require.NotNil(t, keyErr)
+	assert.NotNil(t, keyErr.Locked)
+	assert.Equal(t, []deadlock.WaitFor{{Txn: 20, WaitForTxn: 10, KeyHash: keyHash}}, detector.WaitForGraph())
+
+	// A forced deadlock is returned as the deadlock key error.
+	detector.ForceDeadlock(keyHash)
+	keyErr = pessimisticLock("k", 30)
+	require.NotNil(t, keyErr)
+	assert.Equal(t, &kvrpcpb.Deadlock{LockTs: 10, LockKey: []byte("k"), DeadlockKeyHash: keyHash}, keyErr.Deadlock)
+	detector.ClearForcedDeadlocks()
+
+	// A seeded wait-for edge closes the cycle.
+	otherHash := DeadlockKeyHash([]byte("x"))
+	detector.Register(10, 40, otherHash)
+	keyErr = pessimisticLock("k", 40)
+	require.NotNil(t, keyErr)
+	assert.Equal(t, &kvrpcpb.Deadlock{LockTs: 10, LockKey: []byte("k"), DeadlockKeyHash: otherHash}, keyErr.Deadlock)
+
+	// The waiting edges of the transaction are removed after it's committed.
+	mustCommitOK(t, store, [][]byte{[]byte("k")}, 10, 11)
+	assert.Equal(t, []deadlock.WaitFor{{Txn: 20, WaitForTxn: 10, KeyHash: keyHash}}, detector.WaitForGraph())
+}
+
+func TestBatchGetUnsortedKeys(t *testing.T) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(t, err)
+	defer store.Close()
+
+	mustPutOK(t, store, "a", "va1", 1, 2)
+	mustPutOK(t, store, "a", "va2", 3, 4)
+	mustPutOK(t, store, "c", "vc", 1, 2)
+	mustPrewriteOK(t, store, putMutations("b", "vb"), "b", 5)
+
+	// Keys are read by one iterator, which must seek backward as well.
+	pairs := store.BatchGet([][]byte{[]byte("c"), []byte("d"), []byte("a"), []byte("b"), []byte("a")}, 10, kvrpcpb.IsolationLevel_SI, nil)
+	require.Len(t, pairs, 4)
+	assert.Equal(t, Pair{Key: []byte("c"), Value: []byte("vc")}, pairs[0])
+	assert.Equal(t, Pair{Key: []byte("a"), Value: []byte("va2")}, pairs[1])
+	assert.Equal(t, []byte("b"), pairs[2].Key)
+	_, ok := pairs[2].Err.(*ErrLocked)
+	assert.True(t, ok)
+	assert.Equal(t, Pair{Key: []byte("a"), Value: []byte("va2")}, pairs[3])
+
+	// Commit and rollback keys in any order.
+	mustPrewriteOK(t, store, putMutations("d", "vd", "e", "ve"), "d", 6)
+	mustCommitOK(t, store, [][]byte{[]byte("e"), []byte("d")}, 6, 7)
+	mustGetOK(t, store, "d", 8, "vd")
+	mustGetOK(t, store, "e", 8, "ve")
+	mustRollbackOK(t, store, [][]byte{[]byte("b"), []byte("a")}, 5)
+	mustGetNone(t, store, "b", 8)
+	mustGetOK(t, store, "a", 8, "va2")
+}
+
+func BenchmarkMockPrewriteCommit(b *testing.B) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(b, err)
+	defer store.Close()
+
+	const keyCount = 64
+	keys := make([][]byte, 0, keyCount)
+	mutations := make([]*kvrpcpb.Mutation, 0, keyCount)
+	for i := 0; i < keyCount; i++ {
+		key := []byte(fmt.Sprintf("key%04d", i))
+		keys = append(keys, key)
+		mutations = append(mutations, &kvrpcpb.Mutation{
+			Op:    kvrpcpb.Op_Put,
+			Key:   key,
+			Value: []byte(fmt.Sprintf("value%04d", i)),
+		})
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		startTS := uint64(i*2 + 1)
+		errs := store.Prewrite(&kvrpcpb.PrewriteRequest{
+			Mutations:    mutations,
+			PrimaryLock:  keys[0],
+			StartVersion: startTS,
+			LockTtl:      3000,
+		})
+		for _, err := range errs {
+			if err != nil {
+				b.Fatal(err)
+			}
+		}
+		if err := store.Commit(keys, startTS, startTS+1); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkMockScan(b *testing.B) {
+	store, err := NewMVCCLevelDB("")
+	require.Nil(b, err)
+	defer store.Close()
+
+	// Each key has a few versions to skip.
+	const keyCount = 1000
+	for ts := uint64(1); ts < 10; ts += 2 {
+		mutations := make([]*kvrpcpb.Mutation, 0, keyCount)
+		keys := make([][]byte, 0, keyCount)
+		for i := 0; i < keyCount; i++ {
+			key := []byte(fmt.Sprintf("key%04d", i))
+			keys = append(keys, key)
+			mutations = append(mutations, &kvrpcpb.Mutation{
+				Op:    kvrpcpb.Op_Put,
+				Key:   key,
+				Value: []byte(fmt.Sprintf("value%04d", ts)),
+			})
+		}
+		require.True(b, MustPrewrite(store, mutations, string(keys[0]), ts, 3000))
+		require.Nil(b, store.Commit(keys, ts, ts+1))
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		pairs := store.Scan(nil, nil, 100, 20, kvrpcpb.IsolationLevel_SI, nil)
+		if len(pairs) != 100 {
+			b.Fatalf("unexpected pairs: %d", len(pairs))
+		}
+	}
+}
@@ -71,6 +71,10 @@ type mvccLock struct {
 	forUpdateTS uint64
 	txnSize     uint64
 	minCommitTS uint64
+	// useAsyncCommit is set on the locks prewritten by an async-commit transaction, and secondaries are the keys
+	// of the transaction other than the primary, which are only recorded on the primary lock.
+	useAsyncCommit bool
+	secondaries    [][]byte
 }
 
 type mvccEntry struct {
@@ -93,6 +97,11 @@ func (l *mvccLock) MarshalBinary() ([]byte, error) {
 	mh.WriteNumber(&buf, l.forUpdateTS)
 	mh.WriteNumber(&buf, l.txnSize)
 	mh.WriteNumber(&buf, l.minCommitTS)
+	mh.WriteNumber(&buf, l.useAsyncCommit)
+	mh.WriteNumber(&buf, uint64(len(l.secondaries)))
+	for _, secondary := range l.secondaries {
+		mh.WriteSlice(&buf, secondary)
+	}
 	return buf.Bytes(), mh.err
 }
 
@@ -108,6 +117,19 @@ func (l *mvccLock) UnmarshalBinary(data []byte) error {
 	mh.ReadNumber(buf, &l.forUpdateTS)
 	mh.ReadNumber(buf, &l.txnSize)
 	mh.ReadNumber(buf, &l.minCommitTS)
+	// Locks written before async commit is supported end here.
+	if mh.err != nil || buf.Len() == 0 {
+		return mh.err
+	}
+	mh.ReadNumber(buf, &l.useAsyncCommit)
+	var secondaries uint64
+	mh.ReadNumber(buf, &secondaries)
+	l.secondaries = nil
+	for i := uint64(0); i < secondaries && mh.err == nil; i++ {
+		var secondary []byte
+		mh.ReadSlice(buf, &secondary)
+		l.secondaries = append(l.secondaries, secondary)
+	}
 	return mh.err
 }
 
@@ -223,6 +245,22 @@ func (l *mvccLock) lockErr(key []byte) error {
 	}
 }
 
+// lockInfo returns the LockInfo of the lock on the key.
+func (l *mvccLock) lockInfo(key []byte) *kvrpcpb.LockInfo {
+	return &kvrpcpb.LockInfo{
+		PrimaryLock:     l.primary,
+		LockVersion:     l.startTS,
+		Key:             key,
+		LockTtl:         l.ttl,
+		TxnSize:         l.txnSize,
+		LockType:        l.op,
+		LockForUpdateTs: l.forUpdateTS,
+		UseAsyncCommit:  l.useAsyncCommit,
+		MinCommitTs:     l.minCommitTS,
+		Secondaries:     l.secondaries,
+	}
+}
+
 func (l *mvccLock) check(ts uint64, key []byte, resolvedLocks []uint64) (uint64, error) {
 	// ignore when ts is older than lock or lock's type is Lock.
 	// Pessimistic lock doesn't block read.
@@ -265,6 +303,7 @@ func (e *mvccEntry) Get(ts uint64, isoLevel kvrpcpb.IsolationLevel, resolvedLock
 // MVCCStore is a mvcc key-value storage.
 type MVCCStore interface {
 	Get(key []byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel, resolvedLocks []uint64) ([]byte, error)
+	FlashbackGet(key []byte, ts uint64) ([]byte, error)
 	Scan(startKey, endKey []byte, limit int, startTS uint64, isoLevel kvrpcpb.IsolationLevel, resolvedLocks []uint64) []Pair
 	ReverseScan(startKey, endKey []byte, limit int, startTS uint64, isoLevel kvrpcpb.IsolationLevel, resolvedLocks []uint64) []Pair
 	BatchGet(ks [][]byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel, resolvedLocks []uint64) []Pair
@@ -278,9 +317,11 @@ type MVCCStore interface {
 	TxnHeartBeat(primaryKey []byte, startTS uint64, adviseTTL uint64) (uint64, error)
 	ResolveLock(startKey, endKey []byte, startTS, commitTS uint64) error
 	BatchResolveLock(startKey, endKey []byte, txnInfos map[uint64]uint64) error
+	ResolveLockByPrimary(startKey, endKey []byte, primaryKey []byte, startTS, commitTS uint64) error
 	GC(startKey, endKey []byte, safePoint uint64) error
 	DeleteRange(startKey, endKey []byte) error
-	CheckTxnStatus(primaryKey []byte, lockTS uint64, startTS, currentTS uint64, rollbackIfNotFound bool, resolvingPessimisticLock bool) (uint64, uint64, kvrpcpb.Action, error)
+	CheckTxnStatus(primaryKey []byte, lockTS uint64, startTS, currentTS uint64, rollbackIfNotFound bool, resolvingPessimisticLock bool, forceSyncCommit bool) (uint64, uint64, kvrpcpb.Action, *kvrpcpb.LockInfo, error)
+	CheckSecondaryLocks(keys [][]byte, startTS uint64) ([]*kvrpcpb.LockInfo, uint64, error)
 	Close() error
 }
 
@@ -296,15 +337,33 @@ type RawKV interface {
 	RawBatchDelete(cf string, keys [][]byte)
 	RawDeleteRange(cf string, startKey, endKey []byte)
 	RawCompareAndSwap(cf string, key, expectedValue, newvalue []byte) ([]byte, bool, error)
+	RawBatchPutMultiCF(entries []RawEntry) error
+}
+
+// RawEntry is a key-value pair written to a column family by RawBatchPutMultiCF.
+type RawEntry struct {
+	Cf    string
+	Key   []byte
+	Value []byte
 }
 
 // MVCCDebugger is for debugging.
 type MVCCDebugger interface {
 	MvccGetByStartTS(starTS uint64) (*kvrpcpb.MvccInfo, []byte)
 	MvccGetByKey(key []byte) *kvrpcpb.MvccInfo
+	GetHistory(key []byte, fromTS, toTS uint64) ([]HistoryVersion, error)
+}
+
+// HistoryVersion is a committed version of a key read by GetHistory.
+// Value is nil unless Op is kvrpcpb.Op_Put.
+type HistoryVersion struct {
+	CommitTS uint64
+	Op       kvrpcpb.Op
+	Value    []byte
 }
 
 // Pair is a KV pair read from MvccStore or an error if any occurs.
+// For Scan and ReverseScan, Err is always an *ErrLocked carrying the lock of Key.
 type Pair struct {
 	Key   []byte
 	Value []byte
@@ -94,6 +94,21 @@ type MVCCLevelDB struct {
 	// then write, another write may happen during it, so this lock is necessory.
 	mu               sync.RWMutex
 	deadlockDetector *deadlock.Detector
+	// shortValueMaxLen is the max length of values inlined in the write records.
+	shortValueMaxLen int
+	// maxValueSize is the max size of values accepted by Prewrite, 0 means unlimited.
+	maxValueSize int
+	// rawBatchWriteHook is called before RawBatchPutMultiCF writes to a column family, for testing only.
+	rawBatchWriteHook func(cf string) error
+	// assertionFailures are the injected assertion failures of Prewrite, keyed by the key and op of the mutation.
+	assertionFailures map[assertionFailureKey]*ErrAssertionFailed
+	// minCommitTSPushDisabled makes CheckTxnStatus never push forward the minCommitTS of an active lock.
+	minCommitTSPushDisabled bool
+}
+
+type assertionFailureKey struct {
+	key string
+	op  kvrpcpb.Op
 }
 
 const lockVer uint64 = math.MaxUint64
@@ -103,7 +118,8 @@ var ErrInvalidEncodedKey = errors.New("invalid encoded key")
 
 // mvccEncode returns the encoded key.
 func mvccEncode(key []byte, ver uint64) []byte {
-	b := codec.EncodeBytes(nil, key)
+	// Reserve the space of the version too, so that the slice isn't grown when appending it.
+	b := codec.EncodeBytes(make([]byte, 0, (len(key)/8+1)*9+8), key)
 	ret := codec.EncodeUintDesc(b, ver)
 	return ret
 }
@@ -111,8 +127,13 @@ func mvccEncode(key []byte, ver uint64) []byte {
 // mvccDecode parses the origin key and version of an encoded key, if the encoded key is a meta key,
 // just returns the origin key.
 func mvccDecode(encodedKey []byte) ([]byte, uint64, error) {
+	return mvccDecodeWithBuf(encodedKey, nil)
+}
+
+// mvccDecodeWithBuf is like mvccDecode, but decodes the origin key into buf if buf is not nil.
+func mvccDecodeWithBuf(encodedKey []byte, buf []byte) ([]byte, uint64, error) {
 	// Skip DataPrefix
-	remainBytes, key, err := codec.DecodeBytes(encodedKey, nil)
+	remainBytes, key, err := codec.DecodeBytes(encodedKey, buf)
 	if err != nil {
 		// should never happen
 		return nil, 0, err
@@ -160,6 +181,7 @@ func NewMVCCLevelDB(path string) (*MVCCLevelDB, error) {
 	mvccLevelDBs := &MVCCLevelDB{
 		dbs:              make(map[string]*leveldb.DB),
 		deadlockDetector: deadlock.NewDetector(),
+		shortValueMaxLen: defaultShortValueMaxLen,
 	}
 	mvccLevelDBs.dbs[defaultCf] = d
 	return mvccLevelDBs, nil
@@ -181,6 +203,11 @@ func (iter *Iterator) Valid() bool {
 	return iter.valid
 }
 
+// seek moves the iterator to the first key that is greater than or equal to the given key.
+func (iter *Iterator) seek(key []byte) {
+	iter.valid = iter.Iterator.Seek(key)
+}
+
 func newIterator(db *leveldb.DB, slice *util.Range) *Iterator {
 	iter := &Iterator{db.NewIterator(slice, nil), true}
 	iter.Next()
@@ -214,6 +241,24 @@ func newScanIterator(db *leveldb.DB, startKey, endKey []byte) (*Iterator, []byte
 type lockDecoder struct {
 	lock      mvccLock
 	expectKey []byte
+	// keyBuf is reused to decode the keys of the iterator.
+	keyBuf []byte
+}
+
+var lockDecoderPool = sync.Pool{
+	New: func() interface{} { return &lockDecoder{} },
+}
+
+// getLockDecoder gets a lockDecoder from the pool, it should be put back by putLockDecoder after use.
+func getLockDecoder(expectKey []byte) *lockDecoder {
+	dec := lockDecoderPool.Get().(*lockDecoder)
+	dec.expectKey = expectKey
+	return dec
+}
+
+func putLockDecoder(dec *lockDecoder) {
+	*dec = lockDecoder{keyBuf: dec.keyBuf}
+	lockDecoderPool.Put(dec)
 }
 
 // Decode decodes the lock value if current iterator is at expectKey::lock.
@@ -223,10 +268,11 @@ func (dec *lockDecoder) Decode(iter *Iterator) (bool, error) {
 	}
 
 	iterKey := iter.Key()
-	key, ver, err := mvccDecode(iterKey)
+	key, ver, err := mvccDecodeWithBuf(iterKey, dec.keyBuf)
 	if err != nil {
 		return false, err
 	}
+	dec.keyBuf = key
 	if !bytes.Equal(key, dec.expectKey) {
 		return false, nil
 	}
@@ -247,6 +293,24 @@ func (dec *lockDecoder) Decode(iter *Iterator) (bool, error) {
 type valueDecoder struct {
 	value     mvccValue
 	expectKey []byte
+	// keyBuf is reused to decode the keys of the iterator.
+	keyBuf []byte
+}
+
+var valueDecoderPool = sync.Pool{
+	New: func() interface{} { return &valueDecoder{} },
+}
+
+// getValueDecoder gets a valueDecoder from the pool, it should be put back by putValueDecoder after use.
+func getValueDecoder(expectKey []byte) *valueDecoder {
+	dec := valueDecoderPool.Get().(*valueDecoder)
+	dec.expectKey = expectKey
+	return dec
+}
+
+func putValueDecoder(dec *valueDecoder) {
+	*dec = valueDecoder{keyBuf: dec.keyBuf}
+	valueDecoderPool.Put(dec)
 }
 
 // Decode decodes a mvcc value if iter key is expectKey.
@@ -255,10 +319,11 @@ func (dec *valueDecoder) Decode(iter *Iterator) (bool, error) {
 		return false, iter.Error()
 	}
 
-	key, ver, err := mvccDecode(iter.Key())
+	key, ver, err := mvccDecodeWithBuf(iter.Key(), dec.keyBuf)
 	if err != nil {
 		return false, err
 	}
+	dec.keyBuf = key
 	if !bytes.Equal(key, dec.expectKey) {
 		return false, nil
 	}
@@ -278,6 +343,8 @@ func (dec *valueDecoder) Decode(iter *Iterator) (bool, error) {
 
 type skipDecoder struct {
 	currKey []byte
+	// keyBuf is reused to decode the keys of the iterator until a new key is found.
+	keyBuf []byte
 }
 
 // Decode skips the iterator as long as its key is currKey, the new key would be stored.
@@ -286,14 +353,17 @@ func (dec *skipDecoder) Decode(iter *Iterator) (bool, error) {
 		return false, iter.Error()
 	}
 	for iter.Valid() {
-		key, _, err := mvccDecode(iter.Key())
+		key, _, err := mvccDecodeWithBuf(iter.Key(), dec.keyBuf)
 		if err != nil {
 			return false, err
 		}
 		if !bytes.Equal(key, dec.currKey) {
+			// The new key owns the buffer now.
 			dec.currKey = key
+			dec.keyBuf = nil
 			return true, nil
 		}
+		dec.keyBuf = key
 		iter.Next()
 	}
 	return false, nil
@@ -308,6 +378,15 @@ func (mvcc *MVCCLevelDB) Get(key []byte, startTS uint64, isoLevel kvrpcpb.Isolat
 	return mvcc.getValue(key, startTS, isoLevel, resolvedLocks)
 }
 
+// FlashbackGet returns the value of the key committed at or before ts, or nil if the key doesn't exist at ts. Unlike
+// Get, it ignores the locks on the key, because flashback reads a historical snapshot which the locks don't affect.
+func (mvcc *MVCCLevelDB) FlashbackGet(key []byte, ts uint64) ([]byte, error) {
+	mvcc.mu.RLock()
+	defer mvcc.mu.RUnlock()
+
+	return mvcc.getValue(key, ts, kvrpcpb.IsolationLevel_RC, nil)
+}
+
 func (mvcc *MVCCLevelDB) getDB(cf string) *leveldb.DB {
 	if cf == "" {
 		cf = defaultCf
@@ -340,7 +419,8 @@ func (mvcc *MVCCLevelDB) getValue(key []byte, startTS uint64, isoLevel kvrpcpb.I
 }
 
 func getValue(iter *Iterator, key []byte, startTS uint64, isoLevel kvrpcpb.IsolationLevel, resolvedLocks []uint64) ([]byte, error) {
-	dec1 := lockDecoder{expectKey: key}
+	dec1 := getLockDecoder(key)
+	defer putLockDecoder(dec1)
 	ok, err := dec1.Decode(iter)
 	if ok && isoLevel == kvrpcpb.IsolationLevel_SI {
 		startTS, err = dec1.lock.check(startTS, key, resolvedLocks)
@@ -348,7 +428,8 @@ func getValue(iter *Iterator, key []byte, startTS uint64, isoLevel kvrpcpb.Isola
 	if err != nil {
 		return nil, err
 	}
-	dec2 := valueDecoder{expectKey: key}
+	dec2 := getValueDecoder(key)
+	defer putValueDecoder(dec2)
 	for iter.Valid() {
 		ok, err := dec2.Decode(iter)
 		if err != nil {
@@ -378,9 +459,14 @@ func (mvcc *MVCCLevelDB) BatchGet(ks [][]byte, startTS uint64, isoLevel kvrpcpb.
 	mvcc.mu.RLock()
 	defer mvcc.mu.RUnlock()
 
+	// All keys are read by one iterator.
+	iter := newIterator(mvcc.getDB(""), nil)
+	defer iter.Release()
+
 	pairs := make([]Pair, 0, len(ks))
 	for _, k := range ks {
-		v, err := mvcc.getValue(k, startTS, isoLevel, resolvedLocks)
+		iter.seek(mvccEncode(k, lockVer))
+		v, err := getValue(iter, k, startTS, isoLevel, resolvedLocks)
 		if v == nil && err == nil {
 			continue
 		}
@@ -407,9 +493,15 @@ func (mvcc *MVCCLevelDB) Scan(startKey, endKey []byte, limit int, startTS uint64
 
 	ok := true
 	var pairs []Pair
+	var skip skipDecoder
 	for len(pairs) < limit && ok {
 		value, err := getValue(iter, currKey, startTS, isoLevel, resolvedLock)
 		if err != nil {
+			// Only a lock is returned to the client to resolve, like ReverseScan does.
+			if _, ok := errors.Cause(err).(*ErrLocked); !ok {
+				logutil.BgLogger().Error("scan get value fail", zap.Error(err))
+				break
+			}
 			pairs = append(pairs, Pair{
 				Key: currKey,
 				Err: err,
@@ -422,7 +514,7 @@ func (mvcc *MVCCLevelDB) Scan(startKey, endKey []byte, limit int, startTS uint64
 			})
 		}
 
-		skip := skipDecoder{currKey}
+		skip.currKey = currKey
 		ok, err = skip.Decode(iter)
 		if err != nil {
 			logutil.BgLogger().Error("seek to next key error", zap.Error(err))
@@ -608,7 +700,7 @@ func (mvcc *MVCCLevelDB) pessimisticLockMutation(batch *leveldb.Batch, mutation
 	}
 	if ok {
 		if dec.lock.startTS != startTS {
-			errDeadlock := mvcc.deadlockDetector.Detect(startTS, dec.lock.startTS, farm.Fingerprint64(mutation.Key))
+			errDeadlock := mvcc.deadlockDetector.Detect(startTS, dec.lock.startTS, DeadlockKeyHash(mutation.Key))
 			if errDeadlock != nil {
 				return &ErrDeadlock{
 					LockKey:        mutation.Key,
@@ -642,7 +734,7 @@ func (mvcc *MVCCLevelDB) pessimisticLockMutation(batch *leveldb.Batch, mutation
 		forUpdateTS: forUpdateTS,
 		minCommitTS: lctx.minCommitTs,
 	}
-	writeKey := mvccEncode(mutation.Key, lockVer)
+	writeKey := startKey
 	writeValue, err := lock.MarshalBinary()
 	if err != nil {
 		return err
@@ -714,13 +806,17 @@ func (mvcc *MVCCLevelDB) Prewrite(req *kvrpcpb.PrewriteRequest) []error {
 	batch := &leveldb.Batch{}
 	errs := make([]error, 0, len(mutations))
 	txnSize := req.TxnSize
+	// All mutations are read by one iterator.
+	iter := newIterator(mvcc.getDB(""), nil)
+	defer iter.Release()
 	for i, m := range mutations {
 		// If the operation is Insert, check if key is exists at first.
 		var err error
 		// no need to check insert values for pessimistic transaction.
 		op := m.GetOp()
 		if (op == kvrpcpb.Op_Insert || op == kvrpcpb.Op_CheckNotExists) && forUpdateTS == 0 {
-			v, err := mvcc.getValue(m.Key, startTS, kvrpcpb.IsolationLevel_SI, req.Context.ResolvedLocks)
+			iter.seek(mvccEncode(m.Key, lockVer))
+			v, err := getValue(iter, m.Key, startTS, kvrpcpb.IsolationLevel_SI, req.Context.ResolvedLocks)
 			if err != nil {
 				errs = append(errs, err)
 				anyError = true
@@ -738,8 +834,23 @@ func (mvcc *MVCCLevelDB) Prewrite(req *kvrpcpb.PrewriteRequest) []error {
 		if op == kvrpcpb.Op_CheckNotExists {
 			continue
 		}
+		if mvcc.maxValueSize > 0 && len(m.Value) > mvcc.maxValueSize && (op == kvrpcpb.Op_Put || op == kvrpcpb.Op_Insert) {
+			errs = append(errs, &ErrValueTooLarge{
+				Key:     m.Key,
+				Size:    len(m.Value),
+				MaxSize: mvcc.maxValueSize,
+			})
+			anyError = true
+			continue
+		}
+		if assertionErr, ok := mvcc.assertionFailures[assertionFailureKey{string(m.Key), op}]; ok {
+			errs = append(errs, assertionErr)
+			anyError = true
+			continue
+		}
 		isPessimisticLock := len(req.IsPessimisticLock) > 0 && req.IsPessimisticLock[i]
-		err = prewriteMutation(mvcc.getDB(""), batch, m, startTS, primary, ttl, txnSize, isPessimisticLock, minCommitTS, req.AssertionLevel)
+		err = prewriteMutation(iter, batch, m, startTS, primary, ttl, txnSize, isPessimisticLock, minCommitTS, req.AssertionLevel,
+			req.UseAsyncCommit, req.Secondaries)
 		errs = append(errs, err)
 		if err != nil {
 			anyError = true
@@ -867,20 +978,17 @@ func checkConflictValue(iter *Iterator, m *kvrpcpb.Mutation, forUpdateTS uint64,
 	return nil, nil
 }
 
-func prewriteMutation(db *leveldb.DB, batch *leveldb.Batch,
+func prewriteMutation(iter *Iterator, batch *leveldb.Batch,
 	mutation *kvrpcpb.Mutation, startTS uint64,
 	primary []byte, ttl uint64, txnSize uint64,
 	isPessimisticLock bool, minCommitTS uint64,
-	assertionLevel kvrpcpb.AssertionLevel) error {
+	assertionLevel kvrpcpb.AssertionLevel,
+	useAsyncCommit bool, secondaries [][]byte) error {
 	startKey := mvccEncode(mutation.Key, lockVer)
-	iter := newIterator(db, &util.Range{
-		Start: startKey,
-	})
-	defer iter.Release()
+	iter.seek(startKey)
 
-	dec := lockDecoder{
-		expectKey: mutation.Key,
-	}
+	dec := getLockDecoder(mutation.Key)
+	defer putLockDecoder(dec)
 	ok, err := dec.Decode(iter)
 	if err != nil {
 		return err
@@ -932,13 +1040,18 @@ func prewriteMutation(db *leveldb.DB, batch *leveldb.Batch,
 		op:      op,
 		ttl:     ttl,
 		txnSize: txnSize,
+
+		useAsyncCommit: useAsyncCommit,
 	}
 	// Write minCommitTS on the primary lock.
 	if bytes.Equal(primary, mutation.GetKey()) {
 		lock.minCommitTS = minCommitTS
+		if useAsyncCommit {
+			lock.secondaries = secondaries
+		}
 	}
 
-	writeKey := mvccEncode(mutation.Key, lockVer)
+	writeKey := startKey
 	writeValue, err := lock.MarshalBinary()
 	if err != nil {
 		return err
@@ -957,8 +1070,11 @@ func (mvcc *MVCCLevelDB) Commit(keys [][]byte, startTS, commitTS uint64) error {
 	}()
 
 	batch := &leveldb.Batch{}
+	// All keys are read by one iterator.
+	iter := newIterator(mvcc.getDB(""), nil)
+	defer iter.Release()
 	for _, k := range keys {
-		err := commitKey(mvcc.getDB(""), batch, k, startTS, commitTS)
+		err := commitKey(iter, batch, k, startTS, commitTS)
 		if err != nil {
 			return err
 		}
@@ -966,16 +1082,14 @@ func (mvcc *MVCCLevelDB) Commit(keys [][]byte, startTS, commitTS uint64) error {
 	return mvcc.getDB("").Write(batch, nil)
 }
 
-func commitKey(db *leveldb.DB, batch *leveldb.Batch, key []byte, startTS, commitTS uint64) error {
-	startKey := mvccEncode(key, lockVer)
-	iter := newIterator(db, &util.Range{
-		Start: startKey,
-	})
-	defer iter.Release()
-
-	dec := lockDecoder{
-		expectKey: key,
+func commitKey(iter *Iterator, batch *leveldb.Batch, key []byte, startTS, commitTS uint64) error {
+	if commitTS <= startTS {
+		return &ErrInvalidCommitTS{StartTS: startTS, CommitTS: commitTS}
 	}
+	iter.seek(mvccEncode(key, lockVer))
+
+	dec := getLockDecoder(key)
+	defer putLockDecoder(dec)
 	ok, err := dec.Decode(iter)
 	if err != nil {
 		return err
@@ -985,10 +1099,14 @@ func commitKey(db *leveldb.DB, batch *leveldb.Batch, key []byte, startTS, commit
 		// another transaction, check commit information of this transaction.
 		c, ok, err1 := getTxnCommitInfo(iter, key, startTS)
 		if err1 != nil {
-			return err
+			return err1
 		}
 		if ok && c.valueType != typeRollback {
-			// c.valueType != typeRollback means the transaction is already committed, do nothing.
+			// c.valueType != typeRollback means the transaction is already committed. It's fine to commit it
+			// again with the same commitTS, but a different commitTS must be a bug of the client.
+			if c.commitTS != commitTS {
+				return &ErrCommitTSMismatch{Key: key, StartTS: startTS, CommitTS: commitTS, ExistingCommitTS: c.commitTS}
+			}
 			return nil
 		}
 		return ErrRetryable("txn not found")
@@ -1044,8 +1162,11 @@ func (mvcc *MVCCLevelDB) Rollback(keys [][]byte, startTS uint64) error {
 	}()
 
 	batch := &leveldb.Batch{}
+	// All keys are read by one iterator.
+	iter := newIterator(mvcc.getDB(""), nil)
+	defer iter.Release()
 	for _, k := range keys {
-		err := rollbackKey(mvcc.getDB(""), batch, k, startTS)
+		err := rollbackKey(iter, batch, k, startTS)
 		if err != nil {
 			return err
 		}
@@ -1053,43 +1174,37 @@ func (mvcc *MVCCLevelDB) Rollback(keys [][]byte, startTS uint64) error {
 	return mvcc.getDB("").Write(batch, nil)
 }
 
-func rollbackKey(db *leveldb.DB, batch *leveldb.Batch, key []byte, startTS uint64) error {
-	startKey := mvccEncode(key, lockVer)
-	iter := newIterator(db, &util.Range{
-		Start: startKey,
-	})
-	defer iter.Release()
+func rollbackKey(iter *Iterator, batch *leveldb.Batch, key []byte, startTS uint64) error {
+	iter.seek(mvccEncode(key, lockVer))
 
-	if iter.Valid() {
-		dec := lockDecoder{
-			expectKey: key,
-		}
-		ok, err := dec.Decode(iter)
-		if err != nil {
+	dec := getLockDecoder(key)
+	defer putLockDecoder(dec)
+	ok, err := dec.Decode(iter)
+	if err != nil {
+		return err
+	}
+	// If current transaction's lock exist.
+	if ok && dec.lock.startTS == startTS {
+		if err = rollbackLock(batch, key, startTS); err != nil {
 			return err
 		}
-		// If current transaction's lock exist.
-		if ok && dec.lock.startTS == startTS {
-			if err = rollbackLock(batch, key, startTS); err != nil {
-				return err
-			}
-			return nil
-		}
+		return nil
+	}
 
-		// If current transaction's lock not exist.
-		// If commit info of current transaction exist.
-		c, ok, err := getTxnCommitInfo(iter, key, startTS)
-		if err != nil {
-			return err
-		}
-		if ok {
-			// If current transaction is already committed.
-			if c.valueType != typeRollback {
-				return ErrAlreadyCommitted(c.commitTS)
-			}
-			// If current transaction is already rollback.
-			return nil
+	// If current transaction's lock not exist.
+	// If commit info of current transaction exist. The write records are always checked, so that a committed
+	// transaction is never rolled back no matter where the iterator is.
+	c, ok, err := getTxnCommitInfo(iter, key, startTS)
+	if err != nil {
+		return err
+	}
+	if ok {
+		// If current transaction is already committed.
+		if c.valueType != typeRollback {
+			return ErrAlreadyCommitted(c.commitTS)
 		}
+		// If current transaction is already rollback.
+		return nil
 	}
 
 	// If current transaction is not prewritted before.
@@ -1148,6 +1263,38 @@ func getTxnCommitInfo(iter *Iterator, expectKey []byte, startTS uint64) (mvccVal
 	return mvccValue{}, false, nil
 }
 
+// GetCommitTS returns the commit ts of the transaction started at startTS on the key.
+// It returns 0 if the transaction is still locked, rolled back or never prewritten on the key.
+// It's a read-only operation for tests to verify where a commit landed.
+func (mvcc *MVCCLevelDB) GetCommitTS(key []byte, startTS uint64) (uint64, error) {
+	mvcc.mu.RLock()
+	defer mvcc.mu.RUnlock()
+
+	iter := newIterator(mvcc.getDB(""), &util.Range{
+		Start: mvccEncode(key, lockVer),
+	})
+	defer iter.Release()
+
+	dec := lockDecoder{
+		expectKey: key,
+	}
+	ok, err := dec.Decode(iter)
+	if err != nil {
+		return 0, err
+	}
+	if ok && dec.lock.startTS == startTS {
+		return 0, nil
+	}
+	c, ok, err := getTxnCommitInfo(iter, key, startTS)
+	if err != nil {
+		return 0, err
+	}
+	if !ok || c.valueType == typeRollback {
+		return 0, nil
+	}
+	return c.commitTS, nil
+}
+
 // Cleanup implements the MVCCStore interface.
 // Cleanup API is deprecated, use CheckTxnStatus instead.
 func (mvcc *MVCCLevelDB) Cleanup(key []byte, startTS, currentTS uint64) error {
@@ -1225,11 +1372,14 @@ func (mvcc *MVCCLevelDB) Cleanup(key []byte, startTS, currentTS uint64) error {
 // Note that CheckTxnStatus may also push forward the `minCommitTS` of the
 // transaction, so it's not simply a read-only operation.
 //
+// If the primary lock is written by an async-commit transaction and forceSyncCommit is false, the lock is returned
+// as it is.
+//
 // primaryKey + lockTS together could locate the primary lock.
 // callerStartTS is the start ts of reader transaction.
 // currentTS is the current ts, but it may be inaccurate. Just use it to check TTL.
 func (mvcc *MVCCLevelDB) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS, currentTS uint64,
-	rollbackIfNotExist bool, resolvingPessimisticLock bool) (ttl uint64, commitTS uint64, action kvrpcpb.Action, err error) {
+	rollbackIfNotExist bool, resolvingPessimisticLock bool, forceSyncCommit bool) (ttl uint64, commitTS uint64, action kvrpcpb.Action, lockInfo *kvrpcpb.LockInfo, err error) {
 	mvcc.mu.Lock()
 	defer mvcc.mu.Unlock()
 
@@ -1255,6 +1405,12 @@ func (mvcc *MVCCLevelDB) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS
 			lock := dec.lock
 			batch := &leveldb.Batch{}
 
+			// Never roll back or push forward an async-commit lock, the status of the transaction is determined by
+			// CheckSecondaryLocks. The lock is returned with its secondaries for the caller to check them.
+			if lock.useAsyncCommit && !forceSyncCommit {
+				return lock.ttl, 0, action, lock.lockInfo(primaryKey), nil
+			}
+
 			// If the lock has already outdated, clean up it.
 			if uint64(oracle.ExtractPhysical(lock.startTS))+lock.ttl < uint64(oracle.ExtractPhysical(currentTS)) {
 				if resolvingPessimisticLock && lock.op == kvrpcpb.Op_PessimisticLock {
@@ -1272,7 +1428,12 @@ func (mvcc *MVCCLevelDB) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS
 					err = errors.WithStack(err)
 					return
 				}
-				return 0, 0, action, nil
+				return 0, 0, action, nil, nil
+			}
+
+			// Pretend the minCommitTS can't be pushed, the caller has to wait for the lock.
+			if mvcc.minCommitTSPushDisabled {
+				return lock.ttl, 0, action, nil, nil
 			}
 
 			// If the caller_start_ts is MaxUint64, it's a point get in the autocommit transaction.
@@ -1310,7 +1471,7 @@ func (mvcc *MVCCLevelDB) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS
 				}
 			}
 
-			return lock.ttl, 0, action, nil
+			return lock.ttl, 0, action, nil, nil
 		}
 
 		// If current transaction's lock does not exist.
@@ -1323,10 +1484,10 @@ func (mvcc *MVCCLevelDB) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS
 		if ok {
 			// If current transaction is already committed.
 			if c.valueType != typeRollback {
-				return 0, c.commitTS, action, nil
+				return 0, c.commitTS, action, nil, nil
 			}
 			// If current transaction is already rollback.
-			return 0, 0, kvrpcpb.Action_NoAction, nil
+			return 0, 0, kvrpcpb.Action_NoAction, nil, nil
 		}
 	}
 
@@ -1339,7 +1500,7 @@ func (mvcc *MVCCLevelDB) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS
 
 	if rollbackIfNotExist {
 		if resolvingPessimisticLock {
-			return 0, 0, kvrpcpb.Action_LockNotExistDoNothing, nil
+			return 0, 0, kvrpcpb.Action_LockNotExistDoNothing, nil, nil
 		}
 		// Write rollback record, but not delete the lock on the primary key. There may exist lock which has
 		// different lock.startTS with input lockTS, for example the primary key could be already
@@ -1354,15 +1515,70 @@ func (mvcc *MVCCLevelDB) CheckTxnStatus(primaryKey []byte, lockTS, callerStartTS
 			err = errors.WithStack(err1)
 			return
 		}
-		return 0, 0, kvrpcpb.Action_LockNotExistRollback, nil
+		return 0, 0, kvrpcpb.Action_LockNotExistRollback, nil, nil
 	}
 
-	return 0, 0, action, &ErrTxnNotFound{kvrpcpb.TxnNotFound{
+	return 0, 0, action, nil, &ErrTxnNotFound{kvrpcpb.TxnNotFound{
 		StartTs:    lockTS,
 		PrimaryKey: primaryKey,
 	}}
 }
 
+// CheckSecondaryLocks implements the MVCCStore interface.
+// It returns the locks of the async-commit transaction started at startTS on all the keys. If a key isn't locked by
+// the transaction, the transaction must have been committed or rolled back, and no lock is returned: the commitTS is
+// returned if it's committed, otherwise 0 is returned and a rollback record is written on the key, so that the lock
+// can't be prewritten later.
+func (mvcc *MVCCLevelDB) CheckSecondaryLocks(keys [][]byte, startTS uint64) ([]*kvrpcpb.LockInfo, uint64, error) {
+	mvcc.mu.Lock()
+	defer mvcc.mu.Unlock()
+
+	// All keys are read by one iterator.
+	iter := newIterator(mvcc.getDB(""), nil)
+	defer iter.Release()
+	locks := make([]*kvrpcpb.LockInfo, 0, len(keys))
+	for _, key := range keys {
+		iter.seek(mvccEncode(key, lockVer))
+		dec := lockDecoder{
+			expectKey: key,
+		}
+		ok, err := dec.Decode(iter)
+		if err != nil {
+			return nil, 0, err
+		}
+		batch := &leveldb.Batch{}
+		if ok && dec.lock.startTS == startTS {
+			if dec.lock.op != kvrpcpb.Op_PessimisticLock {
+				locks = append(locks, dec.lock.lockInfo(key))
+				continue
+			}
+			// The transaction hasn't prewritten the key, roll back the pessimistic lock.
+			if err = rollbackLock(batch, key, startTS); err != nil {
+				return nil, 0, err
+			}
+		} else {
+			c, ok, err := getTxnCommitInfo(iter, key, startTS)
+			if err != nil {
+				return nil, 0, err
+			}
+			if ok && c.valueType != typeRollback {
+				return nil, c.commitTS, nil
+			}
+			if ok {
+				return nil, 0, nil
+			}
+			if err = writeRollback(batch, key, startTS); err != nil {
+				return nil, 0, err
+			}
+		}
+		if err = mvcc.getDB("").Write(batch, nil); err != nil {
+			return nil, 0, errors.WithStack(err)
+		}
+		return nil, 0, nil
+	}
+	return locks, 0, nil
+}
+
 // TxnHeartBeat implements the MVCCStore interface.
 func (mvcc *MVCCLevelDB) TxnHeartBeat(key []byte, startTS uint64, adviseTTL uint64) (uint64, error) {
 	mvcc.mu.Lock()
@@ -1524,6 +1740,47 @@ func (mvcc *MVCCLevelDB) BatchResolveLock(startKey, endKey []byte, txnInfos map[
 	return mvcc.getDB("").Write(batch, nil)
 }
 
+// ResolveLockByPrimary implements the MVCCStore interface. It resolves the locks in the range of the transaction
+// whose primary is primaryKey, with the status the caller has determined from the primary, i.e. commits them if
+// commitTS > 0, otherwise rolls them back. It models resolving the secondaries of a transaction region by region.
+func (mvcc *MVCCLevelDB) ResolveLockByPrimary(startKey, endKey []byte, primaryKey []byte, startTS, commitTS uint64) error {
+	mvcc.mu.Lock()
+	defer mvcc.mu.Unlock()
+
+	iter, currKey, err := newScanIterator(mvcc.getDB(""), startKey, endKey)
+	defer iter.Release()
+	if err != nil {
+		return err
+	}
+
+	batch := &leveldb.Batch{}
+	for iter.Valid() {
+		dec := lockDecoder{expectKey: currKey}
+		ok, err := dec.Decode(iter)
+		if err != nil {
+			return err
+		}
+		if ok && dec.lock.startTS == startTS && bytes.Equal(dec.lock.primary, primaryKey) {
+			if commitTS > 0 {
+				err = commitLock(batch, dec.lock, currKey, startTS, commitTS)
+			} else {
+				err = rollbackLock(batch, currKey, startTS)
+			}
+			if err != nil {
+				return err
+			}
+		}
+
+		skip := skipDecoder{currKey: currKey}
+		_, err = skip.Decode(iter)
+		if err != nil {
+			return err
+		}
+		currKey = skip.currKey
+	}
+	return mvcc.getDB("").Write(batch, nil)
+}
+
 // GC implements the MVCCStore interface
 func (mvcc *MVCCLevelDB) GC(startKey, endKey []byte, safePoint uint64) error {
 	mvcc.mu.Lock()
@@ -1604,6 +1861,17 @@ func (mvcc *MVCCLevelDB) Close() error {
 	return mvcc.getDB("").Close()
 }
 
+// DeadlockDetector returns the deadlock detector used by pessimistic locking,
+// tests can use it to seed or inspect the wait-for graph and force deadlocks.
+func (mvcc *MVCCLevelDB) DeadlockDetector() *deadlock.Detector {
+	return mvcc.deadlockDetector
+}
+
+// DeadlockKeyHash returns the hash of the key used by the deadlock detector.
+func DeadlockKeyHash(key []byte) uint64 {
+	return farm.Fingerprint64(key)
+}
+
 // RawPut implements the RawKV interface.
 func (mvcc *MVCCLevelDB) RawPut(cf string, key, value []byte) {
 	mvcc.mu.Lock()
@@ -1648,6 +1916,98 @@ func (mvcc *MVCCLevelDB) RawBatchPut(cf string, keys, values [][]byte) {
 	tikverr.Log(db.Write(batch, nil))
 }
 
+// rawStagedBatch is the write to a column family staged by RawBatchPutMultiCF.
+type rawStagedBatch struct {
+	cf    string
+	db    *leveldb.DB
+	isNew bool
+	batch leveldb.Batch
+	// undo restores the keys written by batch to their old values.
+	undo leveldb.Batch
+	keys map[string]struct{}
+}
+
+// RawBatchPutMultiCF implements the RawKV interface. The entries are written to their column families atomically:
+// the writes and the old values of the keys are staged before writing anything, and if the write to any column
+// family fails, the column families written already are restored, so nothing is applied.
+func (mvcc *MVCCLevelDB) RawBatchPutMultiCF(entries []RawEntry) (err error) {
+	mvcc.mu.Lock()
+	defer mvcc.mu.Unlock()
+
+	var staged []*rawStagedBatch
+	stagedByCF := make(map[string]*rawStagedBatch)
+	defer func() {
+		if err == nil {
+			return
+		}
+		// The column families created by the write are dropped.
+		for _, s := range staged {
+			if s.isNew {
+				tikverr.Log(s.db.Close())
+			}
+		}
+	}()
+	for _, entry := range entries {
+		cf := entry.Cf
+		if cf == "" {
+			cf = defaultCf
+		}
+		s, ok := stagedByCF[cf]
+		if !ok {
+			s = &rawStagedBatch{cf: cf, db: mvcc.getDB(cf), keys: make(map[string]struct{})}
+			if s.db == nil {
+				s.db, err = leveldb.Open(storage.NewMemStorage(), nil)
+				if err != nil {
+					return errors.WithStack(err)
+				}
+				s.isNew = true
+			}
+			staged = append(staged, s)
+			stagedByCF[cf] = s
+		}
+		value := entry.Value
+		if value == nil {
+			value = []byte{}
+		}
+		s.batch.Put(entry.Key, value)
+		if _, ok := s.keys[string(entry.Key)]; ok || s.isNew {
+			continue
+		}
+		s.keys[string(entry.Key)] = struct{}{}
+		old, err := s.db.Get(entry.Key, nil)
+		if err == leveldb.ErrNotFound {
+			s.undo.Delete(entry.Key)
+		} else if err != nil {
+			return errors.WithStack(err)
+		} else {
+			s.undo.Put(entry.Key, old)
+		}
+	}
+
+	for i, s := range staged {
+		if mvcc.rawBatchWriteHook != nil {
+			err = mvcc.rawBatchWriteHook(s.cf)
+		}
+		if err == nil {
+			err = s.db.Write(&s.batch, nil)
+		}
+		if err != nil {
+			for _, written := range staged[:i] {
+				if !written.isNew {
+					tikverr.Log(written.db.Write(&written.undo, nil))
+				}
+			}
+			return errors.WithStack(err)
+		}
+	}
+	for _, s := range staged {
+		if s.isNew {
+			mvcc.dbs[s.cf] = s.db
+		}
+	}
+	return nil
+}
+
 // RawGet implements the RawKV interface.
 func (mvcc *MVCCLevelDB) RawGet(cf string, key []byte) []byte {
 	mvcc.mu.Lock()
@@ -1898,7 +2258,7 @@ func (mvcc *MVCCLevelDB) mvccGetByKeyNoLock(key []byte) *kvrpcpb.MvccInfo {
 	}
 	if ok {
 		var shortValue []byte
-		if isShortValue(dec1.lock.value) {
+		if mvcc.isShortValue(dec1.lock.value) {
 			shortValue = dec1.lock.value
 		}
 		info.Lock = &kvrpcpb.MvccLock{
@@ -1922,7 +2282,7 @@ func (mvcc *MVCCLevelDB) mvccGetByKeyNoLock(key []byte) *kvrpcpb.MvccInfo {
 			break
 		}
 		var shortValue []byte
-		if isShortValue(dec2.value.value) {
+		if mvcc.isShortValue(dec2.value.value) {
 			shortValue = dec2.value.value
 		}
 		write := &kvrpcpb.MvccWrite{
@@ -1944,8 +2304,90 @@ func (mvcc *MVCCLevelDB) mvccGetByKeyNoLock(key []byte) *kvrpcpb.MvccInfo {
 	return info
 }
 
-const shortValueMaxLen = 64
+// GetHistory implements the MVCCDebugger interface. It returns the committed versions of the key whose
+// commitTS is in [fromTS, toTS], from the newest to the oldest. Rollback records are skipped.
+func (mvcc *MVCCLevelDB) GetHistory(key []byte, fromTS, toTS uint64) ([]HistoryVersion, error) {
+	mvcc.mu.RLock()
+	defer mvcc.mu.RUnlock()
+
+	if fromTS > toTS {
+		return nil, nil
+	}
+	// Versions are sorted in descending order, so seeking to toTS skips the lock and the newer versions.
+	iter := newIterator(mvcc.getDB(""), &util.Range{
+		Start: mvccEncode(key, toTS),
+	})
+	defer iter.Release()
+
+	dec := getValueDecoder(key)
+	defer putValueDecoder(dec)
+	var history []HistoryVersion
+	for {
+		ok, err := dec.Decode(iter)
+		if err != nil {
+			return nil, err
+		}
+		if !ok || dec.value.commitTS < fromTS {
+			break
+		}
+		if dec.value.valueType == typeRollback {
+			continue
+		}
+		version := HistoryVersion{
+			CommitTS: dec.value.commitTS,
+			Op:       valueTypeOpMap[dec.value.valueType],
+		}
+		if dec.value.valueType == typePut {
+			version.Value = dec.value.value
+		}
+		history = append(history, version)
+	}
+	return history, nil
+}
+
+const defaultShortValueMaxLen = 64
+
+// SetShortValueMaxLen sets the max length of values inlined in the write records, which
+// affects the short values returned by MvccGetByKey and MvccGetByStartTS. The default is 64.
+func (mvcc *MVCCLevelDB) SetShortValueMaxLen(maxLen int) {
+	mvcc.mu.Lock()
+	mvcc.shortValueMaxLen = maxLen
+	mvcc.mu.Unlock()
+}
+
+// SetMaxValueSize sets the max size of values accepted by Prewrite. Prewriting a larger value fails with
+// ErrValueTooLarge. A non-positive size means unlimited, which is the default.
+func (mvcc *MVCCLevelDB) SetMaxValueSize(size int) {
+	mvcc.mu.Lock()
+	mvcc.maxValueSize = size
+	mvcc.mu.Unlock()
+}
+
+// SetAssertionFailure makes Prewrite fail the mutations of err.Key with the op with err, so that the handling of
+// assertion failures can be tested without constructing the MVCC state that fails the assertion. A nil err clears
+// all the injected failures. No failure is injected by default.
+func (mvcc *MVCCLevelDB) SetAssertionFailure(op kvrpcpb.Op, err *ErrAssertionFailed) {
+	mvcc.mu.Lock()
+	defer mvcc.mu.Unlock()
+	if err == nil {
+		mvcc.assertionFailures = nil
+		return
+	}
+	if mvcc.assertionFailures == nil {
+		mvcc.assertionFailures = make(map[assertionFailureKey]*ErrAssertionFailed)
+	}
+	mvcc.assertionFailures[assertionFailureKey{string(err.Key), op}] = err
+}
+
+// SetMinCommitTSPushDisabled makes CheckTxnStatus return Action_NoAction for an active lock without pushing forward
+// its minCommitTS if disabled is true, so that the reaction of the client to a lock that can't be pushed can be
+// tested. The minCommitTS is pushed by default.
+func (mvcc *MVCCLevelDB) SetMinCommitTSPushDisabled(disabled bool) {
+	mvcc.mu.Lock()
+	mvcc.minCommitTSPushDisabled = disabled
+	mvcc.mu.Unlock()
+}
 
-func isShortValue(value []byte) bool {
-	return len(value) <= shortValueMaxLen
+func (mvcc *MVCCLevelDB) isShortValue(value []byte) bool {
+	return len(value) <= mvcc.shortValueMaxLen
 }
@@ -53,8 +53,39 @@ var tsMu = struct {
 	sync.Mutex
 	physicalTS int64
 	logicalTS  int64
+	policy     ClockSkewPolicy
+	now        func() time.Time
 }{}
 
+// ClockSkewPolicy is how the mock PD handles the clock going backward relative to the last issued timestamp.
+type ClockSkewPolicy int
+
+const (
+	// ClockSkewClamp keeps the timestamps monotonic by increasing the logical part of the last issued one. It's the
+	// default.
+	ClockSkewClamp ClockSkewPolicy = iota
+	// ClockSkewError makes GetTS return ErrClockSkew, so that tests can check how the client reacts to TSO anomalies.
+	ClockSkewError
+)
+
+// ErrClockSkew is returned by GetTS when the clock goes backward and the policy is ClockSkewError.
+var ErrClockSkew = errors.New("clock goes backward")
+
+// SetClockSkewPolicy sets how all mock PD clients handle the clock going backward.
+func SetClockSkewPolicy(policy ClockSkewPolicy) {
+	tsMu.Lock()
+	defer tsMu.Unlock()
+	tsMu.policy = policy
+}
+
+// SetClock replaces the clock which all mock PD clients get the physical time of timestamps from. A nil clock
+// restores time.Now.
+func SetClock(now func() time.Time) {
+	tsMu.Lock()
+	defer tsMu.Unlock()
+	tsMu.now = now
+}
+
 type pdClient struct {
 	cluster *Cluster
 	// SafePoint set by `UpdateGCSafePoint`. Not to be confused with SafePointKV.
@@ -94,7 +125,14 @@ func (c *pdClient) GetTS(context.Context) (int64, int64, error) {
 	tsMu.Lock()
 	defer tsMu.Unlock()
 
-	ts := time.Now().UnixNano() / int64(time.Millisecond)
+	now := time.Now
+	if tsMu.now != nil {
+		now = tsMu.now
+	}
+	ts := now().UnixNano() / int64(time.Millisecond)
+	if tsMu.physicalTS > ts && tsMu.policy == ClockSkewError {
+		return 0, 0, errors.Wrapf(ErrClockSkew, "physical time %d is behind the last issued %d", ts, tsMu.physicalTS)
+	}
 	if tsMu.physicalTS >= ts {
 		tsMu.logicalTS++
 	} else {
@@ -138,8 +176,11 @@ func (c *pdClient) GetRegion(ctx context.Context, key []byte, opts ...pd.GetRegi
 	return &pd.Region{Meta: region, Leader: peer, Buckets: buckets}, nil
 }
 
+// GetRegionFromMember returns the region containing the key like GetRegion. The mock cluster has no PD members, so
+// memberURLs is ignored.
 func (c *pdClient) GetRegionFromMember(ctx context.Context, key []byte, memberURLs []string) (*pd.Region, error) {
-	return &pd.Region{}, nil
+	region, peer, _ := c.cluster.GetRegionByKey(key)
+	return &pd.Region{Meta: region, Leader: peer}, nil
 }
 
 func (c *pdClient) GetPrevRegion(ctx context.Context, key []byte, opts ...pd.GetRegionOption) (*pd.Region, error) {
@@ -0,0 +1,80 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package mocktikv
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGetRegionFromMember(t *testing.T) {
+	mvccStore := MustNewMVCCStore()
+	defer mvccStore.Close()
+	cluster := NewCluster(mvccStore)
+	_, regionIDs, _ := BootstrapWithMultiRegions(cluster, []byte("m"))
+	pdClient := NewPDClient(cluster)
+
+	for _, c := range []struct {
+		key      string
+		regionID uint64
+	}{
+		{"a", regionIDs[0]},
+		{"m", regionIDs[1]},
+		{"z", regionIDs[1]},
+	} {
+		expected, err := pdClient.GetRegion(context.Background(), []byte(c.key))
+		require.Nil(t, err)
+		region, err := pdClient.GetRegionFromMember(context.Background(), []byte(c.key), []string{"http://pd:2379"})
+		require.Nil(t, err)
+		require.Equal(t, c.regionID, region.Meta.GetId())
+		require.Equal(t, expected.Meta, region.Meta)
+		require.Equal(t, expected.Leader, region.Leader)
+	}
+}
+
+func TestGetTSClockSkew(t *testing.T) {
+	defer SetClock(nil)
+	defer SetClockSkewPolicy(ClockSkewClamp)
+	pdClient := NewPDClient(nil)
+	ctx := context.Background()
+
+	base := time.Now()
+	SetClock(func() time.Time { return base })
+	physical, logical, err := pdClient.GetTS(ctx)
+	require.Nil(t, err)
+	require.Equal(t, base.UnixNano()/int64(time.Millisecond), physical)
+
+	// The clock goes backward.
+	SetClock(func() time.Time { return base.Add(-10 * time.Millisecond) })
+	physical1, logical1, err := pdClient.GetTS(ctx)
+	require.Nil(t, err)
+	require.Equal(t, physical, physical1)
+	require.Equal(t, logical+1, logical1)
+
+	SetClockSkewPolicy(ClockSkewError)
+	_, _, err = pdClient.GetTS(ctx)
+	require.Equal(t, ErrClockSkew, errors.Cause(err))
+
+	// The clock catches up.
+	SetClock(func() time.Time { return base.Add(10 * time.Millisecond) })
+	physical2, logical2, err := pdClient.GetTS(ctx)
+	require.Nil(t, err)
+	require.Equal(t, physical+10, physical2)
+	require.Equal(t, int64(0), logical2)
+}
@@ -175,7 +175,7 @@ func (h kvHandler) handleKvGet(req *kvrpcpb.GetRequest) *kvrpcpb.GetResponse {
 		panic("KvGet: key not in region")
 	}
 
-	val, err := h.mvccStore.Get(req.Key, req.GetVersion(), h.isolationLevel, req.Context.GetResolvedLocks())
+	val, err := h.mvccStore.Get(req.Key, h.readTS(req.GetVersion()), h.isolationLevel, req.Context.GetResolvedLocks())
 	if err != nil {
 		return &kvrpcpb.GetResponse{
 			Error: convertToKeyError(err),
@@ -310,11 +310,27 @@ func (h kvHandler) handleKvCheckTxnStatus(req *kvrpcpb.CheckTxnStatusRequest) *k
 		panic("KvCheckTxnStatus: key not in region")
 	}
 	var resp kvrpcpb.CheckTxnStatusResponse
-	ttl, commitTS, action, err := h.mvccStore.CheckTxnStatus(req.GetPrimaryKey(), req.GetLockTs(), req.GetCallerStartTs(), req.GetCurrentTs(), req.GetRollbackIfNotExist(), req.ResolvingPessimisticLock)
+	ttl, commitTS, action, lockInfo, err := h.mvccStore.CheckTxnStatus(req.GetPrimaryKey(), req.GetLockTs(), req.GetCallerStartTs(), req.GetCurrentTs(), req.GetRollbackIfNotExist(), req.ResolvingPessimisticLock, req.ForceSyncCommit)
 	if err != nil {
 		resp.Error = convertToKeyError(err)
 	} else {
-		resp.LockTtl, resp.CommitVersion, resp.Action = ttl, commitTS, action
+		resp.LockTtl, resp.CommitVersion, resp.Action, resp.LockInfo = ttl, commitTS, action, lockInfo
+	}
+	return &resp
+}
+
+func (h kvHandler) handleCheckSecondaryLocks(req *kvrpcpb.CheckSecondaryLocksRequest) *kvrpcpb.CheckSecondaryLocksResponse {
+	for _, k := range req.Keys {
+		if !h.checkKeyInRegion(k) {
+			panic("CheckSecondaryLocks: key not in region")
+		}
+	}
+	var resp kvrpcpb.CheckSecondaryLocksResponse
+	locks, commitTS, err := h.mvccStore.CheckSecondaryLocks(req.Keys, req.GetStartVersion())
+	if err != nil {
+		resp.Error = convertToKeyError(err)
+	} else {
+		resp.Locks, resp.CommitTs = locks, commitTS
 	}
 	return &resp
 }
@@ -338,7 +354,7 @@ func (h kvHandler) handleKvBatchGet(req *kvrpcpb.BatchGetRequest) *kvrpcpb.Batch
 			panic("KvBatchGet: key not in region")
 		}
 	}
-	pairs := h.mvccStore.BatchGet(req.Keys, req.GetVersion(), h.isolationLevel, req.Context.GetResolvedLocks())
+	pairs := h.mvccStore.BatchGet(req.Keys, h.readTS(req.GetVersion()), h.isolationLevel, req.Context.GetResolvedLocks())
 	return &kvrpcpb.BatchGetResponse{
 		Pairs: convertToPbPairs(pairs),
 	}
@@ -668,7 +684,7 @@ func (c *RPCClient) getAndCheckStoreByAddr(addr string) (*metapb.Store, error) {
 	return nil, errors.New("connection refused")
 }
 
-func (c *RPCClient) checkArgs(ctx context.Context, addr string) (*Session, error) {
+func (c *RPCClient) checkArgs(ctx context.Context, addr, forwardedHost string) (*Session, error) {
 	if err := checkGoContext(ctx); err != nil {
 		return nil, err
 	}
@@ -677,6 +693,17 @@ func (c *RPCClient) checkArgs(ctx context.Context, addr string) (*Session, error
 	if err != nil {
 		return nil, err
 	}
+	if c.Cluster.IsStorePartitioned(store.GetId()) {
+		return nil, errors.Errorf("connection refused, store %d is partitioned", store.GetId())
+	}
+	// The request is forwarded to the store of forwardedHost by the store of addr, so the partition of the former
+	// doesn't matter.
+	if len(forwardedHost) > 0 {
+		store, err = c.getAndCheckStoreByAddr(forwardedHost)
+		if err != nil {
+			return nil, err
+		}
+	}
 	session := &Session{
 		cluster:   c.Cluster,
 		mvccStore: c.MvccStore,
@@ -701,7 +728,7 @@ func (c *RPCClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.R
 	reqCtx := &req.Context
 	resp := &tikvrpc.Response{}
 
-	session, err := c.checkArgs(ctx, addr)
+	session, err := c.checkArgs(ctx, addr, req.ForwardedHost)
 	if err != nil {
 		return nil, err
 	}
@@ -822,6 +849,13 @@ func (c *RPCClient) SendRequest(ctx context.Context, addr string, req *tikvrpc.R
 			return resp, nil
 		}
 		resp.Resp = kvHandler{session}.handleKvCheckTxnStatus(r)
+	case tikvrpc.CmdCheckSecondaryLocks:
+		r := req.CheckSecondaryLocks()
+		if err := session.checkRequest(reqCtx, r.Size()); err != nil {
+			resp.Resp = &kvrpcpb.CheckSecondaryLocksResponse{RegionError: err}
+			return resp, nil
+		}
+		resp.Resp = kvHandler{session}.handleCheckSecondaryLocks(r)
 	case tikvrpc.CmdTxnHeartBeat:
 		r := req.TxnHeartBeat()
 		if err := session.checkRequest(reqCtx, r.Size()); err != nil {
@@ -57,6 +57,8 @@ type Session struct {
 	// isolationLevel is used for current request.
 	isolationLevel kvrpcpb.IsolationLevel
 	resolvedLocks  []uint64
+	// replicaRead indicates whether the current request is a replica read.
+	replicaRead bool
 }
 
 // GetIsolationLevel returns the session's isolation level.
@@ -130,8 +132,8 @@ func (s *Session) CheckRequestContext(ctx *kvrpcpb.Context) *errorpb.Error {
 			},
 		}
 	}
-	// The Peer on the Store is not leader. If it's tiflash store , we pass this check.
-	if storePeer.GetId() != leaderPeer.GetId() && !isTiFlashStore(s.cluster.GetStore(storePeer.GetStoreId())) {
+	// The Peer on the Store is not leader. If it's tiflash store or a replica read, we pass this check.
+	if storePeer.GetId() != leaderPeer.GetId() && !ctx.GetReplicaRead() && !isTiFlashStore(s.cluster.GetStore(storePeer.GetStoreId())) {
 		return &errorpb.Error{
 			Message: *proto.String("not leader"),
 			NotLeader: &errorpb.NotLeader{
@@ -157,9 +159,19 @@ func (s *Session) CheckRequestContext(ctx *kvrpcpb.Context) *errorpb.Error {
 	s.startKey, s.endKey = region.StartKey, region.EndKey
 	s.isolationLevel = ctx.IsolationLevel
 	s.resolvedLocks = ctx.ResolvedLocks
+	s.replicaRead = ctx.GetReplicaRead()
 	return nil
 }
 
+// readTS returns the ts to read the data at for a read request at ts. It's smaller for a replica read served by a
+// stale replica.
+func (s *Session) readTS(ts uint64) uint64 {
+	if !s.replicaRead {
+		return ts
+	}
+	return s.cluster.replicaReadTS(s.storeID, ts)
+}
+
 func (s *Session) checkRequestSize(size int) *errorpb.Error {
 	// TiKV has a limitation on raft log size.
 	// mocktikv has no raft inside, so we check the request's size instead.
@@ -281,6 +281,11 @@ func (b *Backoffer) GetTotalSleep() int {
 	return b.totalSleep
 }
 
+// Exhausted returns whether the total sleep time has reached maxSleep, after which Backoff always fails.
+func (b *Backoffer) Exhausted() bool {
+	return b.maxSleep > 0 && (b.totalSleep-b.excludedSleep) >= b.maxSleep
+}
+
 // GetTypes returns type list of this backoff and all its ancestors.
 func (b *Backoffer) GetTypes() []string {
 	typs := make([]string, 0, len(b.configs))
@@ -81,6 +81,7 @@ var (
 	TiKVGRPCConnTransientFailureCounter      *prometheus.CounterVec
 	TiKVPanicCounter                         *prometheus.CounterVec
 	TiKVForwardRequestCounter                *prometheus.CounterVec
+	TiKVForwardRequestBytes                  *prometheus.CounterVec
 	TiKVTSFutureWaitDuration                 prometheus.Histogram
 	TiKVSafeTSUpdateCounter                  *prometheus.CounterVec
 	TiKVMinSafeTSGapSeconds                  *prometheus.GaugeVec
@@ -92,6 +93,23 @@ var (
 	TiKVReadThroughput                       prometheus.Histogram
 	TiKVUnsafeDestroyRangeFailuresCounterVec *prometheus.CounterVec
 	TiKVPrewriteAssertionUsageCounter        *prometheus.CounterVec
+	TiKVHedgeRequestCounter                  *prometheus.CounterVec
+	TiKVRegionCacheDanglingVersionCounter    prometheus.Counter
+	TiKVMessageTooLargeSplitCounter          *prometheus.CounterVec
+	TiKVRegionCacheLookupCounter             *prometheus.CounterVec
+	TiKVRegionCacheLookupDuration            *prometheus.HistogramVec
+	TiKVStoreSendFailureRate                 *prometheus.GaugeVec
+	TiKVBatchClientDowngraded                *prometheus.GaugeVec
+	TiKVReadYourWritesViolationCounter       prometheus.Counter
+	TiKVPrewriteRegionErrorCounter           *prometheus.CounterVec
+	TiKVPreferTiFlashFallbackCounter         prometheus.Counter
+	TiKVInflightRequests                     *prometheus.GaugeVec
+	TiKVPendingStoreChecks                   prometheus.Gauge
+	TiKVKVReadTimeoutRetryCounter            prometheus.Counter
+	TiKVHotRegionFollowerReadCounter         prometheus.Counter
+	TiKVRegionLoadInflight                   prometheus.Gauge
+	TiKVRegionLoadWaitDuration               prometheus.Histogram
+	TiKVLivenessProbeCounter                 *prometheus.CounterVec
 )
 
 // Label constants.
@@ -113,509 +131,757 @@ const (
 	LblStaleRead       = "stale_read"
 )
 
-func initMetrics(namespace, subsystem string) {
+func initMetrics(namespace, subsystem string, constLabels prometheus.Labels) {
 	TiKVTxnCmdHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "txn_cmd_duration_seconds",
-			Help:      "Bucketed histogram of processing time of txn cmds.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "txn_cmd_duration_seconds",
+			Help:        "Bucketed histogram of processing time of txn cmds.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
 		}, []string{LblType})
 
 	TiKVBackoffHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "backoff_seconds",
-			Help:      "total backoff seconds of a single backoffer.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "backoff_seconds",
+			Help:        "total backoff seconds of a single backoffer.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
 		}, []string{LblType})
 
 	TiKVSendReqHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "request_seconds",
-			Help:      "Bucketed histogram of sending request duration.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "request_seconds",
+			Help:        "Bucketed histogram of sending request duration.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
 		}, []string{LblType, LblStore, LblStaleRead})
 
 	TiKVCoprocessorHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "cop_duration_seconds",
-			Help:      "Run duration of a single coprocessor task, includes backoff time.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "cop_duration_seconds",
+			Help:        "Run duration of a single coprocessor task, includes backoff time.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
 		}, []string{LblStore, LblStaleRead})
 
 	TiKVLockResolverCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "lock_resolver_actions_total",
-			Help:      "Counter of lock resolver actions.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "lock_resolver_actions_total",
+			Help:        "Counter of lock resolver actions.",
 		}, []string{LblType})
 
 	TiKVRegionErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "region_err_total",
-			Help:      "Counter of region errors.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "region_err_total",
+			Help:        "Counter of region errors.",
 		}, []string{LblType})
 
 	TiKVTxnWriteKVCountHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "txn_write_kv_num",
-			Help:      "Count of kv pairs to write in a transaction.",
-			Buckets:   prometheus.ExponentialBuckets(1, 4, 17), // 1 ~ 4G
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "txn_write_kv_num",
+			Help:        "Count of kv pairs to write in a transaction.",
+			Buckets:     prometheus.ExponentialBuckets(1, 4, 17), // 1 ~ 4G
 		})
 
 	TiKVTxnWriteSizeHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "txn_write_size_bytes",
-			Help:      "Size of kv pairs to write in a transaction.",
-			Buckets:   prometheus.ExponentialBuckets(16, 4, 17), // 16Bytes ~ 64GB
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "txn_write_size_bytes",
+			Help:        "Size of kv pairs to write in a transaction.",
+			Buckets:     prometheus.ExponentialBuckets(16, 4, 17), // 16Bytes ~ 64GB
 		})
 
 	TiKVRawkvCmdHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "rawkv_cmd_seconds",
-			Help:      "Bucketed histogram of processing time of rawkv cmds.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "rawkv_cmd_seconds",
+			Help:        "Bucketed histogram of processing time of rawkv cmds.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 29), // 0.5ms ~ 1.5days
 		}, []string{LblType})
 
 	TiKVRawkvSizeHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "rawkv_kv_size_bytes",
-			Help:      "Size of key/value to put, in bytes.",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 30), // 1Byte ~ 512MB
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "rawkv_kv_size_bytes",
+			Help:        "Size of key/value to put, in bytes.",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 30), // 1Byte ~ 512MB
 		}, []string{LblType})
 
 	TiKVTxnRegionsNumHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "txn_regions_num",
-			Help:      "Number of regions in a transaction.",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 25), // 1 ~ 16M
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "txn_regions_num",
+			Help:        "Number of regions in a transaction.",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 25), // 1 ~ 16M
 		}, []string{LblType})
 
 	TiKVLoadSafepointCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "load_safepoint_total",
-			Help:      "Counter of load safepoint.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "load_safepoint_total",
+			Help:        "Counter of load safepoint.",
 		}, []string{LblType})
 
 	TiKVSecondaryLockCleanupFailureCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "lock_cleanup_task_total",
-			Help:      "failure statistic of secondary lock cleanup task.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "lock_cleanup_task_total",
+			Help:        "failure statistic of secondary lock cleanup task.",
 		}, []string{LblType})
 
 	TiKVRegionCacheCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "region_cache_operations_total",
-			Help:      "Counter of region cache.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "region_cache_operations_total",
+			Help:        "Counter of region cache.",
 		}, []string{LblType, LblResult})
 
 	TiKVLocalLatchWaitTimeHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "local_latch_wait_seconds",
-			Help:      "Wait time of a get local latch.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms ~ 262s
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "local_latch_wait_seconds",
+			Help:        "Wait time of a get local latch.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms ~ 262s
 		})
 
 	TiKVStatusDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "kv_status_api_duration",
-			Help:      "duration for kv status api.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms ~ 262s
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "kv_status_api_duration",
+			Help:        "duration for kv status api.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 20), // 0.5ms ~ 262s
 		}, []string{"store"})
 
 	TiKVStatusCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "kv_status_api_count",
-			Help:      "Counter of access kv status api.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "kv_status_api_count",
+			Help:        "Counter of access kv status api.",
 		}, []string{LblResult})
 
 	TiKVBatchWaitDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_wait_duration",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 34), // 1ns ~ 8s
-			Help:      "batch wait duration",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_wait_duration",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 34), // 1ns ~ 8s
+			Help:        "batch wait duration",
 		})
 
 	TiKVBatchSendLatency = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_send_latency",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 34), // 1ns ~ 8s
-			Help:      "batch send latency",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_send_latency",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 34), // 1ns ~ 8s
+			Help:        "batch send latency",
 		})
 
 	TiKVBatchRecvLatency = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_recv_latency",
-			Buckets:   prometheus.ExponentialBuckets(1000, 2, 34), // 1us ~ 8000s
-			Help:      "batch recv latency",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_recv_latency",
+			Buckets:     prometheus.ExponentialBuckets(1000, 2, 34), // 1us ~ 8000s
+			Help:        "batch recv latency",
 		}, []string{LblResult})
 
 	TiKVBatchWaitOverLoad = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_wait_overload",
-			Help:      "event of tikv transport layer overload",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_wait_overload",
+			Help:        "event of tikv transport layer overload",
 		})
 
 	TiKVBatchPendingRequests = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_pending_requests",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 11), // 1 ~ 1024
-			Help:      "number of requests pending in the batch channel",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_pending_requests",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 11), // 1 ~ 1024
+			Help:        "number of requests pending in the batch channel",
 		}, []string{"store"})
 
 	TiKVBatchRequests = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_requests",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 11), // 1 ~ 1024
-			Help:      "number of requests in one batch",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_requests",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 11), // 1 ~ 1024
+			Help:        "number of requests in one batch",
 		}, []string{"store"})
 
 	TiKVBatchClientUnavailable = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_client_unavailable_seconds",
-			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 28), // 1ms ~ 1.5days
-			Help:      "batch client unavailable",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_client_unavailable_seconds",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 28), // 1ms ~ 1.5days
+			Help:        "batch client unavailable",
 		})
 
 	TiKVBatchClientWaitEstablish = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_client_wait_connection_establish",
-			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 28), // 1ms ~ 1.5days
-			Help:      "batch client wait new connection establish",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_client_wait_connection_establish",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 28), // 1ms ~ 1.5days
+			Help:        "batch client wait new connection establish",
 		})
 
 	TiKVBatchClientRecycle = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_client_reset",
-			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 28), // 1ms ~ 1.5days
-			Help:      "batch client recycle connection and reconnect duration",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_client_reset",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 28), // 1ms ~ 1.5days
+			Help:        "batch client recycle connection and reconnect duration",
 		})
 
 	TiKVRangeTaskStats = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "range_task_stats",
-			Help:      "stat of range tasks",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "range_task_stats",
+			Help:        "stat of range tasks",
 		}, []string{LblType, LblResult})
 
 	TiKVRangeTaskPushDuration = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "range_task_push_duration",
-			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20), // 1ms ~ 524s
-			Help:      "duration to push sub tasks to range task workers",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "range_task_push_duration",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 20), // 1ms ~ 524s
+			Help:        "duration to push sub tasks to range task workers",
 		}, []string{LblType})
 
 	TiKVTokenWaitDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_executor_token_wait_duration",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 34), // 1ns ~ 8s
-			Help:      "tidb txn token wait duration to process batches",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_executor_token_wait_duration",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 34), // 1ns ~ 8s
+			Help:        "tidb txn token wait duration to process batches",
 		})
 
 	TiKVTxnHeartBeatHistogram = prometheus.NewHistogramVec(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "txn_heart_beat",
-			Help:      "Bucketed histogram of the txn_heartbeat request duration.",
-			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 20), // 1ms ~ 524s
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "txn_heart_beat",
+			Help:        "Bucketed histogram of the txn_heartbeat request duration.",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 20), // 1ms ~ 524s
 		}, []string{LblType})
 
 	TiKVPessimisticLockKeysDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "pessimistic_lock_keys_duration",
-			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 24), // 1ms ~ 8389s
-			Help:      "tidb txn pessimistic lock keys duration",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "pessimistic_lock_keys_duration",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 24), // 1ms ~ 8389s
+			Help:        "tidb txn pessimistic lock keys duration",
 		})
 
 	TiKVTTLLifeTimeReachCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "ttl_lifetime_reach_total",
-			Help:      "Counter of ttlManager live too long.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "ttl_lifetime_reach_total",
+			Help:        "Counter of ttlManager live too long.",
 		})
 
 	TiKVNoAvailableConnectionCounter = prometheus.NewCounter(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "batch_client_no_available_connection_total",
-			Help:      "Counter of no available batch client.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_client_no_available_connection_total",
+			Help:        "Counter of no available batch client.",
 		})
 
 	TiKVTwoPCTxnCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "commit_txn_counter",
-			Help:      "Counter of 2PC transactions.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "commit_txn_counter",
+			Help:        "Counter of 2PC transactions.",
 		}, []string{LblType})
 
 	TiKVAsyncCommitTxnCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "async_commit_txn_counter",
-			Help:      "Counter of async commit transactions.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "async_commit_txn_counter",
+			Help:        "Counter of async commit transactions.",
 		}, []string{LblType})
 
 	TiKVOnePCTxnCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "one_pc_txn_counter",
-			Help:      "Counter of 1PC transactions.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "one_pc_txn_counter",
+			Help:        "Counter of 1PC transactions.",
 		}, []string{LblType})
 
 	TiKVStoreLimitErrorCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "get_store_limit_token_error",
-			Help:      "store token is up to the limit, probably because one of the stores is the hotspot or unavailable",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "get_store_limit_token_error",
+			Help:        "store token is up to the limit, probably because one of the stores is the hotspot or unavailable",
 		}, []string{LblAddress, LblStore})
 
 	TiKVGRPCConnTransientFailureCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "connection_transient_failure_count",
-			Help:      "Counter of gRPC connection transient failure",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "connection_transient_failure_count",
+			Help:        "Counter of gRPC connection transient failure",
 		}, []string{LblAddress, LblStore})
 
 	TiKVPanicCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "panic_total",
-			Help:      "Counter of panic.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "panic_total",
+			Help:        "Counter of panic.",
 		}, []string{LblType})
 
 	TiKVForwardRequestCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "forward_request_counter",
-			Help:      "Counter of tikv request being forwarded through another node",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "forward_request_counter",
+			Help:        "Counter of tikv request being forwarded through another node",
 		}, []string{LblFromStore, LblToStore, LblType, LblResult})
 
+	TiKVForwardRequestBytes = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "forward_request_bytes",
+			Help:        "Bytes of tikv requests being forwarded through another node",
+		}, []string{LblFromStore, LblToStore})
+
 	TiKVTSFutureWaitDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "ts_future_wait_seconds",
-			Help:      "Bucketed histogram of seconds cost for waiting timestamp future.",
-			Buckets:   prometheus.ExponentialBuckets(0.000005, 2, 30), // 5us ~ 2560s
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "ts_future_wait_seconds",
+			Help:        "Bucketed histogram of seconds cost for waiting timestamp future.",
+			Buckets:     prometheus.ExponentialBuckets(0.000005, 2, 30), // 5us ~ 2560s
 		})
 
 	TiKVSafeTSUpdateCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "safets_update_counter",
-			Help:      "Counter of tikv safe_ts being updated.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "safets_update_counter",
+			Help:        "Counter of tikv safe_ts being updated.",
 		}, []string{LblResult, LblStore})
 
 	TiKVMinSafeTSGapSeconds = prometheus.NewGaugeVec(
 		prometheus.GaugeOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "min_safets_gap_seconds",
-			Help:      "The minimal (non-zero) SafeTS gap for each store.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "min_safets_gap_seconds",
+			Help:        "The minimal (non-zero) SafeTS gap for each store.",
 		}, []string{LblStore})
 
 	TiKVReplicaSelectorFailureCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "replica_selector_failure_counter",
-			Help:      "Counter of the reason why the replica selector cannot yield a potential leader.",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "replica_selector_failure_counter",
+			Help:        "Counter of the reason why the replica selector cannot yield a potential leader.",
 		}, []string{LblType})
 
 	TiKVRequestRetryTimesHistogram = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "request_retry_times",
-			Help:      "Bucketed histogram of how many times a region request retries.",
-			Buckets:   []float64{1, 2, 3, 4, 8, 16, 32, 64, 128, 256},
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "request_retry_times",
+			Help:        "Bucketed histogram of how many times a region request retries.",
+			Buckets:     []float64{1, 2, 3, 4, 8, 16, 32, 64, 128, 256},
 		})
 	TiKVTxnCommitBackoffSeconds = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "txn_commit_backoff_seconds",
-			Help:      "Bucketed histogram of the total backoff duration in committing a transaction.",
-			Buckets:   prometheus.ExponentialBuckets(0.001, 2, 22), // 1ms ~ 2097s
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "txn_commit_backoff_seconds",
+			Help:        "Bucketed histogram of the total backoff duration in committing a transaction.",
+			Buckets:     prometheus.ExponentialBuckets(0.001, 2, 22), // 1ms ~ 2097s
 		})
 	TiKVTxnCommitBackoffCount = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "txn_commit_backoff_count",
-			Help:      "Bucketed histogram of the backoff count in committing a transaction.",
-			Buckets:   prometheus.ExponentialBuckets(1, 2, 12), // 1 ~ 2048
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "txn_commit_backoff_count",
+			Help:        "Bucketed histogram of the backoff count in committing a transaction.",
+			Buckets:     prometheus.ExponentialBuckets(1, 2, 12), // 1 ~ 2048
 		})
 
 	// TiKVSmallReadDuration uses to collect small request read duration.
 	TiKVSmallReadDuration = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: "sli", // Always use "sli" to make it compatible with TiDB.
-			Name:      "tikv_small_read_duration",
-			Help:      "Read time of TiKV small read.",
-			Buckets:   prometheus.ExponentialBuckets(0.0005, 2, 28), // 0.5ms ~ 74h
+			Namespace:   namespace,
+			Subsystem:   "sli", // Always use "sli" to make it compatible with TiDB.
+			ConstLabels: constLabels,
+			Name:        "tikv_small_read_duration",
+			Help:        "Read time of TiKV small read.",
+			Buckets:     prometheus.ExponentialBuckets(0.0005, 2, 28), // 0.5ms ~ 74h
 		})
 
 	TiKVReadThroughput = prometheus.NewHistogram(
 		prometheus.HistogramOpts{
-			Namespace: namespace,
-			Subsystem: "sli",
-			Name:      "tikv_read_throughput",
-			Help:      "Read throughput of TiKV read in Bytes/s.",
-			Buckets:   prometheus.ExponentialBuckets(1024, 2, 13), // 1MB/s ~ 4GB/s
+			Namespace:   namespace,
+			Subsystem:   "sli",
+			ConstLabels: constLabels,
+			Name:        "tikv_read_throughput",
+			Help:        "Read throughput of TiKV read in Bytes/s.",
+			Buckets:     prometheus.ExponentialBuckets(1024, 2, 13), // 1MB/s ~ 4GB/s
 		})
 
 	TiKVUnsafeDestroyRangeFailuresCounterVec = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "gc_unsafe_destroy_range_failures",
-			Help:      "Counter of unsafe destroyrange failures",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "gc_unsafe_destroy_range_failures",
+			Help:        "Counter of unsafe destroyrange failures",
 		}, []string{LblType})
 
 	TiKVPrewriteAssertionUsageCounter = prometheus.NewCounterVec(
 		prometheus.CounterOpts{
-			Namespace: namespace,
-			Subsystem: subsystem,
-			Name:      "prewrite_assertion_count",
-			Help:      "Counter of assertions used in prewrite requests",
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "prewrite_assertion_count",
+			Help:        "Counter of assertions used in prewrite requests",
+		}, []string{LblType})
+
+	TiKVHedgeRequestCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "hedge_request_total",
+			Help:        "Counter of hedged read requests.",
+		}, []string{LblType})
+
+	TiKVRegionCacheDanglingVersionCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "region_cache_dangling_version_total",
+			Help:        "Counter of latest region versions removed from region cache because the region is missing.",
+		})
+
+	TiKVMessageTooLargeSplitCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "message_too_large_split_total",
+			Help:        "Counter of requests split because the request or response exceeds the gRPC message size limit.",
+		}, []string{LblType})
+
+	TiKVRegionCacheLookupCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "region_cache_lookup_total",
+			Help:        "Counter of region cache lookups by operation and outcome.",
+		}, []string{"operation", "outcome"})
+
+	TiKVRegionCacheLookupDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "region_cache_lookup_duration_seconds",
+			Help:        "Duration of looking up regions in region cache, which is sampled, and loading them from PD on cache miss.",
+			Buckets:     prometheus.ExponentialBuckets(0.000001, 2, 28), // 1us ~ 134s
 		}, []string{LblType})
 
+	TiKVStoreSendFailureRate = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "store_send_failure_rate",
+			Help:        "Ratio of failed sends among the latest sends to each store.",
+		}, []string{LblStore})
+
+	TiKVBatchClientDowngraded = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "batch_client_downgraded",
+			Help:        "Whether requests to the store are sent by unary calls because it doesn't support batch commands.",
+		}, []string{LblStore})
+
+	TiKVReadYourWritesViolationCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "read_your_writes_violation_total",
+			Help:        "Counter of replica reads which miss the writes committed by the client before the snapshot.",
+		})
+
+	TiKVPrewriteRegionErrorCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "prewrite_region_error_total",
+			Help:        "Counter of region errors encountered by prewrite requests, by category.",
+		}, []string{LblType})
+
+	TiKVPreferTiFlashFallbackCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "prefer_tiflash_fallback_total",
+			Help:        "Counter of region reads which prefer TiFlash but fall back to TiKV because the region has no valid TiFlash peer.",
+		})
+
+	TiKVInflightRequests = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "inflight_requests",
+			Help:        "Number of requests in progress to the store.",
+		}, []string{LblStore})
+
+	TiKVPendingStoreChecks = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "pending_store_checks",
+			Help:        "Number of stores marked need check and waiting to be re-resolved.",
+		})
+
+	TiKVKVReadTimeoutRetryCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "kv_read_timeout_retry_total",
+			Help:        "Counter of read attempts retried after exceeding the kv read timeout.",
+		})
+
+	TiKVHotRegionFollowerReadCounter = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "hot_region_follower_read_total",
+			Help:        "Counter of leader reads upgraded to mixed replica reads because the regions are hot.",
+		})
+
+	TiKVRegionLoadInflight = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "region_load_inflight",
+			Help:        "Number of requests in progress to load regions from PD.",
+		})
+
+	TiKVRegionLoadWaitDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "region_load_wait_seconds",
+			Buckets:     prometheus.ExponentialBuckets(0.0001, 2, 20), // 0.1ms ~ 52s
+			Help:        "Duration waiting for the concurrency limit to load regions from PD.",
+		})
+
+	TiKVLivenessProbeCounter = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Namespace:   namespace,
+			Subsystem:   subsystem,
+			ConstLabels: constLabels,
+			Name:        "liveness_probe_total",
+			Help:        "Counter of store liveness probes launched and the checks deduplicated into the probes in flight.",
+		}, []string{LblType, LblResult})
+
 	initShortcuts()
 }
 
 func init() {
-	initMetrics("tikv", "client_go")
+	initMetrics("tikv", "client_go", nil)
 }
 
 // InitMetrics initializes metrics variables with given namespace and subsystem name.
 func InitMetrics(namespace, subsystem string) {
-	initMetrics(namespace, subsystem)
+	initMetrics(namespace, subsystem, nil)
+}
+
+// InitMetricsWithConstLabels initializes metrics variables with given namespace, subsystem name and const labels.
+// The const labels are attached to all the series, so that the metrics of different client libraries in one binary
+// can be told apart.
+func InitMetricsWithConstLabels(namespace, subsystem string, constLabels prometheus.Labels) {
+	initMetrics(namespace, subsystem, constLabels)
 }
 
-// RegisterMetrics registers all metrics variables.
+// RegisterMetrics registers all metrics variables to the default registerer.
 // Note: to change default namespace and subsystem name, call `InitMetrics` before registering.
 func RegisterMetrics() {
-	prometheus.MustRegister(TiKVTxnCmdHistogram)
-	prometheus.MustRegister(TiKVBackoffHistogram)
-	prometheus.MustRegister(TiKVSendReqHistogram)
-	prometheus.MustRegister(TiKVCoprocessorHistogram)
-	prometheus.MustRegister(TiKVLockResolverCounter)
-	prometheus.MustRegister(TiKVRegionErrorCounter)
-	prometheus.MustRegister(TiKVTxnWriteKVCountHistogram)
-	prometheus.MustRegister(TiKVTxnWriteSizeHistogram)
-	prometheus.MustRegister(TiKVRawkvCmdHistogram)
-	prometheus.MustRegister(TiKVRawkvSizeHistogram)
-	prometheus.MustRegister(TiKVTxnRegionsNumHistogram)
-	prometheus.MustRegister(TiKVLoadSafepointCounter)
-	prometheus.MustRegister(TiKVSecondaryLockCleanupFailureCounter)
-	prometheus.MustRegister(TiKVRegionCacheCounter)
-	prometheus.MustRegister(TiKVLocalLatchWaitTimeHistogram)
-	prometheus.MustRegister(TiKVStatusDuration)
-	prometheus.MustRegister(TiKVStatusCounter)
-	prometheus.MustRegister(TiKVBatchWaitDuration)
-	prometheus.MustRegister(TiKVBatchSendLatency)
-	prometheus.MustRegister(TiKVBatchRecvLatency)
-	prometheus.MustRegister(TiKVBatchWaitOverLoad)
-	prometheus.MustRegister(TiKVBatchPendingRequests)
-	prometheus.MustRegister(TiKVBatchRequests)
-	prometheus.MustRegister(TiKVBatchClientUnavailable)
-	prometheus.MustRegister(TiKVBatchClientWaitEstablish)
-	prometheus.MustRegister(TiKVBatchClientRecycle)
-	prometheus.MustRegister(TiKVRangeTaskStats)
-	prometheus.MustRegister(TiKVRangeTaskPushDuration)
-	prometheus.MustRegister(TiKVTokenWaitDuration)
-	prometheus.MustRegister(TiKVTxnHeartBeatHistogram)
-	prometheus.MustRegister(TiKVPessimisticLockKeysDuration)
-	prometheus.MustRegister(TiKVTTLLifeTimeReachCounter)
-	prometheus.MustRegister(TiKVNoAvailableConnectionCounter)
-	prometheus.MustRegister(TiKVTwoPCTxnCounter)
-	prometheus.MustRegister(TiKVAsyncCommitTxnCounter)
-	prometheus.MustRegister(TiKVOnePCTxnCounter)
-	prometheus.MustRegister(TiKVStoreLimitErrorCounter)
-	prometheus.MustRegister(TiKVGRPCConnTransientFailureCounter)
-	prometheus.MustRegister(TiKVPanicCounter)
-	prometheus.MustRegister(TiKVForwardRequestCounter)
-	prometheus.MustRegister(TiKVTSFutureWaitDuration)
-	prometheus.MustRegister(TiKVSafeTSUpdateCounter)
-	prometheus.MustRegister(TiKVMinSafeTSGapSeconds)
-	prometheus.MustRegister(TiKVReplicaSelectorFailureCounter)
-	prometheus.MustRegister(TiKVRequestRetryTimesHistogram)
-	prometheus.MustRegister(TiKVTxnCommitBackoffSeconds)
-	prometheus.MustRegister(TiKVTxnCommitBackoffCount)
-	prometheus.MustRegister(TiKVSmallReadDuration)
-	prometheus.MustRegister(TiKVReadThroughput)
-	prometheus.MustRegister(TiKVUnsafeDestroyRangeFailuresCounterVec)
-	prometheus.MustRegister(TiKVPrewriteAssertionUsageCounter)
+	RegisterMetricsWith(prometheus.DefaultRegisterer)
+}
+
+// RegisterMetricsWith registers all metrics variables to the registerer, e.g. a registry of the embedder, which
+// avoids collisions with the collectors registered to the default registerer by others.
+// Note: the metrics variables and the shortcuts of them are recreated by `InitMetrics`, so call it before
+// registering rather than after.
+func RegisterMetricsWith(registerer prometheus.Registerer) {
+	registerer.MustRegister(TiKVTxnCmdHistogram)
+	registerer.MustRegister(TiKVBackoffHistogram)
+	registerer.MustRegister(TiKVSendReqHistogram)
+	registerer.MustRegister(TiKVCoprocessorHistogram)
+	registerer.MustRegister(TiKVLockResolverCounter)
+	registerer.MustRegister(TiKVRegionErrorCounter)
+	registerer.MustRegister(TiKVTxnWriteKVCountHistogram)
+	registerer.MustRegister(TiKVTxnWriteSizeHistogram)
+	registerer.MustRegister(TiKVRawkvCmdHistogram)
+	registerer.MustRegister(TiKVRawkvSizeHistogram)
+	registerer.MustRegister(TiKVTxnRegionsNumHistogram)
+	registerer.MustRegister(TiKVLoadSafepointCounter)
+	registerer.MustRegister(TiKVSecondaryLockCleanupFailureCounter)
+	registerer.MustRegister(TiKVRegionCacheCounter)
+	registerer.MustRegister(TiKVLocalLatchWaitTimeHistogram)
+	registerer.MustRegister(TiKVStatusDuration)
+	registerer.MustRegister(TiKVStatusCounter)
+	registerer.MustRegister(TiKVBatchWaitDuration)
+	registerer.MustRegister(TiKVBatchSendLatency)
+	registerer.MustRegister(TiKVBatchRecvLatency)
+	registerer.MustRegister(TiKVBatchWaitOverLoad)
+	registerer.MustRegister(TiKVBatchPendingRequests)
+	registerer.MustRegister(TiKVBatchRequests)
+	registerer.MustRegister(TiKVBatchClientUnavailable)
+	registerer.MustRegister(TiKVBatchClientWaitEstablish)
+	registerer.MustRegister(TiKVBatchClientRecycle)
+	registerer.MustRegister(TiKVRangeTaskStats)
+	registerer.MustRegister(TiKVRangeTaskPushDuration)
+	registerer.MustRegister(TiKVTokenWaitDuration)
+	registerer.MustRegister(TiKVTxnHeartBeatHistogram)
+	registerer.MustRegister(TiKVPessimisticLockKeysDuration)
+	registerer.MustRegister(TiKVTTLLifeTimeReachCounter)
+	registerer.MustRegister(TiKVNoAvailableConnectionCounter)
+	registerer.MustRegister(TiKVTwoPCTxnCounter)
+	registerer.MustRegister(TiKVAsyncCommitTxnCounter)
+	registerer.MustRegister(TiKVOnePCTxnCounter)
+	registerer.MustRegister(TiKVStoreLimitErrorCounter)
+	registerer.MustRegister(TiKVGRPCConnTransientFailureCounter)
+	registerer.MustRegister(TiKVPanicCounter)
+	registerer.MustRegister(TiKVForwardRequestCounter)
+	registerer.MustRegister(TiKVForwardRequestBytes)
+	registerer.MustRegister(TiKVTSFutureWaitDuration)
+	registerer.MustRegister(TiKVSafeTSUpdateCounter)
+	registerer.MustRegister(TiKVMinSafeTSGapSeconds)
+	registerer.MustRegister(TiKVReplicaSelectorFailureCounter)
+	registerer.MustRegister(TiKVRequestRetryTimesHistogram)
+	registerer.MustRegister(TiKVTxnCommitBackoffSeconds)
+	registerer.MustRegister(TiKVTxnCommitBackoffCount)
+	registerer.MustRegister(TiKVSmallReadDuration)
+	registerer.MustRegister(TiKVReadThroughput)
+	registerer.MustRegister(TiKVUnsafeDestroyRangeFailuresCounterVec)
+	registerer.MustRegister(TiKVPrewriteAssertionUsageCounter)
+	registerer.MustRegister(TiKVHedgeRequestCounter)
+	registerer.MustRegister(TiKVRegionCacheDanglingVersionCounter)
+	registerer.MustRegister(TiKVMessageTooLargeSplitCounter)
+	registerer.MustRegister(TiKVRegionCacheLookupCounter)
+	registerer.MustRegister(TiKVRegionCacheLookupDuration)
+	registerer.MustRegister(TiKVStoreSendFailureRate)
+	registerer.MustRegister(TiKVBatchClientDowngraded)
+	registerer.MustRegister(TiKVReadYourWritesViolationCounter)
+	registerer.MustRegister(TiKVPrewriteRegionErrorCounter)
+	registerer.MustRegister(TiKVPreferTiFlashFallbackCounter)
+	registerer.MustRegister(TiKVInflightRequests)
+	registerer.MustRegister(TiKVPendingStoreChecks)
+	registerer.MustRegister(TiKVKVReadTimeoutRetryCounter)
+	registerer.MustRegister(TiKVHotRegionFollowerReadCounter)
+	registerer.MustRegister(TiKVRegionLoadInflight)
+	registerer.MustRegister(TiKVRegionLoadWaitDuration)
+	registerer.MustRegister(TiKVLivenessProbeCounter)
 }
 
 // readCounter reads the value of a prometheus.Counter.
@@ -657,6 +923,11 @@ func GetTxnCommitCounter() TxnCommitCounter {
 	}
 }
 
+// GetReadYourWritesViolations gets the number of replica reads which miss the writes committed by the client.
+func GetReadYourWritesViolations() int64 {
+	return readCounter(TiKVReadYourWritesViolationCounter)
+}
+
 const (
 	smallTxnReadRow  = 20
 	smallTxnReadSize = 1 * 1024 * 1024 //1MB
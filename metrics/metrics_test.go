@@ -0,0 +1,59 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package metrics
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/require"
+)
+
+func TestRegisterMetricsWith(t *testing.T) {
+	defer InitMetrics("tikv", "client_go")
+
+	// The metrics of two client libraries are registered to one registry, told apart by the const labels.
+	registry := prometheus.NewRegistry()
+	for _, client := range []string{"a", "b"} {
+		InitMetricsWithConstLabels("tikv", "client_go", prometheus.Labels{"client": client})
+		require.NotPanics(t, func() { RegisterMetricsWith(registry) })
+		BackoffHistogramRPC.Observe(1)
+		// The cached children are resolved again from the collectors of the client.
+		SendReqHistogramWith("Get", 1, false).Observe(1)
+	}
+	// Registering the same collectors again fails.
+	require.Panics(t, func() { RegisterMetricsWith(registry) })
+
+	families, err := registry.Gather()
+	require.Nil(t, err)
+	clients := make(map[string][]string)
+	for _, family := range families {
+		if family.GetName() != "tikv_client_go_backoff_seconds" && family.GetName() != "tikv_client_go_request_seconds" {
+			continue
+		}
+		for _, m := range family.GetMetric() {
+			if m.GetHistogram().GetSampleCount() == 0 {
+				continue
+			}
+			for _, label := range m.GetLabel() {
+				if label.GetName() == "client" {
+					clients[family.GetName()] = append(clients[family.GetName()], label.GetValue())
+				}
+			}
+		}
+	}
+	require.Equal(t, []string{"a", "b"}, clients["tikv_client_go_backoff_seconds"])
+	require.Equal(t, []string{"a", "b"}, clients["tikv_client_go_request_seconds"])
+}
@@ -34,7 +34,12 @@
 
 package metrics
 
-import "github.com/prometheus/client_golang/prometheus"
+import (
+	"strconv"
+	"sync"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
 
 // Shortcuts for performance improvement.
 var (
@@ -92,6 +97,7 @@ var (
 
 	RegionCacheCounterWithInvalidateRegionFromCacheOK prometheus.Counter
 	RegionCacheCounterWithSendFail                    prometheus.Counter
+	RegionCacheCounterWithAllReplicasFailed           prometheus.Counter
 	RegionCacheCounterWithGetRegionByIDOK             prometheus.Counter
 	RegionCacheCounterWithGetRegionByIDError          prometheus.Counter
 	RegionCacheCounterWithGetRegionOK                 prometheus.Counter
@@ -101,6 +107,16 @@ var (
 	RegionCacheCounterWithGetStoreOK                  prometheus.Counter
 	RegionCacheCounterWithGetStoreError               prometheus.Counter
 	RegionCacheCounterWithInvalidateStoreRegionsOK    prometheus.Counter
+	RegionCacheCounterWithIgnoreDownPeers             prometheus.Counter
+	RegionCacheCounterWithRegionLoadThrottled         prometheus.Counter
+	RegionCacheCounterWithRegionLoadCollapsed         prometheus.Counter
+	RegionCacheCounterWithLeaderHintRecovered         prometheus.Counter
+	RegionCacheCounterWithLeaderHintInvalidated       prometheus.Counter
+	RegionCacheCounterWithStoreCheckCoalesced         prometheus.Counter
+	RegionCacheCounterWithFailureHandled              prometheus.Counter
+	RegionCacheCounterWithFailureCoalesced            prometheus.Counter
+	RegionCacheCounterWithEpochMismatchRefresh        prometheus.Counter
+	RegionCacheCounterWithEpochMismatchInvalidate     prometheus.Counter
 
 	TxnHeartBeatHistogramOK    prometheus.Observer
 	TxnHeartBeatHistogramError prometheus.Observer
@@ -128,9 +144,65 @@ var (
 	PrewriteAssertionUsageCounterExist    prometheus.Counter
 	PrewriteAssertionUsageCounterNotExist prometheus.Counter
 	PrewriteAssertionUsageCounterUnknown  prometheus.Counter
+
+	HedgeRequestCounterFired prometheus.Counter
+	HedgeRequestCounterWin   prometheus.Counter
+
+	MessageTooLargeSplitCounterBatchGet prometheus.Counter
+	MessageTooLargeSplitCounterScan     prometheus.Counter
+	MessageTooLargeSplitCounterPrewrite prometheus.Counter
+	MessageTooLargeSplitCounterCommit   prometheus.Counter
+
+	RegionCacheLookupLocateKeyHit               prometheus.Counter
+	RegionCacheLookupLocateKeyMissLoad          prometheus.Counter
+	RegionCacheLookupLocateKeyHitStaleReload    prometheus.Counter
+	RegionCacheLookupLocateKeyExpired           prometheus.Counter
+	RegionCacheLookupLocateEndKeyHit            prometheus.Counter
+	RegionCacheLookupLocateEndKeyMissLoad       prometheus.Counter
+	RegionCacheLookupLocateEndKeyHitStaleReload prometheus.Counter
+	RegionCacheLookupLocateEndKeyExpired        prometheus.Counter
+	RegionCacheLookupByIDHit                    prometheus.Counter
+	RegionCacheLookupByIDMissLoad               prometheus.Counter
+	RegionCacheLookupByIDHitStaleReload         prometheus.Counter
+	RegionCacheLookupByIDExpired                prometheus.Counter
+	RegionCacheLookupRPCCtxHit                  prometheus.Counter
+	RegionCacheLookupRPCCtxNil                  prometheus.Counter
+
+	RegionCacheLookupDurationCache  prometheus.Observer
+	RegionCacheLookupDurationPDLoad prometheus.Observer
+
+	PrewriteRegionErrorCounterEpochNotMatch    prometheus.Counter
+	PrewriteRegionErrorCounterDiskFull         prometheus.Counter
+	PrewriteRegionErrorCounterServerBusyOrFake prometheus.Counter
+	PrewriteRegionErrorCounterOther            prometheus.Counter
 )
 
+// sendReqHistCache caches the children of TiKVSendReqHistogram. It's cleared when the metrics are initialized again,
+// so that the observations don't go to the children of the replaced collector.
+var sendReqHistCache sync.Map
+
+type sendReqHistCacheKey struct {
+	tp        string
+	storeID   uint64
+	staleRead bool
+}
+
+// SendReqHistogramWith returns the child of TiKVSendReqHistogram with the labels, which is cached.
+func SendReqHistogramWith(reqType string, storeID uint64, staleRead bool) prometheus.Observer {
+	key := sendReqHistCacheKey{reqType, storeID, staleRead}
+	if v, ok := sendReqHistCache.Load(key); ok {
+		return v.(prometheus.Observer)
+	}
+	v := TiKVSendReqHistogram.WithLabelValues(reqType, strconv.FormatUint(storeID, 10), strconv.FormatBool(staleRead))
+	sendReqHistCache.Store(key, v)
+	return v
+}
+
 func initShortcuts() {
+	sendReqHistCache.Range(func(key, _ interface{}) bool {
+		sendReqHistCache.Delete(key)
+		return true
+	})
 	TxnCmdHistogramWithCommit = TiKVTxnCmdHistogram.WithLabelValues(LblCommit)
 	TxnCmdHistogramWithRollback = TiKVTxnCmdHistogram.WithLabelValues(LblRollback)
 	TxnCmdHistogramWithBatchGet = TiKVTxnCmdHistogram.WithLabelValues(LblBatchGet)
@@ -185,6 +257,7 @@ func initShortcuts() {
 
 	RegionCacheCounterWithInvalidateRegionFromCacheOK = TiKVRegionCacheCounter.WithLabelValues("invalidate_region_from_cache", "ok")
 	RegionCacheCounterWithSendFail = TiKVRegionCacheCounter.WithLabelValues("send_fail", "ok")
+	RegionCacheCounterWithAllReplicasFailed = TiKVRegionCacheCounter.WithLabelValues("all_replicas_failed", "ok")
 	RegionCacheCounterWithGetRegionByIDOK = TiKVRegionCacheCounter.WithLabelValues("get_region_by_id", "ok")
 	RegionCacheCounterWithGetRegionByIDError = TiKVRegionCacheCounter.WithLabelValues("get_region_by_id", "err")
 	RegionCacheCounterWithGetRegionOK = TiKVRegionCacheCounter.WithLabelValues("get_region", "ok")
@@ -194,6 +267,16 @@ func initShortcuts() {
 	RegionCacheCounterWithGetStoreOK = TiKVRegionCacheCounter.WithLabelValues("get_store", "ok")
 	RegionCacheCounterWithGetStoreError = TiKVRegionCacheCounter.WithLabelValues("get_store", "err")
 	RegionCacheCounterWithInvalidateStoreRegionsOK = TiKVRegionCacheCounter.WithLabelValues("invalidate_store_regions", "ok")
+	RegionCacheCounterWithIgnoreDownPeers = TiKVRegionCacheCounter.WithLabelValues("ignore_down_peers", "ok")
+	RegionCacheCounterWithRegionLoadThrottled = TiKVRegionCacheCounter.WithLabelValues("region_load_throttled", "ok")
+	RegionCacheCounterWithRegionLoadCollapsed = TiKVRegionCacheCounter.WithLabelValues("region_load_collapsed", "ok")
+	RegionCacheCounterWithLeaderHintRecovered = TiKVRegionCacheCounter.WithLabelValues("leader_hint", "recovered")
+	RegionCacheCounterWithLeaderHintInvalidated = TiKVRegionCacheCounter.WithLabelValues("leader_hint", "invalidated")
+	RegionCacheCounterWithStoreCheckCoalesced = TiKVRegionCacheCounter.WithLabelValues("notify_store_check", "coalesced")
+	RegionCacheCounterWithFailureHandled = TiKVRegionCacheCounter.WithLabelValues("region_failure", "handled")
+	RegionCacheCounterWithFailureCoalesced = TiKVRegionCacheCounter.WithLabelValues("region_failure", "coalesced")
+	RegionCacheCounterWithEpochMismatchRefresh = TiKVRegionCacheCounter.WithLabelValues("epoch_mismatch", "refresh")
+	RegionCacheCounterWithEpochMismatchInvalidate = TiKVRegionCacheCounter.WithLabelValues("epoch_mismatch", "invalidate")
 
 	TxnHeartBeatHistogramOK = TiKVTxnHeartBeatHistogram.WithLabelValues("ok")
 	TxnHeartBeatHistogramError = TiKVTxnHeartBeatHistogram.WithLabelValues("err")
@@ -221,4 +304,35 @@ func initShortcuts() {
 	PrewriteAssertionUsageCounterExist = TiKVPrewriteAssertionUsageCounter.WithLabelValues("exist")
 	PrewriteAssertionUsageCounterNotExist = TiKVPrewriteAssertionUsageCounter.WithLabelValues("not-exist")
 	PrewriteAssertionUsageCounterUnknown = TiKVPrewriteAssertionUsageCounter.WithLabelValues("unknown")
+
+	HedgeRequestCounterFired = TiKVHedgeRequestCounter.WithLabelValues("fired")
+	HedgeRequestCounterWin = TiKVHedgeRequestCounter.WithLabelValues("win")
+
+	MessageTooLargeSplitCounterBatchGet = TiKVMessageTooLargeSplitCounter.WithLabelValues("batch_get")
+	MessageTooLargeSplitCounterScan = TiKVMessageTooLargeSplitCounter.WithLabelValues("scan")
+	MessageTooLargeSplitCounterPrewrite = TiKVMessageTooLargeSplitCounter.WithLabelValues("prewrite")
+	MessageTooLargeSplitCounterCommit = TiKVMessageTooLargeSplitCounter.WithLabelValues("commit")
+
+	RegionCacheLookupLocateKeyHit = TiKVRegionCacheLookupCounter.WithLabelValues("locate_key", "hit")
+	RegionCacheLookupLocateKeyMissLoad = TiKVRegionCacheLookupCounter.WithLabelValues("locate_key", "miss_load")
+	RegionCacheLookupLocateKeyHitStaleReload = TiKVRegionCacheLookupCounter.WithLabelValues("locate_key", "hit_stale_reload")
+	RegionCacheLookupLocateKeyExpired = TiKVRegionCacheLookupCounter.WithLabelValues("locate_key", "expired")
+	RegionCacheLookupLocateEndKeyHit = TiKVRegionCacheLookupCounter.WithLabelValues("locate_end_key", "hit")
+	RegionCacheLookupLocateEndKeyMissLoad = TiKVRegionCacheLookupCounter.WithLabelValues("locate_end_key", "miss_load")
+	RegionCacheLookupLocateEndKeyHitStaleReload = TiKVRegionCacheLookupCounter.WithLabelValues("locate_end_key", "hit_stale_reload")
+	RegionCacheLookupLocateEndKeyExpired = TiKVRegionCacheLookupCounter.WithLabelValues("locate_end_key", "expired")
+	RegionCacheLookupByIDHit = TiKVRegionCacheLookupCounter.WithLabelValues("by_id", "hit")
+	RegionCacheLookupByIDMissLoad = TiKVRegionCacheLookupCounter.WithLabelValues("by_id", "miss_load")
+	RegionCacheLookupByIDHitStaleReload = TiKVRegionCacheLookupCounter.WithLabelValues("by_id", "hit_stale_reload")
+	RegionCacheLookupByIDExpired = TiKVRegionCacheLookupCounter.WithLabelValues("by_id", "expired")
+	RegionCacheLookupRPCCtxHit = TiKVRegionCacheLookupCounter.WithLabelValues("rpc_ctx", "hit")
+	RegionCacheLookupRPCCtxNil = TiKVRegionCacheLookupCounter.WithLabelValues("rpc_ctx", "nil")
+
+	RegionCacheLookupDurationCache = TiKVRegionCacheLookupDuration.WithLabelValues("cache")
+	RegionCacheLookupDurationPDLoad = TiKVRegionCacheLookupDuration.WithLabelValues("pd_load")
+
+	PrewriteRegionErrorCounterEpochNotMatch = TiKVPrewriteRegionErrorCounter.WithLabelValues("epoch_not_match")
+	PrewriteRegionErrorCounterDiskFull = TiKVPrewriteRegionErrorCounter.WithLabelValues("disk_full")
+	PrewriteRegionErrorCounterServerBusyOrFake = TiKVPrewriteRegionErrorCounter.WithLabelValues("server_busy_or_fake")
+	PrewriteRegionErrorCounterOther = TiKVPrewriteRegionErrorCounter.WithLabelValues("other")
 }
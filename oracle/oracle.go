@@ -56,6 +56,12 @@ type Oracle interface {
 	Close()
 }
 
+// CommitTSOracle acquires the commit timestamps of transactions. The returned timestamp must be fetched after the call
+// begins, be greater than startTS and not less than minCommitTS (0 means no requirement).
+type CommitTSOracle interface {
+	GetCommitTimestamp(ctx context.Context, opt *Option, startTS, minCommitTS uint64) (uint64, error)
+}
+
 // Future is a future which promises to return a timestamp.
 type Future interface {
 	Wait() (uint64, error)
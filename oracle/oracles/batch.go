@@ -0,0 +1,128 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oracles
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tikv/client-go/v2/oracle"
+)
+
+var _ oracle.CommitTSOracle = &BatchCommitTSOracle{}
+
+// BatchCommitTSOracle coalesces the concurrent commit timestamp requests of transactions into one GetTimestamp call
+// to reduce the TSO QPS.
+//
+// A commit timestamp is safe as long as it's fetched after the request begins, because then it's greater than all
+// the timestamps allocated before the transaction is committed. So the requests that arrive before a batch is fetched
+// can share its timestamp. It's not safe to hand out the following logical timestamps of the batch because they may
+// be allocated to other transactions as start timestamps later. The per-transaction requirements, i.e., greater
+// than startTS and not less than minCommitTS, are checked against the batch timestamp, and a request falls back to
+// an individual fetch if the batch timestamp is insufficient or fails.
+type BatchCommitTSOracle struct {
+	oracle     oracle.Oracle
+	window     time.Duration
+	maxWaiters int
+
+	mu sync.Mutex
+	// txn_scope -> the batch that is collecting requests
+	pending map[string]*commitTSBatch
+}
+
+type commitTSBatch struct {
+	waiters int
+	full    chan struct{}
+	done    chan struct{}
+	ts      uint64
+	err     error
+}
+
+// NewBatchCommitTSOracle creates a BatchCommitTSOracle which waits at most window or until maxWaiters requests
+// arrive before fetching the timestamp of a batch. maxWaiters <= 0 means no limit on the number of requests.
+func NewBatchCommitTSOracle(o oracle.Oracle, window time.Duration, maxWaiters int) *BatchCommitTSOracle {
+	return &BatchCommitTSOracle{
+		oracle:     o,
+		window:     window,
+		maxWaiters: maxWaiters,
+		pending:    make(map[string]*commitTSBatch),
+	}
+}
+
+// GetCommitTimestamp implements oracle.CommitTSOracle.
+func (o *BatchCommitTSOracle) GetCommitTimestamp(ctx context.Context, opt *oracle.Option, startTS, minCommitTS uint64) (uint64, error) {
+	b, leader := o.join(opt.TxnScope)
+	if leader {
+		o.fetch(ctx, opt, b)
+	} else {
+		select {
+		case <-b.done:
+		case <-ctx.Done():
+			return 0, ctx.Err()
+		}
+	}
+	if b.err == nil && b.ts > startTS && b.ts >= minCommitTS {
+		return b.ts, nil
+	}
+	if err := ctx.Err(); err != nil {
+		return 0, err
+	}
+	return o.oracle.GetTimestamp(ctx, opt)
+}
+
+// join adds the request to the pending batch of the txnScope, the request creating the batch is its leader.
+func (o *BatchCommitTSOracle) join(txnScope string) (*commitTSBatch, bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	b, ok := o.pending[txnScope]
+	if !ok {
+		b = &commitTSBatch{full: make(chan struct{}), done: make(chan struct{})}
+		o.pending[txnScope] = b
+	}
+	b.waiters++
+	if o.maxWaiters > 0 && b.waiters >= o.maxWaiters {
+		o.detachLocked(txnScope, b)
+	}
+	return b, !ok
+}
+
+// detachLocked stops the batch from collecting more requests. It must be called with o.mu held.
+func (o *BatchCommitTSOracle) detachLocked(txnScope string, b *commitTSBatch) {
+	if o.pending[txnScope] == b {
+		delete(o.pending, txnScope)
+		close(b.full)
+	}
+}
+
+func (o *BatchCommitTSOracle) fetch(ctx context.Context, opt *oracle.Option, b *commitTSBatch) {
+	defer close(b.done)
+	timer := time.NewTimer(o.window)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-b.full:
+	case <-ctx.Done():
+	}
+	o.mu.Lock()
+	o.detachLocked(opt.TxnScope, b)
+	o.mu.Unlock()
+	// The requests of the batch have all arrived, so the timestamp fetched from now on is safe for them.
+	if err := ctx.Err(); err != nil {
+		b.err = err
+		return
+	}
+	b.ts, b.err = o.oracle.GetTimestamp(ctx, opt)
+}
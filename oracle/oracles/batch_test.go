@@ -0,0 +1,162 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package oracles_test
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+	"github.com/tikv/client-go/v2/oracle"
+	"github.com/tikv/client-go/v2/oracle/oracles"
+)
+
+// seqOracle allocates timestamps in sequence and counts the calls.
+type seqOracle struct {
+	oracle.Oracle
+	ts      uint64
+	calls   int64
+	latency time.Duration
+}
+
+func (o *seqOracle) GetTimestamp(ctx context.Context, _ *oracle.Option) (uint64, error) {
+	atomic.AddInt64(&o.calls, 1)
+	if o.latency > 0 {
+		time.Sleep(o.latency)
+	}
+	return atomic.AddUint64(&o.ts, 1), nil
+}
+
+func TestBatchCommitTSOracle(t *testing.T) {
+	base := &seqOracle{}
+	o := oracles.NewBatchCommitTSOracle(base, 50*time.Millisecond, 10)
+	opt := &oracle.Option{TxnScope: oracle.GlobalTxnScope}
+
+	const txns = 100
+	var wg sync.WaitGroup
+	var startCalls int64
+	for i := 0; i < txns; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			startTS, err := base.GetTimestamp(context.Background(), opt)
+			require.Nil(t, err)
+			// The timestamp allocated before committing must be less than the commit timestamp.
+			prevTS, err := base.GetTimestamp(context.Background(), opt)
+			require.Nil(t, err)
+			atomic.AddInt64(&startCalls, 2)
+			commitTS, err := o.GetCommitTimestamp(context.Background(), opt, startTS, prevTS)
+			require.Nil(t, err)
+			require.Greater(t, commitTS, startTS)
+			require.Greater(t, commitTS, prevTS)
+		}()
+	}
+	wg.Wait()
+	commitCalls := atomic.LoadInt64(&base.calls) - atomic.LoadInt64(&startCalls)
+	require.Less(t, commitCalls, int64(txns))
+}
+
+func TestBatchCommitTSOracleShared(t *testing.T) {
+	base := &seqOracle{}
+	o := oracles.NewBatchCommitTSOracle(base, time.Hour, 5)
+	opt := &oracle.Option{TxnScope: oracle.GlobalTxnScope}
+
+	// The batch is fetched once all the 5 requests arrive, and they share the batch timestamp.
+	var wg sync.WaitGroup
+	commitTSs := make([]uint64, 5)
+	for i := range commitTSs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			commitTS, err := o.GetCommitTimestamp(context.Background(), opt, 0, 0)
+			require.Nil(t, err)
+			commitTSs[i] = commitTS
+		}(i)
+	}
+	wg.Wait()
+	require.Equal(t, int64(1), atomic.LoadInt64(&base.calls))
+	require.Equal(t, []uint64{1, 1, 1, 1, 1}, commitTSs)
+}
+
+func TestBatchCommitTSOracleFallback(t *testing.T) {
+	base := &seqOracle{}
+	o := oracles.NewBatchCommitTSOracle(base, time.Millisecond, 1)
+	opt := &oracle.Option{TxnScope: oracle.GlobalTxnScope}
+
+	// The batch timestamp is 1, which is less than minCommitTS, so it's fetched again.
+	commitTS, err := o.GetCommitTimestamp(context.Background(), opt, 0, 2)
+	require.Nil(t, err)
+	require.Equal(t, uint64(2), commitTS)
+	require.Equal(t, int64(2), atomic.LoadInt64(&base.calls))
+
+	// The batch timestamp is 3, which isn't greater than startTS.
+	commitTS, err = o.GetCommitTimestamp(context.Background(), opt, 3, 0)
+	require.Nil(t, err)
+	require.Equal(t, uint64(4), commitTS)
+	require.Equal(t, int64(4), atomic.LoadInt64(&base.calls))
+
+	// It doesn't fall back if the context is canceled.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, err = o.GetCommitTimestamp(ctx, opt, 0, 0)
+	require.ErrorIs(t, err, context.Canceled)
+	require.Equal(t, int64(4), atomic.LoadInt64(&base.calls))
+}
+
+// BenchmarkBatchCommitTSOracle commits 1000 concurrent transactions per op and reports the TSO requests of their
+// commit timestamps.
+func BenchmarkBatchCommitTSOracle(b *testing.B) {
+	const txns = 1000
+	opt := &oracle.Option{TxnScope: oracle.GlobalTxnScope}
+	run := func(b *testing.B, newGetCommitTS func(base *seqOracle) func(startTS uint64) (uint64, error)) {
+		base := &seqOracle{latency: 100 * time.Microsecond}
+		getCommitTS := newGetCommitTS(base)
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			var wg sync.WaitGroup
+			for j := 0; j < txns; j++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					startTS, _ := base.GetTimestamp(context.Background(), opt)
+					commitTS, err := getCommitTS(startTS)
+					if err != nil || commitTS <= startTS {
+						b.Errorf("invalid commit ts %d for start ts %d: %v", commitTS, startTS, err)
+					}
+				}()
+			}
+			wg.Wait()
+		}
+		b.ReportMetric(float64(atomic.LoadInt64(&base.calls)-int64(b.N*txns))/float64(b.N), "commit-tso/op")
+	}
+	b.Run("individual", func(b *testing.B) {
+		run(b, func(base *seqOracle) func(uint64) (uint64, error) {
+			return func(uint64) (uint64, error) {
+				return base.GetTimestamp(context.Background(), opt)
+			}
+		})
+	})
+	b.Run("batched", func(b *testing.B) {
+		run(b, func(base *seqOracle) func(uint64) (uint64, error) {
+			o := oracles.NewBatchCommitTSOracle(base, 500*time.Microsecond, 64)
+			return func(startTS uint64) (uint64, error) {
+				return o.GetCommitTimestamp(context.Background(), opt, startTS, 0)
+			}
+		})
+	})
+}
@@ -144,7 +144,7 @@ func NewClient(ctx context.Context, pdAddrs []string, security config.Security,
 		clusterID:   pdCli.GetClusterID(ctx),
 		regionCache: locate.NewRegionCache(pdCli),
 		pdClient:    pdCli,
-		rpcClient:   client.NewRPCClient(client.WithSecurity(security)),
+		rpcClient:   client.NewInterceptedClient(client.NewRPCClient(client.WithSecurity(security))),
 	}, nil
 }
 
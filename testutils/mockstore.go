@@ -56,6 +56,25 @@ var BootstrapWithMultiStores = mocktikv.BootstrapWithMultiStores
 // Store. The number of Regions will be len(splitKeys) + 1.
 var BootstrapWithMultiRegions = mocktikv.BootstrapWithMultiRegions
 
+// ClockSkewPolicy is how the mock PD handles the clock going backward relative to the last issued timestamp.
+type ClockSkewPolicy = mocktikv.ClockSkewPolicy
+
+const (
+	// ClockSkewClamp keeps the timestamps monotonic, it's the default.
+	ClockSkewClamp = mocktikv.ClockSkewClamp
+	// ClockSkewError makes the mock PD fail to get timestamps with ErrClockSkew.
+	ClockSkewError = mocktikv.ClockSkewError
+)
+
+// ErrClockSkew is returned by the mock PD when the clock goes backward and the policy is ClockSkewError.
+var ErrClockSkew = mocktikv.ErrClockSkew
+
+// SetClockSkewPolicy sets how the mock PD handles the clock going backward.
+var SetClockSkewPolicy = mocktikv.SetClockSkewPolicy
+
+// SetClock replaces the clock of the mock PD, a nil clock restores time.Now.
+var SetClock = mocktikv.SetClock
+
 // ErrLocked is returned when trying to Read/Write on a locked key. Client should
 // backoff or cleanup the lock then retry.
 type ErrLocked = mocktikv.ErrLocked
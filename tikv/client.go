@@ -35,8 +35,11 @@
 package tikv
 
 import (
+	"time"
+
 	"github.com/tikv/client-go/v2/config"
 	"github.com/tikv/client-go/v2/internal/client"
+	"github.com/tikv/client-go/v2/tikvrpc"
 )
 
 // Client is a client that sends RPC.
@@ -51,6 +54,15 @@ func WithSecurity(security config.Security) ClientOpt {
 	return client.WithSecurity(security)
 }
 
+// ConnPoolAutoResize configures the RPC client to resize the connection pool of each address by the number of
+// requests in progress to it.
+type ConnPoolAutoResize = client.ConnPoolAutoResize
+
+// WithConnPoolAutoResize makes the RPC client resize the connection pools automatically.
+func WithConnPoolAutoResize(cfg ConnPoolAutoResize) ClientOpt {
+	return client.WithConnPoolAutoResize(cfg)
+}
+
 // Timeout durations.
 const (
 	ReadTimeoutMedium     = client.ReadTimeoutMedium
@@ -58,6 +70,24 @@ const (
 	MaxWriteExecutionTime = client.MaxWriteExecutionTime
 )
 
+// TimeoutConfig decides the default timeout of a request by its type and result size hint.
+type TimeoutConfig = client.TimeoutConfig
+
+// DefaultTimeoutConfig returns the TimeoutConfig used by default.
+func DefaultTimeoutConfig() TimeoutConfig {
+	return client.DefaultTimeoutConfig()
+}
+
+// SetTimeoutConfig overrides the config used by TimeoutFor.
+func SetTimeoutConfig(cfg TimeoutConfig) {
+	client.SetTimeoutConfig(cfg)
+}
+
+// TimeoutFor returns the default timeout of the request according to its type and result size hint.
+func TimeoutFor(req *tikvrpc.Request) time.Duration {
+	return client.TimeoutFor(req)
+}
+
 // NewRPCClient creates a client that manages connections and rpc calls with tikv-servers.
 func NewRPCClient(opts ...ClientOpt) *client.RPCClient {
 	return client.NewRPCClient(opts...)
@@ -54,7 +54,7 @@ func (s *KVStore) GC(ctx context.Context, safepoint uint64) (newSafePoint uint64
 		return
 	}
 
-	return s.pdClient.UpdateGCSafePoint(ctx, safepoint)
+	return s.GetPDClient().UpdateGCSafePoint(ctx, safepoint)
 }
 
 func (s *KVStore) resolveLocks(ctx context.Context, safePoint uint64, concurrency int) error {
@@ -136,7 +136,8 @@ func (s *KVStore) scanLocksInRegionWithStartKey(bo *retry.Backoffer, startKey []
 			StartKey:   startKey,
 			EndKey:     loc.EndKey,
 		})
-		resp, err := s.SendReq(bo, req, loc.Region, ReadTimeoutMedium)
+		req.ResultSizeHint = gcScanLockLimit
+		resp, err := s.SendReq(bo, req, loc.Region, TimeoutFor(req))
 		if err != nil {
 			return nil, loc, err
 		}
@@ -265,7 +266,7 @@ func (s *KVStore) UnsafeDestroyRange(ctx context.Context, startKey []byte, endKe
 }
 
 func (s *KVStore) listStoresForUnsafeDestory(ctx context.Context) ([]*metapb.Store, error) {
-	stores, err := s.pdClient.GetAllStores(ctx)
+	stores, err := s.GetPDClient().GetAllStores(ctx)
 	if err != nil {
 		return nil, errors.WithStack(err)
 	}
@@ -105,10 +105,13 @@ type KVStore struct {
 		sync.RWMutex
 		client Client
 	}
-	pdClient     pd.Client
 	regionCache  *locate.RegionCache
 	lockResolver *txnlock.LockResolver
 	txnLatches   *latch.LatchesScheduler
+	// recentCommits records the recently committed keys for the read-your-writes check of replica reads.
+	recentCommits *txnsnapshot.RecentCommits
+	// commitTSOracle acquires the commit timestamps of 2PC transactions if it's set.
+	commitTSOracle oracle.CommitTSOracle
 
 	mock bool
 
@@ -173,7 +176,6 @@ func NewKVStore(uuid string, pdClient pd.Client, spkv SafePointKV, tikvclient Cl
 		clusterID:       pdClient.GetClusterID(context.TODO()),
 		uuid:            uuid,
 		oracle:          o,
-		pdClient:        pdClient,
 		regionCache:     locate.NewRegionCache(pdClient),
 		kv:              spkv,
 		safePoint:       0,
@@ -222,6 +224,27 @@ func (s *KVStore) EnableTxnLocalLatches(size uint) {
 	s.txnLatches = latch.NewScheduler(size)
 }
 
+// EnableReadYourWritesCheck records at most capacity keys of the recently committed transactions, so that the replica
+// reads of snapshots with SetReadYourWritesCheck can be checked against them. It's a diagnostic tool for stale
+// replicas. It should be called before using the store to serve any requests.
+func (s *KVStore) EnableReadYourWritesCheck(capacity int) {
+	if capacity > 0 {
+		s.recentCommits = txnsnapshot.NewRecentCommits(capacity)
+	}
+}
+
+// SetCommitTSOracle sets the oracle to acquire the commit timestamps of 2PC transactions, e.g., a
+// oracles.BatchCommitTSOracle to batch the requests of concurrent transactions. The timestamps are fetched from the
+// store's oracle by default. It should be called before using the store to serve any requests.
+func (s *KVStore) SetCommitTSOracle(o oracle.CommitTSOracle) {
+	s.commitTSOracle = o
+}
+
+// GetRecentCommits returns the recently committed keys, it's nil if the read-your-writes check isn't enabled.
+func (s *KVStore) GetRecentCommits() *txnsnapshot.RecentCommits {
+	return s.recentCommits
+}
+
 // IsLatchEnabled is used by mockstore.TestConfig.
 func (s *KVStore) IsLatchEnabled() bool {
 	return s.txnLatches != nil
@@ -302,7 +325,7 @@ func (s *KVStore) Close() error {
 	s.wg.Wait()
 
 	s.oracle.Close()
-	s.pdClient.Close()
+	s.GetPDClient().Close()
 	s.lockResolver.Close()
 
 	if err := s.GetTiKVClient().Close(); err != nil {
@@ -340,7 +363,21 @@ func (s *KVStore) GetTimestampWithRetry(bo *Backoffer, scope string) (uint64, er
 	return s.getTimestampWithRetry(bo, scope)
 }
 
+// GetCommitTimestampWithRetry returns a commit timestamp which is greater than startTS and not less than minCommitTS.
+func (s *KVStore) GetCommitTimestampWithRetry(bo *Backoffer, scope string, startTS, minCommitTS uint64) (uint64, error) {
+	if s.commitTSOracle == nil {
+		return s.getTimestampWithRetry(bo, scope)
+	}
+	return s.getTimestampWithRetryFn(bo, scope, func(ctx context.Context, opt *oracle.Option) (uint64, error) {
+		return s.commitTSOracle.GetCommitTimestamp(ctx, opt, startTS, minCommitTS)
+	})
+}
+
 func (s *KVStore) getTimestampWithRetry(bo *Backoffer, txnScope string) (uint64, error) {
+	return s.getTimestampWithRetryFn(bo, txnScope, s.oracle.GetTimestamp)
+}
+
+func (s *KVStore) getTimestampWithRetryFn(bo *Backoffer, txnScope string, getTS func(context.Context, *oracle.Option) (uint64, error)) (uint64, error) {
 	if span := opentracing.SpanFromContext(bo.GetCtx()); span != nil && span.Tracer() != nil {
 		span1 := span.Tracer().StartSpan("TiKVStore.getTimestampWithRetry", opentracing.ChildOf(span.Context()))
 		defer span1.Finish()
@@ -348,7 +385,7 @@ func (s *KVStore) getTimestampWithRetry(bo *Backoffer, txnScope string) (uint64,
 	}
 
 	for {
-		startTS, err := s.oracle.GetTimestamp(bo.GetCtx(), &oracle.Option{TxnScope: txnScope})
+		startTS, err := getTS(bo.GetCtx(), &oracle.Option{TxnScope: txnScope})
 		// mockGetTSErrorInRetry should wait MockCommitErrorOnce first, then will run into retry() logic.
 		// Then mockGetTSErrorInRetry will return retryable error when first retry.
 		// Before PR #8743, we don't cleanup txn after meet error such as error like: PD server timeout
@@ -378,9 +415,10 @@ func (s *KVStore) GetOracle() oracle.Oracle {
 	return s.oracle
 }
 
-// GetPDClient returns the PD client.
+// GetPDClient returns the PD client, which is the one used by the region cache, see
+// locate.RegionCache.ReplacePDClient.
 func (s *KVStore) GetPDClient() pd.Client {
-	return s.pdClient
+	return s.regionCache.PDClient()
 }
 
 // SupportDeleteRange gets the storage support delete range or not.
@@ -487,6 +525,12 @@ func (s *KVStore) getSafeTS(storeID uint64) uint64 {
 	return safeTS.(uint64)
 }
 
+// HasSafeTS returns whether the safe ts of the store is known, which tells how far the replicas on the store may lag.
+// It can be used with WithSkipFollowersOfUnknownLag.
+func (s *KVStore) HasSafeTS(storeID uint64) bool {
+	return s.getSafeTS(storeID) > 0
+}
+
 // setSafeTS sets safeTs for store storeID, export for testing
 func (s *KVStore) setSafeTS(storeID, safeTS uint64) {
 	s.safeTSMap.Store(storeID, safeTS)
@@ -47,6 +47,9 @@ import (
 // RPCContext contains data that is needed to send RPC to a region.
 type RPCContext = locate.RPCContext
 
+// RPCContextLogFields is the structured form of an RPCContext for logging.
+type RPCContextLogFields = locate.RPCContextLogFields
+
 // RPCCanceller is rpc send cancelFunc collector.
 type RPCCanceller = locate.RPCCanceller
 
@@ -56,6 +59,9 @@ type RegionVerID = locate.RegionVerID
 // RegionCache caches Regions loaded from PD.
 type RegionCache = locate.RegionCache
 
+// RegionMetaKeyDecoder decodes the range keys of a region meta returned by TiKV.
+type RegionMetaKeyDecoder = locate.RegionMetaKeyDecoder
+
 // KeyLocation is the region and range that a key is located.
 type KeyLocation = locate.KeyLocation
 
@@ -82,6 +88,21 @@ type RegionRequestSender = locate.RegionRequestSender
 // StoreSelectorOption configures storeSelectorOp.
 type StoreSelectorOption = locate.StoreSelectorOption
 
+// RPCOutcome is the outcome of a request sent with an RPCContext, see RegionCache.ReleaseRPCContext.
+type RPCOutcome = locate.RPCOutcome
+
+const (
+	// RPCOutcomeOK means the request gets a response without region errors.
+	RPCOutcomeOK = locate.RPCOutcomeOK
+	// RPCOutcomeRegionError means the request gets a region error.
+	RPCOutcomeRegionError = locate.RPCOutcomeRegionError
+	// RPCOutcomeSendFail means the request fails to be sent or gets no response.
+	RPCOutcomeSendFail = locate.RPCOutcomeSendFail
+)
+
+// RegionCacheOption configures the RegionCache created by NewRegionCache.
+type RegionCacheOption = locate.RegionCacheOption
+
 // RegionRequestRuntimeStats records the runtime stats of send region requests.
 type RegionRequestRuntimeStats = locate.RegionRequestRuntimeStats
 
@@ -140,6 +161,58 @@ func WithMatchLabels(labels []*metapb.StoreLabel) StoreSelectorOption {
 	return locate.WithMatchLabels(labels)
 }
 
+// WithTiFlashFallback makes the region cache return ErrNoAvailableTiFlash instead of a nil RPCContext when all the
+// TiFlash peers of a region are invalid, so that the request can be sent to TiKV instead.
+func WithTiFlashFallback() StoreSelectorOption {
+	return locate.WithTiFlashFallback()
+}
+
+// WithForwarding indicates whether requests to an unreachable leader can be forwarded by a proxy store
+func WithForwarding(enabled bool) StoreSelectorOption {
+	return locate.WithForwarding(enabled)
+}
+
+// WithSkipFollowersOfUnknownLag makes follower and mixed reads skip the followers whose lag behind the leader is
+// unknown and fall back to the leader if no follower is left. KVStore.HasSafeTS can be used as lagKnown.
+func WithSkipFollowersOfUnknownLag(lagKnown func(storeID uint64) bool) StoreSelectorOption {
+	return locate.WithSkipFollowersOfUnknownLag(lagKnown)
+}
+
+// MixedReadPreference indicates the replicas preferred by mixed reads.
+type MixedReadPreference = locate.MixedReadPreference
+
+const (
+	// MixedReadPreferNone selects the replicas uniformly, which is the default.
+	MixedReadPreferNone = locate.MixedReadPreferNone
+	// MixedReadPreferLeader prefers the leader for fresher data.
+	MixedReadPreferLeader = locate.MixedReadPreferLeader
+	// MixedReadPreferLocal prefers the replicas on the local stores for lower latency.
+	MixedReadPreferLocal = locate.MixedReadPreferLocal
+)
+
+// WithMixedReadPreference biases mixed reads toward the preferred replicas by weight.
+func WithMixedReadPreference(pref MixedReadPreference, weight uint32, localLabels []*metapb.StoreLabel) StoreSelectorOption {
+	return locate.WithMixedReadPreference(pref, weight, localLabels)
+}
+
+// Liveness is the liveness of a store, see RegionCache.SetStoreLivenessProvider.
+type Liveness = locate.Liveness
+
+const (
+	// LivenessUnknown means the liveness of the store can't be told for now.
+	LivenessUnknown = locate.LivenessUnknown
+	// LivenessReachable means the store can be accessed directly.
+	LivenessReachable = locate.LivenessReachable
+	// LivenessUnreachable means the store can't be accessed directly.
+	LivenessUnreachable = locate.LivenessUnreachable
+)
+
+// HotRegionConfig is the configuration of detecting hot regions, see RegionCache.SetHotRegionConfig.
+type HotRegionConfig = locate.HotRegionConfig
+
+// HotRegion is a region detected hot on the client.
+type HotRegion = locate.HotRegion
+
 // NewRegionRequestRuntimeStats returns a new RegionRequestRuntimeStats.
 func NewRegionRequestRuntimeStats() RegionRequestRuntimeStats {
 	return locate.NewRegionRequestRuntimeStats()
@@ -156,6 +229,30 @@ func SetStoreLivenessTimeout(t time.Duration) {
 }
 
 // NewRegionCache creates a RegionCache.
-func NewRegionCache(pdClient pd.Client) *locate.RegionCache {
-	return locate.NewRegionCache(pdClient)
+func NewRegionCache(pdClient pd.Client, opts ...RegionCacheOption) *locate.RegionCache {
+	return locate.NewRegionCache(pdClient, opts...)
+}
+
+// WithMaxConcurrentRegionLoads limits the number of concurrent requests to load regions from PD.
+// It's unlimited if n <= 0. The default is 256.
+func WithMaxConcurrentRegionLoads(n int) RegionCacheOption {
+	return locate.WithMaxConcurrentRegionLoads(n)
+}
+
+// WithStoreEpochRefresh sets whether the store epochs of a cached region are refreshed when one of its stores has
+// failed, instead of invalidating the region and loading it from PD again. It's enabled by default.
+func WithStoreEpochRefresh(enabled bool) RegionCacheOption {
+	return locate.WithStoreEpochRefresh(enabled)
+}
+
+// WithStoreNotFoundTTL sets how long a store that PD reports as tombstone or not found is remembered. By default,
+// it's remembered forever.
+func WithStoreNotFoundTTL(ttl time.Duration) RegionCacheOption {
+	return locate.WithStoreNotFoundTTL(ttl)
+}
+
+// WithRandSeed sets the seed of the random choices of replicas and proxies made by the RegionCache, so that
+// a failure can be reproduced with the same seed.
+func WithRandSeed(seed int64) RegionCacheOption {
+	return locate.WithRandSeed(seed)
 }
@@ -137,7 +137,7 @@ func (s *KVStore) batchSendSingleRegion(bo *Backoffer, batch kvrpc.Batch, scatte
 		}
 	}
 
-	resp, err := s.pdClient.SplitRegions(bo.GetCtx(), batch.Keys)
+	resp, err := s.GetPDClient().SplitRegions(bo.GetCtx(), batch.Keys)
 	if err != nil {
 		resp := &pdpb.SplitRegionsResponse{}
 		resp.Header = &pdpb.ResponseHeader{}
@@ -214,7 +214,7 @@ func (s *KVStore) scatterRegion(bo *Backoffer, regionID uint64, tableID *int64)
 		if tableID != nil {
 			opts = append(opts, pd.WithGroup(fmt.Sprintf("%v", *tableID)))
 		}
-		_, err := s.pdClient.ScatterRegions(bo.GetCtx(), []uint64{regionID}, opts...)
+		_, err := s.GetPDClient().ScatterRegions(bo.GetCtx(), []uint64{regionID}, opts...)
 
 		if val, err2 := util.EvalFailpoint("mockScatterRegionTimeout"); err2 == nil {
 			if val.(bool) {
@@ -244,51 +244,15 @@ func (s *KVStore) WaitScatterRegionFinish(ctx context.Context, regionID uint64,
 	if backOff <= 0 {
 		backOff = waitScatterRegionFinishBackoff
 	}
-	logutil.BgLogger().Info("wait scatter region",
-		zap.Uint64("regionID", regionID), zap.Int("backoff(ms)", backOff))
-
 	bo := retry.NewBackofferWithVars(ctx, backOff, nil)
-	logFreq := 0
-	for {
-		resp, err := s.pdClient.GetOperator(ctx, regionID)
-		if err == nil && resp != nil {
-			if !bytes.Equal(resp.Desc, []byte("scatter-region")) || resp.Status != pdpb.OperatorStatus_RUNNING {
-				logutil.BgLogger().Info("wait scatter region finished",
-					zap.Uint64("regionID", regionID))
-				return nil
-			}
-			if resp.GetHeader().GetError() != nil {
-				err = errors.WithStack(&tikverr.PDError{
-					Err: resp.Header.Error,
-				})
-				logutil.BgLogger().Warn("wait scatter region error",
-					zap.Uint64("regionID", regionID), zap.Error(err))
-				return err
-			}
-			if logFreq%10 == 0 {
-				logutil.BgLogger().Info("wait scatter region",
-					zap.Uint64("regionID", regionID),
-					zap.String("reverse", string(resp.Desc)),
-					zap.String("status", pdpb.OperatorStatus_name[int32(resp.Status)]))
-			}
-			logFreq++
-		}
-		if err != nil {
-			err = bo.Backoff(retry.BoRegionMiss, errors.New(err.Error()))
-		} else {
-			err = bo.Backoff(retry.BoRegionMiss, errors.New("wait scatter region timeout"))
-		}
-		if err != nil {
-			return err
-		}
-	}
+	return s.regionCache.WaitScatterRegionFinish(bo, regionID, 0)
 }
 
 // CheckRegionInScattering uses to check whether scatter region finished.
 func (s *KVStore) CheckRegionInScattering(regionID uint64) (bool, error) {
 	bo := rangetask.NewLocateRegionBackoffer(context.Background())
 	for {
-		resp, err := s.pdClient.GetOperator(context.Background(), regionID)
+		resp, err := s.GetPDClient().GetOperator(context.Background(), regionID)
 		if err == nil && resp != nil {
 			if !bytes.Equal(resp.Desc, []byte("scatter-region")) || resp.Status != pdpb.OperatorStatus_RUNNING {
 				return false, nil
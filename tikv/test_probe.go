@@ -99,6 +99,11 @@ func (s StoreProbe) SaveSafePoint(v uint64) error {
 	return saveSafePoint(s.GetSafePointKV(), v)
 }
 
+// SetStoreResolveState changes the resolve state of a store in region cache, for testing only.
+func (s StoreProbe) SetStoreResolveState(storeID uint64, state uint64) bool {
+	return s.regionCache.SetStoreResolveState(storeID, state)
+}
+
 // SetRegionCacheStore is used to set a store in region cache, for testing only
 func (s StoreProbe) SetRegionCacheStore(id uint64, storeType tikvrpc.EndpointType, state uint64, labels []*metapb.StoreLabel) {
 	s.regionCache.SetRegionCacheStore(id, storeType, state, labels)
@@ -176,6 +181,11 @@ func (c ConfigProbe) GetGetMaxBackoff() int {
 	return txnsnapshot.ConfigProbe{}.GetGetMaxBackoff()
 }
 
+// SetScannerNextMaxBackoff sets the max sleep of each Next of scanners and returns the previous value.
+func (c ConfigProbe) SetScannerNextMaxBackoff(v int) int {
+	return txnsnapshot.ConfigProbe{}.SetScannerNextMaxBackoff(v)
+}
+
 // LoadPreSplitDetectThreshold returns presplit detect threshold config.
 func (c ConfigProbe) LoadPreSplitDetectThreshold() uint32 {
 	return transaction.ConfigProbe{}.LoadPreSplitDetectThreshold()
@@ -64,6 +64,12 @@ import (
 // RPCInterceptor, please refer to:
 //     tikv/kv.go#NewKVStore()
 //     internal/client/client_interceptor.go#SendRequest.
+//
+// The interceptor is executed for each attempt of a request, after the target
+// store is selected, so it runs within the "regionRequest.SendReqCtx" tracing
+// span. The "rpcClient.SendRequest" span is started inside next, so it covers
+// only the real RPC and not the logic of the interceptor. It applies to both
+// the unary and the batched RPCs.
 type RPCInterceptor func(next RPCInterceptorFunc) RPCInterceptorFunc
 
 // RPCInterceptorFunc is a callable function used to initiate a request to TiKV.
@@ -144,7 +150,15 @@ type interceptorCtxKeyType struct{}
 var interceptorCtxKey = interceptorCtxKeyType{}
 
 // WithRPCInterceptor is a helper function used to bind RPCInterceptor with ctx.
+// If ctx is bound with an interceptor already, the new one is chained after it,
+// i.e. the interceptor bound earlier is executed first. The interceptors apply
+// only to the requests sent with the returned ctx and its children, so they can
+// be used to observe, modify or deny the requests of a single call chain, e.g.
+// in tests, without affecting other requests of the process.
 func WithRPCInterceptor(ctx context.Context, interceptor RPCInterceptor) context.Context {
+	if v := ctx.Value(interceptorCtxKey); v != nil {
+		interceptor = ChainRPCInterceptors(v.(RPCInterceptor), interceptor)
+	}
 	return context.WithValue(ctx, interceptorCtxKey, interceptor)
 }
 
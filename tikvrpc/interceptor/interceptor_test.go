@@ -15,6 +15,7 @@
 package interceptor
 
 import (
+	"context"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
@@ -38,3 +39,25 @@ func TestInterceptor(t *testing.T) {
 	assert.Equal(t, "INTERCEPTOR-1", execLog[0])
 	assert.Equal(t, "INTERCEPTOR-2", execLog[1])
 }
+
+func TestWithRPCInterceptor(t *testing.T) {
+	manager := MockInterceptorManager{}
+	ctx := context.Background()
+	assert.Nil(t, GetRPCInterceptorFromCtx(ctx))
+	ctx1 := WithRPCInterceptor(ctx, manager.CreateMockInterceptor("INTERCEPTOR-1"))
+	ctx2 := WithRPCInterceptor(ctx1, manager.CreateMockInterceptor("INTERCEPTOR-2"))
+	send := func(target string, req *tikvrpc.Request) (*tikvrpc.Response, error) {
+		return nil, nil
+	}
+
+	// The interceptors bound to ctx are chained in the order of binding.
+	_, _ = GetRPCInterceptorFromCtx(ctx2)(send)("", nil)
+	assert.Equal(t, 2, manager.BeginCount())
+	assert.Equal(t, 2, manager.EndCount())
+	assert.Equal(t, []string{"INTERCEPTOR-1", "INTERCEPTOR-2"}, manager.ExecLog())
+
+	// The parent ctx isn't affected.
+	manager.Reset()
+	_, _ = GetRPCInterceptorFromCtx(ctx1)(send)("", nil)
+	assert.Equal(t, []string{"INTERCEPTOR-1"}, manager.ExecLog())
+}
@@ -36,6 +36,7 @@ package tikvrpc
 
 import (
 	"context"
+	"strings"
 	"sync/atomic"
 	"time"
 
@@ -217,6 +218,58 @@ type Request struct {
 	// If it's not empty, the store which receive the request will forward it to
 	// the forwarded host. It's useful when network partition occurs.
 	ForwardedHost string
+	// UseCompressor is the name of the gRPC compressor to compress the request with, e.g. gzip. The request is sent
+	// by a unary call if it's set, because requests in the BatchCommands stream share the compressor of the stream.
+	UseCompressor string
+	// ForceUnary makes the request sent by a unary call even if batching is enabled, bypassing the batch queue to
+	// reduce the latency of small latency-critical requests.
+	ForceUnary bool
+	// Metadata is the custom gRPC metadata sent with the request, e.g. tracing or tenant headers. Requests in the
+	// BatchCommands stream share the metadata of the stream, so the request is sent by a unary call if it carries
+	// any key not set by SetBestEffortMetadataKeys. The best-effort metadata is dropped if the request is batched.
+	Metadata map[string]string
+	// KVReadTimeout limits each attempt of a read request if it's shorter than the timeout of the call. A timed out
+	// attempt is retried on the next replica without marking the store failed or backing off, until the Backoffer's
+	// context is done. The kvproto in use has no field to pass it to TiKV, so it's only enforced by the client.
+	KVReadTimeout time.Duration
+	// AllowHotRegionFollowerRead indicates the leader read tolerates being served by a follower, so it can be
+	// upgraded to a mixed replica read when the region is hot, see locate.RegionCache.SetHotRegionConfig.
+	AllowHotRegionFollowerRead bool
+	// ResultSizeHint is the estimated number of key-value pairs in the response, 0 means unknown. It's used to pick
+	// the default timeout of the request, see client.TimeoutFor.
+	ResultSizeHint uint64
+	// LowPriorityBatch puts the request behind the normal ones in the batch queue of the connection if it's batched,
+	// e.g. resolving locks in the background. It's independent of the command priority, which is for TiKV.
+	LowPriorityBatch bool
+}
+
+// bestEffortMetadataKeys is the set of lower-cased Request.Metadata keys which the request can be sent without.
+var bestEffortMetadataKeys atomic.Value // map[string]struct{}
+
+// SetBestEffortMetadataKeys sets the keys of Request.Metadata which are sent on a best-effort basis, e.g. tracing
+// headers, so a request carrying only them can still be batched and the metadata is dropped then. A request
+// carrying any other key, e.g. tenant headers checked by server-side middleware, is sent by a unary call. The keys
+// are case-insensitive like gRPC metadata, and no key is set by default.
+func SetBestEffortMetadataKeys(keys ...string) {
+	m := make(map[string]struct{}, len(keys))
+	for _, k := range keys {
+		m[strings.ToLower(k)] = struct{}{}
+	}
+	bestEffortMetadataKeys.Store(m)
+}
+
+// HasUnbatchableMetadata returns whether the request carries any metadata key not set by SetBestEffortMetadataKeys.
+func (req *Request) HasUnbatchableMetadata() bool {
+	if len(req.Metadata) == 0 {
+		return false
+	}
+	keys, _ := bestEffortMetadataKeys.Load().(map[string]struct{})
+	for k := range req.Metadata {
+		if _, ok := keys[strings.ToLower(k)]; !ok {
+			return true
+		}
+	}
+	return false
 }
 
 // NewRequest returns new kv rpc request.
@@ -147,7 +147,7 @@ func (t *DeleteRangeTask) sendReqOnRange(ctx context.Context, r kv.KeyRange) (Ta
 			NotifyOnly: t.notifyOnly,
 		})
 
-		resp, err := t.store.SendReq(bo, req, loc.Region, client.ReadTimeoutMedium)
+		resp, err := t.store.SendReq(bo, req, loc.Region, client.TimeoutFor(req))
 		if err != nil {
 			return stat, err
 		}
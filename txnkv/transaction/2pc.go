@@ -62,6 +62,7 @@ import (
 	"github.com/tikv/client-go/v2/oracle"
 	"github.com/tikv/client-go/v2/tikvrpc"
 	"github.com/tikv/client-go/v2/txnkv/txnlock"
+	"github.com/tikv/client-go/v2/txnkv/txnsnapshot"
 	"github.com/tikv/client-go/v2/util"
 	zap "go.uber.org/zap"
 )
@@ -99,6 +100,8 @@ type kvstore interface {
 
 	// GetTimestampWithRetry returns latest timestamp.
 	GetTimestampWithRetry(bo *retry.Backoffer, scope string) (uint64, error)
+	// GetCommitTimestampWithRetry returns a commit timestamp which is greater than startTS and not less than minCommitTS.
+	GetCommitTimestampWithRetry(bo *retry.Backoffer, scope string, startTS, minCommitTS uint64) (uint64, error)
 	// GetOracle gets a timestamp oracle client.
 	GetOracle() oracle.Oracle
 	CurrentTimestamp(txnScope string) (uint64, error)
@@ -114,6 +117,8 @@ type kvstore interface {
 	GetClusterID() uint64
 	// IsClose checks whether the store is closed.
 	IsClose() bool
+	// GetRecentCommits returns the recently committed keys, it's nil if they aren't recorded.
+	GetRecentCommits() *txnsnapshot.RecentCommits
 }
 
 // twoPhaseCommitter executes a two-phase commit protocol.
@@ -503,6 +508,7 @@ func (c *twoPhaseCommitter) initKeysAndMutations(ctx context.Context) error {
 
 	var err error
 	var assertionError error
+	primaryFixed := len(c.primaryKey) > 0
 	for it := memBuf.IterWithFlags(nil, nil); it.Valid(); err = it.Next() {
 		_ = err
 		key := it.Key()
@@ -620,6 +626,11 @@ func (c *twoPhaseCommitter) initKeysAndMutations(ctx context.Context) error {
 	if c.mutations.Len() == 0 {
 		return nil
 	}
+	if !primaryFixed && txn.primarySelection != nil {
+		if err = c.selectPrimary(txn.primarySelection); err != nil {
+			return err
+		}
+	}
 	c.txnSize = size
 
 	const logEntryCount = 10000
@@ -646,7 +657,7 @@ func (c *twoPhaseCommitter) initKeysAndMutations(ctx context.Context) error {
 		return err
 	}
 
-	commitDetail := &util.CommitDetails{WriteSize: size, WriteKeys: c.mutations.Len()}
+	commitDetail := &util.CommitDetails{WriteSize: size, WriteKeys: c.mutations.Len(), PrimaryKey: c.primary()}
 	metrics.TiKVTxnWriteKVCountHistogram.Observe(float64(commitDetail.WriteKeys))
 	metrics.TiKVTxnWriteSizeHistogram.Observe(float64(commitDetail.WriteSize))
 	c.hasNoNeedCommitKeys = checkCnt > 0
@@ -671,6 +682,79 @@ func (c *twoPhaseCommitter) primary() []byte {
 	return c.primaryKey
 }
 
+// PrimarySelection selects the index of the primary key in the mutations of a transaction. The mutation selected
+// must not be an Op_CheckNotExists one, which isn't locked.
+type PrimarySelection func(mutations CommitterMutations) int
+
+var (
+	// PrimarySelectionDefault selects the first mutation that is locked as the primary.
+	PrimarySelectionDefault PrimarySelection = func(mutations CommitterMutations) int {
+		for i := 0; i < mutations.Len(); i++ {
+			if mutations.GetOp(i) != kvrpcpb.Op_CheckNotExists {
+				return i
+			}
+		}
+		return 0
+	}
+	// PrimarySelectionRandom selects the primary uniformly at random from the mutations that are locked, to avoid
+	// CheckTxnStatus hotspots on the same primary keys.
+	PrimarySelectionRandom PrimarySelection = func(mutations CommitterMutations) int {
+		candidates := 0
+		for i := 0; i < mutations.Len(); i++ {
+			if mutations.GetOp(i) != kvrpcpb.Op_CheckNotExists {
+				candidates++
+			}
+		}
+		if candidates == 0 {
+			return 0
+		}
+		n := rand.Intn(candidates)
+		for i := 0; i < mutations.Len(); i++ {
+			if mutations.GetOp(i) == kvrpcpb.Op_CheckNotExists {
+				continue
+			}
+			if n == 0 {
+				return i
+			}
+			n--
+		}
+		return 0
+	}
+)
+
+// PrimarySelectionCallback selects the primary by f, which returns the index in the mutations.
+func PrimarySelectionCallback(f func(mutations CommitterMutations) int) PrimarySelection {
+	return f
+}
+
+// selectPrimary fixes the primary key selected by selection. The mutations are sorted by key, so the primary is
+// selected before they are grouped into batches.
+func (c *twoPhaseCommitter) selectPrimary(selection PrimarySelection) error {
+	idx := selection(c.mutations)
+	if idx < 0 || idx >= c.mutations.Len() {
+		return errors.Errorf("invalid primary index %d selected from %d mutations", idx, c.mutations.Len())
+	}
+	if c.mutations.GetOp(idx) == kvrpcpb.Op_CheckNotExists {
+		// All mutations are Op_CheckNotExists, nothing is locked so the primary doesn't matter.
+		if len(c.primaryKey) == 0 {
+			return nil
+		}
+		return errors.Errorf("invalid primary index %d selected, the mutation is not locked", idx)
+	}
+	c.primaryKey = c.mutations.GetKey(idx)
+	return nil
+}
+
+// writeRequestContext returns the context of the prewrite and commit requests.
+func (c *twoPhaseCommitter) writeRequestContext() kvrpcpb.Context {
+	return kvrpcpb.Context{
+		Priority:         c.priority,
+		SyncLog:          c.syncLog,
+		ResourceGroupTag: c.resourceGroupTag,
+		DiskFullOpt:      c.diskFullOpt,
+	}
+}
+
 // asyncSecondaries returns all keys that must be checked in the recovery phase of an async commit.
 func (c *twoPhaseCommitter) asyncSecondaries() [][]byte {
 	secondaries := make([][]byte, 0, c.mutations.Len())
@@ -872,10 +956,13 @@ func (c *twoPhaseCommitter) doActionOnGroupMutations(bo *retry.Backoffer, action
 		}
 	}
 
+	sizeLimit, keyLimit := c.batchLimits()
 	batchBuilder := newBatched(c.primary())
+	// Custom batch limits are for bulk loading, whose primary key is committed ahead of the large batches of the
+	// secondaries in a batch of its own. 1PC requires all the mutations in one batch.
+	batchBuilder.isolatePrimary = c.hasCustomBatchLimits() && !c.isOnePC()
 	for _, group := range groups {
-		batchBuilder.appendBatchMutationsBySize(group.region, group.mutations, sizeFunc,
-			int(kv.TxnCommitBatchSize.Load()))
+		batchBuilder.appendBatchMutationsBySize(group.region, group.mutations, sizeFunc, sizeLimit, keyLimit)
 	}
 	firstIsPrimary := batchBuilder.setPrimary()
 
@@ -951,12 +1038,22 @@ func (c *twoPhaseCommitter) doActionOnGroupMutations(bo *retry.Backoffer, action
 				}
 			}
 
-			e := c.doActionOnBatches(secondaryBo, action, batchBuilder.allBatches())
+			// The secondaries are committed after Commit returns, so their outcomes are reported to the secondaries
+			// callback instead of the commit details of the transaction.
+			secondaryDetail := &util.CommitDetails{}
+			e := c.doActionOnBatches(secondaryBo, actionCommit{detail: secondaryDetail}, batchBuilder.allBatches())
+			c.onSecondariesCommitted(secondaryDetail, e)
 			if e != nil {
+				secondaryDetail.Mu.Lock()
 				logutil.BgLogger().Debug("2PC async doActionOnBatches",
 					zap.Uint64("session", c.sessionID),
 					zap.Stringer("action type", action),
+					zap.Int32("batches", secondaryDetail.Mu.CommitBatchNum),
+					zap.Int32("failed batches", secondaryDetail.Mu.CommitFailedBatchNum),
+					zap.Uint64("slowest region", secondaryDetail.Mu.SlowestCommitRegion),
+					zap.Duration("slowest time", secondaryDetail.Mu.SlowestCommitTime),
 					zap.Error(e))
+				secondaryDetail.Mu.Unlock()
 				metrics.SecondaryLockCleanupFailureCounterCommit.Inc()
 			}
 		}()
@@ -966,6 +1063,14 @@ func (c *twoPhaseCommitter) doActionOnGroupMutations(bo *retry.Backoffer, action
 	return err
 }
 
+// onSecondariesCommitted reports the outcomes of the secondaries committed in the background to the callback set by
+// KVTxn.SetSecondariesCallback.
+func (c *twoPhaseCommitter) onSecondariesCommitted(detail *util.CommitDetails, err error) {
+	if c.txn != nil && c.txn.secondariesCallback != nil {
+		c.txn.secondariesCallback(detail, err)
+	}
+}
+
 // doActionOnBatches does action to batches in parallel.
 func (c *twoPhaseCommitter) doActionOnBatches(bo *retry.Backoffer, action twoPhaseCommitAction, batches []batchMutations) error {
 	if len(batches) == 0 {
@@ -980,7 +1085,7 @@ func (c *twoPhaseCommitter) doActionOnBatches(bo *retry.Backoffer, action twoPha
 	}
 	if noNeedFork {
 		for _, b := range batches {
-			e := action.handleSingleBatch(c, bo, b)
+			e := c.handleBatch(bo, action, b)
 			if e != nil {
 				logutil.BgLogger().Debug("2PC doActionOnBatches failed",
 					zap.Uint64("session", c.sessionID),
@@ -997,13 +1102,55 @@ func (c *twoPhaseCommitter) doActionOnBatches(bo *retry.Backoffer, action twoPha
 	// If the rate limit is too high, tikv will report service is busy.
 	// If the rate limit is too low, we can't full utilize the tikv's throughput.
 	// TODO: Find a self-adaptive way to control the rate limit here.
-	if rateLim > config.GetGlobalConfig().CommitterConcurrency {
-		rateLim = config.GetGlobalConfig().CommitterConcurrency
+	if concurrency := c.concurrency(); rateLim > concurrency {
+		rateLim = concurrency
 	}
 	batchExecutor := newBatchExecutor(rateLim, c, action, bo)
 	return batchExecutor.process(batches)
 }
 
+// concurrency returns the max number of batches of an action handled concurrently. The transaction's own limit set
+// by KVTxn.SetCommitterConcurrency takes precedence over the global CommitterConcurrency.
+func (c *twoPhaseCommitter) concurrency() int {
+	if c.txn != nil && c.txn.committerConcurrency > 0 {
+		return c.txn.committerConcurrency
+	}
+	return config.GetGlobalConfig().CommitterConcurrency
+}
+
+// prewriteMaxAttempts returns the max number of attempts to prewrite a batch, 0 means unlimited. The transaction's
+// own limit set by KVTxn.SetPrewriteMaxAttempts takes precedence over the global PrewriteMaxAttempts.
+func (c *twoPhaseCommitter) prewriteMaxAttempts() uint {
+	if c.txn != nil && c.txn.prewriteMaxAttempts > 0 {
+		return c.txn.prewriteMaxAttempts
+	}
+	return config.GetGlobalConfig().TiKVClient.PrewriteMaxAttempts
+}
+
+// handleBatch applies the action to the batch. The outcome of each commit batch is recorded in the details of the
+// commit action. A failed commit batch doesn't stop the others, since the transaction is committed once its primary is.
+func (c *twoPhaseCommitter) handleBatch(bo *retry.Backoffer, action twoPhaseCommitAction, batch batchMutations) error {
+	ac, ok := action.(actionCommit)
+	if !ok || ac.detail == nil {
+		return action.handleSingleBatch(c, bo, batch)
+	}
+	start := time.Now()
+	err := action.handleSingleBatch(c, bo, batch)
+	elapsed := time.Since(start)
+	commitDetail := ac.detail
+	commitDetail.Mu.Lock()
+	commitDetail.Mu.CommitBatchNum++
+	if err != nil {
+		commitDetail.Mu.CommitFailedBatchNum++
+	}
+	if elapsed > commitDetail.Mu.SlowestCommitTime {
+		commitDetail.Mu.SlowestCommitTime = elapsed
+		commitDetail.Mu.SlowestCommitRegion = batch.region.GetID()
+	}
+	commitDetail.Mu.Unlock()
+	return err
+}
+
 func (c *twoPhaseCommitter) keyValueSize(key, value []byte) int {
 	return len(key) + len(value)
 }
@@ -1016,6 +1163,21 @@ func (c *twoPhaseCommitter) SetDiskFullOpt(level kvrpcpb.DiskFullOpt) {
 	c.diskFullOpt = level
 }
 
+// storeSelectorOptions returns the options to select stores for the requests of the transaction.
+func (c *twoPhaseCommitter) storeSelectorOptions() []locate.StoreSelectorOption {
+	if c.txn == nil || c.txn.forwarding == nil {
+		return nil
+	}
+	return []locate.StoreSelectorOption{locate.WithForwarding(*c.txn.forwarding)}
+}
+
+// sendReq sends a request of the transaction to the region with the store selector options of the transaction.
+func (c *twoPhaseCommitter) sendReq(bo *retry.Backoffer, req *tikvrpc.Request, regionID locate.RegionVerID, timeout time.Duration) (*tikvrpc.Response, error) {
+	sender := locate.NewRegionRequestSender(c.store.GetRegionCache(), c.store.GetTiKVClient())
+	resp, _, err := sender.SendReqCtx(bo, req, regionID, timeout, tikvrpc.TiKV, c.storeSelectorOptions()...)
+	return resp, err
+}
+
 type ttlManagerState uint32
 
 const (
@@ -1106,7 +1268,7 @@ func keepAlive(c *twoPhaseCommitter, closeCh chan struct{}, primaryKey []byte, l
 			logutil.Logger(bo.GetCtx()).Info("send TxnHeartBeat",
 				zap.Uint64("startTS", c.startTS), zap.Uint64("newTTL", newTTL))
 			startTime := time.Now()
-			_, stopHeartBeat, err := sendTxnHeartBeat(bo, c.store, primaryKey, c.startTS, newTTL)
+			_, stopHeartBeat, err := sendTxnHeartBeat(bo, c.store, primaryKey, c.startTS, newTTL, c.storeSelectorOptions()...)
 			if err != nil {
 				keepFail++
 				metrics.TxnHeartBeatHistogramError.Observe(time.Since(startTime).Seconds())
@@ -1128,19 +1290,22 @@ func keepAlive(c *twoPhaseCommitter, closeCh chan struct{}, primaryKey []byte, l
 	}
 }
 
-func sendTxnHeartBeat(bo *retry.Backoffer, store kvstore, primary []byte, startTS, ttl uint64) (newTTL uint64, stopHeartBeat bool, err error) {
+// sendTxnHeartBeat sends the TxnHeartBeat request with the store selector options of the transaction, so it's
+// forwarded by a proxy store like the other requests of the transaction.
+func sendTxnHeartBeat(bo *retry.Backoffer, store kvstore, primary []byte, startTS, ttl uint64, opts ...locate.StoreSelectorOption) (newTTL uint64, stopHeartBeat bool, err error) {
 	req := tikvrpc.NewRequest(tikvrpc.CmdTxnHeartBeat, &kvrpcpb.TxnHeartBeatRequest{
 		PrimaryLock:   primary,
 		StartVersion:  startTS,
 		AdviseLockTtl: ttl,
 	})
+	sender := locate.NewRegionRequestSender(store.GetRegionCache(), store.GetTiKVClient())
 	for {
 		loc, err := store.GetRegionCache().LocateKey(bo, primary)
 		if err != nil {
 			return 0, false, err
 		}
 		req.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
-		resp, err := store.SendReq(bo, req, loc.Region, client.ReadTimeoutShort)
+		resp, _, err := sender.SendReqCtx(bo, req, loc.Region, client.ReadTimeoutShort, tikvrpc.TiKV, opts...)
 		if err != nil {
 			return 0, false, err
 		}
@@ -1187,7 +1352,7 @@ func (c *twoPhaseCommitter) checkAsyncCommit() bool {
 	asyncCommitCfg := config.GetGlobalConfig().TiKVClient.AsyncCommit
 	// TODO the keys limit need more tests, this value makes the unit test pass by now.
 	// Async commit is not compatible with Binlog because of the non unique timestamp issue.
-	if c.txn.enableAsyncCommit &&
+	if c.txn.enableAsyncCommit && !c.txn.disableAsyncCommit &&
 		uint(c.mutations.Len()) <= asyncCommitCfg.KeysLimit &&
 		!c.shouldWriteBinlog() {
 		totalKeySize := uint64(0)
@@ -1213,7 +1378,7 @@ func (c *twoPhaseCommitter) checkOnePC() bool {
 		return false
 	}
 
-	return !c.shouldWriteBinlog() && c.txn.enable1PC
+	return !c.shouldWriteBinlog() && c.txn.enable1PC && !c.txn.disable1PC
 }
 
 func (c *twoPhaseCommitter) needLinearizability() bool {
@@ -1302,6 +1467,7 @@ func (c *twoPhaseCommitter) execute(ctx context.Context) (err error) {
 	var binlogSkipped bool
 	defer func() {
 		if c.isOnePC() {
+			c.getDetail().CommitProtocol = util.CommitProtocol1PC
 			// The error means the 1PC transaction failed.
 			if err != nil {
 				if c.getUndeterminedErr() == nil {
@@ -1312,6 +1478,7 @@ func (c *twoPhaseCommitter) execute(ctx context.Context) (err error) {
 				metrics.OnePCTxnCounterOk.Inc()
 			}
 		} else if c.isAsyncCommit() {
+			c.getDetail().CommitProtocol = util.CommitProtocolAsyncCommit
 			// The error means the async commit should not succeed.
 			if err != nil {
 				if c.getUndeterminedErr() == nil {
@@ -1322,6 +1489,7 @@ func (c *twoPhaseCommitter) execute(ctx context.Context) (err error) {
 				metrics.AsyncCommitTxnCounterOk.Inc()
 			}
 		} else {
+			c.getDetail().CommitProtocol = util.CommitProtocol2PC
 			// Always clean up all written keys if the txn does not commit.
 			c.mu.RLock()
 			committed := c.mu.committed
@@ -1485,7 +1653,7 @@ func (c *twoPhaseCommitter) execute(ctx context.Context) (err error) {
 	} else {
 		start = time.Now()
 		logutil.Event(ctx, "start get commit ts")
-		commitTS, err = c.store.GetTimestampWithRetry(retry.NewBackofferWithVars(ctx, TsoMaxBackoff, c.txn.vars), c.txn.GetScope())
+		commitTS, err = c.store.GetCommitTimestampWithRetry(retry.NewBackofferWithVars(ctx, TsoMaxBackoff, c.txn.vars), c.txn.GetScope(), c.startTS, c.minCommitTS)
 		if err != nil {
 			logutil.Logger(ctx).Warn("2PC get commitTS failed",
 				zap.Error(err),
@@ -1583,7 +1751,9 @@ func (c *twoPhaseCommitter) execute(ctx context.Context) (err error) {
 				return
 			}
 			commitBo := retry.NewBackofferWithVars(c.store.Ctx(), CommitSecondaryMaxBackoff, c.txn.vars)
-			err := c.commitMutations(commitBo, c.mutations)
+			detail := &util.CommitDetails{}
+			err := c.commitMutations(commitBo, c.mutations, detail)
+			c.onSecondariesCommitted(detail, err)
 			if err != nil {
 				logutil.Logger(ctx).Warn("2PC async commit failed", zap.Uint64("sessionID", c.sessionID),
 					zap.Uint64("startTS", c.startTS), zap.Uint64("commitTS", c.commitTS), zap.Error(err))
@@ -1594,13 +1764,31 @@ func (c *twoPhaseCommitter) execute(ctx context.Context) (err error) {
 	return c.commitTxn(ctx, commitDetail)
 }
 
+// recordRecentCommits records the keys written by the committed transaction for the read-your-writes check of
+// replica reads.
+func (c *twoPhaseCommitter) recordRecentCommits() {
+	commits := c.store.GetRecentCommits()
+	if commits == nil {
+		return
+	}
+	commitTS := atomic.LoadUint64(&c.commitTS)
+	for i := 0; i < c.mutations.Len(); i++ {
+		switch c.mutations.GetOp(i) {
+		case kvrpcpb.Op_Put, kvrpcpb.Op_Insert:
+			commits.Record(c.mutations.GetKey(i), c.mutations.GetValue(i), commitTS)
+		case kvrpcpb.Op_Del:
+			commits.Record(c.mutations.GetKey(i), nil, commitTS)
+		}
+	}
+}
+
 func (c *twoPhaseCommitter) commitTxn(ctx context.Context, commitDetail *util.CommitDetails) error {
 	c.txn.GetMemBuffer().DiscardValues()
 	start := time.Now()
 
 	// Use the VeryLongMaxBackoff to commit the primary key.
 	commitBo := retry.NewBackofferWithVars(ctx, int(CommitMaxBackoff), c.txn.vars)
-	err := c.commitMutations(commitBo, c.mutations)
+	err := c.commitMutations(commitBo, c.mutations, commitDetail)
 	commitDetail.CommitTime = time.Since(start)
 	if commitBo.GetTotalSleep() > 0 {
 		commitDetail.Mu.Lock()
@@ -1766,7 +1954,7 @@ func (c *twoPhaseCommitter) tryAmendTxn(ctx context.Context, startInfoSchema Sch
 func (c *twoPhaseCommitter) getCommitTS(ctx context.Context, commitDetail *util.CommitDetails) (uint64, error) {
 	start := time.Now()
 	logutil.Event(ctx, "start get commit ts")
-	commitTS, err := c.store.GetTimestampWithRetry(retry.NewBackofferWithVars(ctx, TsoMaxBackoff, c.txn.vars), c.txn.GetScope())
+	commitTS, err := c.store.GetCommitTimestampWithRetry(retry.NewBackofferWithVars(ctx, TsoMaxBackoff, c.txn.vars), c.txn.GetScope(), c.startTS, c.minCommitTS)
 	if err != nil {
 		logutil.Logger(ctx).Warn("2PC get commitTS failed",
 			zap.Error(err),
@@ -1848,6 +2036,24 @@ func (c *twoPhaseCommitter) calculateMaxCommitTS(ctx context.Context) error {
 	return nil
 }
 
+// batchLimits returns the size limit and the key count limit of a batch. The transaction's own limits set by
+// KVTxn.SetCommitBatchLimits take precedence over the global TxnCommitBatchSize.
+func (c *twoPhaseCommitter) batchLimits() (sizeLimit int, keyLimit int) {
+	sizeLimit = int(kv.TxnCommitBatchSize.Load())
+	if c.txn != nil {
+		if c.txn.commitBatchSize > 0 {
+			sizeLimit = c.txn.commitBatchSize
+		}
+		keyLimit = c.txn.commitBatchKeys
+	}
+	return
+}
+
+// hasCustomBatchLimits returns whether the batch limits are set by KVTxn.SetCommitBatchLimits.
+func (c *twoPhaseCommitter) hasCustomBatchLimits() bool {
+	return c.txn != nil && (c.txn.commitBatchSize > 0 || c.txn.commitBatchKeys > 0)
+}
+
 func (c *twoPhaseCommitter) shouldWriteBinlog() bool {
 	return c.binlog != nil
 }
@@ -1856,6 +2062,8 @@ type batchMutations struct {
 	region    locate.RegionVerID
 	mutations CommitterMutations
 	isPrimary bool
+	// splitDepth is the number of times the mutations are split because the message is too large.
+	splitDepth int
 }
 
 func (b *batchMutations) relocate(bo *retry.Backoffer, c *locate.RegionCache) (bool, error) {
@@ -1871,10 +2079,46 @@ func (b *batchMutations) relocate(bo *retry.Backoffer, c *locate.RegionCache) (b
 	return true, nil
 }
 
+// split splits the batch into halves when the request or its response exceeds the gRPC message size limit.
+// The half containing the primary key is put first. It returns false if the batch can't be split any more.
+func (b *batchMutations) split(primary []byte) ([]batchMutations, bool) {
+	n := b.mutations.Len()
+	if n <= 1 || b.splitDepth >= locate.MaxMessageTooLargeSplitDepth {
+		return nil, false
+	}
+	mid := n / 2
+	halves := []batchMutations{
+		{region: b.region, mutations: b.mutations.Slice(0, mid), splitDepth: b.splitDepth + 1},
+		{region: b.region, mutations: b.mutations.Slice(mid, n), splitDepth: b.splitDepth + 1},
+	}
+	if b.isPrimary {
+		for i := mid; i < n; i++ {
+			if bytes.Equal(b.mutations.GetKey(i), primary) {
+				halves[0], halves[1] = halves[1], halves[0]
+				break
+			}
+		}
+		halves[0].isPrimary = true
+	}
+	return halves, true
+}
+
+// handleSplitBatches applies the action to the split batches one by one, the primary batch goes first.
+func (c *twoPhaseCommitter) handleSplitBatches(bo *retry.Backoffer, action twoPhaseCommitAction, batches []batchMutations) error {
+	for _, batch := range batches {
+		if err := action.handleSingleBatch(c, bo, batch); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
 type batched struct {
 	batches    []batchMutations
 	primaryIdx int
 	primaryKey []byte
+	// isolatePrimary puts the primary key in a batch of its own.
+	isolatePrimary bool
 }
 
 func newBatched(primaryKey []byte) *batched {
@@ -1884,9 +2128,26 @@ func newBatched(primaryKey []byte) *batched {
 	}
 }
 
+// SplitMutationsBySize splits the mutations of a region into batches, each of which holds keys until their
+// accumulated size computed by sizeFn reaches sizeLimit or the number of keys reaches keyLimit. keyLimit <= 0 means
+// the number of keys is not limited. If the primary key is in the mutations, it's put in a batch of its own, which is
+// the first one, as the primary key must be committed ahead of the secondaries.
+func SplitMutationsBySize(mutations CommitterMutations, primaryKey []byte, sizeFn func(k, v []byte) int, sizeLimit, keyLimit int) []CommitterMutations {
+	b := newBatched(primaryKey)
+	b.isolatePrimary = true
+	b.appendBatchMutationsBySize(locate.RegionVerID{}, mutations, sizeFn, sizeLimit, keyLimit)
+	b.setPrimary()
+	batches := make([]CommitterMutations, 0, len(b.batches))
+	for _, batch := range b.batches {
+		batches = append(batches, batch.mutations)
+	}
+	return batches
+}
+
 // appendBatchMutationsBySize appends mutations to b. It may split the keys to make
-// sure each batch's size does not exceed the limit.
-func (b *batched) appendBatchMutationsBySize(region locate.RegionVerID, mutations CommitterMutations, sizeFn func(k, v []byte) int, limit int) {
+// sure each batch's size does not exceed the limit and each batch has at most keyLimit keys.
+// keyLimit <= 0 means the number of keys is not limited.
+func (b *batched) appendBatchMutationsBySize(region locate.RegionVerID, mutations CommitterMutations, sizeFn func(k, v []byte) int, limit int, keyLimit int) {
 	if _, err := util.EvalFailpoint("twoPCRequestBatchSizeLimit"); err == nil {
 		limit = 1
 	}
@@ -1894,14 +2155,22 @@ func (b *batched) appendBatchMutationsBySize(region locate.RegionVerID, mutation
 	var start, end int
 	for start = 0; start < mutations.Len(); start = end {
 		var size int
-		for end = start; end < mutations.Len() && size < limit; end++ {
+		for end = start; end < mutations.Len() && size < limit && (keyLimit <= 0 || end-start < keyLimit); end++ {
 			var k, v []byte
 			k = mutations.GetKey(end)
 			v = mutations.GetValue(end)
-			size += sizeFn(k, v)
 			if b.primaryIdx < 0 && bytes.Equal(k, b.primaryKey) {
+				if b.isolatePrimary && end > start {
+					// End the batch before the primary key, which starts a batch of its own.
+					break
+				}
 				b.primaryIdx = len(b.batches)
+				if b.isolatePrimary {
+					end++
+					break
+				}
 			}
+			size += sizeFn(k, v)
 		}
 		b.batches = append(b.batches, batchMutations{
 			region:    region,
@@ -1989,7 +2258,7 @@ func (batchExe *batchExecutor) startWorker(exitCh chan struct{}, ch chan error,
 					singleBatchBackoffer, singleBatchCancel = batchExe.backoffer.Fork()
 					defer singleBatchCancel()
 				}
-				ch <- batchExe.action.handleSingleBatch(batchExe.committer, singleBatchBackoffer, batch)
+				ch <- batchExe.committer.handleBatch(singleBatchBackoffer, batchExe.action, batch)
 				commitDetail := batchExe.committer.getDetail()
 				// For prewrite, we record the max backoff time
 				if _, ok := batchExe.action.(actionPrewrite); ok {
@@ -0,0 +1,103 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transaction
+
+import (
+	"testing"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/stretchr/testify/assert"
+	"github.com/tikv/client-go/v2/internal/locate"
+)
+
+func TestAppendBatchMutationsBySize(t *testing.T) {
+	assert := assert.New(t)
+
+	mutations := NewPlainMutations(10)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j"} {
+		mutations.Push(kvrpcpb.Op_Put, []byte(k), []byte("v"), false, false, false)
+	}
+	region := locate.NewRegionVerID(1, 1, 1)
+	sizeFn := func(k, v []byte) int { return len(k) + len(v) }
+
+	// Limited by the size only.
+	b := newBatched([]byte("h"))
+	b.appendBatchMutationsBySize(region, &mutations, sizeFn, 8, 0)
+	assert.True(b.setPrimary())
+	batches := b.allBatches()
+	assert.Len(batches, 3)
+	assert.True(batches[0].isPrimary)
+	assert.Equal([][]byte{[]byte("e"), []byte("f"), []byte("g"), []byte("h")}, batches[0].mutations.GetKeys())
+
+	// The primary key is in a batch of its own if it's isolated.
+	b = newBatched([]byte("h"))
+	b.isolatePrimary = true
+	b.appendBatchMutationsBySize(region, &mutations, sizeFn, 8, 0)
+	assert.True(b.setPrimary())
+	batches = b.allBatches()
+	assert.Len(batches, 4)
+	assert.True(batches[0].isPrimary)
+	assert.Equal([][]byte{[]byte("h")}, batches[0].mutations.GetKeys())
+	for _, batch := range batches[1:] {
+		assert.False(batch.isPrimary)
+	}
+
+	// The number of keys is also limited.
+	b = newBatched([]byte("h"))
+	b.isolatePrimary = true
+	b.appendBatchMutationsBySize(region, &mutations, sizeFn, 8, 3)
+	assert.True(b.setPrimary())
+	batches = b.allBatches()
+	assert.Len(batches, 5)
+	total := 0
+	for i, batch := range batches {
+		assert.LessOrEqual(batch.mutations.Len(), 3)
+		assert.Equal(i == 0, batch.isPrimary)
+		total += batch.mutations.Len()
+	}
+	assert.Equal(10, total)
+	assert.Equal([][]byte{[]byte("h")}, batches[0].mutations.GetKeys())
+
+	// The primary key isn't in the mutations.
+	b = newBatched([]byte("z"))
+	b.appendBatchMutationsBySize(region, &mutations, sizeFn, 1000, 4)
+	assert.False(b.setPrimary())
+	assert.Len(b.allBatches(), 3)
+	for _, batch := range b.allBatches() {
+		assert.False(batch.isPrimary)
+	}
+}
+
+func TestSplitMutationsBySize(t *testing.T) {
+	assert := assert.New(t)
+
+	mutations := NewPlainMutations(6)
+	for _, k := range []string{"a", "b", "c", "d", "e", "f"} {
+		mutations.Push(kvrpcpb.Op_Put, []byte(k), []byte("v"), false, false, false)
+	}
+	sizeFn := func(k, v []byte) int { return len(k) + len(v) }
+
+	batches := SplitMutationsBySize(&mutations, []byte("c"), sizeFn, 1000, 2)
+	keys := make([][][]byte, 0, len(batches))
+	for _, batch := range batches {
+		keys = append(keys, batch.GetKeys())
+	}
+	assert.Equal([][][]byte{
+		{[]byte("c")},
+		{[]byte("a"), []byte("b")},
+		{[]byte("d"), []byte("e")},
+		{[]byte("f")},
+	}, keys)
+}
@@ -0,0 +1,127 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transaction
+
+import (
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/tikv/client-go/v2/internal/client"
+	"github.com/tikv/client-go/v2/tikvrpc"
+	"google.golang.org/grpc/encoding/gzip"
+)
+
+// PrewriteOptions are the options to build a prewrite request.
+type PrewriteOptions struct {
+	// Mutations are the mutations to prewrite, they should be in the same region.
+	Mutations CommitterMutations
+	// Primary is the primary key of the transaction.
+	Primary        []byte
+	StartTS        uint64
+	ForUpdateTS    uint64
+	LockTTL        uint64
+	TxnSize        uint64
+	MinCommitTS    uint64
+	MaxCommitTS    uint64
+	AssertionLevel kvrpcpb.AssertionLevel
+	// UseAsyncCommit prewrites the mutations with the async commit protocol. Secondaries should
+	// be set if the mutations contain the primary key.
+	UseAsyncCommit bool
+	Secondaries    [][]byte
+	TryOnePC       bool
+	// Context is the context of the request. MaxExecutionDurationMs is set to the default for write
+	// requests if it's 0.
+	Context kvrpcpb.Context
+	// CompressionThreshold is the size in bytes above which the request is compressed by gzip. 0 means
+	// the request isn't compressed individually.
+	CompressionThreshold int
+}
+
+// CommitOptions are the options to build a commit request.
+type CommitOptions struct {
+	// Keys are the keys to commit, they should be in the same region.
+	Keys     [][]byte
+	StartTS  uint64
+	CommitTS uint64
+	// Context is the context of the request. MaxExecutionDurationMs is set to the default for write
+	// requests if it's 0.
+	Context kvrpcpb.Context
+	// CompressionThreshold is the size in bytes above which the request is compressed by gzip. 0 means
+	// the request isn't compressed individually.
+	CompressionThreshold int
+}
+
+// BuildPrewriteRequest builds a prewrite request.
+func BuildPrewriteRequest(opts PrewriteOptions) *tikvrpc.Request {
+	m := opts.Mutations
+	mutations := make([]*kvrpcpb.Mutation, m.Len())
+	isPessimisticLock := make([]bool, m.Len())
+	for i := 0; i < m.Len(); i++ {
+		assertion := kvrpcpb.Assertion_None
+		if m.IsAssertExists(i) {
+			assertion = kvrpcpb.Assertion_Exist
+		}
+		if m.IsAssertNotExist(i) {
+			assertion = kvrpcpb.Assertion_NotExist
+		}
+		mutations[i] = &kvrpcpb.Mutation{
+			Op:        m.GetOp(i),
+			Key:       m.GetKey(i),
+			Value:     m.GetValue(i),
+			Assertion: assertion,
+		}
+		isPessimisticLock[i] = m.IsPessimisticLock(i)
+	}
+
+	req := &kvrpcpb.PrewriteRequest{
+		Mutations:         mutations,
+		PrimaryLock:       opts.Primary,
+		StartVersion:      opts.StartTS,
+		LockTtl:           opts.LockTTL,
+		IsPessimisticLock: isPessimisticLock,
+		ForUpdateTs:       opts.ForUpdateTS,
+		TxnSize:           opts.TxnSize,
+		MinCommitTs:       opts.MinCommitTS,
+		MaxCommitTs:       opts.MaxCommitTS,
+		AssertionLevel:    opts.AssertionLevel,
+		UseAsyncCommit:    opts.UseAsyncCommit,
+		Secondaries:       opts.Secondaries,
+		TryOnePc:          opts.TryOnePC,
+	}
+	r := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, req, writeRequestContext(opts.Context))
+	if opts.CompressionThreshold > 0 && req.Size() > opts.CompressionThreshold {
+		r.UseCompressor = gzip.Name
+	}
+	return r
+}
+
+// BuildCommitRequest builds a commit request.
+func BuildCommitRequest(opts CommitOptions) *tikvrpc.Request {
+	req := &kvrpcpb.CommitRequest{
+		StartVersion:  opts.StartTS,
+		Keys:          opts.Keys,
+		CommitVersion: opts.CommitTS,
+	}
+	r := tikvrpc.NewRequest(tikvrpc.CmdCommit, req, writeRequestContext(opts.Context))
+	if opts.CompressionThreshold > 0 && req.Size() > opts.CompressionThreshold {
+		r.UseCompressor = gzip.Name
+	}
+	return r
+}
+
+func writeRequestContext(ctx kvrpcpb.Context) kvrpcpb.Context {
+	if ctx.MaxExecutionDurationMs == 0 {
+		ctx.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
+	}
+	return ctx
+}
@@ -67,7 +67,7 @@ func (actionCleanup) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer
 	if c.resourceGroupTag == nil && c.resourceGroupTagger != nil {
 		c.resourceGroupTagger(req)
 	}
-	resp, err := c.store.SendReq(bo, req, batch.region, client.ReadTimeoutShort)
+	resp, err := c.sendReq(bo, req, batch.region, client.ReadTimeoutShort)
 	if err != nil {
 		return err
 	}
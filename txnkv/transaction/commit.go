@@ -42,6 +42,7 @@ import (
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tikv/client-go/v2/config"
 	tikverr "github.com/tikv/client-go/v2/error"
 	"github.com/tikv/client-go/v2/internal/client"
 	"github.com/tikv/client-go/v2/internal/locate"
@@ -49,10 +50,16 @@ import (
 	"github.com/tikv/client-go/v2/internal/retry"
 	"github.com/tikv/client-go/v2/metrics"
 	"github.com/tikv/client-go/v2/tikvrpc"
+	"github.com/tikv/client-go/v2/util"
 	"go.uber.org/zap"
 )
 
-type actionCommit struct{ retry bool }
+type actionCommit struct {
+	retry bool
+	// detail records the outcomes of the batches if it's not nil. It must not be the commit details returned to the
+	// caller of Commit when the batches are committed after Commit returns.
+	detail *util.CommitDetails
+}
 
 var _ twoPhaseCommitAction = actionCommit{}
 
@@ -64,15 +71,16 @@ func (actionCommit) tiKVTxnRegionsNumHistogram() prometheus.Observer {
 	return metrics.TxnRegionsNumHistogramCommit
 }
 
-func (actionCommit) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer, batch batchMutations) error {
+func (action actionCommit) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer, batch batchMutations) error {
 	keys := batch.mutations.GetKeys()
-	req := tikvrpc.NewRequest(tikvrpc.CmdCommit, &kvrpcpb.CommitRequest{
-		StartVersion:  c.startTS,
-		Keys:          keys,
-		CommitVersion: c.commitTS,
-	}, kvrpcpb.Context{Priority: c.priority, SyncLog: c.syncLog,
-		ResourceGroupTag: c.resourceGroupTag, DiskFullOpt: c.diskFullOpt,
-		MaxExecutionDurationMs: uint64(client.MaxWriteExecutionTime.Milliseconds())})
+	req := BuildCommitRequest(CommitOptions{
+		Keys:     keys,
+		StartTS:  c.startTS,
+		CommitTS: c.commitTS,
+		Context:  c.writeRequestContext(),
+
+		CompressionThreshold: int(config.GetGlobalConfig().TiKVClient.GrpcCompressionThreshold),
+	})
 	if c.resourceGroupTag == nil && c.resourceGroupTagger != nil {
 		c.resourceGroupTagger(req)
 	}
@@ -88,7 +96,14 @@ func (actionCommit) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer,
 			tBegin = time.Now()
 		}
 
-		resp, err := sender.SendReq(bo, req, batch.region, client.ReadTimeoutShort)
+		resp, _, err := sender.SendReqCtx(bo, req, batch.region, client.ReadTimeoutShort, tikvrpc.TiKV, c.storeSelectorOptions()...)
+		// The request isn't committed if it's too large, commit the keys in halves.
+		if tikverr.IsErrRPCMessageTooLarge(err) {
+			if batches, ok := batch.split(c.primary()); ok {
+				metrics.MessageTooLargeSplitCounterCommit.Inc()
+				return c.handleSplitBatches(bo, action, batches)
+			}
+		}
 		// If we fail to receive response for the request that commits primary key, it will be undetermined whether this
 		// transaction has been successfully committed.
 		// Under this circumstance, we can not declare the commit is complete (may lead to data lost), nor can we throw
@@ -124,7 +139,7 @@ func (actionCommit) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer,
 			if same {
 				continue
 			}
-			return c.doActionOnMutations(bo, actionCommit{true}, batch.mutations)
+			return c.doActionOnMutations(bo, actionCommit{retry: true}, batch.mutations)
 		}
 
 		if resp.Resp == nil {
@@ -145,8 +160,7 @@ func (actionCommit) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer,
 				// Do not retry for a txn which has a too large MinCommitTs
 				// 3600000 << 18 = 943718400000
 				if rejected.MinCommitTs-rejected.AttemptedCommitTs > 943718400000 {
-					return errors.Errorf("2PC MinCommitTS is too large, we got MinCommitTS: %d, and AttemptedCommitTS: %d",
-						rejected.MinCommitTs, rejected.AttemptedCommitTs)
+					return errors.WithStack(&tikverr.ErrMinCommitTSTooLarge{MinCommitTS: rejected.MinCommitTs, AttemptedCommitTS: rejected.AttemptedCommitTs})
 				}
 
 				// Update commit ts and retry.
@@ -203,12 +217,12 @@ func (actionCommit) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer,
 	return nil
 }
 
-func (c *twoPhaseCommitter) commitMutations(bo *retry.Backoffer, mutations CommitterMutations) error {
+func (c *twoPhaseCommitter) commitMutations(bo *retry.Backoffer, mutations CommitterMutations, detail *util.CommitDetails) error {
 	if span := opentracing.SpanFromContext(bo.GetCtx()); span != nil && span.Tracer() != nil {
 		span1 := span.Tracer().StartSpan("twoPhaseCommitter.commitMutations", opentracing.ChildOf(span.Context()))
 		defer span1.Finish()
 		bo.SetCtx(opentracing.ContextWithSpan(bo.GetCtx(), span1))
 	}
 
-	return c.doActionOnMutations(bo, actionCommit{}, mutations)
+	return c.doActionOnMutations(bo, actionCommit{detail: detail}, mutations)
 }
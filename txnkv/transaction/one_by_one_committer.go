@@ -0,0 +1,312 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package transaction
+
+import (
+	"bytes"
+	"context"
+
+	"github.com/pingcap/kvproto/pkg/errorpb"
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pkg/errors"
+	tikverr "github.com/tikv/client-go/v2/error"
+	"github.com/tikv/client-go/v2/internal/client"
+	"github.com/tikv/client-go/v2/internal/locate"
+	"github.com/tikv/client-go/v2/internal/logutil"
+	"github.com/tikv/client-go/v2/internal/retry"
+	"github.com/tikv/client-go/v2/oracle"
+	"github.com/tikv/client-go/v2/txnkv/txnlock"
+	"go.uber.org/zap"
+)
+
+// RegionMutations are the mutations in the same region. The mutations should be sorted by key.
+type RegionMutations struct {
+	Region    locate.RegionVerID
+	Mutations CommitterMutations
+}
+
+// OneByOneCommitterStore is the store used by OneByOneCommitter, which is implemented by tikv.KVStore.
+type OneByOneCommitterStore interface {
+	// GetRegionCache gets the RegionCache.
+	GetRegionCache() *locate.RegionCache
+	// GetTimestampWithRetry returns latest timestamp.
+	GetTimestampWithRetry(bo *retry.Backoffer, scope string) (uint64, error)
+	// GetTiKVClient gets the client instance.
+	GetTiKVClient() client.Client
+	// GetLockResolver gets the lock resolver.
+	GetLockResolver() *txnlock.LockResolver
+}
+
+// OneByOneCommitter executes the two-phase commit protocol on mutations which are already
+// grouped by region, sending the requests of the regions one by one. Unlike the committer of
+// KVTxn, it doesn't need a transaction or a memory buffer, the caller manages the timestamps and
+// the batching of the mutations. Region errors and locks are handled in the same way as KVTxn.
+//
+// It doesn't clean up the written locks if prewrite fails, they are resolved by other readers
+// and writers after the lock TTL expires.
+type OneByOneCommitter struct {
+	store   OneByOneCommitterStore
+	startTS uint64
+	primary []byte
+	lockTTL uint64
+	reqCtx  kvrpcpb.Context
+}
+
+// NewOneByOneCommitter creates a OneByOneCommitter for the transaction started at startTS.
+func NewOneByOneCommitter(store OneByOneCommitterStore, startTS uint64, primary []byte, lockTTL uint64) *OneByOneCommitter {
+	return &OneByOneCommitter{
+		store:   store,
+		startTS: startTS,
+		primary: primary,
+		lockTTL: lockTTL,
+	}
+}
+
+// SetRequestContext sets the context of the prewrite and commit requests, e.g. the priority.
+func (c *OneByOneCommitter) SetRequestContext(ctx kvrpcpb.Context) {
+	c.reqCtx = ctx
+}
+
+// GroupMutations groups the sorted mutations by region.
+func (c *OneByOneCommitter) GroupMutations(ctx context.Context, mutations CommitterMutations) ([]RegionMutations, error) {
+	bo := retry.NewBackofferWithVars(ctx, PrewriteMaxBackoff, nil)
+	return c.groupMutations(bo, mutations)
+}
+
+func (c *OneByOneCommitter) groupMutations(bo *retry.Backoffer, mutations CommitterMutations) ([]RegionMutations, error) {
+	groups, err := groupSortedMutationsByRegion(c.store.GetRegionCache(), bo, mutations)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]RegionMutations, 0, len(groups))
+	for _, group := range groups {
+		res = append(res, RegionMutations{Region: group.region, Mutations: group.mutations})
+	}
+	return res, nil
+}
+
+// Execute prewrites and commits the mutations, it returns the commit ts of the transaction.
+func (c *OneByOneCommitter) Execute(ctx context.Context, groups []RegionMutations) (uint64, error) {
+	if err := c.Prewrite(ctx, groups); err != nil {
+		return 0, err
+	}
+	bo := retry.NewBackofferWithVars(ctx, int(CommitMaxBackoff), nil)
+	commitTS, err := c.store.GetTimestampWithRetry(bo, oracle.GlobalTxnScope)
+	if err != nil {
+		return 0, err
+	}
+	return c.commitGroups(bo, groups, commitTS)
+}
+
+// Prewrite prewrites the mutations.
+func (c *OneByOneCommitter) Prewrite(ctx context.Context, groups []RegionMutations) error {
+	bo := retry.NewBackofferWithVars(ctx, PrewriteMaxBackoff, nil)
+	return c.prewriteGroups(bo, groups)
+}
+
+// Commit commits the prewritten mutations at commitTS, the region containing the primary key is
+// committed first. If TiKV rejects commitTS before the primary key is committed, a new commit ts is
+// used. It returns the commit ts of the transaction.
+func (c *OneByOneCommitter) Commit(ctx context.Context, groups []RegionMutations, commitTS uint64) (uint64, error) {
+	bo := retry.NewBackofferWithVars(ctx, int(CommitMaxBackoff), nil)
+	return c.commitGroups(bo, groups, commitTS)
+}
+
+func (c *OneByOneCommitter) prewriteGroups(bo *retry.Backoffer, groups []RegionMutations) error {
+	for _, group := range groups {
+		if err := c.prewriteGroup(bo, group); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *OneByOneCommitter) prewriteGroup(bo *retry.Backoffer, group RegionMutations) error {
+	if group.Mutations.Len() == 0 {
+		return nil
+	}
+	req := BuildPrewriteRequest(PrewriteOptions{
+		Mutations:   group.Mutations,
+		Primary:     c.primary,
+		StartTS:     c.startTS,
+		LockTTL:     c.lockTTL,
+		TxnSize:     uint64(group.Mutations.Len()),
+		MinCommitTS: c.startTS + 1,
+		Context:     c.reqCtx,
+	})
+	sender := locate.NewRegionRequestSender(c.store.GetRegionCache(), c.store.GetTiKVClient())
+	for {
+		resp, err := sender.SendReq(bo, req, group.Region, client.ReadTimeoutShort)
+		if err != nil {
+			return err
+		}
+		regionErr, err := resp.GetRegionError()
+		if err != nil {
+			return err
+		}
+		if regionErr != nil {
+			groups, err := c.onRegionError(bo, regionErr, &group)
+			if err != nil {
+				return err
+			}
+			if groups == nil {
+				continue
+			}
+			return c.prewriteGroups(bo, groups)
+		}
+		if resp.Resp == nil {
+			return errors.WithStack(tikverr.ErrBodyMissing)
+		}
+		keyErrs := resp.Resp.(*kvrpcpb.PrewriteResponse).GetErrors()
+		if len(keyErrs) == 0 {
+			return nil
+		}
+		var locks []*txnlock.Lock
+		for _, keyErr := range keyErrs {
+			if alreadyExist := keyErr.GetAlreadyExist(); alreadyExist != nil {
+				return errors.WithStack(&tikverr.ErrKeyExist{AlreadyExist: alreadyExist})
+			}
+			lock, err1 := txnlock.ExtractLockFromKeyErr(keyErr)
+			if err1 != nil {
+				return err1
+			}
+			if lock.TxnID > c.startTS {
+				return tikverr.NewErrWriteConfictWithArgs(c.startTS, lock.TxnID, 0, lock.Key)
+			}
+			locks = append(locks, lock)
+		}
+		msBeforeExpired, err := c.store.GetLockResolver().ResolveLocks(bo, c.startTS, locks)
+		if err != nil {
+			return err
+		}
+		if msBeforeExpired > 0 {
+			err = bo.BackoffWithCfgAndMaxSleep(retry.BoTxnLock, int(msBeforeExpired), errors.Errorf("prewrite lockedKeys: %d", len(locks)))
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func (c *OneByOneCommitter) commitGroups(bo *retry.Backoffer, groups []RegionMutations, commitTS uint64) (uint64, error) {
+	// Commit the group containing the primary key first, no secondary key can be committed before it.
+	ordered := make([]RegionMutations, 0, len(groups))
+	for _, group := range groups {
+		if c.containsPrimary(group) {
+			ordered = append([]RegionMutations{group}, ordered...)
+		} else {
+			ordered = append(ordered, group)
+		}
+	}
+	for _, group := range ordered {
+		var err error
+		if commitTS, err = c.commitGroup(bo, group, commitTS); err != nil {
+			return 0, err
+		}
+	}
+	return commitTS, nil
+}
+
+func (c *OneByOneCommitter) commitGroup(bo *retry.Backoffer, group RegionMutations, commitTS uint64) (uint64, error) {
+	if group.Mutations.Len() == 0 {
+		return commitTS, nil
+	}
+	isPrimary := c.containsPrimary(group)
+	req := BuildCommitRequest(CommitOptions{
+		Keys:     group.Mutations.GetKeys(),
+		StartTS:  c.startTS,
+		CommitTS: commitTS,
+		Context:  c.reqCtx,
+	})
+	sender := locate.NewRegionRequestSender(c.store.GetRegionCache(), c.store.GetTiKVClient())
+	for {
+		resp, err := sender.SendReq(bo, req, group.Region, client.ReadTimeoutShort)
+		if err != nil {
+			return 0, err
+		}
+		regionErr, err := resp.GetRegionError()
+		if err != nil {
+			return 0, err
+		}
+		if regionErr != nil {
+			groups, err := c.onRegionError(bo, regionErr, &group)
+			if err != nil {
+				return 0, err
+			}
+			if groups == nil {
+				continue
+			}
+			return c.commitGroups(bo, groups, commitTS)
+		}
+		if resp.Resp == nil {
+			return 0, errors.WithStack(tikverr.ErrBodyMissing)
+		}
+		keyErr := resp.Resp.(*kvrpcpb.CommitResponse).GetError()
+		if keyErr == nil {
+			return commitTS, nil
+		}
+		if rejected := keyErr.GetCommitTsExpired(); rejected != nil && isPrimary {
+			logutil.Logger(bo.GetCtx()).Info("commitTS rejected by TiKV, retry with a newer commitTS",
+				zap.Uint64("txnStartTS", c.startTS),
+				zap.Stringer("info", logutil.Hex(rejected)))
+			// Do not retry for a txn which has a too large MinCommitTs
+			// 3600000 << 18 = 943718400000
+			if rejected.MinCommitTs-rejected.AttemptedCommitTs > 943718400000 {
+				return 0, errors.Errorf("MinCommitTS is too large, we got MinCommitTS: %d, and AttemptedCommitTS: %d",
+					rejected.MinCommitTs, rejected.AttemptedCommitTs)
+			}
+			commitTS, err = c.store.GetTimestampWithRetry(bo, oracle.GlobalTxnScope)
+			if err != nil {
+				return 0, err
+			}
+			req.Commit().CommitVersion = commitTS
+			continue
+		}
+		return 0, tikverr.ExtractKeyErr(keyErr)
+	}
+}
+
+// onRegionError backs off if needed and locates the mutations again. It returns nil if the mutations
+// are still in one region, whose RegionVerID is updated in group. Otherwise, the mutations are
+// grouped by the new regions.
+func (c *OneByOneCommitter) onRegionError(bo *retry.Backoffer, regionErr *errorpb.Error, group *RegionMutations) ([]RegionMutations, error) {
+	// For other region error and the fake region error, backoff because
+	// there's something wrong.
+	// For the real EpochNotMatch error, don't backoff.
+	if regionErr.GetEpochNotMatch() == nil || locate.IsFakeRegionError(regionErr) {
+		if err := bo.Backoff(retry.BoRegionMiss, errors.New(regionErr.String())); err != nil {
+			return nil, err
+		}
+	}
+	batch := batchMutations{region: group.Region, mutations: group.Mutations}
+	same, err := batch.relocate(bo, c.store.GetRegionCache())
+	if err != nil {
+		return nil, err
+	}
+	if same {
+		group.Region = batch.region
+		return nil, nil
+	}
+	return c.groupMutations(bo, group.Mutations)
+}
+
+func (c *OneByOneCommitter) containsPrimary(group RegionMutations) bool {
+	for i := 0; i < group.Mutations.Len(); i++ {
+		if bytes.Equal(group.Mutations.GetKey(i), c.primary) {
+			return true
+		}
+	}
+	return false
+}
@@ -42,6 +42,7 @@ import (
 	"time"
 
 	"github.com/opentracing/opentracing-go"
+	"github.com/pingcap/kvproto/pkg/errorpb"
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pkg/errors"
 	"github.com/prometheus/client_golang/prometheus"
@@ -58,7 +59,12 @@ import (
 	"go.uber.org/zap"
 )
 
-type actionPrewrite struct{ retry bool }
+type actionPrewrite struct {
+	retry bool
+	// attempts is the number of attempts already made to prewrite the mutations before they are split again, which
+	// counts towards the max attempts of the new batches.
+	attempts int
+}
 
 var _ twoPhaseCommitAction = actionPrewrite{}
 
@@ -71,25 +77,6 @@ func (actionPrewrite) tiKVTxnRegionsNumHistogram() prometheus.Observer {
 }
 
 func (c *twoPhaseCommitter) buildPrewriteRequest(batch batchMutations, txnSize uint64) *tikvrpc.Request {
-	m := batch.mutations
-	mutations := make([]*kvrpcpb.Mutation, m.Len())
-	isPessimisticLock := make([]bool, m.Len())
-	for i := 0; i < m.Len(); i++ {
-		assertion := kvrpcpb.Assertion_None
-		if m.IsAssertExists(i) {
-			assertion = kvrpcpb.Assertion_Exist
-		}
-		if m.IsAssertNotExist(i) {
-			assertion = kvrpcpb.Assertion_NotExist
-		}
-		mutations[i] = &kvrpcpb.Mutation{
-			Op:        m.GetOp(i),
-			Key:       m.GetKey(i),
-			Value:     m.GetValue(i),
-			Assertion: assertion,
-		}
-		isPessimisticLock[i] = m.IsPessimisticLock(i)
-	}
 	c.mu.Lock()
 	minCommitTS := c.minCommitTS
 	c.mu.Unlock()
@@ -111,9 +98,9 @@ func (c *twoPhaseCommitter) buildPrewriteRequest(batch batchMutations, txnSize u
 	if c.sessionID > 0 {
 		if _, err := util.EvalFailpoint("twoPCShortLockTTL"); err == nil {
 			ttl = 1
-			keys := make([]string, 0, len(mutations))
-			for _, m := range mutations {
-				keys = append(keys, hex.EncodeToString(m.Key))
+			keys := make([]string, 0, batch.mutations.Len())
+			for _, k := range batch.mutations.GetKeys() {
+				keys = append(keys, hex.EncodeToString(k))
 			}
 			logutil.BgLogger().Info("[failpoint] injected lock ttl = 1 on prewrite",
 				zap.Uint64("txnStartTS", c.startTS), zap.Strings("keys", keys))
@@ -125,45 +112,56 @@ func (c *twoPhaseCommitter) buildPrewriteRequest(batch batchMutations, txnSize u
 		assertionLevel = kvrpcpb.AssertionLevel_Off
 	}
 
-	req := &kvrpcpb.PrewriteRequest{
-		Mutations:         mutations,
-		PrimaryLock:       c.primary(),
-		StartVersion:      c.startTS,
-		LockTtl:           ttl,
-		IsPessimisticLock: isPessimisticLock,
-		ForUpdateTs:       c.forUpdateTS,
-		TxnSize:           txnSize,
-		MinCommitTs:       minCommitTS,
-		MaxCommitTs:       c.maxCommitTS,
-		AssertionLevel:    assertionLevel,
+	opts := PrewriteOptions{
+		Mutations:      batch.mutations,
+		Primary:        c.primary(),
+		StartTS:        c.startTS,
+		ForUpdateTS:    c.forUpdateTS,
+		LockTTL:        ttl,
+		TxnSize:        txnSize,
+		MinCommitTS:    minCommitTS,
+		MaxCommitTS:    c.maxCommitTS,
+		AssertionLevel: assertionLevel,
+		TryOnePC:       c.isOnePC(),
+		Context:        c.writeRequestContext(),
+
+		CompressionThreshold: int(config.GetGlobalConfig().TiKVClient.GrpcCompressionThreshold),
 	}
 
 	if _, err := util.EvalFailpoint("invalidMaxCommitTS"); err == nil {
-		if req.MaxCommitTs > 0 {
-			req.MaxCommitTs = minCommitTS - 1
+		if opts.MaxCommitTS > 0 {
+			opts.MaxCommitTS = minCommitTS - 1
 		}
 	}
 
 	if c.isAsyncCommit() {
 		if batch.isPrimary {
-			req.Secondaries = c.asyncSecondaries()
+			opts.Secondaries = c.asyncSecondaries()
 		}
-		req.UseAsyncCommit = true
-	}
-
-	if c.isOnePC() {
-		req.TryOnePc = true
+		opts.UseAsyncCommit = true
 	}
 
-	r := tikvrpc.NewRequest(tikvrpc.CmdPrewrite, req,
-		kvrpcpb.Context{Priority: c.priority, SyncLog: c.syncLog, ResourceGroupTag: c.resourceGroupTag,
-			DiskFullOpt: c.diskFullOpt, MaxExecutionDurationMs: uint64(client.MaxWriteExecutionTime.Milliseconds())})
+	r := BuildPrewriteRequest(opts)
 	if c.resourceGroupTag == nil && c.resourceGroupTagger != nil {
 		c.resourceGroupTagger(r)
 	}
 	return r
 }
 
+// observePrewriteRegionError counts the region error of a prewrite request by its category.
+func observePrewriteRegionError(regionErr *errorpb.Error) {
+	switch {
+	case regionErr.GetServerIsBusy() != nil || locate.IsFakeRegionError(regionErr):
+		metrics.PrewriteRegionErrorCounterServerBusyOrFake.Inc()
+	case regionErr.GetEpochNotMatch() != nil:
+		metrics.PrewriteRegionErrorCounterEpochNotMatch.Inc()
+	case regionErr.GetDiskFull() != nil:
+		metrics.PrewriteRegionErrorCounterDiskFull.Inc()
+	default:
+		metrics.PrewriteRegionErrorCounterOther.Inc()
+	}
+}
+
 func (action actionPrewrite) handleSingleBatch(c *twoPhaseCommitter, bo *retry.Backoffer, batch batchMutations) (err error) {
 	// WARNING: This function only tries to send a single request to a single region, so it don't
 	// need to unset the `useOnePC` flag when it fails. A special case is that when TiKV returns
@@ -206,7 +204,8 @@ func (action actionPrewrite) handleSingleBatch(c *twoPhaseCommitter, bo *retry.B
 	}
 
 	tBegin := time.Now()
-	attempts := 0
+	attempts := action.attempts
+	maxAttempts := c.prewriteMaxAttempts()
 
 	req := c.buildPrewriteRequest(batch, txnSize)
 	sender := locate.NewRegionRequestSender(c.store.GetRegionCache(), c.store.GetTiKVClient())
@@ -222,15 +221,29 @@ func (action actionPrewrite) handleSingleBatch(c *twoPhaseCommitter, bo *retry.B
 		}
 	}()
 	for {
+		if maxAttempts > 0 && uint(attempts) >= maxAttempts {
+			logutil.Logger(bo.GetCtx()).Warn("prewrite exceeds max attempts",
+				zap.Uint64("startTS", c.startTS),
+				zap.Stringer("region", &batch.region),
+				zap.Int("attempts", attempts))
+			return errors.WithStack(&tikverr.ErrPrewriteTooManyAttempts{Attempts: attempts})
+		}
 		attempts++
 		if time.Since(tBegin) > slowRequestThreshold {
 			logutil.BgLogger().Warn("slow prewrite request", zap.Uint64("startTS", c.startTS), zap.Stringer("region", &batch.region), zap.Int("attempts", attempts))
 			tBegin = time.Now()
 		}
 
-		resp, err := sender.SendReq(bo, req, batch.region, client.ReadTimeoutShort)
+		resp, _, err := sender.SendReqCtx(bo, req, batch.region, client.ReadTimeoutShort, tikvrpc.TiKV, c.storeSelectorOptions()...)
 		// Unexpected error occurs, return it
 		if err != nil {
+			// Splitting the batch breaks the atomicity of 1PC, so only split it for 2PC.
+			if tikverr.IsErrRPCMessageTooLarge(err) && !c.isOnePC() {
+				if batches, ok := batch.split(c.primary()); ok {
+					metrics.MessageTooLargeSplitCounterPrewrite.Inc()
+					return c.handleSplitBatches(bo, actionPrewrite{retry: action.retry, attempts: attempts}, batches)
+				}
+			}
 			return err
 		}
 
@@ -239,6 +252,7 @@ func (action actionPrewrite) handleSingleBatch(c *twoPhaseCommitter, bo *retry.B
 			return err
 		}
 		if regionErr != nil {
+			observePrewriteRegionError(regionErr)
 			// For other region error and the fake region error, backoff because
 			// there's something wrong.
 			// For the real EpochNotMatch error, don't backoff.
@@ -259,7 +273,7 @@ func (action actionPrewrite) handleSingleBatch(c *twoPhaseCommitter, bo *retry.B
 					zap.String("store_id", desc),
 					zap.String("reason", regionErr.GetDiskFull().GetReason()))
 
-				return errors.New(regionErr.String())
+				return errors.WithMessage(tikverr.ErrTiKVDiskFull, regionErr.String())
 			}
 			same, err := batch.relocate(bo, c.store.GetRegionCache())
 			if err != nil {
@@ -268,7 +282,7 @@ func (action actionPrewrite) handleSingleBatch(c *twoPhaseCommitter, bo *retry.B
 			if same {
 				continue
 			}
-			err = c.doActionOnMutations(bo, actionPrewrite{true}, batch.mutations)
+			err = c.doActionOnMutations(bo, actionPrewrite{retry: true, attempts: attempts}, batch.mutations)
 			return err
 		}
 
@@ -294,7 +308,7 @@ func (action actionPrewrite) handleSingleBatch(c *twoPhaseCommitter, bo *retry.B
 			if c.isOnePC() {
 				if prewriteResp.OnePcCommitTs == 0 {
 					if prewriteResp.MinCommitTs != 0 {
-						return errors.New("MinCommitTs must be 0 when 1pc falls back to 2pc")
+						return errors.WithStack(&tikverr.ErrInvalidOnePCFallback{MinCommitTS: prewriteResp.MinCommitTs})
 					}
 					logutil.Logger(bo.GetCtx()).Warn("1pc failed and fallbacks to normal commit procedure",
 						zap.Uint64("startTS", c.startTS))
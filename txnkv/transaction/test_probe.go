@@ -221,7 +221,7 @@ func (c CommitterProbe) PrewriteMutations(ctx context.Context, mutations Committ
 
 // CommitMutations performs the second phase of commit.
 func (c CommitterProbe) CommitMutations(ctx context.Context) error {
-	return c.commitMutations(retry.NewBackofferWithVars(ctx, int(atomic.LoadUint64(&CommitMaxBackoff)), nil), c.mutationsOfKeys([][]byte{c.primaryKey}))
+	return c.commitMutations(retry.NewBackofferWithVars(ctx, int(atomic.LoadUint64(&CommitMaxBackoff)), nil), c.mutationsOfKeys([][]byte{c.primaryKey}), nil)
 }
 
 // MutationsOfKeys returns mutations match the keys.
@@ -99,6 +99,8 @@ type KVTxn struct {
 	schemaAmender SchemaAmender
 	// commitCallback is called after current transaction gets committed
 	commitCallback func(info string, err error)
+	// secondariesCallback is called after the secondaries committed in the background are handled.
+	secondariesCallback func(detail *util.CommitDetails, err error)
 
 	binlog                  BinlogExecutor
 	schemaLeaseChecker      SchemaLeaseChecker
@@ -107,16 +109,27 @@ type KVTxn struct {
 	isPessimistic           bool
 	enableAsyncCommit       bool
 	enable1PC               bool
+	disableAsyncCommit      bool
+	disable1PC              bool
+	primarySelection        PrimarySelection
 	causalConsistency       bool
 	scope                   string
 	kvFilter                KVFilter
 	resourceGroupTag        []byte
 	resourceGroupTagger     tikvrpc.ResourceGroupTagger // use this when resourceGroupTag is nil
 	diskFullOpt             kvrpcpb.DiskFullOpt
+	forwarding              *bool
 	commitTSUpperBoundCheck func(uint64) bool
 	// interceptor is used to decorate the RPC request logic related to the txn.
 	interceptor    interceptor.RPCInterceptor
 	assertionLevel kvrpcpb.AssertionLevel
+	// commitBatchSize and commitBatchKeys bound the size and the number of keys of a batch in 2PC requests.
+	commitBatchSize int
+	commitBatchKeys int
+	// committerConcurrency bounds the number of batches handled concurrently in 2PC, 0 means the global default.
+	committerConcurrency int
+	// prewriteMaxAttempts bounds the attempts to prewrite a batch, 0 means the global default.
+	prewriteMaxAttempts uint
 }
 
 // NewTiKVTxn creates a new KVTxn.
@@ -276,6 +289,13 @@ func (txn *KVTxn) SetCommitCallback(f func(string, error)) {
 	txn.commitCallback = f
 }
 
+// SetSecondariesCallback sets up a function that will be called when the secondary keys committed in the background
+// after Commit returns are all handled. The details have the outcomes of the batches of the secondaries, and the
+// error is the first failure of them, which doesn't fail the committed transaction.
+func (txn *KVTxn) SetSecondariesCallback(f func(detail *util.CommitDetails, err error)) {
+	txn.secondariesCallback = f
+}
+
 // SetEnableAsyncCommit indicates if the transaction will try to use async commit.
 func (txn *KVTxn) SetEnableAsyncCommit(b bool) {
 	txn.enableAsyncCommit = b
@@ -287,6 +307,24 @@ func (txn *KVTxn) SetEnable1PC(b bool) {
 	txn.enable1PC = b
 }
 
+// SetDisableAsyncCommit forbids the transaction to use async commit, regardless of SetEnableAsyncCommit and the
+// global config. It takes effect as long as it is called before the transaction commits.
+func (txn *KVTxn) SetDisableAsyncCommit(b bool) {
+	txn.disableAsyncCommit = b
+}
+
+// SetDisable1PC forbids the transaction to use 1PC, regardless of SetEnable1PC and the global config. It takes
+// effect as long as it is called before the transaction commits.
+func (txn *KVTxn) SetDisable1PC(b bool) {
+	txn.disable1PC = b
+}
+
+// SetPrimarySelection sets the strategy to select the primary key when the transaction commits. It doesn't take
+// effect if the primary is already fixed, e.g. by the first pessimistic lock. The default is PrimarySelectionDefault.
+func (txn *KVTxn) SetPrimarySelection(selection PrimarySelection) {
+	txn.primarySelection = selection
+}
+
 // SetCausalConsistency indicates if the transaction does not need to
 // guarantee linearizability. Default value is false which means
 // linearizability is guaranteed.
@@ -326,11 +364,42 @@ func (txn *KVTxn) ClearDiskFullOpt() {
 	txn.diskFullOpt = kvrpcpb.DiskFullOpt_NotAllowedOnFull
 }
 
+// SetForwarding sets whether the requests of the transaction to an unreachable leader can be forwarded by a
+// proxy store. It overrides the EnableForwarding config for the transaction.
+func (txn *KVTxn) SetForwarding(enabled bool) {
+	txn.forwarding = &enabled
+}
+
 // SetAssertionLevel sets how strict the assertions in the transaction should be.
 func (txn *KVTxn) SetAssertionLevel(assertionLevel kvrpcpb.AssertionLevel) {
 	txn.assertionLevel = assertionLevel
 }
 
+// SetCommitBatchLimits sets the granularity of the batches that the mutations of a region are split into when the
+// transaction is committed. A batch holds keys until their accumulated size reaches sizeLimit or the number of keys
+// reaches keyLimit. A non-positive sizeLimit falls back to the global TxnCommitBatchSize and a non-positive keyLimit
+// doesn't limit the number of keys. With the limits set, the primary key is in a batch of its own ahead of the
+// secondaries, unless the transaction is committed by 1PC.
+// It's useful for bulk loading which prefers fewer but larger requests.
+func (txn *KVTxn) SetCommitBatchLimits(sizeLimit, keyLimit int) {
+	txn.commitBatchSize = sizeLimit
+	txn.commitBatchKeys = keyLimit
+}
+
+// SetCommitterConcurrency sets the max number of batches, e.g. the batches of secondary keys to commit or to clean
+// up, handled concurrently when the transaction commits. A non-positive n falls back to the global
+// CommitterConcurrency.
+func (txn *KVTxn) SetCommitterConcurrency(n int) {
+	txn.committerConcurrency = n
+}
+
+// SetPrewriteMaxAttempts sets the max number of attempts to prewrite a batch of mutations, including the retries
+// after resolving locks. The prewrite fails with ErrPrewriteTooManyAttempts once it's exceeded. 0 falls back to the
+// global PrewriteMaxAttempts.
+func (txn *KVTxn) SetPrewriteMaxAttempts(n uint) {
+	txn.prewriteMaxAttempts = n
+}
+
 // IsPessimistic returns true if it is pessimistic.
 func (txn *KVTxn) IsPessimistic() bool {
 	return txn.isPessimistic
@@ -437,6 +506,9 @@ func (txn *KVTxn) Commit(ctx context.Context) error {
 		if val == nil || sessionID > 0 {
 			txn.onCommitted(err)
 		}
+		if err == nil {
+			committer.recordRecentCommits()
+		}
 		logutil.Logger(ctx).Debug("[kv] txnLatches disabled, 2pc directly", zap.Error(err))
 		return err
 	}
@@ -460,6 +532,7 @@ func (txn *KVTxn) Commit(ctx context.Context) error {
 	}
 	if err == nil {
 		lock.SetCommitTS(committer.commitTS)
+		committer.recordRecentCommits()
 	}
 	logutil.Logger(ctx).Debug("[kv] txnLatches enabled while txn retryable", zap.Error(err))
 	return err
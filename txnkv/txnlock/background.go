@@ -0,0 +1,112 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package txnlock
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/pingcap/kvproto/pkg/kvrpcpb"
+	"github.com/pkg/errors"
+	"github.com/tikv/client-go/v2/internal/retry"
+	"github.com/tikv/client-go/v2/tikvrpc"
+)
+
+type backgroundResolveCtxKey struct{}
+
+// WithBackgroundResolve marks the locks resolved with the returned context as background cleanup, e.g. by GC.
+// Requests to resolve such locks are sent with low priority so they don't starve foreground reads and writes,
+// and the number of locks resolved per second is limited by the BackgroundResolveLockRate config.
+func WithBackgroundResolve(ctx context.Context) context.Context {
+	return context.WithValue(ctx, backgroundResolveCtxKey{}, struct{}{})
+}
+
+func isBackgroundResolve(bo *retry.Backoffer) bool {
+	return bo.GetCtx().Value(backgroundResolveCtxKey{}) != nil
+}
+
+// setResolvePriority lowers the priority of the request if it resolves locks in the background, both on TiKV and in
+// the batch queue of the client.
+func setResolvePriority(bo *retry.Backoffer, req *tikvrpc.Request) {
+	if isBackgroundResolve(bo) {
+		req.Priority = kvrpcpb.CommandPri_Low
+		req.LowPriorityBatch = true
+	}
+}
+
+// resolveRateLimiter limits the number of locks resolved per second. It doesn't allow bursts: after a batch
+// of n locks is admitted, the next batch waits n/rate seconds.
+type resolveRateLimiter struct {
+	mu sync.Mutex
+	// rate is the max number of locks per second, 0 means unlimited.
+	rate uint
+	// next is the time when the next batch can be admitted.
+	next time.Time
+	// now and after replace time.Now and time.After in tests if they're set.
+	now   func() time.Time
+	after func(time.Duration) <-chan time.Time
+}
+
+func (l *resolveRateLimiter) setClock(now func() time.Time, after func(time.Duration) <-chan time.Time) {
+	l.mu.Lock()
+	l.now, l.after = now, after
+	l.mu.Unlock()
+}
+
+func (l *resolveRateLimiter) setRate(rate uint) {
+	l.mu.Lock()
+	l.rate = rate
+	l.next = time.Time{}
+	l.mu.Unlock()
+}
+
+// wait blocks until n locks can be resolved or ctx is done.
+func (l *resolveRateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	if l.rate == 0 || n <= 0 {
+		l.mu.Unlock()
+		return nil
+	}
+	now, after := time.Now, l.after
+	if l.now != nil {
+		now = l.now
+	}
+	current := now()
+	if l.next.Before(current) {
+		l.next = current
+	}
+	delay := l.next.Sub(current)
+	l.next = l.next.Add(time.Duration(n) * time.Second / time.Duration(l.rate))
+	l.mu.Unlock()
+
+	if delay <= 0 {
+		return nil
+	}
+	var ready <-chan time.Time
+	if after != nil {
+		ready = after(delay)
+	} else {
+		timer := time.NewTimer(delay)
+		defer timer.Stop()
+		ready = timer.C
+	}
+	select {
+	case <-ready:
+		return nil
+	case <-ctx.Done():
+		return errors.WithStack(ctx.Err())
+	}
+}
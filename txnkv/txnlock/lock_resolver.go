@@ -69,6 +69,8 @@ type LockResolver struct {
 	testingKnobs struct {
 		meetLock func(locks []*Lock)
 	}
+	// backgroundLimiter limits the rate of resolving locks in the background.
+	backgroundLimiter resolveRateLimiter
 
 	// LockResolver may have some goroutines resolving locks in the background.
 	// The Cancel function is to cancel these goroutines for passing goleak test.
@@ -84,10 +86,17 @@ func NewLockResolver(store storage) *LockResolver {
 	}
 	r.mu.resolved = make(map[uint64]TxnStatus)
 	r.mu.recentResolved = list.New()
+	r.backgroundLimiter.setRate(config.GetGlobalConfig().TiKVClient.BackgroundResolveLockRate)
 	r.asyncResolveCtx, r.asyncResolveCancel = context.WithCancel(context.Background())
 	return r
 }
 
+// SetBackgroundResolveLockRate sets the max number of locks resolved per second in the background.
+// 0 means unlimited.
+func (lr *LockResolver) SetBackgroundResolveLockRate(locksPerSecond uint) {
+	lr.backgroundLimiter.setRate(locksPerSecond)
+}
+
 // Close cancels all background goroutines.
 func (lr *LockResolver) Close() {
 	lr.asyncResolveCancel()
@@ -203,11 +212,19 @@ func (lr *LockResolver) getResolved(txnID uint64) (TxnStatus, bool) {
 }
 
 // BatchResolveLocks resolve locks in a batch.
-// Used it in gcworker only!
+// Used it in gcworker only! The locks are resolved in the background, see WithBackgroundResolve.
 func (lr *LockResolver) BatchResolveLocks(bo *retry.Backoffer, locks []*Lock, loc locate.RegionVerID) (bool, error) {
 	if len(locks) == 0 {
 		return true, nil
 	}
+	if !isBackgroundResolve(bo) {
+		// Don't change the context of the caller's Backoffer.
+		bo = bo.Clone()
+		bo.SetCtx(WithBackgroundResolve(bo.GetCtx()))
+	}
+	if err := lr.backgroundLimiter.wait(bo.GetCtx(), len(locks)); err != nil {
+		return false, err
+	}
 
 	metrics.LockResolverCountWithBatchResolve.Inc()
 
@@ -249,7 +266,7 @@ func (lr *LockResolver) BatchResolveLocks(bo *retry.Backoffer, locks []*Lock, lo
 
 		if status.ttl > 0 {
 			logutil.BgLogger().Error("BatchResolveLocks fail to clean locks, this result is not expected!")
-			return false, errors.New("TiDB ask TiKV to rollback locks but it doesn't, the protocol maybe wrong")
+			return false, errors.WithStack(&tikverr.ErrLockResolveProtocol{Reason: "TiDB ask TiKV to rollback locks but it doesn't"})
 		}
 
 		txnInfos[l.TxnID] = status.commitTS
@@ -268,6 +285,7 @@ func (lr *LockResolver) BatchResolveLocks(bo *retry.Backoffer, locks []*Lock, lo
 
 	req := tikvrpc.NewRequest(tikvrpc.CmdResolveLock, &kvrpcpb.ResolveLockRequest{TxnInfos: listTxnInfos})
 	req.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
+	setResolvePriority(bo, req)
 	startTime = time.Now()
 	resp, err := lr.store.SendReq(bo, req, loc, client.ReadTimeoutShort)
 	if err != nil {
@@ -292,7 +310,7 @@ func (lr *LockResolver) BatchResolveLocks(bo *retry.Backoffer, locks []*Lock, lo
 	}
 	cmdResp := resp.Resp.(*kvrpcpb.ResolveLockResponse)
 	if keyErr := cmdResp.GetError(); keyErr != nil {
-		return false, errors.Errorf("unexpected resolve err: %s", keyErr)
+		return false, errors.WithMessage(&tikverr.ErrUnexpectedKeyErr{KeyErr: keyErr}, "batch resolve locks failed")
 	}
 
 	logutil.BgLogger().Info("BatchResolveLocks: resolve locks in a batch",
@@ -322,6 +340,13 @@ func (lr *LockResolver) ResolveLocksForRead(bo *retry.Backoffer, callerStartTS u
 	return lr.resolveLocks(bo, callerStartTS, locks, true, lite)
 }
 
+// ResolveLock resolves a single lock, e.g. a lock found by ScanLock. It checks the status of the
+// primary key of the lock's transaction, then commits or rolls back the lock accordingly. If the
+// transaction is still alive, the lock is kept and the ms before it expires is returned.
+func (lr *LockResolver) ResolveLock(bo *retry.Backoffer, l *Lock) (int64, error) {
+	return lr.ResolveLocks(bo, 0, []*Lock{l})
+}
+
 func (lr *LockResolver) resolveLocks(bo *retry.Backoffer, callerStartTS uint64, locks []*Lock, forRead bool, lite bool) (int64, []uint64 /* canIgnore */, []uint64 /* canAccess */, error) {
 	if lr.testingKnobs.meetLock != nil {
 		lr.testingKnobs.meetLock(locks)
@@ -331,6 +356,11 @@ func (lr *LockResolver) resolveLocks(bo *retry.Backoffer, callerStartTS uint64,
 		return msBeforeTxnExpired.value(), nil, nil, nil
 	}
 	metrics.LockResolverCountWithResolve.Inc()
+	if isBackgroundResolve(bo) {
+		if err := lr.backgroundLimiter.wait(bo.GetCtx(), len(locks)); err != nil {
+			return msBeforeTxnExpired.value(), nil, nil, err
+		}
+	}
 
 	// TxnID -> []Region, record resolved Regions.
 	// TODO: Maybe put it in LockResolver and share by all txns.
@@ -509,7 +539,7 @@ func (lr *LockResolver) getTxnStatusFromLock(bo *retry.Backoffer, l *Lock, calle
 			if l.LockType == kvrpcpb.Op_PessimisticLock {
 				if _, err := util.EvalFailpoint("txnExpireRetTTL"); err == nil {
 					return TxnStatus{action: kvrpcpb.Action_LockNotExistDoNothing},
-						errors.New("error txn not found and lock expired")
+						errors.WithMessage(&tikverr.ErrTxnNotFound{StartTS: l.TxnID}, "lock expired")
 				}
 			}
 			// For pessimistic lock resolving, if the primary lock does not exist and rollbackIfNotExist is true,
@@ -580,6 +610,7 @@ func (lr *LockResolver) getTxnStatus(bo *retry.Backoffer, txnID uint64, primary
 			return status, err
 		}
 		req.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
+		setResolvePriority(bo, req)
 		resp, err := lr.store.SendReq(bo, req, loc.Region, client.ReadTimeoutShort)
 		if err != nil {
 			return status, err
@@ -605,7 +636,7 @@ func (lr *LockResolver) getTxnStatus(bo *retry.Backoffer, txnID uint64, primary
 				return status, txnNotFoundErr{txnNotFound}
 			}
 
-			err = errors.Errorf("unexpected err: %s, tid: %v", keyErr, txnID)
+			err = errors.WithMessagef(&tikverr.ErrUnexpectedKeyErr{KeyErr: keyErr}, "check txn status failed, tid: %v", txnID)
 			logutil.BgLogger().Error("getTxnStatus error", zap.Error(err))
 			return status, err
 		}
@@ -675,14 +706,14 @@ func (data *asyncResolveData) addKeys(locks []*kvrpcpb.LockInfo, expected int, s
 		if !data.missingLock {
 			// commitTS == 0 => lock has been rolled back.
 			if commitTS != 0 && commitTS < data.commitTs {
-				return errors.Errorf("commit TS must be greater or equal to min commit TS: commit ts: %v, min commit ts: %v", commitTS, data.commitTs)
+				return errors.WithStack(&tikverr.ErrLockResolveProtocol{Reason: fmt.Sprintf("commit TS must be greater or equal to min commit TS: commit ts: %v, min commit ts: %v", commitTS, data.commitTs)})
 			}
 			data.commitTs = commitTS
 		}
 		data.missingLock = true
 
 		if data.commitTs != commitTS {
-			return errors.Errorf("commit TS mismatch in async commit recovery: %v and %v", data.commitTs, commitTS)
+			return errors.WithStack(&tikverr.ErrLockResolveProtocol{Reason: fmt.Sprintf("commit TS mismatch in async commit recovery: %v and %v", data.commitTs, commitTS)})
 		}
 
 		// We do not need to resolve the remaining locks because TiKV will have resolved them as appropriate.
@@ -693,7 +724,7 @@ func (data *asyncResolveData) addKeys(locks []*kvrpcpb.LockInfo, expected int, s
 	// Save all locks to be resolved.
 	for _, lockInfo := range locks {
 		if lockInfo.LockVersion != startTS {
-			err := errors.Errorf("unexpected timestamp, expected: %v, found: %v", startTS, lockInfo.LockVersion)
+			err := errors.WithStack(&tikverr.ErrLockResolveProtocol{Reason: fmt.Sprintf("unexpected timestamp, expected: %v, found: %v", startTS, lockInfo.LockVersion)})
 			logutil.BgLogger().Error("addLocks error", zap.Error(err))
 			return err
 		}
@@ -717,6 +748,7 @@ func (lr *LockResolver) checkSecondaries(bo *retry.Backoffer, txnID uint64, curK
 	req := tikvrpc.NewRequest(tikvrpc.CmdCheckSecondaryLocks, checkReq)
 	metrics.LockResolverCountWithQueryCheckSecondaryLocks.Inc()
 	req.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
+	setResolvePriority(bo, req)
 	resp, err := lr.store.SendReq(bo, req, curRegionID, client.ReadTimeoutShort)
 	if err != nil {
 		return err
@@ -785,7 +817,7 @@ func (lr *LockResolver) resolveAsyncResolveData(bo *retry.Backoffer, l *Lock, st
 	}
 
 	if len(errs) > 0 {
-		return errors.Errorf("async commit recovery (sending ResolveLock) finished with errors: %v", errs)
+		return errors.WithMessage(&tikverr.ErrResolveLocksFailed{Errs: errs}, "async commit recovery (sending ResolveLock) failed")
 	}
 
 	return nil
@@ -870,6 +902,7 @@ func (lr *LockResolver) resolveRegionLocks(bo *retry.Backoffer, l *Lock, region
 	lreq.Keys = keys
 	req := tikvrpc.NewRequest(tikvrpc.CmdResolveLock, lreq)
 	req.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
+	setResolvePriority(bo, req)
 	resp, err := lr.store.SendReq(bo, req, region, client.ReadTimeoutShort)
 	if err != nil {
 		return err
@@ -905,7 +938,7 @@ func (lr *LockResolver) resolveRegionLocks(bo *retry.Backoffer, l *Lock, region
 	}
 	cmdResp := resp.Resp.(*kvrpcpb.ResolveLockResponse)
 	if keyErr := cmdResp.GetError(); keyErr != nil {
-		err = errors.Errorf("unexpected resolve err: %s, lock: %v", keyErr, l)
+		err = errors.WithMessagef(&tikverr.ErrUnexpectedKeyErr{KeyErr: keyErr}, "resolve lock failed, lock: %v", l)
 		logutil.BgLogger().Error("resolveLock error", zap.Error(err))
 	}
 
@@ -946,6 +979,7 @@ func (lr *LockResolver) resolveLock(bo *retry.Backoffer, l *Lock, status TxnStat
 		}
 		req := tikvrpc.NewRequest(tikvrpc.CmdResolveLock, lreq)
 		req.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
+		setResolvePriority(bo, req)
 		resp, err := lr.store.SendReq(bo, req, loc.Region, client.ReadTimeoutShort)
 		if err != nil {
 			return err
@@ -966,7 +1000,7 @@ func (lr *LockResolver) resolveLock(bo *retry.Backoffer, l *Lock, status TxnStat
 		}
 		cmdResp := resp.Resp.(*kvrpcpb.ResolveLockResponse)
 		if keyErr := cmdResp.GetError(); keyErr != nil {
-			err = errors.Errorf("unexpected resolve err: %s, lock: %v", keyErr, l)
+			err = errors.WithMessagef(&tikverr.ErrUnexpectedKeyErr{KeyErr: keyErr}, "resolve lock failed, lock: %v", l)
 			logutil.BgLogger().Error("resolveLock error", zap.Error(err))
 			return err
 		}
@@ -999,6 +1033,7 @@ func (lr *LockResolver) resolvePessimisticLock(bo *retry.Backoffer, l *Lock) err
 		}
 		req := tikvrpc.NewRequest(tikvrpc.CmdPessimisticRollback, pessimisticRollbackReq)
 		req.MaxExecutionDurationMs = uint64(client.MaxWriteExecutionTime.Milliseconds())
+		setResolvePriority(bo, req)
 		resp, err := lr.store.SendReq(bo, req, loc.Region, client.ReadTimeoutShort)
 		if err != nil {
 			return err
@@ -1019,7 +1054,7 @@ func (lr *LockResolver) resolvePessimisticLock(bo *retry.Backoffer, l *Lock) err
 		}
 		cmdResp := resp.Resp.(*kvrpcpb.PessimisticRollbackResponse)
 		if keyErr := cmdResp.GetErrors(); len(keyErr) > 0 {
-			err = errors.Errorf("unexpected resolve pessimistic lock err: %s, lock: %v", keyErr[0], l)
+			err = errors.WithMessagef(&tikverr.ErrUnexpectedKeyErr{KeyErr: keyErr[0]}, "resolve pessimistic lock failed, lock: %v", l)
 			logutil.Logger(bo.GetCtx()).Error("resolveLock error", zap.Error(err))
 			return err
 		}
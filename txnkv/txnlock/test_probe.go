@@ -15,6 +15,8 @@
 package txnlock
 
 import (
+	"time"
+
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pkg/errors"
 	"github.com/tikv/client-go/v2/internal/locate"
@@ -77,6 +79,12 @@ func (l LockResolverProbe) GetSecondariesFromTxnStatus(status TxnStatus) [][]byt
 	return status.primaryLock.GetSecondaries()
 }
 
+// SetBackgroundResolveClock replaces time.Now and time.After used to limit the rate of resolving locks in the
+// background.
+func (l LockResolverProbe) SetBackgroundResolveClock(now func() time.Time, after func(time.Duration) <-chan time.Time) {
+	l.backgroundLimiter.setClock(now, after)
+}
+
 // SetMeetLockCallback is called whenever it meets locks.
 func (l LockResolverProbe) SetMeetLockCallback(f func([]*Lock)) {
 	l.testingKnobs.meetLock = f
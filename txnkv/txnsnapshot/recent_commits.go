@@ -0,0 +1,101 @@
+// Copyright 2022 TiKV Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package txnsnapshot
+
+import (
+	"container/list"
+	"sync"
+
+	"github.com/dgryski/go-farm"
+)
+
+// RecentCommits records the keys written by the transactions recently committed by the client. It's used to check
+// whether replica reads see the writes of the client, which is a diagnostic tool for stale replicas. The keys are
+// recorded by hash and the memory is bounded: the least recently recorded keys are evicted when it's full.
+type RecentCommits struct {
+	mu       sync.Mutex
+	capacity int
+	lru      *list.List
+	entries  map[uint64]*list.Element
+}
+
+type recentCommit struct {
+	keyHash   uint64
+	commitTS  uint64
+	valueHash uint64
+}
+
+// NewRecentCommits creates a RecentCommits which records at most capacity keys.
+func NewRecentCommits(capacity int) *RecentCommits {
+	return &RecentCommits{
+		capacity: capacity,
+		lru:      list.New(),
+		entries:  make(map[uint64]*list.Element),
+	}
+}
+
+// Record records that the key is written with the value by a transaction committed at commitTS. An empty value means
+// the key is deleted.
+func (c *RecentCommits) Record(key, value []byte, commitTS uint64) {
+	if c.capacity <= 0 {
+		return
+	}
+	keyHash := farm.Fingerprint64(key)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if e, ok := c.entries[keyHash]; ok {
+		entry := e.Value.(*recentCommit)
+		if entry.commitTS > commitTS {
+			return
+		}
+		entry.commitTS, entry.valueHash = commitTS, farm.Fingerprint64(value)
+		c.lru.MoveToFront(e)
+		return
+	}
+	if c.lru.Len() >= c.capacity {
+		oldest := c.lru.Back()
+		c.lru.Remove(oldest)
+		delete(c.entries, oldest.Value.(*recentCommit).keyHash)
+	}
+	c.entries[keyHash] = c.lru.PushFront(&recentCommit{
+		keyHash:   keyHash,
+		commitTS:  commitTS,
+		valueHash: farm.Fingerprint64(value),
+	})
+}
+
+// Len returns the number of keys recorded.
+func (c *RecentCommits) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.lru.Len()
+}
+
+// matches checks whether the value read at readTS is the latest recorded write of the key. It returns true if the
+// key isn't recorded or is committed after readTS, as there is nothing to compare with.
+func (c *RecentCommits) matches(key, value []byte, readTS uint64) (commitTS uint64, ok bool) {
+	keyHash := farm.Fingerprint64(key)
+	c.mu.Lock()
+	e, found := c.entries[keyHash]
+	var entry recentCommit
+	if found {
+		entry = *e.Value.(*recentCommit)
+	}
+	c.mu.Unlock()
+	if !found || entry.commitTS >= readTS {
+		return 0, true
+	}
+	return entry.commitTS, entry.valueHash == farm.Fingerprint64(value)
+}
@@ -37,6 +37,8 @@ package txnsnapshot
 import (
 	"bytes"
 	"context"
+	"sync"
+	"sync/atomic"
 
 	"github.com/pingcap/kvproto/pkg/kvrpcpb"
 	"github.com/pkg/errors"
@@ -46,6 +48,7 @@ import (
 	"github.com/tikv/client-go/v2/internal/logutil"
 	"github.com/tikv/client-go/v2/internal/retry"
 	"github.com/tikv/client-go/v2/kv"
+	"github.com/tikv/client-go/v2/metrics"
 	"github.com/tikv/client-go/v2/tikvrpc"
 	"github.com/tikv/client-go/v2/tikvrpc/interceptor"
 	"github.com/tikv/client-go/v2/txnkv/txnlock"
@@ -67,6 +70,33 @@ type Scanner struct {
 
 	valid bool
 	eof   bool
+
+	// skippedRanges is the number of failed ranges skipped by the partial result handler of the snapshot.
+	skippedRanges int
+
+	// prefetch is the state of locating the next region in advance, if the snapshot enables it.
+	prefetch struct {
+		sync.WaitGroup
+		// ctx is canceled when the scanner is closed, so the prefetch doesn't outlive the scanner.
+		ctx    context.Context
+		cancel context.CancelFunc
+		// running is 1 if a prefetch is outstanding.
+		running int32
+		// lastKey is the key of the last prefetch, so that each region is prefetched once.
+		lastKey []byte
+	}
+}
+
+// scanRegionError is the error of scanning a region, which may be skipped by the partial result handler.
+type scanRegionError struct {
+	err         error
+	failedRange kv.KeyRange
+	loc         *locate.KeyLocation
+	reqStartKey []byte
+}
+
+func (e *scanRegionError) Error() string {
+	return e.err.Error()
 }
 
 func newScanner(snapshot *KVSnapshot, startKey []byte, endKey []byte, batchSize int, reverse bool) (*Scanner, error) {
@@ -74,6 +104,10 @@ func newScanner(snapshot *KVSnapshot, startKey []byte, endKey []byte, batchSize
 	if batchSize <= 1 {
 		batchSize = defaultScanBatchSize
 	}
+	// A response capped by the server has fewer pairs than the limit, which would be taken as the end of the region.
+	if snapshot.scanMaxLimit > 0 && batchSize > snapshot.scanMaxLimit {
+		batchSize = snapshot.scanMaxLimit
+	}
 	scanner := &Scanner{
 		snapshot:     snapshot,
 		batchSize:    batchSize,
@@ -111,20 +145,25 @@ func (s *Scanner) Value() []byte {
 	return nil
 }
 
-const scannerNextMaxBackoff = 20000
+var scannerNextMaxBackoff = 20000
 
-// Next return next element.
-func (s *Scanner) Next() error {
+func (s *Scanner) newBackoffer() *retry.Backoffer {
 	bo := retry.NewBackofferWithVars(context.WithValue(context.Background(), retry.TxnStartKey, s.snapshot.version), scannerNextMaxBackoff, s.snapshot.vars)
-	if !s.valid {
-		return errors.New("scanner iterator is invalid")
-	}
 	if s.snapshot.interceptor != nil {
 		// User has called snapshot.SetRPCInterceptor() to explicitly set an interceptor, we
 		// need to bind it to ctx so that the internal client can perceive and execute
 		// it before initiating an RPC request.
 		bo.SetCtx(interceptor.WithRPCInterceptor(bo.GetCtx(), s.snapshot.interceptor))
 	}
+	return bo
+}
+
+// Next return next element.
+func (s *Scanner) Next() error {
+	if !s.valid {
+		return errors.New("scanner iterator is invalid")
+	}
+	bo := s.newBackoffer()
 	var err error
 	for {
 		s.idx++
@@ -134,6 +173,16 @@ func (s *Scanner) Next() error {
 				return nil
 			}
 			err = s.getData(bo)
+			if regionErr, ok := err.(*scanRegionError); ok {
+				if !s.snapshot.partialResultHandler(regionErr.failedRange, regionErr.err) {
+					s.Close()
+					return regionErr.err
+				}
+				s.skipRegion(regionErr)
+				// The backoff budget may be used up by the failed region.
+				bo = s.newBackoffer()
+				continue
+			}
 			if err != nil {
 				s.Close()
 				return err
@@ -172,6 +221,90 @@ func (s *Scanner) Next() error {
 // Close close iterator.
 func (s *Scanner) Close() {
 	s.valid = false
+	if s.prefetch.cancel != nil {
+		s.prefetch.cancel()
+		s.prefetch.Wait()
+	}
+}
+
+// prefetchNextRegion locates the next region of loc in the background, so that its location is cached by the time
+// the scanner moves to it. It's best effort: at most one prefetch is outstanding, and if it fails, the scanner
+// locates the region synchronously as usual.
+func (s *Scanner) prefetchNextRegion(loc *locate.KeyLocation) {
+	var key []byte
+	if !s.reverse {
+		if len(loc.EndKey) == 0 || (len(s.endKey) > 0 && bytes.Compare(loc.EndKey, s.endKey) >= 0) {
+			return
+		}
+		key = loc.EndKey
+	} else {
+		if len(loc.StartKey) == 0 || (len(s.nextStartKey) > 0 && bytes.Compare(loc.StartKey, s.nextStartKey) <= 0) {
+			return
+		}
+		key = loc.StartKey
+	}
+	if bytes.Equal(key, s.prefetch.lastKey) || !atomic.CompareAndSwapInt32(&s.prefetch.running, 0, 1) {
+		return
+	}
+	s.prefetch.lastKey = key
+	if s.prefetch.cancel == nil {
+		s.prefetch.ctx, s.prefetch.cancel = context.WithCancel(context.Background())
+	}
+	ctx, reverse, cache := s.prefetch.ctx, s.reverse, s.snapshot.store.GetRegionCache()
+	s.prefetch.Add(1)
+	go func() {
+		defer s.prefetch.Done()
+		defer atomic.StoreInt32(&s.prefetch.running, 0)
+		bo := retry.NewNoopBackoff(ctx)
+		var err error
+		if !reverse {
+			_, err = cache.LocateKey(bo, key)
+		} else {
+			_, err = cache.LocateEndKey(bo, key)
+		}
+		if err != nil {
+			logutil.BgLogger().Debug("scanner failed to prefetch the next region",
+				zap.String("key", kv.StrKey(key)),
+				zap.Bool("reverse", reverse),
+				zap.Error(err))
+		}
+	}()
+}
+
+// Err returns an *tikverr.ErrPartialScan if some failed ranges are skipped by the partial result handler of the
+// snapshot, so the scanned data is incomplete.
+func (s *Scanner) Err() error {
+	if s.skippedRanges > 0 {
+		return errors.WithStack(&tikverr.ErrPartialScan{SkippedRanges: s.skippedRanges})
+	}
+	return nil
+}
+
+// skipRegion skips the failed range of the region and moves to the next region.
+func (s *Scanner) skipRegion(regionErr *scanRegionError) {
+	logutil.BgLogger().Warn("scanner skips failed range",
+		zap.String("startKey", kv.StrKey(regionErr.failedRange.StartKey)),
+		zap.String("endKey", kv.StrKey(regionErr.failedRange.EndKey)),
+		zap.Uint64("regionID", regionErr.loc.Region.GetID()),
+		zap.Uint64("txnStartTS", s.startTS()),
+		zap.Error(regionErr.err))
+	s.skippedRanges++
+	s.cache, s.idx = nil, -1
+	s.moveToNextRegion(regionErr.loc, regionErr.reqStartKey)
+}
+
+// moveToNextRegion makes the next getData() start from the next region of loc, or sets eof if loc is the last one.
+func (s *Scanner) moveToNextRegion(loc *locate.KeyLocation, reqStartKey []byte) {
+	if !s.reverse {
+		s.nextStartKey = loc.EndKey
+	} else {
+		s.nextEndKey = reqStartKey
+	}
+	if (!s.reverse && (len(loc.EndKey) == 0 || (len(s.endKey) > 0 && kv.CmpKey(s.nextStartKey, s.endKey) >= 0))) ||
+		(s.reverse && (len(loc.StartKey) == 0 || (len(s.nextStartKey) > 0 && kv.CmpKey(s.nextStartKey, s.nextEndKey) >= 0))) {
+		// Current Region is the last one.
+		s.eof = true
+	}
 }
 
 func (s *Scanner) startTS() uint64 {
@@ -189,6 +322,33 @@ func (s *Scanner) resolveCurrentLock(bo *retry.Backoffer, current *kvrpcpb.KvPai
 	return nil
 }
 
+// regionError wraps the error of scanning the region of loc, so that the failed range can be skipped by the partial
+// result handler of the snapshot. Only the errors after the retries of the region are used up, i.e. the backoffer is
+// exhausted or the region is unavailable, are wrapped, the others fail the scan.
+func (s *Scanner) regionError(bo *retry.Backoffer, err error, loc *locate.KeyLocation, reqStartKey []byte) error {
+	if s.snapshot.partialResultHandler == nil {
+		return err
+	}
+	if !bo.Exhausted() && errors.Cause(err) != tikverr.ErrRegionUnavailable {
+		return err
+	}
+	var failedRange kv.KeyRange
+	if !s.reverse {
+		failedRange = kv.KeyRange{StartKey: s.nextStartKey, EndKey: loc.EndKey}
+		if len(s.endKey) > 0 && (len(loc.EndKey) == 0 || bytes.Compare(s.endKey, loc.EndKey) < 0) {
+			failedRange.EndKey = s.endKey
+		}
+	} else {
+		failedRange = kv.KeyRange{StartKey: reqStartKey, EndKey: s.nextEndKey}
+	}
+	return &scanRegionError{
+		err:         err,
+		failedRange: failedRange,
+		loc:         loc,
+		reqStartKey: reqStartKey,
+	}
+}
+
 func (s *Scanner) getData(bo *retry.Backoffer) error {
 	logutil.BgLogger().Debug("txn getData",
 		zap.String("nextStartKey", kv.StrKey(s.nextStartKey)),
@@ -199,6 +359,7 @@ func (s *Scanner) getData(bo *retry.Backoffer) error {
 	var reqEndKey, reqStartKey []byte
 	var loc *locate.KeyLocation
 	var err error
+	splitDepth := 0
 	for {
 		if !s.reverse {
 			loc, err = s.snapshot.store.GetRegionCache().LocateKey(bo, s.nextStartKey)
@@ -251,14 +412,28 @@ func (s *Scanner) getData(bo *retry.Backoffer) error {
 		if s.snapshot.resourceGroupTag == nil && s.snapshot.resourceGroupTagger != nil {
 			s.snapshot.resourceGroupTagger(req)
 		}
+		req.KVReadTimeout = s.snapshot.kvReadTimeout
+		req.AllowHotRegionFollowerRead = s.snapshot.hotRegionFollowerRead
+		req.ResultSizeHint = uint64(sreq.Limit)
 		s.snapshot.mu.RUnlock()
-		resp, err := sender.SendReq(bo, req, loc.Region, client.ReadTimeoutMedium)
+		et, err := s.snapshot.readEndpoint(bo, loc.Region, req.Type)
 		if err != nil {
-			return err
+			return s.regionError(bo, err, loc, reqStartKey)
+		}
+		resp, _, err := sender.SendReqCtx(bo, req, loc.Region, client.TimeoutFor(req), et)
+		if err != nil {
+			if tikverr.IsErrRPCMessageTooLarge(err) && s.batchSize > 1 && splitDepth < locate.MaxMessageTooLargeSplitDepth {
+				// Scan with a smaller limit if the response is too large.
+				metrics.MessageTooLargeSplitCounterScan.Inc()
+				s.batchSize /= 2
+				splitDepth++
+				continue
+			}
+			return s.regionError(bo, err, loc, reqStartKey)
 		}
 		regionErr, err := resp.GetRegionError()
 		if err != nil {
-			return err
+			return s.regionError(bo, err, loc, reqStartKey)
 		}
 		if regionErr != nil {
 			logutil.BgLogger().Debug("scanner getData failed",
@@ -269,13 +444,13 @@ func (s *Scanner) getData(bo *retry.Backoffer) error {
 			if regionErr.GetEpochNotMatch() == nil || locate.IsFakeRegionError(regionErr) {
 				err = bo.Backoff(retry.BoRegionMiss, errors.New(regionErr.String()))
 				if err != nil {
-					return err
+					return s.regionError(bo, err, loc, reqStartKey)
 				}
 			}
 			continue
 		}
 		if resp.Resp == nil {
-			return errors.WithStack(tikverr.ErrBodyMissing)
+			return s.regionError(bo, errors.WithStack(tikverr.ErrBodyMissing), loc, reqStartKey)
 		}
 		cmdScanResp := resp.Resp.(*kvrpcpb.ScanResponse)
 
@@ -289,16 +464,16 @@ func (s *Scanner) getData(bo *retry.Backoffer) error {
 		if keyErr := cmdScanResp.GetError(); keyErr != nil {
 			lock, err := txnlock.ExtractLockFromKeyErr(keyErr)
 			if err != nil {
-				return err
+				return s.regionError(bo, err, loc, reqStartKey)
 			}
 			msBeforeExpired, err := txnlock.NewLockResolver(s.snapshot.store).ResolveLocks(bo, s.snapshot.version, []*txnlock.Lock{lock})
 			if err != nil {
-				return err
+				return s.regionError(bo, err, loc, reqStartKey)
 			}
 			if msBeforeExpired > 0 {
 				err = bo.BackoffWithMaxSleepTxnLockFast(int(msBeforeExpired), errors.Errorf("key is locked during scanning"))
 				if err != nil {
-					return err
+					return s.regionError(bo, err, loc, reqStartKey)
 				}
 			}
 			continue
@@ -310,26 +485,20 @@ func (s *Scanner) getData(bo *retry.Backoffer) error {
 			if keyErr := pair.GetError(); keyErr != nil && len(pair.Key) == 0 {
 				lock, err := txnlock.ExtractLockFromKeyErr(keyErr)
 				if err != nil {
-					return err
+					return s.regionError(bo, err, loc, reqStartKey)
 				}
 				pair.Key = lock.Key
 			}
 		}
 
+		if s.snapshot.scanPrefetch {
+			s.prefetchNextRegion(loc)
+		}
 		s.cache, s.idx = kvPairs, 0
 		if len(kvPairs) < s.batchSize {
 			// No more data in current Region. Next getData() starts
 			// from current Region's endKey.
-			if !s.reverse {
-				s.nextStartKey = loc.EndKey
-			} else {
-				s.nextEndKey = reqStartKey
-			}
-			if (!s.reverse && (len(loc.EndKey) == 0 || (len(s.endKey) > 0 && kv.CmpKey(s.nextStartKey, s.endKey) >= 0))) ||
-				(s.reverse && (len(loc.StartKey) == 0 || (len(s.nextStartKey) > 0 && kv.CmpKey(s.nextStartKey, s.nextEndKey) >= 0))) {
-				// Current Region is the last one.
-				s.eof = true
-			}
+			s.moveToNextRegion(loc, reqStartKey)
 			return nil
 		}
 		// next getData() starts from the last key in kvPairs (but skip
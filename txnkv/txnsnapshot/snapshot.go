@@ -39,6 +39,7 @@ import (
 	"context"
 	"fmt"
 	"math"
+	"sort"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -98,6 +99,8 @@ type kvstore interface {
 	SendReq(bo *retry.Backoffer, req *tikvrpc.Request, regionID locate.RegionVerID, timeout time.Duration) (*tikvrpc.Response, error)
 	// GetOracle gets a timestamp oracle client.
 	GetOracle() oracle.Oracle
+	// GetRecentCommits returns the keys recently committed by the client, it's nil if they aren't recorded.
+	GetRecentCommits() *RecentCommits
 }
 
 // KVSnapshot implements the tidbkv.Snapshot interface.
@@ -141,8 +144,27 @@ type KVSnapshot struct {
 	resourceGroupTagger tikvrpc.ResourceGroupTagger
 	// interceptor is used to decorate the RPC request logic related to the snapshot.
 	interceptor interceptor.RPCInterceptor
+	// readYourWritesCheck indicates whether to check replica reads against the recent commits of the client.
+	readYourWritesCheck bool
+	// partialResultHandler decides whether a scan skips a range that fails.
+	partialResultHandler PartialResultHandler
+	// preferTiFlash indicates whether to read the regions from TiFlash if they have valid TiFlash peers.
+	preferTiFlash bool
+	// scanPrefetch indicates whether the scanners locate the next region in advance.
+	scanPrefetch bool
+	// scanMaxLimit caps the limit of each scan request, a value not greater than 0 means no cap.
+	scanMaxLimit int
+	// kvReadTimeout limits each attempt of the read requests, 0 means no limit.
+	kvReadTimeout time.Duration
+	// hotRegionFollowerRead indicates whether the leader reads of hot regions can be spread to followers.
+	hotRegionFollowerRead bool
 }
 
+// PartialResultHandler is called by a scanner when the requests to a region fail. failedRange is the part of the
+// scan range in the region that isn't read yet. The scanner skips the range and continues with the next region if
+// it returns true, otherwise the scan fails with err.
+type PartialResultHandler func(failedRange kv.KeyRange, err error) bool
+
 // NewTiKVSnapshot creates a snapshot of an TiKV store.
 func NewTiKVSnapshot(store kvstore, ts uint64, replicaReadSeed uint32) *KVSnapshot {
 	// Sanity check for snapshot version.
@@ -182,29 +204,66 @@ func (s *KVSnapshot) SetSnapshotTS(ts uint64) {
 // The map will not contain nonexistent keys.
 // NOTE: Don't modify keys. Some codes rely on the order of keys.
 func (s *KVSnapshot) BatchGet(ctx context.Context, keys [][]byte) (map[string][]byte, error) {
-	// Check the cached value first.
 	m := make(map[string][]byte)
+	err := s.batchGet(ctx, keys, func(idx int, value []byte) {
+		m[string(keys[idx])] = value
+	})
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// BatchGetInto gets all the keys' value from kv-server like BatchGet, but instead of building a map, it calls f with
+// the index in keys and the value of each existing key. For a key that appears in keys multiple times, it's fetched
+// only once and f is called for each of its indexes. f is called sequentially after all values are fetched.
+// The value passed to f is not copied and is shared with the snapshot's cache, so it must not be modified. It stays
+// valid after f returns.
+// NOTE: Don't modify keys. Some codes rely on the order of keys.
+func (s *KVSnapshot) BatchGetInto(ctx context.Context, keys [][]byte, f func(idx int, value []byte)) error {
+	return s.batchGet(ctx, keys, f)
+}
+
+func (s *KVSnapshot) batchGet(ctx context.Context, keys [][]byte, f func(idx int, value []byte)) error {
+	uniqKeys, indexes, starts := dedupKeys(keys)
+	values := make([][]byte, len(uniqKeys))
+
+	// Check the cached value first.
+	pendingKeys := uniqKeys
 	s.mu.RLock()
 	if s.mu.cached != nil {
-		tmp := make([][]byte, 0, len(keys))
-		for _, key := range keys {
+		pendingKeys = make([][]byte, 0, len(uniqKeys))
+		for i, key := range uniqKeys {
 			if val, ok := s.mu.cached[string(key)]; ok {
 				atomic.AddInt64(&s.mu.hitCnt, 1)
-				if len(val) > 0 {
-					m[string(key)] = val
-				}
+				values[i] = val
 			} else {
-				tmp = append(tmp, key)
+				pendingKeys = append(pendingKeys, key)
 			}
 		}
-		keys = tmp
 	}
 	s.mu.RUnlock()
 
-	if len(keys) == 0 {
-		return m, nil
+	if len(pendingKeys) > 0 {
+		if err := s.fetchAndCache(ctx, uniqKeys, pendingKeys, values); err != nil {
+			return err
+		}
+	}
+
+	for i, val := range values {
+		if len(val) == 0 {
+			continue
+		}
+		for _, idx := range indexes[starts[i]:starts[i+1]] {
+			f(idx, val)
+		}
 	}
+	return nil
+}
 
+// fetchAndCache gets the values of pendingKeys, which are part of uniqKeys, from kv-server and puts them in the
+// cache. values are filled in the same order as uniqKeys.
+func (s *KVSnapshot) fetchAndCache(ctx context.Context, uniqKeys, pendingKeys [][]byte, values [][]byte) error {
 	ctx = context.WithValue(ctx, retry.TxnStartKey, s.version)
 	bo := retry.NewBackofferWithVars(ctx, batchGetMaxBackoff, s.vars)
 
@@ -215,34 +274,38 @@ func (s *KVSnapshot) BatchGet(ctx context.Context, keys [][]byte) (map[string][]
 		bo.SetCtx(interceptor.WithRPCInterceptor(bo.GetCtx(), s.interceptor))
 	}
 
-	// Create a map to collect key-values from region servers.
-	var mu sync.Mutex
-	err := s.batchGetKeysByRegions(bo, keys, func(k, v []byte) {
+	// Each key is fetched once, so every value is written by only one goroutine.
+	err := s.batchGetKeysByRegions(bo, pendingKeys, func(k, v []byte) {
 		if len(v) == 0 {
 			return
 		}
-
-		mu.Lock()
-		m[string(k)] = v
-		mu.Unlock()
+		values[searchKey(uniqKeys, k)] = v
 	})
+	if err == nil && s.needCheckReadYourWrites() {
+		for _, key := range pendingKeys {
+			idx := searchKey(uniqKeys, key)
+			if values[idx], err = s.checkReadYourWrites(bo, key, values[idx]); err != nil {
+				break
+			}
+		}
+	}
 	s.recordBackoffInfo(bo)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	err = s.store.CheckVisibility(s.version)
 	if err != nil {
-		return nil, err
+		return err
 	}
 
 	// Update the cache.
 	s.mu.Lock()
 	if s.mu.cached == nil {
-		s.mu.cached = make(map[string][]byte, len(m))
+		s.mu.cached = make(map[string][]byte, len(pendingKeys))
 	}
-	for _, key := range keys {
-		val := m[string(key)]
+	for _, key := range pendingKeys {
+		val := values[searchKey(uniqKeys, key)]
 		s.mu.cachedSize += len(key) + len(val)
 		s.mu.cached[string(key)] = val
 	}
@@ -250,7 +313,7 @@ func (s *KVSnapshot) BatchGet(ctx context.Context, keys [][]byte) (map[string][]
 	const cachedSizeLimit = 10 << 30
 	if s.mu.cachedSize >= cachedSizeLimit {
 		for k, v := range s.mu.cached {
-			if _, needed := m[k]; needed {
+			if hasKey(uniqKeys, k) {
 				continue
 			}
 			delete(s.mu.cached, k)
@@ -261,13 +324,51 @@ func (s *KVSnapshot) BatchGet(ctx context.Context, keys [][]byte) (map[string][]
 		}
 	}
 	s.mu.Unlock()
+	return nil
+}
 
-	return m, nil
+// dedupKeys groups the indexes of equal keys together. The distinct keys are returned in ascending order, and
+// the indexes of the i-th distinct key in keys are indexes[starts[i]:starts[i+1]].
+func dedupKeys(keys [][]byte) (uniqKeys [][]byte, indexes []int, starts []int) {
+	indexes = make([]int, len(keys))
+	for i := range indexes {
+		indexes[i] = i
+	}
+	sort.SliceStable(indexes, func(i, j int) bool {
+		return bytes.Compare(keys[indexes[i]], keys[indexes[j]]) < 0
+	})
+	uniqKeys = make([][]byte, 0, len(keys))
+	starts = make([]int, 0, len(keys)+1)
+	for i, idx := range indexes {
+		if i == 0 || !bytes.Equal(keys[idx], uniqKeys[len(uniqKeys)-1]) {
+			uniqKeys = append(uniqKeys, keys[idx])
+			starts = append(starts, i)
+		}
+	}
+	starts = append(starts, len(indexes))
+	return uniqKeys, indexes, starts
+}
+
+// hasKey returns whether the sorted keys contain key.
+func hasKey(keys [][]byte, key string) bool {
+	i := sort.Search(len(keys), func(i int) bool {
+		return string(keys[i]) >= key
+	})
+	return i < len(keys) && string(keys[i]) == key
+}
+
+// searchKey returns the index of key in the sorted keys which must contain it.
+func searchKey(keys [][]byte, key []byte) int {
+	return sort.Search(len(keys), func(i int) bool {
+		return bytes.Compare(keys[i], key) >= 0
+	})
 }
 
 type batchKeys struct {
 	region locate.RegionVerID
 	keys   [][]byte
+	// splitDepth is the number of times the keys are split because the message is too large.
+	splitDepth int
 }
 
 func (b *batchKeys) relocate(bo *retry.Backoffer, c *locate.RegionCache) (bool, error) {
@@ -371,6 +472,9 @@ func (s *KVSnapshot) batchGetSingleRegion(bo *retry.Backoffer, batch batchKeys,
 		if s.resourceGroupTag == nil && s.resourceGroupTagger != nil {
 			s.resourceGroupTagger(req)
 		}
+		req.KVReadTimeout = s.kvReadTimeout
+		req.AllowHotRegionFollowerRead = s.hotRegionFollowerRead
+		req.ResultSizeHint = uint64(len(pending))
 		scope := s.mu.readReplicaScope
 		isStaleness := s.mu.isStaleness
 		matchStoreLabels := s.mu.matchStoreLabels
@@ -384,10 +488,26 @@ func (s *KVSnapshot) batchGetSingleRegion(bo *retry.Backoffer, batch batchKeys,
 		if len(matchStoreLabels) > 0 {
 			ops = append(ops, locate.WithMatchLabels(matchStoreLabels))
 		}
-		resp, _, _, err := cli.SendReqCtx(bo, req, batch.region, client.ReadTimeoutMedium, tikvrpc.TiKV, "", ops...)
+		et, err := s.readEndpoint(bo, batch.region, req.Type)
 		if err != nil {
 			return err
 		}
+		resp, _, _, err := cli.SendReqCtx(bo, req, batch.region, client.TimeoutFor(req), et, "", ops...)
+		if err != nil {
+			if tikverr.IsErrRPCMessageTooLarge(err) && len(pending) > 1 && batch.splitDepth < locate.MaxMessageTooLargeSplitDepth {
+				// Get the keys in halves if the response is too large.
+				metrics.MessageTooLargeSplitCounterBatchGet.Inc()
+				mid := len(pending) / 2
+				for _, keys := range [][][]byte{pending[:mid], pending[mid:]} {
+					err = s.batchGetSingleRegion(bo, batchKeys{region: batch.region, keys: keys, splitDepth: batch.splitDepth + 1}, collectF)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			}
+			return err
+		}
 		regionErr, err := resp.GetRegionError()
 		if err != nil {
 			return err
@@ -550,6 +670,8 @@ func (s *KVSnapshot) get(ctx context.Context, bo *retry.Backoffer, k []byte) ([]
 	if s.resourceGroupTag == nil && s.resourceGroupTagger != nil {
 		s.resourceGroupTagger(req)
 	}
+	req.KVReadTimeout = s.kvReadTimeout
+	req.AllowHotRegionFollowerRead = s.hotRegionFollowerRead
 	isStaleness := s.mu.isStaleness
 	matchStoreLabels := s.mu.matchStoreLabels
 	scope := s.mu.readReplicaScope
@@ -571,7 +693,11 @@ func (s *KVSnapshot) get(ctx context.Context, bo *retry.Backoffer, k []byte) ([]
 		if err != nil {
 			return nil, err
 		}
-		resp, _, _, err := cli.SendReqCtx(bo, req, loc.Region, client.ReadTimeoutShort, tikvrpc.TiKV, "", ops...)
+		et, err := s.readEndpoint(bo, loc.Region, req.Type)
+		if err != nil {
+			return nil, err
+		}
+		resp, _, _, err := cli.SendReqCtx(bo, req, loc.Region, client.TimeoutFor(req), et, "", ops...)
 		if err != nil {
 			return nil, err
 		}
@@ -630,10 +756,102 @@ func (s *KVSnapshot) get(ctx context.Context, bo *retry.Backoffer, k []byte) ([]
 			}
 			continue
 		}
+		if s.needCheckReadYourWrites() {
+			return s.checkReadYourWrites(bo, k, val)
+		}
 		return val, nil
 	}
 }
 
+// readEndpoint returns the endpoint to send the command of the region to, which is TiFlash if it's preferred and
+// TiFlash serves the command, unless the region has no valid TiFlash peer.
+func (s *KVSnapshot) readEndpoint(bo *retry.Backoffer, region locate.RegionVerID, cmd tikvrpc.CmdType) (tikvrpc.EndpointType, error) {
+	if !s.preferTiFlash || !servedByTiFlash(cmd) {
+		return tikvrpc.TiKV, nil
+	}
+	rpcCtx, err := s.store.GetRegionCache().GetTiFlashRPCContext(bo, region, false, locate.WithTiFlashFallback())
+	if tikverr.IsErrNoAvailableTiFlash(err) {
+		metrics.TiKVPreferTiFlashFallbackCounter.Inc()
+		return tikvrpc.TiKV, nil
+	}
+	if err != nil {
+		return tikvrpc.TiKV, err
+	}
+	if rpcCtx == nil {
+		// The region is stale rather than lacking TiFlash peers. The request fails with a region error and is retried
+		// with the reloaded region, which is checked for TiFlash peers again.
+		return tikvrpc.TiFlash, nil
+	}
+	// The context only tells the region has a valid TiFlash peer, no request is sent with it.
+	s.store.GetRegionCache().ReleaseRPCContext(rpcCtx, locate.RPCOutcomeOK)
+	return tikvrpc.TiFlash, nil
+}
+
+// servedByTiFlash returns whether TiFlash serves the command. TiFlash only serves the coprocessor and MPP requests,
+// the KV reads such as KvGet, KvBatchGet and KvScan are served by TiKV only.
+func servedByTiFlash(cmd tikvrpc.CmdType) bool {
+	switch cmd {
+	case tikvrpc.CmdCop, tikvrpc.CmdCopStream, tikvrpc.CmdBatchCop,
+		tikvrpc.CmdMPPTask, tikvrpc.CmdMPPConn, tikvrpc.CmdMPPCancel, tikvrpc.CmdMPPAlive:
+		return true
+	}
+	return false
+}
+
+// needCheckReadYourWrites returns whether the values read by the snapshot should be checked against the recent
+// commits of the client, which is only necessary for replica reads.
+func (s *KVSnapshot) needCheckReadYourWrites() bool {
+	if !s.readYourWritesCheck || s.store.GetRecentCommits() == nil {
+		return false
+	}
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.mu.replicaRead.IsFollowerRead() || s.mu.isStaleness
+}
+
+// checkReadYourWrites checks whether the value of the key read from a replica misses the write recently committed by
+// the client before the snapshot. If it does, the value is read from the leader again, and an inconsistency is
+// reported if the leader returns a different value.
+func (s *KVSnapshot) checkReadYourWrites(bo *retry.Backoffer, k, val []byte) ([]byte, error) {
+	commitTS, ok := s.store.GetRecentCommits().matches(k, val, s.version)
+	if ok {
+		return val, nil
+	}
+	leaderVal, err := s.leaderSnapshot().get(bo.GetCtx(), bo, k)
+	if err != nil {
+		return nil, err
+	}
+	if bytes.Equal(val, leaderVal) {
+		// The key is overwritten by other clients after the recorded commit.
+		return val, nil
+	}
+	metrics.TiKVReadYourWritesViolationCounter.Inc()
+	s.mu.RLock()
+	replicaRead, isStaleness := s.mu.replicaRead, s.mu.isStaleness
+	s.mu.RUnlock()
+	logutil.Logger(bo.GetCtx()).Warn("replica read misses the write committed before the snapshot, read from leader instead",
+		zap.String("key", kv.StrKey(k)),
+		zap.Uint64("startTS", s.version),
+		zap.Uint64("commitTS", commitTS),
+		zap.Uint8("replicaRead", uint8(replicaRead)),
+		zap.Bool("staleRead", isStaleness),
+		zap.Int("replicaValueLen", len(val)),
+		zap.Int("leaderValueLen", len(leaderVal)))
+	return leaderVal, nil
+}
+
+// leaderSnapshot returns a snapshot at the same version which reads from the leaders.
+func (s *KVSnapshot) leaderSnapshot() *KVSnapshot {
+	snapshot := NewTiKVSnapshot(s.store, s.version, s.replicaReadSeed)
+	snapshot.isolationLevel = s.isolationLevel
+	snapshot.priority = s.priority
+	snapshot.notFillCache = s.notFillCache
+	snapshot.vars = s.vars
+	snapshot.resourceGroupTag = s.resourceGroupTag
+	snapshot.resourceGroupTagger = s.resourceGroupTagger
+	return snapshot
+}
+
 func (s *KVSnapshot) mergeExecDetail(detail *kvrpcpb.ExecDetailsV2) {
 	s.mu.Lock()
 	defer s.mu.Unlock()
@@ -685,6 +903,57 @@ func (s *KVSnapshot) SetReplicaRead(readType kv.ReplicaReadType) {
 	s.mu.replicaRead = readType
 }
 
+// SetReadYourWritesCheck sets whether to check the replica reads of the snapshot against the transactions recently
+// committed by the client, which is a diagnostic tool for stale replicas. It takes effect only if the store records
+// the recent commits. When a replica read misses such a write, an inconsistency is reported and the key is read from
+// the leader again.
+func (s *KVSnapshot) SetReadYourWritesCheck(b bool) {
+	s.readYourWritesCheck = b
+}
+
+// SetPartialResultHandler sets the handler to decide whether the scanners of the snapshot skip the ranges of regions
+// that fail, so that a scan can return partial results. Scanner.Err reports the number of skipped ranges. By default,
+// a scan fails if any region fails.
+func (s *KVSnapshot) SetPartialResultHandler(handler PartialResultHandler) {
+	s.partialResultHandler = handler
+}
+
+// SetPreferTiFlash sets whether to read from TiFlash. If it's true, the requests of a region that TiFlash serves are
+// sent to TiFlash if the region has a valid TiFlash peer, otherwise they fall back to TiKV. TiFlash doesn't serve the
+// KV reads, so the gets, batch gets and scans of the snapshot are always sent to TiKV.
+func (s *KVSnapshot) SetPreferTiFlash(prefer bool) {
+	s.preferTiFlash = prefer
+}
+
+// SetScanPrefetch sets whether the scanners of the snapshot locate the next region in the background after receiving
+// the first response from the current region, which hides the latency of loading the next region from PD when the
+// region cache is cold.
+func (s *KVSnapshot) SetScanPrefetch(b bool) {
+	s.scanPrefetch = b
+}
+
+// SetScanMaxLimit caps the number of pairs each scan request asks for, which should not exceed the limit the server
+// enforces on a scan response. The scanners continue from the last returned key until the caller stops, so a large
+// scan batch size is split into requests within the cap. A limit not greater than 0 means no cap.
+func (s *KVSnapshot) SetScanMaxLimit(limit int) {
+	s.scanMaxLimit = limit
+}
+
+// SetKVReadTimeout limits each attempt of the Get, BatchGet and Scan requests of the snapshot to d if it's shorter than
+// the default timeout. A timed out attempt is retried on the next replica for replica reads, or on the leader,
+// without marking the store failed, until the Backoffer's context is done. 0 means no limit.
+//
+// The kvproto in use can't tell TiKV to abandon the read, so the limit is only enforced by the client.
+func (s *KVSnapshot) SetKVReadTimeout(d time.Duration) {
+	s.kvReadTimeout = d
+}
+
+// SetHotRegionFollowerRead sets whether the Get, BatchGet and Scan requests of the snapshot can be served by
+// followers if they are leader reads and the regions are detected hot by the region cache.
+func (s *KVSnapshot) SetHotRegionFollowerRead(allow bool) {
+	s.hotRegionFollowerRead = allow
+}
+
 // SetIsolationLevel sets the isolation level used to scan data from tikv.
 func (s *KVSnapshot) SetIsolationLevel(level IsoLevel) {
 	s.isolationLevel = level
@@ -53,6 +53,11 @@ func (s SnapshotProbe) BatchGetSingleRegion(bo *retry.Backoffer, region locate.R
 	return s.batchGetSingleRegion(bo, batchKeys{region: region, keys: keys}, collectF)
 }
 
+// ReadEndpoint returns the endpoint to send the command of the region to.
+func (s SnapshotProbe) ReadEndpoint(bo *retry.Backoffer, region locate.RegionVerID, cmd tikvrpc.CmdType) (tikvrpc.EndpointType, error) {
+	return s.readEndpoint(bo, region, cmd)
+}
+
 // NewScanner returns a scanner to iterate given key range.
 func (s SnapshotProbe) NewScanner(start, end []byte, batchSize int, reverse bool) (*Scanner, error) {
 	return newScanner(s.KVSnapshot, start, end, batchSize, reverse)
@@ -70,3 +75,10 @@ func (c ConfigProbe) GetScanBatchSize() int {
 func (c ConfigProbe) GetGetMaxBackoff() int {
 	return getMaxBackoff
 }
+
+// SetScannerNextMaxBackoff sets the max sleep of each Next of scanners and returns the previous value.
+func (c ConfigProbe) SetScannerNextMaxBackoff(v int) int {
+	prev := scannerNextMaxBackoff
+	scannerNextMaxBackoff = v
+	return prev
+}
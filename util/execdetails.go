@@ -71,14 +71,35 @@ type CommitDetails struct {
 		sync.Mutex
 		CommitBackoffTime int64
 		BackoffTypes      []string
+		// CommitBatchNum is the number of the batches committed before the commit returns, including the failed
+		// ones. The batches of the secondaries committed in the background aren't counted, they're reported to the
+		// secondaries callback of the transaction instead.
+		CommitBatchNum int32
+		// CommitFailedBatchNum is the number of the counted batches that failed to commit.
+		CommitFailedBatchNum int32
+		// SlowestCommitRegion is the ID of the region whose batch took the longest time to commit.
+		SlowestCommitRegion uint64
+		// SlowestCommitTime is the time taken by the batch of SlowestCommitRegion.
+		SlowestCommitTime time.Duration
 	}
 	ResolveLockTime   int64
 	WriteKeys         int
 	WriteSize         int
 	PrewriteRegionNum int32
 	TxnRetry          int
+	// CommitProtocol is the protocol finally used to commit the transaction, see CommitProtocol2PC, etc.
+	CommitProtocol string
+	// PrimaryKey is the primary key selected to commit the transaction.
+	PrimaryKey []byte
 }
 
+// The protocols used to commit transactions.
+const (
+	CommitProtocol2PC         = "2pc"
+	CommitProtocolAsyncCommit = "async_commit"
+	CommitProtocol1PC         = "1pc"
+)
+
 // Merge merges commit details into itself.
 func (cd *CommitDetails) Merge(other *CommitDetails) {
 	cd.GetCommitTsTime += other.GetCommitTsTime
@@ -91,8 +112,20 @@ func (cd *CommitDetails) Merge(other *CommitDetails) {
 	cd.WriteSize += other.WriteSize
 	cd.PrewriteRegionNum += other.PrewriteRegionNum
 	cd.TxnRetry += other.TxnRetry
+	if other.CommitProtocol != "" {
+		cd.CommitProtocol = other.CommitProtocol
+	}
+	if other.PrimaryKey != nil {
+		cd.PrimaryKey = other.PrimaryKey
+	}
 	cd.Mu.CommitBackoffTime += other.Mu.CommitBackoffTime
 	cd.Mu.BackoffTypes = append(cd.Mu.BackoffTypes, other.Mu.BackoffTypes...)
+	cd.Mu.CommitBatchNum += other.Mu.CommitBatchNum
+	cd.Mu.CommitFailedBatchNum += other.Mu.CommitFailedBatchNum
+	if other.Mu.SlowestCommitTime > cd.Mu.SlowestCommitTime {
+		cd.Mu.SlowestCommitRegion = other.Mu.SlowestCommitRegion
+		cd.Mu.SlowestCommitTime = other.Mu.SlowestCommitTime
+	}
 }
 
 // Clone returns a deep copy of itself.
@@ -108,9 +141,15 @@ func (cd *CommitDetails) Clone() *CommitDetails {
 		WriteSize:              cd.WriteSize,
 		PrewriteRegionNum:      cd.PrewriteRegionNum,
 		TxnRetry:               cd.TxnRetry,
+		CommitProtocol:         cd.CommitProtocol,
+		PrimaryKey:             append([]byte(nil), cd.PrimaryKey...),
 	}
 	commit.Mu.BackoffTypes = append([]string{}, cd.Mu.BackoffTypes...)
 	commit.Mu.CommitBackoffTime = cd.Mu.CommitBackoffTime
+	commit.Mu.CommitBatchNum = cd.Mu.CommitBatchNum
+	commit.Mu.CommitFailedBatchNum = cd.Mu.CommitFailedBatchNum
+	commit.Mu.SlowestCommitRegion = cd.Mu.SlowestCommitRegion
+	commit.Mu.SlowestCommitTime = cd.Mu.SlowestCommitTime
 	return commit
 }
 